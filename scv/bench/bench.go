@@ -0,0 +1,156 @@
+/*
+Package bench measures an SCV under load: the latencies of every endpoint
+called by fake cores and managers, grouped by route, and the throughput of
+frames. Unlike the Multiplex test of the manager, requests go through HTTP to
+a running SCV, so the numbers include the router, the middlewares and Mongo.
+*/
+package bench
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Prefixes of the routes taking the id of a stream, optionally followed by a file.
+var STREAM_ROUTES = []string{
+	"/streams/info/", "/streams/download/", "/streams/start/", "/streams/stop/",
+	"/streams/quarantine/", "/streams/release/", "/streams/delete/",
+	"/streams/undelete/", "/streams/tags/", "/streams/meta/", "/streams/sync/",
+	"/streams/verify/", "/streams/history/", "/streams/lineage/", "/streams/export/",
+	"/streams/truncate/", "/streams/errors/",
+}
+
+/*
+Returns the route a request was sent to, eg. GET /streams/info/{stream_id},
+so that requests to different streams are reported together. The query is
+dropped.
+*/
+func Endpoint(method, path string) string {
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	for _, prefix := range STREAM_ROUTES {
+		if strings.HasPrefix(path, prefix) {
+			rest := strings.TrimPrefix(path, prefix)
+			path = prefix + "{stream_id}"
+			if i := strings.Index(rest, "/"); i >= 0 {
+				path += "/{file}"
+			}
+			break
+		}
+	}
+	if strings.HasPrefix(path, "/targets/") {
+		parts := strings.SplitN(path, "/", 4)
+		if len(parts) == 4 {
+			path = "/targets/{target_id}/" + parts[3]
+		}
+	}
+	return method + " " + path
+}
+
+type samples struct {
+	latencies []time.Duration
+	errors    int // replies with a 4xx or 5xx, or no reply at all
+}
+
+// Latencies of the requests made during a run, safe for concurrent use.
+type Recorder struct {
+	sync.Mutex
+	endpoints map[string]*samples
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{endpoints: make(map[string]*samples)}
+}
+
+// Record a request, with the signature of client.Client.Observe.
+func (r *Recorder) Observe(method, path string, status int, elapsed time.Duration) {
+	endpoint := Endpoint(method, path)
+	r.Lock()
+	defer r.Unlock()
+	s, ok := r.endpoints[endpoint]
+	if ok == false {
+		s = &samples{}
+		r.endpoints[endpoint] = s
+	}
+	s.latencies = append(s.latencies, elapsed)
+	if status == 0 || status >= 400 {
+		s.errors += 1
+	}
+}
+
+// Returns the p-th percentile of sorted latencies, using the nearest rank.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// Summary of the requests made to one endpoint.
+type EndpointStats struct {
+	Endpoint string
+	Requests int
+	Errors   int
+	P50      time.Duration
+	P95      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+// Returns the stats of every endpoint, sorted by endpoint.
+func (r *Recorder) Stats() []EndpointStats {
+	r.Lock()
+	defer r.Unlock()
+	stats := make([]EndpointStats, 0, len(r.endpoints))
+	for endpoint, s := range r.endpoints {
+		sorted := make([]time.Duration, len(s.latencies))
+		copy(sorted, s.latencies)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		stats = append(stats, EndpointStats{
+			Endpoint: endpoint,
+			Requests: len(sorted),
+			Errors:   s.errors,
+			P50:      percentile(sorted, 50),
+			P95:      percentile(sorted, 95),
+			P99:      percentile(sorted, 99),
+			Max:      percentile(sorted, 100),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Endpoint < stats[j].Endpoint })
+	return stats
+}
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.1f", float64(d)/float64(time.Millisecond))
+}
+
+// Write the table of latencies per endpoint, followed by the throughput of
+// frames and bytes over the elapsed time.
+func (r *Recorder) Report(w io.Writer, elapsed time.Duration, frames, bytes int64) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "endpoint\trequests\terrors\tp50 ms\tp95 ms\tp99 ms\tmax ms\t")
+	for _, s := range r.Stats() {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t\n",
+			s.Endpoint, s.Requests, s.Errors, ms(s.P50), ms(s.P95), ms(s.P99), ms(s.Max))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	seconds := elapsed.Seconds()
+	_, err := fmt.Fprintf(w, "%d frames in %.1fs: %.1f frames/s, %.2f MB/s\n",
+		frames, seconds, float64(frames)/seconds, float64(bytes)/seconds/1e6)
+	return err
+}
@@ -0,0 +1,54 @@
+package bench
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEndpoint(t *testing.T) {
+	assert.Equal(t, Endpoint("GET", "/streams/info/abc"), "GET /streams/info/{stream_id}")
+	assert.Equal(t, Endpoint("GET", "/streams/sync/abc?manifest=true"), "GET /streams/sync/{stream_id}")
+	assert.Equal(t, Endpoint("GET", "/streams/download/abc/0/frames.xtc"), "GET /streams/download/{stream_id}/{file}")
+	assert.Equal(t, Endpoint("GET", "/targets/t1/stats"), "GET /targets/{target_id}/stats")
+	assert.Equal(t, Endpoint("PUT", "/core/frame"), "PUT /core/frame")
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	assert.Equal(t, percentile(sorted, 50), 50*time.Millisecond)
+	assert.Equal(t, percentile(sorted, 95), 95*time.Millisecond)
+	assert.Equal(t, percentile(sorted, 99), 99*time.Millisecond)
+	assert.Equal(t, percentile(sorted, 100), 100*time.Millisecond)
+	assert.Equal(t, percentile(sorted[:1], 99), time.Millisecond)
+	assert.Equal(t, percentile(nil, 50), time.Duration(0))
+}
+
+func TestReport(t *testing.T) {
+	r := NewRecorder()
+	for i := 1; i <= 10; i++ {
+		r.Observe("PUT", "/core/frame", 200, time.Duration(i)*time.Millisecond)
+	}
+	r.Observe("GET", "/streams/info/a", 200, time.Millisecond)
+	r.Observe("GET", "/streams/info/b", 404, 3*time.Millisecond)
+	r.Observe("GET", "/streams/info/c", 0, 2*time.Millisecond)
+
+	stats := r.Stats()
+	assert.Equal(t, len(stats), 2)
+	assert.Equal(t, stats[0], EndpointStats{"GET /streams/info/{stream_id}", 3, 2,
+		2 * time.Millisecond, 3 * time.Millisecond, 3 * time.Millisecond, 3 * time.Millisecond})
+	assert.Equal(t, stats[1].Requests, 10)
+	assert.Equal(t, stats[1].P50, 5*time.Millisecond)
+
+	var buf bytes.Buffer
+	assert.Nil(t, r.Report(&buf, 2*time.Second, 10, 4e6))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, len(lines), 4)
+	assert.True(t, strings.HasPrefix(lines[2], "PUT /core/frame"))
+	assert.Equal(t, lines[3], "10 frames in 2.0s: 5.0 frames/s, 2.00 MB/s")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	".."
+	"../../client"
+	"../../fakecore"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Runs fake cores and managers against an SCV for a while, then reports the
+// latencies of every endpoint and the throughput of frames.
+func main() {
+	config := fakecore.Config{}
+	flag.StringVar(&config.AssignURL, "assign", "", "/assign url of the SCV, or /core/assign url of a CC")
+	flag.StringVar(&config.EngineKey, "key", "", "engine key")
+	flag.StringVar(&config.DonorToken, "donor", "", "donor token (optional)")
+	flag.StringVar(&config.TargetId, "target", "", "target to request (optional)")
+	flag.DurationVar(&config.FrameInterval, "interval", time.Second, "time between frames of a core")
+	flag.IntVar(&config.CheckpointFrames, "checkpoint", 10, "frames between checkpoints")
+	flag.DurationVar(&config.HeartbeatInterval, "heartbeat", time.Minute, "time between heartbeats")
+	flag.IntVar(&config.FrameBytes, "bytes", 4096, "size of each frame")
+	flag.IntVar(&config.Frames, "frames", 100, "frames per session")
+	var cores = flag.Int("cores", 10, "number of concurrent cores")
+	var host = flag.String("scv", "", "url of the SCV polled by the managers, eg. https://vspg11.stanford.edu:8080")
+	var token = flag.String("token", "", "manager token")
+	var managers = flag.Int("managers", 0, "number of concurrent managers")
+	var think = flag.Duration("think", time.Second, "time between two polls of a manager")
+	var download = flag.Bool("download", false, "managers also download the frames of the streams they poll")
+	var duration = flag.Duration("duration", time.Minute, "length of the run")
+	flag.Parse()
+	if config.AssignURL == "" || config.EngineKey == "" || (*managers > 0 && (*host == "" || *token == "")) {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	recorder := bench.NewRecorder()
+	config.Observe = recorder.Observe
+	finish := make(chan struct{})
+	var wg sync.WaitGroup
+	running := make([]*fakecore.Core, *cores)
+	for i := range running {
+		running[i] = fakecore.New(config)
+		wg.Add(1)
+		go func(core *fakecore.Core) {
+			defer wg.Done()
+			for {
+				if err := core.Run(); err != nil {
+					log.Println("Session failed:", err)
+					time.Sleep(config.FrameInterval)
+				}
+				select {
+				case <-finish:
+					return
+				default:
+				}
+			}
+		}(running[i])
+	}
+	for i := 0; i < *managers; i++ {
+		c := client.New(*host, *token)
+		c.Observe = recorder.Observe
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bench.RunManager(c, *think, *download, finish)
+		}()
+	}
+
+	began := time.Now()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-time.After(*duration):
+	case <-interrupt:
+	}
+	close(finish)
+	for _, core := range running {
+		core.Stop()
+	}
+	wg.Wait()
+
+	var frames, bytes int64
+	for _, core := range running {
+		s := core.Stats()
+		frames += s.Frames
+		bytes += s.Bytes
+	}
+	log.Printf("%d cores and %d managers", *cores, *managers)
+	if err := recorder.Report(os.Stdout, time.Since(began), frames, bytes); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,47 @@
+package bench
+
+import (
+	"../client"
+	"math/rand"
+	"time"
+)
+
+/*
+Simulates a manager polling the SCV until finish is closed: it lists the
+active streams, then gets the info and the partitions of one of them, and
+downloads its frames if download is set. The client's Observe records the
+latencies, errors are only counted.
+*/
+func RunManager(c *client.Client, think time.Duration, download bool, finish <-chan struct{}) {
+	for {
+		select {
+		case <-finish:
+			return
+		case <-time.After(think):
+		}
+		active, err := c.ActiveStreams()
+		if err != nil {
+			continue
+		}
+		ids := make([]string, 0)
+		for _, streams := range active {
+			for id := range streams {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		streamId := ids[rand.Intn(len(ids))]
+		if _, err := c.Get("/streams/info/" + streamId); err != nil {
+			continue
+		}
+		sync, err := c.Sync(streamId, false)
+		if err != nil || download == false {
+			continue
+		}
+		for _, file := range sync.FrameFiles {
+			c.Download(streamId, file)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"../src"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -13,10 +12,8 @@ import (
 
 func main() {
 	runtime.GOMAXPROCS(2 * runtime.NumCPU())
-	conf := scv.Configuration{
-		SSL: make(map[string]string),
-	}
 	var configFile = flag.String("config", "", "configuration file for the SCV")
+	var skipFrameVerify = flag.Bool("skip-frame-verify", false, "trust the frame counts in Mongo at startup")
 	flag.Parse()
 	fmt.Println(*configFile)
 	config := ""
@@ -27,12 +24,14 @@ func main() {
 		config = *configFile
 	}
 	log.Println("Config file: ", config)
-	file, err := os.Open(config)
+	conf, err := scv.LoadConfiguration(config)
 	if err != nil {
-		panic("Could not open config file.")
+		panic("Could not load config file: " + err.Error())
+	}
+	if *skipFrameVerify {
+		conf.SkipFrameVerify = true
 	}
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&conf)
 	app := scv.NewApplication(conf)
+	app.ConfigPath = config
 	app.Run()
 }
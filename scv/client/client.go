@@ -0,0 +1,595 @@
+/*
+Package client wraps the HTTP API of an SCV, so that cores and tools do not
+have to build requests by hand. A Client is bound to one SCV and one token:
+a manager's token for the stream methods, the SCV's password for
+ActivateStream, or the token of an activated stream for the core methods.
+
+Requests that fail because of the network, a 5xx other than 507 (SCV full)
+or a 429 are retried with an exponential backoff. POSTs are not idempotent, eg.
+a retried POST /streams creates a second stream, so they are only retried after
+a 429, which the SCV replies before handling the request. The request bodies
+and replies are the types declared by the SCV in messages.go.
+*/
+package client
+
+import (
+	"../src"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attempts made after the first one, and the delay before the first retry.
+// The delay doubles after each attempt.
+const DEFAULT_RETRIES int = 3
+const DEFAULT_BACKOFF time.Duration = time.Second
+
+type Client struct {
+	Host    string // eg. https://vspg11.stanford.edu:8080
+	Token   string // sent in the Authorization header
+	HTTP    *http.Client
+	Retries int
+	Backoff time.Duration
+
+	// Called after each attempt of a request, eg. to record latencies. The
+	// status is 0 if no reply was received.
+	Observe func(method, path string, status int, elapsed time.Duration)
+}
+
+func New(host, token string) *Client {
+	return &Client{
+		Host:    strings.TrimRight(host, "/"),
+		Token:   token,
+		HTTP:    &http.Client{Timeout: 5 * time.Minute},
+		Retries: DEFAULT_RETRIES,
+		Backoff: DEFAULT_BACKOFF,
+	}
+}
+
+// Returns a copy of the client using another token, eg. the one returned by
+// ActivateStream.
+func (c *Client) WithToken(token string) *Client {
+	clone := *c
+	clone.Token = token
+	return &clone
+}
+
+// An error replied by the SCV.
+type Error struct {
+	Status int
+	scv.ErrorReply
+}
+
+func (e *Error) Error() string {
+	return strconv.Itoa(e.Status) + " " + e.Code + ": " + e.Message
+}
+
+// Returns the status of the error replied by the SCV, or 0 if err was not
+// replied by the SCV.
+func Status(err error) int {
+	if e, ok := err.(*Error); ok {
+		return e.Status
+	}
+	return 0
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// A full SCV stays full until an operator frees space, so 507 is not retried.
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		(status >= 500 && status != http.StatusInsufficientStorage)
+}
+
+// Returns true if sending a request twice has the same effect as sending it
+// once, so that it may be retried whatever happened to the first attempt.
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// Read an error reply. SCVs that predate the JSON envelope reply with the
+// message as plain text.
+func readError(resp *http.Response, body []byte) error {
+	e := &Error{Status: resp.StatusCode}
+	if json.Unmarshal(body, &e.ErrorReply) != nil || e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	return e
+}
+
+/*
+Send a request, retrying it if it could not be sent or if the SCV was
+unavailable. Requests that are not idempotent are only retried if the SCV
+refused them with a 429. Every attempt carries the same X-Request-ID, so that the SCV logs
+the retries of a request under one id. Returns the body of a 2xx or 304 reply.
+*/
+func (c *Client) do(method, p string, body []byte, header http.Header) (*http.Response, []byte, error) {
+	requestId := newRequestId()
+	backoff := c.Backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var resp *http.Response
+		var data []byte
+		resp, data, err = c.send(method, p, body, header, requestId)
+		if err == nil {
+			if resp.StatusCode < 300 || resp.StatusCode == http.StatusNotModified {
+				return resp, data, nil
+			}
+			err = readError(resp, data)
+			if retryable(resp.StatusCode) == false {
+				return resp, data, err
+			}
+		}
+		if attempt >= c.Retries {
+			return resp, data, err
+		}
+		if idempotent(method) == false && (resp == nil || resp.StatusCode != http.StatusTooManyRequests) {
+			return resp, data, err
+		}
+		wait := backoff
+		if resp != nil {
+			if seconds, e := strconv.Atoi(resp.Header.Get("Retry-After")); e == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+		}
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+func (c *Client) send(method, p string, body []byte, header http.Header, requestId string) (*http.Response, []byte, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	} else {
+		reader = bytes.NewReader([]byte{})
+	}
+	req, err := http.NewRequest(method, c.Host+p, reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", c.Token)
+	}
+	req.Header.Set("X-Request-ID", requestId)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	began := time.Now()
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		c.observe(method, p, 0, began)
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.observe(method, p, 0, began)
+		return nil, nil, err
+	}
+	c.observe(method, p, resp.StatusCode, began)
+	return resp, data, nil
+}
+
+func (c *Client) observe(method, p string, status int, began time.Time) {
+	if c.Observe != nil {
+		c.Observe(method, p, status, time.Since(began))
+	}
+}
+
+// Send a JSON body and decode the JSON reply into reply, unless it is nil.
+func (c *Client) doJSON(method, p string, msg, reply interface{}) error {
+	var body []byte
+	if msg != nil {
+		var err error
+		if body, err = json.Marshal(msg); err != nil {
+			return err
+		}
+	}
+	_, data, err := c.do(method, p, body, nil)
+	if err != nil || reply == nil {
+		return err
+	}
+	return json.Unmarshal(data, reply)
+}
+
+func contentMD5(body []byte) http.Header {
+	h := md5.Sum(body)
+	return http.Header{"Content-Md5": []string{hex.EncodeToString(h[:])}}
+}
+
+// Encode a file for a request body. Files are compressed first if compress is
+// set. The name the SCV decodes the file as is name, with .gz.b64 or .b64
+// appended.
+func EncodeFile(name string, data []byte, compress bool) (string, string, error) {
+	if compress {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return "", "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", "", err
+		}
+		return name + ".gz.b64", base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+	}
+	return name + ".b64", base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Decode a file whose name ends in .b64 or .gz.b64, as sent by /core/start.
+// Returns the name without these extensions. Other files are returned as is.
+func DecodeFile(name, content string) (string, []byte, error) {
+	if strings.HasSuffix(name, ".b64") == false {
+		return name, []byte(content), nil
+	}
+	name = strings.TrimSuffix(name, ".b64")
+	data, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return "", nil, err
+	}
+	if strings.HasSuffix(name, ".gz") {
+		name = strings.TrimSuffix(name, ".gz")
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", nil, err
+		}
+		defer reader.Close()
+		if data, err = ioutil.ReadAll(reader); err != nil {
+			return "", nil, err
+		}
+	}
+	return name, data, nil
+}
+
+// Add a stream. The files and tags must already be encoded, see EncodeFile.
+// Requires a manager's token.
+func (c *Client) PostStream(msg scv.PostStreamRequest) (string, error) {
+	reply := scv.PostStreamReply{}
+	err := c.doJSON("POST", "/streams", msg, &reply)
+	return reply.StreamId, err
+}
+
+// Activate a stream and return the core's token. Requires the SCV's password,
+// as the CC does.
+func (c *Client) ActivateStream(msg scv.ActivateRequest) (string, error) {
+	reply := scv.ActivateReply{}
+	err := c.doJSON("POST", "/streams/activate", msg, &reply)
+	return reply.Token, err
+}
+
+// Assign a stream to a core, with the engine key as the client's token. The
+// path is /assign on an SCV, or /core/assign on a CC.
+func (c *Client) Assign(path string, msg scv.AssignRequest) (scv.AssignReply, error) {
+	reply := scv.AssignReply{}
+	err := c.doJSON("POST", path, msg, &reply)
+	return reply, err
+}
+
+// Get the files and options of the activated stream. The reply is checked
+// against its Content-MD5. Requires the core's token.
+func (c *Client) CoreStart() (scv.CoreStartReply, error) {
+	reply := scv.CoreStartReply{}
+	resp, data, err := c.do("GET", "/core/start", nil, http.Header{"Accept-Encoding": []string{"gzip"}})
+	if err != nil {
+		return reply, err
+	}
+	h := md5.Sum(data)
+	if expected := resp.Header.Get("Content-MD5"); expected != "" && expected != hex.EncodeToString(h[:]) {
+		return reply, errors.New("MD5 mismatch in /core/start reply")
+	}
+	// the transport only decompresses replies it asked for itself
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return reply, err
+		}
+		defer reader.Close()
+		if data, err = ioutil.ReadAll(reader); err != nil {
+			return reply, err
+		}
+	}
+	err = json.Unmarshal(data, &reply)
+	return reply, err
+}
+
+/*
+Append a frame of the activated stream. The files are compressed and base64
+encoded, the SCV stores them decoded under their names. If the frame was
+received but the reply was lost, the retry is refused as a duplicate, which
+is treated as a success.
+*/
+func (c *Client) PostFrame(files map[string][]byte, frames int) error {
+	msg := scv.FrameRequest{Files: make(map[string]string), Frames: frames}
+	for name, data := range files {
+		encodedName, encoded, err := EncodeFile(name, data, true)
+		if err != nil {
+			return err
+		}
+		msg.Files[encodedName] = encoded
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do("PUT", "/core/frame", body, contentMD5(body))
+	if Status(err) == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+// Write a checkpoint of the activated stream. The files are stored as given,
+// and are usually encoded with EncodeFile. If frames is negative, the SCV
+// credits the number of buffered frames.
+func (c *Client) PostCheckpoint(files map[string]string, frames float64) error {
+	msg := scv.CheckpointRequest{Files: files}
+	if frames >= 0 {
+		msg.Frames = &frames
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do("PUT", "/core/checkpoint", body, contentMD5(body))
+	return err
+}
+
+// Upload log files of the activated stream's core. The files are compressed
+// and base64 encoded, the SCV stores them gzipped.
+func (c *Client) PostLogs(files map[string][]byte) error {
+	msg := scv.LogRequest{Files: make(map[string]string)}
+	for name, data := range files {
+		encodedName, encoded, err := EncodeFile(name, data, true)
+		if err != nil {
+			return err
+		}
+		msg.Files[encodedName] = encoded
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.do("PUT", "/core/logs", body, contentMD5(body))
+	return err
+}
+
+// Keep the activated stream from expiring.
+func (c *Client) Heartbeat() error {
+	_, _, err := c.do("POST", "/core/heartbeat", nil, nil)
+	return err
+}
+
+// Keep the activated stream from expiring for up to seconds, 0 for as long as
+// the SCV allows, while the core is paused.
+func (c *Client) Pause(seconds int) (scv.CorePauseReply, error) {
+	reply := scv.CorePauseReply{}
+	err := c.doJSON("POST", "/core/pause", scv.CorePauseRequest{Duration: seconds}, &reply)
+	return reply, err
+}
+
+// End the pause of the activated stream.
+func (c *Client) Resume() error {
+	_, _, err := c.do("POST", "/core/resume", nil, nil)
+	return err
+}
+
+// Deactivate the stream. A non-empty message reports that the core failed.
+func (c *Client) CoreStop(message string) error {
+	msg := scv.CoreStopRequest{}
+	if message != "" {
+		msg.Error = base64.StdEncoding.EncodeToString([]byte(message))
+	}
+	return c.doJSON("PUT", "/core/stop", msg, nil)
+}
+
+// Download a file of a stream. Frame files are the concatenation of every
+// partition. Requires a manager's token.
+func (c *Client) Download(streamId, file string) ([]byte, error) {
+	_, data, err := c.do("GET", "/streams/download/"+streamId+"/"+file, nil, nil)
+	return data, err
+}
+
+// Download the copy of a file stored in a partition.
+func (c *Client) DownloadPartition(streamId, file string, partition int) ([]byte, error) {
+	p := "/streams/download/" + streamId + "/" + file + "?partition=" + strconv.Itoa(partition)
+	_, data, err := c.do("GET", p, nil, nil)
+	return data, err
+}
+
+// List the partitions and files of a stream, with the manifest of each
+// partition if manifest is set. Requires a manager's token.
+func (c *Client) Sync(streamId string, manifest bool) (scv.SyncReply, error) {
+	reply := scv.SyncReply{}
+	p := "/streams/sync/" + streamId
+	if manifest {
+		p += "?manifest=true"
+	}
+	err := c.doJSON("GET", p, nil, &reply)
+	return reply, err
+}
+
+// List the progress of the active streams, keyed by target then stream.
+func (c *Client) ActiveStreams() (map[string]map[string]scv.ActiveStreamInfo, error) {
+	reply := make(map[string]map[string]scv.ActiveStreamInfo)
+	err := c.doJSON("GET", "/active_streams", nil, &reply)
+	return reply, err
+}
+
+// List the streams activated and deactivated since the version of a previous
+// delta, or every active stream if since is 0 or the delta is a Reset.
+func (c *Client) ActiveStreamsSince(since uint64) (scv.ActiveStreamsDelta, error) {
+	reply := scv.ActiveStreamsDelta{}
+	err := c.doJSON("GET", "/active_streams?since="+strconv.FormatUint(since, 10), nil, &reply)
+	return reply, err
+}
+
+// Send a GET request to a route without a dedicated method, eg.
+// /streams/info/{stream_id}, and return the body of the reply.
+func (c *Client) Get(p string) ([]byte, error) {
+	_, data, err := c.do("GET", p, nil, nil)
+	return data, err
+}
+
+// List the streams of a target, by state. Requires a manager's token.
+func (c *Client) TargetStreams(targetId string) (scv.TargetStreamsReply, error) {
+	reply := scv.TargetStreamsReply{}
+	err := c.doJSON("GET", "/targets/"+targetId+"/streams", nil, &reply)
+	return reply, err
+}
+
+// List the SCVs holding streams of a target, to send requests to each of
+// them. Requires a manager's token.
+func (c *Client) TargetShards(targetId string) ([]scv.Shard, error) {
+	reply := struct {
+		Shards []scv.Shard `json:"shards"`
+	}{}
+	err := c.doJSON("GET", "/targets/"+targetId+"/shards", nil, &reply)
+	return reply.Shards, err
+}
+
+// Make a stream eligible for activation again. Requires a manager's token.
+func (c *Client) EnableStream(streamId string) error {
+	_, _, err := c.do("PUT", "/streams/start/"+streamId, nil, nil)
+	return err
+}
+
+// Keep a stream from being activated, stopping it if it is active.
+func (c *Client) DisableStream(streamId string) error {
+	_, _, err := c.do("PUT", "/streams/stop/"+streamId, nil, nil)
+	return err
+}
+
+// Delete a stream. Its files are kept until the retention period of the SCV
+// ends.
+func (c *Client) DeleteStream(streamId string) error {
+	_, _, err := c.do("PUT", "/streams/delete/"+streamId, nil, nil)
+	return err
+}
+
+// Discard the partitions of a stream after frames. Returns the checkpoint the
+// stream now restarts from.
+func (c *Client) Truncate(streamId string, frames int) (scv.RestartPoint, error) {
+	reply := scv.RestartPoint{}
+	msg := map[string]int{"frames": frames}
+	err := c.doJSON("PUT", "/streams/truncate/"+streamId, msg, &reply)
+	return reply, err
+}
+
+// Recompute the checksums of a stream. Returns the number of checkpoints
+// checked and those whose files are missing or corrupted.
+func (c *Client) Verify(streamId string) (int, []scv.Corruption, error) {
+	reply := struct {
+		Checked   int              `json:"checked"`
+		Corrupted []scv.Corruption `json:"corrupted"`
+	}{}
+	err := c.doJSON("GET", "/streams/verify/"+streamId, nil, &reply)
+	return reply.Checked, reply.Corrupted, err
+}
+
+// Stop activating streams, or activate them again if drain is false. Requires
+// the SCV's password.
+func (c *Client) Drain(drain bool) (scv.DrainReply, error) {
+	reply := scv.DrainReply{}
+	method := "POST"
+	if drain == false {
+		method = "DELETE"
+	}
+	err := c.doJSON(method, "/admin/drain", nil, &reply)
+	return reply, err
+}
+
+/*
+Send a GET request whose reply is read as it arrives, without retrying it
+nor timing it out. The caller must close the body of the reply. Used for
+tarballs and event streams, which may be large or never end.
+*/
+func (c *Client) open(p string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.Host+p, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", c.Token)
+	}
+	req.Header.Set("X-Request-ID", newRequestId())
+	h := *c.HTTP
+	h.Timeout = 0
+	resp, err := h.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, readError(resp, body)
+	}
+	return resp, nil
+}
+
+// Write the tarball of a stream, see /streams/export. Requires a manager's
+// token.
+func (c *Client) Export(streamId string, w io.Writer) error {
+	resp, err := c.open("/streams/export/" + streamId)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+/*
+Follow the events of the manager's streams, restricted to the given targets
+unless none are given, and call fn with each of them. Returns when fn returns
+an error, or the SCV closes the connection, in which case the error is nil.
+*/
+func (c *Client) Events(targetIds []string, fn func(scv.Event) error) error {
+	p := "/events"
+	if len(targetIds) > 0 {
+		p += "?" + url.Values{"target_id": targetIds}.Encode()
+	}
+	resp, err := c.open(p)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data: ") == false {
+			continue
+		}
+		e := scv.Event{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,164 @@
+package client
+
+import (
+	"../src"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeFile(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		name, encoded, err := EncodeFile("frames.xtc", []byte("12345"), compress)
+		assert.Nil(t, err)
+		name, data, err := DecodeFile(name, encoded)
+		assert.Nil(t, err)
+		assert.Equal(t, name, "frames.xtc")
+		assert.Equal(t, data, []byte("12345"))
+	}
+	name, data, err := DecodeFile("log.txt", "abc")
+	assert.Nil(t, err)
+	assert.Equal(t, name, "log.txt")
+	assert.Equal(t, data, []byte("abc"))
+}
+
+func TestCoreProtocol(t *testing.T) {
+	failures := 1
+	frames := make([]scv.FrameRequest, 0)
+	requestIds := make([]string, 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/core/frame", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.Header.Get("Authorization"), "core_token")
+		requestIds = append(requestIds, r.Header.Get("X-Request-ID"))
+		body, _ := ioutil.ReadAll(r.Body)
+		h := md5.Sum(body)
+		assert.Equal(t, r.Header.Get("Content-MD5"), hex.EncodeToString(h[:]))
+		msg := scv.FrameRequest{}
+		json.Unmarshal(body, &msg)
+		frames = append(frames, msg)
+		if failures > 0 {
+			// received, but the reply is lost
+			failures -= 1
+			w.WriteHeader(503)
+			return
+		}
+		w.WriteHeader(409)
+		w.Write([]byte(`{"code": "conflict", "message": "POSTed same frame twice"}`))
+	})
+	mux.HandleFunc("/core/start", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := json.Marshal(scv.CoreStartReply{StreamId: "s1", Files: map[string]string{"state.xml": "abc"}})
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		h := md5.Sum(buf.Bytes())
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-MD5", hex.EncodeToString(h[:]))
+		w.Write(buf.Bytes())
+	})
+	mux.HandleFunc("/core/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(401)
+		w.Write([]byte(`{"code": "unauthorized", "message": "invalid token", "request_id": "1"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c := New(server.URL, "manager_token").WithToken("core_token")
+	c.Backoff = time.Millisecond
+	observed := make([]string, 0)
+	c.Observe = func(method, path string, status int, elapsed time.Duration) {
+		observed = append(observed, method+" "+path+" "+strconv.Itoa(status))
+	}
+	start, err := c.CoreStart()
+	assert.Nil(t, err)
+	assert.Equal(t, start.StreamId, "s1")
+	assert.Equal(t, start.Files["state.xml"], "abc")
+
+	assert.Nil(t, c.PostFrame(map[string][]byte{"frames.xtc": []byte("12345")}, 1))
+	assert.Equal(t, len(frames), 2)
+	assert.Equal(t, requestIds[0], requestIds[1])
+	assert.Equal(t, observed, []string{"GET /core/start 200", "PUT /core/frame 503", "PUT /core/frame 409"})
+	name, data, err := DecodeFile("frames.xtc.gz.b64", frames[0].Files["frames.xtc.gz.b64"])
+	assert.Nil(t, err)
+	assert.Equal(t, name, "frames.xtc")
+	assert.Equal(t, data, []byte("12345"))
+
+	// client errors are not retried
+	err = c.Heartbeat()
+	assert.Equal(t, Status(err), 401)
+	assert.Equal(t, err.(*Error).Message, "invalid token")
+}
+
+func TestPostRetries(t *testing.T) {
+	statuses := []int{}
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[attempts]
+		attempts += 1
+		w.WriteHeader(status)
+		if status == 200 {
+			w.Write([]byte(`{"stream_id": "s1"}`))
+		}
+	}))
+	defer server.Close()
+	c := New(server.URL, "manager_token")
+	c.Backoff = time.Millisecond
+
+	// the stream may have been created before the 503
+	statuses = []int{503, 200}
+	_, err := c.PostStream(scv.PostStreamRequest{TargetId: "t1"})
+	assert.Equal(t, Status(err), 503)
+	assert.Equal(t, attempts, 1)
+
+	// but not before a 429
+	statuses, attempts = []int{429, 200}, 0
+	streamId, err := c.PostStream(scv.PostStreamRequest{TargetId: "t1"})
+	assert.Nil(t, err)
+	assert.Equal(t, streamId, "s1")
+	assert.Equal(t, attempts, 2)
+}
+
+func TestEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/events":
+			assert.Equal(t, r.URL.Query()["target_id"], []string{"t1", "t2"})
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte(": keepalive\n\n"))
+			w.Write([]byte("event: frame\ndata: {\"type\": \"frame\", \"stream_id\": \"s1\", \"target_id\": \"t1\"}\n\n"))
+			w.Write([]byte("event: deleted\ndata: {\"type\": \"deleted\", \"stream_id\": \"s2\", \"target_id\": \"t2\"}\n\n"))
+		case "/streams/export/s1":
+			w.Write([]byte("tarball"))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`{"code": "not_found", "message": "Stream does not exist"}`))
+		}
+	}))
+	defer server.Close()
+	c := New(server.URL, "manager_token")
+
+	events := make([]string, 0)
+	err := c.Events([]string{"t1", "t2"}, func(e scv.Event) error {
+		events = append(events, e.Type+" "+e.StreamId)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, events, []string{"frame s1", "deleted s2"})
+
+	var buf bytes.Buffer
+	assert.Nil(t, c.Export("s1", &buf))
+	assert.Equal(t, buf.String(), "tarball")
+	err = c.Export("s3", &buf)
+	assert.Equal(t, Status(err), 404)
+	assert.Equal(t, err.Error(), "404 not_found: Stream does not exist")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	".."
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Runs cores concurrently, each starting a new session when the previous one
+// ends, and reports their throughput.
+func main() {
+	config := fakecore.Config{}
+	flag.StringVar(&config.AssignURL, "assign", "", "/core/assign url of a CC, or /assign url of an SCV")
+	flag.StringVar(&config.EngineKey, "key", "", "engine key")
+	flag.StringVar(&config.EngineVersion, "version", "", "engine version (optional)")
+	flag.StringVar(&config.DonorToken, "donor", "", "donor token (optional)")
+	flag.StringVar(&config.TargetId, "target", "", "target to request (optional)")
+	flag.DurationVar(&config.FrameInterval, "interval", time.Second, "time between frames")
+	flag.IntVar(&config.CheckpointFrames, "checkpoint", 10, "frames between checkpoints")
+	flag.DurationVar(&config.HeartbeatInterval, "heartbeat", time.Minute, "time between heartbeats")
+	flag.IntVar(&config.FrameBytes, "bytes", 4096, "size of each frame")
+	flag.IntVar(&config.Frames, "frames", 100, "frames per session, 0 for a single endless session")
+	var cores = flag.Int("cores", 1, "number of concurrent cores")
+	var duration = flag.Duration("duration", 0, "stop after this long, 0 to run until interrupted")
+	var report = flag.Duration("report", 10*time.Second, "time between reports")
+	flag.Parse()
+	if config.AssignURL == "" || config.EngineKey == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	finish := make(chan struct{})
+	var wg sync.WaitGroup
+	running := make([]*fakecore.Core, *cores)
+	for i := range running {
+		running[i] = fakecore.New(config)
+		wg.Add(1)
+		go func(core *fakecore.Core) {
+			defer wg.Done()
+			for {
+				if err := core.Run(); err != nil {
+					log.Println("Session failed:", err)
+					time.Sleep(config.FrameInterval)
+				}
+				select {
+				case <-finish:
+					return
+				default:
+				}
+			}
+		}(running[i])
+	}
+
+	total := func() fakecore.Stats {
+		sum := fakecore.Stats{}
+		for _, core := range running {
+			s := core.Stats()
+			sum.Sessions += s.Sessions
+			sum.Frames += s.Frames
+			sum.Checkpoints += s.Checkpoints
+			sum.Heartbeats += s.Heartbeats
+			sum.Bytes += s.Bytes
+			sum.Errors += s.Errors
+		}
+		return sum
+	}
+	began := time.Now()
+	summary := func() {
+		s := total()
+		seconds := time.Since(began).Seconds()
+		log.Printf("%d cores: %d sessions, %d frames (%.1f/s), %d checkpoints, %.2f MB/s, %d errors",
+			*cores, s.Sessions, s.Frames, float64(s.Frames)/seconds, s.Checkpoints,
+			float64(s.Bytes)/seconds/1e6, s.Errors)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	var timeout <-chan time.Time
+	if *duration > 0 {
+		timeout = time.After(*duration)
+	}
+	ticker := time.NewTicker(*report)
+	defer ticker.Stop()
+	for done := false; done == false; {
+		select {
+		case <-ticker.C:
+			summary()
+		case <-interrupt:
+			done = true
+		case <-timeout:
+			done = true
+		}
+	}
+	close(finish)
+	for _, core := range running {
+		core.Stop()
+	}
+	wg.Wait()
+	summary()
+}
@@ -0,0 +1,230 @@
+/*
+Package fakecore simulates a core, for integration tests and to generate load
+when planning the capacity of an SCV. A Core is assigned a stream through the
+same path as a real core, /core/assign of a CC or /assign of an SCV, pulls
+/core/start, then posts synthetic frames and checkpoints at a fixed rate and
+sends heartbeats until it stops.
+*/
+package fakecore
+
+import (
+	"../client"
+	"../src"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Config struct {
+	AssignURL     string // eg. https://cc.proteneer.com/core/assign
+	EngineKey     string
+	EngineVersion string // optional, checked against min_engine_version
+	DonorToken    string // optional
+	TargetId      string // optional
+
+	FrameInterval     time.Duration // between two frames
+	CheckpointFrames  int           // frames between two checkpoints
+	HeartbeatInterval time.Duration
+	FrameBytes        int // size of the synthetic frames.xtc of each frame
+	Frames            int // frames posted before stopping, 0 to run until Stop is called
+
+	// Called after each request, see client.Client.
+	Observe func(method, path string, status int, elapsed time.Duration)
+}
+
+func (c Config) withDefaults() Config {
+	if c.FrameInterval <= 0 {
+		c.FrameInterval = time.Second
+	}
+	if c.CheckpointFrames <= 0 {
+		c.CheckpointFrames = 10
+	}
+	if c.HeartbeatInterval <= 0 {
+		c.HeartbeatInterval = time.Minute
+	}
+	if c.FrameBytes < 4 {
+		c.FrameBytes = 4096
+	}
+	return c
+}
+
+// Counters of a core, safe to read while it runs.
+type Stats struct {
+	Sessions    int64
+	Frames      int64
+	Checkpoints int64
+	Heartbeats  int64
+	Bytes       int64 // sent in frames and checkpoints
+	Errors      int64
+}
+
+type Core struct {
+	config Config
+	stats  Stats
+	finish chan struct{}
+}
+
+func New(config Config) *Core {
+	return &Core{
+		config: config.withDefaults(),
+		finish: make(chan struct{}),
+	}
+}
+
+// Makes Run return after the current frame. Must be called at most once.
+func (c *Core) Stop() {
+	close(c.finish)
+}
+
+func (c *Core) Stats() Stats {
+	return Stats{
+		Sessions:    atomic.LoadInt64(&c.stats.Sessions),
+		Frames:      atomic.LoadInt64(&c.stats.Frames),
+		Checkpoints: atomic.LoadInt64(&c.stats.Checkpoints),
+		Heartbeats:  atomic.LoadInt64(&c.stats.Heartbeats),
+		Bytes:       atomic.LoadInt64(&c.stats.Bytes),
+		Errors:      atomic.LoadInt64(&c.stats.Errors),
+	}
+}
+
+func (c *Core) fail(err error) error {
+	atomic.AddInt64(&c.stats.Errors, 1)
+	return err
+}
+
+// A frames.xtc that passes the xtc validator: the XTC magic number followed by
+// random bytes.
+func syntheticFrame(size int) []byte {
+	frame := make([]byte, size)
+	rand.Read(frame[4:])
+	binary.BigEndian.PutUint32(frame, scv.XTC_MAGIC)
+	return frame
+}
+
+// Splits the /core/start URL returned by an assignment into the host of the
+// SCV and the path.
+func coreHost(startURL string) (string, error) {
+	u, err := url.Parse(startURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" || strings.HasSuffix(u.Path, "/core/start") == false {
+		return "", errors.New("bad /core/start url: " + startURL)
+	}
+	return u.Scheme + "://" + u.Host + strings.TrimSuffix(u.Path, "/core/start"), nil
+}
+
+// Get a stream assigned and the client of its SCV, bound to the core's token.
+func (c *Core) assign() (*client.Client, error) {
+	u, err := url.Parse(c.config.AssignURL)
+	if err != nil {
+		return nil, err
+	}
+	cc := client.New(u.Scheme+"://"+u.Host, c.config.EngineKey)
+	cc.Observe = c.config.Observe
+	reply, err := cc.Assign(u.Path, scv.AssignRequest{
+		DonorToken:    c.config.DonorToken,
+		TargetId:      c.config.TargetId,
+		EngineVersion: c.config.EngineVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+	host, err := coreHost(reply.URL)
+	if err != nil {
+		return nil, err
+	}
+	core := cc.WithToken(reply.Token)
+	core.Host = host
+	return core, nil
+}
+
+/*
+Run one session: get a stream assigned, start it, and post frames until
+Config.Frames frames were posted or Stop is called. A checkpoint is written
+every CheckpointFrames frames and before stopping, unless no frame was posted
+since the last one. If the session fails, the stream is stopped with the
+error, as a real core would.
+*/
+func (c *Core) Run() error {
+	core, err := c.assign()
+	if err != nil {
+		return c.fail(err)
+	}
+	atomic.AddInt64(&c.stats.Sessions, 1)
+	err = c.session(core)
+	message := ""
+	if err != nil {
+		message = err.Error()
+		c.fail(err)
+	}
+	if e := core.CoreStop(message); e != nil && err == nil {
+		err = c.fail(e)
+	}
+	return err
+}
+
+func (c *Core) session(core *client.Client) error {
+	start, err := core.CoreStart()
+	if err != nil {
+		return err
+	}
+	stepsPerFrame := 1
+	if steps, ok := start.Options["steps_per_frame"].(float64); ok && steps > 0 {
+		stepsPerFrame = int(steps)
+	}
+	frames := time.NewTicker(c.config.FrameInterval)
+	defer frames.Stop()
+	heartbeats := time.NewTicker(c.config.HeartbeatInterval)
+	defer heartbeats.Stop()
+	posted, buffered := 0, 0
+	for c.config.Frames == 0 || posted < c.config.Frames {
+		select {
+		case <-c.finish:
+			return c.checkpoint(core, &buffered, posted*stepsPerFrame)
+		case <-heartbeats.C:
+			if err := core.Heartbeat(); err != nil {
+				return err
+			}
+			atomic.AddInt64(&c.stats.Heartbeats, 1)
+			continue
+		case <-frames.C:
+		}
+		frame := syntheticFrame(c.config.FrameBytes)
+		if err := core.PostFrame(map[string][]byte{"frames.xtc": frame}, 1); err != nil {
+			return err
+		}
+		posted += 1
+		buffered += 1
+		atomic.AddInt64(&c.stats.Frames, 1)
+		atomic.AddInt64(&c.stats.Bytes, int64(len(frame)))
+		if buffered >= c.config.CheckpointFrames {
+			if err := c.checkpoint(core, &buffered, posted*stepsPerFrame); err != nil {
+				return err
+			}
+		}
+	}
+	return c.checkpoint(core, &buffered, posted*stepsPerFrame)
+}
+
+func (c *Core) checkpoint(core *client.Client, buffered *int, step int) error {
+	if *buffered == 0 {
+		return nil
+	}
+	name, state, err := client.EncodeFile("state.xml", []byte(`<State step="`+strconv.Itoa(step)+`"/>`), true)
+	if err != nil {
+		return err
+	}
+	if err := core.PostCheckpoint(map[string]string{name: state}, float64(*buffered)); err != nil {
+		return err
+	}
+	*buffered = 0
+	atomic.AddInt64(&c.stats.Checkpoints, 1)
+	atomic.AddInt64(&c.stats.Bytes, int64(len(state)))
+	return nil
+}
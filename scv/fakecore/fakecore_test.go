@@ -0,0 +1,109 @@
+package fakecore
+
+import (
+	"../client"
+	"../src"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// An SCV serving one stream, recording what the core sent.
+type fakeSCV struct {
+	sync.Mutex
+	frames      [][]byte
+	checkpoints []float64
+	stopped     string
+}
+
+func (f *fakeSCV) handler(t *testing.T) http.Handler {
+	mux := http.NewServeMux()
+	var server string
+	mux.HandleFunc("/assign", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, r.Header.Get("Authorization"), "engine_key")
+		server = "http://" + r.Host
+		json.NewEncoder(w).Encode(scv.AssignReply{Token: "core_token", URL: server + "/core/start"})
+	})
+	mux.HandleFunc("/core/start", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(scv.CoreStartReply{StreamId: "s1", Options: map[string]interface{}{"steps_per_frame": 100}})
+	})
+	mux.HandleFunc("/core/frame", func(w http.ResponseWriter, r *http.Request) {
+		msg := scv.FrameRequest{}
+		json.NewDecoder(r.Body).Decode(&msg)
+		_, data, err := client.DecodeFile("frames.xtc.gz.b64", msg.Files["frames.xtc.gz.b64"])
+		assert.Nil(t, err)
+		f.Lock()
+		f.frames = append(f.frames, data)
+		f.Unlock()
+	})
+	mux.HandleFunc("/core/checkpoint", func(w http.ResponseWriter, r *http.Request) {
+		msg := scv.CheckpointRequest{}
+		json.NewDecoder(r.Body).Decode(&msg)
+		_, state, err := client.DecodeFile("state.xml.gz.b64", msg.Files["state.xml.gz.b64"])
+		assert.Nil(t, err)
+		assert.Contains(t, string(state), "step=")
+		f.Lock()
+		f.checkpoints = append(f.checkpoints, *msg.Frames)
+		f.Unlock()
+	})
+	mux.HandleFunc("/core/heartbeat", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/core/stop", func(w http.ResponseWriter, r *http.Request) {
+		msg := scv.CoreStopRequest{}
+		json.NewDecoder(r.Body).Decode(&msg)
+		f.Lock()
+		f.stopped = "stopped:" + msg.Error
+		f.Unlock()
+	})
+	return mux
+}
+
+func TestFakeCore(t *testing.T) {
+	f := &fakeSCV{}
+	server := httptest.NewServer(f.handler(t))
+	defer server.Close()
+	core := New(Config{
+		AssignURL:         server.URL + "/assign",
+		EngineKey:         "engine_key",
+		FrameInterval:     time.Millisecond,
+		CheckpointFrames:  2,
+		HeartbeatInterval: time.Hour,
+		FrameBytes:        64,
+		Frames:            5,
+	})
+	assert.Nil(t, core.Run())
+	assert.Equal(t, len(f.frames), 5)
+	assert.Equal(t, len(f.frames[0]), 64)
+	assert.Equal(t, binary.BigEndian.Uint32(f.frames[0]), scv.XTC_MAGIC)
+	// the last frame is checkpointed before stopping
+	assert.Equal(t, f.checkpoints, []float64{2, 2, 1})
+	assert.Equal(t, f.stopped, "stopped:")
+	stats := core.Stats()
+	assert.Equal(t, stats.Sessions, int64(1))
+	assert.Equal(t, stats.Frames, int64(5))
+	assert.Equal(t, stats.Checkpoints, int64(3))
+	assert.Equal(t, stats.Errors, int64(0))
+
+	// Stop ends an endless session
+	f.frames = nil
+	core = New(Config{AssignURL: server.URL + "/assign", EngineKey: "engine_key", FrameInterval: time.Millisecond})
+	done := make(chan error)
+	go func() { done <- core.Run() }()
+	time.Sleep(50 * time.Millisecond)
+	core.Stop()
+	assert.Nil(t, <-done)
+	assert.True(t, core.Stats().Frames > 0)
+}
+
+func TestCoreHost(t *testing.T) {
+	host, err := coreHost("https://vspg11.stanford.edu:8080/core/start")
+	assert.Nil(t, err)
+	assert.Equal(t, host, "https://vspg11.stanford.edu:8080")
+	_, err = coreHost("vspg11/core/start")
+	assert.NotNil(t, err)
+}
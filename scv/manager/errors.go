@@ -0,0 +1,50 @@
+package manager
+
+import (
+	"net/http"
+)
+
+// An error of the Manager that tells which HTTP status a server should reply
+// with, eg. ErrNotFound when a stream does not exist. Programs compare them
+// against the errors below with errors.Is, or against the errors of
+// ActivateStream.
+type StatusError struct {
+	Status  int
+	Code    string
+	Message string
+	Details map[string]string // replied along with the message, may be nil
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// Returns an error with the status, code and details of e and the given
+// message.
+func (e *StatusError) With(message string) error {
+	return &StatusError{e.Status, e.Code, message, e.Details}
+}
+
+// Like With, but also sets the details replied, for clients that act on more
+// than the code.
+func (e *StatusError) WithDetails(message string, details map[string]string) error {
+	return &StatusError{e.Status, e.Code, message, details}
+}
+
+// The token does not belong to an active stream.
+var ErrUnauthorized = &StatusError{http.StatusUnauthorized, "unauthorized", "Unauthorized", nil}
+
+// The user does not own the stream.
+var ErrForbidden = &StatusError{http.StatusForbidden, "forbidden", "Forbidden", nil}
+
+// The stream or target does not exist.
+var ErrNotFound = &StatusError{http.StatusNotFound, "not_found", "not found", nil}
+
+// The stream is not in a state that allows the change, eg. it is quarantined.
+var ErrConflict = &StatusError{http.StatusConflict, "conflict", "Conflict", nil}
+
+// The donor or the target already has as many active streams as it may.
+var ErrTooManyRequests = &StatusError{http.StatusTooManyRequests, "too_many_requests", "Too many requests", nil}
+
+// The target is paused.
+var ErrUnavailable = &StatusError{http.StatusServiceUnavailable, "unavailable", "Service unavailable", nil}
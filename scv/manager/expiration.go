@@ -0,0 +1,146 @@
+package manager
+
+import (
+	"container/heap"
+	"time"
+)
+
+/*
+A session that expires, or a cool-down that ends, at a deadline. Instead of a
+timer per stream, the Manager keeps them in a single queue scanned by
+expireLoop. Heartbeats only refresh the lastHeartbeat of their session, and
+the deadline of a session is pushed back when it is reached, so that sessions
+that keep beating do not touch the queue more than once per expiration time.
+*/
+type expiration struct {
+	deadline time.Time
+	stream   *Stream
+	token    string // of the session that expires, empty for the end of a cool-down
+	index    int    // in the queue, -1 once out of it
+}
+
+// A heap of expirations, soonest first.
+type expirationQueue []*expiration
+
+func (q expirationQueue) Len() int           { return len(q) }
+func (q expirationQueue) Less(i, j int) bool { return q[i].deadline.Before(q[j].deadline) }
+
+func (q expirationQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expirationQueue) Push(x interface{}) {
+	e := x.(*expiration)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *expirationQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	e.index = -1
+	return e
+}
+
+// Queue an expiration, starting expireLoop if it is not running. Assumes that
+// the manager is locked.
+func (m *Manager) schedule(e *expiration) {
+	heap.Push(&m.expirations, e)
+	if m.expiring == false {
+		m.expiring = true
+		go m.expireLoop()
+	} else if e.index == 0 {
+		// expireLoop is waiting for a later deadline
+		select {
+		case m.wakeExpiry <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Remove an expiration from the queue, if it is still in it. Assumes that the
+// manager is locked.
+func (m *Manager) unschedule(e *expiration) {
+	if e != nil && e.index >= 0 {
+		heap.Remove(&m.expirations, e.index)
+	}
+}
+
+// Bring forward the deadline of an expiration still in the queue, waking
+// expireLoop if it becomes the soonest. Later deadlines are left to expire,
+// which queues them again. Assumes that the manager is locked.
+func (m *Manager) advance(e *expiration, deadline time.Time) {
+	if e == nil || e.index < 0 || deadline.Before(e.deadline) == false {
+		return
+	}
+	e.deadline = deadline
+	heap.Fix(&m.expirations, e.index)
+	if e.index == 0 {
+		select {
+		case m.wakeExpiry <- struct{}{}:
+		default:
+		}
+	}
+}
+
+/*
+Pop the expirations whose deadline is past: cool-downs that ended are ended,
+and sessions that went without a heartbeat for their timeout are deactivated
+like by DeactivateStream without an error. Sessions that were reset meanwhile
+are queued again for their new deadline. Assumes that the manager is locked.
+*/
+func (m *Manager) expire(now time.Time) {
+	for len(m.expirations) > 0 && m.expirations[0].deadline.After(now) == false {
+		e := heap.Pop(&m.expirations).(*expiration)
+		stream := e.stream
+		stream.Lock()
+		// the stream may have been removed, deactivated, disabled or released meanwhile
+		t, ok := m.targets[stream.TargetId]
+		switch {
+		case ok == false || stream.removed:
+		case e.token == "":
+			if _, cooling := t.coolingStreams[stream]; cooling && stream.cooldown == e {
+				stream.cooldown = nil
+				m.stateTransfer(stream, t.coolingStreams, t.inactiveStreams)
+			}
+		case stream.activeToken(e.token):
+			if deadline := stream.ActiveStream.Expires(); deadline.After(now) {
+				e.deadline = deadline
+				heap.Push(&m.expirations, e)
+			} else {
+				m.deactivateStreamImpl(stream, t)
+				if stream.ErrorCount >= MAX_STREAM_FAILS {
+					m.disableStreamImpl(stream, t)
+				}
+			}
+		}
+		stream.Unlock()
+	}
+}
+
+// Expire the sessions and end the cool-downs of the queue as they become due.
+// Runs while the queue is not empty, see schedule.
+func (m *Manager) expireLoop() {
+	for {
+		m.Lock()
+		now := time.Now()
+		m.expire(now)
+		if len(m.expirations) == 0 {
+			m.expiring = false
+			m.Unlock()
+			return
+		}
+		wait := m.expirations[0].deadline.Sub(now)
+		m.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-m.wakeExpiry:
+		}
+		timer.Stop()
+	}
+}
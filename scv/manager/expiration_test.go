@@ -0,0 +1,86 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpirationQueue(t *testing.T) {
+	m := NewManagerWithOptions(&ManagerCallbacks{}, ManagerOptions{ExpirationTime: 1, CooldownTime: 1})
+	now := int(time.Now().Unix())
+	for _, streamId := range []string{"a", "b"} {
+		m.AddStream(NewStream(streamId, "target", "none", 0, 0, now), "target", true)
+	}
+	queued := func() (int, bool) {
+		m.RLock()
+		defer m.RUnlock()
+		return len(m.expirations), m.expiring
+	}
+
+	// sessions that ended leave the queue
+	token, _, err := m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	count, _ := queued()
+	assert.Equal(t, count, 1)
+	assert.Nil(t, m.DeactivateStream(token, 0))
+	count, _ = queued()
+	assert.Equal(t, count, 0)
+
+	// heartbeats push the expiration back
+	token, streamId, err := m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	time.Sleep(600 * time.Millisecond)
+	assert.Nil(t, m.ResetActiveStream(token))
+	time.Sleep(600 * time.Millisecond)
+	active, _, _ := m.TargetStreams("target")
+	assert.Equal(t, active, []string{streamId})
+	time.Sleep(1500 * time.Millisecond)
+	active, _, _ = m.TargetStreams("target")
+	assert.Equal(t, active, []string{})
+	assert.NotNil(t, m.ResetActiveStream(token))
+
+	// cool-downs end, after which the loop stops
+	token, _, err = m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Nil(t, m.DeactivateStream(token, 1))
+	assert.Equal(t, m.State().Timers, map[string]int{"expiration": 0, "cooldown": 1})
+	time.Sleep(1500 * time.Millisecond)
+	_, inactive, _ := m.TargetStreams("target")
+	assert.Equal(t, len(inactive), 2)
+	assert.Equal(t, m.State().Targets["target"].Cooling, 0)
+	count, expiring := queued()
+	assert.Equal(t, count, 0)
+	assert.False(t, expiring)
+}
+
+func TestPauseActiveStream(t *testing.T) {
+	m := NewManagerWithOptions(&ManagerCallbacks{}, ManagerOptions{ExpirationTime: 1})
+	m.AddStream(NewStream("stream", "target", "none", 0, 0, int(time.Now().Unix())), "target", true)
+	token, _, err := m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	version := m.ActiveStreamsSince(0).Version
+	until, expires, err := m.PauseActiveStream(token, 2*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, expires, until.Add(time.Second))
+
+	// the pause shows in the next delta
+	delta := m.ActiveStreamsSince(version)
+	info := delta.Activated["target"]["stream"]
+	assert.True(t, info.Paused)
+	assert.Equal(t, info.PausedUntil, int(until.Unix()))
+
+	// paused streams outlive their expiration time
+	time.Sleep(1500 * time.Millisecond)
+	active, _, _ := m.TargetStreams("target")
+	assert.Equal(t, active, []string{"stream"})
+	assert.Nil(t, m.ResumeActiveStream(token))
+	assert.False(t, m.GetActiveStreams()["target"]["stream"].Paused)
+	time.Sleep(1500 * time.Millisecond)
+	active, _, _ = m.TargetStreams("target")
+	assert.Equal(t, active, []string{})
+	_, _, err = m.PauseActiveStream(token, time.Second)
+	assert.NotNil(t, err)
+	assert.NotNil(t, m.ResumeActiveStream(token))
+}
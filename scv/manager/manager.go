@@ -0,0 +1,1229 @@
+/*
+Package manager schedules the streams of an SCV: it keeps the streams of every
+target in a queue ordered by priority, hands out the stream at the front of
+the queue to the cores that activate the target, and expires the sessions of
+cores that go silent. Streams can be disabled, quarantined and cooled down
+after their cores fail, and targets paused or capped.
+
+The Manager only keeps its state in memory. Programs persist the changes it
+makes to the streams through an Injector, and keep their own state of each
+stream and session in Stream.Data and ActiveStream.Data.
+*/
+package manager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ = fmt.Printf
+
+const MAX_STREAM_FAILS int = 50
+const STREAM_EXPIRATION_TIME int = 1200
+
+// By default, a stream is quarantined when its cores fail QUARANTINE_ERRORS
+// times within QUARANTINE_WINDOW seconds.
+const QUARANTINE_ERRORS int = 5
+const QUARANTINE_WINDOW int = 3600
+
+// By default, a stream whose core failed waits COOLDOWN_TIME seconds per error
+// in its error count before it can be activated again, and at most
+// MAX_COOLDOWN_TIME seconds.
+const COOLDOWN_TIME int = 10
+const MAX_COOLDOWN_TIME int = 1800
+
+// Maximum number of seconds an activation may wait for a stream to become idle.
+// Well below the LONG_REQUEST_TIMEOUT of /streams/activate and the server's
+// WriteTimeout, so that an activation that waited in vain can still reply.
+const MAX_ACTIVATION_WAIT int = 50
+
+// Maximum number of seconds a donor may pause an active stream for, see
+// PauseActiveStream.
+const MAX_PAUSE_TIME int = 8 * 3600
+
+// Activations and deactivations the Manager remembers for ActiveStreamsSince.
+// Clients that fall further behind get every active stream again.
+const ACTIVATION_LOG_SIZE int = 65536
+
+// Errors of ActivateStream, which callers may compare against to tell why no
+// stream was activated.
+var ErrNoTarget = ErrNotFound.With("Target does not exist")
+var ErrNoStreams = errors.New("Target does not have streams")
+var ErrDonorLimit = ErrTooManyRequests.With("Donor has too many active streams")
+var ErrTargetPaused = ErrUnavailable.With("Target is paused")
+var ErrTargetAtCapacity = ErrTooManyRequests.With("Target is at capacity")
+
+/*
+Persists the state changes of the Manager's streams. Each method is called
+with the stream locked for writing, and DeactivateStreamService with the
+manager locked too, so they need to finish fast and must not call back into
+the Manager. The change is made whatever they return. ManagerCallbacks is an
+Injector made of functions.
+*/
+type Injector interface {
+	DeactivateStreamService(*Stream) error // the stream's session ended, it may have been disabled or quarantined
+	DisableStreamService(*Stream) error    // an inactive stream was disabled or quarantined, see Stream.MongoStatus
+	EnableStreamService(*Stream) error     // a disabled or quarantined stream was enabled
+}
+
+// An Injector made of functions, any of which may be nil.
+type ManagerCallbacks struct {
+	Deactivated func(*Stream) error
+	Disabled    func(*Stream) error
+	Enabled     func(*Stream) error
+}
+
+func (c *ManagerCallbacks) DeactivateStreamService(s *Stream) error {
+	if c.Deactivated == nil {
+		return nil
+	}
+	return c.Deactivated(s)
+}
+
+func (c *ManagerCallbacks) DisableStreamService(s *Stream) error {
+	if c.Disabled == nil {
+		return nil
+	}
+	return c.Disabled(s)
+}
+
+func (c *ManagerCallbacks) EnableStreamService(s *Stream) error {
+	if c.Enabled == nil {
+		return nil
+	}
+	return c.Enabled(s)
+}
+
+// The settings of a Manager, which can also be changed later by its setters.
+type ManagerOptions struct {
+	ExpirationTime   int      // seconds an active stream may go without a heartbeat, 0 for STREAM_EXPIRATION_TIME
+	QuarantineErrors int      // failures within QUARANTINE_WINDOW before a stream is quarantined, 0 to never quarantine
+	CooldownTime     int      // seconds of cool-down per error of a failed stream, 0 to reactivate it immediately
+	DonorLimit       int      // active streams a donor may have, 0 for no limit
+	TrustedDonors    []string // donors exempt from DonorLimit
+}
+
+// The mutex in Manager makes guarantees about the state of the system:
+// 1. If the mutex (read or write) can be acquired, then there is no other concurrent operation that could affect stream creation, deletion, activation, or deactivation, target creation and deletion.
+// 2. If you acquire a read lock, you still need to lock individual targets and streams when modifying them (eg. when posting frames).
+// 3. Note that the stream or target may already have been removed by another operation, so it is important that you check the return value of anything you retrieve from the maps for existence. For example, it is possible that one goroutine is trying to deactivate the stream, while another goroutine is trying to post a frame. Both goroutines may be trying to acquire the lock at the same time. If the write goroutine acquires it first, then this means the read goroutine must verify the existence of the active stream through the token.
+// 4. A target exists in the target map if and only if one or more of its streams exists in the streams map.
+// 5. The streams and tokens maps are only changed with the mutex locked for writing, but they are sharded maps that can be read without it. ReadStream, ModifyStream and ModifyActiveStream look streams up without the mutex, so that frames and heartbeats waiting for a busy stream do not hold up activations of other streams. Once they hold the stream's lock, they check that the stream was not removed or deactivated meanwhile.
+type Manager struct {
+	sync.RWMutex
+	targets        map[string]*Target // map of targetId to Target
+	streams        *streamMap         // map of streamId to Stream
+	tokens         *streamMap         // map of tokens to Stream
+	injector       Injector
+	expirationTime int
+
+	quarantineErrors int // failures within QUARANTINE_WINDOW before quarantine, 0 to never quarantine
+	cooldownTime     int // seconds of cool-down per error of a failed stream, 0 to reactivate it immediately
+
+	donorStreams  map[string]int      // active streams of each donor
+	donorLimit    int                 // active streams a donor may have, 0 for no limit
+	trustedDonors map[string]struct{} // donors exempt from donorLimit
+
+	waiters map[string][]chan struct{} // activations waiting for an idle stream, keyed by targetId
+
+	agingRates    map[string]float64 // aging rate of each target, see Target.priority
+	pausedTargets map[string]bool    // targets whose streams are not activated
+	maxActive     map[string]int     // streams each target may have active at once, absent for no limit
+
+	version     uint64             // number of activations, deactivations, pauses and resumes so far
+	activations []activationChange // the last of them, oldest first, see ActiveStreamsSince
+
+	expirations expirationQueue // sessions expiring and cool-downs ending, soonest first
+	expiring    bool            // set while expireLoop runs
+	wakeExpiry  chan struct{}   // tells expireLoop that an earlier deadline was queued
+}
+
+// An activation or deactivation of a stream, see Manager.version. Pauses and
+// resumes are recorded as activations.
+type activationChange struct {
+	version  uint64
+	targetId string
+	streamId string
+	active   bool
+}
+
+// Returns a Manager with the default ManagerOptions.
+func NewManager(inj Injector) *Manager {
+	return NewManagerWithOptions(inj, ManagerOptions{})
+}
+
+func NewManagerWithOptions(inj Injector, options ManagerOptions) *Manager {
+	if options.ExpirationTime <= 0 {
+		options.ExpirationTime = STREAM_EXPIRATION_TIME
+	}
+	m := Manager{
+		targets:          make(map[string]*Target),
+		streams:          newStreamMap(),
+		tokens:           newStreamMap(),
+		injector:         inj,
+		expirationTime:   options.ExpirationTime,
+		quarantineErrors: options.QuarantineErrors,
+		cooldownTime:     options.CooldownTime,
+		waiters:          make(map[string][]chan struct{}),
+		donorStreams:     make(map[string]int),
+		agingRates:       make(map[string]float64),
+		pausedTargets:    make(map[string]bool),
+		maxActive:        make(map[string]int),
+		wakeExpiry:       make(chan struct{}, 1),
+	}
+	m.SetDonorLimit(options.DonorLimit, options.TrustedDonors)
+	return &m
+}
+
+/*
+Tokens of a session embed the epoch of the stream's activation, so that calls
+of a core whose session already ended are refused even if they got hold of the
+stream before it was deactivated, see Stream.activeToken.
+*/
+func createToken(epoch int) string {
+	secret := make([]byte, 18)
+	if _, err := rand.Read(secret); err != nil {
+		panic("FATAL createToken(), crypto/rand failed: " + err.Error())
+	}
+	return strconv.Itoa(epoch) + ":" + hex.EncodeToString(secret)
+}
+
+// Returns the epoch embedded in token, and false if it has none.
+func parseToken(token string) (int, bool) {
+	result := strings.SplitN(token, ":", 2)
+	if len(result) < 2 {
+		return 0, false
+	}
+	epoch, err := strconv.Atoi(result[0])
+	return epoch, err == nil
+}
+
+/*
+Add a stream to the manager. If the stream exists, then nothing happens. Otherwise, if the target does not exist, a target
+is created for this stream. It is assumed that the respective persistent structures (dbs, files) for this
+stream has already been created and ready to go. It is assumed that while AddStream is called, no other goroutine is manipulating
+this particular stream pointer.
+*/
+func (m *Manager) AddStream(stream *Stream, targetId string, enabled bool) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.streams.get(stream.StreamId) != nil {
+		return ErrConflict.With("stream " + stream.StreamId + " already exists")
+	}
+	m.streams.set(stream.StreamId, stream)
+	_, ok := m.targets[targetId]
+	if ok == false {
+		m.targets[targetId] = NewTarget(m.agingRates[targetId])
+	}
+	t := m.targets[targetId]
+	if enabled {
+		stream.queueFrames = stream.Frames
+		t.inactiveStreams.Add(stream)
+		m.wakeWaiter(targetId)
+	} else {
+		t.disabledStreams[stream] = struct{}{}
+	}
+	return nil
+}
+
+/*
+Remove a stream from the manager. The stream is immediately removed from memory.
+However, its data (including files and what not) still persist on disk. It is up
+to the caller to take care of subsequent cleanup (if any). Returns true if target was removed.
+*/
+func (m *Manager) RemoveStream(streamId, user string) error {
+	m.Lock()
+	defer m.Unlock()
+	stream := m.streams.get(streamId)
+	if stream == nil {
+		return ErrNotFound.With("stream " + streamId + " does not exist")
+	}
+	if user != stream.Owner {
+		return ErrForbidden.With(user + " does not own stream " + streamId)
+	}
+	t := m.targets[stream.TargetId]
+	stream.Lock()
+	defer stream.Unlock()
+	m.streams.delete(streamId)
+	stream.removed = true
+	if stream.ActiveStream != nil {
+		m.deactivateStreamImpl(stream, t)
+	}
+	// this is no longer a state transfer but a complete deletion
+	t.inactiveStreams.Remove(stream)
+	delete(t.disabledStreams, stream)
+	if _, ok := t.coolingStreams[stream]; ok {
+		m.unschedule(stream.cooldown)
+		stream.cooldown = nil
+		delete(t.coolingStreams, stream)
+	}
+	if len(t.activeStreams) == 0 && t.inactiveStreams.Len() == 0 && len(t.disabledStreams) == 0 && len(t.coolingStreams) == 0 {
+		delete(m.targets, stream.TargetId)
+	}
+	return nil
+}
+
+func (m *Manager) stateTransfer(s *Stream, src interface{}, dst interface{}) {
+
+	// invariant:
+
+	a := m.targets[s.TargetId].inactiveStreams.Contains(s)
+	_, b := m.targets[s.TargetId].activeStreams[s]
+	_, c := m.targets[s.TargetId].disabledStreams[s]
+	_, d := m.targets[s.TargetId].coolingStreams[s]
+
+	// ensure that the stream must be in exactly one of these states
+	states := 0
+	for _, in := range []bool{a, b, c, d} {
+		if in {
+			states += 1
+		}
+	}
+	if states != 1 {
+		panic(fmt.Sprintf("stream state machine failed! a:%v, b:%v, c:%v, d:%v", a, b, c, d))
+	}
+
+	switch v := src.(type) {
+	case map[*Stream]struct{}:
+		delete(v, s)
+	case *Set:
+		v.Remove(s)
+	}
+	switch w := dst.(type) {
+	case map[*Stream]struct{}:
+		w[s] = struct{}{}
+	case *Set:
+		s.queueFrames = s.Frames
+		w.Add(s)
+		m.wakeWaiter(s.TargetId)
+	}
+}
+
+// Wake the activation that has waited the longest for an idle stream of the
+// target. Assumes that the manager is locked.
+func (m *Manager) wakeWaiter(targetId string) {
+	queue := m.waiters[targetId]
+	if len(queue) == 0 {
+		return
+	}
+	queue[0] <- struct{}{}
+	if len(queue) == 1 {
+		delete(m.waiters, targetId)
+	} else {
+		m.waiters[targetId] = queue[1:]
+	}
+}
+
+// Queue a waiter for an idle stream of the target. The returned channel
+// receives a value once a stream may be available.
+func (m *Manager) addWaiter(targetId string) chan struct{} {
+	m.Lock()
+	defer m.Unlock()
+	ch := make(chan struct{}, 1)
+	if t, ok := m.targets[targetId]; ok && t.inactiveStreams.Len() > 0 && m.atCapacity(targetId, t) == false {
+		// a stream became idle since the activation failed
+		ch <- struct{}{}
+		return ch
+	}
+	m.waiters[targetId] = append(m.waiters[targetId], ch)
+	return ch
+}
+
+// Remove a waiter from the queue. Returns false if it was already woken.
+func (m *Manager) removeWaiter(targetId string, ch chan struct{}) bool {
+	m.Lock()
+	defer m.Unlock()
+	queue := m.waiters[targetId]
+	for i, waiter := range queue {
+		if waiter == ch {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			if len(queue) == 0 {
+				delete(m.waiters, targetId)
+			} else {
+				m.waiters[targetId] = queue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the stream from the active queue. Assumes that locks are in place for target and stream.
+// If this function returns true, you are expected to call the corresponding injector.DeactivateStreamService()
+func (m *Manager) deactivateStreamImpl(s *Stream, t *Target) {
+	if s.ActiveStream != nil {
+		m.tokens.delete(s.ActiveStream.AuthToken)
+		if user := s.ActiveStream.User; user != "" {
+			if m.donorStreams[user] -= 1; m.donorStreams[user] <= 0 {
+				delete(m.donorStreams, user)
+			}
+		}
+		m.unschedule(s.ActiveStream.expiry)
+		m.injector.DeactivateStreamService(s)
+		s.ActiveStream = nil
+		m.stateTransfer(s, t.activeStreams, t.inactiveStreams)
+		m.recordActivation(s, false)
+	} else {
+		log.Println("DAMN: tried to deactivate an non-active stream")
+	}
+}
+
+/*
+Keep a stream whose core just failed from being activated for a while, since
+the next core would likely fail as well: the stream is moved from
+inactiveStreams to coolingStreams for cooldownTime seconds per error in its
+error count. Assumes that locks are in place for target and stream.
+*/
+func (m *Manager) coolStreamImpl(stream *Stream, t *Target) {
+	seconds := m.cooldownTime * stream.ErrorCount
+	if seconds <= 0 {
+		return
+	}
+	if seconds > MAX_COOLDOWN_TIME {
+		seconds = MAX_COOLDOWN_TIME
+	}
+	m.stateTransfer(stream, t.inactiveStreams, t.coolingStreams)
+	stream.cooldown = &expiration{deadline: time.Now().Add(time.Duration(seconds) * time.Second), stream: stream}
+	m.schedule(stream.cooldown)
+}
+
+// Returns the set an enabled, inactive stream is in: coolingStreams while it
+// cools down, in which case the cool-down is cancelled, and inactiveStreams
+// otherwise. Assumes that locks are in place for target and stream.
+func (m *Manager) idleStreams(stream *Stream, t *Target) interface{} {
+	if _, cooling := t.coolingStreams[stream]; cooling {
+		m.unschedule(stream.cooldown)
+		stream.cooldown = nil
+		return t.coolingStreams
+	}
+	return t.inactiveStreams
+}
+
+// Disables the stream entirely. Assumes that locks are in place for target and stream.
+func (m *Manager) disableStreamImpl(stream *Stream, t *Target) {
+	_, isDisabled := t.disabledStreams[stream]
+	if isDisabled {
+		return
+	}
+	stream.MongoStatus = "disabled"
+	m.stateTransfer(stream, m.idleStreams(stream, t), t.disabledStreams)
+}
+
+// Quarantines the stream, deactivating it first if needed. Assumes that locks are in place for target and stream.
+// Returns true if the stream was active, in which case DeactivateStreamService has already recorded the status.
+func (m *Manager) quarantineStreamImpl(stream *Stream, t *Target, reason string) bool {
+	stream.MongoStatus = "quarantined"
+	stream.QuarantineReason = reason
+	isActive := (stream.ActiveStream != nil)
+	if isActive {
+		m.deactivateStreamImpl(stream, t)
+	}
+	_, isDisabled := t.disabledStreams[stream]
+	if isDisabled == false {
+		m.stateTransfer(stream, m.idleStreams(stream, t), t.disabledStreams)
+	}
+	return isActive
+}
+
+// Idempotent, does nothing if stream is already disabled. The stream service is still called!
+func (m *Manager) DisableStream(streamId, user string) error {
+	m.Lock()
+	stream := m.streams.get(streamId)
+	if stream == nil {
+		m.Unlock()
+		return ErrNotFound.With("stream " + streamId + " does not exist")
+	}
+	stream.Lock()
+	defer stream.Unlock()
+	if user != stream.Owner {
+		m.Unlock()
+		return ErrForbidden.With("you do not own this stream.")
+	}
+	t := m.targets[stream.TargetId]
+	// state transfers to inactive if the stream is active
+	isActive := (stream.ActiveStream != nil)
+	if isActive {
+		if stream.MongoStatus != "quarantined" {
+			// so that DeactivateStreamService does not record it as enabled
+			stream.MongoStatus = "disabled"
+		}
+		m.deactivateStreamImpl(stream, t)
+	}
+	// state transfer from inactive to disabled
+	m.disableStreamImpl(stream, t)
+	m.Unlock()
+	return m.injector.DisableStreamService(stream)
+}
+
+func (m *Manager) EnableStream(streamId, user string) error {
+	m.Lock()
+	stream := m.streams.get(streamId)
+	if stream == nil {
+		m.Unlock()
+		return ErrNotFound.With("stream " + streamId + " does not exist")
+	}
+	stream.Lock()
+	defer stream.Unlock()
+	if user != stream.Owner {
+		m.Unlock()
+		return ErrForbidden.With("you do not own this stream.")
+	}
+	if stream.MongoStatus == "quarantined" {
+		m.Unlock()
+		return ErrConflict.With("stream is quarantined and must be released")
+	}
+	t := m.targets[stream.TargetId]
+	_, isActive := t.activeStreams[stream]
+	_, isCooling := t.coolingStreams[stream]
+	isInactive := t.inactiveStreams.Contains(stream)
+	if isActive || isInactive || isCooling {
+		m.Unlock()
+		return m.injector.EnableStreamService(stream)
+	}
+	m.stateTransfer(stream, t.disabledStreams, t.inactiveStreams)
+	m.Unlock()
+	return m.injector.EnableStreamService(stream)
+}
+
+/*
+Quarantine a stream that is suspected of producing bad data. Like a disabled
+stream, a quarantined stream is never activated and its files are kept on
+disk, but it can only be enabled again through ReleaseStream.
+*/
+func (m *Manager) QuarantineStream(streamId, reason string) error {
+	m.Lock()
+	stream := m.streams.get(streamId)
+	if stream == nil {
+		m.Unlock()
+		return ErrNotFound.With("stream " + streamId + " does not exist")
+	}
+	stream.Lock()
+	defer stream.Unlock()
+	t := m.targets[stream.TargetId]
+	wasActive := m.quarantineStreamImpl(stream, t, reason)
+	m.Unlock()
+	if wasActive {
+		return nil
+	}
+	return m.injector.DisableStreamService(stream)
+}
+
+// Release a quarantined stream, making it eligible to be assigned again.
+func (m *Manager) ReleaseStream(streamId string) error {
+	m.Lock()
+	stream := m.streams.get(streamId)
+	if stream == nil {
+		m.Unlock()
+		return ErrNotFound.With("stream " + streamId + " does not exist")
+	}
+	stream.Lock()
+	defer stream.Unlock()
+	if stream.MongoStatus != "quarantined" {
+		m.Unlock()
+		return ErrConflict.With("stream " + streamId + " is not quarantined")
+	}
+	t := m.targets[stream.TargetId]
+	m.stateTransfer(stream, t.disabledStreams, t.inactiveStreams)
+	stream.MongoStatus = "enabled"
+	stream.QuarantineReason = ""
+	stream.recentErrors = nil
+	m.Unlock()
+	return m.injector.EnableStreamService(stream)
+}
+
+func (m *Manager) ReadStream(streamId string, fn func(*Stream) error) error {
+	stream := m.streams.get(streamId)
+	if stream == nil {
+		return ErrNotFound.With("stream " + streamId + " does not exist")
+	}
+	stream.RLock()
+	defer stream.RUnlock()
+	// the stream may have been removed while it was being locked
+	if stream.removed {
+		return ErrNotFound.With("stream " + streamId + " does not exist")
+	}
+	return fn(stream)
+}
+
+func (m *Manager) ModifyStream(streamId string, fn func(*Stream) error) error {
+	stream := m.streams.get(streamId)
+	if stream == nil {
+		return ErrNotFound.With("stream " + streamId + " does not exist")
+	}
+	stream.Lock() // Acquire a write lock
+	defer stream.Unlock()
+	if stream.removed {
+		return ErrNotFound.With("stream " + streamId + " does not exist")
+	}
+	return fn(stream)
+}
+
+// Returns a snapshot of the ids of every stream in the manager.
+func (m *Manager) StreamIds() []string {
+	streams := m.streams.snapshot()
+	result := make([]string, 0, len(streams))
+	for streamId := range streams {
+		result = append(result, streamId)
+	}
+	return result
+}
+
+// Returns the number of inactive streams of every target that has any and is
+// neither paused nor at capacity.
+func (m *Manager) IdleTargets() map[string]int {
+	m.RLock()
+	defer m.RUnlock()
+	result := make(map[string]int)
+	for targetId, t := range m.targets {
+		if t.inactiveStreams.Len() > 0 && m.pausedTargets[targetId] == false && m.atCapacity(targetId, t) == false {
+			result[targetId] = t.inactiveStreams.Len()
+		}
+	}
+	return result
+}
+
+// Returns the number of streams of every target, whatever their state.
+func (m *Manager) TargetSizes() map[string]int {
+	m.RLock()
+	defer m.RUnlock()
+	result := make(map[string]int)
+	for targetId, t := range m.targets {
+		result[targetId] = t.inactiveStreams.Len() + len(t.activeStreams) + len(t.disabledStreams) + len(t.coolingStreams)
+	}
+	return result
+}
+
+// Returns the number of active, inactive, and disabled streams. Streams
+// cooling down are inactive.
+func (m *Manager) Counts() (active, inactive, disabled int) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, t := range m.targets {
+		active += len(t.activeStreams)
+		inactive += t.inactiveStreams.Len() + len(t.coolingStreams)
+		disabled += len(t.disabledStreams)
+	}
+	return
+}
+
+// Returns the ids of the streams of a target, by state. Quarantined streams
+// are disabled, and streams cooling down are inactive.
+func (m *Manager) TargetStreams(targetId string) (active, inactive, disabled []string) {
+	active, inactive, disabled = []string{}, []string{}, []string{}
+	m.RLock()
+	defer m.RUnlock()
+	t, ok := m.targets[targetId]
+	if ok == false {
+		return
+	}
+	for s := range t.activeStreams {
+		active = append(active, s.StreamId)
+	}
+	for i := t.inactiveStreams.Iterator(); i.Next(); {
+		inactive = append(inactive, i.Key().(*Stream).StreamId)
+	}
+	cooling := []string{}
+	for s := range t.coolingStreams {
+		cooling = append(cooling, s.StreamId)
+	}
+	// cooling streams are activated last
+	sort.Strings(cooling)
+	inactive = append(inactive, cooling...)
+	for s := range t.disabledStreams {
+		disabled = append(disabled, s.StreamId)
+	}
+	sort.Strings(active)
+	sort.Strings(disabled)
+	return
+}
+
+// Returns the progress of every active stream, keyed by target then stream.
+func (m *Manager) GetActiveStreams() map[string]map[string]ActiveStreamInfo {
+	finalized := make(map[string]map[string]ActiveStreamInfo)
+	for token, stream := range m.tokens.snapshot() {
+		stream.RLock()
+		if stream.activeToken(token) {
+			if finalized[stream.TargetId] == nil {
+				finalized[stream.TargetId] = make(map[string]ActiveStreamInfo)
+			}
+			finalized[stream.TargetId][stream.StreamId] = stream.activeInfo()
+		}
+		stream.RUnlock()
+	}
+	return finalized
+}
+
+// Bump the version of the Manager for an activation or deactivation. Assumes
+// that the manager is locked.
+func (m *Manager) recordActivation(s *Stream, active bool) {
+	m.version += 1
+	if len(m.activations) >= 2*ACTIVATION_LOG_SIZE {
+		m.activations = append([]activationChange(nil), m.activations[ACTIVATION_LOG_SIZE:]...)
+	}
+	m.activations = append(m.activations, activationChange{m.version, s.TargetId, s.StreamId, active})
+}
+
+/*
+Returns the streams activated and deactivated since the given version of the
+Manager, along with the current version. If the changes since then are no
+longer known, eg. because since is 0 or the SCV restarted, the delta is a
+Reset holding every active stream. The progress of streams activated earlier
+is not included.
+*/
+func (m *Manager) ActiveStreamsSince(since uint64) ActiveStreamsDelta {
+	m.RLock()
+	delta := ActiveStreamsDelta{
+		Version:     m.version,
+		Activated:   make(map[string]map[string]ActiveStreamInfo),
+		Deactivated: make(map[string][]string),
+	}
+	oldest := m.version - uint64(len(m.activations))
+	if since == 0 || since < oldest || since > m.version {
+		m.RUnlock()
+		delta.Reset = true
+		// changes made meanwhile are sent again by the next poll
+		delta.Activated = m.GetActiveStreams()
+		return delta
+	}
+	// only the last change of each stream counts
+	last := make(map[string]activationChange)
+	for _, change := range m.activations[since-oldest:] {
+		last[change.streamId] = change
+	}
+	m.RUnlock()
+	for streamId, change := range last {
+		if change.active == false {
+			delta.Deactivated[change.targetId] = append(delta.Deactivated[change.targetId], streamId)
+			continue
+		}
+		stream := m.streams.get(streamId)
+		if stream == nil {
+			continue
+		}
+		stream.RLock()
+		// else its deactivation is in the next delta
+		if stream.ActiveStream != nil {
+			if delta.Activated[change.targetId] == nil {
+				delta.Activated[change.targetId] = make(map[string]ActiveStreamInfo)
+			}
+			delta.Activated[change.targetId][streamId] = stream.activeInfo()
+		}
+		stream.RUnlock()
+	}
+	for _, streamIds := range delta.Deactivated {
+		sort.Strings(streamIds)
+	}
+	return delta
+}
+
+// Returns true if token was handed to the core of an active stream. The stream
+// is not locked, so it may be deactivated by the time the token is used.
+func (m *Manager) IsActiveToken(token string) bool {
+	return m.tokens.get(token) != nil
+}
+
+// Returns ErrUnauthorized unless token belongs to the current session of an
+// active stream, eg. to refuse an upload before reading its body.
+func (m *Manager) CheckActiveToken(token string) error {
+	stream := m.tokens.get(token)
+	if stream == nil {
+		return ErrUnauthorized.With("invalid token: " + token)
+	}
+	stream.RLock()
+	defer stream.RUnlock()
+	if stream.activeToken(token) == false {
+		return ErrUnauthorized.With("invalid token: " + token)
+	}
+	return nil
+}
+
+func (m *Manager) ModifyActiveStream(token string, fn func(*Stream) error) error {
+	stream := m.tokens.get(token)
+	if stream == nil {
+		return ErrUnauthorized.With("invalid token: " + token)
+	}
+	stream.Lock()
+	defer stream.Unlock()
+	// the stream may have been deactivated while it was being locked
+	if stream.activeToken(token) == false {
+		return ErrUnauthorized.With("invalid token: " + token)
+	}
+	return fn(stream)
+}
+
+// Calls fn with every active stream, locked for writing.
+func (m *Manager) ModifyActiveStreams(fn func(*Stream)) {
+	for token, stream := range m.tokens.snapshot() {
+		stream.Lock()
+		if stream.activeToken(token) {
+			fn(stream)
+		}
+		stream.Unlock()
+	}
+}
+
+// Deactivate the active streams whose donor and engine match, without counting
+// an error, returning their ids.
+func (m *Manager) DeactivateMatching(match func(user, engine string) bool) []string {
+	matched := make(map[string]string)
+	for token, stream := range m.tokens.snapshot() {
+		stream.RLock()
+		if stream.activeToken(token) && match(stream.ActiveStream.User, stream.ActiveStream.Engine) {
+			matched[token] = stream.StreamId
+		}
+		stream.RUnlock()
+	}
+	deactivated := make([]string, 0, len(matched))
+	for token, streamId := range matched {
+		// the stream may have expired in the meantime
+		if m.DeactivateStream(token, 0) == nil {
+			deactivated = append(deactivated, streamId)
+		}
+	}
+	sort.Strings(deactivated)
+	return deactivated
+}
+
+// Returns the expiration time of streams activated or reset from now on.
+func (m *Manager) ExpirationTime() int {
+	m.RLock()
+	defer m.RUnlock()
+	return m.expirationTime
+}
+
+// Change the expiration time of streams activated or reset from now on.
+func (m *Manager) SetExpirationTime(seconds int) {
+	m.Lock()
+	defer m.Unlock()
+	m.expirationTime = seconds
+}
+
+// Limit the number of streams a donor may have active at once, except for the
+// trusted donors. 0 removes the limit. Streams activated without a user are
+// never limited. Active streams over a lowered limit keep running.
+func (m *Manager) SetDonorLimit(limit int, trusted []string) {
+	m.Lock()
+	defer m.Unlock()
+	m.donorLimit = limit
+	m.trustedDonors = make(map[string]struct{})
+	for _, user := range trusted {
+		m.trustedDonors[user] = struct{}{}
+	}
+}
+
+// Returns true if user may not activate another stream. The manager must be
+// locked.
+func (m *Manager) overDonorLimit(user string) bool {
+	if user == "" || m.donorLimit <= 0 {
+		return false
+	}
+	if _, ok := m.trustedDonors[user]; ok {
+		return false
+	}
+	return m.donorStreams[user] >= m.donorLimit
+}
+
+/*
+Pause or resume a target. The streams of a paused target are not activated,
+but its active streams keep running until their cores stop them, so that they
+end their session cleanly. Returns the number of active streams of the target.
+The state is kept for targets that do not have streams yet.
+*/
+func (m *Manager) SetPaused(targetId string, paused bool) int {
+	m.Lock()
+	defer m.Unlock()
+	if paused {
+		m.pausedTargets[targetId] = true
+	} else {
+		delete(m.pausedTargets, targetId)
+	}
+	if t, ok := m.targets[targetId]; ok {
+		return len(t.activeStreams)
+	}
+	return 0
+}
+
+// Limit the streams of a target that may be active at once, 0 for no limit.
+// Streams already active beyond the limit are left running.
+func (m *Manager) SetMaxActive(targetId string, limit int) {
+	m.Lock()
+	defer m.Unlock()
+	if limit > 0 {
+		m.maxActive[targetId] = limit
+	} else {
+		delete(m.maxActive, targetId)
+	}
+}
+
+// Returns true if the target has as many active streams as it may. Assumes
+// that the manager is locked.
+func (m *Manager) atCapacity(targetId string, t *Target) bool {
+	limit, ok := m.maxActive[targetId]
+	return ok && len(t.activeStreams) >= limit
+}
+
+func (m *Manager) Paused(targetId string) bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.pausedTargets[targetId]
+}
+
+/*
+Change the aging rate of a target, in frames of priority per hour since a
+stream's last activation, see Target.priority. The rate is kept for targets that
+do not have streams yet.
+*/
+func (m *Manager) SetAgingRate(targetId string, rate float64) {
+	m.Lock()
+	defer m.Unlock()
+	if current, ok := m.agingRates[targetId]; ok && current == rate {
+		return
+	}
+	m.agingRates[targetId] = rate
+	t, ok := m.targets[targetId]
+	if ok == false {
+		return
+	}
+	// the queue is ordered by the old rate
+	queued := make([]*Stream, 0, t.inactiveStreams.Len())
+	for i := t.inactiveStreams.Iterator(); i.Next(); {
+		queued = append(queued, i.Key().(*Stream))
+	}
+	t.agingRate = rate
+	t.inactiveStreams = NewCustomSet(t.streamComp)
+	for _, s := range queued {
+		t.inactiveStreams.Add(s)
+	}
+}
+
+// Changes applied by Manager.UpdateStreams, fields left to their zero value
+// are left untouched.
+type StreamPatch struct {
+	Priority *float64
+	Status   string // "enabled" or "disabled"
+}
+
+/*
+Patch at once the streams of a target, or of every target if targetId is empty,
+for which match returns true. The manager and the matched streams stay locked
+while commit is called with the matched streams, eg. to persist the patch and
+change other fields such as Meta, and the patch is only applied if commit
+succeeds, so that either every matched stream is updated or none is. The status
+of quarantined streams cannot be changed, they must be released first. Disabled
+streams that are enabled have their error count reset, and active streams that
+are disabled are deactivated. Returns the ids of the matched streams, in order.
+match is called with the manager locked and should not wait on the disk or the
+database.
+*/
+func (m *Manager) UpdateStreams(targetId string, match func(*Stream) bool, patch StreamPatch, commit func([]*Stream) error) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	targets := m.targets
+	if targetId != "" {
+		targets = make(map[string]*Target)
+		if t, ok := m.targets[targetId]; ok {
+			targets[targetId] = t
+		}
+	}
+	matched := make([]*Stream, 0)
+	defer func() {
+		for _, s := range matched {
+			s.Unlock()
+		}
+	}()
+	for _, t := range targets {
+		for _, s := range t.streams() {
+			s.Lock()
+			if match(s) {
+				matched = append(matched, s)
+			} else {
+				s.Unlock()
+			}
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].StreamId < matched[j].StreamId })
+	streamIds := make([]string, 0, len(matched))
+	for _, s := range matched {
+		if patch.Status != "" && s.MongoStatus == "quarantined" {
+			return nil, ErrConflict.With("stream " + s.StreamId + " is quarantined and must be released")
+		}
+		streamIds = append(streamIds, s.StreamId)
+	}
+	if err := commit(matched); err != nil {
+		return nil, err
+	}
+	for _, s := range matched {
+		t := m.targets[s.TargetId]
+		if patch.Priority != nil {
+			// the queue is ordered by the old priority
+			queued := t.inactiveStreams.Contains(s)
+			if queued {
+				t.inactiveStreams.Remove(s)
+			}
+			s.Priority = *patch.Priority
+			if queued {
+				t.inactiveStreams.Add(s)
+			}
+		}
+		switch patch.Status {
+		case "enabled":
+			if _, isDisabled := t.disabledStreams[s]; isDisabled {
+				m.stateTransfer(s, t.disabledStreams, t.inactiveStreams)
+			}
+			s.MongoStatus = "enabled"
+			s.ErrorCount = 0
+		case "disabled":
+			// DeactivateStreamService keeps streams that are being disabled disabled
+			s.MongoStatus = "disabled"
+			if s.ActiveStream != nil {
+				m.deactivateStreamImpl(s, t)
+			}
+			if _, isDisabled := t.disabledStreams[s]; isDisabled == false {
+				m.stateTransfer(s, m.idleStreams(s, t), t.disabledStreams)
+			}
+		}
+	}
+	return streamIds, nil
+}
+
+// Change the seconds of cool-down per error of streams failing from now on. 0
+// disables the cool-down.
+func (m *Manager) SetCooldownTime(seconds int) {
+	m.Lock()
+	defer m.Unlock()
+	m.cooldownTime = seconds
+}
+
+// Change the number of failures within QUARANTINE_WINDOW after which a stream
+// is quarantined. 0 disables automatic quarantine.
+func (m *Manager) SetQuarantineErrors(count int) {
+	m.Lock()
+	defer m.Unlock()
+	m.quarantineErrors = count
+}
+
+func (m *Manager) ResetActiveStream(token string) error {
+	m.RLock()
+	expiration := time.Duration(m.expirationTime) * time.Second
+	m.RUnlock()
+	stream := m.tokens.get(token)
+	if stream == nil {
+		return ErrUnauthorized.With("invalid token: " + token)
+	}
+	stream.Lock()
+	defer stream.Unlock()
+	if stream.activeToken(token) == false {
+		return ErrUnauthorized.With("invalid token: " + token)
+	}
+	// the session expires once the expiration queue finds it went silent
+	stream.ActiveStream.lastHeartbeat = time.Now()
+	stream.ActiveStream.Timeout = expiration
+	return nil
+}
+
+/*
+Pause an active stream for up to d, eg. while the donor's computer sleeps. The
+session does not expire until the pause ends, and from then on only if no
+heartbeat is received within the expiration time, so that the frames buffered
+by the core are kept. d is capped at MAX_PAUSE_TIME seconds, and pausing a
+paused stream again restarts its pause. Returns the time the pause ends, and
+the time the session expires unless it is resumed or reset by then.
+*/
+func (m *Manager) PauseActiveStream(token string, d time.Duration) (until, expires time.Time, err error) {
+	if max := time.Duration(MAX_PAUSE_TIME) * time.Second; d <= 0 || d > max {
+		d = max
+	}
+	err = m.modifyActivation(token, func(as *ActiveStream) {
+		as.lastHeartbeat = time.Now()
+		as.pausedUntil = as.lastHeartbeat.Add(d)
+		until, expires = as.pausedUntil, as.Expires()
+	})
+	return
+}
+
+// Resume a paused stream, which expires again like before it was paused.
+// Resuming counts as a heartbeat.
+func (m *Manager) ResumeActiveStream(token string) error {
+	return m.modifyActivation(token, func(as *ActiveStream) {
+		as.lastHeartbeat = time.Now()
+		as.pausedUntil = time.Time{}
+		// the session was queued to expire after the pause
+		m.advance(as.expiry, as.Expires())
+	})
+}
+
+// Change an active stream in a way that shows in /active_streams, such that
+// ActiveStreamsSince reports it again.
+func (m *Manager) modifyActivation(token string, fn func(*ActiveStream)) error {
+	m.Lock()
+	defer m.Unlock()
+	stream := m.tokens.get(token)
+	if stream == nil {
+		return ErrUnauthorized.With("invalid token: " + token)
+	}
+	stream.Lock()
+	defer stream.Unlock()
+	if stream.activeToken(token) == false {
+		return ErrUnauthorized.With("invalid token: " + token)
+	}
+	fn(stream.ActiveStream)
+	m.recordActivation(stream, true)
+	return nil
+}
+
+func (m *Manager) ActivateStream(targetId, user, engine string, fn func(*Stream) error) (token string, streamId string, err error) {
+	m.Lock()
+
+	t, ok := m.targets[targetId]
+	if ok == false {
+		m.Unlock()
+		err = ErrNoTarget
+		return
+	}
+	if m.pausedTargets[targetId] {
+		m.Unlock()
+		err = ErrTargetPaused
+		return
+	}
+	if m.overDonorLimit(user) {
+		m.Unlock()
+		err = ErrDonorLimit
+		return
+	}
+	if m.atCapacity(targetId, t) {
+		m.Unlock()
+		err = ErrTargetAtCapacity
+		return
+	}
+	iterator := t.inactiveStreams.Iterator()
+	ok = iterator.Next()
+	if ok == false {
+		m.Unlock()
+		err = ErrNoStreams
+		return
+	}
+	stream := iterator.Key().(*Stream)
+	streamId = stream.StreamId
+	stream.Lock()
+	defer stream.Unlock()
+	stream.epoch += 1
+	token = createToken(stream.epoch)
+	m.stateTransfer(stream, t.inactiveStreams, t.activeStreams)
+	stream.lastActivation = int(time.Now().Unix())
+	stream.ActiveStream = NewActiveStream(user, token, engine)
+	m.tokens.set(token, stream)
+	if user != "" {
+		m.donorStreams[user] += 1
+	}
+	stream.ActiveStream.Timeout = time.Duration(m.expirationTime) * time.Second
+	stream.ActiveStream.expiry = &expiration{
+		deadline: stream.ActiveStream.Expires(),
+		stream:   stream,
+		token:    token,
+	}
+	m.schedule(stream.ActiveStream.expiry)
+	stream.ActiveStream.StartFrames = stream.Frames
+	m.recordActivation(stream, true)
+	m.Unlock()
+	err = fn(stream)
+	return
+}
+
+/*
+Like ActivateStream, but if the target has no idle streams or is at capacity,
+wait up to wait for a stream to be added, enabled or deactivated. Waiting
+activations are served in the order they arrived. Stops waiting with the error
+of ctx once it is done, eg. because the core hung up.
+*/
+func (m *Manager) ActivateStreamWait(ctx context.Context, targetId, user, engine string, wait time.Duration, fn func(*Stream) error) (token string, streamId string, err error) {
+	timeout := time.After(wait)
+	for {
+		token, streamId, err = m.ActivateStream(targetId, user, engine, fn)
+		if wait <= 0 || (err != ErrNoTarget && err != ErrNoStreams && err != ErrTargetAtCapacity) {
+			return
+		}
+		ch := m.addWaiter(targetId)
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			if m.removeWaiter(targetId, ch) == false {
+				// pass the wake-up on to the next waiter
+				m.Lock()
+				m.wakeWaiter(targetId)
+				m.Unlock()
+			}
+			return "", "", ctx.Err()
+		case <-timeout:
+			if m.removeWaiter(targetId, ch) {
+				return
+			}
+			// woken as the timeout fired, so a stream may be idle
+			return m.ActivateStream(targetId, user, engine, fn)
+		}
+	}
+}
+
+func (m *Manager) DeactivateStream(token string, error_count int) error {
+	m.Lock()
+	stream := m.tokens.get(token)
+	if stream == nil {
+		m.Unlock()
+		return ErrUnauthorized.With("invalid token: " + token)
+	}
+	t := m.targets[stream.TargetId]
+	stream.Lock()
+	defer stream.Unlock()
+	if stream.activeToken(token) == false {
+		m.Unlock()
+		return ErrUnauthorized.With("invalid token: " + token)
+	}
+	stream.ErrorCount += error_count
+	spike := false
+	if error_count > 0 {
+		stream.ActiveStream.Errored = true
+		failures := stream.recordError(int(time.Now().Unix()))
+		spike = m.quarantineErrors > 0 && failures >= m.quarantineErrors
+	}
+	if spike && stream.ErrorCount < MAX_STREAM_FAILS {
+		// DeactivateStreamService records the quarantine.
+		m.quarantineStreamImpl(stream, t, "error spike")
+		m.Unlock()
+		return nil
+	}
+	m.deactivateStreamImpl(stream, t)
+	if stream.ErrorCount >= MAX_STREAM_FAILS {
+		m.disableStreamImpl(stream, t)
+		// we don't need to call DisableStreamService because DeactivateStreamService takes care of it.
+	} else if error_count > 0 {
+		m.coolStreamImpl(stream, t)
+	}
+	m.Unlock()
+	return nil
+}
+
+// // This returns by copy
+// func (m *Manager) ActiveStreams(targetId string) (result map[ActiveStream]struct{}, err error) {
+// 	m.RLock()
+// 	defer m.RUnlock()
+// 	t, ok := m.targets[targetId]
+// 	if ok == false {
+// 		err = errors.New("Target does not exist")
+// 		return
+// 	}
+// 	t.RLock()
+// 	defer t.RUnlock()
+// 	result = make(map[ActiveStream]struct{})
+// 	for token := range t.tokens {
+// 		result[*t.tokens[token].ActiveStream] = struct{}{}
+// 	}
+// 	return
+// }
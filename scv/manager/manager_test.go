@@ -0,0 +1,937 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var _ = fmt.Printf
+
+var mockFunc = func(*Stream) error { return nil }
+
+type mockInterface struct{}
+
+func (m *mockInterface) DeactivateStreamService(s *Stream) error {
+	return nil
+}
+
+func (m *mockInterface) DisableStreamService(s *Stream) error {
+	return nil
+}
+
+func (m *mockInterface) EnableStreamService(s *Stream) error {
+	return nil
+}
+
+var intf = &mockInterface{}
+
+func randSeq(n int) string {
+	letters := []rune("012345689ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz")
+	b := make([]rune, n)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+func TestAddSameStream(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(36)
+	streamId := randSeq(36)
+	stream := NewStream(streamId, targetId, "none", 0, 0, int(time.Now().Unix()))
+	err := m.AddStream(stream, targetId, true)
+	assert.Nil(t, err)
+	err = m.AddStream(stream, targetId, true)
+	assert.NotNil(t, err)
+}
+
+func TestGetActiveStreams(t *testing.T) {
+	m := NewManager(intf)
+	stream := NewStream("stream", "target", "none", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, "target", true)
+	token, _, err := m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	m.ModifyActiveStream(token, func(s *Stream) error {
+		began := time.Now().Add(-time.Hour)
+		for i := 0; i < 3; i++ {
+			s.ActiveStream.RecordFrame(began.Add(time.Duration(i) * 30 * time.Minute))
+		}
+		s.ActiveStream.BufferFrames = 3
+		return nil
+	})
+	info := m.GetActiveStreams()["target"]["stream"]
+	assert.Equal(t, info.User, "yutong")
+	assert.Equal(t, info.Engine, "openmm")
+	assert.Equal(t, info.SessionFrames, 3)
+	assert.Equal(t, info.BufferFrames, 3)
+	assert.Equal(t, info.FramesPerDay, 48.0)
+	assert.Equal(t, info.LastCheckpoint, 0)
+}
+
+func TestActiveStreamsSince(t *testing.T) {
+	m := NewManager(intf)
+	now := int(time.Now().Unix())
+	for _, streamId := range []string{"a", "b", "c"} {
+		m.AddStream(NewStream(streamId, "target", "none", 0, 0, now), "target", true)
+	}
+	tokenA, streamA, _ := m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	delta := m.ActiveStreamsSince(0)
+	assert.Equal(t, delta.Version, uint64(1))
+	assert.True(t, delta.Reset)
+	assert.Equal(t, len(delta.Activated["target"]), 1)
+
+	_, streamB, _ := m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, m.DeactivateStream(tokenA, 0))
+	delta = m.ActiveStreamsSince(1)
+	assert.Equal(t, delta.Version, uint64(3))
+	assert.False(t, delta.Reset)
+	_, ok := delta.Activated["target"][streamB]
+	assert.Equal(t, len(delta.Activated["target"]), 1)
+	assert.True(t, ok)
+	assert.Equal(t, delta.Deactivated, map[string][]string{"target": []string{streamA}})
+
+	delta = m.ActiveStreamsSince(3)
+	assert.Equal(t, len(delta.Activated), 0)
+	assert.Equal(t, len(delta.Deactivated), 0)
+
+	// versions of another run of the SCV
+	delta = m.ActiveStreamsSince(10)
+	assert.True(t, delta.Reset)
+	assert.Equal(t, delta.Version, uint64(3))
+}
+
+func TestStaleToken(t *testing.T) {
+	m := NewManager(intf)
+	stream := NewStream("stream", "target", "none", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, "target", true)
+	stale, _, err := m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	epoch, ok := parseToken(stale)
+	assert.True(t, ok)
+	assert.Equal(t, epoch, 1)
+	assert.Nil(t, m.DeactivateStream(stale, 0))
+	token, _, err := m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	epoch, _ = parseToken(token)
+	assert.Equal(t, epoch, 2)
+
+	// as if the stale token was looked up before the stream was deactivated
+	m.tokens.set(stale, stream)
+	called := false
+	err = m.ModifyActiveStream(stale, func(s *Stream) error {
+		called = true
+		return nil
+	})
+	assert.Equal(t, err.(*StatusError).Status, 401)
+	assert.False(t, called)
+	assert.NotNil(t, m.ResetActiveStream(stale))
+	assert.NotNil(t, m.DeactivateStream(stale, 0))
+	m.tokens.delete(stale)
+	assert.Nil(t, m.ModifyActiveStream(token, mockFunc))
+	_, ok = parseToken("no epoch")
+	assert.False(t, ok)
+}
+
+func TestDonorLimit(t *testing.T) {
+	m := NewManager(intf)
+	for i := 0; i < 5; i++ {
+		m.AddStream(NewStream(randSeq(5), "target", "none", 0, 0, int(time.Now().Unix())), "target", true)
+	}
+	m.SetDonorLimit(1, []string{"trusted"})
+	token, _, err := m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	_, _, err = m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Equal(t, err, ErrDonorLimit)
+	for i := 0; i < 2; i++ {
+		_, _, err = m.ActivateStream("target", "trusted", "openmm", mockFunc)
+		assert.Nil(t, err)
+	}
+	_, _, err = m.ActivateStream("target", "", "openmm", mockFunc)
+	assert.Nil(t, err)
+	// deactivating frees a slot
+	assert.Nil(t, m.DeactivateStream(token, 0))
+	_, _, err = m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+}
+
+func TestManagerCallbacks(t *testing.T) {
+	events := make([]string, 0)
+	record := func(event string) func(*Stream) error {
+		return func(s *Stream) error {
+			events = append(events, event+":"+s.StreamId)
+			return nil
+		}
+	}
+	m := NewManagerWithOptions(&ManagerCallbacks{
+		Deactivated: record("deactivated"),
+		Enabled:     record("enabled"),
+	}, ManagerOptions{QuarantineErrors: 2, DonorLimit: 1})
+	m.AddStream(NewStream("a", "target", "none", 0, 0, int(time.Now().Unix())), "target", true)
+	m.AddStream(NewStream("b", "target", "none", 0, 0, int(time.Now().Unix())), "target", true)
+	token, streamId, err := m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	_, _, err = m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Equal(t, err, ErrDonorLimit)
+	assert.Nil(t, m.DeactivateStream(token, 1))
+	// Disabled is nil
+	assert.Nil(t, m.DisableStream(streamId, "none"))
+	assert.Nil(t, m.EnableStream(streamId, "none"))
+	assert.Equal(t, events, []string{"deactivated:" + streamId, "enabled:" + streamId})
+	m.AddStream(NewStream("c", "other", "none", 0, 0, int(time.Now().Unix())), "other", true)
+	for i := 0; i < 2; i++ {
+		token, _, err = m.ActivateStream("other", "", "openmm", mockFunc)
+		assert.Nil(t, err)
+		assert.Nil(t, m.DeactivateStream(token, 1))
+	}
+	m.ReadStream("c", func(s *Stream) error {
+		assert.Equal(t, s.MongoStatus, "quarantined")
+		return nil
+	})
+}
+
+func TestAging(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	now := int(time.Now().Unix())
+	fresh := NewStream("fresh", targetId, "none", 10, 0, now)
+	old := NewStream("old", targetId, "none", 0, 0, now-20*3600)
+	m.AddStream(fresh, targetId, true)
+	m.AddStream(old, targetId, true)
+	// streams with more frames come first without aging
+	token, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, streamId, "fresh")
+	assert.Nil(t, m.DeactivateStream(token, 0))
+	// 20 hours of waiting are worth more than 10 frames
+	m.SetAgingRate(targetId, 1)
+	token, streamId, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, streamId, "old")
+	assert.Nil(t, m.DeactivateStream(token, 0))
+
+	m.SetAgingRate(targetId, 0)
+	// queued streams keep their place when their frames change, eg. when rewound
+	m.ModifyStream(fresh.StreamId, func(s *Stream) error {
+		s.Frames = 0
+		return nil
+	})
+	assert.Nil(t, m.RemoveStream(fresh.StreamId, "none"))
+}
+
+func TestPauseTarget(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	for i := 0; i < 2; i++ {
+		m.AddStream(NewStream(randSeq(5), targetId, "none", 0, 0, int(time.Now().Unix())), targetId, true)
+	}
+	token, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, m.SetPaused(targetId, true), 1)
+	assert.True(t, m.Paused(targetId))
+	_, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Equal(t, err, ErrTargetPaused)
+	assert.Equal(t, len(m.IdleTargets()), 0)
+	// active streams are left running
+	assert.Nil(t, m.ModifyActiveStream(token, mockFunc))
+	assert.Nil(t, m.DeactivateStream(token, 0))
+	assert.Equal(t, m.SetPaused(targetId, false), 0)
+	assert.Equal(t, m.IdleTargets(), map[string]int{targetId: 2})
+	_, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+}
+
+func TestMaxActive(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	for i := 0; i < 3; i++ {
+		m.AddStream(NewStream(randSeq(5), targetId, "none", 0, 0, int(time.Now().Unix())), targetId, true)
+	}
+	m.SetMaxActive(targetId, 1)
+	token, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	_, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Equal(t, err, ErrTargetAtCapacity)
+	assert.Equal(t, len(m.IdleTargets()), 0)
+	// waiting activations get the slot of the next deactivated stream
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		m.DeactivateStream(token, 0)
+	}()
+	token, _, err = m.ActivateStreamWait(context.Background(), targetId, "yutong", "openmm", 5*time.Second, mockFunc)
+	assert.Nil(t, err)
+	m.SetMaxActive(targetId, 0)
+	_, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+}
+
+func TestCooldown(t *testing.T) {
+	m := NewManager(intf)
+	m.SetCooldownTime(1)
+	targetId := randSeq(5)
+	stream := NewStream(randSeq(5), targetId, "none", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	token, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	// aborts do not cool the stream down
+	assert.Nil(t, m.DeactivateStream(token, 0))
+	token, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Nil(t, m.DeactivateStream(token, 1))
+	_, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.NotNil(t, err)
+	_, inactive, _ := m.Counts()
+	assert.Equal(t, inactive, 1)
+	time.Sleep(1200 * time.Millisecond)
+	token, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	// disabling a stream cancels its cool-down
+	assert.Nil(t, m.DeactivateStream(token, 1))
+	assert.Nil(t, m.DisableStream(stream.StreamId, "none"))
+	assert.Nil(t, m.EnableStream(stream.StreamId, "none"))
+	_, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+}
+
+func TestStreamError(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	streamId := randSeq(5)
+	stream := NewStream(streamId, targetId, "none", 5, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+
+	for i := 0; i < MAX_STREAM_FAILS; i++ {
+		token, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		err = m.DeactivateStream(token, 1)
+		assert.Nil(t, err)
+	}
+	_, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.NotNil(t, err)
+}
+
+func TestStreamNoError(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	streamId := randSeq(5)
+	stream := NewStream(streamId, targetId, "none", 5, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+
+	for i := 0; i < MAX_STREAM_FAILS; i++ {
+		token, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		err = m.DeactivateStream(token, 0)
+		assert.Nil(t, err)
+	}
+	_, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+}
+
+func TestAddRemoveStream(t *testing.T) {
+	m := NewManager(intf)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	streamPtrs := make(map[*Stream]struct{})
+	targetId := randSeq(36)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			streamId := randSeq(36)
+			stream := NewStream(streamId, targetId, "none", 0, 0, int(time.Now().Unix()))
+			mutex.Lock()
+			streamPtrs[stream] = struct{}{}
+			mutex.Unlock()
+			m.AddStream(stream, targetId, true)
+		}()
+	}
+	wg.Wait()
+	for k, _ := range streamPtrs {
+		assert.True(t, m.targets[targetId].inactiveStreams.Contains(k))
+		assert.Equal(t, m.streams.get(k.StreamId), k)
+	}
+	for k, _ := range streamPtrs {
+		wg.Add(1)
+		go func(stream_id string) {
+			defer wg.Done()
+			m.RemoveStream(stream_id, "none")
+		}(k.StreamId)
+	}
+	wg.Wait()
+	_, ok := m.targets[targetId]
+	assert.False(t, ok)
+	for k, _ := range streamPtrs {
+		assert.Nil(t, m.streams.get(k.StreamId))
+	}
+}
+
+func TestRemoveDisabledStream(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	streamId := randSeq(5)
+	stream := NewStream(streamId, targetId, "none", 5, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	assert.Nil(t, m.DisableStream(streamId, "none"))
+	assert.Nil(t, m.RemoveStream(streamId, "none"))
+	_, ok := m.targets[targetId]
+	assert.False(t, ok)
+}
+
+func TestRemoveActiveStream(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	streamId := randSeq(5)
+	stream := NewStream(streamId, targetId, "none", 5, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	_, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, m.tokens.len(), 1)
+	assert.Equal(t, m.streams.len(), 1)
+	m.RemoveStream(streamId, "none")
+	_, ok := m.targets[targetId]
+	assert.False(t, ok)
+	assert.Equal(t, m.streams.len(), 0)
+}
+
+func TestDeactivateTimer(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	streamId := randSeq(5)
+	stream := NewStream(streamId, targetId, "none", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	sleepTime := 6
+	m.expirationTime = 5
+	_, streamId, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.True(t, err == nil)
+	m.ReadStream(streamId, func(s *Stream) error {
+		assert.NotNil(t, s.ActiveStream)
+		return nil
+	})
+	time.Sleep(time.Duration(sleepTime) * time.Second)
+	m.ReadStream(streamId, func(s *Stream) error {
+		assert.Nil(t, s.ActiveStream)
+		return nil
+	})
+
+	assert.Nil(t, stream.ActiveStream)
+}
+
+func TestReadModifyStream(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	streamId := randSeq(5)
+	stream := NewStream(streamId, targetId, "none", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	err := m.ModifyActiveStream("bad_token", mockFunc)
+	assert.NotNil(t, err)
+	err = m.ModifyActiveStream("bad_token:asdf", mockFunc)
+	assert.NotNil(t, err)
+	err = m.ReadStream("bad_stream", mockFunc)
+	assert.NotNil(t, err)
+	err = m.ModifyStream("bad_stream", mockFunc)
+	assert.NotNil(t, err)
+	err = m.RemoveStream("bad_stream", "none")
+	assert.NotNil(t, err)
+	err = m.ReadStream(streamId, mockFunc)
+	assert.Nil(t, err)
+	err = m.ModifyStream(streamId, mockFunc)
+	assert.Nil(t, err)
+	m.RemoveStream(streamId, "none")
+}
+
+func TestEnableDisableStream(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	streamId := randSeq(5)
+	stream := NewStream(streamId, targetId, "some_user", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	assert.NotNil(t, m.DisableStream(streamId, "some_bad_user"))
+	assert.Nil(t, m.DisableStream(streamId, "some_user"))
+	assert.Nil(t, m.DisableStream(streamId, "some_user"))
+	username := randSeq(5)
+	engine := randSeq(5)
+	_, _, err := m.ActivateStream(targetId, username, engine, mockFunc)
+	assert.NotNil(t, err)
+	assert.NotNil(t, m.EnableStream(streamId, "some_bad_user"))
+	assert.Nil(t, m.EnableStream(streamId, "some_user"))
+	assert.Nil(t, m.EnableStream(streamId, "some_user"))
+	token, _, err := m.ActivateStream(targetId, username, engine, mockFunc)
+	assert.Nil(t, m.ModifyActiveStream(token, mockFunc))
+	assert.Nil(t, err)
+	assert.NotNil(t, m.DisableStream(streamId, "some_bad_user"))
+	assert.Nil(t, m.DisableStream(streamId, "some_user"))
+	assert.Nil(t, m.DisableStream(streamId, "some_user"))
+	_, _, err = m.ActivateStream(targetId, username, engine, mockFunc)
+	assert.NotNil(t, err)
+	assert.NotNil(t, m.ModifyActiveStream("bad_token", mockFunc))
+
+	assert.NotNil(t, m.EnableStream("bad_streams", "some_user"))
+}
+
+func TestUpdateStreams(t *testing.T) {
+	m := NewManager(intf)
+	now := int(time.Now().Unix())
+	for i, frames := range []int{10, 5, 0} {
+		m.AddStream(NewStream("s"+strconv.Itoa(i), "target", "none", frames, 0, now), "target", true)
+	}
+	all := func(*Stream) bool { return true }
+	commit := func([]*Stream) error { return nil }
+	priority := 20.0
+	ids, err := m.UpdateStreams("target", func(s *Stream) bool { return s.StreamId == "s2" },
+		StreamPatch{Priority: &priority}, commit)
+	assert.Nil(t, err)
+	assert.Equal(t, ids, []string{"s2"})
+	_, inactive, _ := m.TargetStreams("target")
+	assert.Equal(t, inactive, []string{"s2", "s0", "s1"})
+
+	// nothing is applied if commit fails
+	_, err = m.UpdateStreams("", all, StreamPatch{Status: "disabled"}, func(streams []*Stream) error {
+		assert.Equal(t, len(streams), 3)
+		return errors.New("failed")
+	})
+	assert.NotNil(t, err)
+	_, inactive, disabled := m.TargetStreams("target")
+	assert.Equal(t, len(inactive), 3)
+	assert.Equal(t, len(disabled), 0)
+
+	// active streams are deactivated when disabled
+	_, streamId, err := m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, streamId, "s2")
+	ids, err = m.UpdateStreams("target", all, StreamPatch{Status: "disabled"}, commit)
+	assert.Nil(t, err)
+	assert.Equal(t, ids, []string{"s0", "s1", "s2"})
+	active, inactive, disabled := m.TargetStreams("target")
+	assert.Equal(t, len(active)+len(inactive), 0)
+	assert.Equal(t, disabled, []string{"s0", "s1", "s2"})
+
+	assert.Nil(t, m.QuarantineStream("s0", "bad data"))
+	_, err = m.UpdateStreams("target", all, StreamPatch{Status: "enabled"}, commit)
+	assert.Equal(t, err.(*StatusError).Status, 409)
+	ids, err = m.UpdateStreams("target", func(s *Stream) bool { return s.MongoStatus == "disabled" },
+		StreamPatch{Status: "enabled"}, commit)
+	assert.Nil(t, err)
+	assert.Equal(t, ids, []string{"s1", "s2"})
+	_, inactive, disabled = m.TargetStreams("target")
+	assert.Equal(t, inactive, []string{"s2", "s1"})
+	assert.Equal(t, disabled, []string{"s0"})
+}
+
+func TestQuarantineStream(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	streamId := randSeq(5)
+	stream := NewStream(streamId, targetId, "some_user", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	token, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Nil(t, m.QuarantineStream(streamId, "bad frames"))
+	assert.NotNil(t, m.ModifyActiveStream(token, mockFunc))
+	assert.Equal(t, stream.MongoStatus, "quarantined")
+	assert.Equal(t, stream.QuarantineReason, "bad frames")
+	_, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.NotNil(t, err)
+	// quarantined streams can only be released
+	assert.NotNil(t, m.EnableStream(streamId, "some_user"))
+	assert.Nil(t, m.DisableStream(streamId, "some_user"))
+	assert.Equal(t, stream.MongoStatus, "quarantined")
+	assert.Nil(t, m.ReleaseStream(streamId))
+	assert.NotNil(t, m.ReleaseStream(streamId))
+	assert.Equal(t, stream.MongoStatus, "enabled")
+	assert.Equal(t, stream.QuarantineReason, "")
+	_, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.NotNil(t, m.QuarantineStream("bad_stream", "bad frames"))
+	assert.NotNil(t, m.ReleaseStream("bad_stream"))
+}
+
+func TestQuarantineErrorSpike(t *testing.T) {
+	m := NewManager(intf)
+	m.SetQuarantineErrors(3)
+	targetId := randSeq(5)
+	streamId := randSeq(5)
+	stream := NewStream(streamId, targetId, "some_user", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	for i := 0; i < 3; i++ {
+		// sessions without errors do not count
+		token, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		assert.Nil(t, m.DeactivateStream(token, 0))
+		assert.Equal(t, stream.MongoStatus, "enabled")
+		token, _, err = m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+		assert.Nil(t, err)
+		assert.Nil(t, m.DeactivateStream(token, 1))
+	}
+	assert.Equal(t, stream.MongoStatus, "quarantined")
+	assert.Equal(t, stream.QuarantineReason, "error spike")
+	_, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.NotNil(t, err)
+	assert.Nil(t, m.ReleaseStream(streamId))
+	token, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Nil(t, m.DeactivateStream(token, 1))
+	assert.Equal(t, stream.MongoStatus, "enabled")
+}
+
+func TestActivateStreamWait(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	stream := NewStream(randSeq(5), targetId, "some_user", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	token, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+
+	// times out
+	start := time.Now()
+	_, _, err = m.ActivateStreamWait(context.Background(), targetId, "yutong", "openmm", 100*time.Millisecond, mockFunc)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+	assert.Equal(t, len(m.waiters), 0)
+
+	// the core hung up
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, _, err = m.ActivateStreamWait(ctx, targetId, "yutong", "openmm", 5*time.Second, mockFunc)
+	assert.Equal(t, err, context.Canceled)
+	assert.Equal(t, len(m.waiters), 0)
+
+	// woken by a deactivation, in the order of arrival
+	results := make(chan string, 2)
+	for _, user := range []string{"first", "second"} {
+		go func(user string) {
+			_, _, err := m.ActivateStreamWait(context.Background(), targetId, user, "openmm", 5*time.Second, mockFunc)
+			if err == nil {
+				results <- user
+			}
+		}(user)
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Nil(t, m.DeactivateStream(token, 0))
+	assert.Equal(t, <-results, "first")
+
+	// woken by a new stream, even if the target did not exist
+	otherTarget := randSeq(5)
+	go func() {
+		_, _, err := m.ActivateStreamWait(context.Background(), otherTarget, "third", "openmm", 5*time.Second, mockFunc)
+		if err == nil {
+			results <- "third"
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	m.AddStream(NewStream(randSeq(5), otherTarget, "some_user", 0, 0, int(time.Now().Unix())), otherTarget, true)
+	assert.Equal(t, <-results, "third")
+
+	m.AddStream(NewStream(randSeq(5), targetId, "some_user", 0, 0, int(time.Now().Unix())), targetId, true)
+	assert.Equal(t, <-results, "second")
+}
+
+func TestActivateStream(t *testing.T) {
+	m := NewManager(intf)
+	numStreams := 5
+	targetId := randSeq(5)
+	addOrder := make([]*Stream, 0)
+	for i := 0; i < numStreams; i++ {
+		streamId := randSeq(3)
+		stream := NewStream(streamId, targetId, "none", i, 0, int(time.Now().Unix()))
+		m.AddStream(stream, targetId, true)
+		addOrder = append(addOrder, stream)
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	activationTokens := make([]string, 0)
+	// we need to make sure that the activation order is correct.
+	for i := 0; i < numStreams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// activate a single stream
+			username := randSeq(5)
+			engine := randSeq(5)
+			token, _, err := m.ActivateStream(targetId, username, engine, mockFunc)
+			assert.Nil(t, err)
+			mu.Lock()
+			activationTokens = append(activationTokens, token)
+			mu.Unlock()
+			m.RLock()
+			// target := m.targets[targetId]
+			stream := m.tokens.get(token)
+			assert.Equal(t, stream.ActiveStream.User, username)
+			assert.Equal(t, stream.ActiveStream.Engine, engine)
+			assert.Equal(t, stream.ActiveStream.AuthToken, token)
+			assert.True(t, stream.ActiveStream.StartTime-int(time.Now().Unix()) < 2)
+			m.RUnlock()
+		}()
+	}
+	wg.Wait()
+	for idx, token := range activationTokens {
+		s := m.tokens.get(token)
+		assert.Equal(t, s, addOrder[numStreams-idx-1])
+	}
+	for _, stream := range addOrder {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			err := m.DeactivateStream(token, 0)
+			assert.Nil(t, err)
+		}(stream.ActiveStream.AuthToken)
+	}
+	wg.Wait()
+	assert.Equal(t, m.tokens.len(), 0)
+	assert.Equal(t, len(m.targets[targetId].activeStreams), 0)
+	assert.Equal(t, m.targets[targetId].inactiveStreams.Len(), numStreams)
+}
+
+func TestStreamReadWrite(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	streamId := randSeq(5)
+	stream := NewStream(streamId, targetId, "none", 0, 0, int(time.Now().Unix()))
+	m.AddStream(stream, targetId, true)
+	_, _, err := m.ActivateStream(targetId, "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		if i%100 == 0 {
+			go func() {
+				fn := func(s *Stream) error {
+					s.Frames += 1
+					return nil
+				}
+				m.ModifyStream(streamId, fn)
+				wg.Done()
+			}()
+		} else {
+			go func() {
+				var frame_count int
+				fn := func(s *Stream) error {
+					frame_count = s.Frames
+					return nil
+				}
+				m.ReadStream(streamId, fn)
+				assert.True(t, frame_count <= 10)
+				wg.Done()
+			}()
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, m.streams.get(streamId).Frames, 10)
+}
+
+func TestActivateEmptyTarget(t *testing.T) {
+	m := NewManager(intf)
+	targetId := randSeq(5)
+	numStreams := 3
+	for i := 0; i < numStreams; i++ {
+		streamId := randSeq(3)
+		stream := NewStream(streamId, targetId, "none", 0, 0, int(time.Now().Unix()))
+		m.AddStream(stream, targetId, true)
+		_, _, err := m.ActivateStream(targetId, "foo", "bar", mockFunc)
+		assert.Nil(t, err)
+	}
+	_, _, err := m.ActivateStream(targetId, "foo", "bar", mockFunc)
+	assert.NotNil(t, err)
+}
+
+type MultiplexTester struct {
+	t *testing.T
+}
+
+type testStats struct {
+	sync.Mutex
+	count float64
+	sum   float64
+}
+
+func (s *testStats) Add(val float64) {
+	s.Lock()
+	s.count += 1.0
+	s.sum += val
+	s.Unlock()
+}
+
+func (s *testStats) Mean() float64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.sum / s.count
+}
+
+func (mt *MultiplexTester) Multiplex(nTargets, nStreams, nActivations, secondsBetweenFrames int) error {
+	// add asynchronously
+	m := NewManager(intf)
+	// this test ends after 5 minutes
+	m.expirationTime = 300
+	testDurationInMilliseconds := int64(900)
+	modifyStreamStats := testStats{}
+	activateStreamStats := testStats{}
+	var wg sync.WaitGroup
+	for t := 0; t < nTargets; t++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			targetId := randSeq(20)
+			var wg2 sync.WaitGroup
+			for s := 0; s < nStreams; s++ {
+				wg2.Add(1)
+				go func() {
+					defer wg2.Done()
+					// add streams at random points in time
+					streamId := randSeq(12)
+					stream := NewStream(streamId, targetId, "none", 0, 0, int(time.Now().Unix()))
+					err := m.AddStream(stream, targetId, true)
+					assert.Nil(mt.t, err)
+				}()
+			}
+			wg2.Wait()
+			// activate streams at random points in time (some of these may fail, which is fine)
+			for a := 0; a < nActivations; a++ {
+				// bad XX intrinsically racy as hell
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					// activate these streams over the span of 1 minutes
+					time.Sleep(time.Second * time.Duration(rand.Intn(secondsBetweenFrames)))
+					k := time.Now().UnixNano()
+					token, _, err := m.ActivateStream(targetId, "joe", "bob", mockFunc)
+					if err == nil {
+						activateDuration := float64(time.Now().UnixNano() - k)
+						// fmt.Println("Activate Duration", activateDuration/float64(1e6))
+						activateStreamStats.Add(activateDuration)
+						wg.Add(1)
+						go func() {
+							defer wg.Done()
+							for {
+								writeFileMock := func(s *Stream) error {
+									// fmt.Println(time.Now().Unix(), "doing file io... stream:", streamId, "target:", targetId)
+									time.Sleep(time.Duration(testDurationInMilliseconds) * time.Millisecond)
+									return nil
+								}
+								s := time.Now().UnixNano()
+								err := m.ModifyActiveStream(token, writeFileMock)
+								if err != nil {
+									break
+								} else {
+									modifyDuration := float64(time.Now().UnixNano() - s)
+									// fmt.Println("Modify Duration", modifyDuration/float64(1e6))
+									modifyStreamStats.Add(modifyDuration)
+								}
+								time.Sleep(time.Second * time.Duration(secondsBetweenFrames))
+							}
+						}()
+					}
+				}()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.True(mt.t, activateStreamStats.Mean()/float64(1e6) < 10)
+	assert.True(mt.t, modifyStreamStats.Mean()/float64(1e6)-float64(testDurationInMilliseconds) < 0.01*float64(testDurationInMilliseconds))
+
+	return nil
+}
+
+func TestMultiplex(t *testing.T) {
+	mt := MultiplexTester{t}
+
+	// 50 targets, 20000 streams per target, 2000 active streams per target (activated over a span of 1 hour)
+	// mt.Multiplex(50, 20000, 2000, 300)
+	mt.Multiplex(10, 100, 100, 20)
+}
+
+/*
+Activations and deactivations of streams of 100 targets holding 100k streams,
+while the cores of 1000 other active streams post frames and heartbeats. Each
+frame holds its stream's lock for as long as writing it to disk would, so the
+heartbeats of a stream wait for its frames.
+*/
+func BenchmarkActivation(b *testing.B) {
+	m := NewManager(intf)
+	nTargets, nStreams, nCores := 100, 100000, 1000
+	for i := 0; i < nStreams; i++ {
+		targetId := "target" + strconv.Itoa(i%nTargets)
+		m.AddStream(NewStream(randSeq(36), targetId, "none", 0, 0, 0), targetId, true)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	post := func(token string, fn func(*Stream) error, interval time.Duration) {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+				m.ModifyActiveStream(token, fn)
+			}
+		}
+	}
+	writeFrame := func(*Stream) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	for i := 0; i < nCores; i++ {
+		token, _, err := m.ActivateStream("target"+strconv.Itoa(i%nTargets), "", "openmm", mockFunc)
+		if err != nil {
+			b.Fatal(err)
+		}
+		wg.Add(2)
+		go post(token, writeFrame, time.Millisecond)
+		go post(token, mockFunc, time.Millisecond)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			token, _, err := m.ActivateStream("target"+strconv.Itoa(rand.Intn(nTargets)), "", "openmm", mockFunc)
+			if err == nil {
+				m.DeactivateStream(token, 0)
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
+
+// func TestStreamExpiration(t *testing.T) {
+// 	tm := NewTargetManager()
+// 	target := NewTarget(tm)
+// 	target.ExpirationTime = 7
+// 	numStreams := 3
+// 	// add three streams in intervals of three seconds
+// 	var wg sync.WaitGroup
+// 	for i := 0; i < numStreams; i++ {
+// 		wg.Add(1)
+// 		go func() {
+// 			defer wg.Done()
+// 			stream_id := randSeq(3)
+// 			target.AddStream(stream_id, 0)
+// 			token, stream_id, err := target.ActivateStream("foo", "bar")
+// 			assert.Equal(t, stream_id, stream_id)
+// 			assert.True(t, err == nil)
+// 			_, err = target.ActiveStream(stream_id)
+// 			assert.True(t, err == nil)
+// 			_, err = tm.Tokens.FindStream(token)
+// 			assert.True(t, err == nil)
+// 			inactive_streams, err := target.InactiveStreams()
+// 			_, ok := inactive_streams[stream_id]
+// 			assert.False(t, ok)
+// 			time.Sleep(time.Duration(target.ExpirationTime+1) * time.Second)
+// 			_, err = target.ActiveStream(stream_id)
+// 			assert.True(t, err != nil)
+// 			_, err = tm.Tokens.FindStream(token)
+// 			assert.True(t, err != nil)
+// 			inactive_streams, err = target.InactiveStreams()
+// 			_, ok = inactive_streams[stream_id]
+// 			assert.True(t, ok)
+// 		}()
+// 		time.Sleep(2 * time.Second)
+// 	}
+// 	wg.Wait()
+// 	target.Die()
+// }
@@ -0,0 +1,73 @@
+package manager
+
+// Streams of a target by state, and the settings of the target in the Manager.
+type TargetState struct {
+	Active    int     `json:"active"`
+	Inactive  int     `json:"inactive"` // not counting those cooling down
+	Cooling   int     `json:"cooling"`
+	Disabled  int     `json:"disabled"`
+	Paused    bool    `json:"paused"`
+	MaxActive int     `json:"max_active,omitempty"` // 0 for no limit
+	AgingRate float64 `json:"aging_rate"`
+	Waiters   int     `json:"waiters"` // activations waiting for an idle stream
+}
+
+/*
+The state of a Manager at a point in time. Sessions that ended must have
+released their token and left the expiration queue, and so must the streams
+that are no longer cooling down, so StaleTokens is always 0 and the Timers
+match the active and cooling streams unless something leaked.
+*/
+type ManagerState struct {
+	Version      uint64                 `json:"version"` // see ActiveStreamsSince
+	Streams      int                    `json:"streams"`
+	Tokens       int                    `json:"tokens"`
+	StaleTokens  int                    `json:"stale_tokens"`  // tokens whose stream is no longer in their session
+	DonorStreams map[string]int         `json:"donor_streams"` // active streams of each donor, see MaxDonorStreams
+	Timers       map[string]int         `json:"timers"`        // entries of the expiration queue, by kind
+	Targets      map[string]TargetState `json:"targets"`
+}
+
+// Returns the state of the Manager, read under its lock so that the counts are
+// consistent with each other.
+func (m *Manager) State() ManagerState {
+	m.RLock()
+	defer m.RUnlock()
+	state := ManagerState{
+		Version:      m.version,
+		Streams:      m.streams.len(),
+		DonorStreams: make(map[string]int),
+		Timers:       map[string]int{"expiration": 0, "cooldown": 0},
+		Targets:      make(map[string]TargetState),
+	}
+	// tokens and expirations are only set and cleared with the manager locked
+	for token, stream := range m.tokens.snapshot() {
+		state.Tokens += 1
+		if stream.ActiveStream == nil || stream.ActiveStream.AuthToken != token {
+			state.StaleTokens += 1
+		}
+	}
+	for user, count := range m.donorStreams {
+		state.DonorStreams[user] = count
+	}
+	for _, e := range m.expirations {
+		if e.token == "" {
+			state.Timers["cooldown"] += 1
+		} else {
+			state.Timers["expiration"] += 1
+		}
+	}
+	for targetId, t := range m.targets {
+		state.Targets[targetId] = TargetState{
+			Active:    len(t.activeStreams),
+			Inactive:  t.inactiveStreams.Len(),
+			Cooling:   len(t.coolingStreams),
+			Disabled:  len(t.disabledStreams),
+			Paused:    m.pausedTargets[targetId],
+			MaxActive: m.maxActive[targetId],
+			AgingRate: t.agingRate,
+			Waiters:   len(m.waiters[targetId]),
+		}
+	}
+	return state
+}
@@ -0,0 +1,31 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManagerState(t *testing.T) {
+	m := NewManagerWithOptions(&ManagerCallbacks{}, ManagerOptions{CooldownTime: 60})
+	now := int(time.Now().Unix())
+	for _, streamId := range []string{"a", "b", "c"} {
+		m.AddStream(NewStream(streamId, "target", "none", 0, 0, now), "target", true)
+	}
+	m.SetMaxActive("target", 10)
+	token, _, err := m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+	assert.Nil(t, m.DeactivateStream(token, 1))
+	_, _, err = m.ActivateStream("target", "yutong", "openmm", mockFunc)
+	assert.Nil(t, err)
+
+	state := m.State()
+	assert.Equal(t, state.Version, uint64(3))
+	assert.Equal(t, state.Streams, 3)
+	assert.Equal(t, state.Tokens, 1)
+	assert.Equal(t, state.StaleTokens, 0)
+	assert.Equal(t, state.DonorStreams, map[string]int{"yutong": 1})
+	assert.Equal(t, state.Timers, map[string]int{"expiration": 1, "cooldown": 1})
+	assert.Equal(t, state.Targets["target"], TargetState{Active: 1, Inactive: 1, Cooling: 1, MaxActive: 10})
+}
@@ -0,0 +1,238 @@
+package manager
+
+import (
+	"sync"
+	"time"
+)
+
+// Cached object persisted in Mongo
+type Stream struct {
+	sync.RWMutex `json:"-" bson:"-"`
+	Owner        string `json:"-" bson:"-"`                   // constant (safe to read without mutex)
+	Namespace    string `json:"-" bson:"namespace,omitempty"` // constant, namespace of the owner
+	StreamId     string `json:"-" bson:"_id"`                 // constant
+	TargetId     string `json:"target_id" bson:"target_id"`   // constant
+	Frames       int    `json:"frames" bson:"frames"`
+	ErrorCount   int    `json:"error_count" bson:"error_count"`
+	CreationDate int    `json:"creation_date" bson:"creation_date"`
+
+	MongoStatus string `json:"status" bson:"status"` // this value is used only for persistence purposes.
+
+	// Frames credited to donors, including partial frames reported at
+	// checkpoints. Unlike Frames, this is not a partition count.
+	DonorFrames float64 `json:"donor_frames" bson:"donor_frames"`
+
+	QuarantineReason string `json:"quarantine_reason,omitempty" bson:"quarantine_reason,omitempty"`
+
+	// Set if the stream was forked from frame ForkFrame of another stream.
+	ParentStreamId string `json:"parent_stream_id,omitempty" bson:"parent_stream_id,omitempty"` // constant
+	ForkFrame      int    `json:"fork_frame,omitempty" bson:"fork_frame,omitempty"`             // constant
+
+	Meta map[string]interface{} `json:"meta,omitempty" bson:"meta,omitempty"`
+
+	// Options of the target overridden for this stream.
+	Options map[string]interface{} `json:"options,omitempty" bson:"options,omitempty"`
+
+	// Frames of priority added to the stream's in its target's queue, see
+	// Target.priority. Guarded by the manager's lock as well.
+	Priority float64 `json:"priority,omitempty" bson:"priority,omitempty"`
+
+	// Unix time the stream was last deactivated or enabled.
+	LastActive int `json:"last_active,omitempty" bson:"last_active,omitempty"`
+
+	// Unix time the stream was completed.
+	Completed int `json:"completed,omitempty" bson:"completed,omitempty"`
+
+	// The current session of the stream, nil unless it is active. Set and
+	// cleared by the Manager.
+	ActiveStream *ActiveStream `json:"-" bson:"-"`
+
+	// Whatever the program using the Manager keeps along with the stream. The
+	// Manager never reads it.
+	Data interface{} `json:"-" bson:"-"`
+
+	recentErrors []int       // unix times of recent failed activations
+	cooldown     *expiration // ends the cool-down of a stream in its target's coolingStreams
+	removed      bool        // set once the stream is removed from the manager
+	epoch        int         // incremented whenever the stream is activated, embedded in the session's token
+
+	// Keys of the stream in its target's inactiveStreams, guarded by the
+	// manager's lock rather than the stream's so that they do not change
+	// while the stream is queued, eg. when it is rewound.
+	queueFrames    int // frames of the stream when it was queued
+	lastActivation int // unix time the stream was last activated, or created
+}
+
+// Returns true if the stream is active under token, ie. the token belongs to
+// the stream's current session. The stream must be locked.
+func (s *Stream) activeToken(token string) bool {
+	epoch, ok := parseToken(token)
+	if ok == false || epoch != s.epoch {
+		return false
+	}
+	return s.ActiveStream != nil && s.ActiveStream.AuthToken == token
+}
+
+// Records a failed activation at time now and returns the number of failures
+// in the last QUARANTINE_WINDOW seconds. The stream must be locked.
+func (s *Stream) recordError(now int) int {
+	recent := make([]int, 0, len(s.recentErrors)+1)
+	for _, t := range s.recentErrors {
+		if now-t < QUARANTINE_WINDOW {
+			recent = append(recent, t)
+		}
+	}
+	s.recentErrors = append(recent, now)
+	return len(s.recentErrors)
+}
+
+func NewStream(streamId, targetId, owner string,
+	frames, errorCount, creationDate int) *Stream {
+	stream := &Stream{
+		StreamId:     streamId,
+		TargetId:     targetId,
+		Frames:       frames,
+		ErrorCount:   errorCount,
+		CreationDate: creationDate,
+		Owner:        owner,
+		MongoStatus:  "enabled", // by default is enabled because we can't
+
+		lastActivation: creationDate,
+	}
+	return stream
+}
+
+// The session of an active stream. The fields set by the Manager must not be
+// changed by others, and the stream must be locked to read or change the rest.
+type ActiveStream struct {
+	AuthToken   string        // token of the ActiveStream, set by the Manager
+	User        string        // donor id, set by the Manager
+	Engine      string        // core engine type the stream is assigned to, set by the Manager
+	StartTime   int           // time the stream was activated, set by the Manager
+	StartFrames int           // frames of the stream when it was activated, set by the Manager
+	Errored     bool          // true if the core stopped with an error, set by the Manager
+	Timeout     time.Duration // the session expires after going this long without a heartbeat, set by the Manager
+
+	DonorFrames    float64   // number of frames done by this donor (including partial frames)
+	BufferFrames   int       // number of frames stored in the buffer
+	LastCheckpoint time.Time // zero until the core sent a checkpoint
+
+	// Whatever the program using the Manager keeps along with the session.
+	// The Manager never reads it.
+	Data interface{}
+
+	expiry      *expiration // of the session, in the Manager's expiration queue
+	pausedUntil time.Time   // zero unless the donor paused the core, see Manager.PauseActiveStream
+
+	// progress of the session, see ActiveStreamInfo
+	sessionFrames int
+	firstFrame    time.Time
+	lastFrame     time.Time
+	lastHeartbeat time.Time
+}
+
+// Returns the time the session expires unless it is reset, see
+// Manager.ResetActiveStream. Paused sessions expire once their pause is over
+// and they went the expiration time without a heartbeat.
+func (as *ActiveStream) Expires() time.Time {
+	if as.pausedUntil.After(as.lastHeartbeat) {
+		return as.pausedUntil.Add(as.Timeout)
+	}
+	return as.lastHeartbeat.Add(as.Timeout)
+}
+
+// Returns the progress of the stream's session, which must be active.
+func (s *Stream) activeInfo() ActiveStreamInfo {
+	info := s.ActiveStream.info()
+	info.Options = s.Options
+	return info
+}
+
+// Returns true if the donor paused the core and the pause is not over.
+func (as *ActiveStream) paused() bool {
+	return as.pausedUntil.After(time.Now())
+}
+
+func NewActiveStream(user, token, engine string) *ActiveStream {
+	now := time.Now()
+	as := &ActiveStream{
+		User:          user,
+		Engine:        engine,
+		AuthToken:     token,
+		StartTime:     int(now.Unix()),
+		lastHeartbeat: now,
+	}
+	return as
+}
+
+// Record a frame posted at t.
+func (as *ActiveStream) RecordFrame(t time.Time) {
+	if as.sessionFrames == 0 {
+		as.firstFrame = t
+	}
+	as.lastFrame = t
+	as.sessionFrames += 1
+}
+
+// Frames per day of the core, estimated from the time between its first and
+// last frames. Returns 0 until two frames were posted.
+func (as *ActiveStream) framesPerDay() float64 {
+	elapsed := as.lastFrame.Sub(as.firstFrame).Seconds()
+	if as.sessionFrames < 2 || elapsed <= 0 {
+		return 0
+	}
+	return float64(as.sessionFrames-1) / elapsed * 86400
+}
+
+func (as *ActiveStream) info() ActiveStreamInfo {
+	info := ActiveStreamInfo{
+		User:          as.User,
+		Engine:        as.Engine,
+		StartTime:     as.StartTime,
+		DonorFrames:   as.DonorFrames,
+		BufferFrames:  as.BufferFrames,
+		SessionFrames: as.sessionFrames,
+		LastHeartbeat: int(as.lastHeartbeat.Unix()),
+		FramesPerDay:  as.framesPerDay(),
+	}
+	if as.sessionFrames > 0 {
+		info.LastFrame = int(as.lastFrame.Unix())
+	}
+	if as.LastCheckpoint.IsZero() == false {
+		info.LastCheckpoint = int(as.LastCheckpoint.Unix())
+	}
+	if as.paused() {
+		info.Paused = true
+		info.PausedUntil = int(as.pausedUntil.Unix())
+	}
+	return info
+}
+
+// The progress of an active stream, see Manager.GetActiveStreams. Times are
+// unix timestamps, and those of events that did not happen yet are omitted.
+type ActiveStreamInfo struct {
+	User           string  `json:"user"`
+	Engine         string  `json:"engine"`
+	StartTime      int     `json:"start_time"`
+	DonorFrames    float64 `json:"donor_frames"`   // frames checkpointed by the donor
+	BufferFrames   int     `json:"buffer_frames"`  // frames posted since the last checkpoint
+	SessionFrames  int     `json:"session_frames"` // frames posted since activation
+	LastHeartbeat  int     `json:"last_heartbeat"`
+	LastFrame      int     `json:"last_frame,omitempty"`
+	LastCheckpoint int     `json:"last_checkpoint,omitempty"`
+	FramesPerDay   float64 `json:"frames_per_day,omitempty"` // once two frames were posted
+	NsPerDay       float64 `json:"ns_per_day,omitempty"`     // left for the caller to fill in
+	Paused         bool    `json:"paused,omitempty"`         // the donor paused the core, see Manager.PauseActiveStream
+	PausedUntil    int     `json:"paused_until,omitempty"`
+
+	Options map[string]interface{} `json:"-"` // overridden by the stream
+}
+
+// The streams activated and deactivated since a version of the Manager, keyed
+// by target then stream, see Manager.ActiveStreamsSince.
+type ActiveStreamsDelta struct {
+	Version     uint64                                 `json:"version"` // to pass as since in the next poll
+	Reset       bool                                   `json:"reset"`   // Activated lists every active stream, forget the others
+	Activated   map[string]map[string]ActiveStreamInfo `json:"activated"`
+	Deactivated map[string][]string                    `json:"deactivated"`
+}
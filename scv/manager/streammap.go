@@ -0,0 +1,90 @@
+package manager
+
+import (
+	"sync"
+)
+
+// Number of shards of a streamMap.
+const STREAM_MAP_SHARDS int = 64
+
+/*
+A map of keys, eg. streamIds or tokens, to streams, sharded by the hash of the
+keys so that looking up a stream does not contend with looking up or changing
+others. The lock of a shard is only held while the shard is read or changed,
+never while another lock is acquired, so it can be taken while holding the
+manager's or a stream's lock.
+*/
+type streamMap struct {
+	shards [STREAM_MAP_SHARDS]streamShard
+}
+
+type streamShard struct {
+	sync.RWMutex
+	streams map[string]*Stream
+}
+
+func newStreamMap() *streamMap {
+	sm := &streamMap{}
+	for i := range sm.shards {
+		sm.shards[i].streams = make(map[string]*Stream)
+	}
+	return sm
+}
+
+// FNV-1a, inlined so that lookups do not allocate.
+func (sm *streamMap) shard(key string) *streamShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return &sm.shards[hash%uint32(STREAM_MAP_SHARDS)]
+}
+
+// Returns the stream of key, or nil if there is none.
+func (sm *streamMap) get(key string) *Stream {
+	shard := sm.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+	return shard.streams[key]
+}
+
+func (sm *streamMap) set(key string, stream *Stream) {
+	shard := sm.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.streams[key] = stream
+}
+
+func (sm *streamMap) delete(key string) {
+	shard := sm.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	delete(shard.streams, key)
+}
+
+func (sm *streamMap) len() int {
+	n := 0
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		shard.RLock()
+		n += len(shard.streams)
+		shard.RUnlock()
+	}
+	return n
+}
+
+// Returns a copy of the map. Keys set or deleted while it is copied may or may
+// not be in the copy.
+func (sm *streamMap) snapshot() map[string]*Stream {
+	result := make(map[string]*Stream)
+	for i := range sm.shards {
+		shard := &sm.shards[i]
+		shard.RLock()
+		for key, stream := range shard.streams {
+			result[key] = stream
+		}
+		shard.RUnlock()
+	}
+	return result
+}
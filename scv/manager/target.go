@@ -0,0 +1,64 @@
+package manager
+
+type Target struct {
+	activeStreams   map[*Stream]struct{} // set of active streams
+	disabledStreams map[*Stream]struct{} // set of streams not eligible to be assigned
+	inactiveStreams *Set                 // queue of inactive streams
+	coolingStreams  map[*Stream]struct{} // inactive streams that failed recently, see Manager.coolStreamImpl
+	agingRate       float64              // frames of priority gained per hour since the last activation
+}
+
+/*
+Returns the priority of an inactive stream, streams of higher priority being
+activated first. Streams with more frames come first, but a stream gains
+agingRate frames of priority per hour since it was last activated, so that the
+streams with few frames are not starved. Since every stream ages at the same
+rate, the priority is offset by the current time so that it does not change
+while the stream waits in the queue. Managers can raise or lower a stream by its
+Priority, in frames.
+*/
+func (t *Target) priority(s *Stream) float64 {
+	return float64(s.queueFrames) + s.Priority - t.agingRate*float64(s.lastActivation)/3600
+}
+
+// Returns every stream of the target, whatever its state.
+func (t *Target) streams() []*Stream {
+	result := make([]*Stream, 0, len(t.activeStreams)+t.inactiveStreams.Len()+len(t.coolingStreams)+len(t.disabledStreams))
+	for s := range t.activeStreams {
+		result = append(result, s)
+	}
+	for i := t.inactiveStreams.Iterator(); i.Next(); {
+		result = append(result, i.Key().(*Stream))
+	}
+	for s := range t.coolingStreams {
+		result = append(result, s)
+	}
+	for s := range t.disabledStreams {
+		result = append(result, s)
+	}
+	return result
+}
+
+func (t *Target) streamComp(l, r interface{}) bool {
+	s1 := l.(*Stream)
+	s2 := r.(*Stream)
+	p1, p2 := t.priority(s1), t.priority(s2)
+	if p1 == p2 {
+		return s1.StreamId > s2.StreamId
+	} else {
+		return p1 > p2
+	}
+}
+
+func NewTarget(agingRate float64) *Target {
+	target := Target{
+		// tokens:          make(map[string]*Stream),
+		activeStreams:   make(map[*Stream]struct{}),
+		disabledStreams: make(map[*Stream]struct{}),
+		coolingStreams:  make(map[*Stream]struct{}),
+		agingRate:       agingRate,
+		// timers:          make(map[string]*time.Timer),
+	}
+	target.inactiveStreams = NewCustomSet(target.streamComp)
+	return &target
+}
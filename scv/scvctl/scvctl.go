@@ -0,0 +1,221 @@
+/*
+Command scvctl manages the streams of an SCV from the command line:
+
+    scvctl [flags] command [arguments]
+
+The SCV and the token default to the SCV_HOST and SCV_TOKEN environment
+variables. Commands acting on streams need a manager's token, drain and resume
+need the SCV's password.
+*/
+package main
+
+import (
+	"../client"
+	"../src"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const USAGE = `Commands:
+  streams TARGET_ID          list the streams of a target by state
+  active                     list the active streams
+  enable STREAM_ID...        make streams eligible for activation
+  disable STREAM_ID...       stop streams and keep them from being activated
+  delete STREAM_ID...        delete streams
+  truncate STREAM_ID FRAMES  discard the frames of a stream after FRAMES
+  events [TARGET_ID...]      print the events of your streams as they happen
+  drain                      stop activating streams, wait for active ones to stop
+  resume                     activate streams again after a drain
+  export STREAM_ID [FILE]    save the tarball of a stream, to STREAM_ID.tar by default
+  verify STREAM_ID...        check the checksums of the files of streams
+`
+
+type command struct {
+	args int // minimum number of arguments
+	run  func(c *client.Client, args []string) error
+}
+
+var commands = map[string]command{
+	"streams":  {1, listStreams},
+	"active":   {0, activeStreams},
+	"enable":   {1, forEach((*client.Client).EnableStream)},
+	"disable":  {1, forEach((*client.Client).DisableStream)},
+	"delete":   {1, forEach((*client.Client).DeleteStream)},
+	"truncate": {2, truncate},
+	"events":   {0, tailEvents},
+	"drain":    {0, drain},
+	"resume":   {0, resume},
+	"export":   {1, export},
+	"verify":   {1, verify},
+}
+
+// Applies fn to every stream given, stopping at the first failure.
+func forEach(fn func(*client.Client, string) error) func(*client.Client, []string) error {
+	return func(c *client.Client, streamIds []string) error {
+		for _, streamId := range streamIds {
+			if err := fn(c, streamId); err != nil {
+				return errors.New(streamId + ": " + err.Error())
+			}
+			fmt.Println(streamId)
+		}
+		return nil
+	}
+}
+
+func listStreams(c *client.Client, args []string) error {
+	reply, err := c.TargetStreams(args[0])
+	if err != nil {
+		return err
+	}
+	show := func(ids []string, state string) {
+		for _, id := range ids {
+			fmt.Println(id, state)
+		}
+	}
+	show(reply.Active, "active")
+	show(reply.Inactive, "inactive")
+	show(reply.Disabled, "disabled")
+	return nil
+}
+
+func activeStreams(c *client.Client, args []string) error {
+	active, err := c.ActiveStreams()
+	if err != nil {
+		return err
+	}
+	targetIds := make([]string, 0, len(active))
+	for targetId := range active {
+		targetIds = append(targetIds, targetId)
+	}
+	sort.Strings(targetIds)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "target\tstream\tuser\tengine\tstarted\tframes\tbuffered\theartbeat\tns/day")
+	for _, targetId := range targetIds {
+		ids := make([]string, 0, len(active[targetId]))
+		for id := range active[targetId] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			s := active[targetId][id]
+			nsPerDay := "-"
+			if s.NsPerDay > 0 {
+				nsPerDay = strconv.FormatFloat(s.NsPerDay, 'f', 1, 64)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n", targetId, id, s.User, s.Engine,
+				time.Unix(int64(s.StartTime), 0).Format(time.RFC3339), s.SessionFrames, s.BufferFrames,
+				time.Unix(int64(s.LastHeartbeat), 0).Format(time.RFC3339), nsPerDay)
+		}
+	}
+	return w.Flush()
+}
+
+func truncate(c *client.Client, args []string) error {
+	frames, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errors.New("bad frame count: " + args[1])
+	}
+	point, err := c.Truncate(args[0], frames)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d frames, restarting from checkpoint %d\n", args[0], point.Partition, point.Checkpoint)
+	return nil
+}
+
+func tailEvents(c *client.Client, targetIds []string) error {
+	return c.Events(targetIds, func(e scv.Event) error {
+		data, err := json.Marshal(e.Data)
+		if err != nil {
+			return err
+		}
+		fmt.Println(time.Unix(int64(e.Time), 0).Format(time.RFC3339), e.Type, e.TargetId, e.StreamId, string(data))
+		return nil
+	})
+}
+
+// Start draining and poll the SCV until no stream is active.
+func drain(c *client.Client, args []string) error {
+	for {
+		reply, err := c.Drain(true)
+		if err != nil {
+			return err
+		}
+		fmt.Println(reply.ActiveStreams, "active streams")
+		if reply.ActiveStreams == 0 {
+			return nil
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func resume(c *client.Client, args []string) error {
+	_, err := c.Drain(false)
+	return err
+}
+
+func export(c *client.Client, args []string) error {
+	path := args[0] + ".tar"
+	if len(args) > 1 {
+		path = args[1]
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := c.Export(args[0], file); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+func verify(c *client.Client, streamIds []string) error {
+	corrupted := 0
+	for _, streamId := range streamIds {
+		checked, corruptions, err := c.Verify(streamId)
+		if err != nil {
+			return errors.New(streamId + ": " + err.Error())
+		}
+		fmt.Printf("%s: %d checkpoints checked, %d corrupted\n", streamId, checked, len(corruptions))
+		for _, corruption := range corruptions {
+			fmt.Printf("  partition %d, checkpoint %d: %s\n",
+				corruption.Partition, corruption.Checkpoint, strings.Join(corruption.Files, ", "))
+		}
+		corrupted += len(corruptions)
+	}
+	if corrupted > 0 {
+		return errors.New("corrupted checkpoints found")
+	}
+	return nil
+}
+
+func main() {
+	host := flag.String("scv", os.Getenv("SCV_HOST"), "url of the SCV, eg. https://vspg11.stanford.edu:8080")
+	token := flag.String("token", os.Getenv("SCV_TOKEN"), "manager token, or the SCV's password for drain and resume")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: scvctl [flags] command [arguments]")
+		flag.PrintDefaults()
+		fmt.Fprint(os.Stderr, USAGE)
+	}
+	flag.Parse()
+	cmd, ok := commands[flag.Arg(0)]
+	if ok == false || flag.NArg()-1 < cmd.args || *host == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	c := client.New(*host, *token)
+	if err := cmd.run(c, flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "scvctl:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,280 @@
+package scv
+
+import (
+	"../manager"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+)
+
+// A target that a core may be assigned to.
+type candidate struct {
+	targetId string
+	weight   float64
+}
+
+// Reads the weight field of a target or manager document, 1 by default.
+func targetWeight(doc map[string]interface{}) float64 {
+	switch v := doc["weight"].(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return 1
+}
+
+// Returns the candidates in a random order where targets with a larger weight
+// tend to come first. Candidates with a weight of 0 come last.
+func weightedOrder(candidates []candidate) []candidate {
+	remaining := append([]candidate{}, candidates...)
+	result := make([]candidate, 0, len(candidates))
+	for len(remaining) > 0 {
+		total := 0.0
+		for _, c := range remaining {
+			total += c.weight
+		}
+		picked := 0
+		if total > 0 {
+			x := rand.Float64() * total
+			for picked = 0; picked < len(remaining)-1; picked++ {
+				x -= remaining[picked].weight
+				if x < 0 {
+					break
+				}
+			}
+		} else {
+			picked = rand.Intn(len(remaining))
+		}
+		result = append(result, remaining[picked])
+		remaining = append(remaining[:picked], remaining[picked+1:]...)
+	}
+	return result
+}
+
+/*
+Weigh targets so that managers are picked in proportion to their weight, and
+each manager's targets in proportion to theirs. owners maps each target to its
+owner, and weights holds the weight of every manager.
+*/
+func ownerWeighted(candidates []candidate, owners map[string]string, weights map[string]float64) []candidate {
+	totals := make(map[string]float64)
+	for _, c := range candidates {
+		totals[owners[c.targetId]] += c.weight
+	}
+	result := make([]candidate, 0, len(candidates))
+	for _, c := range candidates {
+		owner := owners[c.targetId]
+		weight := 0.0
+		if totals[owner] > 0 {
+			weight = weights[owner] * c.weight / totals[owner]
+		}
+		result = append(result, candidate{c.targetId, weight})
+	}
+	return result
+}
+
+// Returns the weight of each manager in users.managers. Users that are no
+// longer managers have a weight of 0.
+func (app *Application) managerWeights(users []string) (map[string]float64, error) {
+	docs, err := app.Database.Managers(users)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]float64)
+	for _, doc := range docs {
+		user, _ := doc["_id"].(string)
+		result[user] = targetWeight(doc)
+	}
+	return result, nil
+}
+
+// Returns the public targets supporting engine that have idle streams on this
+// SCV, weighted by the weights of their owners and their own. Paused targets
+// and targets whose min_engine_version is newer than version are left out, and
+// ErrUpgradeRequired is returned if that leaves none.
+func (app *Application) assignableTargets(engine, version string) ([]candidate, error) {
+	idle := app.Manager.IdleTargets()
+	ids := make([]string, 0, len(idle))
+	for targetId := range idle {
+		ids = append(ids, targetId)
+	}
+	docs, err := app.Database.PublicTargets(ids, engine)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]candidate, 0, len(docs))
+	owners := make(map[string]string)
+	users := make([]string, 0)
+	seen := make(map[string]bool)
+	oldest := ""
+	for _, doc := range docs {
+		targetId, _ := doc["_id"].(string)
+		owner, _ := doc["owner"].(string)
+		options, _ := doc["options"].(map[string]interface{})
+		if optionBool(options, "paused", false) {
+			continue
+		}
+		minVersion := optionString(options, "min_engine_version", "")
+		if minVersion != "" && compareVersions(version, minVersion) < 0 {
+			if oldest == "" || compareVersions(minVersion, oldest) < 0 {
+				oldest = minVersion
+			}
+			continue
+		}
+		result = append(result, candidate{targetId, targetWeight(doc)})
+		owners[targetId] = owner
+		if seen[owner] == false {
+			users = append(users, owner)
+			seen[owner] = true
+		}
+	}
+	if len(result) == 0 && oldest != "" {
+		return nil, upgradeRequired(engine, version, oldest)
+	}
+	weights, err := app.managerWeights(users)
+	if err != nil {
+		return nil, err
+	}
+	return ownerWeighted(result, owners, weights), nil
+}
+
+// Activate a stream of one of the targets, picked at random in proportion to
+// their weights. Returns the core's token, or ErrTargetPaused or
+// ErrTargetAtCapacity if every target refused the activation that way.
+func (app *Application) activateWeighted(ctx context.Context, candidates []candidate, user, engine, requestId string) (activation, error) {
+	var refusal error
+	// another core may take the last idle stream of a target first
+	for i, c := range weightedOrder(candidates) {
+		if err := ctx.Err(); err != nil {
+			return activation{}, err
+		}
+		session, err := app.activateStream(ctx, c.targetId, user, engine, requestId, 0)
+		if err == nil {
+			return session, nil
+		} else if err == manager.ErrDonorLimit {
+			return activation{}, err
+		}
+		if i == 0 || err == refusal {
+			refusal = err
+		} else {
+			refusal = nil
+		}
+	}
+	if refusal == manager.ErrTargetPaused || refusal == manager.ErrTargetAtCapacity {
+		return activation{}, refusal
+	}
+	return activation{}, errors.New("no streams available")
+}
+
+// Returns the URL of /core/start on this SCV, which cores are sent to once
+// a stream was activated for them.
+func (app *Application) coreStartURL() string {
+	scheme := "http"
+	if len(app.Settings().SSL) > 0 {
+		scheme = "https"
+	}
+	return scheme + "://" + app.Config.ExternalHost + "/core/start"
+}
+
+/*
+.. http:post:: /assign
+    Assign a stream of this SCV to a core, so that an SCV can be used
+    without a CC. Unless a target is given, a public target supporting
+    the core's engine is picked at random: managers are picked in
+    proportion to their weights, then one of their targets in proportion
+    to the targets' weights.
+    :reqheader Authorization: Engine key
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "donor_token": "token", // optional
+            "target_id": "target_id", // optional
+            "engine_version": "6.1.2" // optional
+        }
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "token": "6lk2j5-tpoi2p6-poipoi23",
+            "url": "https://raynor.stanford.edu:1234/core/start"
+        }
+    :status 200: OK
+    :status 400: Bad request
+    :status 401: Bad engine key or donor token
+    :status 403: Engine not allowed for the target, or the donor or
+        engine is banned
+    :status 426: ``engine_version`` is older than the target's
+        ``min_engine_version``, or than that of every public target when
+        none is given. The error's details hold ``engine``,
+        ``engine_version`` and ``min_engine_version``.
+    :status 429: The donor has ``MaxDonorStreams`` active streams, or
+        ``target_id`` has ``max_active_streams`` active streams
+    :status 503: SCV is draining or under maintenance, or ``target_id``
+        is paused
+    :status 507: SCV full
+*/
+func (app *Application) AssignHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		engine, err := app.Database.EngineByKey(r.Header.Get("Authorization"))
+		if err != nil {
+			return ErrUnauthorized.With("Bad engine key")
+		}
+		if app.ReadOnly() {
+			return ErrFull
+		}
+		if app.Draining() {
+			return errDraining
+		}
+		if err := app.checkMaintenance(); err != nil {
+			return err
+		}
+		msg := AssignRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return errors.New("Could not decode JSON")
+		}
+		user := ""
+		if msg.DonorToken != "" {
+			if user, err = app.tokenUser(msg.DonorToken); err != nil {
+				return ErrUnauthorized.With("Bad donor token")
+			}
+		}
+		if err := app.checkBan(user, engine); err != nil {
+			return err
+		}
+		var candidates []candidate
+		if msg.TargetId != "" {
+			ok, err := app.Database.TargetSupports(msg.TargetId, engine)
+			if err != nil {
+				return err
+			}
+			if ok == false {
+				return ErrForbidden.With("Core engine not allowed for this target")
+			}
+			if err := app.checkEngineVersion(msg.TargetId, engine, msg.EngineVersion); err != nil {
+				return err
+			}
+			candidates = []candidate{{msg.TargetId, 1}}
+		} else {
+			if candidates, err = app.assignableTargets(engine, msg.EngineVersion); err != nil {
+				return err
+			}
+		}
+		session, err := app.activateWeighted(r.Context(), candidates, user, engine, requestId(r))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(AssignReply{
+			Token: session.token,
+			URL:   app.coreStartURL(),
+		})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
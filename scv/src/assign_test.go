@@ -0,0 +1,38 @@
+package scv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedOrder(t *testing.T) {
+	candidates := []candidate{{"heavy", 3}, {"light", 1}, {"never", 0}}
+	first := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		order := weightedOrder(candidates)
+		assert.Equal(t, len(order), 3)
+		assert.Equal(t, order[2].targetId, "never")
+		first[order[0].targetId] += 1
+	}
+	assert.Equal(t, first["never"], 0)
+	assert.InDelta(t, first["heavy"], 3000, 200)
+	assert.InDelta(t, first["light"], 1000, 200)
+	// the input is left untouched
+	assert.Equal(t, candidates[0].targetId, "heavy")
+}
+
+func TestOwnerWeighted(t *testing.T) {
+	candidates := []candidate{{"a1", 1}, {"a2", 3}, {"b1", 5}, {"c1", 1}}
+	owners := map[string]string{"a1": "alice", "a2": "alice", "b1": "bob", "c1": "carol"}
+	weights := map[string]float64{"alice": 2, "bob": 1}
+	result := ownerWeighted(candidates, owners, weights)
+	// alice's weight is split 1:3 between her targets, carol is not a manager
+	assert.Equal(t, result, []candidate{{"a1", 0.5}, {"a2", 1.5}, {"b1", 1}, {"c1", 0}})
+}
+
+func TestTargetWeight(t *testing.T) {
+	assert.Equal(t, targetWeight(map[string]interface{}{"weight": 2}), 2.0)
+	assert.Equal(t, targetWeight(map[string]interface{}{"weight": 0.5}), 0.5)
+	assert.Equal(t, targetWeight(map[string]interface{}{}), 1.0)
+}
@@ -0,0 +1,401 @@
+package scv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of the AuthProviders of the configuration.
+const (
+	AUTH_TOKENS string = "tokens" // the tokens of users.all and the API tokens of /auth/tokens
+	AUTH_OIDC   string = "oidc"   // bearer JWTs signed by an OAuth2 or OpenID Connect issuer
+)
+
+// Seconds of clock skew tolerated when checking the exp and nbf of a JWT.
+const JWT_LEEWAY int = 60
+
+// Seconds the keys of an issuer are kept before being fetched again. They are
+// fetched sooner when a token is signed by an unknown key, but at most every
+// JWKS_MIN_REFRESH seconds.
+const JWKS_TTL int = 3600
+const JWKS_MIN_REFRESH int = 60
+
+// Seconds the SCV waits for the discovery document and keys of an issuer.
+const JWKS_TIMEOUT int = 10
+
+/*
+Identifies the user of an authorization token. The providers of the
+AuthProviders of the configuration are tried in turn by Application.tokenUser,
+and the first one to know the token wins. Authenticate returns ErrNotFound if
+the token is not one of the provider's, so that the next one is tried.
+*/
+type AuthProvider interface {
+	Authenticate(token string) (Identity, error)
+}
+
+// The user a token identifies, and what the token may be used for.
+type Identity struct {
+	User    string
+	Expires time.Time // zero if only the TokenCacheTTL applies
+	Scopes  []string  // of a service token, see ScopeMiddleware
+	Targets []string  // a service token is restricted to
+}
+
+/*
+An authentication provider of the configuration, eg.
+
+	"AuthProviders": [
+	    {"Type": "tokens"},
+	    {"Type": "oidc", "Issuer": "https://sso.example.edu", "Audience": "scv", "UserClaim": "preferred_username"}
+	]
+
+Users authenticated by SSO are managers if they have a document in
+users.managers, like any other user.
+*/
+type AuthProviderConfig struct {
+	Type      string `json:"Type"`      // AUTH_TOKENS or AUTH_OIDC
+	Issuer    string `json:"Issuer"`    // iss of the tokens, whose discovery document lists the keys
+	Audience  string `json:"Audience"`  // the aud the tokens must have, eg. the client id of the SCV
+	UserClaim string `json:"UserClaim"` // claim holding the name of the user, "sub" if empty
+	JWKSURI   string `json:"JWKSURI"`   // keys of the issuer, for OAuth2 servers without discovery
+}
+
+// Returns the providers of the configuration, or the tokens of the database
+// alone if there are none.
+func newAuthProviders(db Database, configs []AuthProviderConfig) ([]AuthProvider, error) {
+	providers := make([]AuthProvider, 0, len(configs))
+	for _, config := range configs {
+		switch config.Type {
+		case AUTH_TOKENS:
+			providers = append(providers, &tokenAuth{db})
+		case AUTH_OIDC:
+			if config.Issuer == "" || config.Audience == "" {
+				return nil, errors.New("oidc auth providers need an Issuer and an Audience")
+			}
+			providers = append(providers, newOIDCAuth(config))
+		default:
+			return nil, errors.New("Unknown auth provider " + config.Type)
+		}
+	}
+	if len(providers) == 0 {
+		providers = append(providers, &tokenAuth{db})
+	}
+	return providers, nil
+}
+
+// Returns the providers tokens are checked against.
+func (app *Application) authProviders() []AuthProvider {
+	app.configMutex.RLock()
+	defer app.configMutex.RUnlock()
+	if app.auth == nil {
+		return []AuthProvider{&tokenAuth{app.Database}}
+	}
+	return app.auth
+}
+
+func (app *Application) setAuthProviders(providers []AuthProvider) {
+	app.configMutex.Lock()
+	app.auth = providers
+	app.configMutex.Unlock()
+}
+
+// Authenticates the user tokens of users.all and the APITokens of
+// /auth/tokens.
+type tokenAuth struct {
+	db Database
+}
+
+func (a *tokenAuth) Authenticate(token string) (Identity, error) {
+	if user, err := a.db.UserByToken(token); err == nil {
+		return Identity{User: user}, nil
+	}
+	doc, err := a.db.TokenBySecret(token)
+	if err != nil {
+		return Identity{}, ErrNotFound
+	}
+	if doc.Expired() {
+		return Identity{}, ErrUnauthorized.With("Token expired")
+	}
+	identity := Identity{User: doc.User, Scopes: doc.Scopes, Targets: doc.Targets}
+	if doc.Expires > 0 {
+		identity.Expires = time.Unix(int64(doc.Expires), 0)
+	}
+	return identity, nil
+}
+
+/*
+Authenticates the JWTs issued by an OAuth2 or OpenID Connect server, as bearer
+tokens. Tokens must be signed with RS256, RS384, RS512, ES256 or ES384 by one
+of the keys of the issuer, have its iss and the configured aud, and must not be
+expired. Their identification expires along with them.
+*/
+type oidcAuth struct {
+	issuer    string
+	audience  string
+	userClaim string
+	jwksURI   string // found through discovery if empty
+	client    *http.Client
+
+	sync.Mutex
+	keys    map[string]crypto.PublicKey // by kid
+	fetched time.Time
+}
+
+func newOIDCAuth(config AuthProviderConfig) *oidcAuth {
+	a := &oidcAuth{
+		issuer:    config.Issuer,
+		audience:  config.Audience,
+		userClaim: config.UserClaim,
+		jwksURI:   config.JWKSURI,
+		client:    &http.Client{Timeout: time.Duration(JWKS_TIMEOUT) * time.Second},
+	}
+	if a.userClaim == "" {
+		a.userClaim = "sub"
+	}
+	return a
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (a *oidcAuth) Authenticate(token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, ErrNotFound
+	}
+	header := jwtHeader{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return Identity{}, ErrNotFound
+	}
+	claims := make(map[string]interface{})
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return Identity{}, ErrNotFound
+	}
+	if iss, _ := claims["iss"].(string); iss != a.issuer {
+		// tokens of other issuers are left to the other providers
+		return Identity{}, ErrNotFound
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, ErrUnauthorized.With("Bad signature")
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return Identity{}, err
+	}
+	if err := verifyJWT(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return Identity{}, ErrUnauthorized.With(err.Error())
+	}
+	now := time.Now()
+	leeway := time.Duration(JWT_LEEWAY) * time.Second
+	exp, ok := claims["exp"].(float64)
+	if ok == false {
+		return Identity{}, ErrUnauthorized.With("Token has no exp")
+	}
+	expires := time.Unix(int64(exp), 0)
+	if now.After(expires.Add(leeway)) {
+		return Identity{}, ErrUnauthorized.With("Token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && time.Unix(int64(nbf), 0).After(now.Add(leeway)) {
+		return Identity{}, ErrUnauthorized.With("Token not valid yet")
+	}
+	if hasString(claims["aud"], a.audience) == false {
+		return Identity{}, ErrUnauthorized.With("Token is not meant for " + a.audience)
+	}
+	user, _ := claims[a.userClaim].(string)
+	if user == "" {
+		return Identity{}, ErrUnauthorized.With("Token has no " + a.userClaim)
+	}
+	return Identity{User: user, Expires: expires}, nil
+}
+
+func decodeJWTPart(part string, result interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, result)
+}
+
+// Check the signature of the signed part of a JWT.
+func verifyJWT(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return errors.New("Unsupported alg " + alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' || rsa.VerifyPKCS1v15(k, hash, digest, signature) != nil {
+			return errors.New("Bad signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(signature) != 2*size {
+			return errors.New("Bad signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if ecdsa.Verify(k, digest, r, s) == false {
+			return errors.New("Bad signature")
+		}
+	default:
+		return errors.New("Unsupported key")
+	}
+	return nil
+}
+
+// Returns the key of the issuer with kid, fetching the keys again if they are
+// stale or kid is unknown.
+func (a *oidcAuth) key(kid string) (crypto.PublicKey, error) {
+	a.Lock()
+	defer a.Unlock()
+	now := time.Now()
+	key, ok := a.keys[kid]
+	stale := now.Sub(a.fetched) > time.Duration(JWKS_TTL)*time.Second
+	if (ok == false || stale) && now.Sub(a.fetched) > time.Duration(JWKS_MIN_REFRESH)*time.Second {
+		keys, err := a.fetchKeys()
+		if err != nil {
+			if ok {
+				// keep using the keys we have while the issuer is down
+				return key, nil
+			}
+			return nil, ErrUnavailable.With("Unable to fetch the keys of " + a.issuer + ": " + err.Error())
+		}
+		a.keys, a.fetched = keys, now
+		key, ok = a.keys[kid]
+	}
+	if ok == false {
+		return nil, ErrUnauthorized.With("Unknown key " + kid)
+	}
+	return key, nil
+}
+
+// Fetch the JSON document at url into result.
+func (a *oidcAuth) get(url string, result interface{}) error {
+	resp, err := a.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(url + " replied " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Fetch the keys of the issuer, looking up their URI in its discovery document
+// unless it is configured.
+func (a *oidcAuth) fetchKeys() (map[string]crypto.PublicKey, error) {
+	uri := a.jwksURI
+	if uri == "" {
+		discovery := struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		if err := a.get(strings.TrimSuffix(a.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.Issuer != a.issuer || discovery.JWKSURI == "" {
+			return nil, errors.New("Bad discovery document")
+		}
+		uri = discovery.JWKSURI
+	}
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := a.get(uri, &jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// keys of unsupported types are skipped
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// A public key of a JWK Set, see RFC 7517.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(data) == 0 {
+			return nil, errors.New("Bad key")
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || e.IsInt64() == false {
+			return nil, errors.New("Bad key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, errors.New("Unsupported curve " + k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if curve.IsOnCurve(x, y) == false {
+			return nil, errors.New("Bad key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("Unsupported key type " + k.Kty)
+}
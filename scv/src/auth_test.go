@@ -0,0 +1,195 @@
+package scv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Serves the discovery document and keys of an OIDC issuer.
+type testIssuer struct {
+	*httptest.Server
+	keys    []map[string]string
+	fetches int
+}
+
+func newTestIssuer() *testIssuer {
+	issuer := &testIssuer{}
+	issuer.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.URL, "jwks_uri": issuer.URL + "/keys"})
+		case "/keys":
+			issuer.fetches += 1
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": issuer.keys})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return issuer
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signJWT(alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64(signature)
+}
+
+func TestOIDCAuth(t *testing.T) {
+	issuer := newTestIssuer()
+	defer issuer.Close()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	issuer.keys = []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+	}
+	_, err := newAuthProviders(nil, []AuthProviderConfig{{Type: AUTH_OIDC, Issuer: issuer.URL}})
+	assert.NotNil(t, err)
+	_, err = newAuthProviders(nil, []AuthProviderConfig{{Type: "ldap"}})
+	assert.NotNil(t, err)
+	providers, err := newAuthProviders(nil, []AuthProviderConfig{
+		{Type: AUTH_OIDC, Issuer: issuer.URL, Audience: "scv", UserClaim: "preferred_username"},
+	})
+	assert.Nil(t, err)
+	auth := providers[0]
+
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": issuer.URL, "aud": []string{"scv", "other"}, "exp": exp,
+			"sub": "1234", "preferred_username": "yutong"}
+		for key, value := range changes {
+			if value == nil {
+				delete(c, key)
+			} else {
+				c[key] = value
+			}
+		}
+		return c
+	}
+	tamper := func(token string) string {
+		parts := strings.Split(token, ".")
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		signature[0] ^= 1
+		return parts[0] + "." + parts[1] + "." + b64(signature)
+	}
+	identity, err := auth.Authenticate(signJWT("RS256", "rsa", rsaKey, claims(nil)))
+	assert.Nil(t, err)
+	assert.Equal(t, identity.User, "yutong")
+	assert.Equal(t, identity.Expires.Unix(), exp)
+
+	// tokens that are not JWTs of the issuer are left to other providers
+	for _, token := range []string{"secret", "a.b.c", signJWT("RS256", "rsa", rsaKey, claims(map[string]interface{}{"iss": "https://other"}))} {
+		_, err = auth.Authenticate(token)
+		assert.Equal(t, err, ErrNotFound)
+	}
+	for _, token := range []string{
+		signJWT("RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": "other"})),
+		signJWT("RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})),
+		signJWT("RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": nil})),
+		signJWT("RS256", "rsa", rsaKey, claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})),
+		signJWT("RS256", "rsa", rsaKey, claims(map[string]interface{}{"preferred_username": nil})),
+		signJWT("HS256", "rsa", rsaKey, claims(nil)),
+		signJWT("ES256", "rsa", ecKey, claims(nil)),
+		tamper(signJWT("RS256", "rsa", rsaKey, claims(nil))),
+	} {
+		_, err = auth.Authenticate(token)
+		assert.NotNil(t, err)
+		assert.NotEqual(t, err, ErrNotFound)
+	}
+	unsigned := strings.Split(signJWT("RS256", "rsa", rsaKey, claims(nil)), ".")
+	header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "rsa"})
+	_, err = auth.Authenticate(b64(header) + "." + unsigned[1] + ".")
+	assert.NotNil(t, err)
+	assert.Equal(t, issuer.fetches, 1)
+
+	// unknown keys are fetched again, but not more than every JWKS_MIN_REFRESH
+	issuer.keys = append(issuer.keys, map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256",
+		"x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))})
+	token := signJWT("ES256", "ec", ecKey, claims(nil))
+	_, err = auth.Authenticate(token)
+	assert.NotNil(t, err)
+	auth.(*oidcAuth).fetched = time.Now().Add(-time.Duration(JWKS_MIN_REFRESH) * time.Second)
+	identity, err = auth.Authenticate(token)
+	assert.Nil(t, err)
+	assert.Equal(t, identity.User, "yutong")
+	assert.Equal(t, issuer.fetches, 2)
+}
+
+func TestTokenUser(t *testing.T) {
+	issuer := newTestIssuer()
+	defer issuer.Close()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	issuer.keys = []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+	}
+	dir, _ := ioutil.TempDir("", "auth")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	db.InsertToken(APIToken{Id: "a", Token: "secret", User: "jesse_v"})
+	db.InsertToken(APIToken{Id: "b", Token: "expired", User: "jesse_v", Expires: 1})
+	app := &Application{Database: db, tokenCache: NewTokenCache(time.Minute)}
+
+	// the tokens of the database are used if no provider is configured
+	user, err := app.tokenUser("secret")
+	assert.Nil(t, err)
+	assert.Equal(t, user, "jesse_v")
+	_, err = app.tokenUser("expired")
+	assert.Equal(t, err.(*StatusError).Status, 401)
+
+	providers, _ := newAuthProviders(db, []AuthProviderConfig{
+		{Type: AUTH_TOKENS},
+		{Type: AUTH_OIDC, Issuer: issuer.URL, Audience: "scv"},
+	})
+	app.setAuthProviders(providers)
+	token := signJWT("RS256", "rsa", rsaKey, map[string]interface{}{"iss": issuer.URL, "aud": "scv",
+		"exp": time.Now().Add(time.Hour).Unix(), "sub": "yutong"})
+	user, err = app.tokenUser("Bearer " + token)
+	assert.Nil(t, err)
+	assert.Equal(t, user, "yutong")
+	user, err = app.tokenUser("Bearer secret")
+	assert.Nil(t, err)
+	assert.Equal(t, user, "jesse_v")
+	_, err = app.tokenUser("unknown")
+	assert.Equal(t, err, ErrNotFound)
+
+	// only SSO users are known once the tokens of the database are removed
+	providers, _ = newAuthProviders(db, []AuthProviderConfig{{Type: AUTH_OIDC, Issuer: issuer.URL, Audience: "scv"}})
+	app.setAuthProviders(providers)
+	app.tokenCache.Clear()
+	_, err = app.tokenUser("secret")
+	assert.Equal(t, err, ErrNotFound)
+	user, _ = app.tokenUser(token)
+	assert.Equal(t, user, "yutong")
+}
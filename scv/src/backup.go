@@ -0,0 +1,304 @@
+package scv
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Name of the tar entry holding the stream's Mongo document.
+const MANIFEST_NAME string = "manifest.json"
+
+// Write a tar entry for a regular file or a directory.
+func writeTarEntry(writer *tar.Writer, name string, info os.FileInfo, path string) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if err := writer.WriteHeader(header); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(writer, src)
+	return err
+}
+
+// Convert json.Numbers decoded from a manifest into ints or floats so they
+// are stored as numbers in Mongo.
+func normalizeManifest(doc map[string]interface{}) {
+	for key, value := range doc {
+		switch v := value.(type) {
+		case json.Number:
+			if i, err := v.Int64(); err == nil {
+				doc[key] = int(i)
+			} else if f, err := v.Float64(); err == nil {
+				doc[key] = f
+			}
+		case map[string]interface{}:
+			normalizeManifest(v)
+		}
+	}
+}
+
+// Move the entries of the directory src into dst.
+func moveEntries(src, dst string) error {
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+.. http:get:: /streams/export/:stream_id
+    Export a stream as a single tarball. The first entry is
+    ``manifest.json``, containing the stream's Mongo document, followed
+    by the seed files, tags, partitions, checkpoints and archives laid
+    out exactly as they are in the stream directory. Buffered frames
+    that have not been checkpointed are not exported.
+    :reqheader Authorization: Manager's authorization token
+    :resheader Content-Type: application/x-tar
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) StreamExportHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		return app.Manager.ReadStream(streamId, func(stream *Stream) error {
+			if app.canManage(user, stream) == false {
+				return ErrForbidden.With("You do not own this stream.")
+			}
+			doc := bson.M{}
+			if err := app.Database.FindStream(streamId, &doc); err != nil {
+				return errors.New("Unable to find stream in DB")
+			}
+			manifest, err := json.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			streamDir := app.StreamDir(streamId)
+			w.Header().Set("Content-Type", "application/x-tar")
+			w.Header().Set("Content-Disposition", "attachment; filename="+streamId+".tar")
+			writer := tar.NewWriter(w)
+			header := &tar.Header{
+				Name:    MANIFEST_NAME,
+				Mode:    0644,
+				Size:    int64(len(manifest)),
+				ModTime: time.Now(),
+			}
+			if err := writer.WriteHeader(header); err != nil {
+				return err
+			}
+			if _, err := writer.Write(manifest); err != nil {
+				return err
+			}
+			err = filepath.Walk(streamDir, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				name, err := filepath.Rel(streamDir, path)
+				if err != nil {
+					return err
+				}
+				if name == "." {
+					return nil
+				}
+				if name == "buffer_files" {
+					return filepath.SkipDir
+				}
+				return writeTarEntry(writer, name, info, path)
+			})
+			if err != nil {
+				return err
+			}
+			return writer.Close()
+		})
+	}
+}
+
+/*
+.. http:post:: /streams/import
+    Import a stream previously exported with ``/streams/export``. The
+    stream keeps its id (rewritten to belong to this SCV), its target,
+    error count and status. Its frame count is recomputed from the
+    imported partitions. The importing manager becomes the owner, and
+    the stream moves to its namespace.
+    :reqheader Authorization: Manager's authorization token
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "stream_id" : "715c592f-8487-46ac-a4b6-838e3b5c2543:hello"
+        }
+    :status 200: OK
+    :status 400: Bad request
+    :status 507: SCV full
+*/
+func (app *Application) StreamImportHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		if app.ReadOnly() {
+			return ErrFull
+		}
+		tmpDir := filepath.Join(app.TmpDir(), RandSeq(12))
+		if err := os.MkdirAll(tmpDir, 0776); err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		reader := tar.NewReader(r.Body)
+		var doc map[string]interface{}
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return errors.New("Bad request: " + err.Error())
+			}
+			name := filepath.Clean(filepath.FromSlash(header.Name))
+			if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+				return errors.New("Invalid file path: " + header.Name)
+			}
+			if name == MANIFEST_NAME {
+				decoder := json.NewDecoder(reader)
+				decoder.UseNumber()
+				if err := decoder.Decode(&doc); err != nil {
+					return errors.New("Bad manifest: " + err.Error())
+				}
+				continue
+			}
+			path := filepath.Join(tmpDir, name)
+			switch header.Typeflag {
+			case tar.TypeDir:
+				err = os.MkdirAll(path, 0776)
+			case tar.TypeReg:
+				os.MkdirAll(filepath.Dir(path), 0776)
+				var file *os.File
+				file, err = os.Create(path)
+				if err == nil {
+					_, err = io.Copy(file, reader)
+					file.Close()
+				}
+			default:
+				err = errors.New("Unsupported entry: " + header.Name)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if doc == nil {
+			return errors.New("Missing " + MANIFEST_NAME)
+		}
+		normalizeManifest(doc)
+		oldId, _ := doc["_id"].(string)
+		targetId, _ := doc["target_id"].(string)
+		if len(oldId) < 36 || targetId == "" {
+			return errors.New("Bad manifest: missing _id or target_id")
+		}
+		if err := app.checkTokenTargets(r, targetId); err != nil {
+			return err
+		}
+		if err := app.checkTarget(targetId, user); err != nil {
+			return err
+		}
+		streamId := oldId[0:36] + ":" + app.Config.Name
+		if _, err := os.Stat(filepath.Join(tmpDir, "files")); err != nil {
+			return errors.New("Missing seed files")
+		}
+		status, _ := doc["status"].(string)
+		if status != "enabled" && status != "disabled" && status != "quarantined" {
+			status = "enabled"
+		}
+		errorCount, _ := doc["error_count"].(int)
+		creationDate, _ := doc["creation_date"].(int)
+
+		streamDir := app.StreamDir(streamId)
+		os.MkdirAll(filepath.Dir(streamDir), 0776)
+		// Mkdir fails if the directory exists, so that concurrent imports of
+		// the same stream cannot both claim it.
+		if err := os.Mkdir(streamDir, 0776); os.IsExist(err) {
+			return ErrConflict.With("stream " + streamId + " already exists")
+		} else if err != nil {
+			return err
+		}
+		if err := moveEntries(tmpDir, streamDir); err != nil {
+			os.RemoveAll(streamDir)
+			return err
+		}
+		partitions, err := app.ListPartitions(streamId)
+		if err != nil {
+			os.RemoveAll(streamDir)
+			return err
+		}
+		frames := 0
+		if len(partitions) > 0 {
+			frames = partitions[len(partitions)-1]
+		}
+		doc["_id"] = streamId
+		doc["frames"] = frames
+		doc["status"] = status
+		doc["namespace"] = app.namespace(user)
+		if err := app.Database.InsertStream(doc); err != nil {
+			os.RemoveAll(streamDir)
+			return errors.New("Unable insert stream into DB")
+		}
+		stream := newStream(streamId, targetId, user, frames, errorCount, creationDate)
+		stream.Namespace = doc["namespace"].(string)
+		stream.MongoStatus = status
+		stream.QuarantineReason, _ = doc["quarantine_reason"].(string)
+		stream.ParentStreamId, _ = doc["parent_stream_id"].(string)
+		stream.ForkFrame, _ = doc["fork_frame"].(int)
+		stream.Meta, _ = doc["meta"].(map[string]interface{})
+		switch v := doc["donor_frames"].(type) {
+		case float64:
+			stream.DonorFrames = v
+		case int:
+			stream.DonorFrames = float64(v)
+		}
+		if err := app.Manager.AddStream(stream, targetId, status == "enabled"); err != nil {
+			os.RemoveAll(streamDir)
+			app.Database.RemoveStream(streamId)
+			return err
+		}
+		app.addShard(targetId)
+		app.usage.SetNamespace(streamId, stream.Namespace)
+		app.usage.Add(targetId, streamId, dirSize(streamDir))
+		data, err := json.Marshal(PostStreamReply{streamId})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,263 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How long, in seconds, the bans read from data.bans are cached. Bans made
+// through another SCV are enforced here after at most this long.
+const BAN_REFRESH_INTERVAL int = 60
+
+/*
+A ban refuses activations to a donor or to a core engine, eg. a core build
+known to write corrupted frames, and refuses the /core/* requests of the
+streams they have active. Bans are stored in data.bans and shared by every SCV.
+Exactly one of User and Engine is set.
+*/
+type Ban struct {
+	Id      string `json:"id" bson:"_id"`
+	User    string `json:"user,omitempty" bson:"user,omitempty"`
+	Engine  string `json:"engine,omitempty" bson:"engine,omitempty"`
+	Reason  string `json:"reason" bson:"reason"`
+	Created int    `json:"created" bson:"created"`
+	Expires int    `json:"expires" bson:"expires"` // unix time, 0 if the ban never expires
+}
+
+func (b *Ban) Expired() bool {
+	return b.Expires > 0 && int(time.Now().Unix()) >= b.Expires
+}
+
+func (b *Ban) Matches(user, engine string) bool {
+	if b.Expired() {
+		return false
+	}
+	if b.User != "" {
+		return b.User == user
+	}
+	return b.Engine == engine
+}
+
+// Returns the bans in data.bans, cached for BAN_REFRESH_INTERVAL seconds, and
+// for as long as the database cannot be reached.
+func (app *Application) bans() ([]Ban, error) {
+	if cached, ok := app.banCache.Get("bans"); ok {
+		return cached.([]Ban), nil
+	}
+	bans, err := app.Database.Bans()
+	if err != nil {
+		if stale, ok := app.banCache.GetStale("bans"); ok && isTransient(err) {
+			return stale.([]Ban), nil
+		}
+		return nil, err
+	}
+	app.banCache.Put("bans", bans)
+	return bans, nil
+}
+
+// Returns ErrBanned if user or engine is banned. If the bans cannot be read,
+// nobody is refused.
+func (app *Application) checkBan(user, engine string) error {
+	bans, err := app.bans()
+	if err != nil {
+		log.Println("Unable to read bans:", err)
+		return nil
+	}
+	for _, ban := range bans {
+		if ban.Matches(user, engine) {
+			if ban.User != "" {
+				return ErrBanned.With("Donor " + user + " is banned: " + ban.Reason)
+			}
+			return ErrBanned.With("Engine " + engine + " is banned: " + ban.Reason)
+		}
+	}
+	return nil
+}
+
+// Refuse the core of an active stream if its donor or engine is banned, and
+// deactivate the stream so that it is handed out to another core. Invalid
+// tokens are left to the handler.
+func (app *Application) refuseBanned(token string) error {
+	var user, engine string
+	err := app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
+		user, engine = stream.ActiveStream.User, stream.ActiveStream.Engine
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+	if err := app.checkBan(user, engine); err != nil {
+		app.Manager.DeactivateStream(token, 0)
+		return err
+	}
+	return nil
+}
+
+/*
+.. http:post:: /admin/bans
+    Ban a donor or a core engine. Banned donors and engines are refused
+    by ``/streams/activate`` and ``/assign``, and the streams they have
+    active are deactivated by their next ``/core/*`` request.
+    .. note:: This request can only be made by CCs.
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "user": "jesse_v", // either user or engine
+            "engine": "openmm_601",
+            "reason": "corrupted frames",
+            "expires_in": 86400 // optional, seconds until the ban expires
+        }
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "id": "ban_id",
+            "engine": "openmm_601",
+            "reason": "corrupted frames",
+            "created": 1404502030,
+            "expires": 1404588430
+        }
+    :status 200: OK
+    :status 400: Bad request
+    :status 401: Not authenticated as a CC
+*/
+func (app *Application) PostBanHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if app.isCC(r) == false {
+			return ErrUnauthorized
+		}
+		msg := struct {
+			User      string `json:"user"`
+			Engine    string `json:"engine"`
+			Reason    string `json:"reason"`
+			ExpiresIn int    `json:"expires_in"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return errors.New("Bad request: " + err.Error())
+		}
+		if (msg.User == "") == (msg.Engine == "") {
+			return errors.New("Exactly one of user and engine must be given")
+		}
+		if msg.ExpiresIn < 0 {
+			return errors.New("expires_in must be positive")
+		}
+		now := int(time.Now().Unix())
+		ban := Ban{
+			Id:      RandSeq(12),
+			User:    msg.User,
+			Engine:  msg.Engine,
+			Reason:  msg.Reason,
+			Created: now,
+		}
+		if msg.ExpiresIn > 0 {
+			ban.Expires = now + msg.ExpiresIn
+		}
+		if err := app.Database.InsertBan(ban); err != nil {
+			return errors.New("Unable to insert ban into DB")
+		}
+		app.banCache.Delete("bans")
+		data, err := json.Marshal(ban)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:get:: /admin/bans
+    List the bans, including expired ones.
+    .. note:: This request can only be made by CCs.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "bans": [
+                {
+                    "id": "ban_id",
+                    "user": "jesse_v",
+                    "reason": "abusive",
+                    "created": 1404502030,
+                    "expires": 0
+                }
+            ]
+        }
+    :status 200: OK
+    :status 401: Not authenticated as a CC
+*/
+func (app *Application) ListBansHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if app.isCC(r) == false {
+			return ErrUnauthorized
+		}
+		bans, err := app.Database.Bans()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(map[string]interface{}{"bans": bans})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:delete:: /admin/bans/:id
+    Lift a ban.
+    .. note:: This request can only be made by CCs.
+    :status 200: OK
+    :status 401: Not authenticated as a CC
+    :status 404: Ban not found
+*/
+func (app *Application) RemoveBanHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if app.isCC(r) == false {
+			return ErrUnauthorized
+		}
+		if err := app.Database.RemoveBan(mux.Vars(r)["id"]); err != nil {
+			return err
+		}
+		app.banCache.Delete("bans")
+		return nil
+	}
+}
+
+/*
+.. http:put:: /admin/bans/:id/deactivate
+    Deactivate the streams of this SCV whose core is refused by a ban,
+    instead of waiting for the cores' next request. The streams are
+    deactivated without counting an error.
+    .. note:: This request can only be made by CCs.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "deactivated": ["stream_id1", "stream_id2"]
+        }
+    :status 200: OK
+    :status 401: Not authenticated as a CC
+    :status 404: Ban not found
+*/
+func (app *Application) BanDeactivateHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if app.isCC(r) == false {
+			return ErrUnauthorized
+		}
+		ban, err := app.Database.Ban(mux.Vars(r)["id"])
+		if err != nil {
+			return err
+		}
+		deactivated := app.Manager.DeactivateMatching(ban.Matches)
+		data, err := json.Marshal(map[string]interface{}{"deactivated": deactivated})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,60 @@
+package scv
+
+import (
+	"../manager"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBans(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "bans")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{
+		Config:   Configuration{Name: filepath.Join(dir, "scv")},
+		Database: db,
+		banCache: NewResultCache(time.Minute),
+		Manager:  manager.NewManager(intf),
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		app.Manager.AddStream(newStream(id, "target", "owner", 0, 0, 0), "target", true)
+	}
+	assert.Nil(t, app.checkBan("joe", "openmm_601"))
+
+	now := int(time.Now().Unix())
+	assert.Nil(t, db.InsertBan(Ban{Id: "1", Engine: "openmm_601", Reason: "bad frames", Created: now}))
+	assert.Nil(t, db.InsertBan(Ban{Id: "2", User: "bob", Created: now - 10, Expires: now - 1}))
+	// cached until invalidated
+	assert.Nil(t, app.checkBan("joe", "openmm_601"))
+	app.banCache.Delete("bans")
+	err = app.checkBan("joe", "openmm_601")
+	assert.Equal(t, err.(*StatusError).Code, "banned")
+	assert.Nil(t, app.checkBan("joe", "openmm_602"))
+	assert.Nil(t, app.checkBan("bob", "openmm_602"))
+
+	bad, _, err := app.Manager.ActivateStream("target", "joe", "openmm_601", mockFunc)
+	assert.Nil(t, err)
+	good, _, err := app.Manager.ActivateStream("target", "joe", "openmm_602", mockFunc)
+	assert.Nil(t, err)
+	assert.NotNil(t, app.refuseBanned(bad))
+	assert.Nil(t, app.refuseBanned(good))
+	// deactivated by the refusal
+	assert.Nil(t, app.refuseBanned(bad))
+	active, _, _ := app.Manager.Counts()
+	assert.Equal(t, active, 1)
+
+	_, streamId, err := app.Manager.ActivateStream("target", "joe", "openmm_601", mockFunc)
+	assert.Nil(t, err)
+	ban, err := db.Ban("1")
+	assert.Nil(t, err)
+	assert.Equal(t, app.Manager.DeactivateMatching(ban.Matches), []string{streamId})
+	active, _, _ = app.Manager.Counts()
+	assert.Equal(t, active, 1)
+}
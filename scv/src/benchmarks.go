@@ -0,0 +1,153 @@
+package scv
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Speed of the sessions of a donor on an engine, as summed from the
+// benchmarks DB.
+type DonorBenchmark struct {
+	User     string  `json:"user" bson:"_id"`
+	NsPerDay float64 `json:"ns_per_day" bson:"ns_per_day"` // mean over the sessions
+	Best     float64 `json:"best" bson:"best"`
+	Sessions int     `json:"sessions" bson:"sessions"`
+}
+
+type BenchmarksReply struct {
+	Engine   string           `json:"engine"`
+	NsPerDay float64          `json:"ns_per_day"` // mean over the donors
+	Sessions int              `json:"sessions"`
+	Donors   []DonorBenchmark `json:"donors"`
+}
+
+// Returns true if the streams of a target are benchmarks, see
+// discardBenchmarkCheckpoint.
+func (app *Application) isBenchmark(targetId string) bool {
+	options, err := app.targetOptions(targetId)
+	if err != nil {
+		return false
+	}
+	return optionBool(options, "benchmark", false)
+}
+
+/*
+Drop the buffer of a benchmark stream on checkpoint instead of moving it into
+a partition. The frames are still credited to the donor, but the stream never
+accumulates frames, so that every core restarts it from its seed files. The
+stream must be locked for writing.
+*/
+func (app *Application) discardBenchmarkCheckpoint(s *Stream, donorFrames float64) error {
+	bufferDir := filepath.Join(app.StreamDir(s.StreamId), "buffer_files")
+	app.usage.Add(s.TargetId, s.StreamId, -dirSize(bufferDir))
+	streamData(s).filesChanged()
+	if err := os.RemoveAll(bufferDir); err != nil {
+		return err
+	}
+	s.DonorFrames += donorFrames
+	s.ActiveStream.DonorFrames += donorFrames
+	s.ActiveStream.BufferFrames = 0
+	sessionData(s).xtcFrames = 0
+	s.ActiveStream.LastCheckpoint = time.Now()
+	app.events.Publish(NewEvent(EVENT_CHECKPOINT, s, map[string]interface{}{
+		"frames":       s.Frames,
+		"donor_frames": s.DonorFrames,
+	}))
+	return nil
+}
+
+/*
+Record the speed of the session of a benchmark stream in the benchmarks DB,
+which holds a collection of sessions per engine. Only the frames up to the
+last checkpoint count, and sessions of targets whose frames have no known
+length are skipped, see nsPerFrame. The stream must be locked.
+*/
+func (app *Application) recordBenchmark(s *Stream) {
+	as := s.ActiveStream
+	if as.DonorFrames <= 0 || as.LastCheckpoint.IsZero() {
+		return
+	}
+	options, err := app.targetOptions(s.TargetId)
+	if err != nil || optionBool(options, "benchmark", false) == false {
+		return
+	}
+	ns := nsPerFrame(options)
+	seconds := as.LastCheckpoint.Unix() - int64(as.StartTime)
+	if ns <= 0 || seconds <= 0 {
+		return
+	}
+	app.deferInsert("benchmarks", as.Engine, []string{"user"}, bson.M{
+		"user":       as.User,
+		"target":     s.TargetId,
+		"stream":     s.StreamId,
+		"start_time": as.StartTime,
+		"end_time":   int(as.LastCheckpoint.Unix()),
+		"frames":     as.DonorFrames,
+		"ns_per_day": as.DonorFrames * ns * 86400 / float64(seconds),
+	})
+}
+
+/*
+.. http:get:: /benchmarks/:engine
+    Simulation speed of the donors of an engine, as measured on the
+    streams of benchmark targets, to calibrate the points_per_frame of
+    other targets. Results are cached for a few minutes.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "engine": "openmm_60_opencl",
+            "ns_per_day": 41.5,
+            "sessions": 12,
+            "donors": [
+                {"user": "jesse_v", "ns_per_day": 53, "best": 60.2, "sessions": 8},
+                {"user": "yutong", "ns_per_day": 30, "best": 30, "sessions": 4}
+            ]
+        }
+    .. note:: A target is a benchmark if its ``benchmark`` option is set.
+        Its streams always restart from their seed files, since
+        checkpoints are discarded, and need ``ns_per_frame`` or
+        ``steps_per_frame`` and ``timestep_fs`` options.
+    .. note:: ``ns_per_day`` of a donor is the mean over its sessions, and
+        the engine's the mean over its donors. Anonymous sessions are
+        counted in the latter but not listed. Donors are sorted from the
+        fastest.
+    :status 200: OK
+*/
+func (app *Application) BenchmarksHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		engine := mux.Vars(r)["engine"]
+		key := "benchmarks:" + engine
+		if cached, ok := app.statsCache.Get(key); ok {
+			w.Write(cached.([]byte))
+			return nil
+		}
+		rows, err := app.Database.Benchmarks(engine)
+		if err != nil {
+			return err
+		}
+		reply := BenchmarksReply{Engine: engine, Donors: make([]DonorBenchmark, 0, len(rows))}
+		for _, row := range rows {
+			reply.NsPerDay += row.NsPerDay / float64(len(rows))
+			reply.Sessions += row.Sessions
+			if row.User != "" {
+				reply.Donors = append(reply.Donors, row)
+			}
+		}
+		sort.Slice(reply.Donors, func(i, j int) bool { return reply.Donors[i].NsPerDay > reply.Donors[j].NsPerDay })
+		data, err := json.Marshal(reply)
+		if err != nil {
+			return err
+		}
+		app.statsCache.Put(key, data)
+		w.Write(data)
+		return nil
+	}
+}
+
@@ -0,0 +1,102 @@
+package scv
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gorilla/mux"
+)
+
+// Directory of a stream holding the buffer of its previous core, see
+// recoverBuffer.
+const RECOVERED_BUFFER string = "recovered_buffer"
+
+/*
+Clear the buffer_files left by the previous core of a stream, which hold the
+frames it posted after its last checkpoint. They are never part of a partition
+since a core could not restart from them. If KeepBuffers is set, a non-empty
+buffer is moved to recovered_buffer instead, replacing the one recovered
+before, so that the stream's manager can inspect the frames, eg. of a session
+cut short by a restart of the SCV. The stream must be locked for writing.
+*/
+func (app *Application) recoverBuffer(s *Stream) error {
+	streamDir := app.StreamDir(s.StreamId)
+	bufferDir := filepath.Join(streamDir, "buffer_files")
+	streamData(s).filesChanged()
+	files, err := ioutil.ReadDir(bufferDir)
+	if app.Settings().KeepBuffers == false || len(files) == 0 || err != nil {
+		app.usage.Add(s.TargetId, s.StreamId, -dirSize(bufferDir))
+		return os.RemoveAll(bufferDir)
+	}
+	if err := app.discardRecovered(s); err != nil {
+		return err
+	}
+	return os.Rename(bufferDir, filepath.Join(streamDir, RECOVERED_BUFFER))
+}
+
+// Remove the recovered buffer of a stream, if any. The stream must be locked
+// for writing.
+func (app *Application) discardRecovered(s *Stream) error {
+	recoveredDir := filepath.Join(app.StreamDir(s.StreamId), RECOVERED_BUFFER)
+	app.usage.Add(s.TargetId, s.StreamId, -dirSize(recoveredDir))
+	streamData(s).filesChanged()
+	return os.RemoveAll(recoveredDir)
+}
+
+// Returns the files of the recovered buffer of a stream, relative to the
+// stream's directory so that they can be passed to /streams/download.
+func (app *Application) listRecovered(streamId string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(app.StreamDir(streamId), RECOVERED_BUFFER))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(files))
+	for _, fileInfo := range files {
+		res = append(res, filepath.Join(RECOVERED_BUFFER, fileInfo.Name()))
+	}
+	return res, nil
+}
+
+// Write the frames queued by every active stream to its buffer, so that they
+// are not lost when the SCV stops.
+func (app *Application) flushBuffers() {
+	app.Manager.ModifyActiveStreams(func(stream *Stream) {
+		if writer := sessionData(stream).writer; writer != nil {
+			if err := writer.Flush(); err != nil {
+				log.Println("Unable to flush the buffer of stream "+stream.StreamId+":", err)
+			}
+		}
+	})
+}
+
+/*
+.. http:delete:: /streams/recovered/:stream_id
+    Discard the buffer recovered from the previous core of the stream,
+    once it was inspected. Recovered buffers are only kept if
+    ``KeepBuffers`` is set, see ``/streams/sync``.
+    :reqheader Authorization: manager authorization token
+    :status 200: OK
+    :status 401: Unauthorized
+    :status 403: You do not own this stream
+    :status 404: Stream does not exist
+*/
+func (app *Application) StreamRecoveredHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		streamId := mux.Vars(r)["stream_id"]
+		user, err := app.CurrentManager(r)
+		if err != nil {
+			return err
+		}
+		return app.Manager.ModifyStream(streamId, func(stream *Stream) error {
+			if app.canManage(user, stream) == false {
+				return ErrForbidden.With("You do not own this stream.")
+			}
+			return app.discardRecovered(stream)
+		})
+	}
+}
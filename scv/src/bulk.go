@@ -0,0 +1,196 @@
+package scv
+
+import (
+	"../manager"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+/*
+.. http:post:: /streams/bulk_update
+    Update at once the priority, status and metadata of every stream
+    of the manager's namespace matching a filter. Either every matched
+    stream is updated or none is.
+    :reqheader Authorization: Manager's authorization token
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "filter": {
+                "target_id": "target_id", // optional
+                "tag": "pdb.gz.b64", // optional
+                "status": "enabled" // optional
+            },
+            "patch": {
+                "priority": 100, // optional
+                "status": "disabled", // optional
+                "meta": {"round": 2, "temperature": null} // optional
+            }
+        }
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "stream_ids": ["stream_id1", "stream_id2"]
+        }
+    .. note:: ``tag`` matches the streams that have a tag of that name,
+        and ``status`` is one of enabled, disabled or quarantined.
+    .. note:: ``priority`` is added to the frames of a stream when the
+        streams of its target are queued, see ``aging_rate`` in
+        ``/targets``. ``meta`` is merged as by ``/streams/meta``.
+    .. note:: Disabled streams that are enabled have their error count
+        reset, and active streams that are disabled are stopped. The
+        status of quarantined streams cannot be changed, see
+        ``/streams/release``.
+    :status 200: OK
+    :status 400: Bad request
+    :status 403: The target belongs to another namespace
+    :status 409: A matched stream is quarantined
+    :status 413: The metadata of a stream would be too large
+*/
+func (app *Application) StreamsBulkUpdateHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		msg := BulkUpdateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return errors.New("Bad request: " + err.Error())
+		}
+		filter, patch := msg.Filter, msg.Patch
+		switch filter.Status {
+		case "", "enabled", "disabled", "quarantined":
+		default:
+			return errors.New("Bad status filter: " + filter.Status)
+		}
+		if filter.Tag != "" && validTagName(filter.Tag) == false {
+			return errors.New("Bad tag name: " + filter.Tag)
+		}
+		now := int(time.Now().Unix())
+		set := bson.M{}
+		unset := bson.M{}
+		if patch.Priority != nil {
+			set["priority"] = *patch.Priority
+		}
+		switch patch.Status {
+		case "":
+		case "enabled":
+			set["status"] = "enabled"
+			set["error_count"] = 0
+			set["last_active"] = now
+		case "disabled":
+			set["status"] = "disabled"
+		default:
+			return errors.New("Bad status: " + patch.Status)
+		}
+		for key, value := range patch.Meta {
+			if validMetaKey(key) == false {
+				return errors.New("Bad metadata key: " + key)
+			}
+			if value == nil {
+				unset["meta."+key] = ""
+			} else {
+				set["meta."+key] = value
+			}
+		}
+		if len(set) == 0 && len(unset) == 0 {
+			return errors.New("Bad request: empty patch")
+		}
+		if err := app.checkTokenTargets(r, filter.TargetId); err != nil {
+			return err
+		}
+		if filter.TargetId != "" {
+			if err := app.checkTarget(filter.TargetId, user); err != nil {
+				return err
+			}
+		}
+		// match is called with the manager locked, so the tags are looked up
+		// beforehand. Streams added in between are not matched by a tag.
+		tagged := make(map[string]bool)
+		if filter.Tag != "" {
+			candidates := app.Manager.StreamIds()
+			if filter.TargetId != "" {
+				active, inactive, disabled := app.Manager.TargetStreams(filter.TargetId)
+				candidates = append(append(active, inactive...), disabled...)
+			}
+			for _, streamId := range candidates {
+				if _, err := os.Stat(filepath.Join(app.StreamDir(streamId), "tags", filter.Tag)); err == nil {
+					tagged[streamId] = true
+				}
+			}
+		}
+		match := func(s *Stream) bool {
+			if app.canManage(user, s) == false {
+				return false
+			}
+			if filter.Status != "" && s.MongoStatus != filter.Status {
+				return false
+			}
+			if filter.Tag != "" {
+				return tagged[s.StreamId]
+			}
+			return true
+		}
+		events := make([]Event, 0)
+		commit := func(streams []*Stream) error {
+			if len(streams) == 0 {
+				return nil
+			}
+			ids := make([]string, 0, len(streams))
+			for _, s := range streams {
+				if len(patch.Meta) > 0 {
+					if err := app.loadStreamFields(s); err != nil {
+						return err
+					}
+					data, err := json.Marshal(mergeMeta(s.Meta, patch.Meta))
+					if err != nil {
+						return err
+					}
+					if len(data) > MAX_META_BYTES {
+						return ErrTooLarge.With("Metadata of stream " + s.StreamId + " would exceed 16384 bytes")
+					}
+				}
+				ids = append(ids, s.StreamId)
+			}
+			if err := app.Database.UpdateStreams(ids, set, unset); err != nil {
+				return err
+			}
+			for _, s := range streams {
+				if len(patch.Meta) > 0 {
+					s.Meta = mergeMeta(s.Meta, patch.Meta)
+				}
+				if patch.Status == "enabled" {
+					// enabling a stream counts as activity, as in EnableStreamService
+					s.LastActive = now
+				}
+				if patch.Status == "enabled" && s.MongoStatus != "enabled" {
+					events = append(events, NewEvent(EVENT_ENABLED, s, nil))
+				} else if patch.Status == "disabled" && s.MongoStatus != "disabled" {
+					events = append(events, NewEvent(EVENT_DISABLED, s, nil))
+				}
+			}
+			return nil
+		}
+		streamIds, err := app.Manager.UpdateStreams(filter.TargetId, match, manager.StreamPatch{
+			Priority: patch.Priority,
+			Status:   patch.Status,
+		}, commit)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			app.events.Publish(e)
+		}
+		data, err := json.Marshal(BulkUpdateReply{streamIds})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
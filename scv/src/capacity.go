@@ -0,0 +1,108 @@
+package scv
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// Reply of GET /capacity, also stored in the SCV's document in servers.scvs.
+type CapacityReply struct {
+	Status        string         `json:"status" bson:"status"`                 // online, draining, full, or the state of a maintenance window
+	IdleStreams   map[string]int `json:"idle_streams" bson:"idle_streams"`     // streams that can be activated, by target
+	ActiveStreams int            `json:"active_streams" bson:"active_streams"` // over all targets
+	DiskFree      int64          `json:"disk_free" bson:"disk_free"`           // bytes free on the data partition, -1 if unknown
+	IngestRate    float64        `json:"ingest_rate" bson:"ingest_rate"`       // bytes of frames per second over the last INGEST_RATE_WINDOW seconds
+	Load          float64        `json:"load" bson:"load"`                     // one minute load average of the host
+	Health        float64        `json:"health" bson:"health"`                 // from 0 (saturated) to 1 (idle), see Capacity
+}
+
+// Returns the status of the SCV as stored in servers.scvs.
+func (app *Application) status() string {
+	if app.ReadOnly() {
+		return "full"
+	} else if app.Draining() {
+		return "draining"
+	} else if state := maintenanceState(app.Settings().Maintenance, time.Now()); state != "" {
+		return state
+	}
+	return "online"
+}
+
+// Clamp x to [0, 1].
+func unitInterval(x float64) float64 {
+	return math.Max(0, math.Min(1, x))
+}
+
+/*
+Returns what the CC needs to decide whether to send cores to this SCV. The
+Health is 0 unless the SCV is online, and otherwise how far its most saturated
+resource is from its limit: the free space on the data partition against
+ReadOnlyDiskFree, the load average against the number of CPUs, and the writes
+deferred to the database against MaxStatsQueue.
+*/
+func (app *Application) Capacity() CapacityReply {
+	settings := app.Settings()
+	active, _, _ := app.Manager.Counts()
+	reply := CapacityReply{
+		Status:        app.status(),
+		IdleStreams:   app.Manager.IdleTargets(),
+		ActiveStreams: active,
+		DiskFree:      app.dataFree(),
+		IngestRate:    app.ingest.Rate(),
+		Load:          loadAverage(),
+	}
+	if reply.Status != "online" {
+		return reply
+	}
+	disk := 0.0
+	threshold := settings.ReadOnlyDiskFree
+	if threshold == 0 {
+		threshold = READ_ONLY_DISK_FREE
+	}
+	if threshold < 0 {
+		disk = 1
+	} else if reply.DiskFree > 0 {
+		disk = unitInterval(1 - float64(threshold)/float64(reply.DiskFree))
+	}
+	cpu := unitInterval(1 - reply.Load/float64(runtime.NumCPU()))
+	maxQueue := settings.MaxStatsQueue
+	if maxQueue <= 0 {
+		maxQueue = MAX_STATS_QUEUE
+	}
+	queue := unitInterval(1 - float64(app.stats.Depth())/float64(maxQueue))
+	reply.Health = math.Min(disk, math.Min(cpu, queue))
+	return reply
+}
+
+/*
+.. http:get:: /capacity
+    What the CC weighs when assigning cores to SCVs. The same fields are
+    stored in the ``capacity`` of the SCV's document in ``servers.scvs``
+    on every heartbeat.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "status": "online",
+            "idle_streams": {"target_id": 120}, // streams that can be activated
+            "active_streams": 4012,
+            "disk_free": 53687091200,
+            "ingest_rate": 2097152.5, // bytes of frames per second
+            "load": 3.2,
+            "health": 0.6 // 0 if saturated or not online, up to 1
+        }
+    :status 200: OK
+*/
+func (app *Application) CapacityHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		data, err := json.Marshal(app.Capacity())
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,64 @@
+package scv
+
+import (
+	"../manager"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCapacity(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "capacity")
+	defer os.RemoveAll(dir)
+	app := &Application{
+		Config: Configuration{Name: filepath.Join(dir, "scv"), ReadOnlyDiskFree: -1, MaxStatsQueue: 2},
+		stats:  NewStatsWriter(4),
+		ingest: NewIngestThrottle(RateLimit{}, RateLimit{}),
+	}
+	app.Manager = manager.NewManager(&manager.ManagerCallbacks{})
+	now := int(time.Now().Unix())
+	for _, streamId := range []string{"a", "b"} {
+		app.Manager.AddStream(newStream(streamId, "target", "none", 0, 0, now), "target", true)
+	}
+	_, _, err := app.Manager.ActivateStream("target", "", "openmm", mockFunc)
+	assert.Nil(t, err)
+	app.ingest.Allow("token", 6000)
+
+	capacity := func() CapacityReply {
+		req, _ := http.NewRequest("GET", "/capacity", nil)
+		w := httptest.NewRecorder()
+		app.CapacityHandler().ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+		reply := CapacityReply{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &reply))
+		return reply
+	}
+	reply := capacity()
+	assert.Equal(t, reply.Status, "online")
+	assert.Equal(t, reply.IdleStreams, map[string]int{"target": 1})
+	assert.Equal(t, reply.ActiveStreams, 1)
+	assert.Equal(t, reply.IngestRate, 100.0)
+	assert.True(t, reply.DiskFree > 0)
+	assert.True(t, reply.Health >= 0 && reply.Health <= 1)
+
+	// the most saturated resource counts, here the stats writer
+	app.stats.enqueue(&deferredOp{})
+	assert.True(t, capacity().Health <= 0.5)
+	app.stats.enqueue(&deferredOp{})
+	assert.Equal(t, capacity().Health, 0.0)
+	<-app.stats.queue
+	<-app.stats.queue
+
+	atomic.StoreInt32(&app.draining, 1)
+	reply = capacity()
+	assert.Equal(t, reply.Status, "draining")
+	assert.Equal(t, reply.Health, 0.0)
+}
@@ -0,0 +1,396 @@
+package scv
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Name of the sidecar manifest written into every checkpoint directory of a
+// partition (eg. 5/0/checksums.json). It maps the path of each file in the
+// directory to its SHA-256 hexdigest. Directories written before checksums
+// were introduced have no manifest and are not verified.
+const CHECKSUM_MANIFEST string = "checksums.json"
+
+// A checkpoint directory whose files do not match their manifest.
+type Corruption struct {
+	Partition  int      `json:"partition"`
+	Checkpoint int      `json:"checkpoint"`
+	Files      []string `json:"files"`
+}
+
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Compute the checksums of every file in dir and write them to its manifest.
+func writeChecksums(dir string) error {
+	checksums := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || name == CHECKSUM_MANIFEST {
+			return nil
+		}
+		sum, err := sha256File(path)
+		if err != nil {
+			return err
+		}
+		checksums[filepath.ToSlash(name)] = sum
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(checksums)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, CHECKSUM_MANIFEST), data, 0776)
+}
+
+// Read the manifest of dir. Returns nil if dir has no manifest.
+func readChecksums(dir string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, CHECKSUM_MANIFEST))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]string)
+	if err := json.Unmarshal(data, &checksums); err != nil {
+		return nil, err
+	}
+	return checksums, nil
+}
+
+// Remove the entries of dir's manifest whose path starts with prefix, once the
+// files were deleted on purpose.
+func dropChecksums(dir, prefix string) error {
+	checksums, err := readChecksums(dir)
+	if err != nil || checksums == nil {
+		return err
+	}
+	for name := range checksums {
+		if strings.HasPrefix(name, prefix) {
+			delete(checksums, name)
+		}
+	}
+	data, err := json.Marshal(checksums)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, CHECKSUM_MANIFEST), data, 0776)
+}
+
+// Locate the manifest covering file, a path relative to the stream directory
+// such as 5/0/frames.xtc. Returns the checkpoint directory and the name of the
+// file relative to it.
+func checksumDir(streamDir, file string) (dir string, name string, ok bool) {
+	parts := strings.Split(filepath.ToSlash(filepath.Clean(file)), "/")
+	if len(parts) < 3 {
+		return "", "", false
+	}
+	if _, err := strconv.Atoi(parts[0]); err != nil {
+		return "", "", false
+	}
+	if _, err := strconv.Atoi(parts[1]); err != nil {
+		return "", "", false
+	}
+	return filepath.Join(streamDir, parts[0], parts[1]), strings.Join(parts[2:], "/"), true
+}
+
+// Verify data read from name, a path relative to dir, against dir's manifest.
+// Files that are not in a manifest are assumed to be intact.
+func verifyChecksum(dir, name string, data []byte) error {
+	checksums, err := readChecksums(dir)
+	if err != nil {
+		return err
+	}
+	expected, ok := checksums[filepath.ToSlash(name)]
+	if ok == false {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != expected {
+		return errors.New("checksum mismatch for " + filepath.Join(dir, name))
+	}
+	return nil
+}
+
+// Returns the files of dir that are missing or do not match its manifest.
+func verifyDir(dir string) []string {
+	checksums, err := readChecksums(dir)
+	if err != nil {
+		return []string{CHECKSUM_MANIFEST}
+	}
+	return verifyFiles(dir, checksums)
+}
+
+// Returns the files of dir that are missing or do not match checksums.
+func verifyFiles(dir string, checksums map[string]string) []string {
+	corrupted := make([]string, 0)
+	for name, expected := range checksums {
+		sum, err := sha256File(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil || sum != expected {
+			corrupted = append(corrupted, name)
+		}
+	}
+	sort.Strings(corrupted)
+	return corrupted
+}
+
+// Verify the partitions stored in an archive against the manifests archived
+// alongside them. Also returns the number of manifests found.
+func verifyArchive(archivePath string) ([]Corruption, int, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	sums := make(map[string]string)
+	manifests := make(map[string]map[string]string)
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		dir, name := path.Split(header.Name)
+		if name == CHECKSUM_MANIFEST {
+			checksums := make(map[string]string)
+			if err := json.NewDecoder(reader).Decode(&checksums); err != nil {
+				return nil, 0, err
+			}
+			manifests[strings.TrimSuffix(dir, "/")] = checksums
+			continue
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, reader); err != nil {
+			return nil, 0, err
+		}
+		sums[header.Name] = hex.EncodeToString(h.Sum(nil))
+	}
+	res := make([]Corruption, 0)
+	for dir, checksums := range manifests {
+		files := make([]string, 0)
+		for name, expected := range checksums {
+			if sums[dir+"/"+name] != expected {
+				files = append(files, name)
+			}
+		}
+		if len(files) > 0 {
+			sort.Strings(files)
+			parts := strings.Split(dir, "/")
+			c := Corruption{Files: files}
+			c.Partition, _ = strconv.Atoi(parts[0])
+			if len(parts) > 1 {
+				c.Checkpoint, _ = strconv.Atoi(parts[1])
+			}
+			res = append(res, c)
+		}
+	}
+	return res, len(manifests), nil
+}
+
+// A checkpoint directory of a stream and its manifest, read by listChecks.
+type checkedDir struct {
+	partition  int
+	checkpoint int
+	path       string
+	checksums  map[string]string
+	err        error // reading the manifest
+}
+
+// The checkpoint directories and archives of a stream, listed under the
+// stream's lock so that their files can be hashed without it.
+type streamChecks struct {
+	dirs       []checkedDir
+	archives   []Archive
+	generation int // of the stream when listed, see checkGeneration
+}
+
+// List the checkpoint directories of a stream with their manifests, and its
+// archives. The stream must be locked.
+func (app *Application) listChecks(s *Stream) (*streamChecks, error) {
+	streamId := s.StreamId
+	checks := &streamChecks{generation: streamData(s).generation}
+	partitions, err := app.ListPartitions(streamId)
+	if err != nil {
+		return nil, err
+	}
+	for _, partition := range partitions {
+		partitionDir := filepath.Join(app.StreamDir(streamId), strconv.Itoa(partition))
+		checkpoints, err := ioutil.ReadDir(partitionDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fileInfo := range checkpoints {
+			checkpoint, err := strconv.Atoi(fileInfo.Name())
+			if err != nil || fileInfo.IsDir() == false {
+				continue
+			}
+			dir := checkedDir{partition: partition, checkpoint: checkpoint, path: filepath.Join(partitionDir, fileInfo.Name())}
+			dir.checksums, dir.err = readChecksums(dir.path)
+			checks.dirs = append(checks.dirs, dir)
+		}
+	}
+	if checks.archives, err = app.ListArchives(streamId); err != nil {
+		return nil, err
+	}
+	return checks, nil
+}
+
+// Hash the files listed by listChecks. Returns the corrupted directories
+// ordered by partition and checkpoint, and the number of directories that were
+// checked.
+func (app *Application) verifyChecks(streamId string, checks *streamChecks) ([]Corruption, int) {
+	res := make([]Corruption, 0)
+	checked := 0
+	for _, dir := range checks.dirs {
+		files := []string{CHECKSUM_MANIFEST}
+		if dir.err == nil {
+			files = verifyFiles(dir.path, dir.checksums)
+		}
+		checked += 1
+		if len(files) > 0 {
+			res = append(res, Corruption{dir.partition, dir.checkpoint, files})
+		}
+	}
+	for _, archive := range checks.archives {
+		corrupted, n, err := verifyArchive(filepath.Join(app.StreamDir(streamId), filepath.FromSlash(archive.Name)))
+		if err != nil {
+			// an unreadable archive loses all of its partitions
+			n = len(archive.Partitions)
+			for _, partition := range archive.Partitions {
+				corrupted = append(corrupted, Corruption{partition, 0, []string{archive.Name}})
+			}
+		}
+		checked += n
+		res = append(res, corrupted...)
+	}
+	sort.Sort(byPartition(res))
+	return res, checked
+}
+
+/*
+Verify every checkpoint directory of a stream, including those stored in
+archives, against their manifests. Returns the corrupted directories ordered by
+partition and checkpoint, and the number of directories that were checked.
+The directories and their manifests are listed under the stream's lock, but
+hashed without it so that the stream's core is not held up. Returns
+errFilesChanged if files of the stream were removed or replaced meanwhile, as
+they would then look corrupted.
+*/
+func (app *Application) VerifyStream(streamId string) ([]Corruption, int, error) {
+	var checks *streamChecks
+	e := app.Manager.ReadStream(streamId, func(stream *Stream) error {
+		var err error
+		checks, err = app.listChecks(stream)
+		return err
+	})
+	if e != nil {
+		return nil, 0, e
+	}
+	corrupted, checked := app.verifyChecks(streamId, checks)
+	if err := app.checkGeneration(streamId, checks.generation); err != nil {
+		return nil, 0, err
+	}
+	return corrupted, checked, nil
+}
+
+type byPartition []Corruption
+
+func (s byPartition) Len() int      { return len(s) }
+func (s byPartition) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPartition) Less(i, j int) bool {
+	if s[i].Partition != s[j].Partition {
+		return s[i].Partition < s[j].Partition
+	}
+	return s[i].Checkpoint < s[j].Checkpoint
+}
+
+/*
+.. http:get:: /streams/verify/:stream_id
+    Recompute the checksums of every frame and checkpoint file of a
+    stream and report the partitions whose files are missing or
+    corrupted.
+    :reqheader Authorization: Manager's authorization token
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "checked": 12, // number of checkpoint directories verified
+            "corrupted": [
+                {
+                    "partition": 38,
+                    "checkpoint": 0,
+                    "files": ["checkpoint_files/state.xml.gz.b64"]
+                }
+            ]
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) StreamVerifyHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		e := app.Manager.ReadStream(streamId, func(stream *Stream) error {
+			if app.canManage(user, stream) == false {
+				return ErrForbidden.With("You do not own this stream.")
+			}
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+		corrupted, checked, e := app.VerifyStream(streamId)
+		if e != nil {
+			return e
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"checked":   checked,
+			"corrupted": corrupted,
+		})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
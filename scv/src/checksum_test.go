@@ -0,0 +1,97 @@
+package scv
+
+import (
+	"../manager"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scv_checksum")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "checkpoint_files"), 0776)
+	ioutil.WriteFile(filepath.Join(dir, "frames.xtc"), []byte("frames"), 0776)
+	ioutil.WriteFile(filepath.Join(dir, "checkpoint_files", "state.xml"), []byte("state"), 0776)
+	// directories without a manifest are not verified
+	assert.Equal(t, verifyDir(dir), []string{})
+	assert.Nil(t, verifyChecksum(dir, "frames.xtc", []byte("anything")))
+
+	assert.Nil(t, writeChecksums(dir))
+	checksums, err := readChecksums(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(checksums), 2)
+	assert.Equal(t, verifyDir(dir), []string{})
+	assert.Nil(t, verifyChecksum(dir, "checkpoint_files/state.xml", []byte("state")))
+	assert.NotNil(t, verifyChecksum(dir, "checkpoint_files/state.xml", []byte("stat")))
+
+	ioutil.WriteFile(filepath.Join(dir, "frames.xtc"), []byte("frameZ"), 0776)
+	os.Remove(filepath.Join(dir, "checkpoint_files", "state.xml"))
+	assert.Equal(t, verifyDir(dir), []string{"checkpoint_files/state.xml", "frames.xtc"})
+
+	checkpointDir, name, ok := checksumDir("stream", "5/0/checkpoint_files/state.xml")
+	assert.True(t, ok)
+	assert.Equal(t, checkpointDir, filepath.Join("stream", "5", "0"))
+	assert.Equal(t, name, "checkpoint_files/state.xml")
+	_, _, ok = checksumDir("stream", "files/state.xml")
+	assert.False(t, ok)
+}
+
+func TestVerifyArchive(t *testing.T) {
+	streamDir, err := ioutil.TempDir("", "scv_checksum")
+	assert.Nil(t, err)
+	defer os.RemoveAll(streamDir)
+	for _, partition := range []string{"5", "10"} {
+		dir := filepath.Join(streamDir, partition, "0")
+		os.MkdirAll(dir, 0776)
+		ioutil.WriteFile(filepath.Join(dir, "frames.xtc"), []byte("frames"+partition), 0776)
+		assert.Nil(t, writeChecksums(dir))
+	}
+	// corrupt partition 10 after its checksums were recorded
+	ioutil.WriteFile(filepath.Join(streamDir, "10", "0", "frames.xtc"), []byte("garbage"), 0776)
+	archivePath := filepath.Join(streamDir, "10.tar")
+	assert.Nil(t, writePartitionTar(streamDir, archivePath, []int{5, 10}))
+	corrupted, checked, err := verifyArchive(archivePath)
+	assert.Nil(t, err)
+	assert.Equal(t, checked, 2)
+	assert.Equal(t, corrupted, []Corruption{{Partition: 10, Checkpoint: 0, Files: []string{"frames.xtc"}}})
+}
+
+func TestVerifyStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scv_checksum")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	app := &Application{Config: Configuration{Name: filepath.Join(dir, "scv")}, Manager: manager.NewManager(intf)}
+	app.Manager.AddStream(newStream("stream", "target", "owner", 0, 0, 0), "target", true)
+	checkpointDir := filepath.Join(app.StreamDir("stream"), "5", "0")
+	os.MkdirAll(checkpointDir, 0776)
+	ioutil.WriteFile(filepath.Join(checkpointDir, "frames.xtc"), []byte("frames"), 0776)
+	assert.Nil(t, writeChecksums(checkpointDir))
+	corrupted, checked, err := app.VerifyStream("stream")
+	assert.Nil(t, err)
+	assert.Equal(t, checked, 1)
+	assert.Equal(t, corrupted, []Corruption{})
+
+	ioutil.WriteFile(filepath.Join(checkpointDir, "frames.xtc"), []byte("frameZ"), 0776)
+	corrupted, _, err = app.VerifyStream("stream")
+	assert.Nil(t, err)
+	assert.Equal(t, corrupted, []Corruption{{5, 0, []string{"frames.xtc"}}})
+
+	// files hashed after they were replaced are not reported as corrupted
+	var checks *streamChecks
+	app.Manager.ReadStream("stream", func(s *Stream) error {
+		checks, err = app.listChecks(s)
+		return err
+	})
+	app.Manager.ModifyStream("stream", func(s *Stream) error {
+		streamData(s).filesChanged()
+		return nil
+	})
+	corrupted, _ = app.verifyChecks("stream", checks)
+	assert.Equal(t, len(corrupted), 1)
+	assert.Equal(t, app.checkGeneration("stream", checks.generation), errFilesChanged)
+}
@@ -0,0 +1,210 @@
+package scv
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often, in seconds, the compactor scans the streams.
+const COMPACT_INTERVAL int = 3600
+
+// An archive merges a contiguous run of partitions of a stream into a single
+// tar file. Inside the tar, entries are named relative to the stream directory
+// (eg. 5/0/frames.xtc, 5/0/checkpoint_files/state.xml.gz.b64), so that
+// extracting it into the stream directory restores the original partitions.
+type Archive struct {
+	Name       string `json:"name"`       // file name, relative to the stream directory
+	Partitions []int  `json:"partitions"` // partitions stored in the archive
+}
+
+func (app *Application) ArchiveDir(streamId string) string {
+	return filepath.Join(app.StreamDir(streamId), "archives")
+}
+
+// Return the archives of a stream ordered by their partitions.
+func (app *Application) ListArchives(streamId string) ([]Archive, error) {
+	res := make([]Archive, 0)
+	archiveDir := app.ArchiveDir(streamId)
+	files, err := ioutil.ReadDir(archiveDir)
+	if os.IsNotExist(err) {
+		return res, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// archives are named after their last partition, so ReadDir's ordering is
+	// lexicographic and needs to be fixed up.
+	byLast := make(map[int]Archive)
+	keys := make([]int, 0)
+	for _, fileInfo := range files {
+		root, ext := splitExt(fileInfo.Name())
+		last, err := strconv.Atoi(root)
+		if ext != ".json" || err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(archiveDir, fileInfo.Name()))
+		if err != nil {
+			return nil, err
+		}
+		archive := Archive{}
+		if err := json.Unmarshal(data, &archive); err != nil {
+			return nil, err
+		}
+		byLast[last] = archive
+		keys = append(keys, last)
+	}
+	sort.Ints(keys)
+	for _, last := range keys {
+		res = append(res, byLast[last])
+	}
+	return res, nil
+}
+
+// Write the partitions into a tar file at path.
+func writePartitionTar(streamDir, path string, partitions []int) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := tar.NewWriter(file)
+	for _, partition := range partitions {
+		root := filepath.Join(streamDir, strconv.Itoa(partition))
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			name, err := filepath.Rel(streamDir, path)
+			if err != nil {
+				return err
+			}
+			return writeTarEntry(writer, name, info, path)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+/*
+Merge all but the most recent partition of a stream into a single archive once
+the stream has more than CompactThreshold partitions. The most recent partition
+is always kept as a directory because it holds the checkpoint handed out by
+/core/start. The tar file is built under a read lock since partitions other
+than the last one are never modified, and the partition directories are only
+swapped out for the archive under the write lock.
+*/
+func (app *Application) CompactStream(streamId string) error {
+	threshold := app.Settings().CompactThreshold
+	if threshold <= 0 {
+		return nil
+	}
+	return app.compactStream(streamId, threshold)
+}
+
+// Merge all but the most recent partition of a stream into an archive if it
+// has more than threshold partitions, see CompactStream.
+func (app *Application) compactStream(streamId string, threshold int) error {
+	var partitions []int
+	var tmpPath string
+	e := app.Manager.ReadStream(streamId, func(stream *Stream) error {
+		all, err := app.ListPartitions(streamId)
+		if err != nil {
+			return err
+		}
+		if len(all) <= threshold {
+			return nil
+		}
+		partitions = all[:len(all)-1]
+		os.MkdirAll(app.ArchiveDir(streamId), 0776)
+		// remove archives left behind by an interrupted compaction
+		if files, err := ioutil.ReadDir(app.ArchiveDir(streamId)); err == nil {
+			for _, fileInfo := range files {
+				if isTempArchive(fileInfo.Name()) {
+					os.Remove(filepath.Join(app.ArchiveDir(streamId), fileInfo.Name()))
+				}
+			}
+		}
+		tmpPath = filepath.Join(app.ArchiveDir(streamId), "tmp_"+RandSeq(8))
+		return writePartitionTar(app.StreamDir(streamId), tmpPath, partitions)
+	})
+	if e != nil {
+		if tmpPath != "" {
+			os.Remove(tmpPath)
+		}
+		return e
+	}
+	if len(partitions) == 0 {
+		return nil
+	}
+	e = app.Manager.ModifyStream(streamId, func(stream *Stream) error {
+		name := strconv.Itoa(partitions[len(partitions)-1])
+		archive := Archive{
+			Name:       filepath.ToSlash(filepath.Join("archives", name+".tar")),
+			Partitions: partitions,
+		}
+		index, err := json.Marshal(archive)
+		if err != nil {
+			return err
+		}
+		archivePath := filepath.Join(app.StreamDir(streamId), archive.Name)
+		if err := os.Rename(tmpPath, archivePath); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(app.ArchiveDir(streamId), name+".json"), index, 0776); err != nil {
+			return err
+		}
+		var removed int64
+		for _, partition := range partitions {
+			partitionDir := filepath.Join(app.StreamDir(streamId), strconv.Itoa(partition))
+			removed += dirSize(partitionDir)
+			os.RemoveAll(partitionDir)
+		}
+		streamData(stream).index.invalidate()
+		streamData(stream).filesChanged()
+		app.usage.Add(stream.TargetId, streamId, dirSize(archivePath)-removed)
+		return nil
+	})
+	if e != nil {
+		os.Remove(tmpPath)
+	}
+	return e
+}
+
+// A separate goroutine that periodically compacts the partitions of every stream.
+func (app *Application) RunCompactor() {
+	defer app.workerWG.Done()
+	for {
+		select {
+		case <-app.finish:
+			return
+		case <-time.After(time.Duration(COMPACT_INTERVAL) * time.Second):
+			for _, streamId := range app.Manager.StreamIds() {
+				select {
+				case <-app.finish:
+					return
+				default:
+				}
+				if err := app.CompactStream(streamId); err != nil {
+					log.Println("Unable to compact stream "+streamId+":", err)
+				}
+			}
+		}
+	}
+}
+
+// Returns true if name is the file name of an in-progress archive.
+func isTempArchive(name string) bool {
+	return strings.HasPrefix(name, "tmp_")
+}
@@ -0,0 +1,123 @@
+package scv
+
+import (
+	"../manager"
+	"log"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Returns the frame counts at which the streams of a target send a milestone
+// event, set by the "milestones" option of the target.
+func milestones(options map[string]interface{}) []int {
+	values, _ := options["milestones"].([]interface{})
+	result := make([]int, 0, len(values))
+	for _, value := range values {
+		if frames, ok := value.(float64); ok && frames > 0 {
+			result = append(result, int(frames))
+		}
+	}
+	return result
+}
+
+/*
+Sends the milestone events of a stream that just went from prevFrames to its
+current frames, and returns true once the stream has the max_frames of its
+target, in which case it is completed and the caller is expected to disable it.
+The stream must be locked for writing.
+*/
+func (app *Application) checkProgress(s *Stream, prevFrames int) bool {
+	options, err := app.targetOptions(s.TargetId)
+	if err != nil {
+		return false
+	}
+	for _, milestone := range milestones(options) {
+		if prevFrames < milestone && s.Frames >= milestone {
+			app.events.Publish(NewEvent(EVENT_MILESTONE, s, map[string]interface{}{
+				"milestone": milestone,
+				"frames":    s.Frames,
+			}))
+		}
+	}
+	max := optionInt(options, "max_frames", 0)
+	if max <= 0 || s.Frames < max {
+		return false
+	}
+	s.Completed = int(time.Now().Unix())
+	app.deferUpdate("streams", app.Config.Name, bson.M{"_id": s.StreamId}, bson.M{"$set": bson.M{"completed": s.Completed}})
+	app.events.Publish(NewEvent(EVENT_COMPLETED, s, map[string]interface{}{
+		"frames": s.Frames,
+	}))
+	return true
+}
+
+// Returns the frames of the streams of a target on this SCV, and how many of
+// them are completed.
+func (app *Application) targetProgress(targetId string) (frames, completed int) {
+	active, inactive, disabled := app.Manager.TargetStreams(targetId)
+	for _, streamId := range append(append(active, inactive...), disabled...) {
+		app.Manager.ReadStream(streamId, func(stream *Stream) error {
+			frames += stream.Frames
+			if stream.Completed > 0 {
+				completed += 1
+			}
+			return nil
+		})
+	}
+	return
+}
+
+/*
+Completes a target once its streams on this SCV have its max_target_frames:
+every enabled stream of the target is completed and disabled at once, sending
+completed and disabled events. Streams added or enabled later are completed by
+their next checkpoint.
+*/
+func (app *Application) checkTargetCompleted(targetId string) error {
+	options, err := app.targetOptions(targetId)
+	if err != nil {
+		return nil
+	}
+	max := optionInt(options, "max_target_frames", 0)
+	if max <= 0 {
+		return nil
+	}
+	frames, _ := app.targetProgress(targetId)
+	if frames < max {
+		return nil
+	}
+	now := int(time.Now().Unix())
+	events := make([]Event, 0)
+	enabled := func(s *Stream) bool { return s.MongoStatus == "enabled" }
+	streamIds, err := app.Manager.UpdateStreams(targetId, enabled, manager.StreamPatch{Status: "disabled"}, func(streams []*Stream) error {
+		if len(streams) == 0 {
+			return nil
+		}
+		ids := make([]string, 0, len(streams))
+		for _, s := range streams {
+			ids = append(ids, s.StreamId)
+		}
+		if err := app.Database.UpdateStreams(ids, bson.M{"status": "disabled", "completed": now}, nil); err != nil {
+			return err
+		}
+		for _, s := range streams {
+			s.Completed = now
+			events = append(events, NewEvent(EVENT_COMPLETED, s, map[string]interface{}{
+				"frames":        s.Frames,
+				"target_frames": frames,
+			}), NewEvent(EVENT_DISABLED, s, nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		app.events.Publish(e)
+	}
+	if len(streamIds) > 0 {
+		log.Printf("Target %s completed with %d frames, disabled %d streams", targetId, frames, len(streamIds))
+	}
+	return nil
+}
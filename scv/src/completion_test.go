@@ -0,0 +1,72 @@
+package scv
+
+import (
+	"../manager"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCompletion(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "completion")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(dir, "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{
+		Database:     db,
+		Manager:      manager.NewManager(intf),
+		events:       NewEventBus(),
+		optionsCache: NewResultCache(time.Minute),
+		stats:        NewStatsWriter(16),
+	}
+	app.optionsCache.Put("options:t1", map[string]interface{}{
+		"milestones":        []interface{}{2.0, 4.0},
+		"max_frames":        6.0,
+		"max_target_frames": 9.0,
+	})
+	sub := app.events.Subscribe("", "", nil)
+	defer app.events.Unsubscribe(sub)
+
+	now := int(time.Now().Unix())
+	s1 := newStream("s1", "t1", "none", 0, 0, now)
+	s2 := newStream("s2", "t1", "none", 0, 0, now)
+	for _, s := range []*Stream{s1, s2} {
+		assert.Nil(t, db.InsertStream(bson.M{"_id": s.StreamId, "target_id": "t1", "status": "enabled"}))
+		app.Manager.AddStream(s, "t1", true)
+	}
+	s1.Frames = 5
+	assert.False(t, app.checkProgress(s1, 1))
+	for _, milestone := range []int{2, 4} {
+		e := <-sub.C
+		assert.Equal(t, e.Type, EVENT_MILESTONE)
+		assert.Equal(t, e.Data["milestone"], milestone)
+	}
+	s1.Frames = 6
+	assert.True(t, app.checkProgress(s1, 5))
+	e := <-sub.C
+	assert.Equal(t, e.Type, EVENT_COMPLETED)
+	assert.True(t, s1.Completed > 0)
+
+	// the target is not complete yet
+	s1.Completed = 0
+	s2.Frames = 2
+	assert.Nil(t, app.checkTargetCompleted("t1"))
+	_, inactive, _ := app.Manager.TargetStreams("t1")
+	assert.Equal(t, len(inactive), 2)
+	s2.Frames = 3
+	assert.Nil(t, app.checkTargetCompleted("t1"))
+	_, inactive, disabled := app.Manager.TargetStreams("t1")
+	assert.Equal(t, len(inactive), 0)
+	assert.Equal(t, disabled, []string{"s1", "s2"})
+	frames, completed := app.targetProgress("t1")
+	assert.Equal(t, frames, 9)
+	assert.Equal(t, completed, 2)
+	doc := bson.M{}
+	assert.Nil(t, db.FindStream("s2", &doc))
+	assert.Equal(t, doc["status"], "disabled")
+}
@@ -0,0 +1,314 @@
+package scv
+
+import (
+	"../manager"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Configuration fields that are only read when the SCV starts. Changing them
+// in the configuration file has no effect until the SCV is restarted. Every
+// other field is applied by Reload.
+var RESTART_FIELDS = map[string]bool{
+	"Database":        true,
+	"MongoURI":        true,
+	"Name":            true,
+	"ExternalHost":    true,
+	"InternalHost":    true,
+	"LoadWorkers":     true,
+	"WriteWorkers":    true,
+	"Plugins":         true,
+	"PluginWorkers":   true,
+	"SkipFrameVerify": true,
+	"LazyLoad":        true,
+	"EmbeddedImport":  true,
+	"ServerTimeouts":  true,
+	"DisableHTTP2":    true,
+}
+
+// Read a JSON configuration file.
+func LoadConfiguration(path string) (Configuration, error) {
+	config := Configuration{
+		SSL: make(map[string]string),
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return config, err
+	}
+	defer file.Close()
+	err = json.NewDecoder(file).Decode(&config)
+	return config, err
+}
+
+// Returns a copy of the current configuration. Fields that may change on
+// Reload must be read through Settings rather than app.Config.
+func (app *Application) Settings() Configuration {
+	app.configMutex.RLock()
+	defer app.configMutex.RUnlock()
+	return app.Config
+}
+
+func (app *Application) loadCertificate(ssl map[string]string) error {
+	cert, err := tls.LoadX509KeyPair(ssl["Cert"], ssl["Key"])
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if ssl["ClientCA"] != "" {
+		buf, err := ioutil.ReadFile(ssl["ClientCA"])
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if clientCAs.AppendCertsFromPEM(buf) == false {
+			return errors.New("No certificates found in " + ssl["ClientCA"])
+		}
+	}
+	app.configMutex.Lock()
+	app.certificate = &cert
+	app.clientCAs = clientCAs
+	app.configMutex.Unlock()
+	return nil
+}
+
+// Used as the server's tls.Config.GetCertificate so that certificates can be
+// swapped without restarting the listener.
+func (app *Application) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	app.configMutex.RLock()
+	defer app.configMutex.RUnlock()
+	if app.certificate == nil {
+		return nil, errors.New("No certificate loaded")
+	}
+	return app.certificate, nil
+}
+
+// Used as the server's tls.Config.GetConfigForClient. If SSL["ClientCA"] is
+// set, clients are asked for a certificate, which is verified if given. Cores
+// and managers do not have one, so the handshake does not require it.
+func (app *Application) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	app.configMutex.RLock()
+	defer app.configMutex.RUnlock()
+	if app.clientCAs == nil {
+		return nil, nil
+	}
+	config := app.server.TLSConfig.Clone()
+	config.GetConfigForClient = nil
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	config.ClientCAs = app.clientCAs
+	return config, nil
+}
+
+/*
+Returns true if the request was made by the CC. The CC authenticates with a
+client certificate signed by SSL["ClientCA"] or with the SCV's password in the
+Authorization header. The password is not accepted if SSL["ClientCertOnly"] is
+"true" and a client CA is configured.
+*/
+func (app *Application) isCC(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	settings := app.Settings()
+	if settings.SSL["ClientCA"] != "" && settings.SSL["ClientCertOnly"] == "true" {
+		return false
+	}
+	token := r.Header.Get("Authorization")
+	return token != "" && token == settings.Password
+}
+
+/*
+Re-read the configuration file and apply every field that changed, except for
+the RESTART_FIELDS. Returns the names of the fields that were applied and of
+those that changed but need a restart. Nothing is applied if the file cannot be
+read, its maintenance windows or auth providers are invalid or the new
+certificates cannot be loaded.
+*/
+func (app *Application) Reload() (applied []string, restart []string, err error) {
+	app.reloadMutex.Lock()
+	defer app.reloadMutex.Unlock()
+	applied = make([]string, 0)
+	restart = make([]string, 0)
+	if app.ConfigPath == "" {
+		return applied, restart, errors.New("SCV was not started from a configuration file")
+	}
+	config, err := LoadConfiguration(app.ConfigPath)
+	if err != nil {
+		return applied, restart, err
+	}
+	if err := validateMaintenance(config.Maintenance); err != nil {
+		return applied, restart, err
+	}
+	providers, err := newAuthProviders(app.Database, config.AuthProviders)
+	if err != nil {
+		return applied, restart, err
+	}
+	old := app.Settings()
+	oldValue := reflect.ValueOf(old)
+	newValue := reflect.ValueOf(config)
+	merged := reflect.ValueOf(&old).Elem()
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := oldValue.Type().Field(i).Name
+		a, b := oldValue.Field(i), newValue.Field(i)
+		if reflect.DeepEqual(a.Interface(), b.Interface()) {
+			continue
+		}
+		if a.Kind() == reflect.Map && a.Len() == 0 && b.Len() == 0 {
+			continue
+		}
+		if RESTART_FIELDS[name] {
+			restart = append(restart, name)
+			continue
+		}
+		if name == "SSL" {
+			// certificates can be swapped, but switching between http and
+			// https needs a new listener.
+			_, err := app.getCertificate(nil)
+			if err != nil || len(config.SSL) == 0 {
+				restart = append(restart, name)
+				continue
+			}
+			if err := app.loadCertificate(config.SSL); err != nil {
+				return make([]string, 0), make([]string, 0), err
+			}
+		}
+		merged.Field(i).Set(newValue.Field(i))
+		applied = append(applied, name)
+	}
+	sort.Strings(applied)
+	sort.Strings(restart)
+	changed := make(map[string]bool)
+	for _, name := range applied {
+		changed[name] = true
+	}
+	app.configMutex.Lock()
+	app.Config = old
+	app.configMutex.Unlock()
+	if changed["Password"] {
+		if err := app.Database.UpdateSCV(old.Name, bson.M{"password": old.Password}); err != nil {
+			log.Println("Unable to update password in servers.scvs:", err)
+		}
+	}
+	if changed["ExpirationTime"] {
+		app.Manager.SetExpirationTime(expirationTime(old.ExpirationTime))
+	}
+	if changed["QuarantineErrors"] {
+		app.Manager.SetQuarantineErrors(quarantineErrors(old.QuarantineErrors))
+	}
+	if changed["CooldownTime"] {
+		app.Manager.SetCooldownTime(cooldownTime(old.CooldownTime))
+	}
+	if changed["MaxDonorStreams"] || changed["TrustedDonors"] {
+		app.Manager.SetDonorLimit(old.MaxDonorStreams, old.TrustedDonors)
+	}
+	if changed["TokenCacheTTL"] {
+		app.tokenCache.SetTTL(tokenCacheTTL(old.TokenCacheTTL))
+	}
+	if changed["AuthProviders"] {
+		// users identified by a removed provider must authenticate again
+		app.setAuthProviders(providers)
+		app.tokenCache.Clear()
+	}
+	if changed["StreamIngest"] || changed["GlobalIngest"] {
+		app.ingest.SetLimits(old.StreamIngest, old.GlobalIngest)
+	}
+	if changed["RateLimits"] {
+		for class, limiter := range app.rateLimiters {
+			limiter.SetLimit(old.RateLimits[class])
+		}
+	}
+	log.Printf("Reloaded configuration, applied: %v, restart required: %v", applied, restart)
+	return applied, restart, nil
+}
+
+func expirationTime(seconds int) int {
+	if seconds <= 0 {
+		return manager.STREAM_EXPIRATION_TIME
+	}
+	return seconds
+}
+
+func loadWorkers(count int) int {
+	if count <= 0 {
+		return LOAD_WORKERS
+	}
+	return count
+}
+
+func writeWorkers(count int) int {
+	if count <= 0 {
+		return WRITE_WORKERS
+	}
+	return count
+}
+
+func quarantineErrors(count int) int {
+	if count == 0 {
+		return manager.QUARANTINE_ERRORS
+	} else if count < 0 {
+		return 0
+	}
+	return count
+}
+
+func cooldownTime(seconds int) int {
+	if seconds == 0 {
+		return manager.COOLDOWN_TIME
+	} else if seconds < 0 {
+		return 0
+	}
+	return seconds
+}
+
+func tokenCacheTTL(seconds int) time.Duration {
+	if seconds == 0 {
+		seconds = TOKEN_CACHE_TTL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+/*
+.. http:post:: /admin/reload
+    Re-read the SCV's configuration file and apply the fields that can
+    be changed while running. The same happens when the SCV receives a
+    SIGHUP.
+    .. note:: This request can only be made by CCs.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "applied": ["Password", "RateLimits"],
+            "restart_required": ["InternalHost"]
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) ReloadHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if app.isCC(r) == false {
+			return ErrUnauthorized
+		}
+		applied, restart, err := app.Reload()
+		if err != nil {
+			return errors.New("Unable to reload configuration: " + err.Error())
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"applied":          applied,
+			"restart_required": restart,
+		})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,116 @@
+package scv
+
+import (
+	"../manager"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	file, err := ioutil.TempFile("", "scv_config")
+	assert.Nil(t, err)
+	file.WriteString(data)
+	file.Close()
+	return file.Name()
+}
+
+func TestReload(t *testing.T) {
+	app := &Application{
+		Config: Configuration{
+			Name:         "testServer",
+			Password:     "hello",
+			InternalHost: "127.0.0.1",
+		},
+		tokenCache:   NewTokenCache(tokenCacheTTL(0)),
+		rateLimiters: newRateLimiters(nil),
+	}
+	app.Manager = manager.NewManager(app)
+	_, _, err := app.Reload()
+	assert.NotNil(t, err)
+
+	app.ConfigPath = writeConfig(t, `{
+		"Name": "testServer",
+		"Password": "hello",
+		"InternalHost": "127.0.0.1:8080",
+		"ExpirationTime": 60,
+		"TargetQuota": 1024,
+		"RateLimits": {"core": {"Rate": 2, "Burst": 5}},
+		"PluginWorkers": 4
+	}`)
+	defer os.Remove(app.ConfigPath)
+	applied, restart, err := app.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, applied, []string{"ExpirationTime", "RateLimits", "TargetQuota"})
+	assert.Equal(t, restart, []string{"InternalHost", "PluginWorkers"})
+	assert.Equal(t, app.Settings().InternalHost, "127.0.0.1")
+	assert.Equal(t, app.Settings().TargetQuota, int64(1024))
+	assert.Equal(t, app.Manager.ExpirationTime(), 60)
+	assert.Equal(t, app.rateLimiters[RATE_CORE].Metrics()["burst"], 5)
+	assert.Equal(t, app.rateLimiters[RATE_MANAGER].Metrics()["rate"], 0.0)
+
+	// reloading an unchanged file is a no-op
+	applied, restart, err = app.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, applied, []string{})
+	assert.Equal(t, restart, []string{"InternalHost", "PluginWorkers"})
+
+	// enabling TLS requires a new listener
+	app.ConfigPath = writeConfig(t, `{
+		"Name": "testServer",
+		"Password": "hello",
+		"InternalHost": "127.0.0.1:8080",
+		"ExpirationTime": 60,
+		"TargetQuota": 1024,
+		"RateLimits": {"core": {"Rate": 2, "Burst": 5}},
+		"SSL": {"Cert": "a", "Key": "b"}
+	}`)
+	defer os.Remove(app.ConfigPath)
+	applied, restart, err = app.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, applied, []string{})
+	assert.Equal(t, restart, []string{"InternalHost", "SSL"})
+	assert.Equal(t, len(app.Settings().SSL), 0)
+
+	// auth providers are swapped, unless one is invalid
+	app.ConfigPath = writeConfig(t, `{
+		"Name": "testServer",
+		"Password": "hello",
+		"AuthProviders": [{"Type": "oidc", "Issuer": "https://sso.example.edu"}]
+	}`)
+	defer os.Remove(app.ConfigPath)
+	_, _, err = app.Reload()
+	assert.NotNil(t, err)
+	app.ConfigPath = writeConfig(t, `{
+		"Name": "testServer",
+		"Password": "hello",
+		"AuthProviders": [{"Type": "oidc", "Issuer": "https://sso.example.edu", "Audience": "scv"}]
+	}`)
+	defer os.Remove(app.ConfigPath)
+	applied, _, err = app.Reload()
+	assert.Nil(t, err)
+	assert.True(t, containsString(applied, "AuthProviders"))
+	assert.Equal(t, len(app.authProviders()), 1)
+	assert.Equal(t, app.authProviders()[0].(*oidcAuth).audience, "scv")
+}
+
+func TestIsCC(t *testing.T) {
+	app := &Application{Config: Configuration{Password: "hello"}}
+	req, _ := http.NewRequest("POST", "/streams/activate", nil)
+	assert.False(t, app.isCC(req))
+	req.Header.Set("Authorization", "hello")
+	assert.True(t, app.isCC(req))
+
+	// the password is refused once client certificates are required
+	app.Config.SSL = map[string]string{"ClientCA": "ca.pem", "ClientCertOnly": "true"}
+	assert.False(t, app.isCC(req))
+	req.TLS = &tls.ConnectionState{}
+	assert.False(t, app.isCC(req))
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{&x509.Certificate{}}}
+	assert.True(t, app.isCC(req))
+}
@@ -0,0 +1,100 @@
+package scv
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Headers and methods allowed by default when CORS is enabled.
+var CORS_HEADERS = []string{"Authorization", "Content-Type", "If-None-Match", "X-Request-ID"}
+var CORS_METHODS = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// Headers browsers let scripts read from cross-origin replies.
+var CORS_EXPOSED_HEADERS = []string{"ETag", "Retry-After", "X-Request-ID"}
+
+// Cross-origin access to the manager routes, so that a web dashboard can call
+// the SCV directly. CORS is disabled unless AllowedOrigins is set.
+type CORS struct {
+	AllowedOrigins []string `json:"AllowedOrigins"` // "*" allows any origin
+	AllowedHeaders []string `json:"AllowedHeaders"` // CORS_HEADERS if empty
+	AllowedMethods []string `json:"AllowedMethods"` // CORS_METHODS if empty
+	MaxAge         int      `json:"MaxAge"`         // seconds a preflight reply may be cached, 0 to leave it to the browser
+}
+
+func (c CORS) allows(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func (c CORS) headers() []string {
+	if len(c.AllowedHeaders) == 0 {
+		return CORS_HEADERS
+	}
+	return c.AllowedHeaders
+}
+
+func (c CORS) methods() []string {
+	if len(c.AllowedMethods) == 0 {
+		return CORS_METHODS
+	}
+	return c.AllowedMethods
+}
+
+// Routes used by cores and the CC are never called from a browser.
+func corsRoute(path string) bool {
+	return strings.HasPrefix(path, "/core/") == false &&
+		strings.HasPrefix(path, "/admin/") == false &&
+		path != "/streams/activate"
+}
+
+// Returns the CORS settings if the request comes from an allowed origin and
+// is made to a manager route.
+func (app *Application) corsAllowed(r *http.Request) (CORS, bool) {
+	cors := app.Settings().CORS
+	origin := r.Header.Get("Origin")
+	if origin == "" || corsRoute(r.URL.Path) == false {
+		return cors, false
+	}
+	return cors, cors.allows(origin)
+}
+
+// Middleware adding the CORS headers to replies to allowed origins.
+func (app *Application) CORSMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if _, ok := app.corsAllowed(r); ok {
+			w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(CORS_EXPOSED_HEADERS, ", "))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+.. http:options:: /*
+    Answer the preflight request of a browser. The allowed methods and
+    headers are only listed for allowed origins.
+    :reqheader Origin: origin of the page making the request
+    :resheader Access-Control-Allow-Methods: methods that may be used
+    :resheader Access-Control-Allow-Headers: headers that may be sent
+    :resheader Access-Control-Max-Age: seconds the reply may be cached
+    :status 204: No content
+*/
+func (app *Application) PreflightHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if cors, ok := app.corsAllowed(r); ok {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(cors.methods(), ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.headers(), ", "))
+			if cors.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
@@ -0,0 +1,51 @@
+package scv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	app := &Application{Config: Configuration{CORS: CORS{
+		AllowedOrigins: []string{"https://dashboard.example.org"},
+		MaxAge:         600,
+	}}}
+	app.Router = mux.NewRouter()
+	app.Router.Use(app.CORSMiddleware)
+	app.Router.Methods("OPTIONS").Handler(app.PreflightHandler())
+	app.Router.Handle("/targets/{target_id}/stats", AppHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return nil
+	})).Methods("GET")
+
+	req, _ := http.NewRequest("OPTIONS", "/targets/t1/stats", nil)
+	req.Header.Set("Origin", "https://dashboard.example.org")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 204)
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Origin"), "https://dashboard.example.org")
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Headers"), "Authorization, Content-Type, If-None-Match, X-Request-ID")
+	assert.Equal(t, w.Header().Get("Access-Control-Max-Age"), "600")
+
+	req, _ = http.NewRequest("GET", "/targets/t1/stats", nil)
+	req.Header.Set("Origin", "https://dashboard.example.org")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Origin"), "https://dashboard.example.org")
+
+	// other origins and core routes get no CORS headers
+	req, _ = http.NewRequest("GET", "/targets/t1/stats", nil)
+	req.Header.Set("Origin", "https://evil.example.org")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Origin"), "")
+	req, _ = http.NewRequest("OPTIONS", "/core/frame", nil)
+	req.Header.Set("Origin", "https://dashboard.example.org")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Header().Get("Access-Control-Allow-Methods"), "")
+}
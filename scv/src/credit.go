@@ -0,0 +1,390 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// How often, in seconds, donor credit is recomputed from the stats DB.
+const CREDIT_INTERVAL int = 600
+
+// Points awarded per frame for targets that do not set points_per_frame in
+// their options.
+const DEFAULT_POINTS_PER_FRAME float64 = 1
+
+// Default and maximum number of donors returned by /leaderboard.
+const LEADERBOARD_SIZE int = 100
+const MAX_LEADERBOARD_SIZE int = 1000
+
+// Default and maximum number of sessions returned by /donors/:user/sessions,
+// and the most rows it reads over every target to build a page.
+const DONOR_SESSIONS_SIZE int = 50
+const MAX_DONOR_SESSIONS_SIZE int = 500
+const MAX_DONOR_SESSIONS_ROWS int = 5000
+
+// The kind of device a session ran on, see engineDevice.
+const (
+	DEVICE_GPU string = "gpu"
+	DEVICE_CPU string = "cpu"
+)
+
+// Returns the device of the cores of an engine. Engines are named after their
+// platform, eg. openmm_60_opencl or openmm_60_cpu, and those without a cpu
+// part are taken to run on GPUs.
+func engineDevice(engine string) string {
+	for _, part := range strings.FieldsFunc(strings.ToLower(engine), func(c rune) bool {
+		return c == '_' || c == '-' || c == '.'
+	}) {
+		if part == DEVICE_CPU {
+			return DEVICE_CPU
+		}
+	}
+	return DEVICE_GPU
+}
+
+type TargetCredit struct {
+	Frames   float64 `json:"frames" bson:"frames"`
+	Points   float64 `json:"points" bson:"points"`
+	Sessions int     `json:"sessions" bson:"sessions"`
+	GPUHours float64 `json:"gpu_hours" bson:"gpu_hours"` // wall-clock hours of the sessions
+	CPUHours float64 `json:"cpu_hours" bson:"cpu_hours"`
+}
+
+// Totals of a donor across every target, stored in credit.donors.
+type DonorCredit struct {
+	User     string                  `json:"user" bson:"_id"`
+	Frames   float64                 `json:"frames" bson:"frames"`
+	Points   float64                 `json:"points" bson:"points"`
+	Sessions int                     `json:"sessions" bson:"sessions"`
+	GPUHours float64                 `json:"gpu_hours" bson:"gpu_hours"`
+	CPUHours float64                 `json:"cpu_hours" bson:"cpu_hours"`
+	Targets  map[string]TargetCredit `json:"targets,omitempty" bson:"targets"`
+	Updated  int                     `json:"updated" bson:"updated"`
+}
+
+// Returns the points_per_frame option of a target.
+func (app *Application) pointsPerFrame(targetId string) float64 {
+	options, err := app.targetOptions(targetId)
+	if err != nil {
+		return DEFAULT_POINTS_PER_FRAME
+	}
+	switch v := options["points_per_frame"].(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	}
+	return DEFAULT_POINTS_PER_FRAME
+}
+
+/*
+Recompute the credit of every donor from the stats DB, which holds one
+collection per target. Totals are recomputed from scratch on each pass, so
+changing a target's points_per_frame applies retroactively. Anonymous sessions
+do not earn credit. Hours are the wall-clock time of the sessions, split by the
+device of their engine.
+*/
+func (app *Application) UpdateCredit() error {
+	names, err := app.Database.StatsTargets()
+	if err != nil {
+		return err
+	}
+	now := int(time.Now().Unix())
+	donors := make(map[string]*DonorCredit)
+	for _, targetId := range names {
+		ppf := app.pointsPerFrame(targetId)
+		rows, err := app.Database.DonorTotals(targetId)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if row.User == "" {
+				continue
+			}
+			donor, ok := donors[row.User]
+			if ok == false {
+				donor = &DonorCredit{
+					User:    row.User,
+					Targets: make(map[string]TargetCredit),
+					Updated: now,
+				}
+				donors[row.User] = donor
+			}
+			points := row.Frames * ppf
+			gpuHours := float64(row.GPUSeconds) / 3600
+			cpuHours := float64(row.CPUSeconds) / 3600
+			donor.Frames += row.Frames
+			donor.Points += points
+			donor.Sessions += row.Sessions
+			donor.GPUHours += gpuHours
+			donor.CPUHours += cpuHours
+			donor.Targets[targetId] = TargetCredit{row.Frames, points, row.Sessions, gpuHours, cpuHours}
+		}
+	}
+	for _, donor := range donors {
+		if err := app.Database.UpsertCredit(donor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A separate goroutine that periodically recomputes donor credit.
+func (app *Application) RunCreditor() {
+	defer app.workerWG.Done()
+	for {
+		select {
+		case <-app.finish:
+			return
+		case <-time.After(time.Duration(CREDIT_INTERVAL) * time.Second):
+			if err := app.UpdateCredit(); err != nil {
+				log.Println("Unable to update credit:", err)
+			}
+		}
+	}
+}
+
+/*
+.. http:get:: /donors/:user/stats
+    Credit earned by a donor, in total and per target. Credit is
+    recomputed every few minutes.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "user": "jesse_v",
+            "frames": 120.5,
+            "points": 241,
+            "sessions": 14,
+            "gpu_hours": 52.5, // wall-clock hours of the sessions
+            "cpu_hours": 3.25,
+            "rank": 3,
+            "targets": {
+                "target_id": {"frames": 120.5, "points": 241, "sessions": 14, "gpu_hours": 52.5, "cpu_hours": 3.25}
+            },
+            "updated": 1404502030
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) DonorStatsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user := mux.Vars(r)["user"]
+		donor, err := app.Database.Credit(user)
+		if err != nil {
+			return ErrNotFound.With("donor " + user + " has no credit")
+		}
+		ahead, err := app.Database.CreditRank(donor.Points)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(struct {
+			DonorCredit
+			Rank int `json:"rank"`
+		}{donor, ahead + 1})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+Position of a session in the sessions of a donor over every target. Sessions
+are ordered by end time, then by target and id for those ending at the same
+time, newest first, so that a page of /donors/:user/sessions starts after the
+last session of the previous one.
+*/
+type SessionCursor struct {
+	EndTime  int
+	TargetId string
+	Id       bson.ObjectId
+}
+
+func newSessionCursor(targetId string, s Session) *SessionCursor {
+	return &SessionCursor{s.EndTime, targetId, s.Id}
+}
+
+// Parse a cursor returned in the next field of /donors/:user/sessions.
+func parseSessionCursor(value string) (*SessionCursor, error) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 || bson.IsObjectIdHex(parts[1]) == false {
+		return nil, errors.New("Bad cursor")
+	}
+	endTime, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errors.New("Bad cursor")
+	}
+	return &SessionCursor{endTime, parts[2], bson.ObjectIdHex(parts[1])}, nil
+}
+
+// Target ids may contain colons, so they go last.
+func (c *SessionCursor) String() string {
+	return strconv.Itoa(c.EndTime) + ":" + c.Id.Hex() + ":" + c.TargetId
+}
+
+// Returns true if the session s of a target comes after the cursor.
+func (c *SessionCursor) Before(targetId string, s Session) bool {
+	if s.EndTime != c.EndTime {
+		return s.EndTime < c.EndTime
+	}
+	if targetId != c.TargetId {
+		return targetId < c.TargetId
+	}
+	return s.Id < c.Id
+}
+
+/*
+.. http:get:: /donors/:user/sessions
+    The sessions of a donor, newest first, so that projects can
+    acknowledge their contributors. Sessions appear shortly after the
+    stream is deactivated, as in ``/streams/history``.
+    :query target_id: only list the sessions of this target
+    :query limit: number of sessions returned, 50 by default, at most 500
+    :query after: ``next`` of the previous page
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "sessions": [
+                {
+                    "target_id": "target_id",
+                    "user": "jesse_v",
+                    "engine": "openmm_60_opencl",
+                    "device": "gpu",
+                    "start_time": 1404502030,
+                    "end_time": 1404505630,
+                    "seconds": 3600, // wall-clock
+                    "frames": 10.5,
+                    "start_frames": 0,
+                    "end_frames": 10,
+                    "error": false
+                }
+            ],
+            "next": "1404505630:5f1d7c...:target_id" // omitted on the last page
+        }
+    .. note:: A page is built from at most 5000 sessions read over every
+        target, so the limit is lowered when the donor contributed to
+        many targets. Filter by ``target_id`` beyond 5000 targets.
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) DonorSessionsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user := mux.Vars(r)["user"]
+		query := r.URL.Query()
+		limit := DONOR_SESSIONS_SIZE
+		if value := query.Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+				return errors.New("Bad limit")
+			}
+			if limit > MAX_DONOR_SESSIONS_SIZE {
+				limit = MAX_DONOR_SESSIONS_SIZE
+			}
+		}
+		var after *SessionCursor
+		if value := query.Get("after"); value != "" {
+			var err error
+			if after, err = parseSessionCursor(value); err != nil {
+				return err
+			}
+		}
+		targets := []string{query.Get("target_id")}
+		if targets[0] == "" {
+			var err error
+			if targets, err = app.Database.StatsTargets(); err != nil {
+				return err
+			}
+		}
+		// the page is cut from the newest sessions of every target, one
+		// more than needed telling if there is a next page
+		if len(targets) > MAX_DONOR_SESSIONS_ROWS/2 {
+			return errors.New("Bad request: too many targets, set target_id")
+		}
+		if len(targets)*(limit+1) > MAX_DONOR_SESSIONS_ROWS {
+			limit = MAX_DONOR_SESSIONS_ROWS/len(targets) - 1
+		}
+		sessions := make([]Session, 0)
+		for _, targetId := range targets {
+			rows, err := app.Database.DonorSessions(targetId, user, after, limit+1)
+			if err != nil {
+				return err
+			}
+			for i := range rows {
+				rows[i].TargetId = targetId
+				rows[i].complete()
+			}
+			sessions = append(sessions, rows...)
+		}
+		sort.SliceStable(sessions, func(i, j int) bool {
+			return newSessionCursor(sessions[i].TargetId, sessions[i]).Before(sessions[j].TargetId, sessions[j])
+		})
+		reply := DonorSessionsReply{Sessions: sessions}
+		if len(sessions) > limit {
+			reply.Sessions = sessions[:limit]
+			last := sessions[limit-1]
+			reply.Next = newSessionCursor(last.TargetId, last).String()
+		}
+		data, err := json.Marshal(reply)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:get:: /leaderboard
+    Donors with the most points.
+    :query limit: number of donors returned, 100 by default, at most 1000
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "donors": [
+                {"user": "jesse_v", "frames": 120.5, "points": 241, "sessions": 14, "updated": 1404502030},
+                {"user": "yutong", "frames": 80, "points": 80, "sessions": 9, "updated": 1404502030}
+            ]
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) LeaderboardHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		limit := LEADERBOARD_SIZE
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+				return errors.New("Bad limit")
+			}
+			if limit > MAX_LEADERBOARD_SIZE {
+				limit = MAX_LEADERBOARD_SIZE
+			}
+		}
+		key := "leaderboard:" + strconv.Itoa(limit)
+		if cached, ok := app.statsCache.Get(key); ok {
+			w.Write(cached.([]byte))
+			return nil
+		}
+		donors, err := app.Database.Leaderboard(limit)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(map[string]interface{}{"donors": donors})
+		if err != nil {
+			return err
+		}
+		app.statsCache.Put(key, data)
+		w.Write(data)
+		return nil
+	}
+}
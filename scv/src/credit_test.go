@@ -0,0 +1,96 @@
+package scv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEngineDevice(t *testing.T) {
+	assert.Equal(t, engineDevice("openmm_60_cpu"), DEVICE_CPU)
+	assert.Equal(t, engineDevice("OpenMM-CPU"), DEVICE_CPU)
+	assert.Equal(t, engineDevice("openmm_60_opencl"), DEVICE_GPU)
+	assert.Equal(t, engineDevice("openmm"), DEVICE_GPU)
+	assert.Equal(t, engineDevice("cpuless"), DEVICE_GPU)
+}
+
+func TestDonorSessions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sessions")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{Database: db}
+	ops := make([]*deferredOp, 0)
+	for i := 0; i < 5; i++ {
+		targetId, engine := "t1", "openmm_60_opencl"
+		if i%2 == 1 {
+			targetId, engine = "t2", "openmm_60_cpu"
+		}
+		ops = append(ops, &deferredOp{db: "stats", collection: targetId, doc: bson.M{"_id": bson.NewObjectId(),
+			"user": "joe", "engine": engine, "stream": "s", "frames": 1.0, "start_time": 100 * i, "end_time": 100*i + 60}})
+	}
+	// sessions ending at the same time, ordered by target then id
+	for _, targetId := range []string{"t1", "t2", "t1"} {
+		ops = append(ops, &deferredOp{db: "stats", collection: targetId, doc: bson.M{"_id": bson.NewObjectId(),
+			"user": "joe", "engine": "openmm_60_opencl", "stream": "s", "frames": 1.0, "start_time": 350, "end_time": 400}})
+	}
+	// recorded before sessions had a device and seconds
+	ops = append(ops, &deferredOp{db: "stats", collection: "t1", doc: bson.M{"_id": bson.NewObjectId(),
+		"user": "bob", "engine": "openmm_60_cpu", "stream": "s", "frames": 1.0, "start_time": 0, "end_time": 30}})
+	// writes are applied a collection at a time
+	for _, op := range ops {
+		written, _, _ := db.WriteDeferred([]*deferredOp{op})
+		assert.Equal(t, written, 1)
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/donors/{user}/sessions", app.DonorSessionsHandler())
+	get := func(url string) (DonorSessionsReply, int) {
+		req, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		reply := DonorSessionsReply{}
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return reply, w.Code
+	}
+	reply, code := get("/donors/joe/sessions?limit=2")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, len(reply.Sessions), 2)
+	assert.Equal(t, reply.Sessions[0].EndTime, 460)
+	assert.Equal(t, reply.Sessions[0].TargetId, "t1")
+	assert.Equal(t, reply.Sessions[1].TargetId, "t2")
+	assert.NotEqual(t, reply.Next, "")
+	// pages follow each other, including sessions ending at the same time
+	endTimes := make([]int, 0)
+	for url := "/donors/joe/sessions?limit=1"; ; {
+		reply, code = get(url)
+		assert.Equal(t, code, 200)
+		for _, session := range reply.Sessions {
+			endTimes = append(endTimes, session.EndTime)
+		}
+		if reply.Next == "" {
+			break
+		}
+		url = "/donors/joe/sessions?limit=1&after=" + reply.Next
+	}
+	assert.Equal(t, endTimes, []int{460, 400, 400, 400, 360, 260, 160, 60})
+	reply, _ = get("/donors/joe/sessions?target_id=t2")
+	assert.Equal(t, len(reply.Sessions), 3)
+	assert.Equal(t, reply.Next, "")
+	reply, _ = get("/donors/bob/sessions")
+	assert.Equal(t, reply.Sessions[0].Seconds, 30)
+	assert.Equal(t, reply.Sessions[0].Device, DEVICE_CPU)
+	_, code = get("/donors/joe/sessions?limit=0")
+	assert.Equal(t, code, 400)
+	_, code = get("/donors/joe/sessions?after=460")
+	assert.Equal(t, code, 400)
+}
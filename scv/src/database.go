@@ -0,0 +1,120 @@
+package scv
+
+// Frames, sessions and wall-clock seconds of a donor on a target, as summed
+// from the stats DB. Sessions recorded without a device count as GPU time.
+type DonorTotal struct {
+	User       string  `bson:"_id"`
+	Frames     float64 `bson:"frames"`
+	Sessions   int     `bson:"sessions"`
+	GPUSeconds int     `bson:"gpu_seconds"`
+	CPUSeconds int     `bson:"cpu_seconds"`
+}
+
+/*
+Database is the persistence layer of the SCV. Handlers go through it instead of
+querying Mongo directly, so that other backends can be plugged in and handlers
+can be tested against a fake. Documents are described by the bson tags of the
+types they are decoded into, and updates by the fields to set and unset, whose
+names may be dotted paths into embedded documents (eg. meta.key). Methods
+return ErrNotFound when a document does not exist.
+*/
+type Database interface {
+	// users.all, users.managers and engines.keys
+	UserByToken(token string) (string, error)
+	Manager(user string) (map[string]interface{}, error)
+	Managers(users []string) ([]map[string]interface{}, error)
+	EngineByKey(key string) (string, error)
+
+	// users.tokens
+	InsertToken(token APIToken) error
+	TokenBySecret(secret string) (APIToken, error)
+	Token(id string) (APIToken, error)
+	UserTokens(user string) ([]APIToken, error)
+	SetTokenSecret(id, secret string) error
+	RemoveToken(id string) error
+
+	// data.targets
+	Target(id string) (map[string]interface{}, error)
+	InsertTarget(doc map[string]interface{}) error
+	UpdateTarget(id string, set, unset map[string]interface{}) error
+	// Public targets among ids that support engine.
+	PublicTargets(ids []string, engine string) ([]map[string]interface{}, error)
+	TargetSupports(id, engine string) (bool, error)
+
+	// data.bans
+	Ban(id string) (Ban, error)
+	Bans() ([]Ban, error)
+	InsertBan(ban Ban) error
+	RemoveBan(id string) error
+
+	// data.verifications, see recordVerification
+	DonorVerifications(user string) (DonorVerifications, error)
+	UpsertDonorVerifications(record *DonorVerifications) error
+	FlaggedDonors() ([]DonorVerifications, error)
+
+	// data.webhooks
+	Webhook(id string) (Webhook, error)
+	Webhooks(targetId string) ([]Webhook, error)
+	InsertWebhook(hook Webhook) error
+	RemoveWebhook(id string) error
+
+	// The streams of this SCV, including tombstones.
+	Streams() ([]Stream, error)
+	// The same, without the meta and options of the streams, see streamState.partial.
+	StreamSummaries() ([]Stream, error)
+	DeletedStreams() ([]string, error)
+	// Decode the document of a stream into result.
+	FindStream(id string, result interface{}) error
+	InsertStream(doc interface{}) error
+	UpdateStream(id string, set, unset map[string]interface{}) error
+	// Update the streams of ids at once.
+	UpdateStreams(ids []string, set, unset map[string]interface{}) error
+	RemoveStream(id string) error
+
+	// servers.scvs
+	UpsertSCV(config Configuration) error
+	UpdateSCV(name string, set map[string]interface{}) error
+
+	// servers.shards, the SCVs holding streams of each target
+	Shards(targetId string) ([]Shard, error)
+	SCVShards(scv string) ([]Shard, error)
+	UpsertShard(shard Shard) error
+	RemoveShard(id string) error
+
+	// The stats DB holds a collection of sessions per target.
+	StatsTargets() ([]string, error)
+	// Totals, unique users and daily frames of a target. Hours and Donors
+	// are left to the caller.
+	TargetStats(targetId string) (TargetStats, error)
+	DonorTotals(targetId string) ([]DonorTotal, error)
+	StreamSessions(targetId, streamId string) ([]Session, error)
+	// The limit most recent sessions of a donor on a target that come after
+	// the cursor, if any, newest first, see SessionCursor.
+	DonorSessions(targetId, user string, after *SessionCursor, limit int) ([]Session, error)
+
+	// The benchmarks DB holds a collection of benchmark sessions per engine.
+	Benchmarks(engine string) ([]DonorBenchmark, error)
+
+	// The errors DB holds a collection of core failures per target.
+	StreamErrors(targetId, streamId string) ([]StreamError, error)
+
+	// credit.donors
+	Credit(user string) (DonorCredit, error)
+	UpsertCredit(donor *DonorCredit) error
+	// Number of donors with more than points.
+	CreditRank(points float64) (int, error)
+	// Donors with the most points, without their per target credit.
+	Leaderboard(limit int) ([]DonorCredit, error)
+
+	// Apply the deferred writes of a single collection, in order. Returns the
+	// number of writes applied and the writes that failed. unreachable is true
+	// if the database could not be reached at all.
+	WriteDeferred(ops []*deferredOp) (written int, failed []*deferredOp, unreachable bool)
+	InsertDeadLetter(doc map[string]interface{}) error
+
+	EnsureIndexes() error
+	// Returns an error if the database cannot be reached within PING_TIMEOUT.
+	Ping() error
+	Metrics() map[string]interface{}
+	Close()
+}
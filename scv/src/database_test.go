@@ -0,0 +1,105 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A Database holding users, managers, tokens and targets in memory. Methods
+// that are not overridden panic.
+type fakeDatabase struct {
+	Database
+	users    map[string]string // token to user
+	managers map[string]map[string]interface{}
+	tokens   []APIToken
+	targets  map[string]map[string]interface{}
+	down     bool
+}
+
+func (d *fakeDatabase) Manager(user string) (map[string]interface{}, error) {
+	if doc, ok := d.managers[user]; ok {
+		return doc, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (d *fakeDatabase) UserByToken(token string) (string, error) {
+	if user, ok := d.users[token]; ok {
+		return user, nil
+	}
+	return "", ErrNotFound
+}
+
+func (d *fakeDatabase) TokenBySecret(secret string) (APIToken, error) {
+	for _, token := range d.tokens {
+		if token.Token == secret {
+			return token, nil
+		}
+	}
+	return APIToken{}, ErrNotFound
+}
+
+func (d *fakeDatabase) UserTokens(user string) ([]APIToken, error) {
+	res := make([]APIToken, 0)
+	for _, token := range d.tokens {
+		if token.User == user {
+			res = append(res, token)
+		}
+	}
+	return res, nil
+}
+
+func (d *fakeDatabase) Target(id string) (map[string]interface{}, error) {
+	if d.down {
+		return nil, errors.New("no reachable servers")
+	}
+	if doc, ok := d.targets[id]; ok {
+		return doc, nil
+	}
+	return nil, ErrNotFound
+}
+
+func TestListTokensWithoutMongo(t *testing.T) {
+	db := &fakeDatabase{
+		users: map[string]string{"secret": "yutong"},
+		tokens: []APIToken{
+			{Id: "a", Token: "token_a", User: "yutong"},
+			{Id: "b", Token: "token_b", User: "jesse_v"},
+		},
+	}
+	app := &Application{Database: db, tokenCache: NewTokenCache(time.Minute)}
+	req, _ := http.NewRequest("GET", "/auth/tokens", nil)
+	req.Header.Add("Authorization", "token_a")
+	w := httptest.NewRecorder()
+	app.ListTokensHandler().ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	res := struct {
+		Tokens []APIToken `json:"tokens"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	assert.Equal(t, len(res.Tokens), 1)
+	assert.Equal(t, res.Tokens[0].Id, "a")
+	assert.Equal(t, res.Tokens[0].Token, "")
+}
+
+func TestTargetOptionsDegraded(t *testing.T) {
+	db := &fakeDatabase{targets: map[string]map[string]interface{}{
+		"t1": {"options": map[string]interface{}{"steps_per_frame": 50000}},
+	}}
+	app := &Application{Database: db, optionsCache: NewResultCache(0)}
+	options, err := app.targetOptions("t1")
+	assert.Nil(t, err)
+	assert.Equal(t, options["steps_per_frame"], 50000)
+	db.down = true
+	options, err = app.targetOptions("t1")
+	assert.Nil(t, err)
+	assert.Equal(t, options["steps_per_frame"], 50000)
+	_, err = app.targetOptions("t2")
+	assert.NotNil(t, err)
+}
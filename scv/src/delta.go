@@ -0,0 +1,107 @@
+package scv
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A file of a partition as listed by /streams/sync?manifest=true.
+type ManifestFile struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Frame files only: position of the file in the frame file obtained by
+	// concatenating the partitions listed by /streams/sync in order.
+	Offset *int64 `json:"offset,omitempty"`
+}
+
+// The files of a partition, keyed by their path relative to the partition
+// directory (eg. 0/frames.xtc or 0/checkpoint_files/state.xml.gz.b64).
+type PartitionManifest struct {
+	Partition int                     `json:"partition"`
+	Files     map[string]ManifestFile `json:"files"`
+}
+
+// Returns the checkpoint directories of a partition in numerical order.
+func listCheckpoints(partitionDir string) ([]int, error) {
+	res := make([]int, 0)
+	files, err := ioutil.ReadDir(partitionDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fileInfo := range files {
+		checkpoint, err := strconv.Atoi(fileInfo.Name())
+		if err == nil && fileInfo.IsDir() {
+			res = append(res, checkpoint)
+		}
+	}
+	sort.Ints(res)
+	return res, nil
+}
+
+/*
+List the size and checksum of every file of the given partitions. Checksums
+are read from the manifests written with each checkpoint and only computed for
+directories written before checksums were introduced. Frame files also get
+their offset in the concatenated frame file, so that a client can tell which
+byte ranges it is missing. Stops with the error of ctx once it is done. The
+caller must hold a lock on the stream.
+*/
+func (app *Application) PartitionManifests(ctx context.Context, streamId string, partitions []int) ([]PartitionManifest, error) {
+	res := make([]PartitionManifest, 0, len(partitions))
+	offsets := make(map[string]int64)
+	for _, partition := range partitions {
+		partitionDir := filepath.Join(app.StreamDir(streamId), strconv.Itoa(partition))
+		checkpoints, err := listCheckpoints(partitionDir)
+		if err != nil {
+			return nil, err
+		}
+		files := make(map[string]ManifestFile)
+		for _, checkpoint := range checkpoints {
+			dir := filepath.Join(partitionDir, strconv.Itoa(checkpoint))
+			checksums, err := readChecksums(dir)
+			if err != nil {
+				return nil, err
+			}
+			err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				name, err := filepath.Rel(dir, path)
+				if err != nil {
+					return err
+				}
+				name = filepath.ToSlash(name)
+				if info.IsDir() || name == CHECKSUM_MANIFEST {
+					return nil
+				}
+				sum, ok := checksums[name]
+				if ok == false {
+					if sum, err = sha256File(path); err != nil {
+						return err
+					}
+				}
+				file := ManifestFile{Size: info.Size(), SHA256: sum}
+				if strings.Contains(name, "/") == false {
+					offset := offsets[name]
+					file.Offset = &offset
+					offsets[name] += info.Size()
+				}
+				files[strconv.Itoa(checkpoint)+"/"+name] = file
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, PartitionManifest{partition, files})
+	}
+	return res, nil
+}
@@ -0,0 +1,67 @@
+package scv
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Default free space on the data partition below which the SCV is read-only.
+const READ_ONLY_DISK_FREE int64 = 256 << 20
+
+// Seconds between two checks of the free space on the data partition.
+const DISK_CHECK_INTERVAL int = 10
+
+// Bytes free on the partition holding the data of the SCV, or -1 if unknown.
+func (app *Application) dataFree() int64 {
+	dataDir := app.Config.Name + "_data"
+	if exists, _ := pathExists(dataDir); exists == false {
+		// created along with the first stream, on the same partition
+		dataDir = "."
+	}
+	return diskFree(dataDir)
+}
+
+// Returns true while the data partition is full: no stream is activated or
+// added, and frames are refused. Checkpoints, downloads and syncs still work.
+func (app *Application) ReadOnly() bool {
+	return atomic.LoadInt32(&app.readOnly) == 1
+}
+
+// Compare the free space against ReadOnlyDiskFree and switch the SCV to or
+// from read-only mode. The CC is told through the SCV's heartbeat.
+func (app *Application) CheckDisk() {
+	threshold := app.Settings().ReadOnlyDiskFree
+	if threshold == 0 {
+		threshold = READ_ONLY_DISK_FREE
+	}
+	free := app.dataFree()
+	full := int32(0)
+	if threshold > 0 && free >= 0 && free < threshold {
+		full = 1
+	}
+	if atomic.SwapInt32(&app.readOnly, full) == full {
+		return
+	}
+	if full == 1 {
+		log.Printf("Only %d bytes free on the data partition, switching to read-only", free)
+	} else {
+		log.Printf("%d bytes free on the data partition, accepting frames again", free)
+	}
+	if err := app.Heartbeat(); err != nil {
+		log.Println("Unable to send heartbeat:", err)
+	}
+}
+
+// A separate goroutine that periodically checks the free space.
+func (app *Application) RunDiskMonitor() {
+	defer app.workerWG.Done()
+	for {
+		app.CheckDisk()
+		select {
+		case <-app.finish:
+			return
+		case <-time.After(time.Duration(DISK_CHECK_INTERVAL) * time.Second):
+		}
+	}
+}
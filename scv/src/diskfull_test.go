@@ -0,0 +1,48 @@
+package scv
+
+import (
+	"../manager"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnly(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "diskfull")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{
+		Config:   Configuration{Name: filepath.Join(dir, "scv"), ReadOnlyDiskFree: -1},
+		Database: db,
+		stats:    NewStatsWriter(4),
+		ingest:   NewIngestThrottle(RateLimit{}, RateLimit{}),
+	}
+	app.Manager = manager.NewManager(app)
+	app.CheckDisk()
+	assert.False(t, app.ReadOnly())
+	assert.Equal(t, app.heartbeatStatus()["status"], "online")
+
+	app.Config.ReadOnlyDiskFree = 1 << 62
+	app.CheckDisk()
+	assert.True(t, app.ReadOnly())
+	assert.Equal(t, app.heartbeatStatus()["status"], "full")
+	req, _ := http.NewRequest("PUT", "/core/frame", nil)
+	w := httptest.NewRecorder()
+	app.CoreFrameHandler().ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 507)
+	reply := ErrorReply{}
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	assert.Equal(t, reply.Code, "scv_full")
+
+	app.Config.ReadOnlyDiskFree = 1
+	app.CheckDisk()
+	assert.False(t, app.ReadOnly())
+}
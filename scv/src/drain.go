@@ -0,0 +1,70 @@
+package scv
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+var errDraining = ErrUnavailable.With("SCV is draining")
+
+// Returns true while the SCV is draining: streams are not activated, but
+// active streams keep running until their cores stop them, so that the SCV can
+// be restarted once no stream is active without failing any core.
+func (app *Application) Draining() bool {
+	return atomic.LoadInt32(&app.draining) == 1
+}
+
+// Start or stop draining. The CC is told right away through the SCV's heartbeat
+// so that it stops routing cores here.
+func (app *Application) SetDraining(draining bool) {
+	value := int32(0)
+	if draining {
+		value = 1
+	}
+	if atomic.SwapInt32(&app.draining, value) == value {
+		return
+	}
+	log.Printf("Draining: %v", draining)
+	if err := app.Heartbeat(); err != nil {
+		log.Println("Unable to send heartbeat:", err)
+	}
+}
+
+/*
+.. http:post:: /admin/drain
+    Stop activating streams. Active streams keep running, the reply
+    tells how many are left. The SCV reports itself as ``draining`` to
+    the CC until it is restarted or the drain is cancelled.
+    .. note:: This request can only be made by CCs.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "draining": true,
+            "active_streams": 12
+        }
+    :status 200: OK
+    :status 401: Not authenticated as a CC
+
+.. http:delete:: /admin/drain
+    Cancel a drain and activate streams again. The reply is the same as
+    for POST.
+    :status 200: OK
+    :status 401: Not authenticated as a CC
+*/
+func (app *Application) DrainHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if app.isCC(r) == false {
+			return ErrUnauthorized
+		}
+		app.SetDraining(r.Method == "POST")
+		active, _, _ := app.Manager.Counts()
+		data, err := json.Marshal(DrainReply{app.Draining(), active})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,1177 @@
+package scv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Extension of the files holding the collections of an EmbeddedDatabase.
+const EMBEDDED_EXT string = ".log"
+
+// Databases whose collections only ever get inserts and grow with every
+// session. Their documents are read back from the log when queried instead of
+// being kept in memory, only their ids are.
+var EMBEDDED_APPEND_ONLY = map[string]bool{
+	"stats":      true,
+	"benchmarks": true,
+	"errors":     true,
+}
+
+// Directory of the embedded database.
+func (app *Application) EmbeddedDir() string {
+	return filepath.Join(app.Config.Name+"_data", "db")
+}
+
+// A collection of an EmbeddedDatabase. Documents are kept in memory and every
+// change is appended to the collection's log.
+type embeddedCollection struct {
+	docs map[string]bson.M // keyed by embeddedId(_id), nil if appendOnly
+	ids  map[string]bool   // of the documents of an appendOnly collection
+	path string
+	log  *os.File
+
+	appendOnly bool // see EMBEDDED_APPEND_ONLY
+}
+
+func (c *embeddedCollection) count() int {
+	if c.appendOnly {
+		return len(c.ids)
+	}
+	return len(c.docs)
+}
+
+func (c *embeddedCollection) has(id string) bool {
+	if c.appendOnly {
+		return c.ids[id]
+	}
+	_, ok := c.docs[id]
+	return ok
+}
+
+/*
+EmbeddedDatabase implements Database without an external server, for single
+node deployments. Each collection is held in memory and persisted to its own
+append-only log of BSON records, one per insert, update or removal, in the
+directory given to OpenEmbeddedDatabase. Logs are replayed and compacted when
+the database is opened. Queries scan whole collections, which is fine for the
+number of users, targets and streams a single SCV handles.
+*/
+type EmbeddedDatabase struct {
+	sync.Mutex
+	dir         string
+	name        string // name of the SCV
+	collections map[string]*embeddedCollection
+	writes      int64
+}
+
+func OpenEmbeddedDatabase(dir, name string) (*EmbeddedDatabase, error) {
+	if err := os.MkdirAll(dir, 0776); err != nil {
+		return nil, err
+	}
+	d := &EmbeddedDatabase{
+		dir:         dir,
+		name:        name,
+		collections: make(map[string]*embeddedCollection),
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || strings.HasSuffix(file.Name(), EMBEDDED_EXT) == false {
+			continue
+		}
+		key, err := url.PathUnescape(strings.TrimSuffix(file.Name(), EMBEDDED_EXT))
+		if err != nil {
+			continue
+		}
+		if _, err := d.open(key); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+/*
+Upsert the users, managers and engine keys listed in a JSON file. With Mongo
+they are written by the CC, so this is the only way an embedded database gets
+the documents the SCV needs to authenticate anyone. The file holds an object
+whose "users", "managers" and "engine_keys" are lists of documents of
+users.all, users.managers and engines.keys, each with a string _id, eg.
+
+	{"users": [{"_id": "yutong", "token": "..."}],
+	 "managers": [{"_id": "yutong", "weight": 1}],
+	 "engine_keys": [{"_id": "...", "engine": "openmm"}]}
+*/
+func (d *EmbeddedDatabase) Import(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var lists struct {
+		Users      []bson.M `json:"users"`
+		Managers   []bson.M `json:"managers"`
+		EngineKeys []bson.M `json:"engine_keys"`
+	}
+	if err := json.Unmarshal(data, &lists); err != nil {
+		return err
+	}
+	collections := []struct {
+		db, collection string
+		docs           []bson.M
+	}{
+		{"users", "all", lists.Users},
+		{"users", "managers", lists.Managers},
+		{"engines", "keys", lists.EngineKeys},
+	}
+	for _, c := range collections {
+		for _, doc := range c.docs {
+			if id, ok := doc["_id"].(string); ok == false || id == "" {
+				return fmt.Errorf("Document of %s.%s without an _id", c.db, c.collection)
+			}
+			if err := d.upsert(c.db, c.collection, doc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// String form of an _id, used to key documents.
+func embeddedId(id interface{}) string {
+	if oid, ok := id.(bson.ObjectId); ok {
+		return oid.Hex()
+	}
+	return fmt.Sprint(id)
+}
+
+// Read a log, returning its records in order.
+func readEmbeddedLog(path string) ([]bson.M, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]bson.M, 0)
+	for len(data) >= 4 {
+		size := int(binary.LittleEndian.Uint32(data))
+		if size < 5 || size > len(data) {
+			// torn write at the end of the log
+			break
+		}
+		record := bson.M{}
+		if err := bson.Unmarshal(data[:size], &record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		data = data[size:]
+	}
+	return records, nil
+}
+
+// Name of the log of the collection db.collection. Collection names may
+// contain separators, as target ids are not checked, so the key is escaped.
+func embeddedFile(key string) string {
+	return url.PathEscape(key) + EMBEDDED_EXT
+}
+
+// Load, compact and open for appending the collection db.collection. The
+// database must be locked.
+func (d *EmbeddedDatabase) open(key string) (*embeddedCollection, error) {
+	if c, ok := d.collections[key]; ok {
+		return c, nil
+	}
+	db := strings.SplitN(key, ".", 2)[0]
+	c := &embeddedCollection{
+		path:       filepath.Join(d.dir, embeddedFile(key)),
+		appendOnly: EMBEDDED_APPEND_ONLY[db],
+	}
+	records, err := readEmbeddedLog(c.path)
+	if err != nil && os.IsNotExist(err) == false {
+		return nil, err
+	}
+	if c.appendOnly {
+		// nothing is ever removed, so there is nothing to compact
+		c.ids = make(map[string]bool, len(records))
+		for _, record := range records {
+			if doc, ok := record["doc"].(bson.M); ok {
+				c.ids[embeddedId(doc["_id"])] = true
+			}
+		}
+		if c.log, err = os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0664); err != nil {
+			return nil, err
+		}
+		d.collections[key] = c
+		return c, nil
+	}
+	c.docs = make(map[string]bson.M)
+	for _, record := range records {
+		if doc, ok := record["doc"].(bson.M); ok {
+			c.docs[embeddedId(doc["_id"])] = doc
+		} else {
+			delete(c.docs, embeddedId(record["remove"]))
+		}
+	}
+	// rewrite the log with only the current documents, the old log is only
+	// replaced once the compacted one is on disk
+	var compacted bytes.Buffer
+	for _, doc := range c.docs {
+		if err := appendRecord(&compacted, bson.M{"doc": doc}); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeFileAtomic(c.path, compacted.Bytes(), 0664); err != nil {
+		return nil, err
+	}
+	if c.log, err = os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND, 0664); err != nil {
+		return nil, err
+	}
+	d.collections[key] = c
+	return c, nil
+}
+
+func appendRecord(w io.Writer, record bson.M) error {
+	data, err := bson.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Returns the collection db.collection, creating it if needed. Names are
+// checked as Mongo does. The database must be locked.
+func (d *EmbeddedDatabase) c(db, collection string) (*embeddedCollection, error) {
+	if db == "" || strings.ContainsAny(db, "/\\. \"$\x00") {
+		return nil, errors.New("Invalid database name " + db)
+	}
+	if collection == "" || strings.ContainsAny(collection, "$\x00") {
+		return nil, errors.New("Invalid collection name " + collection)
+	}
+	return d.open(db + "." + collection)
+}
+
+// Convert a document, such as a struct with bson tags, to a bson.M.
+func toDoc(doc interface{}) (bson.M, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	res := bson.M{}
+	err = bson.Unmarshal(data, &res)
+	return res, err
+}
+
+// Decode doc into result as mgo would.
+func fromDoc(doc bson.M, result interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
+
+// Replace or add a document. The database must be locked, and the log synced
+// once the write is complete.
+func (d *EmbeddedDatabase) put(c *embeddedCollection, doc bson.M) error {
+	if err := appendRecord(c.log, bson.M{"doc": doc}); err != nil {
+		return err
+	}
+	if c.appendOnly {
+		c.ids[embeddedId(doc["_id"])] = true
+	} else {
+		c.docs[embeddedId(doc["_id"])] = doc
+	}
+	d.writes += 1
+	return nil
+}
+
+// Returns the documents of an appendOnly collection, read from its log. The
+// database must be locked.
+func (c *embeddedCollection) readDocs() ([]bson.M, error) {
+	records, err := readEmbeddedLog(c.path)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]bson.M, 0, len(records))
+	for _, record := range records {
+		if doc, ok := record["doc"].(bson.M); ok {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, nil
+}
+
+func (d *EmbeddedDatabase) insert(db, collection string, doc interface{}) error {
+	d.Lock()
+	defer d.Unlock()
+	c, err := d.c(db, collection)
+	if err != nil {
+		return err
+	}
+	m, err := toDoc(doc)
+	if err != nil {
+		return err
+	}
+	if _, ok := m["_id"]; ok == false {
+		m["_id"] = bson.NewObjectId()
+	}
+	if c.has(embeddedId(m["_id"])) {
+		return &mgo.LastError{Code: 11000, Err: "duplicate key " + embeddedId(m["_id"])}
+	}
+	if err := d.put(c, m); err != nil {
+		return err
+	}
+	return c.log.Sync()
+}
+
+func (d *EmbeddedDatabase) upsert(db, collection string, doc interface{}) error {
+	d.Lock()
+	defer d.Unlock()
+	c, err := d.c(db, collection)
+	if err != nil {
+		return err
+	}
+	m, err := toDoc(doc)
+	if err != nil {
+		return err
+	}
+	if c.appendOnly {
+		return errors.New("Cannot upsert into append only collection " + db + "." + collection)
+	}
+	if err := d.put(c, m); err != nil {
+		return err
+	}
+	return c.log.Sync()
+}
+
+// Set a field, possibly nested as in a.b.c, creating the embedded documents
+// on the way.
+func setPath(doc bson.M, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := doc[key].(bson.M)
+		if ok == false {
+			next = bson.M{}
+			doc[key] = next
+		}
+		doc = next
+	}
+	doc[keys[len(keys)-1]] = value
+}
+
+func unsetPath(doc bson.M, path string) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := doc[key].(bson.M)
+		if ok == false {
+			return
+		}
+		doc = next
+	}
+	delete(doc, keys[len(keys)-1])
+}
+
+// Apply set and unset to a copy of the document with the given id. The
+// database must be locked.
+func (d *EmbeddedDatabase) update(c *embeddedCollection, id interface{}, set, unset map[string]interface{}) error {
+	doc, ok := c.docs[embeddedId(id)]
+	if ok == false {
+		return ErrNotFound
+	}
+	// the copy is detached from any document previously handed out
+	updated, err := toDoc(doc)
+	if err != nil {
+		return err
+	}
+	if len(set) > 0 {
+		values, err := toDoc(set)
+		if err != nil {
+			return err
+		}
+		for path, value := range values {
+			setPath(updated, path, value)
+		}
+	}
+	for path := range unset {
+		unsetPath(updated, path)
+	}
+	return d.put(c, updated)
+}
+
+func (d *EmbeddedDatabase) updateId(db, collection string, id interface{}, set, unset map[string]interface{}) error {
+	d.Lock()
+	defer d.Unlock()
+	c, err := d.c(db, collection)
+	if err != nil {
+		return err
+	}
+	if err := d.update(c, id, set, unset); err != nil {
+		return err
+	}
+	return c.log.Sync()
+}
+
+func (d *EmbeddedDatabase) remove(db, collection string, id interface{}) error {
+	d.Lock()
+	defer d.Unlock()
+	c, err := d.c(db, collection)
+	if err != nil {
+		return err
+	}
+	if _, ok := c.docs[embeddedId(id)]; ok == false {
+		return ErrNotFound
+	}
+	if err := appendRecord(c.log, bson.M{"remove": id}); err != nil {
+		return err
+	}
+	delete(c.docs, embeddedId(id))
+	d.writes += 1
+	return c.log.Sync()
+}
+
+// Returns the documents of a collection for which match returns true, as
+// copies. match may be nil.
+func (d *EmbeddedDatabase) find(db, collection string, match func(bson.M) bool) ([]bson.M, error) {
+	d.Lock()
+	defer d.Unlock()
+	c, err := d.c(db, collection)
+	if err != nil {
+		return nil, err
+	}
+	if c.appendOnly {
+		// read back from the log, these documents are already copies
+		all, err := c.readDocs()
+		if err != nil {
+			return nil, err
+		}
+		res := make([]bson.M, 0)
+		for _, doc := range all {
+			if match == nil || match(doc) {
+				res = append(res, doc)
+			}
+		}
+		return res, nil
+	}
+	res := make([]bson.M, 0)
+	for _, doc := range c.docs {
+		if match == nil || match(doc) {
+			copied, err := toDoc(doc)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, copied)
+		}
+	}
+	return res, nil
+}
+
+func (d *EmbeddedDatabase) findId(db, collection string, id interface{}, result interface{}) error {
+	d.Lock()
+	defer d.Unlock()
+	c, err := d.c(db, collection)
+	if err != nil {
+		return err
+	}
+	doc, ok := c.docs[embeddedId(id)]
+	if ok == false {
+		return ErrNotFound
+	}
+	return fromDoc(doc, result)
+}
+
+// Numbers read back from BSON may be int, int64 or float64.
+func toFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+func hasString(v interface{}, s string) bool {
+	if v == s {
+		return true
+	}
+	values, _ := v.([]interface{})
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *EmbeddedDatabase) UserByToken(token string) (string, error) {
+	docs, err := d.find("users", "all", func(doc bson.M) bool { return doc["token"] == token })
+	if err != nil {
+		return "", err
+	}
+	if len(docs) == 0 {
+		return "", ErrNotFound
+	}
+	user, _ := docs[0]["_id"].(string)
+	return user, nil
+}
+
+func (d *EmbeddedDatabase) Manager(user string) (map[string]interface{}, error) {
+	doc := bson.M{}
+	if err := d.findId("users", "managers", user, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (d *EmbeddedDatabase) Managers(users []string) ([]map[string]interface{}, error) {
+	res := make([]map[string]interface{}, 0, len(users))
+	for _, user := range users {
+		doc, err := d.Manager(user)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		res = append(res, doc)
+	}
+	return res, nil
+}
+
+func (d *EmbeddedDatabase) EngineByKey(key string) (string, error) {
+	doc := bson.M{}
+	if err := d.findId("engines", "keys", key, &doc); err != nil {
+		return "", err
+	}
+	engine, _ := doc["engine"].(string)
+	return engine, nil
+}
+
+func (d *EmbeddedDatabase) InsertToken(token APIToken) error {
+	return d.insert("users", "tokens", token)
+}
+
+func (d *EmbeddedDatabase) TokenBySecret(secret string) (APIToken, error) {
+	token := APIToken{}
+	docs, err := d.find("users", "tokens", func(doc bson.M) bool { return doc["token"] == secret })
+	if err != nil {
+		return token, err
+	}
+	if len(docs) == 0 {
+		return token, ErrNotFound
+	}
+	err = fromDoc(docs[0], &token)
+	return token, err
+}
+
+func (d *EmbeddedDatabase) Token(id string) (APIToken, error) {
+	token := APIToken{}
+	err := d.findId("users", "tokens", id, &token)
+	return token, err
+}
+
+func (d *EmbeddedDatabase) UserTokens(user string) ([]APIToken, error) {
+	docs, err := d.find("users", "tokens", func(doc bson.M) bool { return doc["user"] == user })
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]APIToken, len(docs))
+	for i, doc := range docs {
+		if err := fromDoc(doc, &tokens[i]); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+func (d *EmbeddedDatabase) SetTokenSecret(id, secret string) error {
+	return d.updateId("users", "tokens", id, bson.M{"token": secret}, nil)
+}
+
+func (d *EmbeddedDatabase) RemoveToken(id string) error {
+	return d.remove("users", "tokens", id)
+}
+
+func (d *EmbeddedDatabase) Target(id string) (map[string]interface{}, error) {
+	doc := bson.M{}
+	if err := d.findId("data", "targets", id, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (d *EmbeddedDatabase) InsertTarget(doc map[string]interface{}) error {
+	return d.insert("data", "targets", doc)
+}
+
+func (d *EmbeddedDatabase) UpdateTarget(id string, set, unset map[string]interface{}) error {
+	return d.updateId("data", "targets", id, set, unset)
+}
+
+func (d *EmbeddedDatabase) PublicTargets(ids []string, engine string) ([]map[string]interface{}, error) {
+	res := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		doc, err := d.Target(id)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if doc["stage"] == "public" && hasString(doc["engines"], engine) {
+			res = append(res, doc)
+		}
+	}
+	return res, nil
+}
+
+func (d *EmbeddedDatabase) TargetSupports(id, engine string) (bool, error) {
+	doc, err := d.Target(id)
+	if err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return hasString(doc["engines"], engine), nil
+}
+
+func (d *EmbeddedDatabase) Ban(id string) (Ban, error) {
+	ban := Ban{}
+	err := d.findId("data", "bans", id, &ban)
+	return ban, err
+}
+
+func (d *EmbeddedDatabase) Bans() ([]Ban, error) {
+	docs, err := d.find("data", "bans", nil)
+	if err != nil {
+		return nil, err
+	}
+	bans := make([]Ban, len(docs))
+	for i, doc := range docs {
+		if err := fromDoc(doc, &bans[i]); err != nil {
+			return nil, err
+		}
+	}
+	return bans, nil
+}
+
+func (d *EmbeddedDatabase) InsertBan(ban Ban) error {
+	return d.insert("data", "bans", ban)
+}
+
+func (d *EmbeddedDatabase) RemoveBan(id string) error {
+	return d.remove("data", "bans", id)
+}
+
+func (d *EmbeddedDatabase) DonorVerifications(user string) (DonorVerifications, error) {
+	record := DonorVerifications{}
+	err := d.findId("data", "verifications", user, &record)
+	return record, err
+}
+
+func (d *EmbeddedDatabase) UpsertDonorVerifications(record *DonorVerifications) error {
+	return d.upsert("data", "verifications", record)
+}
+
+func (d *EmbeddedDatabase) FlaggedDonors() ([]DonorVerifications, error) {
+	docs, err := d.find("data", "verifications", func(doc bson.M) bool { return doc["flagged"] == true })
+	if err != nil {
+		return nil, err
+	}
+	records := make([]DonorVerifications, len(docs))
+	for i, doc := range docs {
+		if err := fromDoc(doc, &records[i]); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Failed > records[j].Failed })
+	return records, nil
+}
+
+func (d *EmbeddedDatabase) Webhook(id string) (Webhook, error) {
+	hook := Webhook{}
+	err := d.findId("data", "webhooks", id, &hook)
+	return hook, err
+}
+
+func (d *EmbeddedDatabase) Webhooks(targetId string) ([]Webhook, error) {
+	docs, err := d.find("data", "webhooks", func(doc bson.M) bool {
+		return doc["target_id"] == targetId
+	})
+	if err != nil {
+		return nil, err
+	}
+	hooks := make([]Webhook, len(docs))
+	for i, doc := range docs {
+		if err := fromDoc(doc, &hooks[i]); err != nil {
+			return nil, err
+		}
+	}
+	return hooks, nil
+}
+
+func (d *EmbeddedDatabase) InsertWebhook(hook Webhook) error {
+	return d.insert("data", "webhooks", hook)
+}
+
+func (d *EmbeddedDatabase) RemoveWebhook(id string) error {
+	return d.remove("data", "webhooks", id)
+}
+
+func (d *EmbeddedDatabase) Streams() ([]Stream, error) {
+	docs, err := d.find("streams", d.name, nil)
+	if err != nil {
+		return nil, err
+	}
+	streams := make([]Stream, len(docs))
+	for i, doc := range docs {
+		if err := fromDoc(doc, &streams[i]); err != nil {
+			return nil, err
+		}
+	}
+	return streams, nil
+}
+
+func (d *EmbeddedDatabase) StreamSummaries() ([]Stream, error) {
+	streams, err := d.Streams()
+	for i := range streams {
+		streams[i].Meta, streams[i].Options = nil, nil
+	}
+	return streams, err
+}
+
+func (d *EmbeddedDatabase) DeletedStreams() ([]string, error) {
+	docs, err := d.find("streams", d.name, func(doc bson.M) bool { return doc["status"] == "deleted" })
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		id, _ := doc["_id"].(string)
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (d *EmbeddedDatabase) FindStream(id string, result interface{}) error {
+	return d.findId("streams", d.name, id, result)
+}
+
+func (d *EmbeddedDatabase) InsertStream(doc interface{}) error {
+	return d.insert("streams", d.name, doc)
+}
+
+func (d *EmbeddedDatabase) UpdateStream(id string, set, unset map[string]interface{}) error {
+	return d.updateId("streams", d.name, id, set, unset)
+}
+
+func (d *EmbeddedDatabase) UpdateStreams(ids []string, set, unset map[string]interface{}) error {
+	d.Lock()
+	defer d.Unlock()
+	c, err := d.c("streams", d.name)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		// like mongo, missing streams are skipped
+		if err := d.update(c, id, set, unset); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return c.log.Sync()
+}
+
+func (d *EmbeddedDatabase) RemoveStream(id string) error {
+	return d.remove("streams", d.name, id)
+}
+
+func (d *EmbeddedDatabase) UpsertSCV(config Configuration) error {
+	return d.upsert("servers", "scvs", config)
+}
+
+func (d *EmbeddedDatabase) UpdateSCV(name string, set map[string]interface{}) error {
+	return d.updateId("servers", "scvs", name, set, nil)
+}
+
+func (d *EmbeddedDatabase) findShards(key, value string) ([]Shard, error) {
+	docs, err := d.find("servers", "shards", func(doc bson.M) bool {
+		return doc[key] == value
+	})
+	if err != nil {
+		return nil, err
+	}
+	shards := make([]Shard, len(docs))
+	for i, doc := range docs {
+		if err := fromDoc(doc, &shards[i]); err != nil {
+			return nil, err
+		}
+	}
+	return shards, nil
+}
+
+func (d *EmbeddedDatabase) Shards(targetId string) ([]Shard, error) {
+	return d.findShards("target_id", targetId)
+}
+
+func (d *EmbeddedDatabase) SCVShards(scv string) ([]Shard, error) {
+	return d.findShards("scv", scv)
+}
+
+func (d *EmbeddedDatabase) UpsertShard(shard Shard) error {
+	return d.upsert("servers", "shards", shard)
+}
+
+func (d *EmbeddedDatabase) RemoveShard(id string) error {
+	return d.remove("servers", "shards", id)
+}
+
+func (d *EmbeddedDatabase) StatsTargets() ([]string, error) {
+	d.Lock()
+	defer d.Unlock()
+	res := make([]string, 0)
+	for key, c := range d.collections {
+		if strings.HasPrefix(key, "stats.") && c.count() > 0 {
+			res = append(res, strings.TrimPrefix(key, "stats."))
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (d *EmbeddedDatabase) TargetStats(targetId string) (TargetStats, error) {
+	stats := TargetStats{Users: make([]string, 0), Daily: make([]DailyFrames, 0)}
+	docs, err := d.find("stats", targetId, nil)
+	if err != nil {
+		return stats, err
+	}
+	users := make(map[string]bool)
+	daily := make(map[int]float64)
+	for _, doc := range docs {
+		frames := toFloat(doc["frames"])
+		endTime := int(toFloat(doc["end_time"]))
+		stats.Frames += frames
+		stats.Partitions += int(toFloat(doc["end_frames"]) - toFloat(doc["start_frames"]))
+		stats.Seconds += endTime - int(toFloat(doc["start_time"]))
+		stats.Sessions += 1
+		user, _ := doc["user"].(string)
+		if users[user] == false {
+			users[user] = true
+			stats.Users = append(stats.Users, user)
+		}
+		daily[endTime-endTime%86400] += frames
+	}
+	for day, frames := range daily {
+		stats.Daily = append(stats.Daily, DailyFrames{day, frames})
+	}
+	sort.Slice(stats.Daily, func(i, j int) bool { return stats.Daily[i].Day < stats.Daily[j].Day })
+	return stats, nil
+}
+
+func (d *EmbeddedDatabase) DonorTotals(targetId string) ([]DonorTotal, error) {
+	docs, err := d.find("stats", targetId, nil)
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[string]*DonorTotal)
+	res := make([]DonorTotal, 0)
+	for _, doc := range docs {
+		user, _ := doc["user"].(string)
+		total, ok := totals[user]
+		if ok == false {
+			total = &DonorTotal{User: user}
+			totals[user] = total
+		}
+		total.Frames += toFloat(doc["frames"])
+		total.Sessions += 1
+		seconds := int(toFloat(doc["end_time"]) - toFloat(doc["start_time"]))
+		if doc["device"] == DEVICE_CPU {
+			total.CPUSeconds += seconds
+		} else {
+			total.GPUSeconds += seconds
+		}
+	}
+	for _, total := range totals {
+		res = append(res, *total)
+	}
+	return res, nil
+}
+
+func (d *EmbeddedDatabase) StreamSessions(targetId, streamId string) ([]Session, error) {
+	docs, err := d.find("stats", targetId, func(doc bson.M) bool { return doc["stream"] == streamId })
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]Session, len(docs))
+	for i, doc := range docs {
+		if err := fromDoc(doc, &sessions[i]); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].StartTime < sessions[j].StartTime })
+	return sessions, nil
+}
+
+func (d *EmbeddedDatabase) DonorSessions(targetId, user string, after *SessionCursor, limit int) ([]Session, error) {
+	docs, err := d.find("stats", targetId, func(doc bson.M) bool { return doc["user"] == user })
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]Session, 0, len(docs))
+	for _, doc := range docs {
+		session := Session{}
+		if err := fromDoc(doc, &session); err != nil {
+			return nil, err
+		}
+		if after == nil || after.Before(targetId, session) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		if sessions[i].EndTime != sessions[j].EndTime {
+			return sessions[i].EndTime > sessions[j].EndTime
+		}
+		return sessions[i].Id > sessions[j].Id
+	})
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	return sessions, nil
+}
+
+func (d *EmbeddedDatabase) Benchmarks(engine string) ([]DonorBenchmark, error) {
+	docs, err := d.find("benchmarks", engine, nil)
+	if err != nil {
+		return nil, err
+	}
+	rows := make(map[string]*DonorBenchmark)
+	res := make([]DonorBenchmark, 0)
+	for _, doc := range docs {
+		user, _ := doc["user"].(string)
+		row, ok := rows[user]
+		if ok == false {
+			row = &DonorBenchmark{User: user}
+			rows[user] = row
+		}
+		nsPerDay := toFloat(doc["ns_per_day"])
+		row.NsPerDay += nsPerDay
+		if nsPerDay > row.Best {
+			row.Best = nsPerDay
+		}
+		row.Sessions += 1
+	}
+	for _, row := range rows {
+		row.NsPerDay /= float64(row.Sessions)
+		res = append(res, *row)
+	}
+	return res, nil
+}
+
+func (d *EmbeddedDatabase) StreamErrors(targetId, streamId string) ([]StreamError, error) {
+	docs, err := d.find("errors", targetId, func(doc bson.M) bool { return doc["stream"] == streamId })
+	if err != nil {
+		return nil, err
+	}
+	streamErrors := make([]StreamError, len(docs))
+	for i, doc := range docs {
+		if err := fromDoc(doc, &streamErrors[i]); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(streamErrors, func(i, j int) bool { return streamErrors[i].Time < streamErrors[j].Time })
+	return streamErrors, nil
+}
+
+func (d *EmbeddedDatabase) Credit(user string) (DonorCredit, error) {
+	donor := DonorCredit{}
+	err := d.findId("credit", "donors", user, &donor)
+	return donor, err
+}
+
+func (d *EmbeddedDatabase) UpsertCredit(donor *DonorCredit) error {
+	return d.upsert("credit", "donors", donor)
+}
+
+func (d *EmbeddedDatabase) CreditRank(points float64) (int, error) {
+	docs, err := d.find("credit", "donors", func(doc bson.M) bool { return toFloat(doc["points"]) > points })
+	return len(docs), err
+}
+
+func (d *EmbeddedDatabase) Leaderboard(limit int) ([]DonorCredit, error) {
+	docs, err := d.find("credit", "donors", nil)
+	if err != nil {
+		return nil, err
+	}
+	donors := make([]DonorCredit, len(docs))
+	for i, doc := range docs {
+		delete(doc, "targets")
+		if err := fromDoc(doc, &donors[i]); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(donors, func(i, j int) bool { return donors[i].Points > donors[j].Points })
+	if len(donors) > limit {
+		donors = donors[:limit]
+	}
+	return donors, nil
+}
+
+// Returns true if doc matches a selector of deferred update. Only equality and
+// $ne are supported.
+func embeddedMatch(doc bson.M, selector bson.M) (bool, error) {
+	for key, want := range selector {
+		if cond, ok := want.(bson.M); ok {
+			for op, value := range cond {
+				if op != "$ne" {
+					return false, errors.New("unsupported operator " + op)
+				}
+				if doc[key] == value {
+					return false, nil
+				}
+			}
+		} else if embeddedId(doc[key]) != embeddedId(want) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Apply a deferred update, which may use $set and $unset. The database must
+// be locked.
+func (d *EmbeddedDatabase) applyUpdate(c *embeddedCollection, op *deferredOp) error {
+	update, err := toDoc(op.update)
+	if err != nil {
+		return err
+	}
+	selector, err := toDoc(op.selector)
+	if err != nil {
+		return err
+	}
+	set, _ := update["$set"].(bson.M)
+	unset, _ := update["$unset"].(bson.M)
+	for key := range update {
+		if key != "$set" && key != "$unset" {
+			return errors.New("unsupported update " + key)
+		}
+	}
+	if id, ok := selector["_id"]; ok {
+		if _, isOp := id.(bson.M); isOp == false {
+			// look the document up rather than scanning the collection
+			doc, ok := c.docs[embeddedId(id)]
+			if ok == false {
+				return nil
+			}
+			if ok, err := embeddedMatch(doc, selector); err != nil || ok == false {
+				return err
+			}
+			return d.update(c, doc["_id"], set, unset)
+		}
+	}
+	for _, doc := range c.docs {
+		ok, err := embeddedMatch(doc, selector)
+		if err != nil {
+			return err
+		}
+		if ok {
+			// like mgo's Update, only the first match is updated
+			return d.update(c, doc["_id"], set, unset)
+		}
+	}
+	return nil
+}
+
+func (d *EmbeddedDatabase) WriteDeferred(ops []*deferredOp) (written int, failed []*deferredOp, unreachable bool) {
+	d.Lock()
+	defer d.Unlock()
+	c, err := d.c(ops[0].db, ops[0].collection)
+	if err != nil {
+		for _, op := range ops {
+			op.err = err
+			op.retries += 1
+		}
+		return 0, ops, false
+	}
+	for _, op := range ops {
+		if op.doc != nil {
+			doc, err := toDoc(op.doc)
+			if err == nil {
+				if c.has(embeddedId(doc["_id"])) {
+					// inserted by a previous attempt
+					written += 1
+					continue
+				}
+				err = d.put(c, doc)
+			}
+			op.err = err
+		} else {
+			op.err = d.applyUpdate(c, op)
+		}
+		if op.err != nil {
+			op.retries += 1
+			failed = append(failed, op)
+		} else {
+			written += 1
+		}
+	}
+	if err := c.log.Sync(); err != nil {
+		// none of the batch can be assumed to be on disk
+		for _, op := range ops {
+			op.err = err
+			op.retries += 1
+		}
+		return 0, ops, false
+	}
+	return written, failed, false
+}
+
+func (d *EmbeddedDatabase) InsertDeadLetter(doc map[string]interface{}) error {
+	return d.insert("dead_letters", d.name, doc)
+}
+
+func (d *EmbeddedDatabase) EnsureIndexes() error {
+	return nil
+}
+
+func (d *EmbeddedDatabase) Metrics() map[string]interface{} {
+	d.Lock()
+	defer d.Unlock()
+	documents := 0
+	for _, c := range d.collections {
+		documents += c.count()
+	}
+	return map[string]interface{}{
+		"backend":     "embedded",
+		"collections": len(d.collections),
+		"documents":   documents,
+		"writes":      d.writes,
+	}
+}
+
+// The embedded database is reachable as long as its directory is.
+func (d *EmbeddedDatabase) Ping() error {
+	_, err := os.Stat(d.dir)
+	return err
+}
+
+func (d *EmbeddedDatabase) Close() {
+	d.Lock()
+	defer d.Unlock()
+	for _, c := range d.collections {
+		c.log.Sync()
+		c.log.Close()
+	}
+}
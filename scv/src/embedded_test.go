@@ -0,0 +1,182 @@
+package scv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEmbeddedDatabase(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "embedded")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(dir, "scv")
+	assert.Nil(t, err)
+	assert.Nil(t, db.InsertStream(bson.M{"_id": "s1", "target_id": "t1", "status": "enabled", "frames": 5}))
+	assert.Nil(t, db.InsertStream(bson.M{"_id": "s2", "target_id": "t1", "status": "enabled"}))
+	assert.NotNil(t, db.InsertStream(bson.M{"_id": "s1"}))
+	assert.Nil(t, db.UpdateStream("s1", bson.M{"meta.name": "a", "meta.size": 2}, nil))
+	assert.Nil(t, db.UpdateStream("s1", nil, bson.M{"meta.size": ""}))
+	assert.Equal(t, db.UpdateStream("s3", bson.M{"frames": 1}, nil), ErrNotFound)
+	assert.Nil(t, db.RemoveStream("s2"))
+	assert.Nil(t, db.InsertToken(APIToken{Id: "a", Token: "secret", User: "yutong"}))
+	assert.Nil(t, db.SetTokenSecret("a", "rotated"))
+	db.Close()
+
+	// the logs are replayed on open
+	db, err = OpenEmbeddedDatabase(dir, "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	streams, err := db.Streams()
+	assert.Nil(t, err)
+	assert.Equal(t, len(streams), 1)
+	assert.Equal(t, streams[0].StreamId, "s1")
+	assert.Equal(t, streams[0].Frames, 5)
+	doc := bson.M{}
+	assert.Nil(t, db.FindStream("s1", &doc))
+	assert.Equal(t, doc["meta"], bson.M{"name": "a"})
+	_, err = db.TokenBySecret("secret")
+	assert.Equal(t, err, ErrNotFound)
+	token, err := db.TokenBySecret("rotated")
+	assert.Nil(t, err)
+	assert.Equal(t, token.User, "yutong")
+
+	// deferred writes, the update must not overwrite a tombstone
+	assert.Nil(t, db.UpdateStream("s1", bson.M{"status": "deleted"}, nil))
+	ops := []*deferredOp{
+		{db: "streams", collection: "scv", selector: bson.M{"_id": "s1", "status": bson.M{"$ne": "deleted"}}, update: bson.M{"$set": bson.M{"status": "enabled"}}},
+	}
+	written, failed, unreachable := db.WriteDeferred(ops)
+	assert.Equal(t, written, 1)
+	assert.Equal(t, len(failed), 0)
+	assert.False(t, unreachable)
+	deleted, _ := db.DeletedStreams()
+	assert.Equal(t, deleted, []string{"s1"})
+
+	// stats
+	id := bson.NewObjectId()
+	ops = []*deferredOp{
+		{db: "stats", collection: "t1", doc: bson.M{"_id": id, "user": "yutong", "stream": "s1", "frames": 2.5, "start_time": 100, "end_time": 3700, "start_frames": 0, "end_frames": 2}},
+		{db: "stats", collection: "t1", doc: bson.M{"_id": id}},
+		{db: "stats", collection: "t1", doc: bson.M{"user": "", "stream": "s1", "frames": 1.0, "start_time": 0, "end_time": 86400, "start_frames": 2, "end_frames": 3}},
+		{db: "stats", collection: "t1", doc: bson.M{"_id": bson.NewObjectId(), "user": "yutong", "stream": "s2", "device": "cpu", "frames": 1.0, "start_time": 4000, "end_time": 5800, "start_frames": 0, "end_frames": 1}},
+	}
+	written, failed, _ = db.WriteDeferred(ops)
+	assert.Equal(t, written, 4)
+	assert.Equal(t, len(failed), 0)
+	targets, _ := db.StatsTargets()
+	assert.Equal(t, targets, []string{"t1"})
+	stats, err := db.TargetStats("t1")
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Frames, 4.5)
+	assert.Equal(t, stats.Partitions, 4)
+	assert.Equal(t, stats.Seconds, 3600+86400+1800)
+	assert.Equal(t, stats.Sessions, 3)
+	assert.Equal(t, stats.Daily, []DailyFrames{{0, 3.5}, {86400, 1}})
+	sessions, _ := db.StreamSessions("t1", "s1")
+	assert.Equal(t, len(sessions), 2)
+	assert.Equal(t, sessions[0].StartTime, 0)
+	sessions, _ = db.DonorSessions("t1", "yutong", nil, 1)
+	assert.Equal(t, len(sessions), 1)
+	assert.Equal(t, sessions[0].EndTime, 5800)
+	totals, _ := db.DonorTotals("t1")
+	for _, total := range totals {
+		if total.User == "yutong" {
+			assert.Equal(t, total, DonorTotal{"yutong", 3.5, 2, 3600, 1800})
+		}
+	}
+
+	// benchmarks
+	ops = []*deferredOp{
+		{db: "benchmarks", collection: "openmm", doc: bson.M{"_id": bson.NewObjectId(), "user": "yutong", "ns_per_day": 20.0}},
+		{db: "benchmarks", collection: "openmm", doc: bson.M{"_id": bson.NewObjectId(), "user": "yutong", "ns_per_day": 40.0}},
+		{db: "benchmarks", collection: "openmm", doc: bson.M{"_id": bson.NewObjectId(), "user": "jesse_v", "ns_per_day": 10.0}},
+	}
+	written, _, _ = db.WriteDeferred(ops)
+	assert.Equal(t, written, 3)
+	benchmarks, err := db.Benchmarks("openmm")
+	assert.Nil(t, err)
+	assert.Equal(t, len(benchmarks), 2)
+	for _, row := range benchmarks {
+		if row.User == "yutong" {
+			assert.Equal(t, row, DonorBenchmark{"yutong", 30, 40, 2})
+		}
+	}
+	benchmarks, _ = db.Benchmarks("cuda")
+	assert.Equal(t, len(benchmarks), 0)
+
+	// credit
+	assert.Nil(t, db.UpsertCredit(&DonorCredit{User: "yutong", Points: 10, Targets: map[string]TargetCredit{"t1": {1, 10, 1, 0.5, 0}}}))
+	assert.Nil(t, db.UpsertCredit(&DonorCredit{User: "jesse_v", Points: 20}))
+	rank, _ := db.CreditRank(10)
+	assert.Equal(t, rank, 1)
+	donors, _ := db.Leaderboard(1)
+	assert.Equal(t, len(donors), 1)
+	assert.Equal(t, donors[0].User, "jesse_v")
+	donor, _ := db.Credit("yutong")
+	assert.Equal(t, donor.Targets["t1"].Points, 10.0)
+}
+
+func TestEmbeddedCollectionNames(t *testing.T) {
+	parent, _ := ioutil.TempDir("", "embedded")
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "db")
+	db, err := OpenEmbeddedDatabase(dir, "scv")
+	assert.Nil(t, err)
+	ops := []*deferredOp{
+		{db: "stats", collection: "../../x", doc: bson.M{"_id": "a", "user": "yutong"}},
+		{db: "stats", collection: "t/1", doc: bson.M{"_id": "b", "user": "yutong"}},
+	}
+	for _, op := range ops {
+		written, _, _ := db.WriteDeferred([]*deferredOp{op})
+		assert.Equal(t, written, 1)
+	}
+	_, err = db.find("../users", "all", nil)
+	assert.NotNil(t, err)
+	db.Close()
+
+	// the logs stay in the directory and keep their names on open
+	files, _ := ioutil.ReadDir(parent)
+	assert.Equal(t, len(files), 1)
+	db, err = OpenEmbeddedDatabase(dir, "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	targets, _ := db.StatsTargets()
+	assert.Equal(t, targets, []string{"../../x", "t/1"})
+	sessions, _ := db.StreamSessions("t/1", "")
+	assert.Equal(t, len(sessions), 0)
+	docs, _ := db.find("stats", "t/1", nil)
+	assert.Equal(t, docs, []bson.M{{"_id": "b", "user": "yutong"}})
+}
+
+func TestEmbeddedImport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "embedded")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	path := filepath.Join(dir, "import.json")
+	ioutil.WriteFile(path, []byte(`{
+		"users": [{"_id": "yutong", "token": "secret"}],
+		"managers": [{"_id": "yutong", "weight": 2}],
+		"engine_keys": [{"_id": "key", "engine": "openmm"}]
+	}`), 0644)
+	assert.Nil(t, db.Import(path))
+	// importing again replaces the documents
+	assert.Nil(t, db.Import(path))
+	user, err := db.UserByToken("secret")
+	assert.Nil(t, err)
+	assert.Equal(t, user, "yutong")
+	manager, err := db.Manager("yutong")
+	assert.Nil(t, err)
+	assert.Equal(t, manager["weight"], 2.0)
+	engine, err := db.EngineByKey("key")
+	assert.Nil(t, err)
+	assert.Equal(t, engine, "openmm")
+
+	ioutil.WriteFile(path, []byte(`{"users": [{"token": "secret"}]}`), 0644)
+	assert.NotNil(t, db.Import(path))
+}
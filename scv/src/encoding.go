@@ -0,0 +1,283 @@
+package scv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Replies smaller than this many bytes are not gzipped by EncodingMiddleware,
+// as they would barely shrink.
+const GZIP_MIN_SIZE int = 1024
+
+// Media types under which managers may ask for msgpack replies.
+var MSGPACK_TYPES = []string{"application/msgpack", "application/x-msgpack"}
+
+// Returns true if the Accept header of r lists msgpack.
+func acceptsMsgpack(r *http.Request) bool {
+	for _, media := range strings.Split(r.Header.Get("Accept"), ",") {
+		parts := strings.Split(media, ";")
+		media = strings.ToLower(strings.TrimSpace(parts[0]))
+		for _, param := range parts[1:] {
+			if q := strings.Replace(param, " ", "", -1); q == "q=0" || q == "q=0.0" {
+				media = ""
+			}
+		}
+		for _, msgpackType := range MSGPACK_TYPES {
+			if media == msgpackType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Suffix of the ETags of replies sent with the given encodings, so that each
+// representation of a reply has its own ETag.
+func encodingSuffix(msgpack, gzipped bool) string {
+	suffix := ""
+	if msgpack {
+		suffix += "-msgpack"
+	}
+	if gzipped {
+		suffix += "-gz"
+	}
+	return suffix
+}
+
+/*
+Buffers the JSON reply of a handler so that it can be encoded once the handler
+returns. Replies with a Content-Encoding, or a Content-Type other than JSON,
+eg. downloads and event streams, are passed on to the client as they are
+written.
+*/
+type encodingWriter struct {
+	w       http.ResponseWriter
+	code    int
+	buf     bytes.Buffer
+	decided bool // once the headers of the reply were looked at
+	passing bool // the reply is passed on instead of being buffered
+}
+
+func (ew *encodingWriter) Header() http.Header {
+	return ew.w.Header()
+}
+
+func (ew *encodingWriter) decide() {
+	if ew.decided {
+		return
+	}
+	ew.decided = true
+	header := ew.w.Header()
+	mediaType := strings.TrimSpace(strings.Split(header.Get("Content-Type"), ";")[0])
+	ew.passing = header.Get("Content-Encoding") != "" ||
+		(mediaType != "" && mediaType != "application/json")
+}
+
+func (ew *encodingWriter) WriteHeader(code int) {
+	if ew.code != 0 {
+		return
+	}
+	ew.code = code
+	ew.decide()
+	if ew.passing {
+		ew.w.WriteHeader(code)
+	}
+}
+
+func (ew *encodingWriter) Write(data []byte) (int, error) {
+	if ew.code == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.passing {
+		return ew.w.Write(data)
+	}
+	return ew.buf.Write(data)
+}
+
+// Lets http.ResponseController reach the connection, see extendDeadlines.
+func (ew *encodingWriter) Unwrap() http.ResponseWriter {
+	return ew.w
+}
+
+func (ew *encodingWriter) Flush() {
+	ew.decide()
+	if flusher, ok := ew.w.(http.Flusher); ok && ew.passing {
+		flusher.Flush()
+	}
+}
+
+/*
+Middleware of the manager endpoints sending their JSON replies as msgpack if
+the Accept header of the request lists application/msgpack, and gzipped if its
+Accept-Encoding allows it and the reply is at least GZIP_MIN_SIZE bytes. The
+ETags of such replies get a -msgpack or -gz suffix, and the middleware replies
+with a 304 itself if the client has that version.
+*/
+func (app *Application) EncodingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.Settings().DisableEncoding {
+			next.ServeHTTP(w, r)
+			return
+		}
+		msgpack := acceptsMsgpack(r)
+		gzipped := acceptsGzip(r)
+		ew := &encodingWriter{w: w}
+		next.ServeHTTP(ew, r)
+		ew.decide()
+		if ew.passing {
+			return
+		}
+		header := w.Header()
+		header.Add("Vary", "Accept")
+		header.Add("Vary", "Accept-Encoding")
+		if etag := header.Get("ETag"); etag != "" && (msgpack || gzipped) {
+			etag = strings.TrimSuffix(etag, `"`) + encodingSuffix(msgpack, gzipped) + `"`
+			header.Set("ETag", etag)
+			// the handler only knows the ETag of the JSON reply
+			if ew.code == http.StatusOK && etagMatch(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		data := ew.buf.Bytes()
+		if msgpack && len(data) > 0 {
+			if encoded, err := jsonToMsgpack(data); err == nil {
+				data = encoded
+				header.Set("Content-Type", MSGPACK_TYPES[0])
+			}
+		}
+		if gzipped && len(data) >= GZIP_MIN_SIZE {
+			if compressed, err := gzipBytes(data); err == nil {
+				data = compressed
+				header.Set("Content-Encoding", "gzip")
+			}
+		}
+		if header.Get("Content-Type") == "" && len(data) > 0 {
+			header.Set("Content-Type", "application/json")
+		}
+		header.Del("Content-Length")
+		if ew.code != 0 {
+			w.WriteHeader(ew.code)
+		}
+		w.Write(data)
+	})
+}
+
+// Convert a JSON document to msgpack. Integers are kept as such, and the keys of
+// objects are sorted.
+func jsonToMsgpack(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	var buf bytes.Buffer
+	writeMsgpack(&buf, value)
+	return buf.Bytes(), nil
+}
+
+// Write a value decoded by a json.Decoder using UseNumber as msgpack.
+func writeMsgpack(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			writeMsgpackInt(buf, i)
+		} else if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			buf.WriteByte(0xcf)
+			binary.Write(buf, binary.BigEndian, u)
+		} else {
+			f, _ := v.Float64()
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		writeMsgpackLength(buf, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		buf.WriteString(v)
+	case []interface{}:
+		writeMsgpackLength(buf, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			writeMsgpack(buf, item)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		writeMsgpackLength(buf, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			writeMsgpack(buf, key)
+			writeMsgpack(buf, v[key])
+		}
+	}
+}
+
+// Write the smallest msgpack integer holding i.
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(i)})
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(i))
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, uint64(i))
+	case i >= math.MinInt8:
+		buf.Write([]byte{0xd0, byte(int8(i))})
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// Write the header of a string, array or map of the given length: fixed is the
+// type of the short form holding lengths below fixedMax, and short, medium and
+// long those with an 8, 16 and 32 bit length. Arrays and maps have no 8 bit
+// form.
+func writeMsgpackLength(buf *bytes.Buffer, length int, fixed byte, fixedMax int, short, medium, long byte) {
+	switch {
+	case length < fixedMax:
+		buf.WriteByte(fixed | byte(length))
+	case short != 0 && length <= math.MaxUint8:
+		buf.Write([]byte{short, byte(length)})
+	case length <= math.MaxUint16:
+		buf.WriteByte(medium)
+		binary.Write(buf, binary.BigEndian, uint16(length))
+	default:
+		buf.WriteByte(long)
+		binary.Write(buf, binary.BigEndian, uint32(length))
+	}
+}
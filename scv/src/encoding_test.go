@@ -0,0 +1,92 @@
+package scv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONToMsgpack(t *testing.T) {
+	data, err := jsonToMsgpack([]byte(`{"b": [true, null, -1, 200, -200, 70000], "a": "x", "c": 1.5}`))
+	assert.Nil(t, err)
+	assert.Equal(t, data, []byte{
+		0x83,
+		0xa1, 'a', 0xa1, 'x',
+		0xa1, 'b', 0x96, 0xc3, 0xc0, 0xff, 0xcc, 200, 0xd1, 0xff, 0x38, 0xce, 0x00, 0x01, 0x11, 0x70,
+		0xa1, 'c', 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+	})
+	long := strings.Repeat("x", 40)
+	data, err = jsonToMsgpack([]byte(`"` + long + `"`))
+	assert.Nil(t, err)
+	assert.Equal(t, data, append([]byte{0xd9, 40}, long...))
+	_, err = jsonToMsgpack([]byte(`not json`))
+	assert.NotNil(t, err)
+}
+
+func TestEncodingMiddleware(t *testing.T) {
+	app := &Application{}
+	reply := `{"streams": ["` + strings.Repeat("a", GZIP_MIN_SIZE) + `"]}`
+	handler := app.EncodingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte(`{"a": 1}`))
+		case "/large":
+			if notModified(w, r, dataETag([]byte(reply))) {
+				return
+			}
+			w.Write([]byte(reply))
+		case "/file":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte(reply))
+		}
+	}))
+	serve := func(path string, header map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("/small", map[string]string{"Accept-Encoding": "gzip"})
+	assert.Equal(t, w.Body.String(), `{"a": 1}`)
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/json")
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "")
+
+	w = serve("/small", map[string]string{"Accept": "application/msgpack"})
+	assert.Equal(t, w.Body.Bytes(), []byte{0x81, 0xa1, 'a', 0x01})
+	assert.Equal(t, w.Header().Get("Content-Type"), "application/msgpack")
+
+	w = serve("/large", map[string]string{"Accept-Encoding": "gzip, deflate"})
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "gzip")
+	body, err := gunzipBytes(w.Body.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, string(body), reply)
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, etag, strings.TrimSuffix(dataETag([]byte(reply)), `"`)+`-gz"`)
+	assert.Equal(t, w.Header()["Vary"], []string{"Accept", "Accept-Encoding"})
+
+	// the ETag of each representation is only matched by that representation
+	w = serve("/large", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": etag})
+	assert.Equal(t, w.Code, 304)
+	assert.Equal(t, w.Body.Len(), 0)
+	w = serve("/large", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), reply)
+
+	// replies other than JSON are passed on
+	w = serve("/file", map[string]string{"Accept-Encoding": "gzip", "Accept": "application/msgpack"})
+	assert.Equal(t, w.Body.String(), reply)
+	assert.Equal(t, w.Header().Get("Content-Encoding"), "")
+	assert.Equal(t, len(w.Header()["Vary"]), 0)
+
+	app.Config.DisableEncoding = true
+	w = serve("/small", map[string]string{"Accept": "application/msgpack"})
+	assert.Equal(t, w.Body.String(), `{"a": 1}`)
+}
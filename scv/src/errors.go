@@ -0,0 +1,89 @@
+package scv
+
+import (
+	"../manager"
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// An error replied with a status code other than 400, see package manager.
+// Handlers return plain errors for malformed requests, and one of the errors
+// below, or a copy made with With, when the request is well formed but cannot
+// be served.
+type StatusError = manager.StatusError
+
+// The Authorization header is missing or does not identify anyone.
+var ErrUnauthorized = manager.ErrUnauthorized
+
+// The caller is known but not allowed to do this.
+var ErrForbidden = manager.ErrForbidden
+
+// Returned by a Database when the requested document does not exist, and by
+// handlers when a stream, target or token does not.
+var ErrNotFound = manager.ErrNotFound
+
+// The request conflicts with the state of the resource, eg. a frame that was
+// already posted.
+var ErrConflict = manager.ErrConflict
+
+// The body exceeds the configured limit.
+var ErrTooLarge = &StatusError{Status: http.StatusRequestEntityTooLarge, Code: "too_large", Message: "Request body too large"}
+
+// The donor or engine of a core is banned, see Ban. Cores should stop their
+// stream.
+var ErrBanned = &StatusError{Status: http.StatusForbidden, Code: "banned", Message: "Banned"}
+
+// The core's engine is older than the target's min_engine_version, see
+// checkEngineVersion. The details hold the versions, for the core to display.
+var ErrUpgradeRequired = &StatusError{Status: http.StatusUpgradeRequired, Code: "upgrade_required", Message: "Upgrade required"}
+
+// Too many requests were made with the same credentials.
+var ErrTooManyRequests = manager.ErrTooManyRequests
+
+// The SCV does not serve this request for now, eg. activations while it is
+// draining.
+var ErrUnavailable = manager.ErrUnavailable
+
+// The handler did not reply within the timeout of its route, see
+// TimeoutMiddleware.
+var ErrTimeout = &StatusError{Status: http.StatusServiceUnavailable, Code: "timeout", Message: "Request timed out"}
+
+// The data partition is full, see ReadOnly. Cores should stop their stream,
+// and the CC should assign them to another SCV.
+var ErrFull = &StatusError{Status: http.StatusInsufficientStorage, Code: "scv_full", Message: "SCV full"}
+
+// Prepends prefix to the message of err, keeping its status.
+func prefixError(prefix string, err error) error {
+	var e *StatusError
+	if errors.As(err, &e) {
+		return e.With(prefix + err.Error())
+	}
+	return errors.New(prefix + err.Error())
+}
+
+/*
+Reply with err in a JSON envelope and return the status code, that of the
+first StatusError in err's chain or 400 without one. The request id
+lets the CC and managers point at the matching line of the SCV's log:
+
+    {
+        "code": "not_found",
+        "message": "stream 1234 does not exist",
+        "request_id": "5f2ae1c09a7d4b3e"
+    }
+*/
+func writeError(w http.ResponseWriter, r *http.Request, err error) int {
+	status, code := http.StatusBadRequest, "bad_request"
+	var details map[string]string
+	var e *StatusError
+	if errors.As(err, &e) {
+		status, code, details = e.Status, e.Code, e.Details
+	}
+	data, _ := json.Marshal(ErrorReply{code, err.Error(), requestId(r), details})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(data)
+	return status
+}
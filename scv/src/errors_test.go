@@ -0,0 +1,61 @@
+package scv
+
+import (
+	"../manager"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorEnvelope(t *testing.T) {
+	serve := func(err error) (int, map[string]string) {
+		handler := AppHandler(func(w http.ResponseWriter, r *http.Request) error {
+			return err
+		})
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set(REQUEST_ID_HEADER, "cc-1234")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, w.Header().Get("Content-Type"), "application/json")
+		reply := make(map[string]string)
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &reply))
+		return w.Code, reply
+	}
+	code, reply := serve(errors.New("Could not decode JSON"))
+	assert.Equal(t, code, 400)
+	assert.Equal(t, reply, map[string]string{"code": "bad_request", "message": "Could not decode JSON", "request_id": "cc-1234"})
+	code, reply = serve(ErrNotFound.With("stream 1234 does not exist"))
+	assert.Equal(t, code, 404)
+	assert.Equal(t, reply["code"], "not_found")
+	assert.Equal(t, reply["message"], "stream 1234 does not exist")
+	code, _ = serve(ErrUnauthorized)
+	assert.Equal(t, code, 401)
+	// wrapped errors keep their status
+	code, reply = serve(fmt.Errorf("Unable to read stream: %w", ErrNotFound.With("stream 1234 does not exist")))
+	assert.Equal(t, code, 404)
+	assert.Equal(t, reply["message"], "Unable to read stream: stream 1234 does not exist")
+	// details are replied along with the message
+	handler := AppHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return ErrUpgradeRequired.WithDetails("Engine too old", map[string]string{"min_engine_version": "6.1"})
+	})
+	req, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	detailed := ErrorReply{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &detailed))
+	assert.Equal(t, w.Code, 426)
+	assert.Equal(t, detailed.Details, map[string]string{"min_engine_version": "6.1"})
+
+	// prefixes keep the status
+	err := prefixError("Unable to activate stream: ", manager.ErrNoTarget)
+	assert.Equal(t, err.(*StatusError).Status, 404)
+	assert.Equal(t, err.Error(), "Unable to activate stream: Target does not exist")
+	err = prefixError("Unable to activate stream: ", manager.ErrNoStreams)
+	_, ok := err.(*StatusError)
+	assert.False(t, ok)
+}
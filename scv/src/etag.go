@@ -0,0 +1,44 @@
+package scv
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ETag of a file on disk, derived from its size and modification time so that
+// the file does not need to be read.
+func fileETag(info os.FileInfo) string {
+	return `"` + strconv.FormatInt(info.Size(), 16) + "-" + strconv.FormatInt(info.ModTime().UnixNano(), 16) + `"`
+}
+
+// ETag of a reply computed in memory.
+func dataETag(data []byte) string {
+	sum := sha1.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Returns true if etag is listed in an If-None-Match header.
+func etagMatch(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the ETag header of the reply. If the client already has this version,
+// the reply is completed with a 304 and true is returned.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if header := r.Header.Get("If-None-Match"); header != "" && etagMatch(header, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
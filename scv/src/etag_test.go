@@ -0,0 +1,17 @@
+package scv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestETagMatch(t *testing.T) {
+	etag := dataETag([]byte("partitions"))
+	assert.True(t, etagMatch(etag, etag))
+	assert.True(t, etagMatch(`"abc", `+etag, etag))
+	assert.True(t, etagMatch("W/"+etag, etag))
+	assert.True(t, etagMatch("*", etag))
+	assert.False(t, etagMatch(`"abc"`, etag))
+	assert.False(t, etagMatch(dataETag([]byte("other")), etag))
+}
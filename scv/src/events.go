@@ -0,0 +1,242 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Types of stream lifecycle events.
+const (
+	EVENT_ACTIVATED   string = "activated"
+	EVENT_FRAME       string = "frame"
+	EVENT_CHECKPOINT  string = "checkpoint"
+	EVENT_DEACTIVATED string = "deactivated"
+	EVENT_ERRORED     string = "errored"
+	EVENT_ENABLED     string = "enabled"
+	EVENT_DISABLED    string = "disabled"
+	EVENT_DELETED     string = "deleted"
+	EVENT_UNDELETED   string = "undeleted"
+	EVENT_CORRUPTED   string = "corrupted"
+	EVENT_QUARANTINED string = "quarantined"
+	EVENT_REWOUND     string = "rewound"
+	EVENT_NOTICE      string = "notice"
+	EVENT_COMPLETED   string = "completed"
+	EVENT_MILESTONE   string = "milestone"
+)
+
+// Number of events buffered per subscriber before events are dropped.
+const EVENT_BUFFER_SIZE int = 256
+
+type Event struct {
+	Type     string                 `json:"type"`
+	StreamId string                 `json:"stream_id"`
+	TargetId string                 `json:"target_id"`
+	Time     int                    `json:"time"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+
+	owner     string // owner of the stream, only the managers of the stream are notified
+	namespace string // namespace of the stream
+}
+
+func NewEvent(eventType string, s *Stream, data map[string]interface{}) Event {
+	return Event{
+		Type:      eventType,
+		StreamId:  s.StreamId,
+		TargetId:  s.TargetId,
+		Time:      int(time.Now().Unix()),
+		Data:      data,
+		owner:     s.Owner,
+		namespace: s.Namespace,
+	}
+}
+
+// A Subscription receives the events of streams owned by user or in its
+// namespace, optionally restricted to a set of targets.
+type Subscription struct {
+	C         chan Event
+	user      string
+	namespace string
+	targets   map[string]struct{} // nil for all targets
+	types     map[string]struct{} // nil for all types
+}
+
+func (s *Subscription) matches(e Event) bool {
+	if s.user != "" && s.user != e.owner && (e.namespace == "" || e.namespace != s.namespace) {
+		return false
+	}
+	if s.types != nil {
+		if _, ok := s.types[e.Type]; ok == false {
+			return false
+		}
+	}
+	if s.targets == nil {
+		return true
+	}
+	_, ok := s.targets[e.TargetId]
+	return ok
+}
+
+// EventBus fans out events to subscribers. Publishing never blocks: if a
+// subscriber is too slow to drain its channel, its events are dropped.
+type EventBus struct {
+	sync.RWMutex
+	subscribers map[*Subscription]struct{}
+	published   int64
+	dropped     int64
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe to the events of streams owned by user or in namespace. If user is
+// empty, events of every stream are received. If targets is empty, events of
+// every target are received.
+func (b *EventBus) Subscribe(user, namespace string, targets []string) *Subscription {
+	sub := &Subscription{
+		C:         make(chan Event, EVENT_BUFFER_SIZE),
+		user:      user,
+		namespace: namespace,
+	}
+	if len(targets) > 0 {
+		sub.targets = make(map[string]struct{})
+		for _, targetId := range targets {
+			sub.targets[targetId] = struct{}{}
+		}
+	}
+	b.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.Unlock()
+	return sub
+}
+
+// Subscribe to the events of the given types of every stream.
+func (b *EventBus) SubscribeTypes(types []string) *Subscription {
+	sub := &Subscription{
+		C:     make(chan Event, EVENT_BUFFER_SIZE),
+		types: make(map[string]struct{}),
+	}
+	for _, eventType := range types {
+		sub.types[eventType] = struct{}{}
+	}
+	b.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.Unlock()
+	return sub
+}
+
+func (b *EventBus) Unsubscribe(sub *Subscription) {
+	b.Lock()
+	delete(b.subscribers, sub)
+	b.Unlock()
+}
+
+func (b *EventBus) Publish(e Event) {
+	b.Lock()
+	defer b.Unlock()
+	b.published += 1
+	for sub := range b.subscribers {
+		if sub.matches(e) == false {
+			continue
+		}
+		select {
+		case sub.C <- e:
+		default:
+			b.dropped += 1
+		}
+	}
+}
+
+func (b *EventBus) Metrics() map[string]interface{} {
+	b.RLock()
+	defer b.RUnlock()
+	return map[string]interface{}{
+		"subscribers": len(b.subscribers),
+		"published":   b.published,
+		"dropped":     b.dropped,
+	}
+}
+
+/*
+.. http:get:: /events
+    Stream lifecycle events of the streams of the manager's namespace
+    as Server-Sent Events. Each event is sent as a single ``data:``
+    line containing a JSON object. The connection is kept open until
+    the client disconnects.
+    :reqheader Authorization: Manager's authorization token
+    :query target_id: only report events of this target, may be repeated
+    **Example event**
+    .. sourcecode:: javascript
+        {
+            "type": "checkpoint", // activated, frame, checkpoint,
+                                  // deactivated, errored, enabled,
+                                  // disabled, deleted, corrupted,
+                                  // notice, completed, milestone
+            "stream_id": "stream_id",
+            "target_id": "target_id",
+            "time": 1404502030,
+            "data": {"frames": 25}
+        }
+    .. note:: ``notice`` events announce that the ``stream_lifecycle`` of
+        the stream's target is about to disable, archive or delete the
+        stream. Their data holds the ``action`` and the unix time it is
+        ``due``, and the action is taken on a later pass if the stream
+        is still idle by then.
+    :resheader Content-Type: text/event-stream
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) EventsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		targetIds := r.URL.Query()["target_id"]
+		if err := app.checkTokenTargets(r, targetIds...); err != nil {
+			return err
+		}
+		flusher, ok := w.(http.Flusher)
+		if ok == false {
+			return errors.New("Streaming is not supported")
+		}
+		// the stream outlasts the WriteTimeout of the Server
+		extendDeadlines(w, 0)
+		sub := app.events.Subscribe(user, app.namespace(user), targetIds)
+		defer app.events.Unsubscribe(sub)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+		flusher.Flush()
+		keepalive := time.NewTicker(15 * time.Second)
+		defer keepalive.Stop()
+		for {
+			select {
+			case e := <-sub.C:
+				data, err := json.Marshal(e)
+				if err != nil {
+					return nil
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+					return nil
+				}
+				flusher.Flush()
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return nil
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return nil
+			case <-app.finish:
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package scv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	all := bus.Subscribe("", "", nil)
+	mine := bus.Subscribe("yutong", "yutong", nil)
+	filtered := bus.Subscribe("yutong", "yutong", []string{"target1"})
+	lab := bus.Subscribe("jesse_v", "pande", nil)
+	s1 := newStream("stream1", "target1", "yutong", 0, 0, 0)
+	s2 := newStream("stream2", "target2", "yutong", 0, 0, 0)
+	s3 := newStream("stream3", "target1", "diwakar", 0, 0, 0)
+	s3.Namespace = "pande"
+	bus.Publish(NewEvent(EVENT_ACTIVATED, s1, nil))
+	bus.Publish(NewEvent(EVENT_ACTIVATED, s2, nil))
+	bus.Publish(NewEvent(EVENT_ACTIVATED, s3, nil))
+	assert.Equal(t, len(all.C), 3)
+	assert.Equal(t, len(mine.C), 2)
+	assert.Equal(t, len(filtered.C), 1)
+	// managers of a namespace receive the events of its streams
+	assert.Equal(t, len(lab.C), 1)
+	e := <-filtered.C
+	assert.Equal(t, e.StreamId, "stream1")
+	assert.Equal(t, e.Type, EVENT_ACTIVATED)
+
+	// slow subscribers lose events instead of blocking publishers
+	for i := 0; i < EVENT_BUFFER_SIZE; i++ {
+		bus.Publish(NewEvent(EVENT_FRAME, s1, nil))
+	}
+	assert.Equal(t, len(all.C), EVENT_BUFFER_SIZE)
+	assert.Equal(t, len(mine.C), EVENT_BUFFER_SIZE)
+	assert.Equal(t, len(filtered.C), EVENT_BUFFER_SIZE)
+	assert.Equal(t, bus.Metrics()["dropped"], int64(5))
+
+	bus.Unsubscribe(all)
+	bus.Unsubscribe(mine)
+	bus.Unsubscribe(filtered)
+	bus.Unsubscribe(lab)
+	assert.Equal(t, bus.Metrics()["subscribers"], 0)
+}
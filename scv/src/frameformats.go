@@ -0,0 +1,205 @@
+package scv
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// How the frames of a file are added to the buffer of a stream, see
+// frameFormats.
+const (
+	FORMAT_APPEND string = "append" // the bytes of each frame are appended to the file
+	FORMAT_SPLIT  string = "split"  // each frame is stored in a file of its own
+	FORMAT_JSONL  string = "jsonl"  // each frame holds JSON documents, appended as lines
+	FORMAT_REJECT string = "reject" // frames are refused rather than corrupting the file
+)
+
+// Formats of the extensions whose files cannot be appended to one another, for
+// targets that do not set one. Files of other extensions are appended.
+var DEFAULT_FRAME_FORMATS = map[string]string{
+	"dcd":  FORMAT_REJECT, // the header holds the number of frames
+	"nc":   FORMAT_REJECT,
+	"h5":   FORMAT_REJECT,
+	"hdf5": FORMAT_REJECT,
+	"json": FORMAT_JSONL,
+}
+
+/*
+The format of the frame files of a target by extension, set by the
+"frame_formats" option of the target over DEFAULT_FRAME_FORMATS, eg.
+
+	"frame_formats": {"dcd": "split", "log": "append"}
+
+Files of split formats are stored in a directory named after the file, one file
+per frame named after the number of the first frame it holds, eg.
+frames.dcd/13.dcd, and the frames of jsonl files are stored as one line per
+JSON document. Extensions are matched without the .gz of compressed files.
+*/
+type frameFormats map[string]string
+
+// Parse the frame formats in the options of a target.
+func newFrameFormats(options map[string]interface{}) (frameFormats, error) {
+	formats := make(frameFormats)
+	for ext, format := range DEFAULT_FRAME_FORMATS {
+		formats[ext] = format
+	}
+	config, ok := options["frame_formats"]
+	if ok == false {
+		return formats, nil
+	}
+	entries, ok := config.(map[string]interface{})
+	if ok == false {
+		return nil, errors.New("frame_formats must be an object")
+	}
+	for ext, value := range entries {
+		format, _ := value.(string)
+		switch format {
+		case FORMAT_APPEND, FORMAT_SPLIT, FORMAT_JSONL, FORMAT_REJECT:
+		default:
+			return nil, errors.New("unknown format of " + ext + ": " + format)
+		}
+		formats[strings.ToLower(strings.TrimPrefix(ext, "."))] = format
+	}
+	return formats, nil
+}
+
+func (app *Application) frameFormats(targetId string) (frameFormats, error) {
+	if cached, ok := app.optionsCache.Get("formats:" + targetId); ok {
+		return cached.(frameFormats), nil
+	}
+	options, err := app.targetOptions(targetId)
+	if err != nil {
+		// targets without a document in data.targets use the defaults
+		options = nil
+	}
+	formats, err := newFrameFormats(options)
+	if err != nil {
+		return nil, errors.New("Bad frame_formats for target " + targetId + ": " + err.Error())
+	}
+	app.optionsCache.Put("formats:"+targetId, formats)
+	return formats, nil
+}
+
+// Split the stored name of a frame file into its name without .gz, and .gz if
+// it is compressed.
+func splitGz(name string) (string, string) {
+	if root, ext := splitExt(name); ext == ".gz" {
+		return root, ext
+	}
+	return name, ""
+}
+
+// Returns the format of a frame file.
+func (f frameFormats) format(name string) string {
+	name, _ = splitGz(name)
+	if format, ok := f[strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))]; ok {
+		return format
+	}
+	return FORMAT_APPEND
+}
+
+// Returns the name under which the frames of a split file starting at frame are
+// stored.
+func splitFrameName(name string, frame int) string {
+	name, gz := splitGz(name)
+	return filepath.Join(name, strconv.Itoa(frame)+filepath.Ext(name)+gz)
+}
+
+// Convert the JSON documents of a frame file into JSON lines, gunzipping and
+// gzipping them again if the file is compressed.
+func jsonLines(name string, data []byte) ([]byte, error) {
+	_, gz := splitGz(name)
+	if gz != "" {
+		var err error
+		if data, err = gunzipBytes(data); err != nil {
+			return nil, err
+		}
+	}
+	var lines bytes.Buffer
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var document json.RawMessage
+		if err := decoder.Decode(&document); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.New("Bad request: " + name + " is not JSON: " + err.Error())
+		}
+		if err := json.Compact(&lines, document); err != nil {
+			return nil, err
+		}
+		lines.WriteByte('\n')
+	}
+	if lines.Len() == 0 {
+		return nil, errors.New("Bad request: " + name + " holds no JSON document")
+	}
+	if gz != "" {
+		return gzipBytes(lines.Bytes())
+	}
+	return lines.Bytes(), nil
+}
+
+func errFrameFormat(name string) error {
+	return errors.New("Bad request: frames of " + name + " cannot be appended, see the frame_formats option of the target")
+}
+
+/*
+Prepare the files of a frame starting at frame for the buffer according to
+their formats. Returns the files by the name they are stored under, or an error
+if a file is refused. The map passed is left untouched.
+*/
+func (f frameFormats) apply(files map[string][]byte, frame int) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+	for name, data := range files {
+		switch f.format(name) {
+		case FORMAT_SPLIT:
+			result[splitFrameName(name, frame)] = data
+		case FORMAT_JSONL:
+			lines, err := jsonLines(name, data)
+			if err != nil {
+				return nil, err
+			}
+			result[name] = lines
+		case FORMAT_REJECT:
+			return nil, errFrameFormat(name)
+		default:
+			result[name] = data
+		}
+	}
+	return result, nil
+}
+
+// Like apply, for the files of a frame spooled to disk. The JSON lines of jsonl
+// files replace their spooled copy.
+func (f frameFormats) applySpooled(paths map[string]string, frame int) (map[string]string, error) {
+	result := make(map[string]string)
+	for name, path := range paths {
+		switch f.format(name) {
+		case FORMAT_SPLIT:
+			result[splitFrameName(name, frame)] = path
+		case FORMAT_JSONL:
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			lines, err := jsonLines(name, data)
+			if err != nil {
+				return nil, err
+			}
+			if err := ioutil.WriteFile(path, lines, 0666); err != nil {
+				return nil, err
+			}
+			result[name] = path
+		case FORMAT_REJECT:
+			return nil, errFrameFormat(name)
+		default:
+			result[name] = path
+		}
+	}
+	return result, nil
+}
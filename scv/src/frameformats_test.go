@@ -0,0 +1,88 @@
+package scv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFrameFormats(t *testing.T) {
+	formats, err := newFrameFormats(map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, formats.format("frames.dcd"), FORMAT_REJECT)
+	assert.Equal(t, formats.format("frames.DCD.gz"), FORMAT_REJECT)
+	assert.Equal(t, formats.format("log.json"), FORMAT_JSONL)
+	assert.Equal(t, formats.format("frames.xtc"), FORMAT_APPEND)
+	assert.Equal(t, formats.format("log"), FORMAT_APPEND)
+	formats, err = newFrameFormats(map[string]interface{}{
+		"frame_formats": map[string]interface{}{"dcd": "split", ".xtc": "reject"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, formats.format("frames.dcd"), FORMAT_SPLIT)
+	assert.Equal(t, formats.format("frames.xtc"), FORMAT_REJECT)
+	assert.Equal(t, formats.format("frames.nc"), FORMAT_REJECT)
+	_, err = newFrameFormats(map[string]interface{}{
+		"frame_formats": map[string]interface{}{"dcd": "bogus"},
+	})
+	assert.NotNil(t, err)
+	_, err = newFrameFormats(map[string]interface{}{"frame_formats": "split"})
+	assert.NotNil(t, err)
+
+	app := &Application{optionsCache: NewResultCache(time.Minute)}
+	app.optionsCache.Put("options:target", map[string]interface{}{
+		"frame_formats": map[string]interface{}{"dcd": "split"},
+	})
+	formats, err = app.frameFormats("target")
+	assert.Nil(t, err)
+	assert.Equal(t, formats.format("frames.dcd"), FORMAT_SPLIT)
+}
+
+func TestApplyFrameFormats(t *testing.T) {
+	formats, _ := newFrameFormats(map[string]interface{}{
+		"frame_formats": map[string]interface{}{"dcd": "split"},
+	})
+	gz, _ := gzipBytes([]byte("{\"a\": 1}\n"))
+	files := map[string][]byte{
+		"frames.xtc":  []byte("xtc"),
+		"frames.dcd":  []byte("dcd"),
+		"traj.dcd.gz": []byte("gz"),
+		"log.json":    []byte("{\"step\": 1,\n \"t\": 2.5} [3]"),
+		"log.json.gz": gz,
+	}
+	result, err := formats.apply(files, 13)
+	assert.Nil(t, err)
+	assert.Equal(t, len(files), 5)
+	assert.Equal(t, string(result["frames.xtc"]), "xtc")
+	assert.Equal(t, string(result[filepath.Join("frames.dcd", "13.dcd")]), "dcd")
+	assert.Equal(t, string(result[filepath.Join("traj.dcd", "13.dcd.gz")]), "gz")
+	assert.Equal(t, string(result["log.json"]), "{\"step\":1,\"t\":2.5}\n[3]\n")
+	lines, _ := gunzipBytes(result["log.json.gz"])
+	assert.Equal(t, string(lines), "{\"a\":1}\n")
+
+	_, err = formats.apply(map[string][]byte{"frames.nc": []byte("nc")}, 1)
+	assert.NotNil(t, err)
+	_, err = formats.apply(map[string][]byte{"log.json": []byte("{\"step\":")}, 1)
+	assert.NotNil(t, err)
+	_, err = formats.apply(map[string][]byte{"log.json": []byte(" ")}, 1)
+	assert.NotNil(t, err)
+
+	dir, _ := ioutil.TempDir("", "frameformats")
+	defer os.RemoveAll(dir)
+	jsonPath := filepath.Join(dir, "json")
+	ioutil.WriteFile(jsonPath, []byte("{\"step\": 2}"), 0666)
+	paths, err := formats.applySpooled(map[string]string{
+		"log.json":   jsonPath,
+		"frames.dcd": filepath.Join(dir, "dcd"),
+	}, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, paths, map[string]string{
+		"log.json":                           jsonPath,
+		filepath.Join("frames.dcd", "2.dcd"): filepath.Join(dir, "dcd"),
+	})
+	data, _ := ioutil.ReadFile(jsonPath)
+	assert.Equal(t, string(data), "{\"step\":2}\n")
+}
@@ -0,0 +1,119 @@
+package scv
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Sidecar of the buffer and partitions of a stream holding one FrameRecord per
+// line for the frames posted with metadata.
+const FRAME_METADATA string = "frames.jsonl"
+
+var errReservedFile = errors.New(FRAME_METADATA + " is reserved for frame metadata")
+
+// Returns the line of the sidecar recording meta for frame, received at t.
+func frameRecordLine(frame int, t time.Time, meta FrameMetadata) ([]byte, error) {
+	data, err := json.Marshal(FrameRecord{frame, int(t.Unix()), meta})
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// Returns the frame records of the partitions of a stream, in order. Partitions
+// whose frames were posted without metadata have none, and partitions merged
+// into archives are skipped.
+func (app *Application) readFrameRecords(streamId string, partitions []int) ([]FrameRecord, error) {
+	records := make([]FrameRecord, 0)
+	for _, partition := range partitions {
+		path := filepath.Join(app.StreamDir(streamId), strconv.Itoa(partition), "0", FRAME_METADATA)
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record FrameRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				file.Close()
+				return nil, errors.New("Corrupted frame metadata in partition " + strconv.Itoa(partition))
+			}
+			records = append(records, record)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+/*
+.. http:get:: /streams/frames/:stream_id
+    Metadata of the checkpointed frames of a stream, as posted by its
+    cores with ``/core/frame``, in order.
+    :reqheader Authorization: manager authorization token
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "frames": [
+                {
+                    "frame": 11,
+                    "received": 1404502030,
+                    "simulation_time": 220.0,
+                    "wall_clock": 95.3,
+                    "gpu": "GeForce GTX 980",
+                    "core_version": "0.1.4"
+                }
+            ]
+        }
+    .. note:: ``frame`` is the frame count of the stream including the
+        frame, and ``received`` the time the frame was posted.
+    .. note:: Frames posted without metadata are not listed, nor are the
+        frames of partitions merged into archives.
+    :status 200: OK
+    :status 401: Unauthorized
+    :status 403: You do not own this stream
+    :status 404: Stream does not exist
+*/
+func (app *Application) StreamFramesHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		streamId := mux.Vars(r)["stream_id"]
+		user, err := app.CurrentManager(r)
+		if err != nil {
+			return err
+		}
+		var reply FramesReply
+		err = app.Manager.ReadStream(streamId, func(stream *Stream) error {
+			if app.canManage(user, stream) == false {
+				return ErrForbidden.With("You do not own this stream.")
+			}
+			partitions, err := app.streamPartitions(stream)
+			if err != nil {
+				return err
+			}
+			reply.Frames, err = app.readFrameRecords(streamId, partitions)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(reply)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,295 @@
+package scv
+
+import (
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Default limit on the size of frames uploaded through /core/frame/stream.
+const MAX_STREAMED_FRAME_BYTES int64 = 1 << 30
+
+// Seconds /core/frame/stream has to receive and store a frame, as the read and
+// write timeouts of the Server are too short for MAX_STREAMED_FRAME_BYTES.
+const STREAMED_FRAME_TIMEOUT int = 1800
+
+/*
+Spool the parts of a multipart frame upload into temporary files, one per file
+of the frame, decoding them as decodeFrameFiles would so that no file is held
+in memory. The files may not decode to more than limit bytes together. Returns
+the stored name of each file mapped to its temporary file, which must be
+removed with releaseFrameFiles.
+*/
+func (app *Application) spoolFrameParts(reader *multipart.Reader, compressed bool, limit int64) (map[string]string, error) {
+	os.MkdirAll(app.TmpDir(), 0776)
+	paths := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return paths, nil
+		} else if err != nil {
+			releaseFrameFiles(paths)
+			return nil, err
+		}
+		filename := part.FileName()
+		if filename == "" {
+			filename = part.FormName()
+		}
+		if filename == "" || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+			releaseFrameFiles(paths)
+			return nil, errors.New("Bad filename: " + filename)
+		}
+		stored, path, size, err := app.spoolFramePart(filename, part, compressed, limit)
+		part.Close()
+		if err != nil {
+			releaseFrameFiles(paths)
+			return nil, fmt.Errorf("Unable to read %s: %w", filename, err)
+		}
+		limit -= size
+		if _, ok := paths[stored]; ok {
+			os.Remove(path)
+			releaseFrameFiles(paths)
+			return nil, errors.New("File posted twice: " + stored)
+		}
+		paths[stored] = path
+	}
+}
+
+// Decode a file of a frame into a temporary file, returning the name it is
+// stored under, the temporary file and the size of the decoded file. Files
+// decoding to more than limit bytes are refused with ErrTooLarge.
+func (app *Application) spoolFramePart(filename string, src io.Reader, compressed bool, limit int64) (string, string, int64, error) {
+	if root, ext := splitExt(filename); ext == ".b64" {
+		filename = root
+		src = base64.NewDecoder(base64.StdEncoding, src)
+		if root, ext := splitExt(filename); ext == ".gz" && compressed == false {
+			reader, err := gzip.NewReader(src)
+			if err != nil {
+				return "", "", 0, err
+			}
+			defer reader.Close()
+			filename, src = root, reader
+		}
+	}
+	file, err := ioutil.TempFile(app.TmpDir(), "frame_")
+	if err != nil {
+		return "", "", 0, err
+	}
+	var dst io.Writer = file
+	var gz *gzip.Writer
+	if compressed && filepath.Ext(filename) != ".gz" {
+		gz = gzip.NewWriter(file)
+		filename, dst = filename+".gz", gz
+	}
+	size, err := io.Copy(dst, io.LimitReader(src, limit+1))
+	if err == nil && size > limit {
+		err = ErrTooLarge.With("Decoded files too large")
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", "", 0, err
+	}
+	return filename, file.Name(), size, nil
+}
+
+func releaseFrameFiles(paths map[string]string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// Run the validators of the stream's target on a frame spooled to disk. The
+// files are only read into memory if the target has validators.
+func (app *Application) validateSpooledFrame(stream *Stream, paths map[string]string, compressed bool) error {
+	tv, err := app.validators(stream.TargetId)
+	if err != nil {
+		return err
+	}
+	if len(tv.validators) == 0 {
+		return nil
+	}
+	files := make(map[string][]byte)
+	for filename, path := range paths {
+		if files[filename], err = ioutil.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	if compressed {
+		return app.validateCompressedFrame(stream, files)
+	}
+	return app.validateUpload(stream, files, false)
+}
+
+/*
+ ..  http:put:: /core/frame/stream
+    Append a frame to the stream's buffer, like ``/core/frame``, but
+    the files are sent as the parts of a ``multipart/form-data`` body,
+    one part per file named after the file. Parts are raw bytes, though
+    names ending in .b64 or .gz.b64 are decoded as in ``/core/frame``.
+    Neither the core nor the SCV need to hold the frame in memory, so
+    that large frames can be uploaded, eg. with chunked transfer
+    encoding.
+    :reqheader Content-Type: multipart/form-data; boundary=...
+    :reqheader Content-MD5: MD5 Sum of the body. With chunked transfer
+        encoding, it may be sent as a trailer instead.
+    :reqheader Authorization: core Authorization token
+    **Example request**
+    .. sourcecode:: http
+        PUT /core/frame/stream HTTP/1.1
+        Content-Type: multipart/form-data; boundary=frame
+        Transfer-Encoding: chunked
+        Trailer: Content-MD5
+
+        --frame
+        Content-Disposition: form-data; name="frames.xtc"; filename="frames.xtc"
+
+        <binary>
+        --frame--
+    .. note:: The body may not exceed ``MaxStreamedFrameBytes`` (1GB by
+        default), nor may the decoded files. The upload has 30 minutes,
+        regardless of the read and write timeouts of the SCV.
+    .. note:: The files are only read into memory if the target has
+        validators, or for ``jsonl`` formats, see ``/core/frame``. The
+        .xtc files are also read if the target verifies frames, in
+        which case they must hold a single frame.
+    :status 200: OK
+    :status 400: Bad request
+    :status 401: Invalid core token
+    :status 403: The donor or engine of the core is banned, the stream
+        is deactivated
+    :status 409: Frame was already posted
+    :status 413: Body exceeds ``MaxStreamedFrameBytes``
+    :status 429: Frame uploads exceed ``StreamIngest`` or ``GlobalIngest``,
+        or too many frames are waiting to be written
+    :status 507: SCV full, the core should stop the stream
+*/
+func (app *Application) CoreFrameStreamHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		if app.ReadOnly() {
+			return ErrFull
+		}
+		token := r.Header.Get("Authorization")
+		// nothing is read from unknown cores
+		if err := app.Manager.CheckActiveToken(token); err != nil {
+			return err
+		}
+		if r.ContentLength >= 0 {
+			if err := app.throttleFrame(w, token, r.ContentLength); err != nil {
+				return err
+			}
+		}
+		if err := app.refuseBanned(token); err != nil {
+			return err
+		}
+		settings := app.Settings()
+		extendDeadlines(w, app.routeTimeout(settings, "/core/frame/stream"))
+		compressed := settings.FrameStorage == STORE_COMPRESSED
+		limit := uploadLimit(settings.MaxStreamedFrameBytes, MAX_STREAMED_FRAME_BYTES)
+		h := md5.New()
+		body := http.MaxBytesReader(w, r.Body, limit)
+		r.Body = ioutil.NopCloser(io.TeeReader(body, h))
+		reader, err := r.MultipartReader()
+		if err != nil {
+			return errors.New("Expected a multipart body: " + err.Error())
+		}
+		paths, err := app.spoolFrameParts(reader, compressed, limit)
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				return ErrTooLarge.With("Request body too large")
+			}
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) {
+				return statusErr
+			}
+			return err
+		}
+		frame := &bufferedFrame{paths: paths}
+		enqueued := false
+		defer func() {
+			if enqueued == false {
+				frame.release()
+			}
+		}()
+		// the epilogue and the trailers follow the last part
+		if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+			return err
+		}
+		md5String := r.Header.Get("Content-MD5")
+		if md5String == "" {
+			md5String = r.Trailer.Get("Content-MD5")
+		}
+		if md5String != hex.EncodeToString(h.Sum(nil)) {
+			return errors.New("MD5 mismatch")
+		}
+		if r.ContentLength < 0 {
+			var size int64
+			for _, path := range paths {
+				if info, err := os.Stat(path); err == nil {
+					size += info.Size()
+				}
+			}
+			if err := app.throttleFrame(w, token, size); err != nil {
+				return err
+			}
+		}
+		var streamId string
+		err = app.Manager.ModifyActiveStream(token, recordFailure(r, func(stream *Stream) error {
+			streamId = stream.StreamId
+			if md5String == sessionData(stream).frameHash {
+				return ErrConflict.With("POSTed same frame twice")
+			}
+			if err := app.checkQuota(stream); err != nil {
+				return err
+			}
+			if err := app.validateSpooledFrame(stream, paths, compressed); err != nil {
+				return err
+			}
+			count, err := app.verifySpooledFrame(stream, paths, 1)
+			if err != nil {
+				return err
+			}
+			formats, err := app.frameFormats(stream.TargetId)
+			if err != nil {
+				return err
+			}
+			if frame.paths, err = formats.applySpooled(paths, stream.Frames+stream.ActiveStream.BufferFrames+1); err != nil {
+				return err
+			}
+			if sessionData(stream).writer == nil {
+				sessionData(stream).writer = app.newFrameWriter(stream)
+			}
+			if err := sessionData(stream).writer.Enqueue(frame); err != nil {
+				return err
+			}
+			enqueued = true
+			sessionData(stream).frameHash = md5String
+			stream.ActiveStream.BufferFrames += 1
+			sessionData(stream).addFrameCount(count)
+			stream.ActiveStream.RecordFrame(time.Now())
+			app.events.Publish(NewEvent(EVENT_FRAME, stream, map[string]interface{}{
+				"buffer_frames": stream.ActiveStream.BufferFrames,
+			}))
+			return nil
+		}))
+		app.quarantineInvalid(streamId, err)
+		return err
+	}
+}
@@ -0,0 +1,88 @@
+package scv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoolFrameParts(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "framestream")
+	defer os.RemoveAll(dir)
+	app := &Application{Config: Configuration{Name: filepath.Join(dir, "scv")}, usage: NewDiskUsage()}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("zipped"))
+	zw.Close()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("frames.xtc", "frames.xtc")
+	part.Write([]byte("frame"))
+	part, _ = mw.CreateFormFile("log.txt.gz.b64", "log.txt.gz.b64")
+	part.Write([]byte(base64.StdEncoding.EncodeToString(gz.Bytes())))
+	mw.Close()
+
+	paths, err := app.spoolFrameParts(multipart.NewReader(bytes.NewReader(body.Bytes()), mw.Boundary()), false, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, len(paths), 2)
+	stream := &Stream{StreamId: "s1", TargetId: "t1"}
+	fw := app.newFrameWriter(stream)
+	assert.Nil(t, fw.Enqueue(&bufferedFrame{paths: paths}))
+	assert.Nil(t, fw.Flush())
+	fw.Stop()
+	data, _ := ioutil.ReadFile(filepath.Join(app.StreamDir("s1"), "buffer_files", "frames.xtc"))
+	assert.Equal(t, string(data), "frame")
+	data, _ = ioutil.ReadFile(filepath.Join(app.StreamDir("s1"), "buffer_files", "log.txt"))
+	assert.Equal(t, string(data), "zipped")
+	// the spooled files are removed once written
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// compressed storage gzips the files that are not
+	paths, err = app.spoolFrameParts(multipart.NewReader(bytes.NewReader(body.Bytes()), mw.Boundary()), true, 1024)
+	assert.Nil(t, err)
+	defer releaseFrameFiles(paths)
+	data, _ = ioutil.ReadFile(paths["log.txt.gz"])
+	assert.Equal(t, data, gz.Bytes())
+	data, _ = ioutil.ReadFile(paths["frames.xtc.gz"])
+	contents, err := gunzipBytes(data)
+	assert.Nil(t, err)
+	assert.Equal(t, string(contents), "frame")
+
+	body.Reset()
+	mw = multipart.NewWriter(&body)
+	mw.CreateFormField("../frames.xtc")
+	mw.Close()
+	_, err = app.spoolFrameParts(multipart.NewReader(bytes.NewReader(body.Bytes()), mw.Boundary()), false, 1024)
+	assert.NotNil(t, err)
+
+	// the parts may not decode to more than the limit together
+	gz.Reset()
+	zw = gzip.NewWriter(&gz)
+	zw.Write(make([]byte, 1<<20))
+	zw.Close()
+	body.Reset()
+	mw = multipart.NewWriter(&body)
+	part, _ = mw.CreateFormFile("frames.xtc", "frames.xtc")
+	part.Write(make([]byte, 1000))
+	part, _ = mw.CreateFormFile("bomb.txt.gz.b64", "bomb.txt.gz.b64")
+	part.Write([]byte(base64.StdEncoding.EncodeToString(gz.Bytes())))
+	mw.Close()
+	spooled, _ := ioutil.ReadDir(app.TmpDir())
+	_, err = app.spoolFrameParts(multipart.NewReader(bytes.NewReader(body.Bytes()), mw.Boundary()), false, 1024)
+	var statusErr *StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, statusErr.Status, 413)
+	files, _ := ioutil.ReadDir(app.TmpDir())
+	assert.Equal(t, len(files), len(spooled))
+}
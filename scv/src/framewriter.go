@@ -0,0 +1,264 @@
+package scv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Values of Configuration.FrameStorage. Decoded frame files are stored as
+// posted minus their encodings, compressed ones are stored gzipped, which saves
+// disk space and gunzipping gzipped uploads. gzip members can be appended to one
+// another, so the buffered and partition files stay valid gzip files.
+const (
+	STORE_DECODED    string = "decoded"
+	STORE_COMPRESSED string = "compressed"
+)
+
+// Frames of a stream accepted but not yet appended to its buffer. A core
+// posting frames faster than they are written gets a 429.
+const FRAME_QUEUE_SIZE int = 8
+
+var errFrameQueueFull = ErrTooManyRequests.With("Too many frames waiting to be written")
+
+// A frame whose files were decoded and validated, waiting to be appended. The
+// files of frames uploaded through /core/frame/stream are spooled to disk
+// rather than held in memory, see spoolFrameParts.
+type bufferedFrame struct {
+	files map[string][]byte
+	paths map[string]string // stored name of a file to its temporary file
+}
+
+// Remove the temporary files of the frame.
+func (frame *bufferedFrame) release() {
+	releaseFrameFiles(frame.paths)
+}
+
+/*
+frameWriter appends the frames of an active stream to its buffer_files in a
+goroutine of its own, so that frames are acknowledged without holding the
+stream's lock during disk I/O. Frames are written in the order they were
+enqueued. The first failed write is kept: later frames are dropped, and the
+error is returned by Enqueue and Flush until the stream is deactivated, since
+the buffer is then incomplete.
+*/
+type frameWriter struct {
+	app      *Application
+	stream   *Stream // only TargetId and StreamId are read, which are constant
+	dir      string
+	queue    chan *bufferedFrame
+	pending  sync.WaitGroup // frames enqueued but not written
+	done     chan struct{}  // closed once the goroutine returns
+	stopped  int32
+	errMutex sync.Mutex
+	err      error
+}
+
+func (app *Application) newFrameWriter(stream *Stream) *frameWriter {
+	fw := &frameWriter{
+		app:    app,
+		stream: stream,
+		dir:    filepath.Join(app.StreamDir(stream.StreamId), "buffer_files"),
+		queue:  make(chan *bufferedFrame, FRAME_QUEUE_SIZE),
+		done:   make(chan struct{}),
+	}
+	go fw.run()
+	return fw
+}
+
+func (fw *frameWriter) error() error {
+	fw.errMutex.Lock()
+	defer fw.errMutex.Unlock()
+	return fw.err
+}
+
+func (fw *frameWriter) run() {
+	defer close(fw.done)
+	for frame := range fw.queue {
+		if atomic.LoadInt32(&fw.stopped) == 0 && fw.error() == nil {
+			if err := fw.write(frame); err != nil {
+				fw.errMutex.Lock()
+				fw.err = errors.New("Unable to write frame: " + err.Error())
+				fw.errMutex.Unlock()
+			}
+		}
+		frame.release()
+		fw.pending.Done()
+	}
+}
+
+func (fw *frameWriter) write(frame *bufferedFrame) error {
+	if err := os.MkdirAll(fw.dir, 0776); err != nil {
+		return err
+	}
+	for filename, data := range frame.files {
+		path, err := fw.path(filename)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0776)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(data)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		fw.app.usage.Add(fw.stream.TargetId, fw.stream.StreamId, int64(len(data)))
+	}
+	for filename, src := range frame.paths {
+		path, err := fw.path(filename)
+		if err != nil {
+			return err
+		}
+		written, err := appendFile(path, src)
+		fw.app.usage.Add(fw.stream.TargetId, fw.stream.StreamId, written)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the path of a file of the buffer, creating its directory if it is in
+// one, eg. the frames of split formats, see frameFormats.
+func (fw *frameWriter) path(filename string) (string, error) {
+	path := filepath.Join(fw.dir, filename)
+	if dir := filepath.Dir(path); dir != fw.dir {
+		if err := os.MkdirAll(dir, 0776); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// Append the contents of the file at src to the file at dst, returning the
+// number of bytes appended.
+func appendFile(dst, src string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0776)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+// Queue a frame for writing. Never blocks, the stream's lock may be held.
+func (fw *frameWriter) Enqueue(frame *bufferedFrame) error {
+	if err := fw.error(); err != nil {
+		return err
+	}
+	fw.pending.Add(1)
+	select {
+	case fw.queue <- frame:
+		return nil
+	default:
+		fw.pending.Done()
+		return errFrameQueueFull
+	}
+}
+
+// Wait until every frame enqueued so far is written. Returns the first error
+// met while writing.
+func (fw *frameWriter) Flush() error {
+	fw.pending.Wait()
+	return fw.error()
+}
+
+// Drop the frames still queued, and wait for the frame being written, if any.
+// The writer cannot be used afterwards.
+func (fw *frameWriter) Stop() {
+	atomic.StoreInt32(&fw.stopped, 1)
+	close(fw.queue)
+	<-fw.done
+}
+
+// Stat path or, if it does not exist, the compressed copy stored at path.gz.
+// Returns the path found.
+func statStored(path string) (string, os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) && filepath.Ext(path) != ".gz" {
+		if gzInfo, gzErr := os.Stat(path + ".gz"); gzErr == nil {
+			return path + ".gz", gzInfo, nil
+		}
+	}
+	return path, info, err
+}
+
+// Decode the files of a frame into the form they are stored in: names ending in
+// .b64 are base64 decoded, then those ending in .gz are gunzipped, and the
+// extensions are removed. If compressed is set, gzipped files are kept as is
+// and the others are gzipped instead, so that every file is stored as name.gz.
+// The files may not decompress to more than limit bytes together.
+func decodeFrameFiles(encoded map[string]string, compressed bool, limit int64) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for filename, filestring := range encoded {
+		root, ext := splitExt(filename)
+		filebin := []byte(filestring)
+		if ext == ".b64" {
+			filename = root
+			reader := base64.NewDecoder(base64.StdEncoding, bytes.NewReader(filebin))
+			filecopy, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return nil, err
+			}
+			filebin = filecopy
+			root, ext := splitExt(filename)
+			if ext == ".gz" && compressed {
+				// only the header is checked, validators decode the rest
+				reader, err := gzip.NewReader(bytes.NewReader(filebin))
+				if err != nil {
+					return nil, err
+				}
+				reader.Close()
+			} else if ext == ".gz" {
+				filename = root
+				if filebin, err = gunzipBytesLimit(filebin, limit); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if compressed && filepath.Ext(filename) != ".gz" {
+			gzipped, err := gzipBytes(filebin)
+			if err != nil {
+				return nil, err
+			}
+			filename, filebin = filename+".gz", gzipped
+		}
+		files[filename] = filebin
+		limit -= int64(len(filebin))
+	}
+	return files, nil
+}
+
+// Undo the compression of frame files stored as name.gz, for validators.
+func frameContents(stored map[string][]byte) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for filename, data := range stored {
+		if root, ext := splitExt(filename); ext == ".gz" {
+			contents, err := gunzipBytes(data)
+			if err != nil {
+				return nil, errors.New("Unable to gunzip " + filename + ": " + err.Error())
+			}
+			filename, data = root, contents
+		}
+		files[filename] = data
+	}
+	return files, nil
+}
@@ -0,0 +1,107 @@
+package scv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeFrameFiles(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("zipped"))
+	zw.Close()
+	files, err := decodeFrameFiles(map[string]string{
+		"frames.xtc.b64": base64.StdEncoding.EncodeToString([]byte("plain")),
+		"log.txt.gz.b64": base64.StdEncoding.EncodeToString(gz.Bytes()),
+		"raw.txt":        "raw",
+	}, false, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, files, map[string][]byte{
+		"frames.xtc": []byte("plain"),
+		"log.txt":    []byte("zipped"),
+		"raw.txt":    []byte("raw"),
+	})
+	_, err = decodeFrameFiles(map[string]string{"bad.gz.b64": base64.StdEncoding.EncodeToString([]byte("nope"))}, false, 1024)
+	assert.NotNil(t, err)
+
+	// files are not decompressed past the limit
+	gz.Reset()
+	zw = gzip.NewWriter(&gz)
+	zw.Write(make([]byte, 1<<20))
+	zw.Close()
+	_, err = decodeFrameFiles(map[string]string{"bomb.gz.b64": base64.StdEncoding.EncodeToString(gz.Bytes())}, false, 1024)
+	assert.Equal(t, err.(*StatusError).Status, 413)
+	gz.Reset()
+	zw = gzip.NewWriter(&gz)
+	zw.Write([]byte("zipped"))
+	zw.Close()
+
+	// compressed storage keeps gzipped files as they are, and gzips the others
+	files, err = decodeFrameFiles(map[string]string{
+		"frames.xtc.b64": base64.StdEncoding.EncodeToString([]byte("plain")),
+		"log.txt.gz.b64": base64.StdEncoding.EncodeToString(gz.Bytes()),
+	}, true, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, len(files), 2)
+	assert.Equal(t, files["log.txt.gz"], gz.Bytes())
+	contents, err := frameContents(files)
+	assert.Nil(t, err)
+	assert.Equal(t, contents, map[string][]byte{
+		"frames.xtc": []byte("plain"),
+		"log.txt":    []byte("zipped"),
+	})
+	_, err = decodeFrameFiles(map[string]string{"bad.gz.b64": base64.StdEncoding.EncodeToString([]byte("nope"))}, true, 1024)
+	assert.NotNil(t, err)
+}
+
+func TestStatStored(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "framewriter")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "log.txt"), []byte("log"), 0666)
+	ioutil.WriteFile(filepath.Join(dir, "frames.xtc.gz"), []byte("gz"), 0666)
+	path, _, err := statStored(filepath.Join(dir, "log.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, path, filepath.Join(dir, "log.txt"))
+	path, info, err := statStored(filepath.Join(dir, "frames.xtc"))
+	assert.Nil(t, err)
+	assert.Equal(t, path, filepath.Join(dir, "frames.xtc.gz"))
+	assert.Equal(t, info.Size(), int64(2))
+	_, _, err = statStored(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFrameWriter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "framewriter")
+	defer os.RemoveAll(dir)
+	app := &Application{Config: Configuration{Name: filepath.Join(dir, "scv")}, usage: NewDiskUsage()}
+	stream := &Stream{StreamId: "s1", TargetId: "t1"}
+	fw := app.newFrameWriter(stream)
+	for _, data := range []string{"a", "b", "c"} {
+		assert.Nil(t, fw.Enqueue(&bufferedFrame{files: map[string][]byte{"frames.xtc": []byte(data)}}))
+	}
+	assert.Nil(t, fw.Flush())
+	data, _ := ioutil.ReadFile(filepath.Join(app.StreamDir("s1"), "buffer_files", "frames.xtc"))
+	assert.Equal(t, string(data), "abc")
+	// the frames of split formats are stored in a directory
+	assert.Nil(t, fw.Enqueue(&bufferedFrame{files: map[string][]byte{filepath.Join("frames.dcd", "4.dcd"): []byte("d")}}))
+	assert.Nil(t, fw.Flush())
+	data, _ = ioutil.ReadFile(filepath.Join(app.StreamDir("s1"), "buffer_files", "frames.dcd", "4.dcd"))
+	assert.Equal(t, string(data), "d")
+	fw.Stop()
+
+	// a failed write is sticky
+	fw = app.newFrameWriter(stream)
+	os.RemoveAll(fw.dir)
+	ioutil.WriteFile(fw.dir, nil, 0666)
+	assert.Nil(t, fw.Enqueue(&bufferedFrame{files: map[string][]byte{"frames.xtc": []byte("d")}}))
+	assert.NotNil(t, fw.Flush())
+	assert.NotNil(t, fw.Enqueue(&bufferedFrame{files: map[string][]byte{"frames.xtc": []byte("e")}}))
+	fw.Stop()
+}
@@ -0,0 +1,134 @@
+package scv
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Default free space on the data partition below which the SCV is not ready.
+const MIN_DISK_FREE int64 = 1 << 30
+
+// Default number of deferred writes waiting for the database above which the
+// SCV is not ready.
+const MAX_STATS_QUEUE int = STATS_QUEUE_SIZE / 2
+
+// Time the database has to answer the ping of a readiness check.
+const PING_TIMEOUT time.Duration = 2 * time.Second
+
+// Outcome of a single readiness check. Value and Threshold are set for the
+// checks that compare a measure against a limit.
+type Check struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	Value     int64  `json:"value,omitempty"`
+	Threshold int64  `json:"threshold,omitempty"`
+}
+
+// Reply of GET /readyz.
+type ReadyReply struct {
+	Ready  bool             `json:"ready"`
+	Checks map[string]Check `json:"checks"`
+}
+
+/*
+Check the dependencies of the SCV: the database must answer a ping, the data
+partition must have at least MinDiskFree bytes free, and the stats writer must
+not be more than MaxStatsQueue writes behind.
+*/
+func (app *Application) Readiness() ReadyReply {
+	settings := app.Settings()
+	checks := make(map[string]Check)
+
+	database := Check{OK: true}
+	if err := app.Database.Ping(); err != nil {
+		database = Check{OK: false, Error: err.Error()}
+	}
+	checks["database"] = database
+
+	minFree := settings.MinDiskFree
+	if minFree == 0 {
+		minFree = MIN_DISK_FREE
+	}
+	free := app.dataFree()
+	disk := Check{OK: true, Value: free}
+	if minFree > 0 {
+		disk.Threshold = minFree
+		if free < 0 {
+			disk.OK, disk.Error = false, "Unable to stat the data partition"
+		} else if free < minFree {
+			disk.OK, disk.Error = false, "Data partition is almost full"
+		}
+	}
+	checks["disk"] = disk
+
+	maxQueue := settings.MaxStatsQueue
+	if maxQueue <= 0 {
+		maxQueue = MAX_STATS_QUEUE
+	}
+	depth := app.stats.Depth()
+	queue := Check{OK: true, Value: int64(depth), Threshold: int64(maxQueue)}
+	if depth > maxQueue {
+		queue.OK, queue.Error = false, "Stats writes are falling behind"
+	}
+	checks["stats_queue"] = queue
+
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.OK
+	}
+	return ReadyReply{ready, checks}
+}
+
+/*
+.. http:get:: /healthz
+    Liveness probe: replies as long as the SCV serves requests, whatever
+    the state of its dependencies.
+    :status 200: OK
+*/
+func (app *Application) HealthHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(`{"status": "ok"}`))
+		return nil
+	}
+}
+
+/*
+.. http:get:: /readyz
+    Readiness probe for load balancers: fails if the database cannot be
+    reached, the data partition is almost full, or the writes deferred to
+    the database pile up.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "ready": false,
+            "checks": {
+                "database": {"ok": true},
+                "disk": {
+                    "ok": false,
+                    "error": "Data partition is almost full",
+                    "value": 52428800, // bytes free
+                    "threshold": 1073741824
+                },
+                "stats_queue": {"ok": true, "value": 12, "threshold": 5000}
+            }
+        }
+    :status 200: Ready
+    :status 503: Not ready
+*/
+func (app *Application) ReadyHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		reply := app.Readiness()
+		data, err := json.Marshal(reply)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		if reply.Ready == false {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,70 @@
+package scv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadiness(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "health")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{
+		Config:   Configuration{Name: filepath.Join(dir, "scv"), MinDiskFree: 1, MaxStatsQueue: 1},
+		Database: db,
+		stats:    NewStatsWriter(4),
+	}
+	ready := func() (ReadyReply, int) {
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		w := httptest.NewRecorder()
+		app.ReadyHandler().ServeHTTP(w, req)
+		reply := ReadyReply{}
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return reply, w.Code
+	}
+	reply, code := ready()
+	assert.Equal(t, code, 200)
+	assert.True(t, reply.Ready)
+	assert.Equal(t, len(reply.Checks), 3)
+	assert.True(t, reply.Checks["disk"].Value > 0)
+
+	app.Config.MinDiskFree = 1 << 62
+	reply, code = ready()
+	assert.Equal(t, code, 503)
+	assert.False(t, reply.Ready)
+	assert.False(t, reply.Checks["disk"].OK)
+	assert.True(t, reply.Checks["database"].OK)
+	app.Config.MinDiskFree = -1
+	reply, _ = ready()
+	assert.True(t, reply.Checks["disk"].OK)
+
+	app.stats.enqueue(&deferredOp{})
+	app.stats.enqueue(&deferredOp{})
+	reply, code = ready()
+	assert.Equal(t, code, 503)
+	assert.Equal(t, reply.Checks["stats_queue"], Check{false, "Stats writes are falling behind", 2, 1})
+
+	// the database is gone
+	<-app.stats.queue
+	<-app.stats.queue
+	os.RemoveAll(filepath.Join(dir, "db"))
+	reply, code = ready()
+	assert.Equal(t, code, 503)
+	assert.False(t, reply.Checks["database"].OK)
+	assert.True(t, reply.Checks["stats_queue"].OK)
+
+	// liveness does not depend on any of this
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	w := httptest.NewRecorder()
+	app.HealthHandler().ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+}
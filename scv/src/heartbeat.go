@@ -0,0 +1,76 @@
+package scv
+
+import (
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// How often, in seconds, the SCV reports itself to servers.scvs.
+const SCV_HEARTBEAT_INTERVAL int = 30
+
+// Returns the one minute load average of the host, or 0 if unavailable.
+func loadAverage() float64 {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, _ := strconv.ParseFloat(fields[0], 64)
+	return load
+}
+
+// The fields of the servers.scvs document that are refreshed on every
+// heartbeat.
+func (app *Application) heartbeatStatus() bson.M {
+	active, inactive, disabled := app.Manager.Counts()
+	capacity := app.Capacity()
+	return bson.M{
+		"status":           capacity.Status,
+		"last_seen":        int(time.Now().Unix()),
+		"active_streams":   active,
+		"inactive_streams": inactive,
+		"disabled_streams": disabled,
+		"disk_free":        capacity.DiskFree,
+		"load":             capacity.Load,
+		"capacity":         capacity,
+	}
+}
+
+// Update the SCV's document in servers.scvs so the CC knows it is alive.
+func (app *Application) Heartbeat() error {
+	return app.Database.UpdateSCV(app.Config.Name, app.heartbeatStatus())
+}
+
+// Tell the CC that the SCV is going away. Called on graceful shutdown.
+func (app *Application) MarkUnreachable() error {
+	return app.Database.UpdateSCV(app.Config.Name, bson.M{
+		"status":    "unreachable",
+		"last_seen": int(time.Now().Unix()),
+	})
+}
+
+// A separate goroutine that periodically sends heartbeats.
+func (app *Application) RunHeartbeat() {
+	defer app.workerWG.Done()
+	for {
+		if err := app.Heartbeat(); err != nil {
+			log.Println("Unable to send heartbeat:", err)
+		}
+		if err := app.SyncShards(); err != nil {
+			log.Println("Unable to update shards:", err)
+		}
+		select {
+		case <-app.finish:
+			return
+		case <-time.After(time.Duration(SCV_HEARTBEAT_INTERVAL) * time.Second):
+		}
+	}
+}
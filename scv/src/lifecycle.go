@@ -0,0 +1,169 @@
+package scv
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// Days before a lifecycle action its notice is sent, for targets that do not
+// set notice_days.
+const LIFECYCLE_NOTICE_DAYS int = 1
+
+// Actions of a LifecyclePolicy, in the order they are considered.
+const (
+	LIFECYCLE_DELETE  string = "delete"
+	LIFECYCLE_DISABLE string = "disable"
+	LIFECYCLE_ARCHIVE string = "archive"
+)
+
+/*
+Ages out the streams of a target, set by the "stream_lifecycle" option of the
+target, eg.
+
+    "stream_lifecycle": {
+        "disable_idle_days": 30,
+        "delete_idle_days": 365,
+        "archive_age_days": 180,
+        "notice_days": 3
+    }
+
+Streams that were not active for disable_idle_days are disabled, and those not
+active for delete_idle_days are deleted, as by /streams/delete so that they can
+be restored for TrashDays. Streams created archive_age_days ago have all but
+their last partition merged into an archive, as the compactor does. A stream
+is idle since it was last deactivated, enabled or created, and active streams
+are left alone. Each action is announced by a notice event notice_days before
+it is due, and is only taken on a later pass of the scheduler, so that the
+stream's managers always get a chance to intervene. 0 disables an action.
+*/
+type LifecyclePolicy struct {
+	DisableIdleDays int
+	DeleteIdleDays  int
+	ArchiveAgeDays  int
+	NoticeDays      int
+}
+
+// Parse the lifecycle policy in the options of a target. Returns false if the
+// target's streams are kept as they are.
+func newLifecyclePolicy(options map[string]interface{}) (LifecyclePolicy, bool, error) {
+	config, ok := options["stream_lifecycle"].(map[string]interface{})
+	if ok == false {
+		return LifecyclePolicy{}, false, nil
+	}
+	policy := LifecyclePolicy{
+		DisableIdleDays: optionInt(config, "disable_idle_days", 0),
+		DeleteIdleDays:  optionInt(config, "delete_idle_days", 0),
+		ArchiveAgeDays:  optionInt(config, "archive_age_days", 0),
+		NoticeDays:      optionInt(config, "notice_days", LIFECYCLE_NOTICE_DAYS),
+	}
+	if policy.DisableIdleDays < 0 || policy.DeleteIdleDays < 0 || policy.ArchiveAgeDays < 0 || policy.NoticeDays < 0 {
+		return LifecyclePolicy{}, false, errors.New("days must not be negative")
+	}
+	return policy, true, nil
+}
+
+func (app *Application) lifecyclePolicy(targetId string) (LifecyclePolicy, bool, error) {
+	options, err := app.targetOptions(targetId)
+	if err != nil {
+		// targets without a document in data.targets keep everything
+		return LifecyclePolicy{}, false, nil
+	}
+	policy, ok, err := newLifecyclePolicy(options)
+	if err != nil {
+		return LifecyclePolicy{}, false, errors.New("Bad stream_lifecycle for target " + targetId + ": " + err.Error())
+	}
+	return policy, ok, nil
+}
+
+/*
+Returns the actions of the policy that are due for a stream at now, and sends
+the notices of those coming up. An action is only returned once its notice was
+sent on a previous call, and notices of actions that are no longer coming up,
+eg. because the stream was activated, are forgotten. The stream must be locked
+for writing.
+*/
+func (app *Application) dueLifecycleActions(s *Stream, policy LifecyclePolicy, now int) []string {
+	if s.ActiveStream != nil {
+		return nil
+	}
+	idleSince := s.CreationDate
+	if s.LastActive > idleSince {
+		idleSince = s.LastActive
+	}
+	days := map[string]int{
+		LIFECYCLE_DELETE:  policy.DeleteIdleDays,
+		LIFECYCLE_DISABLE: policy.DisableIdleDays,
+		LIFECYCLE_ARCHIVE: policy.ArchiveAgeDays,
+	}
+	if s.MongoStatus != "enabled" {
+		days[LIFECYCLE_DISABLE] = 0
+	}
+	if streamData(s).lifecycleNotices == nil {
+		streamData(s).lifecycleNotices = make(map[string]int)
+	}
+	actions := make([]string, 0)
+	for _, action := range []string{LIFECYCLE_DELETE, LIFECYCLE_DISABLE, LIFECYCLE_ARCHIVE} {
+		if days[action] == 0 {
+			delete(streamData(s).lifecycleNotices, action)
+			continue
+		}
+		due := idleSince + days[action]*86400
+		if action == LIFECYCLE_ARCHIVE {
+			due = s.CreationDate + days[action]*86400
+		}
+		if now < due-policy.NoticeDays*86400 {
+			delete(streamData(s).lifecycleNotices, action)
+			continue
+		}
+		if _, ok := streamData(s).lifecycleNotices[action]; ok == false {
+			streamData(s).lifecycleNotices[action] = now
+			app.events.Publish(NewEvent(EVENT_NOTICE, s, map[string]interface{}{
+				"action": action,
+				"due":    due,
+			}))
+			continue
+		}
+		if now >= due {
+			actions = append(actions, action)
+			if action == LIFECYCLE_DELETE {
+				// the other actions are moot
+				break
+			}
+		}
+	}
+	return actions
+}
+
+// Apply the lifecycle policy of the stream's target to a stream at now.
+func (app *Application) applyLifecycle(streamId string, now time.Time) error {
+	var actions []string
+	var owner string
+	err := app.Manager.ModifyStream(streamId, func(stream *Stream) error {
+		policy, ok, err := app.lifecyclePolicy(stream.TargetId)
+		if err != nil || ok == false {
+			return err
+		}
+		owner = stream.Owner
+		actions = app.dueLifecycleActions(stream, policy, int(now.Unix()))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, action := range actions {
+		switch action {
+		case LIFECYCLE_DELETE:
+			err = app.deleteStream(streamId, owner, owner)
+		case LIFECYCLE_DISABLE:
+			err = app.Manager.DisableStream(streamId, owner)
+		case LIFECYCLE_ARCHIVE:
+			err = app.compactStream(streamId, 1)
+		}
+		if err != nil {
+			return errors.New("Unable to " + action + " stream: " + err.Error())
+		}
+		log.Println("Applied stream_lifecycle to stream " + streamId + ": " + action)
+	}
+	return nil
+}
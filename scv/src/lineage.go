@@ -0,0 +1,149 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// A stream in a lineage tree, along with the streams forked from it.
+type LineageNode struct {
+	StreamId  string         `json:"stream_id"`
+	ForkFrame int            `json:"fork_frame"` // frame of the parent this stream was forked from
+	Frames    int            `json:"frames"`
+	Children  []*LineageNode `json:"children"`
+}
+
+// Checks that user may fork a new stream from frame forkFrame of parentId.
+func (app *Application) checkFork(parentId string, forkFrame int, user string) error {
+	if parentId == "" {
+		if forkFrame != 0 {
+			return errors.New("fork_frame requires parent_stream_id")
+		}
+		return nil
+	}
+	return app.Manager.ReadStream(parentId, func(parent *Stream) error {
+		if app.canManage(user, parent) == false {
+			return ErrForbidden.With("You do not own the parent stream.")
+		}
+		if forkFrame < 0 || forkFrame > parent.Frames {
+			return errors.New("fork_frame must be between 0 and " + strconv.Itoa(parent.Frames))
+		}
+		return nil
+	})
+}
+
+/*
+Reconstruct the lineage of a stream from the streams of this SCV. Returns the
+tree rooted at the stream's oldest known ancestor, and the ids of its
+ancestors, parent first. The last ancestor may no longer exist (eg. if it was
+deleted), in which case the tree is rooted at its child.
+*/
+func (app *Application) Lineage(streamId string) (*LineageNode, []string, error) {
+	nodes := make(map[string]*LineageNode)
+	parents := make(map[string]string)
+	for _, id := range app.Manager.StreamIds() {
+		app.Manager.ReadStream(id, func(stream *Stream) error {
+			nodes[id] = &LineageNode{id, stream.ForkFrame, stream.Frames, make([]*LineageNode, 0)}
+			if stream.ParentStreamId != "" {
+				parents[id] = stream.ParentStreamId
+			}
+			return nil
+		})
+	}
+	if _, ok := nodes[streamId]; ok == false {
+		return nil, nil, ErrNotFound.With("stream " + streamId + " does not exist")
+	}
+	for id, parentId := range parents {
+		if parent, ok := nodes[parentId]; ok {
+			parent.Children = append(parent.Children, nodes[id])
+		}
+	}
+	for _, node := range nodes {
+		sort.Sort(byForkFrame(node.Children))
+	}
+	ancestors := make([]string, 0)
+	root := streamId
+	visited := map[string]bool{streamId: true}
+	for {
+		parentId, ok := parents[root]
+		if ok == false || visited[parentId] {
+			break
+		}
+		ancestors = append(ancestors, parentId)
+		visited[parentId] = true
+		if _, ok := nodes[parentId]; ok == false {
+			break
+		}
+		root = parentId
+	}
+	return nodes[root], ancestors, nil
+}
+
+type byForkFrame []*LineageNode
+
+func (s byForkFrame) Len() int      { return len(s) }
+func (s byForkFrame) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byForkFrame) Less(i, j int) bool {
+	if s[i].ForkFrame != s[j].ForkFrame {
+		return s[i].ForkFrame < s[j].ForkFrame
+	}
+	return s[i].StreamId < s[j].StreamId
+}
+
+/*
+.. http:get:: /streams/lineage/:stream_id
+    The ancestry tree of a stream. The tree is rooted at the oldest
+    ancestor of the stream on this SCV and contains every stream forked
+    from it, directly or not.
+    :reqheader Authorization: Manager's authorization token
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "ancestors": ["parent_id", "root_id"], // parent first
+            "tree": {
+                "stream_id": "root_id",
+                "fork_frame": 0,
+                "frames": 40,
+                "children": [
+                    {
+                        "stream_id": "parent_id",
+                        "fork_frame": 25, // forked from frame 25 of root_id
+                        "frames": 12,
+                        "children": [...]
+                    }
+                ]
+            }
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) StreamLineageHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		if _, err := app.checkOwner(streamId, user); err != nil {
+			return err
+		}
+		tree, ancestors, err := app.Lineage(streamId)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"ancestors": ancestors,
+			"tree":      tree,
+		})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
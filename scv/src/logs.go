@@ -0,0 +1,174 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Default size, in bytes, of the logs kept per stream, see MaxLogBytes.
+const MAX_LOG_BYTES int64 = 16 << 20
+
+/*
+Returns the log files of a stream, relative to the stream's directory so that
+they can be passed to /streams/download, eg. logs/1404502030/core.log.gz. Logs
+are kept in a directory per session, named after the session's start time, in
+increasing order.
+*/
+func (app *Application) listLogs(streamId string) ([]string, error) {
+	logsDir := filepath.Join(app.StreamDir(streamId), "logs")
+	sessions, err := logSessions(logsDir)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for _, session := range sessions {
+		files, err := ioutil.ReadDir(filepath.Join(logsDir, session))
+		if err != nil {
+			return nil, err
+		}
+		for _, fileInfo := range files {
+			res = append(res, filepath.Join("logs", session, fileInfo.Name()))
+		}
+	}
+	return res, nil
+}
+
+// Returns the session directories of a logs directory, oldest first.
+func logSessions(logsDir string) ([]string, error) {
+	dirs, err := ioutil.ReadDir(logsDir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	starts := make([]int, 0, len(dirs))
+	for _, dir := range dirs {
+		if start, err := strconv.Atoi(dir.Name()); err == nil && dir.IsDir() {
+			starts = append(starts, start)
+		}
+	}
+	sort.Ints(starts)
+	sessions := make([]string, len(starts))
+	for i, start := range starts {
+		sessions[i] = strconv.Itoa(start)
+	}
+	return sessions, nil
+}
+
+/*
+Make room for size bytes of logs of the current session by deleting the logs of
+the oldest sessions of the stream. Returns ErrTooLarge if the logs of the
+current session would still exceed limit. The stream must be locked for
+writing.
+*/
+func (app *Application) trimLogs(s *Stream, current string, size, limit int64) error {
+	logsDir := filepath.Join(app.StreamDir(s.StreamId), "logs")
+	sessions, err := logSessions(logsDir)
+	if err != nil {
+		return err
+	}
+	total := dirSize(logsDir) + size
+	for _, session := range sessions {
+		if total <= limit || session == current {
+			break
+		}
+		sessionDir := filepath.Join(logsDir, session)
+		removed := dirSize(sessionDir)
+		streamData(s).filesChanged()
+		if err := os.RemoveAll(sessionDir); err != nil {
+			return err
+		}
+		app.usage.Add(s.TargetId, s.StreamId, -removed)
+		total -= removed
+	}
+	if total > limit {
+		return ErrTooLarge.With("Logs of the session exceed MaxLogBytes")
+	}
+	return nil
+}
+
+/*
+..  http:put:: /core/logs
+    Upload log files of the core, eg. before stopping with an error, so
+    that the stream's manager can see what went wrong. Files are decoded
+    as in ``/core/frame`` and stored gzipped, under
+    ``logs/:start_time/:filename.gz`` where ``start_time`` is the time
+    the stream was activated. Files uploaded twice in a session are
+    appended to one another.
+    :reqheader Content-MD5: MD5 Sum of the body
+    :reqheader Authorization: core Authorization token
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "files" : {
+                "core.log.gz.b64": "file.gz.b64"
+            }
+        }
+    .. note:: At most ``MaxLogBytes`` (16MB by default) of logs are kept per
+        stream. The logs of the oldest sessions are deleted to make room
+        for newer ones.
+    .. note:: Logs are listed by ``/streams/sync`` and can be downloaded
+        with ``/streams/download``.
+    :status 200: OK
+    :status 400: Bad request
+    :status 401: Invalid core token
+    :status 413: The logs of the session exceed ``MaxLogBytes``
+*/
+func (app *Application) CoreLogsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		token := r.Header.Get("Authorization")
+		limit := uploadLimit(app.Settings().MaxLogBytes, MAX_LOG_BYTES)
+		md5String := r.Header.Get("Content-MD5")
+		// base64 inflates the files by a third
+		body, err := app.spoolBody(w, r, 2*limit, md5String)
+		if err != nil {
+			return err
+		}
+		defer releaseBody(body)
+		msg := LogRequest{}
+		if err := json.NewDecoder(body).Decode(&msg); err != nil {
+			return errors.New("Could not decode JSON")
+		}
+		files, err := decodeFrameFiles(msg.Files, true, limit)
+		if err != nil {
+			return errors.New("Unable to decode logs: " + err.Error())
+		}
+		var size int64
+		for filename, data := range files {
+			if filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+				return errors.New("Bad filename: " + filename)
+			}
+			size += int64(len(data))
+		}
+		return app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
+			session := strconv.Itoa(stream.ActiveStream.StartTime)
+			if err := app.trimLogs(stream, session, size, limit); err != nil {
+				return err
+			}
+			sessionDir := filepath.Join(app.StreamDir(stream.StreamId), "logs", session)
+			if err := os.MkdirAll(sessionDir, 0776); err != nil {
+				return err
+			}
+			for filename, data := range files {
+				file, err := os.OpenFile(filepath.Join(sessionDir, filename), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0776)
+				if err != nil {
+					return err
+				}
+				_, err = file.Write(data)
+				file.Close()
+				if err != nil {
+					return err
+				}
+				app.usage.Add(stream.TargetId, stream.StreamId, int64(len(data)))
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package scv
+
+import (
+	"../manager"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoreLogsHandler(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "logs")
+	defer os.RemoveAll(dir)
+	app := &Application{
+		Config:  Configuration{Name: filepath.Join(dir, "scv"), MaxLogBytes: 1024},
+		usage:   NewDiskUsage(),
+		Manager: manager.NewManager(intf),
+	}
+	app.Manager.AddStream(newStream("stream", "target", "owner", 0, 0, 0), "target", true)
+	token, _, err := app.Manager.ActivateStream("target", "joe", "openmm", mockFunc)
+	assert.Nil(t, err)
+	put := func(files map[string]string) int {
+		body, _ := json.Marshal(LogRequest{files})
+		h := md5.Sum(body)
+		req, _ := http.NewRequest("PUT", "/core/logs", bytes.NewReader(body))
+		req.Header.Set("Authorization", token)
+		req.Header.Set("Content-MD5", hex.EncodeToString(h[:]))
+		w := httptest.NewRecorder()
+		app.CoreLogsHandler().ServeHTTP(w, req)
+		return w.Code
+	}
+	// an older session, deleted to make room
+	old := filepath.Join(app.StreamDir("stream"), "logs", "1000")
+	os.MkdirAll(old, 0776)
+	ioutil.WriteFile(filepath.Join(old, "core.log.gz"), make([]byte, 1000), 0666)
+
+	assert.Equal(t, put(map[string]string{"core.log": "starting\n"}), 200)
+	assert.Equal(t, put(map[string]string{"core.log": "NaN detected\n"}), 200)
+	logs, err := app.listLogs("stream")
+	assert.Nil(t, err)
+	var session string
+	app.Manager.ModifyActiveStream(token, func(s *Stream) error {
+		session = strconv.Itoa(s.ActiveStream.StartTime)
+		return nil
+	})
+	assert.Equal(t, logs, []string{filepath.Join("logs", session, "core.log.gz")})
+	data, _ := ioutil.ReadFile(filepath.Join(app.StreamDir("stream"), logs[0]))
+	contents, err := gunzipBytes(data)
+	assert.Nil(t, err)
+	assert.Equal(t, string(contents), "starting\nNaN detected\n")
+
+	assert.Equal(t, put(map[string]string{"../escape.log": "x"}), 400)
+	random := make([]byte, 2000)
+	for i := range random {
+		random[i] = byte(i*7919 + i/3)
+	}
+	assert.Equal(t, put(map[string]string{"dump.bin": string(random)}), 413)
+}
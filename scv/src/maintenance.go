@@ -0,0 +1,268 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States of the SCV with respect to its maintenance windows.
+const (
+	MAINTENANCE_ACTIVE   string = "maintenance" // a window is under way
+	MAINTENANCE_DRAINING string = "draining"    // a window starts soon
+)
+
+var errMaintenance = ErrUnavailable.With("SCV is under maintenance")
+
+/*
+A period during which the SCV refuses activations, eg. to patch its host. A
+window either recurs, starting at the times given by Cron, or happens once,
+starting at Start. Drain seconds before a window starts, streams are no longer
+activated either, so that the active streams can finish their sessions before
+the window instead of being cut off by it.
+*/
+type MaintenanceWindow struct {
+	Cron     string `json:"Cron"`     // eg. "0 3 * * 0" for Sundays at 3:00 local time
+	Start    string `json:"Start"`    // RFC 3339, eg. "2014-07-04T03:00:00-07:00"
+	Duration int    `json:"Duration"` // seconds
+	Drain    int    `json:"Drain"`    // seconds before the window, 0 to keep activating until it starts
+	Reason   string `json:"Reason"`
+}
+
+/*
+A cron schedule: minute, hour, day of month, month and day of week. Fields are
+*, a number, a range a-b, a list of those separated by commas, and any of them
+followed by /step. Sunday is 0 or 7. As in cron, if both the day of month and
+the day of week are restricted, a day matching either one matches.
+*/
+type cronSchedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	anyDom, anyDow                bool
+}
+
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("cron schedule must have 5 fields: " + spec)
+	}
+	sets := make([]map[int]bool, 5)
+	for i, field := range fields {
+		set, err := parseCronField(field, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, errors.New("bad cron field " + field + ": " + err.Error())
+		}
+		sets[i] = set
+	}
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return &cronSchedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		anyDom: strings.HasPrefix(fields[2], "*"),
+		anyDow: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, errors.New("bad step")
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, errors.New("out of range")
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Returns the first time matching the schedule strictly after t, in t's
+// location, or false if there is none within 5 years, eg. for February 30.
+func (c *cronSchedule) next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month[int(t.Month())] == false:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case c.matchesDay(t) == false:
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour[t.Hour()] == false:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute[t.Minute()] == false:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Returns the first start of the window strictly after t, or false if it has
+// none.
+func (w *MaintenanceWindow) nextStart(t time.Time) (time.Time, bool) {
+	if w.Cron != "" {
+		schedule, err := parseCron(w.Cron)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return schedule.next(t)
+	}
+	start, err := time.Parse(time.RFC3339, w.Start)
+	if err != nil || start.After(t) == false {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+/*
+Returns the next occurrence of the window that has not ended at now: its start,
+which is before now if the window is under way, and its end. Returns false if
+the window will not happen again.
+*/
+func (w *MaintenanceWindow) occurrence(now time.Time) (start, end time.Time, ok bool) {
+	duration := time.Duration(w.Duration) * time.Second
+	start, ok = w.nextStart(now.Add(-duration))
+	return start, start.Add(duration), ok
+}
+
+func validateMaintenance(windows []MaintenanceWindow) error {
+	for _, w := range windows {
+		if (w.Cron == "") == (w.Start == "") {
+			return errors.New("Maintenance windows need exactly one of Cron and Start")
+		}
+		if w.Duration <= 0 || w.Drain < 0 {
+			return errors.New("Maintenance windows need a positive Duration and a non-negative Drain")
+		}
+		if w.Cron != "" {
+			if _, err := parseCron(w.Cron); err != nil {
+				return err
+			}
+		} else if _, err := time.Parse(time.RFC3339, w.Start); err != nil {
+			return errors.New("Bad maintenance Start: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Returns MAINTENANCE_ACTIVE if a maintenance window is under way at now,
+// MAINTENANCE_DRAINING if one starts within its Drain seconds, and "" otherwise.
+func maintenanceState(windows []MaintenanceWindow, now time.Time) string {
+	state := ""
+	for _, w := range windows {
+		start, _, ok := w.occurrence(now)
+		if ok == false {
+			continue
+		}
+		if start.After(now) == false {
+			return MAINTENANCE_ACTIVE
+		} else if start.Sub(now) <= time.Duration(w.Drain)*time.Second {
+			state = MAINTENANCE_DRAINING
+		}
+	}
+	return state
+}
+
+// Returns errMaintenance if activations are refused by a maintenance window.
+func (app *Application) checkMaintenance() error {
+	if maintenanceState(app.Settings().Maintenance, time.Now()) != "" {
+		return errMaintenance
+	}
+	return nil
+}
+
+/*
+.. http:get:: /admin/maintenance
+    The maintenance windows of the SCV, set by ``Maintenance`` in its
+    configuration file. Activations are refused while a window is under
+    way, and ``Drain`` seconds before it starts.
+    .. note:: This request can only be made by CCs.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "state": "draining", // "", draining or maintenance
+            "windows": [
+                {
+                    "cron": "0 3 * * 0", // or "start"
+                    "duration": 7200,
+                    "drain": 3600,
+                    "reason": "OS updates",
+                    "next_start": 1404640800, // 0 if it will not happen again
+                    "next_end": 1404648000
+                }
+            ]
+        }
+    :status 200: OK
+    :status 401: Not authenticated as a CC
+*/
+func (app *Application) MaintenanceHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if app.isCC(r) == false {
+			return ErrUnauthorized
+		}
+		windows := app.Settings().Maintenance
+		now := time.Now()
+		reply := MaintenanceReply{
+			State:   maintenanceState(windows, now),
+			Windows: make([]MaintenanceInfo, 0, len(windows)),
+		}
+		for _, window := range windows {
+			info := MaintenanceInfo{
+				Cron:     window.Cron,
+				Start:    window.Start,
+				Duration: window.Duration,
+				Drain:    window.Drain,
+				Reason:   window.Reason,
+			}
+			if start, end, ok := window.occurrence(now); ok {
+				info.NextStart, info.NextEnd = int(start.Unix()), int(end.Unix())
+			}
+			reply.Windows = append(reply.Windows, info)
+		}
+		data, err := json.Marshal(reply)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,87 @@
+package scv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, spec := range []string{"0 3 * * 0", "*/15 1-5 1,15 * 7", "30 2 * 1-12/3 1"} {
+		_, err := parseCron(spec)
+		assert.Nil(t, err, spec)
+	}
+	for _, spec := range []string{"", "0 3 * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := parseCron(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		result, _ := time.Parse("2006-01-02 15:04", s)
+		return result
+	}
+	// a Wednesday
+	now := at("2014-07-02 10:30")
+	cases := map[string]string{
+		"0 3 * * 0":     "2014-07-06 03:00",
+		"0 3 * * 7":     "2014-07-06 03:00",
+		"*/20 * * * *":  "2014-07-02 10:40",
+		"30 10 * * *":   "2014-07-03 10:30",
+		"0 0 1 * *":     "2014-08-01 00:00",
+		"0 0 1 1 *":     "2015-01-01 00:00",
+		"0 12 15 * 5":   "2014-07-04 12:00", // the 15th or a Friday
+		"0 0 29 2 *":    "2016-02-29 00:00",
+		"15 8-9 2 7 3":  "2014-07-09 08:15",
+		"45 10 2 7 *":   "2014-07-02 10:45",
+		"0-59 * * * *":  "2014-07-02 10:31",
+		"0 0 * 12 1-5":  "2014-12-01 00:00",
+		"59 23 31 12 *": "2014-12-31 23:59",
+	}
+	for spec, want := range cases {
+		schedule, err := parseCron(spec)
+		assert.Nil(t, err, spec)
+		next, ok := schedule.next(now)
+		assert.True(t, ok, spec)
+		assert.Equal(t, next, at(want), spec)
+	}
+	schedule, _ := parseCron("0 0 30 2 *")
+	_, ok := schedule.next(now)
+	assert.False(t, ok)
+}
+
+func TestMaintenanceState(t *testing.T) {
+	now := time.Date(2014, 7, 6, 3, 30, 0, 0, time.UTC)
+	weekly := MaintenanceWindow{Cron: "0 3 * * 0", Duration: 3600, Drain: 1800}
+	once := MaintenanceWindow{Start: "2014-07-06T05:00:00Z", Duration: 600, Drain: 3600}
+	assert.Equal(t, maintenanceState(nil, now), "")
+	assert.Equal(t, maintenanceState([]MaintenanceWindow{weekly}, now), MAINTENANCE_ACTIVE)
+	assert.Equal(t, maintenanceState([]MaintenanceWindow{weekly}, now.Add(30*time.Minute)), "")
+	assert.Equal(t, maintenanceState([]MaintenanceWindow{weekly}, now.Add(-50*time.Minute)), MAINTENANCE_DRAINING)
+	assert.Equal(t, maintenanceState([]MaintenanceWindow{weekly}, now.Add(-70*time.Minute)), "")
+	assert.Equal(t, maintenanceState([]MaintenanceWindow{once}, now), "")
+	assert.Equal(t, maintenanceState([]MaintenanceWindow{once, weekly}, now.Add(time.Hour)), MAINTENANCE_DRAINING)
+	assert.Equal(t, maintenanceState([]MaintenanceWindow{once}, now.Add(95*time.Minute)), MAINTENANCE_ACTIVE)
+	assert.Equal(t, maintenanceState([]MaintenanceWindow{once}, now.Add(2*time.Hour)), "")
+
+	start, end, ok := weekly.occurrence(now)
+	assert.True(t, ok)
+	assert.Equal(t, start, time.Date(2014, 7, 6, 3, 0, 0, 0, time.UTC))
+	assert.Equal(t, end, time.Date(2014, 7, 6, 4, 0, 0, 0, time.UTC))
+	_, _, ok = once.occurrence(now.Add(2 * time.Hour))
+	assert.False(t, ok)
+
+	assert.Nil(t, validateMaintenance([]MaintenanceWindow{weekly, once}))
+	for _, w := range []MaintenanceWindow{
+		{Duration: 60},
+		{Cron: "0 3 * * 0", Start: "2014-07-06T05:00:00Z", Duration: 60},
+		{Cron: "0 3 * * 0"},
+		{Cron: "0 3 * * 0", Duration: 60, Drain: -1},
+		{Cron: "0 3 * *", Duration: 60},
+		{Start: "tomorrow", Duration: 60},
+	} {
+		assert.NotNil(t, validateMaintenance([]MaintenanceWindow{w}))
+	}
+}
@@ -0,0 +1,257 @@
+package scv
+
+import (
+	"../manager"
+)
+
+// Bodies of the requests and replies of the core protocol and of the calls
+// made by the CC. The handlers decode into and encode these types, and the
+// OpenAPI document served at /api/schema is generated from them, so the two
+// cannot drift apart.
+
+// Body of POST /streams/activate.
+type ActivateRequest struct {
+	TargetId      string `json:"target_id,omitempty"` // a public target is picked if empty
+	Engine        string `json:"engine"`
+	EngineVersion string `json:"engine_version,omitempty"` // checked against min_engine_version
+	User          string `json:"user,omitempty"`
+	Wait          int    `json:"wait,omitempty"` // seconds to wait for an idle stream
+}
+
+// Reply of POST /streams/activate, which the CC passes on to the core.
+type ActivateReply struct {
+	Token             string `json:"token"`
+	URL               string `json:"url"`                // /core/start of this SCV
+	Expires           int    `json:"expires"`            // unix time the session expires unless the core sends a heartbeat
+	HeartbeatInterval int    `json:"heartbeat_interval"` // seconds between heartbeats suggested to the core
+	Backoff           int    `json:"backoff"`            // seconds before retrying a failed heartbeat, doubled after each failure up to HeartbeatInterval
+}
+
+// Body of POST /assign.
+type AssignRequest struct {
+	DonorToken    string `json:"donor_token,omitempty"`
+	TargetId      string `json:"target_id,omitempty"`
+	EngineVersion string `json:"engine_version,omitempty"` // checked against min_engine_version
+}
+
+// Reply of POST /assign.
+type AssignReply struct {
+	Token string `json:"token"`
+	URL   string `json:"url"` // /core/start of this SCV
+}
+
+// Reply of GET /core/start.
+type CoreStartReply struct {
+	StreamId string                 `json:"stream_id"`
+	TargetId string                 `json:"target_id"`
+	Files    map[string]string      `json:"files"`   // checkpoint files, and seed files not overridden by them
+	Options  map[string]interface{} `json:"options"` // eg. steps_per_frame
+}
+
+// Body of PUT /core/frame.
+type FrameRequest struct {
+	Files  map[string]string `json:"files"`            // .b64 and .gz.b64 files are decoded
+	Frames int               `json:"frames,omitempty"` // frames in the files, 1 if omitted
+	Meta   *FrameMetadata    `json:"meta,omitempty"`   // recorded in the frames.jsonl sidecar
+}
+
+// Optional metadata of a frame, for performance analysis across donors.
+type FrameMetadata struct {
+	SimulationTime float64 `json:"simulation_time,omitempty"` // picoseconds simulated by the end of the frame
+	WallClock      float64 `json:"wall_clock,omitempty"`      // seconds the core took to compute the frame
+	GPU            string  `json:"gpu,omitempty"`
+	CoreVersion    string  `json:"core_version,omitempty"`
+}
+
+// A line of the frames.jsonl sidecar of a partition.
+type FrameRecord struct {
+	Frame    int `json:"frame"`    // frame count of the stream including the frame
+	Received int `json:"received"` // unix time the frame was posted
+	FrameMetadata
+}
+
+// Reply of GET /streams/frames/:stream_id.
+type FramesReply struct {
+	Frames []FrameRecord `json:"frames"`
+}
+
+// Body of PUT /core/checkpoint.
+type CheckpointRequest struct {
+	Files  map[string]string `json:"files"`
+	Frames *float64          `json:"frames,omitempty"` // frames credited to the donor, the buffered frames if omitted
+	Energy *float64          `json:"energy,omitempty"` // potential energy of the checkpoint in kJ/mol, compared by verifications
+}
+
+// Body of PUT /core/logs.
+type LogRequest struct {
+	Files map[string]string `json:"files"` // decoded as in FrameRequest
+}
+
+// Body of PUT /core/stop.
+type CoreStopRequest struct {
+	Error string `json:"error,omitempty"` // b64 encoded
+	Kind  string `json:"kind,omitempty"`  // ERROR_CORE, ERROR_SIMULATION or ERROR_ABORTED, classified from Error if omitted
+}
+
+// Body of POST /core/pause.
+type CorePauseRequest struct {
+	Duration int `json:"duration,omitempty"` // seconds, MAX_PAUSE_TIME if omitted
+}
+
+// Reply of POST /core/pause.
+type CorePauseReply struct {
+	PausedUntil int `json:"paused_until"`
+	Expires     int `json:"expires"` // unless the core resumes or sends a heartbeat by then
+}
+
+// An active stream in the reply of GET /active_streams, see
+// Manager.GetActiveStreams.
+type ActiveStreamInfo = manager.ActiveStreamInfo
+
+// Reply of GET /active_streams?since=version, keyed by target then stream.
+type ActiveStreamsDelta = manager.ActiveStreamsDelta
+
+// Body of POST /streams.
+type PostStreamRequest struct {
+	TargetId string            `json:"target_id"`
+	Files    map[string]string `json:"files"`
+	Tags     map[string]string `json:"tags,omitempty"`
+
+	// Options of the target overridden for this stream, see /streams/options.
+	Options map[string]interface{} `json:"options,omitempty"`
+
+	ParentStreamId string `json:"parent_stream_id,omitempty"`
+	ForkFrame      int    `json:"fork_frame,omitempty"`
+}
+
+// Reply of POST /streams and POST /streams/import.
+type PostStreamReply struct {
+	StreamId string `json:"stream_id"`
+}
+
+// Body of POST /streams/bulk_update. Empty filters match every stream.
+type BulkUpdateRequest struct {
+	Filter struct {
+		TargetId string `json:"target_id,omitempty"`
+		Tag      string `json:"tag,omitempty"`    // name of a tag the streams have
+		Status   string `json:"status,omitempty"` // enabled, disabled or quarantined
+	} `json:"filter"`
+	Patch struct {
+		Priority *float64               `json:"priority,omitempty"`
+		Status   string                 `json:"status,omitempty"` // enabled or disabled
+		Meta     map[string]interface{} `json:"meta,omitempty"`
+	} `json:"patch"`
+}
+
+// Reply of POST /streams/bulk_update.
+type BulkUpdateReply struct {
+	StreamIds []string `json:"stream_ids"`
+}
+
+// Reply of GET /targets/{target_id}/streams. Inactive streams are listed in the
+// order they are activated.
+type TargetStreamsReply struct {
+	Active   []string `json:"active"`
+	Inactive []string `json:"inactive"`
+	Disabled []string `json:"disabled"`
+	Paused   bool     `json:"paused"`
+}
+
+// Reply of PUT /targets/:target_id/pause and /resume.
+type TargetPauseReply struct {
+	Paused        bool `json:"paused"`
+	ActiveStreams int  `json:"active_streams"` // active streams of the target on this SCV
+}
+
+// Reply of POST and DELETE /admin/drain.
+type DrainReply struct {
+	Draining      bool `json:"draining"`
+	ActiveStreams int  `json:"active_streams"`
+}
+
+// Reply of GET /admin/maintenance.
+type MaintenanceReply struct {
+	State   string            `json:"state"` // MAINTENANCE_ACTIVE, MAINTENANCE_DRAINING or ""
+	Windows []MaintenanceInfo `json:"windows"`
+}
+
+// A maintenance window and its next occurrence, in unix time.
+type MaintenanceInfo struct {
+	Cron      string `json:"cron,omitempty"`
+	Start     string `json:"start,omitempty"`
+	Duration  int    `json:"duration"`
+	Drain     int    `json:"drain"`
+	Reason    string `json:"reason"`
+	NextStart int    `json:"next_start"`
+	NextEnd   int    `json:"next_end"`
+}
+
+// Reply of GET /streams/sync. Frame and checkpoint files are those of the first
+// partition, and are omitted if the stream has no partitions.
+type SyncReply struct {
+	Partitions      []int               `json:"partitions"`
+	SeedFiles       []string            `json:"seed_files"`
+	FrameFiles      []string            `json:"frame_files,omitempty"`
+	CheckpointFiles []string            `json:"checkpoint_files,omitempty"`
+	Archives        []Archive           `json:"archives"`
+	LogFiles        []string            `json:"log_files,omitempty"` // uploaded by /core/logs
+	RecoveredFiles  []string            `json:"recovered_files"`     // buffered by the previous core, see recoverBuffer
+	Manifest        []PartitionManifest `json:"manifest,omitempty"`  // if requested with manifest=true
+	TargetPaused    bool                `json:"target_paused"`
+}
+
+// Reply of GET /donors/{user}/sessions.
+type DonorSessionsReply struct {
+	Sessions []Session `json:"sessions"`
+	Next     string    `json:"next,omitempty"` // after parameter of the next page, if any, see SessionCursor
+}
+
+// Body of every error reply, see writeError.
+type ErrorReply struct {
+	Code      string            `json:"code"`
+	Message   string            `json:"message"`
+	RequestId string            `json:"request_id"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// Body of POST /verifications/activate.
+type VerificationActivateRequest struct {
+	User   string `json:"user"` // one of the Verifiers of the configuration
+	Engine string `json:"engine"`
+}
+
+// Reply of POST /verifications/activate, which the CC passes on to the core.
+type VerificationActivateReply struct {
+	Id      string `json:"id"`
+	Token   string `json:"token"`
+	URL     string `json:"url"`     // /core/verification/start of this SCV
+	Expires int    `json:"expires"` // unix time the result must be posted by
+}
+
+// Reply of GET /core/verification/start.
+type VerificationStartReply struct {
+	Id       string                 `json:"id"`
+	StreamId string                 `json:"stream_id"`
+	TargetId string                 `json:"target_id"`
+	Files    map[string]string      `json:"files"`   // as in CoreStartReply
+	Options  map[string]interface{} `json:"options"` // of the stream when the checkpoint was sampled
+	Frames   int                    `json:"frames"`  // to simulate
+	Steps    int                    `json:"steps"`   // to simulate, 0 if the target has no steps_per_frame
+}
+
+// Body of PUT /core/verification/result.
+type VerificationResultRequest struct {
+	Hashes map[string]string `json:"hashes,omitempty"` // SHA-256 hexdigests of the checkpoint files, by name
+	Energy *float64          `json:"energy,omitempty"` // potential energy in kJ/mol
+}
+
+// Reply of PUT /core/verification/result.
+type VerificationResultReply struct {
+	Status string `json:"status"` // VERIFY_PASSED or VERIFY_FAILED
+}
+
+// Reply of GET /admin/verifications.
+type VerificationsReply struct {
+	Verifications []Verification       `json:"verifications"`
+	Flagged       []DonorVerifications `json:"flagged"`
+}
@@ -0,0 +1,180 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Maximum size of the JSON encoded metadata of a stream.
+const MAX_META_BYTES int = 16384
+
+func validTagName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+func validMetaKey(key string) bool {
+	return key != "" && strings.HasPrefix(key, "$") == false && strings.Contains(key, ".") == false
+}
+
+// Returns a copy of meta updated by patch, whose keys set to nil are removed.
+func mergeMeta(meta, patch map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for key, value := range meta {
+		result[key] = value
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(result, key)
+		} else {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+/*
+.. http:put:: /streams/tags/:stream_id
+    Add, replace or delete the tags of a stream. Tags that are not
+    mentioned are left untouched.
+    :reqheader Authorization: Manager's authorization token
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "pdb.gz.b64": "file4.b64", // added or replaced
+            "notes.txt": null // deleted
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) StreamTagsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		tags := make(map[string]*string)
+		if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+			return errors.New("Could not decode JSON")
+		}
+		for name := range tags {
+			if validTagName(name) == false {
+				return errors.New("Bad tag name: " + name)
+			}
+		}
+		return app.Manager.ModifyStream(streamId, func(stream *Stream) error {
+			if app.canManage(user, stream) == false {
+				return ErrForbidden.With("You do not own this stream.")
+			}
+			if err := app.checkQuota(stream); err != nil {
+				return err
+			}
+			dir := filepath.Join(app.StreamDir(streamId), "tags")
+			os.MkdirAll(dir, 0776)
+			streamData(stream).filesChanged()
+			for name, content := range tags {
+				path := filepath.Join(dir, name)
+				var size int64
+				if info, err := os.Stat(path); err == nil {
+					size = info.Size()
+				}
+				if content == nil {
+					if err := os.Remove(path); err != nil && os.IsNotExist(err) == false {
+						return err
+					}
+					app.usage.Add(stream.TargetId, streamId, -size)
+					continue
+				}
+				if err := writeFileAtomic(path, []byte(*content), 0776); err != nil {
+					return err
+				}
+				app.usage.Add(stream.TargetId, streamId, int64(len(*content))-size)
+			}
+			return nil
+		})
+	}
+}
+
+/*
+.. http:patch:: /streams/meta/:stream_id
+    Update the metadata of a stream, arbitrary key-value pairs returned
+    in ``meta`` by ``/streams/info``. Keys set to null are removed, and
+    keys that are not mentioned are left untouched. Keys may not contain
+    dots or start with ``$``.
+    :reqheader Authorization: Manager's authorization token
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "temperature": 300,
+            "round": null // removed
+        }
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "temperature": 300,
+            "forcefield": "amber99sb"
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) StreamMetaHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		patch := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			return errors.New("Could not decode JSON")
+		}
+		set := bson.M{}
+		unset := bson.M{}
+		for key, value := range patch {
+			if validMetaKey(key) == false {
+				return errors.New("Bad metadata key: " + key)
+			}
+			if value == nil {
+				unset["meta."+key] = ""
+			} else {
+				set["meta."+key] = value
+			}
+		}
+		var data []byte
+		e := app.Manager.ModifyStream(streamId, func(stream *Stream) error {
+			if app.canManage(user, stream) == false {
+				return ErrForbidden.With("You do not own this stream.")
+			}
+			if err := app.loadStreamFields(stream); err != nil {
+				return err
+			}
+			meta := mergeMeta(stream.Meta, patch)
+			var err error
+			if data, err = json.Marshal(meta); err != nil {
+				return err
+			}
+			if len(data) > MAX_META_BYTES {
+				return ErrTooLarge.With("Metadata may not exceed 16384 bytes")
+			}
+			if len(set) > 0 || len(unset) > 0 {
+				if err := app.Database.UpdateStream(streamId, set, unset); err != nil {
+					return err
+				}
+			}
+			stream.Meta = meta
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+		w.Write(data)
+		return nil
+	}
+}
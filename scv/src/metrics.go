@@ -0,0 +1,83 @@
+package scv
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Collect the counters exposed by the various subsystems of the SCV.
+func (app *Application) Metrics() map[string]interface{} {
+	rateLimits := make(map[string]interface{})
+	for class, limiter := range app.rateLimiters {
+		rateLimits[class] = limiter.Metrics()
+	}
+	return map[string]interface{}{
+		"token_cache": app.tokenCache.Metrics(),
+		"rate_limits": rateLimits,
+		"ingest":      app.ingest.Metrics(),
+		"events":      app.events.Metrics(),
+		"scrubber":    app.scrubber.Metrics(),
+		"stats":       app.stats.Metrics(),
+		"database":    app.Database.Metrics(),
+		"disk":        map[string]interface{}{"free": app.dataFree(), "read_only": app.ReadOnly()},
+		"requests":    app.requestMetrics.Metrics(),
+		"connections": app.server.Connections(),
+	}
+}
+
+/*
+.. http:get:: /metrics
+    Internal counters of the SCV, grouped by subsystem.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "token_cache": {
+                "hits": 1023,
+                "misses": 12,
+                "size": 8,
+                "hit_rate": 0.988
+            },
+            "rate_limits": {
+                "core": {"rate": 10, "burst": 20, "buckets": 5, "rejected": 3},
+                "manager": {"rate": 0, "burst": 0, "buckets": 0, "rejected": 0},
+                "anonymous": {"rate": 0, "burst": 0, "buckets": 0, "rejected": 0}
+            },
+            "ingest": { // bytes of frames
+                "stream": {"rate": 1048576, "burst": 4194304, "buckets": 40, "rejected": 12},
+                "global": {"rate": 0, "burst": 0, "buckets": 0, "rejected": 0}
+            },
+            "events": {"subscribers": 2, "published": 4012, "dropped": 0},
+            "scrubber": {
+                "passes": 3,
+                "streams": 1200,
+                "corrupted": 1,
+                "last_pass": 1404502030
+            },
+            "stats": { // writes deferred to the stats writer
+                "queued": 3,
+                "retrying": 0,
+                "written": 5120,
+                "retried": 2,
+                "dead_letters": 0,
+                "dropped": 0
+            },
+            "database": {"backend": "mongo", "sessions": 8, "refreshes": 0},
+            "disk": {"free": 53687091200, "read_only": false},
+            "requests": { // slower than SlowRequestTime, or timed out
+                "slow": {"/streams/sync/{stream_id}": 4},
+                "timed_out": {"/core/heartbeat": 1}
+            },
+            "connections": {"new": 0, "active": 12, "idle": 30}
+        }
+    :status 200: OK
+*/
+func (app *Application) MetricsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		data, e := json.Marshal(app.Metrics())
+		if e != nil {
+			return e
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,818 @@
+package scv
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Number of sessions handlers share, see MongoPool.
+const MONGO_POOL_SIZE int = 8
+
+// Attempts made by withRetry after a transient error, and the delay before
+// the first one. The delay doubles after each attempt.
+const MONGO_RETRIES int = 3
+const MONGO_RETRY_DELAY time.Duration = 100 * time.Millisecond
+
+// Longest delay between two attempts of waitForMongo.
+const MONGO_MAX_WAIT time.Duration = 30 * time.Second
+
+/*
+MongoPool hands out copies of the master session in turn so that handlers are
+not serialized on a single socket. A session that saw a network error keeps
+failing until it is refreshed, so the pool is refreshed as a whole whenever a
+transient error is seen.
+*/
+type MongoPool struct {
+	sync.Mutex
+	sessions  []*mgo.Session
+	next      int
+	refreshes int64
+}
+
+func NewMongoPool(master *mgo.Session, size int) *MongoPool {
+	pool := &MongoPool{sessions: make([]*mgo.Session, size)}
+	for i := range pool.sessions {
+		pool.sessions[i] = master.Copy()
+	}
+	return pool
+}
+
+func (p *MongoPool) Session() *mgo.Session {
+	p.Lock()
+	defer p.Unlock()
+	session := p.sessions[p.next]
+	p.next = (p.next + 1) % len(p.sessions)
+	return session
+}
+
+func (p *MongoPool) Refresh() {
+	p.Lock()
+	defer p.Unlock()
+	for _, session := range p.sessions {
+		session.Refresh()
+	}
+	p.refreshes += 1
+}
+
+func (p *MongoPool) Close() {
+	p.Lock()
+	defer p.Unlock()
+	for _, session := range p.sessions {
+		session.Close()
+	}
+}
+
+func (p *MongoPool) Metrics() map[string]interface{} {
+	p.Lock()
+	defer p.Unlock()
+	return map[string]interface{}{
+		"sessions":  len(p.sessions),
+		"refreshes": p.refreshes,
+	}
+}
+
+// Returns true if err means that Mongo could not be reached, rather than that
+// it rejected the operation.
+func isTransient(err error) bool {
+	if err == nil || err == mgo.ErrNotFound {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	msg := err.Error()
+	for _, s := range []string{"no reachable servers", "Closed explicitly", "connection reset", "broken pipe", "i/o timeout"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run fn, retrying with exponential backoff as long as it fails with a
+// transient error, up to MONGO_RETRIES times.
+func withRetry(fn func() error) error {
+	delay := MONGO_RETRY_DELAY
+	for i := 0; ; i++ {
+		err := fn()
+		if i >= MONGO_RETRIES || isTransient(err) == false {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Run fn until it succeeds, for operations the SCV cannot start without.
+func waitForDatabase(what string, fn func() error) {
+	delay := MONGO_RETRY_DELAY
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		log.Printf("Unable to %s, retrying in %v: %v", what, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > MONGO_MAX_WAIT {
+			delay = MONGO_MAX_WAIT
+		}
+	}
+}
+
+// Dial Mongo, waiting for it to come up if it cannot be reached.
+func dialMongo(uri string) *mgo.Session {
+	delay := MONGO_RETRY_DELAY
+	for {
+		session, err := mgo.Dial(uri)
+		if err == nil {
+			return session
+		}
+		log.Printf("Unable to connect to MongoDB at %s, retrying in %v: %v", uri, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > MONGO_MAX_WAIT {
+			delay = MONGO_MAX_WAIT
+		}
+	}
+}
+
+/*
+MongoDatabase implements Database on top of a MongoPool. Streams are stored in
+the streams DB, in a collection named after the SCV. Sessions that see a
+transient error are refreshed so that the next operation reconnects.
+*/
+type MongoDatabase struct {
+	pool    *MongoPool
+	name    string          // name of the SCV
+	indexed map[string]bool // collections indexed by WriteDeferred
+}
+
+func NewMongoDatabase(master *mgo.Session, name string) *MongoDatabase {
+	return &MongoDatabase{
+		pool:    NewMongoPool(master, MONGO_POOL_SIZE),
+		name:    name,
+		indexed: make(map[string]bool),
+	}
+}
+
+// Returns a database on one of the pooled sessions.
+func (d *MongoDatabase) DB(name string) *mgo.Database {
+	return d.pool.Session().DB(name)
+}
+
+func (d *MongoDatabase) streams() *mgo.Collection {
+	return d.DB("streams").C(d.name)
+}
+
+func (d *MongoDatabase) tokens() *mgo.Collection {
+	return d.DB("users").C("tokens")
+}
+
+func (d *MongoDatabase) targets() *mgo.Collection {
+	return d.DB("data").C("targets")
+}
+
+func (d *MongoDatabase) bans() *mgo.Collection {
+	return d.DB("data").C("bans")
+}
+
+func (d *MongoDatabase) verifications() *mgo.Collection {
+	return d.DB("data").C("verifications")
+}
+
+func (d *MongoDatabase) webhooks() *mgo.Collection {
+	return d.DB("data").C("webhooks")
+}
+
+func (d *MongoDatabase) shards() *mgo.Collection {
+	return d.DB("servers").C("shards")
+}
+
+func (d *MongoDatabase) credit() *mgo.Collection {
+	return d.DB("credit").C("donors")
+}
+
+// Refresh the pool after a transient error and translate mgo's errors.
+func (d *MongoDatabase) check(err error) error {
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if isTransient(err) {
+		d.pool.Refresh()
+	}
+	return err
+}
+
+// Run fn with withRetry, refreshing the pool after each transient error so
+// that the next attempt gets a fresh session. Inserts are not retried: if
+// only the reply was lost, the second attempt would fail as a duplicate.
+func (d *MongoDatabase) retry(fn func() error) error {
+	return withRetry(func() error { return d.check(fn()) })
+}
+
+// Builds a Mongo update from the fields to set and unset.
+func mongoUpdate(set, unset map[string]interface{}) bson.M {
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update
+}
+
+func (d *MongoDatabase) UserByToken(token string) (string, error) {
+	result := make(map[string]interface{})
+	err := d.retry(func() error {
+		return d.DB("users").C("all").Find(bson.M{"token": token}).One(&result)
+	})
+	if err != nil {
+		return "", err
+	}
+	user, _ := result["_id"].(string)
+	return user, nil
+}
+
+func (d *MongoDatabase) Manager(user string) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	err := d.retry(func() error {
+		return d.DB("users").C("managers").FindId(user).One(&result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (d *MongoDatabase) Managers(users []string) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	err := d.retry(func() error {
+		return d.DB("users").C("managers").Find(bson.M{"_id": bson.M{"$in": users}}).All(&docs)
+	})
+	return docs, err
+}
+
+func (d *MongoDatabase) EngineByKey(key string) (string, error) {
+	result := make(map[string]interface{})
+	err := d.retry(func() error {
+		return d.DB("engines").C("keys").FindId(key).One(&result)
+	})
+	if err != nil {
+		return "", err
+	}
+	engine, _ := result["engine"].(string)
+	return engine, nil
+}
+
+func (d *MongoDatabase) InsertToken(token APIToken) error {
+	return d.check(d.tokens().Insert(token))
+}
+
+func (d *MongoDatabase) TokenBySecret(secret string) (APIToken, error) {
+	doc := APIToken{}
+	err := d.retry(func() error {
+		return d.tokens().Find(bson.M{"token": secret}).One(&doc)
+	})
+	return doc, err
+}
+
+func (d *MongoDatabase) Token(id string) (APIToken, error) {
+	doc := APIToken{}
+	err := d.retry(func() error {
+		return d.tokens().FindId(id).One(&doc)
+	})
+	return doc, err
+}
+
+func (d *MongoDatabase) UserTokens(user string) ([]APIToken, error) {
+	tokens := make([]APIToken, 0)
+	err := d.retry(func() error {
+		return d.tokens().Find(bson.M{"user": user}).All(&tokens)
+	})
+	return tokens, err
+}
+
+func (d *MongoDatabase) SetTokenSecret(id, secret string) error {
+	return d.retry(func() error {
+		return d.tokens().UpdateId(id, bson.M{"$set": bson.M{"token": secret}})
+	})
+}
+
+func (d *MongoDatabase) RemoveToken(id string) error {
+	return d.retry(func() error {
+		return d.tokens().RemoveId(id)
+	})
+}
+
+func (d *MongoDatabase) Target(id string) (map[string]interface{}, error) {
+	doc := make(map[string]interface{})
+	err := d.retry(func() error {
+		return d.targets().FindId(id).One(&doc)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (d *MongoDatabase) InsertTarget(doc map[string]interface{}) error {
+	return d.check(d.targets().Insert(doc))
+}
+
+func (d *MongoDatabase) UpdateTarget(id string, set, unset map[string]interface{}) error {
+	return d.retry(func() error {
+		return d.targets().UpdateId(id, mongoUpdate(set, unset))
+	})
+}
+
+func (d *MongoDatabase) PublicTargets(ids []string, engine string) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	err := d.retry(func() error {
+		return d.targets().Find(bson.M{
+			"_id":     bson.M{"$in": ids},
+			"engines": engine,
+			"stage":   "public",
+		}).All(&docs)
+	})
+	return docs, err
+}
+
+func (d *MongoDatabase) TargetSupports(id, engine string) (bool, error) {
+	var n int
+	err := d.retry(func() (err error) {
+		n, err = d.targets().Find(bson.M{"_id": id, "engines": engine}).Count()
+		return err
+	})
+	return n > 0, err
+}
+
+func (d *MongoDatabase) Ban(id string) (Ban, error) {
+	ban := Ban{}
+	err := d.retry(func() error {
+		return d.bans().FindId(id).One(&ban)
+	})
+	return ban, err
+}
+
+func (d *MongoDatabase) Bans() ([]Ban, error) {
+	bans := make([]Ban, 0)
+	err := d.retry(func() error {
+		return d.bans().Find(nil).All(&bans)
+	})
+	return bans, err
+}
+
+func (d *MongoDatabase) InsertBan(ban Ban) error {
+	return d.check(d.bans().Insert(ban))
+}
+
+func (d *MongoDatabase) RemoveBan(id string) error {
+	return d.retry(func() error {
+		return d.bans().RemoveId(id)
+	})
+}
+
+func (d *MongoDatabase) DonorVerifications(user string) (DonorVerifications, error) {
+	record := DonorVerifications{}
+	err := d.retry(func() error {
+		return d.verifications().FindId(user).One(&record)
+	})
+	return record, err
+}
+
+func (d *MongoDatabase) UpsertDonorVerifications(record *DonorVerifications) error {
+	return d.retry(func() error {
+		_, err := d.verifications().UpsertId(record.User, record)
+		return err
+	})
+}
+
+func (d *MongoDatabase) FlaggedDonors() ([]DonorVerifications, error) {
+	records := make([]DonorVerifications, 0)
+	err := d.retry(func() error {
+		return d.verifications().Find(bson.M{"flagged": true}).Sort("-failed").All(&records)
+	})
+	return records, err
+}
+
+func (d *MongoDatabase) Webhook(id string) (Webhook, error) {
+	hook := Webhook{}
+	err := d.retry(func() error {
+		return d.webhooks().FindId(id).One(&hook)
+	})
+	return hook, err
+}
+
+func (d *MongoDatabase) Webhooks(targetId string) ([]Webhook, error) {
+	hooks := make([]Webhook, 0)
+	err := d.retry(func() error {
+		return d.webhooks().Find(bson.M{"target_id": targetId}).All(&hooks)
+	})
+	return hooks, err
+}
+
+func (d *MongoDatabase) InsertWebhook(hook Webhook) error {
+	return d.check(d.webhooks().Insert(hook))
+}
+
+func (d *MongoDatabase) RemoveWebhook(id string) error {
+	return d.retry(func() error {
+		return d.webhooks().RemoveId(id)
+	})
+}
+
+func (d *MongoDatabase) Streams() ([]Stream, error) {
+	var streams []Stream
+	err := d.retry(func() error {
+		return d.streams().Find(bson.M{}).All(&streams)
+	})
+	return streams, err
+}
+
+func (d *MongoDatabase) StreamSummaries() ([]Stream, error) {
+	var streams []Stream
+	err := d.retry(func() error {
+		return d.streams().Find(bson.M{}).Select(bson.M{"meta": 0, "options": 0}).All(&streams)
+	})
+	return streams, err
+}
+
+func (d *MongoDatabase) DeletedStreams() ([]string, error) {
+	var tombstones []struct {
+		StreamId string `bson:"_id"`
+	}
+	err := d.retry(func() error {
+		return d.streams().Find(bson.M{"status": "deleted"}).Select(bson.M{"_id": 1}).All(&tombstones)
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(tombstones))
+	for _, t := range tombstones {
+		ids = append(ids, t.StreamId)
+	}
+	return ids, nil
+}
+
+func (d *MongoDatabase) FindStream(id string, result interface{}) error {
+	return d.retry(func() error {
+		return d.streams().FindId(id).One(result)
+	})
+}
+
+func (d *MongoDatabase) InsertStream(doc interface{}) error {
+	return d.check(d.streams().Insert(doc))
+}
+
+func (d *MongoDatabase) UpdateStream(id string, set, unset map[string]interface{}) error {
+	return d.retry(func() error {
+		return d.streams().UpdateId(id, mongoUpdate(set, unset))
+	})
+}
+
+func (d *MongoDatabase) UpdateStreams(ids []string, set, unset map[string]interface{}) error {
+	return d.retry(func() error {
+		_, err := d.streams().UpdateAll(bson.M{"_id": bson.M{"$in": ids}}, mongoUpdate(set, unset))
+		return err
+	})
+}
+
+func (d *MongoDatabase) RemoveStream(id string) error {
+	return d.retry(func() error {
+		return d.streams().RemoveId(id)
+	})
+}
+
+func (d *MongoDatabase) UpsertSCV(config Configuration) error {
+	return d.retry(func() error {
+		_, err := d.DB("servers").C("scvs").UpsertId(config.Name, config)
+		return err
+	})
+}
+
+func (d *MongoDatabase) UpdateSCV(name string, set map[string]interface{}) error {
+	return d.retry(func() error {
+		return d.DB("servers").C("scvs").UpdateId(name, bson.M{"$set": set})
+	})
+}
+
+func (d *MongoDatabase) Shards(targetId string) ([]Shard, error) {
+	shards := make([]Shard, 0)
+	err := d.retry(func() error {
+		return d.shards().Find(bson.M{"target_id": targetId}).All(&shards)
+	})
+	return shards, err
+}
+
+func (d *MongoDatabase) SCVShards(scv string) ([]Shard, error) {
+	shards := make([]Shard, 0)
+	err := d.retry(func() error {
+		return d.shards().Find(bson.M{"scv": scv}).All(&shards)
+	})
+	return shards, err
+}
+
+func (d *MongoDatabase) UpsertShard(shard Shard) error {
+	return d.retry(func() error {
+		_, err := d.shards().UpsertId(shard.Id, shard)
+		return err
+	})
+}
+
+func (d *MongoDatabase) RemoveShard(id string) error {
+	return d.retry(func() error {
+		return d.shards().RemoveId(id)
+	})
+}
+
+func (d *MongoDatabase) StatsTargets() ([]string, error) {
+	var names []string
+	err := d.retry(func() (err error) {
+		names, err = d.DB("stats").CollectionNames()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(name, "system.") == false {
+			res = append(res, name)
+		}
+	}
+	return res, nil
+}
+
+func (d *MongoDatabase) TargetStats(targetId string) (TargetStats, error) {
+	stats := TargetStats{}
+	totals := make([]TargetStats, 0)
+	err := d.retry(func() error {
+		return d.DB("stats").C(targetId).Pipe([]bson.M{
+			{"$group": bson.M{
+				"_id":        nil,
+				"frames":     bson.M{"$sum": "$frames"},
+				"partitions": bson.M{"$sum": bson.M{"$subtract": []string{"$end_frames", "$start_frames"}}},
+				"seconds":    bson.M{"$sum": bson.M{"$subtract": []string{"$end_time", "$start_time"}}},
+				"sessions":   bson.M{"$sum": 1},
+				"users":      bson.M{"$addToSet": "$user"},
+			}},
+		}).All(&totals)
+	})
+	if err != nil {
+		return stats, err
+	}
+	if len(totals) > 0 {
+		stats = totals[0]
+	}
+	stats.Daily = make([]DailyFrames, 0)
+	err = d.retry(func() error {
+		return d.DB("stats").C(targetId).Pipe([]bson.M{
+			{"$group": bson.M{
+				"_id":    bson.M{"$subtract": []interface{}{"$end_time", bson.M{"$mod": []interface{}{"$end_time", 86400}}}},
+				"frames": bson.M{"$sum": "$frames"},
+			}},
+			{"$sort": bson.M{"_id": 1}},
+		}).All(&stats.Daily)
+	})
+	return stats, err
+}
+
+func (d *MongoDatabase) DonorTotals(targetId string) ([]DonorTotal, error) {
+	var rows []DonorTotal
+	seconds := bson.M{"$subtract": []string{"$end_time", "$start_time"}}
+	err := d.retry(func() error {
+		return d.DB("stats").C(targetId).Pipe([]bson.M{
+			{"$group": bson.M{
+				"_id":      "$user",
+				"frames":   bson.M{"$sum": "$frames"},
+				"sessions": bson.M{"$sum": 1},
+				"gpu_seconds": bson.M{"$sum": bson.M{"$cond": []interface{}{
+					bson.M{"$eq": []string{"$device", DEVICE_CPU}}, 0, seconds}}},
+				"cpu_seconds": bson.M{"$sum": bson.M{"$cond": []interface{}{
+					bson.M{"$eq": []string{"$device", DEVICE_CPU}}, seconds, 0}}},
+			}},
+		}).All(&rows)
+	})
+	return rows, err
+}
+
+func (d *MongoDatabase) StreamSessions(targetId, streamId string) ([]Session, error) {
+	sessions := make([]Session, 0)
+	err := d.retry(func() error {
+		return d.DB("stats").C(targetId).Find(bson.M{"stream": streamId}).Sort("start_time").All(&sessions)
+	})
+	return sessions, err
+}
+
+func (d *MongoDatabase) DonorSessions(targetId, user string, after *SessionCursor, limit int) ([]Session, error) {
+	sessions := make([]Session, 0)
+	selector := bson.M{"user": user}
+	if after != nil {
+		// sessions of other targets ending at the same time come after the
+		// cursor if their target does, see SessionCursor
+		if targetId < after.TargetId {
+			selector["end_time"] = bson.M{"$lte": after.EndTime}
+		} else if targetId > after.TargetId {
+			selector["end_time"] = bson.M{"$lt": after.EndTime}
+		} else {
+			selector["$or"] = []bson.M{
+				{"end_time": bson.M{"$lt": after.EndTime}},
+				{"end_time": after.EndTime, "_id": bson.M{"$lt": after.Id}},
+			}
+		}
+	}
+	// served by the user,-end_time,-_id index, see STATS_INDEXES
+	err := d.retry(func() error {
+		return d.DB("stats").C(targetId).Find(selector).Sort("-end_time", "-_id").Limit(limit).All(&sessions)
+	})
+	return sessions, err
+}
+
+func (d *MongoDatabase) Benchmarks(engine string) ([]DonorBenchmark, error) {
+	rows := make([]DonorBenchmark, 0)
+	err := d.retry(func() error {
+		return d.DB("benchmarks").C(engine).Pipe([]bson.M{
+			{"$group": bson.M{
+				"_id":        "$user",
+				"ns_per_day": bson.M{"$avg": "$ns_per_day"},
+				"best":       bson.M{"$max": "$ns_per_day"},
+				"sessions":   bson.M{"$sum": 1},
+			}},
+		}).All(&rows)
+	})
+	return rows, err
+}
+
+func (d *MongoDatabase) StreamErrors(targetId, streamId string) ([]StreamError, error) {
+	streamErrors := make([]StreamError, 0)
+	err := d.retry(func() error {
+		return d.DB("errors").C(targetId).Find(bson.M{"stream": streamId}).Sort("time").All(&streamErrors)
+	})
+	return streamErrors, err
+}
+
+func (d *MongoDatabase) Credit(user string) (DonorCredit, error) {
+	donor := DonorCredit{}
+	err := d.retry(func() error {
+		return d.credit().FindId(user).One(&donor)
+	})
+	return donor, err
+}
+
+func (d *MongoDatabase) UpsertCredit(donor *DonorCredit) error {
+	return d.retry(func() error {
+		_, err := d.credit().UpsertId(donor.User, donor)
+		return err
+	})
+}
+
+func (d *MongoDatabase) CreditRank(points float64) (int, error) {
+	var n int
+	err := d.retry(func() (err error) {
+		n, err = d.credit().Find(bson.M{"points": bson.M{"$gt": points}}).Count()
+		return err
+	})
+	return n, err
+}
+
+func (d *MongoDatabase) Leaderboard(limit int) ([]DonorCredit, error) {
+	donors := make([]DonorCredit, 0)
+	err := d.retry(func() error {
+		return d.credit().Find(nil).Select(bson.M{"targets": 0}).Sort("-points").Limit(limit).All(&donors)
+	})
+	return donors, err
+}
+
+/*
+Run the writes as one ordered bulk operation, so that updates to the same
+document are applied in order. If Mongo reports which write failed, the writes
+after it are resumed immediately; otherwise every write is returned as failed.
+Only called by the writer goroutine.
+*/
+func (d *MongoDatabase) WriteDeferred(ops []*deferredOp) (written int, failed []*deferredOp, unreachable bool) {
+	collection := d.DB(ops[0].db).C(ops[0].collection)
+	if len(ops[0].indexes) > 0 && d.indexed[ops[0].key()] == false {
+		indexed := true
+		for _, index := range ops[0].indexes {
+			if err := collection.EnsureIndexKey(strings.Split(index, ",")...); err != nil {
+				indexed = false
+			}
+		}
+		d.indexed[ops[0].key()] = indexed
+	}
+	for len(ops) > 0 {
+		bulk := collection.Bulk()
+		for _, op := range ops {
+			if op.doc != nil {
+				bulk.Insert(op.doc)
+			} else {
+				bulk.Update(op.selector, op.update)
+			}
+		}
+		_, err := bulk.Run()
+		if err == nil {
+			return written + len(ops), failed, false
+		}
+		berr, ok := err.(*mgo.BulkError)
+		if ok == false || len(berr.Cases()) == 0 || berr.Cases()[0].Index < 0 || berr.Cases()[0].Index >= len(ops) {
+			// attempts made while Mongo is unreachable are not counted
+			unreachable = isTransient(d.check(err))
+			for _, op := range ops {
+				op.err = err
+				if unreachable == false {
+					op.retries += 1
+				}
+			}
+			return written, append(failed, ops...), unreachable
+		}
+		index, cause := berr.Cases()[0].Index, berr.Cases()[0].Err
+		written += index
+		if isTransient(d.check(cause)) {
+			// Mongo became unreachable, the remaining ops were not attempted
+			for _, op := range ops[index:] {
+				op.err = cause
+			}
+			return written, append(failed, ops[index:]...), true
+		}
+		if mgo.IsDup(cause) && ops[index].doc != nil {
+			// inserted by a previous attempt
+			written += 1
+		} else {
+			ops[index].err = cause
+			ops[index].retries += 1
+			failed = append(failed, ops[index])
+		}
+		ops = ops[index+1:]
+	}
+	return written, failed, false
+}
+
+func (d *MongoDatabase) InsertDeadLetter(doc map[string]interface{}) error {
+	return d.check(d.DB("dead_letters").C(d.name).Insert(doc))
+}
+
+func (d *MongoDatabase) EnsureIndexes() error {
+	err := d.streams().EnsureIndex(mgo.Index{
+		Key:        []string{"target_id"},
+		Background: true,
+	})
+	if err != nil {
+		return d.check(err)
+	}
+	err = d.webhooks().EnsureIndex(mgo.Index{
+		Key:        []string{"target_id"},
+		Background: true,
+	})
+	if err != nil {
+		return d.check(err)
+	}
+	for _, key := range []string{"target_id", "scv"} {
+		err = d.shards().EnsureIndex(mgo.Index{
+			Key:        []string{key},
+			Background: true,
+		})
+		if err != nil {
+			return d.check(err)
+		}
+	}
+	err = d.tokens().EnsureIndex(mgo.Index{
+		Key:        []string{"token"},
+		Unique:     true,
+		Background: true,
+	})
+	if err != nil {
+		return d.check(err)
+	}
+	return d.check(d.credit().EnsureIndex(mgo.Index{
+		Key:        []string{"-points"},
+		Background: true,
+	}))
+}
+
+func (d *MongoDatabase) Metrics() map[string]interface{} {
+	metrics := d.pool.Metrics()
+	metrics["backend"] = "mongo"
+	return metrics
+}
+
+func (d *MongoDatabase) Ping() error {
+	session := d.pool.Session().Copy()
+	defer session.Close()
+	session.SetSyncTimeout(PING_TIMEOUT)
+	session.SetSocketTimeout(PING_TIMEOUT)
+	return session.Ping()
+}
+
+func (d *MongoDatabase) Close() {
+	d.pool.Close()
+}
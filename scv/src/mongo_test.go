@@ -0,0 +1,19 @@
+package scv
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2"
+)
+
+func TestIsTransient(t *testing.T) {
+	assert.False(t, isTransient(nil))
+	assert.False(t, isTransient(mgo.ErrNotFound))
+	assert.False(t, isTransient(errors.New("E11000 duplicate key error")))
+	assert.True(t, isTransient(io.EOF))
+	assert.True(t, isTransient(errors.New("no reachable servers")))
+	assert.True(t, isTransient(errors.New("read tcp 127.0.0.1:27017: i/o timeout")))
+}
@@ -0,0 +1,656 @@
+package scv
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const OPENAPI_VERSION string = "3.0.3"
+
+// A body that is not JSON, described by its content type.
+type rawBody string
+
+const (
+	BINARY_BODY    rawBody = "application/octet-stream"
+	TAR_BODY       rawBody = "application/x-tar"
+	EVENT_BODY     rawBody = "text/event-stream"
+	MULTIPART_BODY rawBody = "multipart/form-data"
+)
+
+/*
+A route of the SCV. Routes are registered from this table, and the OpenAPI
+document is generated from it, so that every route is described. Request and
+Reply are a nil pointer to the type of the JSON body, or a rawBody. A nil
+Reply means that the reply is empty.
+*/
+type route struct {
+	Method   string
+	Path     string
+	Handler  http.Handler
+	Auth     string // manager, core, cc, engine, or empty if anyone may call it
+	Scope    string // of the service tokens that may call a manager route, see ScopeMiddleware
+	Public   bool   // anyone may call it for the streams of targets with public_data
+	Summary  string
+	Query    map[string]string // query parameters and their description
+	Request  interface{}
+	Reply    interface{}
+	Statuses []int // statuses other than 200 and 400
+	Timeout  int   // seconds the handler has to reply, 0 for REQUEST_TIMEOUT, <0 for no limit, see TimeoutMiddleware
+
+	// The handler checks the targets named in the body or the query against
+	// those of service tokens, see checkTokenTargets.
+	ChecksTargets bool
+}
+
+type jsonObject *map[string]interface{}
+
+func (app *Application) routes() []route {
+	return []route{
+		{Method: "GET", Path: "/", Handler: app.AliveHandler(),
+			Summary: "Check that the SCV is alive"},
+		{Method: "GET", Path: "/healthz", Handler: app.HealthHandler(),
+			Summary: "Liveness probe",
+			Reply:   jsonObject(nil)},
+		// a 503 carries a ReadyReply, not an error
+		{Method: "GET", Path: "/readyz", Handler: app.ReadyHandler(),
+			Summary: "Readiness probe, replies 503 if a dependency is unhealthy",
+			Reply:   (*ReadyReply)(nil)},
+		{Method: "GET", Path: "/capacity", Handler: app.CapacityHandler(),
+			Summary: "Idle streams, free space, ingest rate and health of the SCV, for the CC",
+			Reply:   (*CapacityReply)(nil)},
+		{Method: "GET", Path: "/api/schema", Handler: app.SchemaHandler(),
+			Summary: "This OpenAPI document",
+			Reply:   jsonObject(nil)},
+		{Method: "GET", Path: "/active_streams", Handler: app.ActiveStreamsHandler(),
+			Summary: "Progress of the active streams of each target, or an ActiveStreamsDelta if since is given",
+			Query:   map[string]string{"since": "version of a previous reply, see the X-Active-Streams-Version header"},
+			Reply:   (*map[string]map[string]ActiveStreamInfo)(nil)},
+		{Method: "GET", Path: "/metrics", Handler: app.MetricsHandler(),
+			Summary: "Operational metrics",
+			Reply:   jsonObject(nil)},
+		{Method: "GET", Path: "/events", Handler: app.EventsHandler(), Auth: "manager", Scope: SCOPE_STREAMS_READ, ChecksTargets: true, Timeout: -1,
+			Summary: "Server-sent events of the streams of the manager",
+			Query:   map[string]string{"target_id": "only send events of this target, may be repeated"},
+			Reply:   EVENT_BODY},
+		{Method: "POST", Path: "/streams", Handler: app.StreamsHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE, ChecksTargets: true, Timeout: LONG_REQUEST_TIMEOUT,
+			Summary:  "Add a stream",
+			Request:  (*PostStreamRequest)(nil),
+			Reply:    (*PostStreamReply)(nil),
+			Statuses: []int{401, 403, 404, 507}},
+		{Method: "GET", Path: "/streams/info/{stream_id}", Handler: app.StreamInfoHandler(),
+			Summary: "Status of a stream",
+			Reply: (*struct {
+				Stream
+				Active       bool `json:"active"`
+				TargetPaused bool `json:"target_paused"`
+			})(nil),
+			Statuses: []int{404}},
+		{Method: "POST", Path: "/streams/activate", Handler: app.StreamActivateHandler(), Auth: "cc", Timeout: LONG_REQUEST_TIMEOUT,
+			Summary:  "Activate a stream for a core",
+			Request:  (*ActivateRequest)(nil),
+			Reply:    (*ActivateReply)(nil),
+			Statuses: []int{401, 403, 404, 426, 429, 503, 507}},
+		{Method: "POST", Path: "/assign", Handler: app.AssignHandler(), Auth: "engine",
+			Summary:  "Activate a stream for a core without a CC",
+			Request:  (*AssignRequest)(nil),
+			Reply:    (*AssignReply)(nil),
+			Statuses: []int{401, 403, 426, 429, 503, 507}},
+		{Method: "GET", Path: "/streams/download/{stream_id}/{file:.+}", Handler: app.StreamDownloadHandler(), Auth: "manager", Scope: SCOPE_DOWNLOAD, Public: true, Timeout: LONG_REQUEST_TIMEOUT,
+			Summary:  "Download a file of a stream",
+			Query:    map[string]string{"partition": "download the copy stored in this partition"},
+			Reply:    BINARY_BODY,
+			Statuses: []int{304, 401, 403, 404}},
+		{Method: "PUT", Path: "/streams/start/{stream_id}", Handler: app.StreamEnableHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE,
+			Summary:  "Enable a stream",
+			Statuses: []int{401, 403, 404, 409}},
+		{Method: "PUT", Path: "/streams/stop/{stream_id}", Handler: app.StreamDisableHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE,
+			Summary:  "Disable a stream",
+			Statuses: []int{401, 403, 404}},
+		{Method: "PUT", Path: "/streams/quarantine/{stream_id}", Handler: app.StreamQuarantineHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE,
+			Summary: "Quarantine a stream",
+			Request: (*struct {
+				Reason string `json:"reason,omitempty"`
+			})(nil),
+			Statuses: []int{401, 403, 404}},
+		{Method: "PUT", Path: "/streams/release/{stream_id}", Handler: app.StreamReleaseHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE,
+			Summary:  "Release a quarantined stream",
+			Statuses: []int{401, 403, 404, 409}},
+		{Method: "PUT", Path: "/streams/delete/{stream_id}", Handler: app.StreamDeleteHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE,
+			Summary:  "Delete a stream",
+			Statuses: []int{401, 403, 404}},
+		{Method: "POST", Path: "/streams/undelete/{stream_id}", Handler: app.StreamUndeleteHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE,
+			Summary:  "Restore a deleted stream",
+			Statuses: []int{401, 403, 404, 409}},
+		{Method: "PUT", Path: "/streams/truncate/{stream_id}", Handler: app.StreamTruncateHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE,
+			Summary: "Discard the frames of a stream after a frame count",
+			Request: (*struct {
+				Frames int `json:"frames"`
+			})(nil),
+			Reply:    (*RestartPoint)(nil),
+			Statuses: []int{401, 403, 404, 409}},
+		{Method: "PUT", Path: "/streams/tags/{stream_id}", Handler: app.StreamTagsHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE,
+			Summary:  "Replace or remove tags of a stream",
+			Request:  (*map[string]*string)(nil),
+			Statuses: []int{401, 403, 404}},
+		{Method: "PATCH", Path: "/streams/meta/{stream_id}", Handler: app.StreamMetaHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE,
+			Summary:  "Set or unset metadata of a stream",
+			Request:  jsonObject(nil),
+			Reply:    jsonObject(nil),
+			Statuses: []int{401, 403, 404, 413}},
+		{Method: "PATCH", Path: "/streams/options/{stream_id}", Handler: app.StreamOptionsHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE,
+			Summary:  "Override options of the target for a stream",
+			Request:  jsonObject(nil),
+			Reply:    jsonObject(nil),
+			Statuses: []int{401, 403, 404, 413}},
+		{Method: "POST", Path: "/streams/bulk_update", Handler: app.StreamsBulkUpdateHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE, ChecksTargets: true,
+			Summary:  "Update the priority, status or metadata of the matching streams at once",
+			Request:  (*BulkUpdateRequest)(nil),
+			Reply:    (*BulkUpdateReply)(nil),
+			Statuses: []int{401, 403, 409, 413}},
+		{Method: "GET", Path: "/streams/sync/{stream_id}", Handler: app.StreamSyncHandler(), Auth: "manager", Scope: SCOPE_DOWNLOAD, Public: true, Timeout: LONG_REQUEST_TIMEOUT,
+			Summary:  "List the files of a stream",
+			Query:    map[string]string{"manifest": "include the manifest of each partition if true"},
+			Reply:    (*SyncReply)(nil),
+			Statuses: []int{304, 401, 403, 404}},
+		{Method: "DELETE", Path: "/streams/recovered/{stream_id}", Handler: app.StreamRecoveredHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE,
+			Summary:  "Discard the buffer recovered from the previous core of a stream",
+			Statuses: []int{401, 403, 404}},
+		{Method: "GET", Path: "/streams/frames/{stream_id}", Handler: app.StreamFramesHandler(), Auth: "manager", Scope: SCOPE_STREAMS_READ,
+			Summary:  "Metadata of the checkpointed frames of a stream",
+			Reply:    (*FramesReply)(nil),
+			Statuses: []int{401, 403, 404}},
+		{Method: "GET", Path: "/streams/verify/{stream_id}", Handler: app.StreamVerifyHandler(), Auth: "manager", Scope: SCOPE_STREAMS_READ,
+			Summary: "Verify the checksums of a stream",
+			Reply: (*struct {
+				Checked   int          `json:"checked"`
+				Corrupted []Corruption `json:"corrupted"`
+			})(nil),
+			Statuses: []int{401, 403, 404}},
+		{Method: "GET", Path: "/streams/history/{stream_id}", Handler: app.StreamHistoryHandler(), Auth: "manager", Scope: SCOPE_STREAMS_READ,
+			Summary: "Activation sessions of a stream",
+			Reply: (*struct {
+				Sessions []Session `json:"sessions"`
+			})(nil),
+			Statuses: []int{401, 403, 404}},
+		{Method: "GET", Path: "/streams/errors/{stream_id}", Handler: app.StreamErrorsHandler(), Auth: "manager", Scope: SCOPE_STREAMS_READ,
+			Summary: "Failures reported by the cores of a stream",
+			Reply: (*struct {
+				Errors []StreamError `json:"errors"`
+			})(nil),
+			Statuses: []int{401, 403, 404}},
+		{Method: "GET", Path: "/streams/lineage/{stream_id}", Handler: app.StreamLineageHandler(), Auth: "manager", Scope: SCOPE_STREAMS_READ,
+			Summary: "Streams a stream was forked from and forked into",
+			Reply: (*struct {
+				Ancestors []string     `json:"ancestors"`
+				Tree      *LineageNode `json:"tree"`
+			})(nil),
+			Statuses: []int{401, 403, 404}},
+		{Method: "GET", Path: "/streams/export/{stream_id}", Handler: app.StreamExportHandler(), Auth: "manager", Scope: SCOPE_DOWNLOAD, Timeout: LONG_REQUEST_TIMEOUT,
+			Summary:  "Export a stream as a tarball",
+			Reply:    TAR_BODY,
+			Statuses: []int{401, 403, 404}},
+		{Method: "POST", Path: "/streams/import", Handler: app.StreamImportHandler(), Auth: "manager", Scope: SCOPE_STREAMS_WRITE, ChecksTargets: true, Timeout: LONG_REQUEST_TIMEOUT,
+			Summary:  "Import a stream exported by an SCV",
+			Request:  TAR_BODY,
+			Reply:    (*PostStreamReply)(nil),
+			Statuses: []int{401, 403, 409, 507}},
+		{Method: "POST", Path: "/targets", Handler: app.PostTargetHandler(), Auth: "manager", Scope: SCOPE_ADMIN,
+			Summary: "Add a target",
+			Request: (*targetUpdate)(nil),
+			Reply: (*struct {
+				TargetId string `json:"target_id"`
+			})(nil),
+			Statuses: []int{401, 403}},
+		{Method: "PUT", Path: "/targets/{target_id}/options", Handler: app.TargetOptionsHandler(), Auth: "manager", Scope: SCOPE_ADMIN,
+			Summary:  "Update a target",
+			Request:  (*targetUpdate)(nil),
+			Statuses: []int{401, 403, 404}},
+		{Method: "PUT", Path: "/targets/{target_id}/pause", Handler: app.TargetPauseHandler(), Auth: "manager", Scope: SCOPE_ADMIN,
+			Summary:  "Stop activating the streams of a target, letting active ones finish",
+			Reply:    (*TargetPauseReply)(nil),
+			Statuses: []int{401, 403, 404}},
+		{Method: "PUT", Path: "/targets/{target_id}/resume", Handler: app.TargetPauseHandler(), Auth: "manager", Scope: SCOPE_ADMIN,
+			Summary:  "Resume a paused target",
+			Reply:    (*TargetPauseReply)(nil),
+			Statuses: []int{401, 403, 404}},
+		{Method: "POST", Path: "/targets/{target_id}/webhooks", Handler: app.PostWebhookHandler(), Auth: "manager", Scope: SCOPE_ADMIN,
+			Summary: "Register a URL to be POSTed the events of the streams of a target",
+			Request: (*struct {
+				URL    string   `json:"url"`
+				Events []string `json:"events,omitempty"`
+			})(nil),
+			Reply:    (*Webhook)(nil),
+			Statuses: []int{401, 403}},
+		{Method: "GET", Path: "/targets/{target_id}/webhooks", Handler: app.ListWebhooksHandler(), Auth: "manager", Scope: SCOPE_ADMIN,
+			Summary: "List the webhooks of a target",
+			Reply: (*struct {
+				Webhooks []Webhook `json:"webhooks"`
+			})(nil),
+			Statuses: []int{401, 403}},
+		{Method: "DELETE", Path: "/targets/{target_id}/webhooks/{id}", Handler: app.RemoveWebhookHandler(), Auth: "manager", Scope: SCOPE_ADMIN,
+			Summary:  "Remove a webhook",
+			Statuses: []int{401, 403, 404}},
+		{Method: "GET", Path: "/targets/{target_id}/usage", Handler: app.TargetUsageHandler(), Auth: "manager", Scope: SCOPE_STREAMS_READ,
+			Summary: "Disk usage of the streams of a target",
+			Reply: (*struct {
+				Bytes          int64            `json:"bytes"`
+				Quota          int64            `json:"quota"`
+				Streams        map[string]int64 `json:"streams"`
+				NamespaceBytes int64            `json:"namespace_bytes"`
+				NamespaceQuota int64            `json:"namespace_quota"`
+			})(nil),
+			Statuses: []int{304, 401, 403}},
+		{Method: "GET", Path: "/targets/{target_id}/streams", Handler: app.TargetStreamsHandler(), Auth: "manager", Scope: SCOPE_STREAMS_READ,
+			Summary:  "Streams of a target, by state",
+			Reply:    (*TargetStreamsReply)(nil),
+			Statuses: []int{401, 403}},
+		{Method: "GET", Path: "/targets/{target_id}/shards", Handler: app.TargetShardsHandler(), Auth: "manager", Scope: SCOPE_STREAMS_READ,
+			Summary: "SCVs holding streams of a target",
+			Reply: (*struct {
+				Shards []Shard `json:"shards"`
+			})(nil),
+			Statuses: []int{401, 403}},
+		{Method: "GET", Path: "/targets/{target_id}/stats", Handler: app.TargetStatsHandler(), Auth: "manager", Scope: SCOPE_STREAMS_READ,
+			Summary:  "Frames and donors of a target",
+			Reply:    (*TargetStats)(nil),
+			Statuses: []int{401, 403}},
+		{Method: "GET", Path: "/donors/{user}/stats", Handler: app.DonorStatsHandler(),
+			Summary: "Credit of a donor",
+			Reply: (*struct {
+				DonorCredit
+				Rank int `json:"rank"`
+			})(nil),
+			Statuses: []int{404}},
+		{Method: "GET", Path: "/donors/{user}/sessions", Handler: app.DonorSessionsHandler(),
+			Summary: "Sessions of a donor, newest first",
+			Query: map[string]string{
+				"target_id": "only list the sessions of this target",
+				"limit":     "number of sessions",
+				"after":     "next of the previous page",
+			},
+			Reply: (*DonorSessionsReply)(nil)},
+		{Method: "GET", Path: "/leaderboard", Handler: app.LeaderboardHandler(),
+			Summary: "Donors with the most points",
+			Query:   map[string]string{"limit": "number of donors"},
+			Reply: (*struct {
+				Donors []DonorCredit `json:"donors"`
+			})(nil)},
+		{Method: "GET", Path: "/benchmarks/{engine}", Handler: app.BenchmarksHandler(),
+			Summary: "Speed of the donors of an engine on benchmark targets",
+			Reply:   (*BenchmarksReply)(nil)},
+		{Method: "POST", Path: "/auth/tokens", Handler: app.PostTokenHandler(), Auth: "manager", Scope: SCOPE_ADMIN,
+			Summary: "Issue an API token",
+			Request: (*struct {
+				Description string   `json:"description,omitempty"`
+				ExpiresIn   int      `json:"expires_in,omitempty"`
+				Scopes      []string `json:"scopes,omitempty"`
+				TargetIds   []string `json:"target_ids,omitempty"`
+			})(nil),
+			Reply:    (*APIToken)(nil),
+			Statuses: []int{401}},
+		{Method: "GET", Path: "/auth/tokens", Handler: app.ListTokensHandler(), Auth: "manager", Scope: SCOPE_ADMIN,
+			Summary: "List the API tokens of the user",
+			Reply: (*struct {
+				Tokens []APIToken `json:"tokens"`
+			})(nil),
+			Statuses: []int{401}},
+		{Method: "PUT", Path: "/auth/tokens/{id}/rotate", Handler: app.RotateTokenHandler(), Auth: "manager", Scope: SCOPE_ADMIN,
+			Summary: "Replace the secret of an API token",
+			Reply: (*struct {
+				Id    string `json:"id"`
+				Token string `json:"token"`
+			})(nil),
+			Statuses: []int{401, 403, 404}},
+		{Method: "DELETE", Path: "/auth/tokens/{id}", Handler: app.RevokeTokenHandler(), Auth: "manager", Scope: SCOPE_ADMIN,
+			Summary:  "Revoke an API token",
+			Statuses: []int{401, 403, 404}},
+		{Method: "GET", Path: "/core/start", Handler: app.CoreStartHandler(), Auth: "core", Timeout: LONG_REQUEST_TIMEOUT,
+			Summary:  "Files and options needed by the core to start",
+			Reply:    (*CoreStartReply)(nil),
+			Statuses: []int{401, 403}},
+		{Method: "PUT", Path: "/core/frame", Handler: app.CoreFrameHandler(), Auth: "core", Timeout: LONG_REQUEST_TIMEOUT,
+			Summary:  "Append a frame to the buffer of the stream",
+			Request:  (*FrameRequest)(nil),
+			Statuses: []int{401, 403, 409, 413, 429, 507}},
+		{Method: "PUT", Path: "/core/frame/stream", Handler: app.CoreFrameStreamHandler(), Auth: "core", Timeout: STREAMED_FRAME_TIMEOUT,
+			Summary:  "Append a frame sent as one part per file to the buffer of the stream",
+			Request:  MULTIPART_BODY,
+			Statuses: []int{401, 403, 409, 413, 429, 507}},
+		{Method: "PUT", Path: "/core/checkpoint", Handler: app.CoreCheckpointHandler(), Auth: "core", Timeout: LONG_REQUEST_TIMEOUT,
+			Summary:  "Write a checkpoint and the buffered frames",
+			Request:  (*CheckpointRequest)(nil),
+			Statuses: []int{401, 403, 413}},
+		{Method: "PUT", Path: "/core/logs", Handler: app.CoreLogsHandler(), Auth: "core",
+			Summary:  "Upload log files of the core",
+			Request:  (*LogRequest)(nil),
+			Statuses: []int{401, 413}},
+		{Method: "PUT", Path: "/core/stop", Handler: app.CoreStopHandler(), Auth: "core",
+			Summary:  "Deactivate the stream",
+			Request:  (*CoreStopRequest)(nil),
+			Statuses: []int{401}},
+		{Method: "POST", Path: "/core/heartbeat", Handler: app.CoreHeartbeatHandler(), Auth: "core", Timeout: HEARTBEAT_TIMEOUT,
+			Summary:  "Keep the stream active",
+			Statuses: []int{401, 403}},
+		{Method: "POST", Path: "/core/pause", Handler: app.CorePauseHandler(), Auth: "core", Timeout: HEARTBEAT_TIMEOUT,
+			Summary:  "Keep the stream active while the core is paused",
+			Request:  (*CorePauseRequest)(nil),
+			Reply:    (*CorePauseReply)(nil),
+			Statuses: []int{401, 403}},
+		{Method: "POST", Path: "/core/resume", Handler: app.CoreResumeHandler(), Auth: "core", Timeout: HEARTBEAT_TIMEOUT,
+			Summary:  "End the pause of the stream",
+			Statuses: []int{401, 403}},
+		{Method: "POST", Path: "/admin/reload", Handler: app.ReloadHandler(), Auth: "cc",
+			Summary: "Reload the configuration file",
+			Reply: (*struct {
+				Applied         []string `json:"applied"`
+				RestartRequired []string `json:"restart_required"`
+			})(nil),
+			Statuses: []int{401}},
+		{Method: "POST", Path: "/admin/drain", Handler: app.DrainHandler(), Auth: "cc",
+			Summary:  "Stop activating streams",
+			Reply:    (*DrainReply)(nil),
+			Statuses: []int{401}},
+		{Method: "DELETE", Path: "/admin/drain", Handler: app.DrainHandler(), Auth: "cc",
+			Summary:  "Resume activating streams",
+			Reply:    (*DrainReply)(nil),
+			Statuses: []int{401}},
+		{Method: "POST", Path: "/verifications/activate", Handler: app.VerificationActivateHandler(), Auth: "cc",
+			Summary:  "Assign a verification to a core of a trusted donor",
+			Request:  (*VerificationActivateRequest)(nil),
+			Reply:    (*VerificationActivateReply)(nil),
+			Statuses: []int{401, 403, 404}},
+		{Method: "GET", Path: "/core/verification/start", Handler: app.CoreVerificationStartHandler(), Auth: "core",
+			Summary:  "Get the files a verifier starts from",
+			Reply:    (*VerificationStartReply)(nil),
+			Statuses: []int{401}},
+		{Method: "PUT", Path: "/core/verification/result", Handler: app.CoreVerificationResultHandler(), Auth: "core",
+			Summary:  "Compare the result of a verifier with the donor's checkpoint",
+			Request:  (*VerificationResultRequest)(nil),
+			Reply:    (*VerificationResultReply)(nil),
+			Statuses: []int{401}},
+		{Method: "GET", Path: "/admin/verifications", Handler: app.ListVerificationsHandler(), Auth: "cc",
+			Summary:  "List the verifications of this SCV and the flagged donors",
+			Reply:    (*VerificationsReply)(nil),
+			Statuses: []int{401}},
+		{Method: "GET", Path: "/admin/state", Handler: app.StateHandler(), Auth: "cc",
+			Summary:  "Snapshot of the state of the manager and queues, for debugging",
+			Reply:    (*StateReply)(nil),
+			Statuses: []int{401}},
+		{Method: "GET", Path: "/admin/maintenance", Handler: app.MaintenanceHandler(), Auth: "cc",
+			Summary:  "Maintenance windows during which streams are not activated",
+			Reply:    (*MaintenanceReply)(nil),
+			Statuses: []int{401}},
+		{Method: "PUT", Path: "/admin/streams/{stream_id}/restart", Handler: app.StreamRestartHandler(), Auth: "cc",
+			Summary:  "Pin the checkpoint a stream restarts from, deleting the data after it",
+			Request:  (*RestartPoint)(nil),
+			Reply:    (*RestartPoint)(nil),
+			Statuses: []int{401, 404, 409}},
+		{Method: "POST", Path: "/admin/bans", Handler: app.PostBanHandler(), Auth: "cc",
+			Summary: "Ban a donor or a core engine",
+			Request: (*struct {
+				User      string `json:"user,omitempty"`
+				Engine    string `json:"engine,omitempty"`
+				Reason    string `json:"reason"`
+				ExpiresIn int    `json:"expires_in,omitempty"`
+			})(nil),
+			Reply:    (*Ban)(nil),
+			Statuses: []int{401}},
+		{Method: "GET", Path: "/admin/bans", Handler: app.ListBansHandler(), Auth: "cc",
+			Summary: "List the bans",
+			Reply: (*struct {
+				Bans []Ban `json:"bans"`
+			})(nil),
+			Statuses: []int{401}},
+		{Method: "DELETE", Path: "/admin/bans/{id}", Handler: app.RemoveBanHandler(), Auth: "cc",
+			Summary:  "Lift a ban",
+			Statuses: []int{401, 404}},
+		{Method: "PUT", Path: "/admin/bans/{id}/deactivate", Handler: app.BanDeactivateHandler(), Auth: "cc",
+			Summary: "Deactivate the streams refused by a ban",
+			Reply: (*struct {
+				Deactivated []string `json:"deactivated"`
+			})(nil),
+			Statuses: []int{401, 404}},
+	}
+}
+
+// Strips the regular expressions from the variables of a mux path.
+var muxVariable = regexp.MustCompile(`\{([a-z_]+)(:[^}]*)?\}`)
+
+// Describes the authentication schemes. All of them send a secret in the
+// Authorization header, they differ in who issues it.
+var SECURITY_SCHEMES = map[string]string{
+	"manager": "token of a manager, or an API token issued by /auth/tokens, which needs the x-scope of the route if it has scopes",
+	"core":    "token returned by /streams/activate, /assign or /verifications/activate",
+	"cc":      "password of the SCV, or a TLS client certificate signed by ClientCA",
+	"engine":  "engine key",
+}
+
+// Builds JSON schemas, collecting named structs as components.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := b.components[name]; ok == false {
+			// registered first so that recursive types terminate
+			b.components[name] = nil
+			b.components[name] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// The schema of a struct, following the rules of encoding/json.
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			if field.Anonymous && tag == "" {
+				ft := field.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					add(ft)
+					continue
+				}
+			}
+			if field.PkgPath != "" {
+				continue
+			}
+			parts := strings.Split(tag, ",")
+			name := parts[0]
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = b.schema(field.Type)
+			omitempty := false
+			for _, option := range parts[1:] {
+				omitempty = omitempty || option == "omitempty"
+			}
+			if omitempty == false && field.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
+	}
+	add(t)
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+func (b *schemaBuilder) content(body interface{}) map[string]interface{} {
+	if raw, ok := body.(rawBody); ok {
+		return map[string]interface{}{string(raw): map[string]interface{}{
+			"schema": map[string]interface{}{"type": "string", "format": "binary"},
+		}}
+	}
+	return map[string]interface{}{"application/json": map[string]interface{}{
+		"schema": b.schema(reflect.TypeOf(body)),
+	}}
+}
+
+// Generates the OpenAPI document describing the routes.
+func openAPI(routes []route) map[string]interface{} {
+	b := &schemaBuilder{components: make(map[string]interface{})}
+	errorReply := map[string]interface{}{
+		"description": "Error",
+		"content":     b.content((*ErrorReply)(nil)),
+	}
+	paths := make(map[string]interface{})
+	for _, rt := range routes {
+		path := muxVariable.ReplaceAllString(rt.Path, "{$1}")
+		parameters := make([]interface{}, 0)
+		for _, match := range muxVariable.FindAllStringSubmatch(rt.Path, -1) {
+			parameters = append(parameters, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		names := make([]string, 0, len(rt.Query))
+		for name := range rt.Query {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        name,
+				"in":          "query",
+				"description": rt.Query[name],
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		ok := map[string]interface{}{"description": "OK"}
+		if rt.Reply != nil {
+			ok["content"] = b.content(rt.Reply)
+		}
+		responses := map[string]interface{}{"200": ok, "400": errorReply}
+		for _, status := range rt.Statuses {
+			if status == http.StatusNotModified {
+				responses["304"] = map[string]interface{}{"description": "Not modified"}
+			} else {
+				responses[strconv.Itoa(status)] = errorReply
+			}
+		}
+		operation := map[string]interface{}{
+			"summary":   rt.Summary,
+			"responses": responses,
+		}
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		if rt.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  b.content(rt.Request),
+			}
+		}
+		if rt.Auth != "" {
+			operation["security"] = []interface{}{map[string]interface{}{rt.Auth: []string{}}}
+			if rt.Public {
+				// an empty requirement makes the authorization optional
+				operation["security"] = append(operation["security"].([]interface{}), map[string]interface{}{})
+			}
+		}
+		if rt.Scope != "" {
+			operation["x-scope"] = rt.Scope
+		}
+		item, exists := paths[path].(map[string]interface{})
+		if exists == false {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(rt.Method)] = operation
+	}
+	schemes := make(map[string]interface{})
+	for name, description := range SECURITY_SCHEMES {
+		schemes[name] = map[string]interface{}{
+			"type":        "apiKey",
+			"in":          "header",
+			"name":        "Authorization",
+			"description": description,
+		}
+	}
+	return map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info": map[string]interface{}{
+			"title":   "Siegetank SCV",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas":         b.components,
+			"securitySchemes": schemes,
+		},
+	}
+}
+
+/*
+.. http:get:: /api/schema
+    The OpenAPI 3 document describing every route of the SCV, including
+    the core protocol. The request and reply bodies are generated from
+    the types the handlers decode and encode.
+    :status 200: OK
+*/
+func (app *Application) SchemaHandler() AppHandler {
+	var once sync.Once
+	var data []byte
+	var err error
+	return func(w http.ResponseWriter, r *http.Request) error {
+		once.Do(func() {
+			data, err = json.Marshal(openAPI(app.routes()))
+		})
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,69 @@
+package scv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAPI(t *testing.T) {
+	app := &Application{}
+	seen := make(map[string]bool)
+	for _, rt := range app.routes() {
+		assert.False(t, seen[rt.Method+" "+rt.Path], rt.Path)
+		seen[rt.Method+" "+rt.Path] = true
+		assert.NotEqual(t, rt.Summary, "", rt.Path)
+		// every manager route can be granted to service tokens
+		assert.Equal(t, rt.Auth == "manager", rt.Scope != "", rt.Path)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/schema", nil)
+	w := httptest.NewRecorder()
+	app.SchemaHandler().ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	doc := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, doc["openapi"], OPENAPI_VERSION)
+	paths := doc["paths"].(map[string]interface{})
+	assert.Equal(t, len(paths), 71)
+
+	frame := paths["/core/frame"].(map[string]interface{})["put"].(map[string]interface{})
+	body := frame["requestBody"].(map[string]interface{})["content"].(map[string]interface{})["application/json"]
+	assert.Equal(t, body.(map[string]interface{})["schema"], map[string]interface{}{"$ref": "#/components/schemas/FrameRequest"})
+	responses := frame["responses"].(map[string]interface{})
+	for _, status := range []string{"200", "400", "401", "409", "413"} {
+		assert.Contains(t, responses, status)
+	}
+	assert.Equal(t, frame["security"], []interface{}{map[string]interface{}{"core": []interface{}{}}})
+
+	// mux patterns are stripped from path parameters
+	download := paths["/streams/download/{stream_id}/{file}"].(map[string]interface{})["get"].(map[string]interface{})
+	assert.Equal(t, len(download["parameters"].([]interface{})), 3)
+	assert.Equal(t, download["x-scope"], SCOPE_DOWNLOAD)
+
+	schemas := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	assert.Equal(t, schemas["FrameRequest"], map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"files":  map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}},
+			"frames": map[string]interface{}{"type": "integer"},
+			"meta":   map[string]interface{}{"$ref": "#/components/schemas/FrameMetadata"},
+		},
+		"required": []interface{}{"files"},
+	})
+	// recursive and unexported types
+	node := schemas["LineageNode"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Equal(t, node["children"].(map[string]interface{})["items"], map[string]interface{}{"$ref": "#/components/schemas/LineageNode"})
+	assert.Contains(t, schemas, "TargetUpdate")
+	// fields hidden from JSON are not described
+	info := paths["/streams/info/{stream_id}"].(map[string]interface{})["get"].(map[string]interface{})
+	reply := info["responses"].(map[string]interface{})["200"].(map[string]interface{})["content"].(map[string]interface{})["application/json"]
+	stream := reply.(map[string]interface{})["schema"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Contains(t, stream, "active")
+	assert.NotContains(t, stream, "StreamId")
+	assert.NotContains(t, stream, "RWMutex")
+	assert.Contains(t, stream, "donor_frames")
+}
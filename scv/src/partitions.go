@@ -0,0 +1,92 @@
+package scv
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/*
+In-memory index of the partition directories of a stream, so that /core/start,
+/core/checkpoint and /streams/sync do not have to list the stream directory on
+every request. The index is built from disk the first time it is needed and
+kept up to date as checkpoints are written. Code that removes partitions from
+disk, such as the compactor, must invalidate it.
+*/
+type partitionIndex struct {
+	sync.Mutex
+	valid       bool
+	partitions  []int       // sorted
+	checkpoints map[int]int // partition to its last checkpoint directory
+}
+
+// Returns the partitions of a stream. The stream must be locked, for reading
+// or writing.
+func (app *Application) streamPartitions(s *Stream) ([]int, error) {
+	index := &streamData(s).index
+	index.Lock()
+	defer index.Unlock()
+	if index.valid == false {
+		partitions, err := app.ListPartitions(s.StreamId)
+		if err != nil {
+			return nil, err
+		}
+		index.partitions = partitions
+		index.checkpoints = make(map[int]int)
+		index.valid = true
+	}
+	res := make([]int, len(index.partitions))
+	copy(res, index.partitions)
+	return res, nil
+}
+
+// Returns the last checkpoint directory of a partition. The stream must be
+// locked, for reading or writing.
+func (app *Application) lastCheckpoint(s *Stream, partition int) (int, error) {
+	if _, err := app.streamPartitions(s); err != nil {
+		return 0, err
+	}
+	index := &streamData(s).index
+	index.Lock()
+	defer index.Unlock()
+	if checkpoint, ok := index.checkpoints[partition]; ok {
+		return checkpoint, nil
+	}
+	partitionDir := filepath.Join(app.StreamDir(s.StreamId), strconv.Itoa(partition))
+	checkpoint, err := maxCheckpoint(partitionDir)
+	if err != nil {
+		return 0, err
+	}
+	index.checkpoints[partition] = checkpoint
+	return checkpoint, nil
+}
+
+// Record that checkpoint directory checkpoint of partition was written. The
+// stream must be locked for writing.
+func (index *partitionIndex) addCheckpoint(partition, checkpoint int) {
+	index.Lock()
+	defer index.Unlock()
+	if index.valid == false {
+		return
+	}
+	// checkpoints taken before the first frame are stored in directory 0,
+	// which is not a partition
+	i := sort.SearchInts(index.partitions, partition)
+	if partition > 0 && (i == len(index.partitions) || index.partitions[i] != partition) {
+		index.partitions = append(index.partitions, 0)
+		copy(index.partitions[i+1:], index.partitions[i:])
+		index.partitions[i] = partition
+	}
+	index.checkpoints[partition] = checkpoint
+}
+
+// Forget the index so that it is rebuilt from disk the next time it is
+// needed.
+func (index *partitionIndex) invalidate() {
+	index.Lock()
+	defer index.Unlock()
+	index.valid = false
+	index.partitions = nil
+	index.checkpoints = nil
+}
@@ -0,0 +1,44 @@
+package scv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partitions")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	app := &Application{Config: Configuration{Name: filepath.Join(dir, "scv")}}
+	stream := newStream("stream", "target", "yutong", 5, 0, 0)
+	for _, path := range []string{"files", "0/0", "5/0", "5/1", "12/0"} {
+		os.MkdirAll(filepath.Join(app.StreamDir("stream"), path), 0776)
+	}
+	partitions, err := app.streamPartitions(stream)
+	assert.Nil(t, err)
+	assert.Equal(t, partitions, []int{5, 12})
+	checkpoint, err := app.lastCheckpoint(stream, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, checkpoint, 1)
+
+	// the index is not read from disk again
+	os.MkdirAll(filepath.Join(app.StreamDir("stream"), "5", "2"), 0776)
+	streamData(stream).index.addCheckpoint(8, 0)
+	streamData(stream).index.addCheckpoint(0, 1)
+	partitions, _ = app.streamPartitions(stream)
+	assert.Equal(t, partitions, []int{5, 8, 12})
+	checkpoint, _ = app.lastCheckpoint(stream, 5)
+	assert.Equal(t, checkpoint, 1)
+	checkpoint, _ = app.lastCheckpoint(stream, 0)
+	assert.Equal(t, checkpoint, 1)
+
+	streamData(stream).index.invalidate()
+	partitions, _ = app.streamPartitions(stream)
+	assert.Equal(t, partitions, []int{5, 12})
+	checkpoint, _ = app.lastCheckpoint(stream, 5)
+	assert.Equal(t, checkpoint, 2)
+}
@@ -0,0 +1,224 @@
+package scv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"plugin"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Default number of goroutines running checkpoint plugins.
+const PLUGIN_WORKERS int = 2
+
+// Checkpoints waiting for the plugins above which new ones are not analysed.
+const PLUGIN_QUEUE_SIZE int = 256
+
+// Default seconds a plugin command may run.
+const PLUGIN_TIMEOUT int = 300
+
+// A checkpoint of a stream, as handed to plugins once it is flushed to disk.
+type CheckpointInfo struct {
+	StreamId  string
+	TargetId  string
+	Partition string // directory of the new checkpoint, eg. <stream dir>/25/0
+	Frames    int    // frames of the stream, including the new partition
+}
+
+/*
+Analyses the checkpoints of streams, eg. to compute their RMSD or update Markov
+state models. The results are stored in the meta of the stream under the name
+of the plugin, replacing those of the previous checkpoint. Plugins run in the
+background once the checkpoint was replied to, so the partition may have been
+archived, pruned by the target's retention or deleted by the time they run.
+*/
+type CheckpointPlugin interface {
+	Analyze(c CheckpointInfo) (map[string]interface{}, error)
+}
+
+/*
+A plugin of the configuration, either an external command or a Go plugin. The
+command is run with the directory of the checkpoint as its last argument, and
+SCV_STREAM_ID, SCV_TARGET_ID, SCV_PARTITION and SCV_FRAMES in its environment,
+and must print a JSON object. Go plugins must export a variable named Plugin
+whose address implements CheckpointPlugin.
+*/
+type PluginConfig struct {
+	Name    string   `json:"Name"`    // key of the results in the meta of the streams
+	Command []string `json:"Command"` // either Command or Path
+	Path    string   `json:"Path"`    // of the .so file of a Go plugin
+	Targets []string `json:"Targets"` // targets whose checkpoints are analysed, every target if empty
+	Timeout int      `json:"Timeout"` // seconds the command may run, 0 for default
+}
+
+type registeredPlugin struct {
+	name    string
+	targets map[string]struct{} // nil for every target
+	plugin  CheckpointPlugin
+}
+
+type pluginJob struct {
+	plugin *registeredPlugin
+	info   CheckpointInfo
+}
+
+// Runs an external command, see PluginConfig.
+type commandPlugin struct {
+	command []string
+	timeout time.Duration
+}
+
+func (p *commandPlugin) Analyze(c CheckpointInfo) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	args := append(append([]string{}, p.command[1:]...), c.Partition)
+	cmd := exec.CommandContext(ctx, p.command[0], args...)
+	cmd.Env = append(os.Environ(),
+		"SCV_STREAM_ID="+c.StreamId,
+		"SCV_TARGET_ID="+c.TargetId,
+		"SCV_PARTITION="+c.Partition,
+		"SCV_FRAMES="+strconv.Itoa(c.Frames),
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New(err.Error() + ": " + stderr.String())
+	}
+	result := make(map[string]interface{})
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, errors.New("output is not a JSON object: " + err.Error())
+	}
+	return result, nil
+}
+
+// Returns the plugin described by a PluginConfig.
+func newPlugin(config PluginConfig) (CheckpointPlugin, error) {
+	if validMetaKey(config.Name) == false {
+		return nil, errors.New("Bad plugin name: " + config.Name)
+	}
+	if (len(config.Command) == 0) == (config.Path == "") {
+		return nil, errors.New("Plugin " + config.Name + " needs exactly one of Command and Path")
+	}
+	if config.Path == "" {
+		timeout := config.Timeout
+		if timeout <= 0 {
+			timeout = PLUGIN_TIMEOUT
+		}
+		return &commandPlugin{config.Command, time.Duration(timeout) * time.Second}, nil
+	}
+	p, err := plugin.Open(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	symbol, err := p.Lookup("Plugin")
+	if err != nil {
+		return nil, err
+	}
+	analyzer, ok := symbol.(CheckpointPlugin)
+	if ok == false {
+		return nil, errors.New("Plugin " + config.Name + " does not implement CheckpointPlugin")
+	}
+	return analyzer, nil
+}
+
+// Load the plugins of the configuration.
+func (app *Application) loadPlugins(configs []PluginConfig) error {
+	for _, config := range configs {
+		p, err := newPlugin(config)
+		if err != nil {
+			return err
+		}
+		app.RegisterPlugin(config.Name, config.Targets, p)
+	}
+	return nil
+}
+
+// Run a plugin on the checkpoints of the given targets, or of every target if
+// there are none. Plugins must be registered before the SCV is run.
+func (app *Application) RegisterPlugin(name string, targets []string, p CheckpointPlugin) {
+	registered := &registeredPlugin{name: name, plugin: p}
+	if len(targets) > 0 {
+		registered.targets = make(map[string]struct{})
+		for _, targetId := range targets {
+			registered.targets[targetId] = struct{}{}
+		}
+	}
+	app.plugins = append(app.plugins, registered)
+}
+
+// Queue a checkpoint for the plugins of its target. Checkpoints are dropped if
+// the plugins are too far behind.
+func (app *Application) analyzeCheckpoint(c CheckpointInfo) {
+	for _, p := range app.plugins {
+		if p.targets != nil {
+			if _, ok := p.targets[c.TargetId]; ok == false {
+				continue
+			}
+		}
+		select {
+		case app.pluginQueue <- pluginJob{p, c}:
+		default:
+			log.Println("Plugin queue full, skipping " + p.name + " of stream " + c.StreamId)
+		}
+	}
+}
+
+// Store the results of a plugin in the meta of a stream.
+func (app *Application) storePluginResult(streamId, name string, result map[string]interface{}) error {
+	return app.Manager.ModifyStream(streamId, func(stream *Stream) error {
+		meta := mergeMeta(stream.Meta, map[string]interface{}{name: result})
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		if len(data) > MAX_META_BYTES {
+			return ErrTooLarge.With("Metadata may not exceed 16384 bytes")
+		}
+		if err := app.Database.UpdateStream(streamId, bson.M{"meta." + name: result}, nil); err != nil {
+			return err
+		}
+		stream.Meta = meta
+		return nil
+	})
+}
+
+// A separate goroutine that runs the plugins on the queued checkpoints with
+// PluginWorkers goroutines.
+func (app *Application) RunPlugins() {
+	defer app.workerWG.Done()
+	workers := app.Config.PluginWorkers
+	if workers <= 0 {
+		workers = PLUGIN_WORKERS
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-app.finish:
+					return
+				case job := <-app.pluginQueue:
+					result, err := job.plugin.plugin.Analyze(job.info)
+					if err == nil {
+						err = app.storePluginResult(job.info.StreamId, job.plugin.name, result)
+					}
+					if err != nil {
+						log.Println("Plugin "+job.plugin.name+" failed on stream "+job.info.StreamId+":", err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,82 @@
+package scv
+
+import (
+	"../manager"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type framesPlugin struct{}
+
+func (p *framesPlugin) Analyze(c CheckpointInfo) (map[string]interface{}, error) {
+	if c.Frames == 0 {
+		return nil, errors.New("no frames")
+	}
+	return map[string]interface{}{"frames": c.Frames}, nil
+}
+
+func TestCommandPlugin(t *testing.T) {
+	p, err := newPlugin(PluginConfig{Name: "rmsd", Command: []string{"sh", "-c", `echo "{\"stream\": \"$SCV_STREAM_ID\", \"dir\": \"$0\"}"`}})
+	assert.Nil(t, err)
+	result, err := p.Analyze(CheckpointInfo{StreamId: "s1", TargetId: "t1", Partition: "/data/s1/5/0", Frames: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, result, map[string]interface{}{"stream": "s1", "dir": "/data/s1/5/0"})
+	p, _ = newPlugin(PluginConfig{Name: "bad", Command: []string{"echo", "not json"}})
+	_, err = p.Analyze(CheckpointInfo{})
+	assert.NotNil(t, err)
+
+	_, err = newPlugin(PluginConfig{Name: "a.b", Command: []string{"true"}})
+	assert.NotNil(t, err)
+	_, err = newPlugin(PluginConfig{Name: "both", Command: []string{"true"}, Path: "plugin.so"})
+	assert.NotNil(t, err)
+}
+
+func TestRunPlugins(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "plugins")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(dir, "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{
+		Database:    db,
+		Manager:     manager.NewManager(intf),
+		finish:      make(chan struct{}),
+		pluginQueue: make(chan pluginJob, PLUGIN_QUEUE_SIZE),
+	}
+	app.RegisterPlugin("progress", []string{"t1"}, &framesPlugin{})
+	stream := newStream("s1", "t1", "none", 5, 0, int(time.Now().Unix()))
+	app.Manager.AddStream(stream, "t1", true)
+	assert.Nil(t, db.InsertStream(bson.M{"_id": "s1", "target_id": "t1", "status": "enabled"}))
+
+	app.analyzeCheckpoint(CheckpointInfo{StreamId: "s1", TargetId: "t2", Frames: 5})
+	assert.Equal(t, len(app.pluginQueue), 0)
+	app.analyzeCheckpoint(CheckpointInfo{StreamId: "s1", TargetId: "t1", Frames: 5})
+	app.workerWG.Add(1)
+	go app.RunPlugins()
+	for i := 0; i < 500; i++ {
+		var meta map[string]interface{}
+		app.Manager.ReadStream("s1", func(s *Stream) error {
+			meta = s.Meta
+			return nil
+		})
+		if meta != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(app.finish)
+	app.workerWG.Wait()
+	app.Manager.ReadStream("s1", func(s *Stream) error {
+		assert.Equal(t, s.Meta["progress"], map[string]interface{}{"frames": 5})
+		return nil
+	})
+	doc := bson.M{}
+	assert.Nil(t, db.FindStream("s1", &doc))
+	assert.Equal(t, doc["meta"], bson.M{"progress": bson.M{"frames": 5}})
+}
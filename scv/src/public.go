@@ -0,0 +1,51 @@
+package scv
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Directories of a stream that are not published along with its frames: the
+// logs of its cores and the frames they buffered since their last checkpoint.
+var PRIVATE_STREAM_DIRS = []string{"logs", "buffer_files", RECOVERED_BUFFER}
+
+/*
+Returns true if the trajectories of a target are published, as set by its
+public_data option. Anyone may then sync and download its streams without
+authentication, rate limited as anonymous requests, while every other route
+still requires a manager. Unlike the public stage of a target, which lets any
+donor simulate it, this does not change who may run its streams.
+*/
+func (app *Application) publicData(targetId string) bool {
+	options, err := app.targetOptions(targetId)
+	if err != nil {
+		return false
+	}
+	return optionBool(options, "public_data", false)
+}
+
+/*
+Check that user may read a stream: a manager of the stream, or anyone if its
+target publishes its data. authErr is the error authenticating the request, if
+it failed or was anonymous, and is returned if the stream is not public.
+Returns true if the stream is only readable as public data.
+*/
+func (app *Application) checkRead(user string, authErr error, s *Stream) (public bool, err error) {
+	if authErr == nil && app.canManage(user, s) {
+		return false, nil
+	}
+	if app.publicData(s.TargetId) {
+		return true, nil
+	}
+	if authErr != nil {
+		return false, authErr
+	}
+	return false, ErrForbidden.With("You do not own this stream.")
+}
+
+// Returns true if a file of a stream, relative to its directory, is kept from
+// the public, see PRIVATE_STREAM_DIRS.
+func privateStreamFile(file string) bool {
+	dir := strings.Split(filepath.ToSlash(filepath.Clean(file)), "/")[0]
+	return containsString(PRIVATE_STREAM_DIRS, dir)
+}
@@ -0,0 +1,95 @@
+package scv
+
+import (
+	"../manager"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublicData(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "public")
+	defer os.RemoveAll(dir)
+	db := &fakeDatabase{
+		managers: map[string]map[string]interface{}{"yutong": {}, "diwakar": {}},
+		tokens: []APIToken{
+			{Id: "1", Token: "yutong_token", User: "yutong"},
+			{Id: "2", Token: "diwakar_token", User: "diwakar"},
+		},
+		targets: map[string]map[string]interface{}{
+			"open":   {"owner": "yutong", "options": map[string]interface{}{"public_data": true}},
+			"closed": {"owner": "yutong"},
+		},
+	}
+	app := &Application{
+		Config:       Configuration{Name: filepath.Join(dir, "scv")},
+		Database:     db,
+		Manager:      manager.NewManager(intf),
+		tokenCache:   NewTokenCache(time.Minute),
+		optionsCache: NewResultCache(time.Minute),
+	}
+	for _, id := range []string{"open", "closed"} {
+		app.Manager.AddStream(newStream(id, id, "yutong", 0, 0, 0), id, true)
+		os.MkdirAll(filepath.Join(app.StreamDir(id), "files"), 0776)
+		os.MkdirAll(filepath.Join(app.StreamDir(id), "logs", "1000"), 0776)
+		ioutil.WriteFile(filepath.Join(app.StreamDir(id), "files", "state.xml"), []byte("state"), 0666)
+		ioutil.WriteFile(filepath.Join(app.StreamDir(id), "logs", "1000", "core.log"), []byte("log"), 0666)
+	}
+	assert.True(t, app.publicData("open"))
+	assert.False(t, app.publicData("closed"))
+	assert.False(t, app.publicData("unknown"))
+	assert.True(t, privateStreamFile(filepath.Join("files", "..", "logs", "1000", "core.log")))
+	assert.True(t, privateStreamFile(filepath.Join(RECOVERED_BUFFER, "frames.xtc")))
+	assert.False(t, privateStreamFile(filepath.Join("12", "0", "frames.xtc")))
+
+	router := mux.NewRouter()
+	router.Handle("/streams/sync/{stream_id}", app.ScopeMiddleware(SCOPE_DOWNLOAD, false, app.StreamSyncHandler()))
+	router.Handle("/streams/download/{stream_id}/{file:.+}", app.ScopeMiddleware(SCOPE_DOWNLOAD, false, app.StreamDownloadHandler()))
+	serve := func(url, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	sync := func(streamId, token string) (SyncReply, int) {
+		w := serve("/streams/sync/"+streamId, token)
+		reply := SyncReply{}
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return reply, w.Code
+	}
+
+	// anyone may read the streams of targets with public data, but not their logs
+	for _, token := range []string{"", "diwakar_token", "bad_token"} {
+		reply, code := sync("open", token)
+		assert.Equal(t, code, 200)
+		assert.Equal(t, reply.SeedFiles, []string{"state.xml"})
+		assert.Equal(t, len(reply.LogFiles), 0)
+		assert.Equal(t, serve("/streams/download/open/files/state.xml", token).Body.String(), "state")
+		assert.Equal(t, serve("/streams/download/open/logs/1000/core.log", token).Code, 403)
+	}
+	reply, code := sync("open", "yutong_token")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, reply.LogFiles, []string{filepath.Join("logs", "1000", "core.log")})
+	assert.Equal(t, serve("/streams/download/open/logs/1000/core.log", "yutong_token").Body.String(), "log")
+
+	// other streams still require their managers
+	_, code = sync("closed", "")
+	assert.Equal(t, code, 401)
+	_, code = sync("closed", "diwakar_token")
+	assert.Equal(t, code, 403)
+	_, code = sync("closed", "yutong_token")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, serve("/streams/download/closed/files/state.xml", "").Code, 401)
+	assert.Equal(t, serve("/streams/download/closed/files/state.xml", "diwakar_token").Code, 403)
+}
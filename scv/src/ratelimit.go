@@ -0,0 +1,180 @@
+package scv
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A token bucket refilled at Rate requests per second, holding at most Burst
+// requests.
+type RateLimit struct {
+	Rate  float64 `json:"Rate"`
+	Burst int     `json:"Burst"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps one token bucket per key (eg. a token or an IP address).
+type RateLimiter struct {
+	sync.Mutex
+	limit    RateLimit
+	buckets  map[string]*tokenBucket
+	calls    int
+	rejected int64
+}
+
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *RateLimiter) SetLimit(limit RateLimit) {
+	l.Lock()
+	defer l.Unlock()
+	l.limit = limit
+}
+
+// Take a token from key's bucket. If the bucket is empty, returns false and
+// how long the caller should wait before retrying. A limiter with a zero rate
+// lets everything through.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	return l.AllowN(key, 1)
+}
+
+// Like Allow, but takes n tokens. A request costing more than the burst is let
+// through once the bucket is full, leaving it in debt until it refills.
+func (l *RateLimiter) AllowN(key string, n float64) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if l.limit.Rate <= 0 {
+		return true, 0
+	}
+	burst := math.Max(float64(l.limit.Burst), 1)
+	now := time.Now()
+	// periodically forget about buckets that have refilled completely.
+	l.calls += 1
+	if l.calls%4096 == 0 {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate >= burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b, ok := l.buckets[key]
+	if ok == false {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+	need := math.Min(n, burst)
+	if b.tokens >= need {
+		b.tokens -= n
+		return true, 0
+	}
+	l.rejected += 1
+	wait := (need - b.tokens) / l.limit.Rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// Give back n tokens taken by AllowN, eg. when another limit rejected the
+// request after this one let it through.
+func (l *RateLimiter) Refund(key string, n float64) {
+	l.Lock()
+	defer l.Unlock()
+	if b, ok := l.buckets[key]; ok {
+		b.tokens = math.Min(math.Max(float64(l.limit.Burst), 1), b.tokens+n)
+	}
+}
+
+func (l *RateLimiter) Metrics() map[string]interface{} {
+	l.Lock()
+	defer l.Unlock()
+	return map[string]interface{}{
+		"rate":     l.limit.Rate,
+		"burst":    l.limit.Burst,
+		"buckets":  len(l.buckets),
+		"rejected": l.rejected,
+	}
+}
+
+// Classes of clients with separate rate limit budgets, used as keys of
+// Configuration.RateLimits.
+const (
+	RATE_CORE      string = "core"
+	RATE_MANAGER   string = "manager"
+	RATE_ANONYMOUS string = "anonymous"
+)
+
+func newRateLimiters(limits map[string]RateLimit) map[string]*RateLimiter {
+	limiters := make(map[string]*RateLimiter)
+	for _, class := range []string{RATE_CORE, RATE_MANAGER, RATE_ANONYMOUS} {
+		limiters[class] = NewRateLimiter(limits[class])
+	}
+	return limiters
+}
+
+/*
+Middleware limiting the request rate of the /core and /streams routes. Cores
+are identified by their Authorization token and managers by their user, once
+the token is validated. Anonymous requests, and those with a token that is not
+valid, are identified by their IP address, so that sending a new token on every
+request does not get a new budget. Each class has its own budget. Requests made
+by the CC are never limited. Rejected requests get a 429 with a Retry-After
+header.
+*/
+func (app *Application) RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if strings.HasPrefix(path, "/core/") == false && strings.HasPrefix(path, "/streams") == false {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if app.isCC(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := r.Header.Get("Authorization")
+		class, key := RATE_ANONYMOUS, ""
+		if token == "" {
+			// anonymous
+		} else if strings.HasPrefix(path, "/core/") {
+			if app.Manager.IsActiveToken(token) || app.verifications.has(token) {
+				class = RATE_CORE
+				// don't keep raw credentials around as map keys
+				h := md5.Sum([]byte(token))
+				key = hex.EncodeToString(h[:])
+			}
+		} else if identity, err := app.tokenIdentity(token); err == nil {
+			class, key = RATE_MANAGER, identity.User
+		}
+		if class == RATE_ANONYMOUS {
+			key, _, _ = net.SplitHostPort(r.RemoteAddr)
+			if key == "" {
+				key = r.RemoteAddr
+			}
+		}
+		ok, wait := app.rateLimiters[class].Allow(key)
+		if ok == false {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			code := writeError(w, r, ErrTooManyRequests)
+			log.Printf("%s %s %s %s %d", r.RemoteAddr, requestId(r), r.Method, r.URL, code)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,105 @@
+package scv
+
+import (
+	"../manager"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(RateLimit{Rate: 10, Burst: 2})
+	ok, _ := l.Allow("a")
+	assert.True(t, ok)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+	ok, wait := l.Allow("a")
+	assert.False(t, ok)
+	assert.True(t, wait > 0 && wait <= 100*time.Millisecond)
+	// buckets are independent
+	ok, _ = l.Allow("b")
+	assert.True(t, ok)
+	time.Sleep(wait + 10*time.Millisecond)
+	ok, _ = l.Allow("a")
+	assert.True(t, ok)
+	assert.Equal(t, l.Metrics()["rejected"], int64(1))
+
+	unlimited := NewRateLimiter(RateLimit{})
+	for i := 0; i < 100; i++ {
+		ok, _ = unlimited.Allow("a")
+		assert.True(t, ok)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	app := &Application{
+		Config:   Configuration{Password: "cc_pass"},
+		Database: &fakeDatabase{tokens: []APIToken{{Id: "1", Token: "manager_token", User: "yutong"}}},
+		Manager:  manager.NewManager(intf),
+		rateLimiters: newRateLimiters(map[string]RateLimit{
+			RATE_CORE:      {Rate: 0.001, Burst: 1},
+			RATE_ANONYMOUS: {Rate: 0.001, Burst: 2},
+		}),
+		tokenCache:    NewTokenCache(time.Minute),
+		verifications: newVerificationQueue(),
+	}
+	app.Manager.AddStream(newStream("s1", "target", "yutong", 0, 0, 0), "target", true)
+	app.Manager.AddStream(newStream("s2", "target", "yutong", 0, 0, 0), "target", true)
+	core1, _, err := app.Manager.ActivateStream("target", "joe", "openmm", mockFunc)
+	assert.Nil(t, err)
+	core2, _, err := app.Manager.ActivateStream("target", "joe", "openmm", mockFunc)
+	assert.Nil(t, err)
+	handler := app.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(path, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", path, nil)
+		req.Header.Add("Authorization", token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, serve("/core/frame", core1).Code, 200)
+	w := serve("/core/frame", core1)
+	assert.Equal(t, w.Code, 429)
+	assert.NotEqual(t, w.HeaderMap.Get("Retry-After"), "")
+	assert.Equal(t, serve("/core/frame", core2).Code, 200)
+	// managers and the CC have separate budgets
+	assert.Equal(t, serve("/streams/info/abc", "manager_token").Code, 200)
+	assert.Equal(t, serve("/streams/activate", "cc_pass").Code, 200)
+}
+
+func TestRateLimitBogusTokens(t *testing.T) {
+	app := &Application{
+		Database: &fakeDatabase{},
+		Manager:  manager.NewManager(intf),
+		rateLimiters: newRateLimiters(map[string]RateLimit{
+			RATE_CORE:      {Rate: 1, Burst: 100},
+			RATE_MANAGER:   {Rate: 1, Burst: 100},
+			RATE_ANONYMOUS: {Rate: 0.001, Burst: 2},
+		}),
+		tokenCache:    NewTokenCache(time.Minute),
+		verifications: newVerificationQueue(),
+	}
+	handler := app.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(path, token string) int {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Add("Authorization", token)
+		req.RemoteAddr = "10.0.0.1:5000"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	// a new token on every request still spends the budget of the address
+	assert.Equal(t, serve("/streams/sync/s1", "bogus1"), 200)
+	assert.Equal(t, serve("/core/frame", "bogus2"), 200)
+	for i := 3; i < 20; i++ {
+		assert.Equal(t, serve("/streams/sync/s1", "bogus"+strconv.Itoa(i)), 429)
+		assert.Equal(t, serve("/core/frame", "bogus"+strconv.Itoa(i)), 429)
+	}
+	assert.Equal(t, app.rateLimiters[RATE_ANONYMOUS].Metrics()["buckets"], 1)
+	assert.Equal(t, app.rateLimiters[RATE_MANAGER].Metrics()["buckets"], 0)
+	assert.Equal(t, app.rateLimiters[RATE_CORE].Metrics()["buckets"], 0)
+}
@@ -0,0 +1,199 @@
+package scv
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Seconds between two passes of the reaper when it is not woken up by a
+// deletion.
+const REAP_INTERVAL int = 600
+
+// The Mongo document of a deleted stream.
+type tombstone struct {
+	Status        string `bson:"status"`
+	Deleted       int    `bson:"deleted"`        // unix time of the deletion
+	DeletedBy     string `bson:"deleted_by"`     // manager who deleted the stream
+	DeletedStatus string `bson:"deleted_status"` // status before the deletion
+	Namespace     string `bson:"namespace"`
+}
+
+// Return a path indicating where the files of a deleted stream are kept until
+// they are purged.
+func (app *Application) TrashDir(streamId string) string {
+	return filepath.Join(app.Config.Name+"_data", "trash", streamId)
+}
+
+func trashRetention(days int) int {
+	if days <= 0 {
+		return 0
+	}
+	return days * 86400
+}
+
+/*
+Remove the files and documents of deleted streams. Deleting a stream only
+marks its document as a tombstone, since removing gigabytes of frames can take a
+while. Tombstones are kept until the files are gone, so that a deletion
+interrupted by a restart is completed by the next pass. If TrashDays is set,
+the files are first moved to the trash and only purged once the retention
+window has passed.
+*/
+func (app *Application) ReapStreams() error {
+	tombstones, err := app.Database.DeletedStreams()
+	if err != nil {
+		return err
+	}
+	retention := trashRetention(app.Settings().TrashDays)
+	now := int(time.Now().Unix())
+	for _, streamId := range tombstones {
+		if err := app.reapStream(streamId, retention, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *Application) reapStream(streamId string, retention, now int) error {
+	app.reapMutex.Lock()
+	defer app.reapMutex.Unlock()
+	t := tombstone{}
+	if err := app.Database.FindStream(streamId, &t); err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if t.Status != "deleted" {
+		// undeleted since the pass started
+		return nil
+	}
+	if now < t.Deleted+retention {
+		exists, err := pathExists(app.StreamDir(streamId))
+		if err != nil || exists == false {
+			return err
+		}
+		os.MkdirAll(filepath.Dir(app.TrashDir(streamId)), 0776)
+		return os.Rename(app.StreamDir(streamId), app.TrashDir(streamId))
+	}
+	if err := os.RemoveAll(app.StreamDir(streamId)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(app.TrashDir(streamId)); err != nil {
+		return err
+	}
+	return app.Database.RemoveStream(streamId)
+}
+
+// Wake up the reaper without waiting for it.
+func (app *Application) wakeReaper() {
+	select {
+	case app.reap <- struct{}{}:
+	default:
+	}
+}
+
+// A separate goroutine that removes deleted streams.
+func (app *Application) RunReaper() {
+	defer app.workerWG.Done()
+	for {
+		if err := app.ReapStreams(); err != nil {
+			log.Println("Unable to reap deleted streams:", err)
+		}
+		select {
+		case <-app.finish:
+			return
+		case <-app.reap:
+		case <-time.After(time.Duration(REAP_INTERVAL) * time.Second):
+		}
+	}
+}
+
+/*
+Restore a deleted stream whose files have not been purged yet. Only the manager
+who deleted the stream may restore it. The stream gets back the status it had
+when it was deleted.
+*/
+func (app *Application) UndeleteStream(streamId, user string) error {
+	app.reapMutex.Lock()
+	defer app.reapMutex.Unlock()
+	t := tombstone{}
+	if err := app.Database.FindStream(streamId, &t); err == ErrNotFound {
+		return ErrNotFound.With("stream " + streamId + " does not exist")
+	} else if err != nil {
+		return err
+	}
+	if t.Status != "deleted" {
+		return ErrConflict.With("stream " + streamId + " is not deleted")
+	}
+	if app.authorized(user, t.DeletedBy, t.Namespace) == false {
+		return ErrForbidden.With("You do not own this stream.")
+	}
+	inTrash, err := pathExists(app.TrashDir(streamId))
+	if err != nil {
+		return err
+	}
+	if inTrash {
+		if err := os.Rename(app.TrashDir(streamId), app.StreamDir(streamId)); err != nil {
+			return err
+		}
+	} else if exists, _ := pathExists(app.StreamDir(streamId)); exists == false {
+		return ErrNotFound.With("stream " + streamId + " has been purged")
+	}
+	status := t.DeletedStatus
+	if status != "disabled" && status != "quarantined" {
+		status = "enabled"
+	}
+	partitions, err := app.ListPartitions(streamId)
+	if err != nil {
+		return err
+	}
+	frames := 0
+	if len(partitions) > 0 {
+		frames = partitions[len(partitions)-1]
+	}
+	err = app.Database.UpdateStream(streamId,
+		bson.M{"status": status, "frames": frames},
+		bson.M{"deleted": "", "deleted_by": "", "deleted_status": ""})
+	if err != nil {
+		return err
+	}
+	stream := &Stream{}
+	if err := app.Database.FindStream(streamId, stream); err != nil {
+		return err
+	}
+	stream.Data = &streamState{hydrated: true}
+	if err := app.Manager.AddStream(stream, stream.TargetId, status == "enabled"); err != nil {
+		return err
+	}
+	app.addShard(stream.TargetId)
+	if stream.Namespace != "" {
+		app.usage.SetNamespace(streamId, stream.Namespace)
+	}
+	app.usage.Add(stream.TargetId, streamId, dirSize(app.StreamDir(streamId)))
+	app.events.Publish(NewEvent(EVENT_UNDELETED, stream, nil))
+	return nil
+}
+
+/*
+.. http:post:: /streams/undelete/:stream_id
+    Restore a stream deleted less than ``TrashDays`` days ago. The
+    stream is restored with the status it had when it was deleted.
+    :reqheader Authorization: Manager's authorization token
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) StreamUndeleteHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		return app.UndeleteStream(mux.Vars(r)["stream_id"], user)
+	}
+}
@@ -0,0 +1,57 @@
+package scv
+
+import (
+	"net/http"
+)
+
+// Header carrying the id of a request. The CC sets it when it calls the SCV on
+// behalf of a donor so that both logs can be correlated.
+const REQUEST_ID_HEADER string = "X-Request-ID"
+
+// Longest request id accepted from a client.
+const MAX_REQUEST_ID_LENGTH int = 128
+
+func validRequestId(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' && c != '.' && c != ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the id of a request, set by RequestIDMiddleware.
+func requestId(r *http.Request) string {
+	return r.Header.Get(REQUEST_ID_HEADER)
+}
+
+// Middleware giving every request an id, taken from the X-Request-ID header if
+// the client sent a valid one. The id is echoed in the reply and logged by
+// AppHandler.
+func (app *Application) RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if validRequestId(id) == false {
+			id = RandSeq(16)
+			r.Header.Set(REQUEST_ID_HEADER, id)
+		}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wraps a function modifying an active stream so that the id of the request
+// is kept on the stream if it fails. The id ends up in the stats recorded when
+// the stream is deactivated.
+func recordFailure(r *http.Request, fn func(*Stream) error) func(*Stream) error {
+	return func(s *Stream) error {
+		err := fn(s)
+		if err != nil && s.ActiveStream != nil {
+			sessionData(s).requests["failed"] = requestId(r)
+		}
+		return err
+	}
+}
@@ -0,0 +1,39 @@
+package scv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	assert.True(t, validRequestId("cc-1:4f2a.b_9"))
+	assert.False(t, validRequestId(""))
+	assert.False(t, validRequestId("a b"))
+	assert.False(t, validRequestId(strings.Repeat("a", MAX_REQUEST_ID_LENGTH+1)))
+
+	app := &Application{}
+	seen := ""
+	handler := app.RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestId(r)
+	}))
+
+	// the id sent by the CC is kept
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set(REQUEST_ID_HEADER, "cc-1234")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, seen, "cc-1234")
+	assert.Equal(t, w.Header().Get(REQUEST_ID_HEADER), "cc-1234")
+
+	// invalid ids are replaced
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set(REQUEST_ID_HEADER, "bad id\n")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, len(seen), 16)
+	assert.Equal(t, w.Header().Get(REQUEST_ID_HEADER), seen)
+}
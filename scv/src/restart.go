@@ -0,0 +1,335 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var errCheckpointNotFound = ErrNotFound.With("Checkpoint not found")
+
+// Returned by readCheckpoint when a file does not match its manifest.
+var errCheckpointCorrupted = errors.New("Checkpoint is corrupted")
+
+// A checkpoint of a stream a core can restart from: directory checkpoint of
+// partition. Partition 0 stands for the seed files.
+type RestartPoint struct {
+	Partition  int `json:"partition"`
+	Checkpoint int `json:"checkpoint"`
+}
+
+// Read the checkpoint files of a restart point, checking them against the
+// manifest of their directory. Callers that do not hold the stream's lock must
+// check that its files did not change meanwhile, see streamState.generation.
+func (app *Application) readCheckpoint(streamId string, point RestartPoint) (map[string]string, error) {
+	checksumDir := filepath.Join(app.StreamDir(streamId), strconv.Itoa(point.Partition), strconv.Itoa(point.Checkpoint))
+	checkpointDir := filepath.Join(checksumDir, "checkpoint_files")
+	checkpointFiles, e := ioutil.ReadDir(checkpointDir)
+	if e != nil {
+		return nil, fmt.Errorf("Cannot load checkpoint directory: %w", e)
+	}
+	files := make(map[string]string)
+	for _, fileProp := range checkpointFiles {
+		binary, e := ioutil.ReadFile(filepath.Join(checkpointDir, fileProp.Name()))
+		if e != nil {
+			return nil, fmt.Errorf("Cannot read checkpoint file: %w", e)
+		}
+		if e := verifyChecksum(checksumDir, "checkpoint_files/"+fileProp.Name(), binary); e != nil {
+			log.Println("Corrupted checkpoint:", e)
+			return nil, errCheckpointCorrupted
+		}
+		files[fileProp.Name()] = string(binary)
+	}
+	return files, nil
+}
+
+/*
+Returns the checkpoint files a core starts the stream from, or nil if the
+stream has no frames and starts from its seed files. The last checkpoint is
+used unless it is corrupted, in which case the stream falls back to the most
+recent intact checkpoint before it, and is rewound to it. Other errors, such as
+a checkpoint that cannot be read, are returned as they may be temporary. The
+stream must be locked for writing, and may only fall back before its core
+posted frames.
+*/
+func (app *Application) restartFiles(s *Stream) (map[string]string, error) {
+	if s.Frames == 0 {
+		return nil, nil
+	}
+	lastCheckpoint, _ := app.lastCheckpoint(s, s.Frames)
+	files, err := app.readCheckpoint(s.StreamId, RestartPoint{s.Frames, lastCheckpoint})
+	if errors.Is(err, errCheckpointCorrupted) == false {
+		return files, err
+	}
+	if s.ActiveStream != nil && s.ActiveStream.BufferFrames > 0 {
+		return nil, err
+	}
+	partitions, e := app.streamPartitions(s)
+	if e != nil {
+		return nil, e
+	}
+	streamDir := app.StreamDir(s.StreamId)
+	for i := len(partitions) - 1; i >= 0; i-- {
+		checkpoints, e := retainedCheckpoints(filepath.Join(streamDir, strconv.Itoa(partitions[i])))
+		if e != nil {
+			return nil, e
+		}
+		for j := len(checkpoints) - 1; j >= 0; j-- {
+			point := RestartPoint{partitions[i], checkpoints[j]}
+			if point.Partition == s.Frames && point.Checkpoint >= lastCheckpoint {
+				continue
+			}
+			fallback, e := app.readCheckpoint(s.StreamId, point)
+			if errors.Is(e, errCheckpointCorrupted) {
+				continue
+			} else if e != nil {
+				return nil, e
+			}
+			log.Printf("Checkpoint %d/%d of stream %s is unusable, falling back to %d/%d",
+				s.Frames, lastCheckpoint, s.StreamId, point.Partition, point.Checkpoint)
+			if e := app.rewindStream(s, point, err.Error()); e != nil {
+				return nil, e
+			}
+			return fallback, nil
+		}
+	}
+	return nil, err
+}
+
+/*
+Make a restart point the last checkpoint of a stream: the partitions after it,
+and the checkpoint directories of its partition after it, are deleted. The
+frames of the deleted partitions are lost, but stay credited to their donors.
+Restart points in archived partitions cannot be used. The stream must be locked
+for writing and must not have buffered frames.
+*/
+func (app *Application) rewindStream(s *Stream, point RestartPoint, reason string) error {
+	partitions, err := app.streamPartitions(s)
+	if err != nil {
+		return err
+	}
+	streamDir := app.StreamDir(s.StreamId)
+	if point.Partition == 0 {
+		archives, err := app.ListArchives(s.StreamId)
+		if err != nil {
+			return err
+		}
+		if len(archives) > 0 {
+			return ErrConflict.With("Partitions of the stream are archived")
+		}
+	} else {
+		checkpoints, err := retainedCheckpoints(filepath.Join(streamDir, strconv.Itoa(point.Partition)))
+		if err != nil {
+			return errCheckpointNotFound
+		}
+		found := false
+		for _, checkpoint := range checkpoints {
+			found = found || checkpoint == point.Checkpoint
+		}
+		if found == false {
+			return errCheckpointNotFound
+		}
+	}
+	defer streamData(s).index.invalidate()
+	streamData(s).filesChanged()
+	var removed int64
+	for _, partition := range partitions {
+		if partition <= point.Partition {
+			continue
+		}
+		partitionDir := filepath.Join(streamDir, strconv.Itoa(partition))
+		removed += dirSize(partitionDir)
+		if err := os.RemoveAll(partitionDir); err != nil {
+			app.usage.Add(s.TargetId, s.StreamId, -removed)
+			return err
+		}
+	}
+	if point.Partition > 0 {
+		partitionDir := filepath.Join(streamDir, strconv.Itoa(point.Partition))
+		checkpoints, err := listCheckpoints(partitionDir)
+		if err != nil {
+			return err
+		}
+		for _, checkpoint := range checkpoints {
+			if checkpoint > point.Checkpoint {
+				checkpointDir := filepath.Join(partitionDir, strconv.Itoa(checkpoint))
+				removed += dirSize(checkpointDir)
+				os.RemoveAll(checkpointDir)
+			}
+		}
+	}
+	app.usage.Add(s.TargetId, s.StreamId, -removed)
+	frames := s.Frames
+	s.Frames = point.Partition
+	if s.ActiveStream != nil {
+		s.ActiveStream.StartFrames = s.Frames
+	}
+	app.events.Publish(NewEvent(EVENT_REWOUND, s, map[string]interface{}{
+		"frames":     s.Frames,
+		"checkpoint": point.Checkpoint,
+		"discarded":  frames - s.Frames,
+		"reason":     reason,
+	}))
+	return app.Database.UpdateStream(s.StreamId, bson.M{"frames": s.Frames}, nil)
+}
+
+/*
+.. http:put:: /admin/streams/:stream_id/restart
+    Pin the checkpoint the stream restarts from. Every frame after
+    ``partition`` and every checkpoint of ``partition`` after
+    ``checkpoint`` is deleted, so that the next ``/core/start`` hands out
+    this checkpoint. Partition 0 restarts the stream from its seed files.
+    .. note:: This request can only be made by CCs.
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "partition": 120,
+            "checkpoint": 0
+        }
+    :status 200: OK
+    :status 400: Bad request
+    :status 401: Not authenticated as a CC
+    :status 404: Stream or checkpoint not found, checkpoints of archived
+        partitions cannot be pinned
+    :status 409: Stream is active, or partition is 0 and the stream has
+        archives
+*/
+func (app *Application) StreamRestartHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if app.isCC(r) == false {
+			return ErrUnauthorized
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		point := RestartPoint{}
+		if err := json.NewDecoder(r.Body).Decode(&point); err != nil {
+			return errors.New("Bad request: " + err.Error())
+		}
+		if point.Partition < 0 || point.Checkpoint < 0 {
+			return errors.New("partition and checkpoint must not be negative")
+		}
+		e := app.Manager.ModifyStream(streamId, func(stream *Stream) error {
+			if stream.ActiveStream != nil {
+				return ErrConflict.With("Stream is active")
+			}
+			if err := app.hydrateStream(stream); err != nil {
+				return err
+			}
+			if point.Partition > stream.Frames {
+				return errCheckpointNotFound
+			}
+			return app.rewindStream(stream, point, "pinned")
+		})
+		if e != nil {
+			return e
+		}
+		data, err := json.Marshal(point)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+// Returns the most recent restart point of a stream whose partition is at
+// most frames, or partition 0 if there is none. The stream must be locked.
+func (app *Application) restartPointBefore(s *Stream, frames int) (RestartPoint, error) {
+	partitions, err := app.streamPartitions(s)
+	if err != nil {
+		return RestartPoint{}, err
+	}
+	for i := len(partitions) - 1; i >= 0; i-- {
+		if partitions[i] > frames {
+			continue
+		}
+		checkpoints, err := retainedCheckpoints(filepath.Join(app.StreamDir(s.StreamId), strconv.Itoa(partitions[i])))
+		if err != nil {
+			return RestartPoint{}, err
+		}
+		if len(checkpoints) > 0 {
+			return RestartPoint{partitions[i], checkpoints[len(checkpoints)-1]}, nil
+		}
+	}
+	return RestartPoint{}, nil
+}
+
+/*
+.. http:put:: /streams/truncate/:stream_id
+    Discard the frames of a stream after ``frames``, eg. because the
+    simulation went unstable. Frames are discarded a partition at a time:
+    the stream is rewound to its last partition of at most ``frames``
+    frames that still has a checkpoint, which the next ``/core/start``
+    hands out. With ``frames`` set to 0, the stream restarts from its
+    seed files.
+    :reqheader Authorization: Manager's authorization token
+    **Example request**:
+    .. sourcecode:: javascript
+        {
+            "frames": 125
+        }
+    **Example reply**:
+    .. sourcecode:: javascript
+        {
+            "partition": 120, // frames of the stream
+            "checkpoint": 0
+        }
+    :status 200: OK
+    :status 400: Bad request
+    :status 401: Not authenticated
+    :status 403: You do not own this stream
+    :status 404: Stream not found
+    :status 409: Stream is active, or the frames kept are archived
+*/
+func (app *Application) StreamTruncateHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		msg := struct {
+			Frames *int `json:"frames"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return errors.New("Could not decode JSON")
+		}
+		if msg.Frames == nil || *msg.Frames < 0 {
+			return errors.New("frames must be given and not be negative")
+		}
+		var point RestartPoint
+		e := app.Manager.ModifyStream(streamId, func(stream *Stream) error {
+			if app.canManage(user, stream) == false {
+				return ErrForbidden.With("You do not own this stream.")
+			}
+			if stream.ActiveStream != nil {
+				return ErrConflict.With("Stream is active")
+			}
+			if err := app.hydrateStream(stream); err != nil {
+				return err
+			}
+			var err error
+			if point, err = app.restartPointBefore(stream, *msg.Frames); err != nil {
+				return err
+			}
+			return app.rewindStream(stream, point, "truncated by "+user)
+		})
+		if e != nil {
+			return e
+		}
+		data, err := json.Marshal(point)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
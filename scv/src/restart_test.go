@@ -0,0 +1,118 @@
+package scv
+
+import (
+	"../manager"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestartFallback(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "restart")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{
+		Config:   Configuration{Name: filepath.Join(dir, "scv"), Password: "secret"},
+		Database: db,
+		events:   NewEventBus(),
+		usage:    NewDiskUsage(),
+	}
+	app.Manager = manager.NewManager(app)
+	stream := newStream("stream", "target", "owner", 20, 0, 0)
+	assert.Nil(t, db.InsertStream(stream))
+	for _, cp := range [][2]int{{10, 0}, {20, 0}, {20, 1}} {
+		cpDir := filepath.Join(app.StreamDir("stream"), strconv.Itoa(cp[0]), strconv.Itoa(cp[1]))
+		os.MkdirAll(filepath.Join(cpDir, "checkpoint_files"), 0776)
+		ioutil.WriteFile(filepath.Join(cpDir, "checkpoint_files", "state.xml"), []byte(strconv.Itoa(cp[0])+"/"+strconv.Itoa(cp[1])), 0666)
+		assert.Nil(t, writeChecksums(cpDir))
+	}
+	corrupt := func(partition, checkpoint int) {
+		path := filepath.Join(app.StreamDir("stream"), strconv.Itoa(partition), strconv.Itoa(checkpoint), "checkpoint_files", "state.xml")
+		ioutil.WriteFile(path, []byte("garbage"), 0666)
+	}
+
+	files, err := app.restartFiles(stream)
+	assert.Nil(t, err)
+	assert.Equal(t, files["state.xml"], "20/1")
+
+	// falls back within the partition
+	corrupt(20, 1)
+	files, err = app.restartFiles(stream)
+	assert.Nil(t, err)
+	assert.Equal(t, files["state.xml"], "20/0")
+	assert.Equal(t, stream.Frames, 20)
+
+	// then to the previous partition, whose frames are discarded
+	corrupt(20, 0)
+	files, err = app.restartFiles(stream)
+	assert.Nil(t, err)
+	assert.Equal(t, files["state.xml"], "10/0")
+	assert.Equal(t, stream.Frames, 10)
+	partitions, _ := app.streamPartitions(stream)
+	assert.Equal(t, partitions, []int{10})
+	doc := Stream{}
+	db.FindStream("stream", &doc)
+	assert.Equal(t, doc.Frames, 10)
+
+	// a checkpoint that cannot be read is not fallen back from
+	unreadable := filepath.Join(app.StreamDir("stream"), "10", "0", "checkpoint_files", "unreadable")
+	os.Mkdir(unreadable, 0776)
+	_, err = app.restartFiles(stream)
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, errCheckpointCorrupted))
+	assert.Equal(t, stream.Frames, 10)
+	os.Remove(unreadable)
+
+	corrupt(10, 0)
+	_, err = app.restartFiles(stream)
+	assert.NotNil(t, err)
+}
+
+func TestStreamRestartHandler(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "restart")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{
+		Config:   Configuration{Name: filepath.Join(dir, "scv"), Password: "secret"},
+		Database: db,
+		events:   NewEventBus(),
+		usage:    NewDiskUsage(),
+	}
+	app.Manager = manager.NewManager(app)
+	stream := newStream("stream", "target", "owner", 20, 0, 0)
+	streamData(stream).hydrated = true
+	assert.Nil(t, db.InsertStream(stream))
+	app.Manager.AddStream(stream, "target", true)
+	for _, cp := range [][2]int{{10, 0}, {20, 0}} {
+		os.MkdirAll(filepath.Join(app.StreamDir("stream"), strconv.Itoa(cp[0]), strconv.Itoa(cp[1]), "checkpoint_files"), 0776)
+	}
+	router := mux.NewRouter()
+	router.Handle("/admin/streams/{stream_id}/restart", app.StreamRestartHandler())
+	put := func(password, body string) int {
+		req, _ := http.NewRequest("PUT", "/admin/streams/stream/restart", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", password)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, put("wrong", `{"partition": 10}`), 401)
+	assert.Equal(t, put("secret", `{"partition": 15}`), 404)
+	assert.Equal(t, put("secret", `{"partition": 10, "checkpoint": 1}`), 404)
+	assert.Equal(t, put("secret", `{"partition": 10}`), 200)
+	assert.Equal(t, stream.Frames, 10)
+	_, err = os.Stat(filepath.Join(app.StreamDir("stream"), "20"))
+	assert.True(t, os.IsNotExist(err))
+}
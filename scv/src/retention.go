@@ -0,0 +1,190 @@
+package scv
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// How often, in seconds, the cleaner applies the checkpoint retention policy
+// of every stream.
+const RETENTION_INTERVAL int = 3600
+
+// Checkpoint retention policies, see RetentionPolicy.
+const (
+	RETAIN_LAST          string = "keep_last"
+	RETAIN_PER_PARTITION string = "per_partition"
+)
+
+/*
+Limits the checkpoint_files kept by the streams of a target, set by the
+"checkpoint_retention" option of the target, eg.
+
+    "checkpoint_retention": {"policy": "keep_last", "count": 3}
+    "checkpoint_retention": {"policy": "per_partition"}
+
+keep_last keeps the checkpoints of the count most recent checkpoint
+directories of the stream, per_partition keeps the last checkpoint of every
+partition. Frame files are never removed, and the most recent checkpoint is
+always kept since it is handed out by /core/start. Partitions merged into
+archives are left alone.
+*/
+type RetentionPolicy struct {
+	Policy string
+	Count  int
+}
+
+// Parse the retention policy in the options of a target. Returns false if the
+// target keeps every checkpoint.
+func newRetentionPolicy(options map[string]interface{}) (RetentionPolicy, bool, error) {
+	config, ok := options["checkpoint_retention"].(map[string]interface{})
+	if ok == false {
+		return RetentionPolicy{}, false, nil
+	}
+	policy := RetentionPolicy{
+		Policy: optionString(config, "policy", ""),
+		Count:  optionInt(config, "count", 0),
+	}
+	switch policy.Policy {
+	case RETAIN_LAST:
+		if policy.Count < 1 {
+			return RetentionPolicy{}, false, errors.New("count must be at least 1")
+		}
+	case RETAIN_PER_PARTITION:
+	default:
+		return RetentionPolicy{}, false, errors.New("unknown policy: " + policy.Policy)
+	}
+	return policy, true, nil
+}
+
+func (app *Application) retentionPolicy(targetId string) (RetentionPolicy, bool, error) {
+	options, err := app.targetOptions(targetId)
+	if err != nil {
+		// targets without a document in data.targets keep everything
+		return RetentionPolicy{}, false, nil
+	}
+	policy, ok, err := newRetentionPolicy(options)
+	if err != nil {
+		return RetentionPolicy{}, false, errors.New("Bad checkpoint_retention for target " + targetId + ": " + err.Error())
+	}
+	return policy, ok, nil
+}
+
+// Returns the checkpoint directories of a partition that still hold their
+// checkpoint_files, in increasing order.
+func retainedCheckpoints(partitionDir string) ([]int, error) {
+	checkpoints, err := listCheckpoints(partitionDir)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]int, 0, len(checkpoints))
+	for _, checkpoint := range checkpoints {
+		dir := filepath.Join(partitionDir, strconv.Itoa(checkpoint), "checkpoint_files")
+		if exists, _ := pathExists(dir); exists {
+			res = append(res, checkpoint)
+		}
+	}
+	return res, nil
+}
+
+// Remove the checkpoint_files of a checkpoint directory and their entries in
+// its checksum manifest.
+func (app *Application) pruneCheckpoint(s *Stream, partition, checkpoint int) error {
+	dir := filepath.Join(app.StreamDir(s.StreamId), strconv.Itoa(partition), strconv.Itoa(checkpoint))
+	checkpointDir := filepath.Join(dir, "checkpoint_files")
+	size := dirSize(checkpointDir)
+	streamData(s).filesChanged()
+	if err := os.RemoveAll(checkpointDir); err != nil {
+		return err
+	}
+	app.usage.Add(s.TargetId, s.StreamId, -size)
+	return dropChecksums(dir, "checkpoint_files/")
+}
+
+/*
+Apply the retention policy of the stream's target, returning the number of
+checkpoints removed. Unless full is set, only the checkpoints made obsolete by
+the latest one are looked for: per_partition only looks at the last partition,
+and keep_last stops at the first partition older than the checkpoints kept that
+has none left. The stream must be locked for writing.
+*/
+func (app *Application) applyRetention(s *Stream, full bool) (int, error) {
+	policy, ok, err := app.retentionPolicy(s.TargetId)
+	if err != nil || ok == false {
+		return 0, err
+	}
+	partitions, err := app.streamPartitions(s)
+	if err != nil {
+		return 0, err
+	}
+	// checkpoints taken before the first frame are in directory 0
+	streamDir := app.StreamDir(s.StreamId)
+	if exists, _ := pathExists(filepath.Join(streamDir, "0")); exists {
+		partitions = append([]int{0}, partitions...)
+	}
+	pruned, kept := 0, 0
+	for i := len(partitions) - 1; i >= 0; i-- {
+		partition := partitions[i]
+		checkpoints, err := retainedCheckpoints(filepath.Join(streamDir, strconv.Itoa(partition)))
+		if err != nil {
+			return pruned, err
+		}
+		if policy.Policy == RETAIN_LAST && full == false && kept == policy.Count && len(checkpoints) == 0 {
+			break
+		}
+		for j := len(checkpoints) - 1; j >= 0; j-- {
+			keep := false
+			if policy.Policy == RETAIN_LAST {
+				keep = kept < policy.Count
+			} else {
+				keep = j == len(checkpoints)-1
+			}
+			if keep {
+				kept += 1
+				continue
+			}
+			if err := app.pruneCheckpoint(s, partition, checkpoints[j]); err != nil {
+				return pruned, err
+			}
+			pruned += 1
+		}
+		if policy.Policy == RETAIN_PER_PARTITION && full == false {
+			break
+		}
+	}
+	return pruned, nil
+}
+
+// A separate goroutine that periodically applies the checkpoint retention
+// policies to every stream, for checkpoints written before a policy was set,
+// and the stream lifecycle policies, see LifecyclePolicy.
+func (app *Application) RunRetention() {
+	defer app.workerWG.Done()
+	for {
+		select {
+		case <-app.finish:
+			return
+		case <-time.After(time.Duration(RETENTION_INTERVAL) * time.Second):
+			for _, streamId := range app.Manager.StreamIds() {
+				select {
+				case <-app.finish:
+					return
+				default:
+				}
+				err := app.Manager.ModifyStream(streamId, func(stream *Stream) error {
+					_, err := app.applyRetention(stream, true)
+					return err
+				})
+				if err != nil {
+					log.Println("Unable to apply checkpoint retention to stream "+streamId+":", err)
+				}
+				if err := app.applyLifecycle(streamId, time.Now()); err != nil {
+					log.Println("Unable to apply stream lifecycle to stream "+streamId+":", err)
+				}
+			}
+		}
+	}
+}
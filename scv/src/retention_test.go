@@ -0,0 +1,133 @@
+package scv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRetentionPolicy(t *testing.T) {
+	_, ok, err := newRetentionPolicy(map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	policy, ok, err := newRetentionPolicy(map[string]interface{}{
+		"checkpoint_retention": map[string]interface{}{"policy": "keep_last", "count": 2.0},
+	})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, policy, RetentionPolicy{RETAIN_LAST, 2})
+	_, _, err = newRetentionPolicy(map[string]interface{}{
+		"checkpoint_retention": map[string]interface{}{"policy": "keep_last"},
+	})
+	assert.NotNil(t, err)
+	_, _, err = newRetentionPolicy(map[string]interface{}{
+		"checkpoint_retention": map[string]interface{}{"policy": "bogus"},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestApplyRetention(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "retention")
+	defer os.RemoveAll(dir)
+	app := &Application{
+		Config:       Configuration{Name: filepath.Join(dir, "scv")},
+		optionsCache: NewResultCache(time.Minute),
+		usage:        NewDiskUsage(),
+	}
+	stream := newStream("stream", "target", "owner", 0, 0, 0)
+	// partition 5 has two checkpoints, partitions 10 and 15 one
+	for _, cp := range [][2]int{{5, 0}, {5, 1}, {10, 0}, {15, 0}} {
+		cpDir := filepath.Join(app.StreamDir("stream"), strconv.Itoa(cp[0]), strconv.Itoa(cp[1]))
+		os.MkdirAll(filepath.Join(cpDir, "checkpoint_files"), 0776)
+		ioutil.WriteFile(filepath.Join(cpDir, "checkpoint_files", "state.xml"), []byte("state"), 0666)
+		if cp[1] == 0 {
+			ioutil.WriteFile(filepath.Join(cpDir, "frames.xtc"), []byte("frames"), 0666)
+		}
+		assert.Nil(t, writeChecksums(cpDir))
+	}
+	retained := func(partition int) []int {
+		res, _ := retainedCheckpoints(filepath.Join(app.StreamDir("stream"), strconv.Itoa(partition)))
+		return res
+	}
+
+	app.optionsCache.Put("options:target", map[string]interface{}{})
+	pruned, err := app.applyRetention(stream, true)
+	assert.Nil(t, err)
+	assert.Equal(t, pruned, 0)
+
+	app.optionsCache.Put("options:target", map[string]interface{}{
+		"checkpoint_retention": map[string]interface{}{"policy": "per_partition"},
+	})
+	// only the last partition is looked at after a checkpoint
+	pruned, _ = app.applyRetention(stream, false)
+	assert.Equal(t, pruned, 0)
+	pruned, _ = app.applyRetention(stream, true)
+	assert.Equal(t, pruned, 1)
+	assert.Equal(t, retained(5), []int{1})
+	assert.Equal(t, verifyDir(filepath.Join(app.StreamDir("stream"), "5", "0")), []string{})
+
+	app.optionsCache.Put("options:target", map[string]interface{}{
+		"checkpoint_retention": map[string]interface{}{"policy": "keep_last", "count": 1.0},
+	})
+	pruned, _ = app.applyRetention(stream, false)
+	assert.Equal(t, pruned, 2)
+	assert.Equal(t, retained(5), []int{})
+	assert.Equal(t, retained(10), []int{})
+	assert.Equal(t, retained(15), []int{0})
+	// frames are kept
+	_, err = os.Stat(filepath.Join(app.StreamDir("stream"), "5", "0", "frames.xtc"))
+	assert.Nil(t, err)
+}
+
+func TestNewLifecyclePolicy(t *testing.T) {
+	_, ok, err := newLifecyclePolicy(map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	policy, ok, err := newLifecyclePolicy(map[string]interface{}{
+		"stream_lifecycle": map[string]interface{}{"disable_idle_days": 30.0, "archive_age_days": 180.0},
+	})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, policy, LifecyclePolicy{30, 0, 180, LIFECYCLE_NOTICE_DAYS})
+	_, _, err = newLifecyclePolicy(map[string]interface{}{
+		"stream_lifecycle": map[string]interface{}{"delete_idle_days": -1.0},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestDueLifecycleActions(t *testing.T) {
+	app := &Application{events: NewEventBus()}
+	sub := app.events.Subscribe("", "", nil)
+	defer app.events.Unsubscribe(sub)
+	day := 86400
+	stream := &Stream{StreamId: "s1", TargetId: "t1", MongoStatus: "enabled", CreationDate: 0, LastActive: 10 * day}
+	policy := LifecyclePolicy{DisableIdleDays: 5, DeleteIdleDays: 20, NoticeDays: 2}
+
+	assert.Equal(t, app.dueLifecycleActions(stream, policy, 12*day), []string{})
+	// a notice is sent in the window before the action
+	assert.Equal(t, app.dueLifecycleActions(stream, policy, 13*day), []string{})
+	e := <-sub.C
+	assert.Equal(t, e.Type, EVENT_NOTICE)
+	assert.Equal(t, e.Data["action"], LIFECYCLE_DISABLE)
+	assert.Equal(t, e.Data["due"], 15*day)
+	// actions are only taken once noticed, even if overdue
+	assert.Equal(t, app.dueLifecycleActions(stream, policy, 16*day), []string{LIFECYCLE_DISABLE})
+
+	// activity cancels the notices
+	stream.LastActive = 16 * day
+	assert.Equal(t, app.dueLifecycleActions(stream, policy, 16*day), []string{})
+	assert.Equal(t, len(streamData(stream).lifecycleNotices), 0)
+
+	// deleting the stream supersedes the other actions
+	streamData(stream).lifecycleNotices = map[string]int{LIFECYCLE_DISABLE: 0, LIFECYCLE_DELETE: 0}
+	assert.Equal(t, app.dueLifecycleActions(stream, policy, 40*day), []string{LIFECYCLE_DELETE})
+
+	// active streams are left alone
+	stream.ActiveStream = &ActiveStream{Data: newSessionState()}
+	assert.Equal(t, len(app.dueLifecycleActions(stream, policy, 40*day)), 0)
+}
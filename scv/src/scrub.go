@@ -0,0 +1,128 @@
+package scv
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Default number of seconds between two passes of the scrubber.
+const SCRUB_INTERVAL int = 86400
+
+// Seconds the scrubber waits between two streams so that it does not compete
+// with cores for disk bandwidth.
+const SCRUB_PAUSE int = 5
+
+// Counters of the background scrubber.
+type Scrubber struct {
+	sync.Mutex
+	passes    int64
+	streams   int64 // streams verified
+	corrupted int64 // streams found to be corrupted
+	lastPass  int   // unix time the last pass completed
+}
+
+func (s *Scrubber) Metrics() map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+	return map[string]interface{}{
+		"passes":    s.passes,
+		"streams":   s.streams,
+		"corrupted": s.corrupted,
+		"last_pass": s.lastPass,
+	}
+}
+
+func scrubInterval(seconds int) time.Duration {
+	if seconds <= 0 {
+		seconds = SCRUB_INTERVAL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+/*
+Verify the checksums of a stream. A corrupted stream is disabled so that it is
+no longer handed out to cores, the corrupted partitions are recorded in its
+Mongo document, and an EVENT_CORRUPTED is published. Files are hashed without
+holding the stream's lock, and verified again if the stream's files changed
+meanwhile.
+*/
+func (app *Application) ScrubStream(streamId string) ([]Corruption, error) {
+	var corrupted []Corruption
+	for attempt := 1; ; attempt++ {
+		var err error
+		corrupted, _, err = app.VerifyStream(streamId)
+		if err == errFilesChanged && attempt < MAX_READ_ATTEMPTS {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		break
+	}
+	var owner, status string
+	e := app.Manager.ReadStream(streamId, func(stream *Stream) error {
+		owner = stream.Owner
+		status = stream.MongoStatus
+		return nil
+	})
+	if e != nil {
+		return nil, e
+	}
+	app.scrubber.Lock()
+	app.scrubber.streams += 1
+	if len(corrupted) > 0 {
+		app.scrubber.corrupted += 1
+	}
+	app.scrubber.Unlock()
+	if len(corrupted) == 0 {
+		return corrupted, nil
+	}
+	log.Printf("Stream %s is corrupted: %v", streamId, corrupted)
+	if err := app.Database.UpdateStream(streamId, bson.M{"corrupted": corrupted}, nil); err != nil {
+		log.Println("Unable to record corruption of stream "+streamId+":", err)
+	}
+	if status != "disabled" {
+		if err := app.Manager.DisableStream(streamId, owner); err != nil {
+			return corrupted, err
+		}
+	}
+	app.Manager.ReadStream(streamId, func(stream *Stream) error {
+		app.events.Publish(NewEvent(EVENT_CORRUPTED, stream, map[string]interface{}{
+			"corrupted": corrupted,
+		}))
+		return nil
+	})
+	return corrupted, nil
+}
+
+// A separate low priority goroutine that periodically scrubs every stream.
+func (app *Application) RunScrubber() {
+	defer app.workerWG.Done()
+	for {
+		interval := app.Settings().ScrubInterval
+		select {
+		case <-app.finish:
+			return
+		case <-time.After(scrubInterval(interval)):
+		}
+		if interval < 0 {
+			continue
+		}
+		for _, streamId := range app.Manager.StreamIds() {
+			select {
+			case <-app.finish:
+				return
+			case <-time.After(time.Duration(SCRUB_PAUSE) * time.Second):
+			}
+			if _, err := app.ScrubStream(streamId); err != nil {
+				log.Println("Unable to scrub stream "+streamId+":", err)
+			}
+		}
+		app.scrubber.Lock()
+		app.scrubber.passes += 1
+		app.scrubber.lastPass = int(time.Now().Unix())
+		app.scrubber.Unlock()
+	}
+}
@@ -1,11 +1,11 @@
 package scv
 
 import (
-	"bytes"
-	"compress/gzip"
-	"container/list"
+	"../manager"
+	"context"
 	"crypto/md5"
-	"encoding/base64"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -13,13 +13,16 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -31,17 +34,52 @@ import (
 var _ = fmt.Printf
 
 type Application struct {
-	Config  Configuration
-	Mongo   *mgo.Session
-	Manager *Manager
-	Router  *mux.Router
+	Config     Configuration
+	ConfigPath string       // file the configuration was loaded from, used by Reload
+	Mongo      *mgo.Session // master session, nil unless Database is Mongo
+	Database   Database
+	Manager    *manager.Manager
+	Router     *mux.Router
 
 	server     *Server
-	stats      *list.List // things we put in this list should persist when server dies
+	usage      *DiskUsage
+	shards     *shardRegistry // targets registered in servers.shards
+	tokenCache *TokenCache
+	events     *EventBus
+	scrubber   *Scrubber
+	statsCache *ResultCache // aggregations over the stats DB
+	stats      *StatsWriter // writes deferred by handlers
 	statsWG    sync.WaitGroup
-	statsMutex sync.Mutex
+	workerWG   sync.WaitGroup // background jobs other than the stats writer
 	shutdown   chan os.Signal
 	finish     chan struct{}
+	ctx        context.Context // parent of the requests' contexts, cancelled by Shutdown
+	cancel     context.CancelFunc
+	reap       chan struct{} // wakes up the reaper after a deletion
+	reapMutex  sync.Mutex    // serializes the reaper and undeletions
+
+	rateLimiters map[string]*RateLimiter // map of client class to limiter
+	ingest       *IngestThrottle         // bandwidth of frame uploads
+	optionsCache *ResultCache            // options and validators of targets
+	banCache     *ResultCache            // data.bans, see bans.go
+
+	routeTimeouts  map[string]int // Timeout of each route, keyed by path template
+	requestMetrics *RequestMetrics
+
+	configMutex sync.RWMutex     // guards Config, certificate and clientCAs on Reload
+	reloadMutex sync.Mutex       // serializes calls to Reload
+	certificate *tls.Certificate // served through GetCertificate
+	clientCAs   *x509.CertPool   // CAs of the CC's client certificates, see isCC
+	auth        []AuthProvider   // of AuthProviders, see tokenUser
+
+	plugins     []*registeredPlugin // run on every checkpoint, see CheckpointPlugin
+	pluginQueue chan pluginJob
+
+	verifications *verificationQueue // checkpoints sampled for re-simulation, see Verification
+	writeSlots    chan struct{}      // held while writing a file of a new stream, see writeStreamFiles
+
+	draining int32 // 1 while no stream may be activated, see drain.go
+	readOnly int32 // 1 while the data partition is full, see diskfull.go
 }
 
 /*
@@ -50,263 +88,558 @@ the manager and stream. Note that this methods runs very fast. Mongo operations
 and processed by a separate goroutine.
 */
 func (app *Application) DeactivateStreamService(s *Stream) error {
+	// frames not written yet are dropped along with the buffer
+	if sessionData(s).writer != nil {
+		sessionData(s).writer.Stop()
+	}
 	// Record stats for stream and defer insertion until later.
-	stats := make(map[string]interface{})
+	stats := bson.M{}
 	streamId := s.StreamId
-	donorFrames := s.activeStream.donorFrames
-	stats["engine"] = s.activeStream.engine
-	stats["user"] = s.activeStream.user
-	stats["start_time"] = s.activeStream.startTime
-	stats["end_time"] = int(time.Now().Unix())
+	donorFrames := s.ActiveStream.DonorFrames
+	endTime := int(time.Now().Unix())
+	stats["engine"] = s.ActiveStream.Engine
+	stats["device"] = engineDevice(s.ActiveStream.Engine)
+	stats["user"] = s.ActiveStream.User
+	stats["start_time"] = s.ActiveStream.StartTime
+	stats["end_time"] = endTime
+	stats["seconds"] = endTime - s.ActiveStream.StartTime // wall-clock, see DonorCredit
 	stats["frames"] = donorFrames
 	stats["stream"] = streamId
-	stats_cursor := app.Mongo.DB("stats").C(s.TargetId)
-	// Record statistics for the stream.
-	fn1 := func() error {
-		return stats_cursor.Insert(stats)
+	stats["start_frames"] = s.ActiveStream.StartFrames
+	stats["end_frames"] = s.Frames
+	stats["error"] = s.ActiveStream.Errored
+	if len(sessionData(s).requests) > 0 {
+		stats["requests"] = sessionData(s).requests
 	}
 	// Update the stream's frames, error_count, and status in Mongo
 	status := "enabled"
-	if s.ErrorCount >= MAX_STREAM_FAILS {
+	if s.MongoStatus == "quarantined" {
+		status = "quarantined"
+	} else if s.MongoStatus == "disabled" {
+		// the stream is being disabled, see Manager.DisableStream
+		status = "disabled"
+	} else if s.ErrorCount >= manager.MAX_STREAM_FAILS {
 		status = "disabled"
 	}
-	stream_prop := bson.M{"$set": bson.M{"frames": s.Frames, "error_count": s.ErrorCount, "status": status}}
-	stream_cursor := app.Mongo.DB("streams").C(app.Config.Name)
-	fn2 := func() error {
-		// Generally, if the error_count or the status fails to update, it's not a catastrophic error. We
-		// can get away with a slightly dirty state for error_count and status if necessary.
-		stream_cursor.UpdateId(streamId, stream_prop)
-		return nil
+	s.LastActive = int(time.Now().Unix())
+	update := bson.M{"frames": s.Frames, "donor_frames": s.DonorFrames, "error_count": s.ErrorCount, "status": status}
+	update["last_active"] = s.LastActive
+	if status == "quarantined" {
+		update["quarantine_reason"] = s.QuarantineReason
 	}
-
-	app.statsMutex.Lock()
-	if donorFrames > 0 {
-		app.stats.PushBack(fn1)
+	// failed sessions are kept for the stream's history even if they did
+	// not produce anything. The stats collection is indexed by stream for
+	// /streams/history, and by donor for /donors/:user/sessions.
+	if donorFrames > 0 || s.ActiveStream.Errored {
+		app.deferInsert("stats", s.TargetId, STATS_INDEXES, stats)
+	}
+	app.recordBenchmark(s)
+	// The stream may have been deleted in the meantime, its tombstone must be kept.
+	app.deferUpdate("streams", app.Config.Name, bson.M{"_id": streamId, "status": bson.M{"$ne": "deleted"}}, bson.M{"$set": update})
+	app.events.Publish(NewEvent(EVENT_DEACTIVATED, s, map[string]interface{}{
+		"donor_frames": donorFrames,
+		"error_count":  s.ErrorCount,
+	}))
+	if status == "disabled" && s.MongoStatus != "disabled" {
+		app.events.Publish(NewEvent(EVENT_DISABLED, s, nil))
+	} else if status == "quarantined" {
+		app.events.Publish(NewEvent(EVENT_QUARANTINED, s, map[string]interface{}{
+			"reason": s.QuarantineReason,
+		}))
 	}
-	app.stats.PushBack(fn2)
-	app.statsMutex.Unlock()
 	return nil
 }
 
+// The HTTP layer persists the Manager's changes through the Injector methods
+// below.
+var _ manager.Injector = (*Application)(nil)
+
 // Implements interface method for Manager's Injector. Only the stream is locked, manager is not.
 func (app *Application) EnableStreamService(s *Stream) error {
-	cursor := app.Mongo.DB("streams").C(app.Config.Name)
 	s.ErrorCount = 0
 	s.MongoStatus = "enabled"
-	return cursor.UpdateId(s.StreamId, bson.M{"$set": bson.M{"status": "enabled", "error_count": 0}})
+	// enabling a stream counts as activity for its target's stream_lifecycle
+	s.LastActive = int(time.Now().Unix())
+	app.events.Publish(NewEvent(EVENT_ENABLED, s, nil))
+	return app.Database.UpdateStream(s.StreamId,
+		bson.M{"status": "enabled", "error_count": 0, "last_active": s.LastActive},
+		bson.M{"quarantine_reason": ""})
 }
 
 // Implements interface method for Manager's Injector. Only the stream is locked, manager is not.
 func (app *Application) DisableStreamService(s *Stream) error {
-	cursor := app.Mongo.DB("streams").C(app.Config.Name)
 	// fmt.Println("DISABLING STREAM", streamId)
-	return cursor.UpdateId(s.StreamId, bson.M{"$set": bson.M{"status": "disabled"}})
-}
-
-// app.stats contains a list of Mongo functions to be executed. Breaks if the function failed.
-func (app *Application) drainStats() {
-	app.statsMutex.Lock()
-	for app.stats.Len() > 0 {
-		ele := app.stats.Front()
-		fn := ele.Value.(func() error)
-		err := fn()
-		if err == nil {
-			app.stats.Remove(ele)
-		} else {
-			fmt.Println(err)
-			break
-		}
-	}
-	app.statsMutex.Unlock()
-}
-
-// A separate goroutine that populates MongoDB with stats entries.
-func (app *Application) RecordDeferredDocs() {
-	defer app.statsWG.Done()
-	for {
-		select {
-		case <-app.finish:
-			app.drainStats()
-			// TOOD: persist stats here if not empty
-			// if app.stats.Len() > 0 {
-			// }
-			return
-		default:
-			app.drainStats()
-			time.Sleep(1 * time.Second)
-		}
+	if s.MongoStatus == "quarantined" {
+		app.events.Publish(NewEvent(EVENT_QUARANTINED, s, map[string]interface{}{
+			"reason": s.QuarantineReason,
+		}))
+		return app.Database.UpdateStream(s.StreamId, bson.M{
+			"status":            "quarantined",
+			"quarantine_reason": s.QuarantineReason,
+		}, nil)
 	}
+	app.events.Publish(NewEvent(EVENT_DISABLED, s, nil))
+	return app.Database.UpdateStream(s.StreamId, bson.M{"status": "disabled"}, nil)
 }
 
 type Configuration struct {
+	Database     string            `json:"Database" bson:"-"` // "mongo" (default) or "embedded", see EmbeddedDatabase
 	MongoURI     string            `json:"MongoURI" bson:"-"`
 	Name         string            `json:"Name" bson:"_id"`
 	Password     string            `json:"Password" bson:"password"`
 	ExternalHost string            `json:"ExternalHost" bson:"host"`
 	InternalHost string            `json:"InternalHost" bson:"-"`
-	SSL          map[string]string `json:"SSL" bson:"-"`
+	SSL          map[string]string `json:"SSL" bson:"-"`         // Cert and Key, and optionally ClientCA and ClientCertOnly, see isCC
+	TargetQuota  int64             `json:"TargetQuota" bson:"-"` // max bytes stored per target, 0 for no limit
+
+	ExpirationTime   int `json:"ExpirationTime" bson:"-"`   // seconds an active stream may go without a heartbeat, 0 for default
+	CompactThreshold int `json:"CompactThreshold" bson:"-"` // partitions a stream may have before being archived, 0 to disable
+	TokenCacheTTL    int `json:"TokenCacheTTL" bson:"-"`    // seconds a token lookup is cached, 0 for default, <0 to disable
+	ScrubInterval    int `json:"ScrubInterval" bson:"-"`    // seconds between checksum scrubs of every stream, 0 for default, <0 to disable
+	QuarantineErrors int `json:"QuarantineErrors" bson:"-"` // failed activations within an hour before a stream is quarantined, 0 for default, <0 to disable
+	CooldownTime     int `json:"CooldownTime" bson:"-"`     // seconds a failed stream waits per error before being activated again, 0 for default, <0 to disable
+	TrashDays        int `json:"TrashDays" bson:"-"`        // days deleted streams can be restored before being purged, 0 to purge immediately
+	LoadWorkers      int `json:"LoadWorkers" bson:"-"`      // goroutines loading streams at startup, 0 for default
+	WriteWorkers     int `json:"WriteWorkers" bson:"-"`     // files of new streams written at once, 0 for default, see writeStreamFiles
+
+	SkipFrameVerify bool `json:"SkipFrameVerify" bson:"-"` // trust the frame counts in Mongo at startup instead of listing partitions
+	LazyLoad        bool `json:"LazyLoad" bson:"-"`        // check the data of each stream on its first activation instead of at startup, and keep its metadata and options in the database until needed
+
+	EmbeddedImport string `json:"EmbeddedImport" bson:"-"` // JSON file of users, managers and engine keys upserted into the embedded database at startup, see EmbeddedDatabase.Import
+
+	RateLimits map[string]RateLimit `json:"RateLimits" bson:"-"` // keyed by "core", "manager" and "anonymous"
+	CORS       CORS                 `json:"CORS" bson:"-"`
+
+	MaxFrameBytes      int64 `json:"MaxFrameBytes" bson:"-"`      // max body size of /core/frame, 0 for default
+	MaxCheckpointBytes int64 `json:"MaxCheckpointBytes" bson:"-"` // max body size of /core/checkpoint, 0 for default
+	MaxLogBytes        int64 `json:"MaxLogBytes" bson:"-"`        // logs kept per stream by /core/logs, 0 for default
+
+	MaxStreamedFrameBytes int64 `json:"MaxStreamedFrameBytes" bson:"-"` // max body size of /core/frame/stream, 0 for default
+
+	MinDiskFree   int64 `json:"MinDiskFree" bson:"-"`   // bytes free on the data partition below which /readyz fails, 0 for default, <0 to disable
+	MaxStatsQueue int   `json:"MaxStatsQueue" bson:"-"` // deferred writes waiting for the database above which /readyz fails, 0 for default
+
+	ReadOnlyDiskFree int64 `json:"ReadOnlyDiskFree" bson:"-"` // bytes free on the data partition below which frames are refused, 0 for default, <0 to disable
+
+	NamespaceQuota int64 `json:"NamespaceQuota" bson:"-"` // max bytes stored by the streams of a namespace of managers, 0 for no limit, see Application.namespace
+
+	StreamIngest RateLimit `json:"StreamIngest" bson:"-"` // bytes per second of frames accepted per active stream, see IngestThrottle
+	GlobalIngest RateLimit `json:"GlobalIngest" bson:"-"` // bytes per second of frames accepted over all streams
+
+	MaxDonorStreams int      `json:"MaxDonorStreams" bson:"-"` // streams a donor may have active at once, 0 for no limit
+	TrustedDonors   []string `json:"TrustedDonors" bson:"-"`   // donors exempt from MaxDonorStreams
+	Verifiers       []string `json:"Verifiers" bson:"-"`       // donors whose cores re-simulate checkpoints, see Verification
+
+	AuthProviders []AuthProviderConfig `json:"AuthProviders" bson:"-"` // tried in turn to identify users, the tokens of the database if empty
+
+	FrameStorage string `json:"FrameStorage" bson:"-"` // STORE_DECODED (default) or STORE_COMPRESSED
+
+	Maintenance []MaintenanceWindow `json:"Maintenance" bson:"-"` // periods during which streams are not activated
+
+	KeepBuffers bool `json:"KeepBuffers" bson:"-"` // keep the frames buffered by a stream's previous core for inspection, see recoverBuffer
+
+	Plugins       []PluginConfig `json:"Plugins" bson:"-"`       // analyses run on every checkpoint, see CheckpointPlugin
+	PluginWorkers int            `json:"PluginWorkers" bson:"-"` // goroutines running them, 0 for default
+
+	ServerTimeouts ServerTimeouts `json:"ServerTimeouts" bson:"-"` // of connections, see Server
+	DisableHTTP2   bool           `json:"DisableHTTP2" bson:"-"`   // serve HTTP/1.1 only over TLS
+
+	DisableEncoding bool `json:"DisableEncoding" bson:"-"` // reply to managers with plain JSON only, see EncodingMiddleware
+
+	Timeouts        map[string]int `json:"Timeouts" bson:"-"`        // seconds handlers have to reply, keyed by path template (eg. "/core/heartbeat"), <0 for no limit, see TimeoutMiddleware
+	SlowRequestTime int            `json:"SlowRequestTime" bson:"-"` // seconds after which a request is logged as slow, 0 for default, <0 to disable
 }
 
 // Registers the SCV with MongoDB
 func (app *Application) RegisterSCV() {
 	log.Printf("Registering SCV %s with database...", app.Config.Name)
-	cursor := app.Mongo.DB("servers").C("scvs")
-	_, err := cursor.UpsertId(app.Config.Name, app.Config)
-	if err != nil {
-		panic("Could not connect to MongoDB: " + err.Error())
-	}
+	waitForDatabase("register SCV", func() error {
+		return app.Database.UpsertSCV(app.Config)
+	})
 }
 
+// Default number of goroutines loading streams at startup.
+const LOAD_WORKERS int = 16
+
 /*
 Invoked on start of the SCV. The following happens:
 1. Loads the list of streams from Mongo. It is guaranteed that if a stream exists in Mongo, then it must exist on disk.
-2. Any stream that is on the disk but not in Mongo is removed.
-3. The status of the stream (enabled, disabled) is set.
+2. Any stream that is on the disk but not in Mongo is removed. Deleted streams are left to the reaper.
+3. The status of the stream (enabled, disabled, quarantined) is set.
 4. If the frame count on disk (as determined by the folders available) is the canonical value. If it does not match
-   the value inside MongoDB, then frame count value inside Mongo is then updated.
+   the value inside MongoDB, then frame count value inside Mongo is then updated. This step is skipped if
+   SkipFrameVerify is set.
+Streams are loaded by LoadWorkers goroutines, progress is logged every 10%. If LazyLoad is set, only the Mongo
+documents are read, without the metadata and options of the streams, and steps 1, 2 and 4 are deferred to the
+first activation of each stream, see hydrateStream. If SkipFrameVerify or LazyLoad is set and the SCV last shut
+down cleanly, the disk usage of the streams is read from the usage cache rather than from their directories, see
+loadUsageCache. Otherwise the directory of every stream is walked, even if LazyLoad is set, so that quotas are
+enforced from the start.
 */
 func (app *Application) LoadStreams() {
 	var mongoStreams []Stream
 
-	err := app.StreamsCursor().Find(bson.M{}).All(&mongoStreams)
-	if err != nil {
-		panic("Could not connect to MongoDB: " + err.Error())
-	}
+	settings := app.Settings()
+	waitForDatabase("load streams", func() (err error) {
+		if settings.LazyLoad {
+			mongoStreams, err = app.Database.StreamSummaries()
+		} else {
+			mongoStreams, err = app.Database.Streams()
+		}
+		return err
+	})
 
 	mongoStreamIds := make(map[string]Stream)
+	tombstones := make(map[string]struct{})
 	for _, val := range mongoStreams {
+		if val.MongoStatus == "deleted" {
+			// files are removed by the reaper
+			tombstones[val.StreamId] = struct{}{}
+			continue
+		}
 		mongoStreamIds[val.StreamId] = val
 	}
 
-	log.Printf("Loading %d streams...", len(mongoStreamIds))
+	log.Printf("Loading %d streams, %d awaiting deletion...", len(mongoStreamIds), len(tombstones))
 
+	var sizes map[string]int64
+	if settings.SkipFrameVerify || settings.LazyLoad {
+		sizes = app.loadUsageCache()
+	} else {
+		// a cache left by the previous shutdown would be wrong after this one
+		os.Remove(app.usageCachePath())
+	}
 	diskStreamIds := make(map[string]struct{})
-	fileData, err := ioutil.ReadDir(filepath.Join(app.Config.Name+"_data", "streams"))
-	for _, v := range fileData {
-		diskStreamIds[v.Name()] = struct{}{}
+	if settings.LazyLoad {
+		// the data of each stream is checked when it is first activated,
+		// orphaned directories are kept until the next full load.
+		for streamId, _ := range mongoStreamIds {
+			diskStreamIds[streamId] = struct{}{}
+		}
+	} else {
+		fileData, _ := ioutil.ReadDir(filepath.Join(app.Config.Name+"_data", "streams"))
+		for _, v := range fileData {
+			diskStreamIds[v.Name()] = struct{}{}
+		}
 	}
 	// Check that disk streams is equal to mongo streams. That is mongoStreams /subset of diskStreamIds
-	for streamId, stream := range mongoStreamIds {
+	for streamId, _ := range mongoStreamIds {
 		_, ok := diskStreamIds[streamId]
 		if ok == false {
 			log.Panicln("Cannot find data for stream " + streamId + " on disk")
 		}
-		partitions, err := app.ListPartitions(streamId)
-		if err != nil {
-			panic("Unable to list partitions for stream " + streamId)
-		}
-		lastFrame := 0
-		if len(partitions) > 0 {
-			lastFrame = partitions[len(partitions)-1]
-		}
-		if lastFrame != stream.Frames {
-			log.Printf("Warning: frame count mismatch for stream %s. Disk: %d, Mongo: %d, using disk value.", streamId, lastFrame, stream.Frames)
-		}
-		stream.Frames = lastFrame
-		mongoStreamIds[streamId] = stream
 	}
 	for streamId, _ := range diskStreamIds {
 		_, ok := mongoStreamIds[streamId]
-		if ok == false {
+		_, deleted := tombstones[streamId]
+		if ok == false && deleted == false {
 			streamDir := app.StreamDir(streamId)
 			log.Println("Warning: stream " + streamId + " is present on disk but not in Mongo, removing " + streamDir)
 			os.RemoveAll(streamDir)
 		}
 	}
 
+	// Reading the partitions and the size of every stream dominates the
+	// startup time, so streams are loaded by a pool of workers.
+	workers := loadWorkers(settings.LoadWorkers)
+	total := int64(len(mongoStreamIds))
+	var loaded int64
+	var failed error
+	var failedMutex sync.Mutex
+	todo := make(chan Stream)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for stream := range todo {
+				if err := app.loadStream(stream, settings, sizes); err != nil {
+					failedMutex.Lock()
+					failed = err
+					failedMutex.Unlock()
+				}
+				n := atomic.AddInt64(&loaded, 1)
+				if n*10/total != (n-1)*10/total {
+					log.Printf("Loaded %d/%d streams (%d%%)", n, total, n*100/total)
+				}
+			}
+		}()
+	}
 	for _, stream := range mongoStreamIds {
-		stream_copy := stream
-		if stream.MongoStatus == "enabled" {
-			app.Manager.AddStream(&stream_copy, stream.TargetId, true)
-		} else if stream.MongoStatus == "disabled" {
-			app.Manager.AddStream(&stream_copy, stream.TargetId, false)
-		} else {
-			panic("Unknown stream status")
+		todo <- stream
+	}
+	close(todo)
+	wg.Wait()
+	if failed != nil {
+		panic(failed.Error())
+	}
+}
+
+// Add a stream read from Mongo to the Manager. Unless the SCV is configured to
+// load streams lazily, the stream is hydrated right away. Either way its disk
+// usage is accounted for, taken from sizes if it is there.
+func (app *Application) loadStream(stream Stream, settings Configuration, sizes map[string]int64) error {
+	streamId := stream.StreamId
+	data := &streamState{}
+	stream.Data = data
+	if settings.LazyLoad == false {
+		if settings.SkipFrameVerify == false {
+			partitions, err := app.ListPartitions(streamId)
+			if err != nil {
+				return errors.New("Unable to list partitions for stream " + streamId)
+			}
+			app.checkFrames(&stream, partitions)
 		}
+		data.hydrated = true
+	} else {
+		data.partial = true
+	}
+	if stream.Namespace != "" {
+		app.usage.SetNamespace(streamId, stream.Namespace)
+	}
+	size, ok := sizes[streamId]
+	if ok == false {
+		size = dirSize(app.StreamDir(streamId))
+	}
+	app.usage.Add(stream.TargetId, streamId, size)
+	if stream.MongoStatus == "enabled" {
+		app.Manager.AddStream(&stream, stream.TargetId, true)
+	} else if stream.MongoStatus == "disabled" || stream.MongoStatus == "quarantined" {
+		app.Manager.AddStream(&stream, stream.TargetId, false)
+	} else {
+		return errors.New("Unknown stream status")
 	}
+	return nil
 }
 
-func NewApplication(config Configuration) *Application {
-	session, err := mgo.Dial(config.MongoURI)
+// Use the frame count on disk, which is the canonical value, if it does not
+// match the one read from Mongo.
+func (app *Application) checkFrames(stream *Stream, partitions []int) {
+	lastFrame := 0
+	if len(partitions) > 0 {
+		lastFrame = partitions[len(partitions)-1]
+	}
+	if lastFrame != stream.Frames {
+		log.Printf("Warning: frame count mismatch for stream %s. Disk: %d, Mongo: %d, using disk value.", stream.StreamId, lastFrame, stream.Frames)
+	}
+	stream.Frames = lastFrame
+}
+
+/*
+Check the data on disk of a stream loaded lazily: its directory must exist and
+its frame count is recomputed from its partitions. Its metadata and options are
+loaded too. The stream must be locked, and is only hydrated once.
+*/
+func (app *Application) hydrateStream(s *Stream) error {
+	if streamData(s).hydrated {
+		return nil
+	}
+	if err := app.loadStreamFields(s); err != nil {
+		return err
+	}
+	exists, err := pathExists(app.StreamDir(s.StreamId))
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if exists == false {
+		return errors.New("Cannot find data for stream " + s.StreamId + " on disk")
+	}
+	partitions, err := app.ListPartitions(s.StreamId)
+	if err != nil {
+		return err
+	}
+	app.checkFrames(s, partitions)
+	if s.ActiveStream != nil {
+		s.ActiveStream.StartFrames = s.Frames
+	}
+	streamData(s).hydrated = true
+	return nil
+}
+
+// Read the Meta and Options of a stream loaded lazily, which are only kept in
+// memory once they are needed. The stream must be locked for writing.
+func (app *Application) loadStreamFields(s *Stream) error {
+	if streamData(s).partial == false {
+		return nil
+	}
+	doc := Stream{}
+	if err := app.Database.FindStream(s.StreamId, &doc); err != nil {
+		return err
 	}
+	s.Meta, s.Options = doc.Meta, doc.Options
+	streamData(s).partial = false
+	return nil
+}
+
+func NewApplication(config Configuration) *Application {
 	app := Application{
-		Config:  config,
-		Mongo:   session,
-		Manager: nil,
-		stats:   list.New(),
-		finish:  make(chan struct{}),
+		Config:     config,
+		Manager:    nil,
+		usage:      NewDiskUsage(),
+		shards:     newShardRegistry(),
+		tokenCache: NewTokenCache(tokenCacheTTL(config.TokenCacheTTL)),
+		events:     NewEventBus(),
+		scrubber:   &Scrubber{},
+		statsCache: NewResultCache(time.Duration(STATS_CACHE_TTL) * time.Second),
+		stats:      NewStatsWriter(STATS_QUEUE_SIZE),
+		finish:     make(chan struct{}),
+		reap:       make(chan struct{}, 1),
+
+		rateLimiters: newRateLimiters(config.RateLimits),
+		ingest:       NewIngestThrottle(config.StreamIngest, config.GlobalIngest),
+		optionsCache: NewResultCache(time.Duration(TARGET_OPTIONS_TTL) * time.Second),
+		banCache:     NewResultCache(time.Duration(BAN_REFRESH_INTERVAL) * time.Second),
+
+		routeTimeouts:  make(map[string]int),
+		requestMetrics: NewRequestMetrics(),
+		pluginQueue:    make(chan pluginJob, PLUGIN_QUEUE_SIZE),
+		verifications:  newVerificationQueue(),
+		writeSlots:     make(chan struct{}, writeWorkers(config.WriteWorkers)),
 	}
 
-	index := mgo.Index{
-		Key:        []string{"target_id"},
-		Background: true,
+	switch config.Database {
+	case "", "mongo":
+		app.Mongo = dialMongo(config.MongoURI)
+		app.Database = NewMongoDatabase(app.Mongo, config.Name)
+	case "embedded":
+		db, err := OpenEmbeddedDatabase(app.EmbeddedDir(), config.Name)
+		if err != nil {
+			log.Panicln("Unable to open embedded database:", err)
+		}
+		if config.EmbeddedImport != "" {
+			if err := db.Import(config.EmbeddedImport); err != nil {
+				log.Panicln("Unable to import into embedded database:", err)
+			}
+		}
+		app.Database = db
+	default:
+		log.Panicln("Unknown database " + config.Database)
+	}
+	if err := validateMaintenance(config.Maintenance); err != nil {
+		log.Panicln(err)
+	}
+	if err := app.loadPlugins(config.Plugins); err != nil {
+		log.Panicln("Unable to load plugins:", err)
+	}
+	auth, err := newAuthProviders(app.Database, config.AuthProviders)
+	if err != nil {
+		log.Panicln(err)
+	}
+	app.auth = auth
+	if err := app.Database.EnsureIndexes(); err != nil {
+		log.Println("Unable to create indexes:", err)
 	}
-	app.StreamsCursor().EnsureIndex(index)
 
-	app.Manager = NewManager(&app)
+	app.Manager = manager.NewManagerWithOptions(&app, manager.ManagerOptions{
+		ExpirationTime:   expirationTime(config.ExpirationTime),
+		QuarantineErrors: quarantineErrors(config.QuarantineErrors),
+		CooldownTime:     cooldownTime(config.CooldownTime),
+		DonorLimit:       config.MaxDonorStreams,
+		TrustedDonors:    config.TrustedDonors,
+	})
 	app.Router = mux.NewRouter()
-	app.Router.Handle("/", app.AliveHandler()).Methods("GET")
-	app.Router.Handle("/active_streams", app.ActiveStreamsHandler()).Methods("GET")
-	app.Router.Handle("/streams", app.StreamsHandler()).Methods("POST")
-	app.Router.Handle("/streams/info/{stream_id}", app.StreamInfoHandler()).Methods("GET")
-	app.Router.Handle("/streams/activate", app.StreamActivateHandler()).Methods("POST")
-	app.Router.Handle("/streams/download/{stream_id}/{file:.+}", app.StreamDownloadHandler()).Methods("GET")
-	app.Router.Handle("/streams/start/{stream_id}", app.StreamEnableHandler()).Methods("PUT")
-	app.Router.Handle("/streams/stop/{stream_id}", app.StreamDisableHandler()).Methods("PUT")
-	app.Router.Handle("/streams/delete/{stream_id}", app.StreamDeleteHandler()).Methods("PUT")
-	app.Router.Handle("/streams/sync/{stream_id}", app.StreamSyncHandler()).Methods("GET")
-	app.Router.Handle("/core/start", app.CoreStartHandler()).Methods("GET")
-	app.Router.Handle("/core/frame", app.CoreFrameHandler()).Methods("PUT")
-	app.Router.Handle("/core/checkpoint", app.CoreCheckpointHandler()).Methods("PUT")
-	app.Router.Handle("/core/stop", app.CoreStopHandler()).Methods("PUT")
-	app.Router.Handle("/core/heartbeat", app.CoreHeartbeatHandler()).Methods("POST")
-	app.server = NewServer(config.InternalHost, app.Router)
+	app.Router.Use(app.RequestIDMiddleware)
+	app.Router.Use(app.CORSMiddleware)
+	app.Router.Use(app.RateLimitMiddleware)
+	app.Router.Use(app.TimeoutMiddleware)
+	app.Router.Methods("OPTIONS").Handler(app.PreflightHandler())
+	for _, rt := range app.routes() {
+		handler := rt.Handler
+		if rt.Auth == "manager" {
+			handler = app.ScopeMiddleware(rt.Scope, rt.ChecksTargets, app.EncodingMiddleware(handler))
+		}
+		app.Router.Handle(rt.Path, handler).Methods(rt.Method)
+		if rt.Timeout != 0 {
+			app.routeTimeouts[rt.Path] = rt.Timeout
+		}
+	}
+	app.server = NewServer(config.InternalHost, app.Router, config.ServerTimeouts)
+	app.ctx, app.cancel = context.WithCancel(context.Background())
+	app.server.BaseContext = func(net.Listener) context.Context { return app.ctx }
 
 	fmt.Println("finished setting up router")
 
 	if len(config.SSL) > 0 {
-		app.server.TLS(config.SSL["Cert"], config.SSL["Key"])
-		// app.server.CA(config.SSL["CA"])
+		if err := app.loadCertificate(config.SSL); err != nil {
+			fmt.Println(err)
+			panic("Could not load X509 Key Pair")
+		}
+		app.server.tlsConfig(config.DisableHTTP2)
+		app.server.TLSConfig.GetCertificate = app.getCertificate
+		app.server.TLSConfig.GetConfigForClient = app.getConfigForClient
 	}
 	app.statsWG.Add(1)
 	return &app
 }
 
+// The streams collection of this SCV, on the master session.
 func (app *Application) StreamsCursor() *mgo.Collection {
 	return app.Mongo.DB("streams").C(app.Config.Name)
 }
 
 type AppHandler func(http.ResponseWriter, *http.Request) error
 
-// When a handler returns an non-nil error, this method sets the status code to 400.
+// When a handler returns an non-nil error, this method replies with it in a
+// JSON envelope. The status code is 400 unless the error is a StatusError.
+// Handlers that gave up because the request's context was cancelled, ie. the
+// client hung up or the SCV is shutting down, are logged with a 499 instead,
+// and those that timed out with the 503 of TimeoutMiddleware.
 func (fn AppHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	code := 200
 	if err := fn(w, r); err != nil {
-		http.Error(w, err.Error(), 400)
-		code = 400
+		if ctxErr := r.Context().Err(); ctxErr != nil && err == ctxErr {
+			code := 499
+			if err == context.DeadlineExceeded {
+				code = ErrTimeout.Status
+			}
+			log.Printf("%s %s %s %s %d: %v", r.RemoteAddr, requestId(r), r.Method, r.URL, code, err)
+			return
+		}
+		code := writeError(w, r, err)
+		log.Printf("%s %s %s %s %d: %v", r.RemoteAddr, requestId(r), r.Method, r.URL, code, err)
+		return
 	}
-	log.Printf("%s %s %s %d", r.RemoteAddr, r.Method, r.URL, code)
+	log.Printf("%s %s %s %s %d", r.RemoteAddr, requestId(r), r.Method, r.URL, 200)
 }
 
-// Look up the User using the Authorization header
+// Look up the User using the Authorization header. The token is either the
+// user's primary token in users.all, an APIToken issued via /auth/tokens, or
+// one known to the other AuthProviders of the configuration. Successful
+// lookups are cached, see TokenCache.
 func (app *Application) CurrentUser(r *http.Request) (user string, err error) {
-	token := r.Header.Get("Authorization")
-	cursor := app.Mongo.DB("users").C("all")
-	result := make(map[string]interface{})
-	if err = cursor.Find(bson.M{"token": token}).One(&result); err != nil {
-		return
+	return app.tokenUser(r.Header.Get("Authorization"))
+}
+
+// Returns the user identified by a token, optionally sent as a bearer token.
+func (app *Application) tokenUser(token string) (user string, err error) {
+	identity, err := app.tokenIdentity(token)
+	return identity.User, err
+}
+
+// Like tokenUser, along with the scopes of service tokens. The error of the
+// first provider that knows the token but refuses it is returned if none
+// accepts it.
+func (app *Application) tokenIdentity(token string) (identity Identity, err error) {
+	token = strings.TrimPrefix(token, "Bearer ")
+	if cached, ok := app.tokenCache.GetIdentity(token); ok {
+		return cached, nil
 	}
-	user = result["_id"].(string)
-	return
+	err = ErrNotFound
+	for _, provider := range app.authProviders() {
+		identity, e := provider.Authenticate(token)
+		if e == nil {
+			app.tokenCache.PutIdentity(token, identity)
+			return identity, nil
+		}
+		if err == ErrNotFound {
+			err = e
+		}
+	}
+	return Identity{}, err
 }
 
 // Returns True if user is a manager.
 func (app *Application) IsManager(user string) bool {
-	cursor := app.Mongo.DB("users").C("managers")
-	result := make(map[string]interface{})
-	if err := cursor.Find(bson.M{"_id": user}).One(&result); err != nil {
+	if _, err := app.Database.Manager(user); err != nil {
 		return false
 	} else {
 		return true
@@ -316,11 +649,11 @@ func (app *Application) IsManager(user string) bool {
 func (app *Application) CurrentManager(r *http.Request) (user string, err error) {
 	user, err = app.CurrentUser(r)
 	if err != nil {
-		return "", errors.New("Unable to find user.")
+		return "", ErrUnauthorized.With("Unable to find user.")
 	}
 	isManager := app.IsManager(user)
 	if isManager == false {
-		return "", errors.New("Not a manager.")
+		return "", ErrForbidden.With("Not a manager.")
 	}
 	return user, nil
 }
@@ -339,24 +672,66 @@ func (app *Application) Run() {
 	app.LoadStreams()
 	go func() {
 		log.Println("Success! Now serving requests...")
-		err := app.server.ListenAndServe()
-		if err != nil {
+		if err := app.server.ListenAndServe(); err != nil {
 			log.Println("ListenAndServe: ", err)
 		}
 	}()
 	go app.RecordDeferredDocs()
+	app.workerWG.Add(9)
+	go app.RunDiskMonitor()
+	go app.RunCompactor()
+	go app.RunRetention()
+	go app.RunHeartbeat()
+	go app.RunScrubber()
+	go app.RunCreditor()
+	go app.RunReaper()
+	go app.RunWebhooks()
+	go app.RunPlugins()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for _ = range hup {
+			if _, _, err := app.Reload(); err != nil {
+				log.Println("Unable to reload configuration:", err)
+			}
+		}
+	}()
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill, syscall.SIGTERM)
 	<-c
+	signal.Stop(hup)
 	app.Shutdown()
 }
 
 func (app *Application) Shutdown() {
 	log.Printf("Shutting down gracefully...")
+	// requests still reading files or waiting for a stream give up once the
+	// server stops waiting for them
+	var abandon *time.Timer
+	if timeout := app.server.ShutdownTimeout; timeout > 0 {
+		abandon = time.AfterFunc(timeout, app.cancel)
+	} else {
+		app.cancel()
+	}
 	app.server.Close()
+	if abandon != nil {
+		abandon.Stop()
+	}
+	app.cancel()
+	app.flushBuffers()
 	close(app.finish)
 	app.statsWG.Wait()
-	app.Mongo.Close()
+	app.workerWG.Wait()
+	if err := app.saveUsageCache(); err != nil {
+		log.Println("Unable to save usage cache:", err)
+	}
+	if err := app.MarkUnreachable(); err != nil {
+		log.Println("Unable to mark SCV as unreachable:", err)
+	}
+	app.Database.Close()
+	if app.Mongo != nil {
+		app.Mongo.Close()
+	}
 }
 
 func (app *Application) AliveHandler() AppHandler {
@@ -370,54 +745,162 @@ func (app *Application) AliveHandler() AppHandler {
     Activate and return the highest priority stream of a target by
     popping the head of the priority queue.
     .. note:: This request can only be made by CCs.
+    .. note:: If ``target_id`` is omitted, a public target supporting the
+        engine is picked as in ``/assign``, in proportion to the weights
+        of the managers owning targets with idle streams.
+    .. note:: If ``wait`` is given and the target has no idle streams,
+        the request is held until a stream becomes idle, for at most
+        ``wait`` seconds (50 at most), or until the CC hangs up. Only
+        applies if ``target_id`` is given.
     **Example request**
     .. sourcecode:: javascript
         {
-            "target_id": "some_uuid4",
+            "target_id": "some_uuid4", // optional
             "engine": "engine_name",
-            "user": "jesse_v" // optional
+            "engine_version": "6.1.2", // optional
+            "user": "jesse_v", // optional
+            "wait": 30 // optional
         }
     **Example reply**
     .. sourcecode:: javascript
         {
-            "token": "uuid token"
+            "token": "uuid token",
+            "url": "https://raynor.stanford.edu:1234/core/start",
+            "expires": 1404506830, // unless the core sends a heartbeat
+            "heartbeat_interval": 300, // seconds
+            "backoff": 5 // doubled after each failed heartbeat
         }
     :status 200: OK
     :status 400: Bad request
+    :status 401: Not authenticated as a CC
+    :status 403: ``user`` or ``engine`` is banned
+    :status 404: Target does not exist
+    :status 426: ``engine_version`` is older than the target's
+        ``min_engine_version``, see ``/assign``
+    :status 429: ``user`` has ``MaxDonorStreams`` active streams, or the
+        target has ``max_active_streams`` active streams
+    :status 503: SCV is draining or under maintenance, see
+        ``/admin/maintenance``, or the target is paused
+    :status 507: SCV full
 */
 func (app *Application) StreamActivateHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) (err error) {
-		if r.Header.Get("Authorization") != app.Config.Password {
-			return errors.New("Unauthorized")
+		if app.isCC(r) == false {
+			return ErrUnauthorized
+		}
+		if app.ReadOnly() {
+			return ErrFull
+		}
+		if app.Draining() {
+			return errDraining
 		}
-		type Message struct {
-			TargetId string `json:"target_id"`
-			Engine   string `json:"engine"`
-			User     string `json:"user"`
+		if err := app.checkMaintenance(); err != nil {
+			return err
 		}
-		msg := Message{}
+		msg := ActivateRequest{}
 		decoder := json.NewDecoder(r.Body)
 		err = decoder.Decode(&msg)
 		if err != nil {
 			return errors.New("Bad request: " + err.Error())
 		}
-		fn := func(s *Stream) error {
-			err := os.RemoveAll(filepath.Join(app.StreamDir(s.StreamId), "buffer_files"))
+		if err := app.checkBan(msg.User, msg.Engine); err != nil {
 			return err
 		}
-		token, _, err := app.Manager.ActivateStream(msg.TargetId, msg.User, msg.Engine, fn)
-		if err != nil {
-			return errors.New("Unable to activate stream: " + err.Error())
+		var session activation
+		if msg.TargetId == "" {
+			var candidates []candidate
+			if candidates, err = app.assignableTargets(msg.Engine, msg.EngineVersion); err != nil {
+				return err
+			}
+			session, err = app.activateWeighted(r.Context(), candidates, msg.User, msg.Engine, requestId(r))
+		} else {
+			if err := app.checkEngineVersion(msg.TargetId, msg.Engine, msg.EngineVersion); err != nil {
+				return err
+			}
+			wait := msg.Wait
+			if wait > manager.MAX_ACTIVATION_WAIT {
+				wait = manager.MAX_ACTIVATION_WAIT
+			}
+			session, err = app.activateStream(r.Context(), msg.TargetId, msg.User, msg.Engine, requestId(r), time.Duration(wait)*time.Second)
 		}
-		type Reply struct {
-			token string
+		if err != nil {
+			return prefixError("Unable to activate stream: ", err)
 		}
-		data, _ := json.Marshal(map[string]string{"token": token})
+		data, _ := json.Marshal(app.activateReply(session))
 		w.Write(data)
 		return
 	}
 }
 
+// Cores are advised to send HEARTBEATS_PER_EXPIRATION heartbeats per
+// expiration time of their session, so that it survives a few lost ones.
+const HEARTBEATS_PER_EXPIRATION int = 4
+
+// Seconds a core is advised to wait before retrying a failed heartbeat, see
+// ActivateReply.Backoff.
+const HEARTBEAT_BACKOFF int = 5
+
+// A session activated for a core, see activateStream.
+type activation struct {
+	token   string
+	expires time.Time     // unless the core sends a heartbeat
+	timeout time.Duration // the session expires after going this long without a heartbeat
+}
+
+// Returns the reply telling the CC, and through it the core, where to start
+// the session and how often to keep it alive.
+func (app *Application) activateReply(session activation) ActivateReply {
+	interval := int(session.timeout/time.Second) / HEARTBEATS_PER_EXPIRATION
+	if interval < 1 {
+		interval = 1
+	}
+	backoff := HEARTBEAT_BACKOFF
+	if backoff > interval {
+		backoff = interval
+	}
+	return ActivateReply{
+		Token:             session.token,
+		URL:               app.coreStartURL(),
+		Expires:           int(session.expires.Unix()),
+		HeartbeatInterval: interval,
+		Backoff:           backoff,
+	}
+}
+
+// Activate a stream of the target for a core, clearing any frames buffered by
+// its previous core, see recoverBuffer. If the target has no idle stream, waits up to wait for
+// one, or until ctx is done. Returns the core's session.
+func (app *Application) activateStream(ctx context.Context, targetId, user, engine, requestId string, wait time.Duration) (activation, error) {
+	var hydrateErr error
+	session := activation{}
+	fn := func(s *Stream) error {
+		s.ActiveStream.Data = newSessionState()
+		// the stream stays locked, so the session cannot have been reset yet
+		session.expires = s.ActiveStream.Expires()
+		session.timeout = s.ActiveStream.Timeout
+		if hydrateErr = app.hydrateStream(s); hydrateErr != nil {
+			return hydrateErr
+		}
+		sessionData(s).requests["activate"] = requestId
+		err := app.recoverBuffer(s)
+		app.events.Publish(NewEvent(EVENT_ACTIVATED, s, map[string]interface{}{
+			"user":   user,
+			"engine": engine,
+		}))
+		return err
+	}
+	app.applyTargetOptions(targetId)
+	token, streamId, err := app.Manager.ActivateStreamWait(ctx, targetId, user, engine, wait, fn)
+	if hydrateErr != nil {
+		// the stream is unusable, keep it from being handed out again
+		if e := app.Manager.QuarantineStream(streamId, hydrateErr.Error()); e != nil {
+			log.Println("Unable to quarantine stream "+streamId+":", e)
+		}
+	}
+	session.token = token
+	return session, err
+}
+
 func splitExt(path string) (root string, ext string) {
 	ext = filepath.Ext(path)
 	root = path[0 : len(path)-len(ext)]
@@ -443,18 +926,39 @@ func maxCheckpoint(path string) (int, error) {
 /*
 .. http:get:: /streams/download/:stream_id/:filename
 	Download file ``filename`` from ``stream_id``. ``filename`` can be
-	either a file in ``files`` or a frame file posted by the core.
+	either a file in ``files``, a frame file posted by the core, or a
+	log file listed in the ``log_files`` of ``/streams/sync``.
 	If it is a frame file, then the frames are concatenated on the fly
 	before returning.
+	:query partition: download the copy of ``filename`` stored in the
+	    last checkpoint of partition N instead, eg.
+	    ``frames.xtc?partition=12``
+	:query checkpoint: with ``partition``, download the copy stored in
+	    checkpoint M of the partition instead of its last one, eg.
+	    ``frames.xtc?partition=12&checkpoint=3``
+	:query format: ``gz`` to download the file gzipped, or ``raw`` to
+	    download it decompressed, whichever way it is stored
+	:reqheader Accept-Encoding: gzip (optional)
+	:resheader Content-Encoding: gzip, if ``filename`` is stored as
+	    ``filename.gz``, ``format`` is not given and the manager accepts
+	    gzip. Otherwise such files are gunzipped on the fly.
 	.. note:: Even if ``filename`` is not found, this handler will
 	    return an empty file with the status code set to 200. This is
 	    because we cannot distinguish between a frame file that has not
 	    been received from that of a non-existent file.
-	:reqheader Authorization: manager authorization token
+	.. note:: Anyone may download the files of the streams of a target
+	    with the ``public_data`` option, except for its logs and
+	    recovered or buffered frames, which remain private to its managers.
+	:reqheader Authorization: manager authorization token, optional if
+	    the stream's target has ``public_data``
+	:reqheader If-None-Match: ETag of a previous download of the file
 	:resheader Content-Type: application/octet-stream
 	:resheader Content-Disposition: attachment; filename=filename
 	:resheader Content-Length: size of file
+	:resheader ETag: changes when the size or modification time of the file
+	    changes, and with the form in which it is sent
 	:status 200: OK
+	:status 304: File is unchanged since the download with the given ETag
 	:status 400: Bad request
 
 */
@@ -462,6 +966,30 @@ func (app *Application) StreamDownloadHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) (err error) {
 		streamId := mux.Vars(r)["stream_id"]
 		file := mux.Vars(r)["file"]
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "gz" && format != "raw" {
+			return errors.New("Bad format")
+		}
+		// the last checkpoint of a partition is resolved under the stream's lock
+		partition, checkpoint := 0, -1
+		if value := r.URL.Query().Get("partition"); value != "" {
+			if partition, err = strconv.Atoi(value); err != nil || partition <= 0 {
+				return errors.New("Bad partition")
+			}
+		}
+		if value := r.URL.Query().Get("checkpoint"); value != "" {
+			if checkpoint, err = strconv.Atoi(value); err != nil || checkpoint < 0 || partition == 0 {
+				return errors.New("Bad checkpoint")
+			}
+		}
+		partitionFile := func(checkpoint int) string {
+			return filepath.Join(strconv.Itoa(partition), strconv.Itoa(checkpoint), mux.Vars(r)["file"])
+		}
+		if partition > 0 && checkpoint >= 0 {
+			file = partitionFile(checkpoint)
+		} else if partition > 0 {
+			file = partitionFile(0)
+		}
 		absStreamDir, _ := filepath.Abs(filepath.Join(app.StreamDir(streamId)))
 		requestedFile, _ := filepath.Abs(filepath.Join(app.StreamDir(streamId), file))
 		if len(requestedFile) < len(absStreamDir) {
@@ -470,22 +998,147 @@ func (app *Application) StreamDownloadHandler() AppHandler {
 		if requestedFile[0:len(absStreamDir)] != absStreamDir {
 			return errors.New("Invalid file path.")
 		}
-		user, err := app.CurrentUser(r)
-		if err != nil {
-			return errors.New("Unable to find user.")
+		// anonymous requests may read the streams of targets with public data
+		user, authErr := app.CurrentUser(r)
+		if authErr != nil {
+			authErr = ErrUnauthorized.With("Unable to find user.")
 		}
-		return app.Manager.ReadStream(streamId, func(stream *Stream) error {
-			if stream.Owner != user {
-				return errors.New("You do not own this stream.")
+		var storedFile string
+		var info os.FileInfo
+		var generation int
+		// The file is only looked up under the stream's lock, and read once
+		// the lock is released so that slow reads do not hold up its core.
+		lookup := func(stream *Stream) error {
+			if public, err := app.checkRead(user, authErr, stream); err != nil {
+				return err
+			} else if public && privateStreamFile(file) {
+				return ErrForbidden.With("File is not public.")
 			}
-			binary, e := ioutil.ReadFile(requestedFile)
-			if e != nil {
+			// frames acknowledged to the core may still be queued
+			if stream.ActiveStream != nil && sessionData(stream).writer != nil &&
+				strings.HasPrefix(filepath.Clean(file), "buffer_files") {
+				sessionData(stream).writer.Flush()
+			}
+			if partition > 0 && checkpoint < 0 {
+				last, e := app.lastCheckpoint(stream, partition)
+				if e != nil {
+					return errors.New("Unable to read file.")
+				}
+				file = partitionFile(last)
+				requestedFile = filepath.Join(absStreamDir, file)
+			}
+			var e error
+			if storedFile, info, e = statStored(requestedFile); e != nil {
 				return errors.New("Unable to read file.")
 			}
+			generation = streamData(stream).generation
+			return nil
+		}
+		// not a JSON reply, see EncodingMiddleware
+		w.Header().Set("Content-Type", "application/octet-stream")
+		var binary []byte
+		for attempt := 1; ; attempt++ {
+			if e := app.Manager.ReadStream(streamId, lookup); e != nil {
+				return e
+			}
+			compressed := filepath.Ext(storedFile) == ".gz"
+			gzipped := compressed
+			// the compressed copy of the file is sent as a Content-Encoding
+			encoded := false
+			if format != "" {
+				gzipped = format == "gz"
+			} else if storedFile != requestedFile {
+				w.Header().Set("Vary", "Accept-Encoding")
+				gzipped = acceptsGzip(r)
+				encoded = gzipped
+			}
+			etag := fileETag(info)
+			if gzipped && compressed == false {
+				etag = strings.TrimSuffix(etag, `"`) + `-gz"`
+			} else if gzipped == false && compressed {
+				etag = strings.TrimSuffix(etag, `"`) + `-raw"`
+			}
+			if notModified(w, r, etag) {
+				return nil
+			}
+			// frames may be appended to the file while it is read
+			if binary, err = readFileSize(r.Context(), storedFile, info.Size()); err != nil && r.Context().Err() != nil {
+				return err
+			} else if err != nil {
+				err = errors.New("Unable to read file.")
+			} else {
+				storedName := file + storedFile[len(requestedFile):]
+				if dir, name, ok := checksumDir(app.StreamDir(streamId), storedName); ok {
+					if e := verifyChecksum(dir, name, binary); e != nil {
+						log.Println("Corrupted file:", e)
+						err = errors.New("File is corrupted.")
+					}
+				}
+			}
+			if e := app.checkGeneration(streamId, generation); e == errFilesChanged && attempt < MAX_READ_ATTEMPTS {
+				continue
+			} else if e != nil {
+				return e
+			}
+			if err != nil {
+				return err
+			}
+			if gzipped && compressed == false {
+				binary, err = gzipBytes(binary)
+			} else if gzipped == false && compressed {
+				binary, err = gunzipBytes(binary)
+			}
+			if err != nil {
+				return errors.New("Unable to decompress file.")
+			}
+			if encoded {
+				w.Header().Set("Content-Encoding", "gzip")
+			}
 			w.Write(binary)
 			return nil
-		})
+		}
+	}
+}
+
+// Returns the files a core starts a stream from: its checkpoint files, and the
+// seed files that are not in the checkpoint.
+func (app *Application) withSeedFiles(streamId string, checkpointFiles map[string]string) (map[string]string, error) {
+	files := make(map[string]string)
+	for name, data := range checkpointFiles {
+		files[name] = data
+	}
+	seedDir := filepath.Join(app.StreamDir(streamId), "files")
+	seedFiles, e := ioutil.ReadDir(seedDir)
+	if e != nil {
+		return nil, errors.New("Cannot read seed directory")
 	}
+	for _, fileProp := range seedFiles {
+		if _, ok := files[fileProp.Name()]; ok == false {
+			binary, e := ioutil.ReadFile(filepath.Join(seedDir, fileProp.Name()))
+			if e != nil {
+				return nil, errors.New("Cannot read seed files")
+			}
+			files[fileProp.Name()] = string(binary)
+		}
+	}
+	return files, nil
+}
+
+// Number of times a handler reads the files of a stream again if they change
+// while they are read.
+const MAX_READ_ATTEMPTS int = 3
+
+var errFilesChanged = ErrConflict.With("Files of the stream changed while they were read, retry")
+
+// Returns errFilesChanged if files of the stream were removed or replaced since
+// it had generation, see streamState.filesChanged.
+func (app *Application) checkGeneration(streamId string, generation int) error {
+	return app.Manager.ReadStream(streamId, func(stream *Stream) error {
+		if streamData(stream).generation != generation {
+			return errFilesChanged
+		}
+		return nil
+	})
 }
 
 // Return the number of partitions in a stream.
@@ -513,7 +1166,11 @@ func (app *Application) ListPartitions(streamId string) ([]int, error) {
     If the partition is comprised of the list [5, 12, 38], then the
     stream is divided into the partition (0, 5](5, 12](12, 38], where
     (a,b] denote the open and closed ends.
-    :reqheader Authorization: Manager token
+    :reqheader Authorization: Manager token, optional if the stream's
+        target has ``public_data``
+    :reqheader If-None-Match: ETag of a previous reply
+    :resheader ETag: changes whenever the reply changes
+    :query manifest: if ``true``, also list the files of every partition
     **Example reply**:
     .. sourcecode:: javascript
         {
@@ -521,20 +1178,66 @@ func (app *Application) ListPartitions(streamId string) ([]int, error) {
             'frame_files': ['frames.xtc', 'log.txt'],
             'checkpoint_files': ['state.xml.gz.b64']
             'seed_files': ['state.xml.gz.b64', 'system.xml.gz.b64',
-                           'integrator.xml.gz.b64']
+                           'integrator.xml.gz.b64'],
+            'archives': [{'name': 'archives/3.tar', 'partitions': [1, 2, 3]}],
+            'log_files': ['logs/1404502030/core.log.gz'],
+            'recovered_files': ['recovered_buffer/frames.xtc'],
+            'target_paused': false
         }
     .. note:: If 'partitions' is not an empty list, then 'frame_files'
         and 'checkpoint_files' are present.
+    .. note:: 'log_files' lists the logs uploaded by cores with
+        ``/core/logs``, which can be downloaded via their name.
+    .. note:: 'recovered_files' lists the frame files buffered by the
+        stream's previous core after its last checkpoint, which are kept
+        when the stream is activated again if ``KeepBuffers`` is set.
+        They can be downloaded via their name, and are replaced by the
+        next recovered buffer or discarded with
+        ``DELETE /streams/recovered/:stream_id``.
+    .. note:: 'target_paused' is true while the stream's target is paused,
+        see ``/targets/:target_id/pause``.
+    .. note:: Anyone may sync the streams of a target with the
+        ``public_data`` option. 'log_files' and 'recovered_files' are
+        then empty unless the request is from a manager of the stream.
+    .. note:: Old partitions are periodically merged into tar archives
+        that no longer appear in 'partitions'. Each archive can be
+        downloaded via its name and extracts into the partition layout.
+    **Example reply with manifest=true** (other keys omitted):
+    .. sourcecode:: javascript
+        {
+            'manifest': [
+                {
+                    'partition': 5,
+                    'files': {
+                        '0/frames.xtc': {'size': 1024, 'sha256': '9f86d0...', 'offset': 0},
+                        '0/checkpoint_files/state.xml.gz.b64': {'size': 2048, 'sha256': '60303a...'}
+                    }
+                },
+                {
+                    'partition': 12,
+                    'files': {
+                        '0/frames.xtc': {'size': 1432, 'sha256': 'fd61a0...', 'offset': 1024},
+                        '0/checkpoint_files/state.xml.gz.b64': {'size': 2048, 'sha256': '2c26b4...'}
+                    }
+                }
+            ]
+        }
+    .. note:: The 'offset' of a frame file is its position in the
+        concatenation of the frame files of the listed partitions. A
+        partition's copy of a frame file can be downloaded with
+        ``/streams/download/:stream_id/:filename?partition=N``.
+    :status 200: OK
+    :status 304: Stream is unchanged since the reply with the given ETag
+    :status 400: Bad request
 */
 func (app *Application) StreamSyncHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		streamId := mux.Vars(r)["stream_id"]
-		user, auth_err := app.CurrentManager(r)
-		if auth_err != nil {
-			return auth_err
-		}
+		// anonymous requests may read the streams of targets with public data
+		user, authErr := app.CurrentManager(r)
 
 		result := make(map[string]interface{})
+		manifest := r.URL.Query().Get("manifest") == "true"
 
 		listSeeds := func() []string {
 			seedDir := filepath.Join(app.StreamDir(streamId), "files")
@@ -549,7 +1252,9 @@ func (app *Application) StreamSyncHandler() AppHandler {
 			return res
 		}
 
-		listFramesAndCheckpoints := func(min_partition int) ([]string, []string) {
+		// checkpoints are listed from the last one, which is never removed
+		// by the retention policy, see RetentionPolicy
+		listFramesAndCheckpoints := func(min_partition int, checkpointDir string) ([]string, []string) {
 
 			frames := make([]string, 0)
 			checkpoints := make([]string, 0)
@@ -561,11 +1266,10 @@ func (app *Application) StreamSyncHandler() AppHandler {
 				panic("FATAL StreamSyncHandler(), can't read frameDir: " + frameDir)
 			}
 			for _, fileInfo := range frameFiles {
-				if fileInfo.Name() != "checkpoint_files" {
+				if fileInfo.Name() != "checkpoint_files" && fileInfo.Name() != CHECKSUM_MANIFEST && fileInfo.Name() != FRAME_METADATA {
 					frames = append(frames, fileInfo.Name())
 				}
 			}
-			checkpointDir := filepath.Join(frameDir, "checkpoint_files")
 			checkpointFiles, err := ioutil.ReadDir(checkpointDir)
 			if err != nil {
 				panic("FATAL StreamSyncHandler(), can't read checkpointDir: " + checkpointDir)
@@ -579,19 +1283,42 @@ func (app *Application) StreamSyncHandler() AppHandler {
 		}
 
 		e := app.Manager.ReadStream(streamId, func(stream *Stream) error {
-			if stream.Owner != user {
-				return errors.New("You do not own this stream.")
+			public, err := app.checkRead(user, authErr, stream)
+			if err != nil {
+				return err
 			}
-			partitions, err := app.ListPartitions(streamId)
+			partitions, err := app.streamPartitions(stream)
+			if err != nil {
+				return err
+			}
+			archives, err := app.ListArchives(streamId)
 			if err != nil {
 				return err
 			}
 			result["partitions"] = partitions
+			result["archives"] = archives
+			result["target_paused"] = app.Manager.Paused(stream.TargetId)
 			result["seed_files"] = listSeeds()
+			if public {
+				result["log_files"], result["recovered_files"] = []string{}, []string{}
+			} else if result["log_files"], err = app.listLogs(streamId); err != nil {
+				return err
+			} else if result["recovered_files"], err = app.listRecovered(streamId); err != nil {
+				return err
+			}
 			if len(partitions) > 0 {
-				result["frame_files"], result["checkpoint_files"] = listFramesAndCheckpoints(partitions[0])
+				last := partitions[len(partitions)-1]
+				checkpoint, err := app.lastCheckpoint(stream, last)
+				if err != nil {
+					return err
+				}
+				checkpointDir := filepath.Join(app.StreamDir(streamId), strconv.Itoa(last), strconv.Itoa(checkpoint), "checkpoint_files")
+				result["frame_files"], result["checkpoint_files"] = listFramesAndCheckpoints(partitions[0], checkpointDir)
 			}
-			return nil
+			if manifest {
+				result["manifest"], err = app.PartitionManifests(r.Context(), streamId, partitions)
+			}
+			return err
 		})
 		if e != nil {
 			return e
@@ -600,6 +1327,9 @@ func (app *Application) StreamSyncHandler() AppHandler {
 		if e != nil {
 			return e
 		}
+		if notModified(w, r, dataETag(data)) {
+			return nil
+		}
 		w.Write(data)
 		return nil
 	}
@@ -624,7 +1354,11 @@ func (app *Application) StreamEnableHandler() AppHandler {
 			return auth_err
 		}
 		streamId := mux.Vars(r)["stream_id"]
-		return app.Manager.EnableStream(streamId, user)
+		owner, err := app.checkOwner(streamId, user)
+		if err != nil {
+			return err
+		}
+		return app.Manager.EnableStream(streamId, owner)
 	}
 }
 
@@ -647,13 +1381,98 @@ func (app *Application) StreamDisableHandler() AppHandler {
 			return auth_err
 		}
 		streamId := mux.Vars(r)["stream_id"]
-		return app.Manager.DisableStream(streamId, user)
+		owner, err := app.checkOwner(streamId, user)
+		if err != nil {
+			return err
+		}
+		return app.Manager.DisableStream(streamId, owner)
 	}
 }
 
+// Checks that user may manage the stream, returning its owner.
+func (app *Application) checkOwner(streamId, user string) (owner string, err error) {
+	err = app.Manager.ReadStream(streamId, func(stream *Stream) error {
+		if app.canManage(user, stream) == false {
+			return ErrForbidden.With("You do not own this stream.")
+		}
+		owner = stream.Owner
+		return nil
+	})
+	return owner, err
+}
+
 /*
- .. http:put:: /streams/delete/:stream_id
-    Delete a stream permanently.
+ .. http:put:: /streams/quarantine/:stream_id
+    Quarantine a stream suspected of producing bad data. A quarantined
+    stream is not assigned and its data is kept on disk, but it cannot
+    be started until it is released. Streams are also quarantined
+    automatically when an upload fails validation, or when their cores
+    fail ``QuarantineErrors`` (5 by default) times within an hour.
+    :reqheader Authorization: Manager's authorization token
+    **Example request**:
+    .. sourcecode:: javascript
+        {
+            "reason": "bad forcefield" // optional
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) StreamQuarantineHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		msg := struct {
+			Reason string `json:"reason"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil && err != io.EOF {
+			return errors.New("Could not decode JSON")
+		}
+		if msg.Reason == "" {
+			msg.Reason = "quarantined by " + user
+		}
+		if _, err := app.checkOwner(streamId, user); err != nil {
+			return err
+		}
+		return app.Manager.QuarantineStream(streamId, msg.Reason)
+	}
+}
+
+/*
+ .. http:put:: /streams/release/:stream_id
+    Release a quarantined stream, making it eligible to be assigned
+    again. Its error count is reset.
+    :reqheader Authorization: Manager's authorization token
+    **Example request**:
+    .. sourcecode:: javascript
+        {
+            // empty
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) StreamReleaseHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		if _, err := app.checkOwner(streamId, user); err != nil {
+			return err
+		}
+		return app.Manager.ReleaseStream(streamId)
+	}
+}
+
+/*
+ .. http:put:: /streams/delete/:stream_id
+    Delete a stream. The stream is removed from the SCV immediately, its
+    files are removed in the background. If the SCV is configured with
+    ``TrashDays``, the files are kept in the trash for that many days,
+    during which the stream can be restored with ``/streams/undelete``.
     :reqheader Authorization: Manager's authorization token
     **Example request**:
     .. sourcecode:: javascript
@@ -672,18 +1491,42 @@ func (app *Application) StreamDeleteHandler() AppHandler {
 		if auth_err != nil {
 			return auth_err
 		}
-		err := app.Manager.RemoveStream(streamId, user)
+		owner, err := app.checkOwner(streamId, user)
 		if err != nil {
 			return err
 		}
-		fn1 := func() error {
-			return app.StreamsCursor().RemoveId(streamId)
-		}
-		app.statsMutex.Lock()
-		app.stats.PushBack(fn1)
-		app.statsMutex.Unlock()
+		return app.deleteStream(streamId, owner, user)
+	}
+}
+
+// Remove a stream owned by owner from the SCV and leave a tombstone recording
+// that deletedBy deleted it, for the reaper to remove its files.
+func (app *Application) deleteStream(streamId, owner, deletedBy string) error {
+	var event Event
+	var status string
+	app.Manager.ReadStream(streamId, func(stream *Stream) error {
+		event = NewEvent(EVENT_DELETED, stream, nil)
+		status = stream.MongoStatus
 		return nil
+	})
+	err := app.Manager.RemoveStream(streamId, owner)
+	if err != nil {
+		return err
+	}
+	app.removeShard(event.TargetId)
+	app.usage.RemoveStream(streamId)
+	tombstone := bson.M{
+		"status":         "deleted",
+		"deleted":        int(time.Now().Unix()),
+		"deleted_by":     deletedBy,
+		"deleted_status": status,
 	}
+	if err := app.Database.UpdateStream(streamId, tombstone, nil); err != nil {
+		return err
+	}
+	app.events.Publish(event)
+	app.wakeReaper()
+	return nil
 }
 
 /*
@@ -699,10 +1542,25 @@ func (app *Application) StreamDeleteHandler() AppHandler {
             }
             "tags": {
                 "pdb.gz.b64": "file4.b64",
-            } // optional
+            }, // optional
+            "parent_stream_id": "uuid4:hello", // optional
+            "fork_frame": 25, // optional
+            "options": {"steps_per_frame": 5000} // optional
         }
     .. note:: Binary files must be base64 encoded.
     .. note:: tags are files that are not used by the core.
+    .. note:: The files are written in parallel by up to ``WriteWorkers``
+        goroutines shared by every creation, and removed along with the
+        stream's directory if any of them or the stream's insertion into
+        the database fails.
+    .. note:: ``options`` override those of the target for this stream,
+        see ``/streams/options``.
+    .. note:: ``parent_stream_id`` and ``fork_frame`` record that the
+        stream was forked from a frame of another stream on this SCV.
+        See ``/streams/lineage``.
+    .. note:: The stream belongs to the namespace of the manager, and
+        can be managed by every manager of the namespace. The target
+        must belong to it too, see ``/targets``.
     **Example reply**
     .. sourcecode:: javascript
         {
@@ -710,6 +1568,8 @@ func (app *Application) StreamDeleteHandler() AppHandler {
         }
     :status 200: OK
     :status 400: Bad request
+    :status 403: The target or parent stream belongs to another namespace
+    :status 507: SCV full
 */
 func (app *Application) StreamsHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) (err error) {
@@ -717,33 +1577,49 @@ func (app *Application) StreamsHandler() AppHandler {
 		if auth_err != nil {
 			return auth_err
 		}
-		type Message struct {
-			TargetId string            `json:"target_id"`
-			Files    map[string]string `json:"files"`
-			Tags     map[string]string `json:"tags,omitempty"`
+		if app.ReadOnly() {
+			return ErrFull
 		}
-		msg := Message{}
+		msg := PostStreamRequest{}
 		decoder := json.NewDecoder(r.Body)
 		err = decoder.Decode(&msg)
 		if err != nil {
 			return errors.New("Bad request: " + err.Error())
 		}
+		if err := app.checkTokenTargets(r, msg.TargetId); err != nil {
+			return err
+		}
+		if err := app.checkTarget(msg.TargetId, user); err != nil {
+			return err
+		}
+		if err := app.checkFork(msg.ParentStreamId, msg.ForkFrame, user); err != nil {
+			return err
+		}
+		if err := checkStreamOptions(msg.Options, false); err != nil {
+			return err
+		}
 		streamId := RandSeq(36) + ":" + app.Config.Name
 		// Add files to disk
-		stream := NewStream(streamId, msg.TargetId, user, 0, 0, int(time.Now().Unix()))
+		stream := newStream(streamId, msg.TargetId, user, 0, 0, int(time.Now().Unix()))
+		stream.Namespace = app.namespace(user)
+		stream.ParentStreamId = msg.ParentStreamId
+		stream.ForkFrame = msg.ForkFrame
+		if len(msg.Options) > 0 {
+			stream.Options = msg.Options
+		}
 		todo := map[string]map[string]string{"files": msg.Files, "tags": msg.Tags}
-		for Directory, Content := range todo {
-			for filename, fileb64 := range Content {
-				files_dir := filepath.Join(app.StreamDir(streamId), Directory)
-				os.MkdirAll(files_dir, 0776)
-				err = ioutil.WriteFile(filepath.Join(files_dir, filename), []byte(fileb64), 0776)
-				if err != nil {
-					return err
+		for _, Content := range todo {
+			for filename := range Content {
+				if validTagName(filename) == false {
+					return errors.New("Bad request: bad file name " + filename)
 				}
 			}
 		}
-		cursor := app.StreamsCursor()
-		err = cursor.Insert(stream)
+		size, err := app.writeStreamFiles(r.Context(), streamId, todo)
+		if err != nil {
+			return err
+		}
+		err = app.Database.InsertStream(stream)
 		if err != nil {
 			// clean up
 			os.RemoveAll(app.StreamDir(streamId))
@@ -752,11 +1628,17 @@ func (app *Application) StreamsHandler() AppHandler {
 		// Insert stream into Manager after ensuring state is correct.
 		e := app.Manager.AddStream(stream, msg.TargetId, true)
 		if e != nil {
+			// clean up
+			os.RemoveAll(app.StreamDir(streamId))
+			app.Database.RemoveStream(streamId)
 			return e
 		}
-		data, err := json.Marshal(map[string]string{"stream_id": streamId})
-		if e != nil {
-			return e
+		app.addShard(msg.TargetId)
+		app.usage.SetNamespace(streamId, stream.Namespace)
+		app.usage.Add(msg.TargetId, streamId, size)
+		data, err := json.Marshal(PostStreamReply{streamId})
+		if err != nil {
+			return err
 		}
 		w.Write(data)
 		return
@@ -770,8 +1652,12 @@ func (app *Application) StreamInfoHandler() AppHandler {
 		streamId := mux.Vars(r)["stream_id"]
 		var result []byte
 		var isActive bool
+		var partial bool
+		var targetId string
 		e := app.Manager.ReadStream(streamId, func(stream *Stream) error {
-			if stream.activeStream != nil {
+			targetId = stream.TargetId
+			partial = streamData(stream).partial
+			if stream.ActiveStream != nil {
 				isActive = true
 			} else {
 				isActive = false
@@ -784,13 +1670,77 @@ func (app *Application) StreamInfoHandler() AppHandler {
 		}
 		tmp := make(map[string]interface{})
 		json.Unmarshal(result, &tmp)
+		if partial {
+			// read without keeping them in memory, see loadStreamFields
+			doc := Stream{}
+			if err := app.Database.FindStream(streamId, &doc); err != nil {
+				return err
+			}
+			if doc.Meta != nil {
+				tmp["meta"] = doc.Meta
+			}
+			if doc.Options != nil {
+				tmp["options"] = doc.Options
+			}
+		}
 		tmp["active"] = isActive
+		tmp["target_paused"] = app.Manager.Paused(targetId)
 		result_final, _ := json.Marshal(tmp)
 		w.Write(result_final)
 		return nil
 	}
 }
 
+/*
+.. http:get:: /targets/:target_id/usage
+    Number of bytes stored on disk by the streams of a target.
+    :reqheader Authorization: Manager's authorization token
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "bytes": 1048576,
+            "quota": 0, // 0 means unlimited
+            "streams": {
+                "stream_id_1": 524288,
+                "stream_id_2": 524288
+            },
+            "namespace_bytes": 2097152, // stored by the manager's namespace
+            "namespace_quota": 0
+        }
+    :status 200: OK
+    :status 400: Bad request
+    :status 403: The target belongs to another namespace
+*/
+func (app *Application) TargetUsageHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		targetId := mux.Vars(r)["target_id"]
+		if err := app.checkTarget(targetId, user); err != nil {
+			return err
+		}
+		namespace := app.namespace(user)
+		result := map[string]interface{}{
+			"bytes":           app.usage.Target(targetId),
+			"quota":           app.Settings().TargetQuota,
+			"streams":         app.usage.Streams(targetId),
+			"namespace_bytes": app.usage.Namespace(namespace),
+			"namespace_quota": app.Settings().NamespaceQuota,
+		}
+		data, e := json.Marshal(result)
+		if e != nil {
+			return e
+		}
+		if notModified(w, r, dataETag(data)) {
+			return nil
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
 func pathExists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -802,12 +1752,109 @@ func pathExists(path string) (bool, error) {
 	return false, err
 }
 
+// Length of a frame of a target in ns, read from its ns_per_frame option or
+// from its steps_per_frame and timestep_fs options. Returns 0 if unknown.
+func nsPerFrame(options map[string]interface{}) float64 {
+	if ns, ok := options["ns_per_frame"].(float64); ok {
+		return ns
+	}
+	steps, ok1 := options["steps_per_frame"].(float64)
+	timestep, ok2 := options["timestep_fs"].(float64)
+	if ok1 && ok2 {
+		return steps * timestep / 1e6
+	}
+	return 0
+}
+
+/*
+.. http:get:: /active_streams
+    Progress of the active streams, grouped by target.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "target_id": {
+                "stream_id": {
+                    "user": "jesse_v",
+                    "engine": "openmm",
+                    "start_time": 1404502030,
+                    "donor_frames": 20.5,
+                    "buffer_frames": 3, // since the last checkpoint
+                    "session_frames": 23,
+                    "last_heartbeat": 1404505630,
+                    "last_frame": 1404505610,
+                    "last_checkpoint": 1404505000,
+                    "frames_per_day": 561.2,
+                    "ns_per_day": 56.1,
+                    "paused": true, // omitted unless paused
+                    "paused_until": 1404509230
+                }
+            }
+        }
+    .. note:: ``frames_per_day`` is estimated from the time between the
+        first and last frames posted by the core. ``ns_per_day`` is only
+        given for targets with an ``ns_per_frame`` option, or with both
+        ``steps_per_frame`` and ``timestep_fs``. ``paused`` is set while
+        the core is paused by its donor, see ``/core/pause``.
+    :query since: a version from a previous reply, to only list the streams
+        activated, deactivated, paused and resumed since then
+    :resheader X-Active-Streams-Version: version of the reply, to pass as
+        ``since`` in the next poll
+    **Example reply** with ``since``
+    .. sourcecode:: javascript
+        {
+            "version": 1520,
+            "reset": false, // true if the changes since ``since`` are
+                            // no longer known, in which case "activated"
+                            // lists every active stream
+            "activated": {
+                "target_id": {
+                    "stream_id": {...} // as above
+                }
+            },
+            "deactivated": {
+                "target_id": ["stream_id"]
+            }
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
 func (app *Application) ActiveStreamsHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		data, e := json.Marshal(app.Manager.GetActiveStreams())
+		var since uint64
+		value := r.URL.Query().Get("since")
+		if value != "" {
+			var err error
+			if since, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return errors.New("Bad request: since must be a version")
+			}
+		}
+		delta := app.Manager.ActiveStreamsSince(since)
+		for targetId, streams := range delta.Activated {
+			options, err := app.targetOptions(targetId)
+			if err != nil {
+				continue
+			}
+			ns := nsPerFrame(options)
+			for streamId, info := range streams {
+				if info.Options != nil {
+					info.NsPerDay = info.FramesPerDay * nsPerFrame(mergeOptions(options, info.Options))
+				} else {
+					info.NsPerDay = info.FramesPerDay * ns
+				}
+				streams[streamId] = info
+			}
+		}
+		var data []byte
+		var e error
+		if value == "" {
+			data, e = json.Marshal(delta.Activated)
+		} else {
+			data, e = json.Marshal(delta)
+		}
 		if e != nil {
 			return e
 		}
+		w.Header().Set("X-Active-Streams-Version", strconv.FormatUint(delta.Version, 10))
 		w.Write(data)
 		return nil
 	}
@@ -818,11 +1865,32 @@ func (app *Application) ActiveStreamsHandler() AppHandler {
     Append a frame to the stream's buffer.
     If the core posts to this method, then the WS assumes that the
     frame is valid. The data received is stored in a buffer until a
-    checkpoint is received. It is assumed that files given here are
-    binary appendable. Files ending in .b64 or .gz are decoded
+    checkpoint is received. Files ending in .b64 or .gz are decoded
     automatically.
+    .. note:: The files of each frame are appended to those of the
+        previous frames, unless the ``frame_formats`` option of the
+        target sets otherwise for their extension:
+        ``append`` appends them, ``split`` stores each frame in a file of
+        its own, eg. ``frames.dcd/13.dcd`` for a frame starting at frame
+        13, ``jsonl`` appends the JSON documents of the file one per
+        line, and ``reject`` refuses the frame with a 400. Formats that
+        cannot be appended are rejected unless set, eg. ``dcd``, ``nc``
+        and ``h5``, and ``json`` files are ``jsonl`` by default.
+        .. sourcecode:: javascript
+            "frame_formats": {"dcd": "split", "log": "append"}
+    .. note:: With ``FrameStorage`` set to ``compressed``, .gz files are
+        only base64 decoded and appended as is, and other files are
+        gzipped, so that frames are stored as eg. ``frames.xtc.gz``.
     :reqheader Content-MD5: MD5 Sum of the body
     :reqheader Authorization: core Authorization token
+    .. note:: The body may not exceed ``MaxFrameBytes`` (64MB by default),
+        nor may the decoded files.
+    .. note:: The decoded files are checked by the validators listed in
+        the target's ``validators`` option. If any of them fails,
+        nothing is written.
+    .. note:: If the target's ``verify_frames`` option is true, every
+        .xtc file must be a valid XTC file holding ``frames`` frames,
+        whose steps follow those of the session's previous frames.
     **Example request**
     .. sourcecode:: javascript
         {
@@ -831,77 +1899,134 @@ func (app *Application) ActiveStreamsHandler() AppHandler {
                 "log.txt.gz.b64": "file.gz.b64"
             },
             "frames": 25,  // optional, number of frames in the files
+            "meta": {  // optional
+                "simulation_time": 220.0,  // ps simulated by the end of the frame
+                "wall_clock": 95.3,  // seconds taken to compute the frame
+                "gpu": "GeForce GTX 980",
+                "core_version": "0.1.4"
+            }
         }
+    .. note:: ``meta`` is appended to the ``frames.jsonl`` sidecar of the
+        buffer, which ends up in the frame's partition, and is listed by
+        ``/streams/frames``. Frame files may not be named ``frames.jsonl``.
     :status 200: OK
     :status 400: Bad request
+    :status 401: Invalid core token
+    :status 403: The donor or engine of the core is banned, the stream
+        is deactivated
+    :status 409: Frame was already posted
+    :status 413: Body exceeds ``MaxFrameBytes``
+    :status 429: Frame uploads exceed ``StreamIngest`` or ``GlobalIngest``,
+        retry after the number of seconds in the Retry-After header, or
+        too many frames are waiting to be written
+    .. note:: The frame is written to disk after the reply. If writing
+        fails, the next frame or checkpoint fails.
+    :status 507: SCV full, the core should stop the stream
 */
 func (app *Application) CoreFrameHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) (err error) {
+		if app.ReadOnly() {
+			return ErrFull
+		}
 		token := r.Header.Get("Authorization")
+		// nothing is read from unknown cores
+		if err := app.Manager.CheckActiveToken(token); err != nil {
+			return err
+		}
+		// throttle before the body hits the disk, unless its size is unknown
+		if r.ContentLength >= 0 {
+			if err := app.throttleFrame(w, token, r.ContentLength); err != nil {
+				return err
+			}
+		}
 		md5String := r.Header.Get("Content-MD5")
-		body, _ := ioutil.ReadAll(r.Body)
-		h := md5.New()
-		io.WriteString(h, string(body))
-		if md5String != hex.EncodeToString(h.Sum(nil)) {
-			return errors.New("MD5 mismatch")
+		limit := uploadLimit(app.Settings().MaxFrameBytes, MAX_FRAME_BYTES)
+		body, err := app.spoolBody(w, r, limit, md5String)
+		if err != nil {
+			return err
 		}
-		return app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
-			type Message struct {
-				Files  map[string]string `json:"files"`
-				Frames int               `json:"frames"`
+		defer releaseBody(body)
+		if r.ContentLength < 0 {
+			info, err := body.Stat()
+			if err != nil {
+				return err
 			}
-			msg := Message{Frames: 1}
-			decoder := json.NewDecoder(bytes.NewReader(body))
-			err := decoder.Decode(&msg)
+			if err := app.throttleFrame(w, token, info.Size()); err != nil {
+				return err
+			}
+		}
+		// decoding happens before the stream is locked, writing after it
+		// is unlocked, see frameWriter.
+		msg := FrameRequest{Frames: 1}
+		if err := json.NewDecoder(body).Decode(&msg); err != nil {
+			return errors.New("Could not decode JSON")
+		}
+		compressed := app.Settings().FrameStorage == STORE_COMPRESSED
+		files, decodeErr := decodeFrameFiles(msg.Files, compressed, limit)
+		if _, ok := files[FRAME_METADATA]; ok && decodeErr == nil {
+			decodeErr = errReservedFile
+		}
+		if err := app.refuseBanned(token); err != nil {
+			return err
+		}
+		var streamId string
+		err = app.Manager.ModifyActiveStream(token, recordFailure(r, func(stream *Stream) error {
+			streamId = stream.StreamId
+			if md5String == sessionData(stream).frameHash {
+				return ErrConflict.With("POSTed same frame twice")
+			}
+			if decodeErr != nil {
+				return decodeErr
+			}
+			if err := app.checkQuota(stream); err != nil {
+				return err
+			}
+			// nothing is written unless every file of the frame is valid
+			var invalid error
+			if compressed {
+				invalid = app.validateCompressedFrame(stream, files)
+			} else {
+				invalid = app.validateUpload(stream, files, false)
+			}
+			if invalid != nil {
+				return invalid
+			}
+			count, err := app.verifyFrames(stream, files, msg.Frames)
 			if err != nil {
-				return errors.New("Could not decode JSON")
+				return err
 			}
-			if md5String == stream.activeStream.frameHash {
-				return errors.New("POSTed same frame twice")
+			formats, err := app.frameFormats(stream.TargetId)
+			if err != nil {
+				return err
 			}
-			stream.activeStream.frameHash = md5String
-			for filename, filestring := range msg.Files {
-				root, ext := splitExt(filename)
-				filebin := []byte(filestring)
-				if ext == ".b64" {
-					filename = root
-					reader := base64.NewDecoder(base64.StdEncoding, bytes.NewReader(filebin))
-					filecopy, err := ioutil.ReadAll(reader)
-					if err != nil {
-						return err
-					}
-					filebin = filecopy
-					root, ext := splitExt(filename)
-					if ext == ".gz" {
-						filename = root
-						reader, err := gzip.NewReader(bytes.NewReader(filebin))
-						defer reader.Close()
-						if err != nil {
-							return err
-						}
-						filecopy, err := ioutil.ReadAll(reader)
-						if err != nil {
-							return err
-						}
-						filebin = filecopy
-					}
-				}
-				dir := filepath.Join(app.StreamDir(stream.StreamId), "buffer_files")
-				os.MkdirAll(dir, 0776)
-				filename = filepath.Join(dir, filename)
-				file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0776)
-				defer file.Close()
-				if err != nil {
-					return err
-				}
-				_, err = file.Write(filebin)
+			frame := stream.Frames + stream.ActiveStream.BufferFrames + 1
+			if files, err = formats.apply(files, frame); err != nil {
+				return err
+			}
+			if msg.Meta != nil {
+				line, err := frameRecordLine(frame, time.Now(), *msg.Meta)
 				if err != nil {
 					return err
 				}
+				files[FRAME_METADATA] = line
+			}
+			if sessionData(stream).writer == nil {
+				sessionData(stream).writer = app.newFrameWriter(stream)
 			}
-			stream.activeStream.bufferFrames += 1
+			if err := sessionData(stream).writer.Enqueue(&bufferedFrame{files: files}); err != nil {
+				return err
+			}
+			sessionData(stream).frameHash = md5String
+			stream.ActiveStream.BufferFrames += 1
+			sessionData(stream).addFrameCount(count)
+			stream.ActiveStream.RecordFrame(time.Now())
+			app.events.Publish(NewEvent(EVENT_FRAME, stream, map[string]interface{}{
+				"buffer_frames": stream.ActiveStream.BufferFrames,
+			}))
 			return nil
-		})
+		}))
+		app.quarantineInvalid(streamId, err)
+		return err
 	}
 }
 
@@ -923,64 +2048,177 @@ func (app *Application) CoreFrameHandler() AppHandler {
     .. note:: filenames must be almost be present in stream_files
     .. note:: If ``frames`` is not provided, the backend uses
         buffer frames an approximation
+    .. note:: ``frames`` may be fractional. It is credited to the donor
+        and added to the stream's ``donor_frames``, while the partition
+        is named after the number of buffered frames.
+    .. note:: If the target's ``verify_frames`` option is true,
+        ``frames`` must be less than one frame more than the buffered
+        frames, counted in XTC frames if they had .xtc files.
+    .. note:: The body may not exceed ``MaxCheckpointBytes`` (256MB by
+        default).
+    .. note:: The checkpoint and buffered frames are flushed to disk
+        before the request returns. Frames are written after
+        ``/core/frame`` replies, so this waits for them first.
+    .. note:: The files are checked by the target's validators first.
+    .. note:: Checkpoints may be sampled for verification according to
+        the target's ``verification`` option, see ``/verifications/activate``.
+        ``energy``, the potential energy of the checkpoint in kJ/mol, is
+        optional and compared with the verifier's.
+    .. note:: Older checkpoints are then removed according to the
+        target's ``checkpoint_retention`` option, see RetentionPolicy.
+    .. note:: Checkpoints of benchmark targets are discarded, see
+        ``/benchmarks``.
+    .. note:: Once the stream has the ``max_frames`` of its target, it
+        is completed and disabled, so that the core's next request
+        fails with a 401. Likewise for every stream of the target once
+        they have ``max_target_frames`` together. Milestone events are
+        sent for the target's ``milestones`` the stream passed.
+    .. note:: The plugins of the SCV then analyse the checkpoint in the
+        background, see CheckpointPlugin.
     :status 200: OK
     :status 400: Bad request
+    :status 401: Invalid core token
+    :status 403: The donor or engine of the core is banned, the stream
+        is deactivated
+    :status 413: Body exceeds ``MaxCheckpointBytes``
 */
 func (app *Application) CoreCheckpointHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) (err error) {
 		token := r.Header.Get("Authorization")
+		if err := app.refuseBanned(token); err != nil {
+			return err
+		}
 		md5String := r.Header.Get("Content-MD5")
-		body, _ := ioutil.ReadAll(r.Body)
-		h := md5.New()
-		io.WriteString(h, string(body))
-		if md5String != hex.EncodeToString(h.Sum(nil)) {
-			return errors.New("MD5 mismatch")
+		body, err := app.spoolBody(w, r, uploadLimit(app.Settings().MaxCheckpointBytes, MAX_CHECKPOINT_BYTES), md5String)
+		if err != nil {
+			return err
 		}
-		return app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
+		defer releaseBody(body)
+		var streamId, owner, targetId string
+		var flushed *CheckpointInfo
+		completed := false
+		err = app.Manager.ModifyActiveStream(token, recordFailure(r, func(stream *Stream) error {
+			streamId, owner, targetId = stream.StreamId, stream.Owner, stream.TargetId
+			// the frames acknowledged so far belong to this checkpoint
+			if writer := sessionData(stream).writer; writer != nil {
+				if err := writer.Flush(); err != nil {
+					return err
+				}
+			}
 			streamDir := app.StreamDir(stream.StreamId)
 			bufferDir := filepath.Join(streamDir, "buffer_files")
 			checkpointDir := filepath.Join(bufferDir, "checkpoint_files")
 			os.MkdirAll(checkpointDir, 0776)
-			type Message struct {
-				Files  map[string]string `json:"files"`
-				Frames float64           `json:"frames"`
-			}
-			msg := Message{}
-			decoder := json.NewDecoder(bytes.NewReader(body))
+			msg := CheckpointRequest{}
+			decoder := json.NewDecoder(body)
 			err := decoder.Decode(&msg)
 			if err != nil {
 				return errors.New("Could not decode JSON")
 			}
+			donorFrames := float64(stream.ActiveStream.BufferFrames)
+			if msg.Frames != nil {
+				if *msg.Frames < 0 {
+					return errors.New("frames must not be negative")
+				}
+				donorFrames = *msg.Frames
+			}
+			if err := app.verifyDonorFrames(stream, donorFrames); err != nil {
+				return err
+			}
+			files := make(map[string][]byte)
+			for filename, filestring := range msg.Files {
+				files[filename] = []byte(filestring)
+			}
+			if err := app.validateUpload(stream, files, true); err != nil {
+				return err
+			}
+			if app.isBenchmark(stream.TargetId) {
+				return app.discardBenchmarkCheckpoint(stream, donorFrames)
+			}
 			for filename, filestring := range msg.Files {
 				fileDir := filepath.Join(checkpointDir, filename)
 				fileBin := []byte(filestring)
-				ioutil.WriteFile(fileDir, fileBin, 0776)
+				if err := writeFileAtomic(fileDir, fileBin, 0776); err != nil {
+					return errors.New("Unable to write checkpoint: " + err.Error())
+				}
+				app.usage.Add(stream.TargetId, stream.StreamId, int64(len(fileBin)))
+			}
+			if err := writeChecksums(bufferDir); err != nil {
+				return errors.New("Unable to write checkpoint: " + err.Error())
 			}
-			bufferFrames := stream.activeStream.bufferFrames
+			// The checkpoint makes the buffered frames canonical, so they
+			// have to be on disk before the buffer is moved into place.
+			if err := syncTree(bufferDir); err != nil {
+				return errors.New("Unable to write checkpoint: " + err.Error())
+			}
+			bufferFrames := stream.ActiveStream.BufferFrames
 			sumFrames := stream.Frames + bufferFrames
 			partition := filepath.Join(streamDir, strconv.Itoa(sumFrames))
 			os.MkdirAll(partition, 0766)
-			var renameDir string
+			checkpoint := 0
 
 			if bufferFrames == 0 {
 				exist, _ := pathExists(partition)
 				if exist {
-					lastCheckpoint, _ := maxCheckpoint(partition)
-					renameDir = filepath.Join(partition, strconv.Itoa(lastCheckpoint+1))
+					lastCheckpoint, _ := app.lastCheckpoint(stream, sumFrames)
+					checkpoint = lastCheckpoint + 1
 				} else {
-					renameDir = filepath.Join(partition, "1")
+					checkpoint = 1
 				}
-			} else {
-				renameDir = filepath.Join(partition, "0")
 			}
-			os.Rename(bufferDir, renameDir)
+			renameDir := filepath.Join(partition, strconv.Itoa(checkpoint))
+			streamData(stream).filesChanged()
+			if err := os.Rename(bufferDir, renameDir); err != nil {
+				return errors.New("Unable to write checkpoint: " + err.Error())
+			}
+			streamData(stream).index.addCheckpoint(sumFrames, checkpoint)
+			if err := syncDir(partition); err != nil {
+				return errors.New("Unable to write checkpoint: " + err.Error())
+			}
+			if err := syncDir(streamDir); err != nil {
+				return errors.New("Unable to write checkpoint: " + err.Error())
+			}
+			// a few checkpoints are re-simulated by trusted cores, which
+			// start from the previous one
+			if bufferFrames > 0 {
+				app.sampleVerification(stream, renameDir, bufferFrames, msg.Energy)
+			}
+			// the checkpoint is safe on disk, older ones may go
+			if _, err := app.applyRetention(stream, false); err != nil {
+				log.Println("Unable to apply checkpoint retention to stream "+stream.StreamId+":", err)
+			}
 			stream.Frames = sumFrames
-			stream.activeStream.donorFrames += msg.Frames
-			stream.activeStream.bufferFrames = 0
+			stream.DonorFrames += donorFrames
+			stream.ActiveStream.DonorFrames += donorFrames
+			stream.ActiveStream.BufferFrames = 0
+			sessionData(stream).xtcFrames = 0
+			stream.ActiveStream.LastCheckpoint = time.Now()
+			app.events.Publish(NewEvent(EVENT_CHECKPOINT, stream, map[string]interface{}{
+				"frames":       stream.Frames,
+				"donor_frames": stream.DonorFrames,
+			}))
+			completed = app.checkProgress(stream, sumFrames-bufferFrames)
+			flushed = &CheckpointInfo{stream.StreamId, stream.TargetId, renameDir, stream.Frames}
 			// TODO: update frame count in MongoDB (do we want to?)
 			// This stream is mutex'd
 			return nil
-		})
+		}))
+		app.quarantineInvalid(streamId, err)
+		if err != nil {
+			return err
+		}
+		if flushed != nil {
+			app.analyzeCheckpoint(*flushed)
+		}
+		if completed {
+			if err := app.Manager.DisableStream(streamId, owner); err != nil {
+				log.Println("Unable to disable completed stream "+streamId+":", err)
+			}
+		}
+		if err := app.checkTargetCompleted(targetId); err != nil {
+			log.Println("Unable to complete target "+targetId+":", err)
+		}
+		return nil
 	}
 }
 
@@ -988,7 +2226,9 @@ func (app *Application) CoreCheckpointHandler() AppHandler {
 .. http:get:: /core/start
     Get files needed for the core to start an activated stream.
     :reqheader Authorization: core Authorization token
-    :resheader Content-MD5: MD5 hexdigest of the body
+    :reqheader Accept-Encoding: gzip (optional)
+    :resheader Content-Encoding: gzip, if requested by the core
+    :resheader Content-MD5: MD5 hexdigest of the body as sent
     **Example reply**
     .. sourcecode:: javascript
         {
@@ -1007,8 +2247,14 @@ func (app *Application) CoreCheckpointHandler() AppHandler {
                 "category": "Benchmark"
             }
         }
+    .. note:: If the last checkpoint is corrupted, the stream falls back
+        to the most recent intact checkpoint, and the frames after it
+        are deleted.
     :status 200: OK
     :status 400: Bad request
+    :status 401: Invalid core token
+    :status 403: The donor or engine of the core is banned, the stream
+        is deactivated
 */
 func (app *Application) CoreStartHandler() AppHandler {
 
@@ -1028,67 +2274,81 @@ func (app *Application) CoreStartHandler() AppHandler {
 
 	return func(w http.ResponseWriter, r *http.Request) (err error) {
 		token := r.Header.Get("Authorization")
-		type Reply struct {
-			StreamId string            `json:"stream_id"`
-			TargetId string            `json:"target_id"`
-			Files    map[string]string `json:"files"`
-			Options  interface{}       `json:"options"`
+		if err := app.refuseBanned(token); err != nil {
+			return err
 		}
-		rep := Reply{
+		rep := CoreStartReply{
 			Files:   make(map[string]string),
 			Options: make(map[string]interface{}),
 		}
+		// The files are read without holding the stream's lock, so that
+		// frames and deactivations are not held up by slow disks. The
+		// restart point is looked up under the lock, and the lock is taken
+		// again to check that the files did not change meanwhile.
+		var generation int
+		var point *RestartPoint
+		var overrides map[string]interface{}
 		e := app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
 			rep.StreamId = stream.StreamId
 			rep.TargetId = stream.TargetId
-			// Load stream's options from Mongo
-			cursor := app.Mongo.DB("data").C("targets")
-			mgoRes := make(map[string]interface{})
-			if err = cursor.Find(bson.M{"_id": stream.TargetId}).One(&mgoRes); err != nil {
-				return errors.New("Cannot load target's options")
-			}
-			rep.Options = mgoRes["options"]
-			// Load the streams' files
+			generation = streamData(stream).generation
+			// replaced rather than modified by /streams/options
+			overrides = stream.Options
 			if stream.Frames > 0 {
-				frameDir := filepath.Join(app.StreamDir(rep.StreamId), strconv.Itoa(stream.Frames))
-				lastCheckpoint, _ := maxCheckpoint(frameDir)
-				checkpointDir := filepath.Join(frameDir, strconv.Itoa(lastCheckpoint), "checkpoint_files")
-				checkpointFiles, e := ioutil.ReadDir(checkpointDir)
-				if e != nil {
-					return errors.New("Cannot load checkpoint directory")
-				}
-				for _, fileProp := range checkpointFiles {
-					binary, e := ioutil.ReadFile(filepath.Join(checkpointDir, fileProp.Name()))
-					if e != nil {
-						return errors.New("Cannot read checkpoint file")
-					}
-					rep.Files[fileProp.Name()] = string(binary)
-				}
-			}
-			seedDir := filepath.Join(app.StreamDir(rep.StreamId), "files")
-			seedFiles, e := ioutil.ReadDir(seedDir)
-			if e != nil {
-				return errors.New("Cannot read seed directory")
-			}
-			for _, fileProp := range seedFiles {
-				_, ok := rep.Files[fileProp.Name()]
-				if ok == false {
-					binary, e := ioutil.ReadFile(filepath.Join(seedDir, fileProp.Name()))
-					if e != nil {
-						return errors.New("Cannot read seed files")
-					}
-					rep.Files[fileProp.Name()] = string(binary)
-				}
+				checkpoint, _ := app.lastCheckpoint(stream, stream.Frames)
+				point = &RestartPoint{stream.Frames, checkpoint}
 			}
 			return nil
 		})
 		if e != nil {
 			return e
 		}
+		// Load stream's options from Mongo, or from the cache if Mongo is down
+		options, err := app.targetOptions(rep.TargetId)
+		if err != nil {
+			return errors.New("Cannot load target's options")
+		}
+		rep.Options = mergeOptions(options, overrides)
+		var checkpointFiles map[string]string
+		if point != nil {
+			checkpointFiles, err = app.readCheckpoint(rep.StreamId, *point)
+		}
+		if err == nil {
+			rep.Files, err = app.withSeedFiles(rep.StreamId, checkpointFiles)
+		}
+		e = app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
+			if err == nil && streamData(stream).generation == generation {
+				return nil
+			}
+			// the checkpoint changed or is unusable, in which case the
+			// stream falls back to an older one
+			checkpointFiles, err := app.restartFiles(stream)
+			if err != nil {
+				return err
+			}
+			rep.Files, err = app.withSeedFiles(stream.StreamId, checkpointFiles)
+			return err
+		})
+		if e != nil {
+			return e
+		}
 		data, e := json.Marshal(rep)
 		if e != nil {
 			return e
 		}
+		// The seed and checkpoint files are b64 text, so they shrink
+		// considerably for cores on slow connections.
+		if acceptsGzip(r) {
+			data, e = gzipBytes(data)
+			if e != nil {
+				return e
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Header().Set("Vary", "Accept-Encoding")
+		h := md5.New()
+		h.Write(data)
+		w.Header().Set("Content-MD5", hex.EncodeToString(h.Sum(nil)))
 		w.Write(data)
 		return
 	}
@@ -1102,18 +2362,26 @@ func (app *Application) CoreStartHandler() AppHandler {
     .. sourcecode:: javascript
         {
             "error": "message_b64",  // optional
+            "kind": "simulation" // optional: core, simulation or aborted
         }
     .. note:: ``error`` must be b64 encoded.
+    .. note:: Failures are recorded and listed by ``/streams/errors``.
+        Without a ``kind``, a failure is a simulation failure if its
+        message mentions NaNs, and a core fault otherwise. Core faults
+        add 1 to the stream's error count and simulation failures 2,
+        since restarting from the same checkpoint tends to fail again.
+        Aborts are not counted.
+    .. note:: A stream that failed is not activated again for
+        ``CooldownTime`` seconds (10 by default) per error in its error
+        count, and at most 30 minutes.
     :status 200: OK
     :status 400: Bad request
+    :status 401: Invalid core token
 */
 func (app *Application) CoreStopHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) (err error) {
 		token := r.Header.Get("Authorization")
-		type Message struct {
-			Error string `json:"error"`
-		}
-		msg := Message{}
+		msg := CoreStopRequest{}
 		if r.Body != nil {
 			decoder := json.NewDecoder(r.Body)
 			err = decoder.Decode(&msg)
@@ -1121,10 +2389,24 @@ func (app *Application) CoreStopHandler() AppHandler {
 				return
 			}
 		}
-		error_count := 0
-		if msg.Error != "" {
-			error_count += 1
+		kind := ""
+		if msg.Error != "" || msg.Kind != "" {
+			if kind, err = classifyError(msg.Kind, decodeErrorMessage(msg.Error)); err != nil {
+				return err
+			}
 		}
+		error_count := ERROR_WEIGHTS[kind]
+		app.Manager.ModifyActiveStream(token, func(stream *Stream) error {
+			sessionData(stream).requests["stop"] = requestId(r)
+			if kind != "" {
+				app.recordStreamError(stream, kind, decodeErrorMessage(msg.Error))
+				app.events.Publish(NewEvent(EVENT_ERRORED, stream, map[string]interface{}{
+					"error": msg.Error,
+					"kind":  kind,
+				}))
+			}
+			return nil
+		})
 		return app.Manager.DeactivateStream(token, error_count)
 	}
 }
@@ -1136,10 +2418,94 @@ func (app *Application) CoreStopHandler() AppHandler {
     :reqheader Authorization: core Authorization token
     :status 200: OK
     :status 400: Bad request
+    :status 401: Invalid core token
+    :status 403: The donor or engine of the core is banned, the stream
+        is deactivated
 */
 func (app *Application) CoreHeartbeatHandler() AppHandler {
 	return func(w http.ResponseWriter, r *http.Request) (err error) {
 		token := r.Header.Get("Authorization")
+		if err := app.refuseBanned(token); err != nil {
+			return err
+		}
 		return app.Manager.ResetActiveStream(token)
 	}
 }
+
+/*
+.. http:post:: /core/pause
+    Keep the stream active while the core is paused, eg. while the
+    donor's computer sleeps, instead of losing the frames it buffered
+    when it stops sending heartbeats. The stream is flagged as paused in
+    ``/active_streams`` until the pause ends or the core resumes.
+    :reqheader Authorization: core Authorization token
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "duration": 3600 // optional, seconds
+        }
+    .. note:: Pauses last at most 8 hours, which is also the default.
+        Once the pause is over, the stream expires unless the core sends
+        a heartbeat or resumes within the expiration time.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "paused_until": 1404509230,
+            "expires": 1404510430
+        }
+    :status 200: OK
+    :status 400: Bad request
+    :status 401: Invalid core token
+    :status 403: The donor or engine of the core is banned, the stream
+        is deactivated
+*/
+func (app *Application) CorePauseHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		token := r.Header.Get("Authorization")
+		if err := app.refuseBanned(token); err != nil {
+			return err
+		}
+		msg := CorePauseRequest{}
+		if r.Body != nil {
+			if err := json.NewDecoder(r.Body).Decode(&msg); err != nil && err != io.EOF {
+				return errors.New("Bad request: " + err.Error())
+			}
+		}
+		if msg.Duration < 0 {
+			return errors.New("Bad request: duration must be positive")
+		}
+		until, expires, err := app.Manager.PauseActiveStream(token, time.Duration(msg.Duration)*time.Second)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(CorePauseReply{
+			PausedUntil: int(until.Unix()),
+			Expires:     int(expires.Unix()),
+		})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:post:: /core/resume
+    End the pause of the stream, see ``/core/pause``. Resuming counts as
+    a heartbeat.
+    :reqheader Authorization: core Authorization token
+    :status 200: OK
+    :status 401: Invalid core token
+    :status 403: The donor or engine of the core is banned, the stream
+        is deactivated
+*/
+func (app *Application) CoreResumeHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		token := r.Header.Get("Authorization")
+		if err := app.refuseBanned(token); err != nil {
+			return err
+		}
+		return app.Manager.ResumeActiveStream(token)
+	}
+}
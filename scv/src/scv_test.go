@@ -1,8 +1,13 @@
 package scv
 
 import (
+	"../manager"
+	"archive/tar"
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -15,6 +20,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -25,10 +31,38 @@ import (
 
 var _ = fmt.Printf
 
+// Activation function of the streams activated directly through the Manager,
+// which starts the SCV's state of the session like activateStream.
+var mockFunc = func(s *Stream) error {
+	s.ActiveStream.Data = newSessionState()
+	return nil
+}
+
+// An Injector that persists nothing.
+var intf = &manager.ManagerCallbacks{}
+
 type Fixture struct {
 	app *Application
 }
 
+// Returns a stream of the Manager, nil if it does not exist.
+func (f *Fixture) stream(streamId string) (stream *Stream) {
+	f.app.Manager.ReadStream(streamId, func(s *Stream) error {
+		stream = s
+		return nil
+	})
+	return
+}
+
+// Returns the stream active under token, nil if there is none.
+func (f *Fixture) activeStream(token string) (stream *Stream) {
+	f.app.Manager.ModifyActiveStream(token, func(s *Stream) error {
+		stream = s
+		return nil
+	})
+	return
+}
+
 func (f *Fixture) addUser(user string) (token string) {
 	token = RandSeq(36)
 	type Msg struct {
@@ -65,6 +99,8 @@ func NewFixture() *Fixture {
 		Password:     "hello",
 		ExternalHost: "alexis.stanford.edu",
 		InternalHost: "127.0.0.1",
+		// most tests reactivate failed streams right away
+		CooldownTime: -1,
 	}
 	f := Fixture{
 		app: NewApplication(config),
@@ -75,6 +111,8 @@ func NewFixture() *Fixture {
 	}
 	os.RemoveAll(f.app.Config.Name + "_data")
 	go f.app.RecordDeferredDocs()
+	f.app.workerWG.Add(1)
+	go f.app.RunReaper()
 	return &f
 }
 
@@ -93,7 +131,7 @@ func TestPostStreamUnauthorized(t *testing.T) {
 	req, _ := http.NewRequest("POST", "/streams", nil)
 	w := httptest.NewRecorder()
 	f.app.Router.ServeHTTP(w, req)
-	assert.Equal(t, w.Code, 400)
+	assert.Equal(t, w.Code, 401)
 	token := f.addUser("yutong")
 	req, _ = http.NewRequest("POST", "/streams", nil)
 	req.Header.Add("Authorization", token)
@@ -101,7 +139,7 @@ func TestPostStreamUnauthorized(t *testing.T) {
 
 	f.app.Router.ServeHTTP(w, req)
 
-	assert.Equal(t, w.Code, 400)
+	assert.Equal(t, w.Code, 403)
 }
 
 func TestPostBadStream(t *testing.T) {
@@ -132,6 +170,19 @@ func (f *Fixture) download(token, streamId, file string) (data []byte) {
 	return
 }
 
+// GET url with an If-None-Match header, returns the status and ETag of the
+// reply.
+func (f *Fixture) conditionalGet(token, url, etag string) (int, string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Authorization", token)
+	if etag != "" {
+		req.Header.Add("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	return w.Code, w.Header().Get("ETag")
+}
+
 func (f *Fixture) downloadFrame(token, streamId, file string, frame int) (data []byte) {
 	return f.download(token, streamId, strconv.Itoa(frame)+"/0/"+file)
 }
@@ -152,9 +203,9 @@ func (f *Fixture) activateStream(target_id, engine, user, cc_token string) (toke
 	if code != 200 {
 		return
 	}
-	result := make(map[string]string)
+	result := ActivateReply{}
 	json.Unmarshal(w.Body.Bytes(), &result)
-	token = result["token"]
+	token = result.Token
 	return
 }
 
@@ -201,10 +252,12 @@ func (f *Fixture) putFrame(token string, data string) (code int) {
 }
 
 type SyncResult struct {
-	Partitions      []int    `json:"partitions"`
-	SeedFiles       []string `json:"seed_files"`
-	FrameFiles      []string `json:"frame_files"`
-	CheckpointFiles []string `json:"checkpoint_files"`
+	Partitions      []int     `json:"partitions"`
+	SeedFiles       []string  `json:"seed_files"`
+	FrameFiles      []string  `json:"frame_files"`
+	CheckpointFiles []string  `json:"checkpoint_files"`
+	Archives        []Archive `json:"archives"`
+	RecoveredFiles  []string  `json:"recovered_files"`
 }
 
 func (f *Fixture) syncStream(token, streamId string) (SyncResult, int) {
@@ -241,6 +294,22 @@ func (f *Fixture) streamStart(token, streamId string) int {
 	return w.Code
 }
 
+func (f *Fixture) streamQuarantine(token, streamId, body string) int {
+	req, _ := http.NewRequest("PUT", "/streams/quarantine/"+streamId, strings.NewReader(body))
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	return w.Code
+}
+
+func (f *Fixture) streamRelease(token, streamId string) int {
+	req, _ := http.NewRequest("PUT", "/streams/release/"+streamId, nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	return w.Code
+}
+
 func (f *Fixture) putCheckpoint(token string, data string) (code int) {
 	dataBuffer := bytes.NewBuffer([]byte(data))
 	req, _ := http.NewRequest("PUT", "/core/checkpoint", dataBuffer)
@@ -278,6 +347,14 @@ func (f *Fixture) deleteStream(token, streamId string) (code int) {
 	return w.Code
 }
 
+func (f *Fixture) undeleteStream(token, streamId string) (code int) {
+	req, _ := http.NewRequest("POST", "/streams/undelete/"+streamId, nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	return w.Code
+}
+
 func (f *Fixture) coreHeartbeat(token string) (code int) {
 	req, _ := http.NewRequest("POST", "/core/heartbeat", nil)
 	req.Header.Add("Authorization", token)
@@ -329,6 +406,202 @@ func TestRegisterSCV(t *testing.T) {
 	assert.Equal(t, config.Password, f.app.Config.Password)
 }
 
+func TestReloadConfig(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	f.app.RegisterSCV()
+	file, _ := ioutil.TempFile("", "scv_config")
+	defer os.Remove(file.Name())
+	file.WriteString(`{
+		"MongoURI": "localhost:27017",
+		"Name": "testServer",
+		"Password": "world",
+		"ExternalHost": "alexis.stanford.edu",
+		"InternalHost": "127.0.0.1"
+	}`)
+	file.Close()
+	f.app.ConfigPath = file.Name()
+	req, _ := http.NewRequest("POST", "/admin/reload", nil)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 401)
+	req.Header.Add("Authorization", "hello")
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	result := make(map[string][]string)
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Equal(t, result["applied"], []string{"Password"})
+	assert.Equal(t, result["restart_required"], []string{})
+	config := Configuration{}
+	f.app.Mongo.DB("servers").C("scvs").FindId(f.app.Config.Name).One(&config)
+	assert.Equal(t, config.Password, "world")
+	// the old password no longer works
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 401)
+}
+
+func TestSCVHeartbeat(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	f.app.RegisterSCV()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	f.postStream(auth_token, jsonData)
+	f.postStream(auth_token, jsonData)
+	_, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Nil(t, f.app.Heartbeat())
+	cursor := f.app.Mongo.DB("servers").C("scvs")
+	result := make(map[string]interface{})
+	assert.Nil(t, cursor.FindId(f.app.Config.Name).One(&result))
+	assert.Equal(t, result["status"], "online")
+	assert.Equal(t, result["active_streams"], 1)
+	assert.Equal(t, result["inactive_streams"], 1)
+	assert.True(t, result["last_seen"].(int) > 0)
+	assert.Nil(t, f.app.MarkUnreachable())
+	assert.Nil(t, cursor.FindId(f.app.Config.Name).One(&result))
+	assert.Equal(t, result["status"], "unreachable")
+}
+
+func TestDrain(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	f.app.RegisterSCV()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	f.postStream(auth_token, jsonData)
+	f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+
+	drain := func(method string) (DrainReply, int) {
+		req, _ := http.NewRequest(method, "/admin/drain", nil)
+		req.Header.Add("Authorization", f.app.Config.Password)
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		reply := DrainReply{}
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return reply, w.Code
+	}
+	req, _ := http.NewRequest("POST", "/admin/drain", nil)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 401)
+	reply, code := drain("POST")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, reply, DrainReply{true, 1})
+	result := make(map[string]interface{})
+	assert.Nil(t, f.app.Mongo.DB("servers").C("scvs").FindId(f.app.Config.Name).One(&result))
+	assert.Equal(t, result["status"], "draining")
+
+	// the active stream keeps running, but no other is activated
+	_, code = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 503)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "12345"}}`), 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+	reply, _ = drain("POST")
+	assert.Equal(t, reply, DrainReply{true, 0})
+
+	reply, code = drain("DELETE")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, reply, DrainReply{false, 0})
+	_, code = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+}
+
+func TestMaintenance(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	f.postStream(auth_token, jsonData)
+	// the window started a minute ago
+	start := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	f.app.Config.Maintenance = []MaintenanceWindow{{Start: start, Duration: 3600, Reason: "OS updates"}}
+	_, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 503)
+
+	req, _ := http.NewRequest("GET", "/admin/maintenance", nil)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 401)
+	req.Header.Add("Authorization", f.app.Config.Password)
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	reply := MaintenanceReply{}
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	assert.Equal(t, reply.State, MAINTENANCE_ACTIVE)
+	assert.Equal(t, len(reply.Windows), 1)
+	assert.Equal(t, reply.Windows[0].NextEnd-reply.Windows[0].NextStart, 3600)
+
+	f.app.Config.Maintenance = nil
+	_, code = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+}
+
+func TestTruncate(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	other_token := f.addManager("diwakar", 1)
+	stream_id, _ := f.postStream(auth_token, jsonData)
+	token, _ := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	for i, frames := range []int{2, 3} {
+		for j := 0; j < frames; j++ {
+			assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "`+strconv.Itoa(i*10+j)+`"}}`), 200)
+		}
+		assert.Equal(t, f.putCheckpoint(token, `{"files": {"state.xml.gz.b64": "`+strconv.Itoa(i)+`"}}`), 200)
+	}
+
+	truncate := func(token, body string) (RestartPoint, int) {
+		req, _ := http.NewRequest("PUT", "/streams/truncate/"+stream_id, bytes.NewBufferString(body))
+		req.Header.Add("Authorization", token)
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		point := RestartPoint{}
+		json.Unmarshal(w.Body.Bytes(), &point)
+		return point, w.Code
+	}
+	_, code := truncate(auth_token, `{"frames": 4}`)
+	assert.Equal(t, code, 409)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+	_, code = truncate(other_token, `{"frames": 4}`)
+	assert.Equal(t, code, 403)
+	_, code = truncate(auth_token, `{}`)
+	assert.Equal(t, code, 400)
+
+	// the partition of 5 frames goes, the next core restarts from the first checkpoint
+	point, code := truncate(auth_token, `{"frames": 4}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, point, RestartPoint{2, 0})
+	sync, _ := f.syncStream(auth_token, stream_id)
+	assert.Equal(t, sync.Partitions, []int{2})
+	assert.Equal(t, f.loadMongoStream(stream_id)["frames"], 2)
+	token, _ = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	req, _ := http.NewRequest("GET", "/core/start", nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	reply := CoreStartReply{}
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	assert.Equal(t, reply.Files["state.xml.gz.b64"], "0")
+}
+
 func TestLoadStreamsSuccess(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
@@ -337,7 +610,7 @@ func TestLoadStreamsSuccess(t *testing.T) {
 		"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
 		"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
 	f.postStream(token, jsonData)
-	f.app.Manager = NewManager(f.app)
+	f.app.Manager = manager.NewManager(f.app)
 	defer func() {
 		if recover() != nil {
 			assert.True(t, false)
@@ -406,13 +679,123 @@ func TestLoadStreamsInconsistentFrames(t *testing.T) {
 	assert.Nil(t, err)
 	stream, code := f.getStream(stream_id)
 	assert.Equal(t, code, 200)
-	f.app.Manager = NewManager(f.app)
+	f.app.Manager = manager.NewManager(f.app)
 	f.app.LoadStreams()
 	stream, code = f.getStream(stream_id)
 	assert.Equal(t, code, 200)
 	assert.Equal(t, stream.Frames, 2)
 }
 
+func TestLoadStreamsSkipFrameVerify(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	token := f.addManager("yutong", 1)
+	jsonData := `{"target_id":"12345",
+		"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+		"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	stream_ids := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		stream_id, _ := f.postStream(token, jsonData)
+		stream_ids = append(stream_ids, stream_id)
+	}
+	err := f.app.StreamsCursor().UpdateId(stream_ids[0], bson.M{"$set": bson.M{"frames": 50}})
+	assert.Nil(t, err)
+	f.app.Config.LoadWorkers = 3
+	f.app.Config.SkipFrameVerify = true
+	f.app.Manager = manager.NewManager(f.app)
+	f.app.LoadStreams()
+	assert.Equal(t, len(f.app.Manager.StreamIds()), 20)
+	stream, code := f.getStream(stream_ids[0])
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.Frames, 50)
+}
+
+func TestLoadStreamsLazy(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	stream_id, _ := f.postStream(auth_token, jsonData)
+	missing_id, _ := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "ZnJhbWUx"}}`), 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "ZnJhbWUy"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"state.xml.gz.b64": "c3RhdGU="}}`), 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+	time.Sleep(time.Second)
+	active_id := stream_id
+	if f.loadMongoStream(stream_id)["frames"] == 0 {
+		active_id, missing_id = missing_id, stream_id
+	}
+	err := f.app.StreamsCursor().UpdateId(active_id, bson.M{"$set": bson.M{"frames": 50}})
+	assert.Nil(t, err)
+	os.RemoveAll(f.app.StreamDir(missing_id))
+
+	f.app.Config.LazyLoad = true
+	f.app.Manager = manager.NewManager(f.app)
+	f.app.usage = NewDiskUsage()
+	defer func() {
+		if recover() != nil {
+			assert.True(t, false)
+		}
+	}()
+	f.app.LoadStreams()
+	assert.Equal(t, len(f.app.Manager.StreamIds()), 2)
+	stream, _ := f.getStream(active_id)
+	assert.Equal(t, stream.Frames, 50)
+	// quotas are enforced before the streams are hydrated
+	assert.True(t, f.app.usage.Target(target_id) > 0)
+
+	// the stream without data is quarantined on its first activation
+	for i := 0; i < 2; i++ {
+		f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	}
+	stream, _ = f.getStream(active_id)
+	assert.Equal(t, stream.Frames, 2)
+	assert.True(t, f.app.usage.Target(target_id) > 0)
+	stream, _ = f.getStream(missing_id)
+	assert.Equal(t, stream.MongoStatus, "quarantined")
+}
+
+func TestLoadStreamFields(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lazy")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{
+		Config:   Configuration{Name: filepath.Join(dir, "scv")},
+		Database: db,
+		usage:    NewDiskUsage(),
+	}
+	app.Manager = manager.NewManager(app)
+	stream := newStream("s1", "t1", "owner", 0, 0, 0)
+	stream.Meta = map[string]interface{}{"round": 1}
+	stream.Options = map[string]interface{}{"steps_per_frame": 10}
+	assert.Nil(t, db.InsertStream(stream))
+	os.MkdirAll(app.StreamDir("s1"), 0776)
+	ioutil.WriteFile(filepath.Join(app.StreamDir("s1"), "seed"), []byte("12345"), 0666)
+
+	summaries, err := db.StreamSummaries()
+	assert.Nil(t, err)
+	assert.Equal(t, len(summaries), 1)
+	assert.Nil(t, summaries[0].Meta)
+	assert.Nil(t, app.loadStream(summaries[0], Configuration{LazyLoad: true}, nil))
+	assert.Equal(t, app.usage.Target("t1"), int64(5))
+	app.Manager.ModifyStream("s1", func(s *Stream) error {
+		assert.True(t, streamData(s).partial)
+		assert.Nil(t, app.loadStreamFields(s))
+		assert.False(t, streamData(s).partial)
+		assert.Equal(t, s.Meta, map[string]interface{}{"round": 1})
+		assert.Equal(t, s.Options, map[string]interface{}{"steps_per_frame": 10})
+		return nil
+	})
+}
+
 func TestLoadDisabledStreams(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
@@ -423,14 +806,14 @@ func TestLoadDisabledStreams(t *testing.T) {
 	auth_token := f.addManager("yutong", 1)
 	stream_id, _ := f.postStream(auth_token, jsonData)
 	assert.Equal(t, f.streamStop(auth_token, stream_id), 200)
-	f.app.Manager = NewManager(f.app)
+	f.app.Manager = manager.NewManager(f.app)
 	f.app.LoadStreams()
 	stream, code := f.getStream(stream_id)
 	assert.Equal(t, code, 200)
 	assert.Equal(t, stream.MongoStatus, "disabled")
-	targetImpl := f.app.Manager.targets[target_id]
-	assert.Equal(t, len(targetImpl.disabledStreams), 1)
-	assert.Equal(t, targetImpl.inactiveStreams.Len(), 0)
+	_, inactive, disabled := f.app.Manager.TargetStreams(target_id)
+	assert.Equal(t, len(disabled), 1)
+	assert.Equal(t, len(inactive), 0)
 }
 
 func TestLoadStreamsErrorCount(t *testing.T) {
@@ -442,19 +825,21 @@ func TestLoadStreamsErrorCount(t *testing.T) {
 				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
 	auth_token := f.addManager("yutong", 1)
 	stream_id, code := f.postStream(auth_token, jsonData)
-	for i := 0; i < MAX_STREAM_FAILS; i++ {
+	// errors this frequent would quarantine the stream before it is disabled
+	f.app.Manager.SetQuarantineErrors(0)
+	for i := 0; i < manager.MAX_STREAM_FAILS; i++ {
 		token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
 		assert.Equal(t, code, 200)
 		assert.Equal(t, f.coreStop(token, "some_error"), 200)
 	}
 	// It takes some time to insert the stream's status into Mongo
 	time.Sleep(1 * time.Second)
-	f.app.Manager = NewManager(f.app)
+	f.app.Manager = manager.NewManager(f.app)
 	f.app.LoadStreams()
 	stream, code := f.getStream(stream_id)
 	assert.Equal(t, code, 200)
 	assert.Equal(t, stream.MongoStatus, "disabled")
-	assert.Equal(t, stream.ErrorCount, MAX_STREAM_FAILS)
+	assert.Equal(t, stream.ErrorCount, manager.MAX_STREAM_FAILS)
 }
 
 func TestLoadStreamsErrorCountOK(t *testing.T) {
@@ -473,7 +858,7 @@ func TestLoadStreamsErrorCountOK(t *testing.T) {
 	}
 	// It takes some time to insert the stream's status into Mongo
 	time.Sleep(1 * time.Second)
-	f.app.Manager = NewManager(f.app)
+	f.app.Manager = manager.NewManager(f.app)
 	f.app.LoadStreams()
 	stream, code := f.getStream(stream_id)
 	assert.Equal(t, code, 200)
@@ -500,7 +885,7 @@ func TestPostStream(t *testing.T) {
 	assert.True(t, mStream.CreationDate-start < 1)
 
 	_, code = f.getStream("12345")
-	assert.Equal(t, code, 400)
+	assert.Equal(t, code, 404)
 
 	// try adding tags
 	jsonData = `{"target_id":"12345",
@@ -550,8 +935,8 @@ func TestDeleteStream(t *testing.T) {
 		"amber": "b234"}}`
 	stream_id, _ := f.postStream(token, jsonData)
 	assert.Equal(t, f.deleteStream(token, stream_id), 200)
-	assert.Equal(t, len(f.app.Manager.streams), 0)
-	assert.Equal(t, len(f.app.Manager.targets), 0)
+	assert.Equal(t, len(f.app.Manager.StreamIds()), 0)
+	assert.Equal(t, len(f.app.Manager.TargetSizes()), 0)
 	time.Sleep(time.Second)
 	count, _ := f.app.StreamsCursor().Count()
 	assert.Equal(t, count, 0)
@@ -568,8 +953,8 @@ func TestDeleteActiveStream(t *testing.T) {
 	stream_id, _ := f.postStream(token, jsonData)
 	f.activateStream("12345", "a", "b", f.app.Config.Password)
 	assert.Equal(t, f.deleteStream(token, stream_id), 200)
-	assert.Equal(t, len(f.app.Manager.streams), 0)
-	assert.Equal(t, len(f.app.Manager.targets), 0)
+	assert.Equal(t, len(f.app.Manager.StreamIds()), 0)
+	assert.Equal(t, len(f.app.Manager.TargetSizes()), 0)
 	time.Sleep(time.Second)
 	count, _ := f.app.StreamsCursor().Count()
 	assert.Equal(t, count, 0)
@@ -584,7 +969,9 @@ func TestDeleteDisabledStream(t *testing.T) {
 		"files": {"openmm": "b123",
 		"amber": "b234"}}`
 	stream_id, _ := f.postStream(auth_token, jsonData)
-	for i := 0; i < MAX_STREAM_FAILS; i++ {
+	// errors this frequent would quarantine the stream before it is disabled
+	f.app.Manager.SetQuarantineErrors(0)
+	for i := 0; i < manager.MAX_STREAM_FAILS; i++ {
 		token, code := f.activateStream("12345", "some_engine", "some_donor", f.app.Config.Password)
 		assert.Equal(t, code, 200)
 		assert.Equal(t, f.coreStop(token, "some_error"), 200)
@@ -592,11 +979,164 @@ func TestDeleteDisabledStream(t *testing.T) {
 	_, code := f.activateStream("12345", "some_engine", "some_donor", f.app.Config.Password)
 	assert.Equal(t, code, 400)
 	assert.Equal(t, f.deleteStream(auth_token, stream_id), 200)
-	assert.Equal(t, len(f.app.Manager.streams), 0)
-	assert.Equal(t, len(f.app.Manager.targets), 0)
+	assert.Equal(t, len(f.app.Manager.StreamIds()), 0)
+	assert.Equal(t, len(f.app.Manager.TargetSizes()), 0)
+	time.Sleep(time.Second)
+	count, _ := f.app.StreamsCursor().Count()
+	assert.Equal(t, count, 0)
+}
+
+func TestDeleteStreamTombstone(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	token := f.addManager("yutong", 1)
+	f.addTarget("12345", "yutong", `{"options": {"steps_per_frame": 1}}`)
+	jsonData := `{"target_id":"12345",
+		"files": {"openmm": "b123",
+		"amber": "b234"}}`
+	stream_id, _ := f.postStream(token, jsonData)
+	// a deletion interrupted by a restart leaves a tombstone and the files
+	f.app.StreamsCursor().UpdateId(stream_id, bson.M{"$set": bson.M{"status": "deleted"}})
+	f.app.Manager = manager.NewManager(f.app)
+	f.app.LoadStreams()
+	assert.Equal(t, len(f.app.Manager.StreamIds()), 0)
+	_, err := os.Stat(f.app.StreamDir(stream_id))
+	assert.Nil(t, err)
+	assert.Nil(t, f.app.ReapStreams())
+	_, err = os.Stat(f.app.StreamDir(stream_id))
+	assert.True(t, os.IsNotExist(err))
+	count, _ := f.app.StreamsCursor().Count()
+	assert.Equal(t, count, 0)
+}
+
+func TestUndeleteStream(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	f.app.Config.TrashDays = 1
+	token := f.addManager("yutong", 1)
+	other := f.addManager("jesse", 1)
+	f.addTarget("12345", "yutong", `{"options": {"steps_per_frame": 1}}`)
+	jsonData := `{"target_id":"12345",
+		"files": {"openmm": "b123",
+		"amber": "b234"}}`
+	stream_id, _ := f.postStream(token, jsonData)
+	assert.Equal(t, f.undeleteStream(token, stream_id), 409)
+	assert.Equal(t, f.deleteStream(token, stream_id), 200)
 	time.Sleep(time.Second)
+	_, err := os.Stat(f.app.TrashDir(stream_id))
+	assert.Nil(t, err)
+	_, err = os.Stat(f.app.StreamDir(stream_id))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, len(f.app.Manager.StreamIds()), 0)
+
+	assert.Equal(t, f.undeleteStream(other, stream_id), 403)
+	assert.Equal(t, f.undeleteStream(token, stream_id), 200)
+	assert.Equal(t, len(f.app.Manager.StreamIds()), 1)
+	_, err = os.Stat(f.app.StreamDir(stream_id))
+	assert.Nil(t, err)
+	_, code := f.activateStream("12345", "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+
+	// streams are purged once the retention window has passed
+	assert.Equal(t, f.deleteStream(token, stream_id), 200)
+	f.app.StreamsCursor().UpdateId(stream_id, bson.M{"$set": bson.M{"deleted": 0}})
+	assert.Nil(t, f.app.ReapStreams())
+	_, err = os.Stat(f.app.TrashDir(stream_id))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(f.app.StreamDir(stream_id))
+	assert.True(t, os.IsNotExist(err))
 	count, _ := f.app.StreamsCursor().Count()
 	assert.Equal(t, count, 0)
+	assert.Equal(t, f.undeleteStream(token, stream_id), 404)
+}
+
+func TestConditionalGet(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	token := f.addManager("yutong", 1)
+	f.addTarget("12345", "yutong", `{"options": {"steps_per_frame": 1}}`)
+	jsonData := `{"target_id":"12345",
+		"files": {"openmm": "b123",
+		"amber": "b234"}}`
+	stream_id, _ := f.postStream(token, jsonData)
+
+	code, syncTag := f.conditionalGet(token, "/streams/sync/"+stream_id, "")
+	assert.Equal(t, code, 200)
+	assert.NotEqual(t, syncTag, "")
+	code, _ = f.conditionalGet(token, "/streams/sync/"+stream_id, syncTag)
+	assert.Equal(t, code, 304)
+	code, fileTag := f.conditionalGet(token, "/streams/download/"+stream_id+"/files/openmm", "")
+	assert.Equal(t, code, 200)
+	code, _ = f.conditionalGet(token, "/streams/download/"+stream_id+"/files/openmm", fileTag)
+	assert.Equal(t, code, 304)
+
+	// a new frame changes the partitions
+	core_token, _ := f.activateStream("12345", "a", "b", f.app.Config.Password)
+	assert.Equal(t, f.putFrame(core_token, `{"files": {"some_file": "ZnJhbWUx"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(core_token, `{"files": {"chkpt": "data"}}`), 200)
+	code, newTag := f.conditionalGet(token, "/streams/sync/"+stream_id, syncTag)
+	assert.Equal(t, code, 200)
+	assert.NotEqual(t, newTag, syncTag)
+	code, _ = f.conditionalGet(token, "/streams/download/"+stream_id+"/files/openmm", fileTag)
+	assert.Equal(t, code, 304)
+}
+
+func TestSyncManifest(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	streamId, _ := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	// frame1, frame2
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "ZnJhbWUx"}}`), 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "ZnJhbWUy"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"state.xml.gz.b64": "c3RhdGU="}}`), 200)
+	// frame3
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "ZnJhbWUz"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"state.xml.gz.b64": "c3RhdGU="}}`), 200)
+
+	req, _ := http.NewRequest("GET", "/streams/sync/"+streamId+"?manifest=true", nil)
+	req.Header.Add("Authorization", auth_token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	var result struct {
+		Manifest []PartitionManifest `json:"manifest"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, len(result.Manifest), 2)
+	assert.Equal(t, result.Manifest[0].Partition, 2)
+	assert.Equal(t, result.Manifest[1].Partition, 3)
+	first := result.Manifest[0].Files["0/frames.xtc"]
+	assert.Equal(t, first.Size, int64(12))
+	assert.Equal(t, *first.Offset, int64(0))
+	second := result.Manifest[1].Files["0/frames.xtc"]
+	assert.Equal(t, second.Size, int64(6))
+	assert.Equal(t, *second.Offset, int64(12))
+	sum := sha256.Sum256([]byte("frame3"))
+	assert.Equal(t, second.SHA256, hex.EncodeToString(sum[:]))
+	state := result.Manifest[1].Files["0/checkpoint_files/state.xml.gz.b64"]
+	assert.Nil(t, state.Offset)
+	assert.Equal(t, state.Size, int64(8))
+
+	// without the manifest, the reply is unchanged
+	req, _ = http.NewRequest("GET", "/streams/sync/"+streamId, nil)
+	req.Header.Add("Authorization", auth_token)
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.NotContains(t, w.Body.String(), "manifest")
+
+	assert.Equal(t, string(f.download(auth_token, streamId, "frames.xtc?partition=3")), "frame3")
+	assert.Equal(t, string(f.download(auth_token, streamId, "frames.xtc?partition=2")), "frame1frame2")
+	assert.Equal(t, len(f.download(auth_token, streamId, "frames.xtc?partition=-1")), 0)
+	assert.Equal(t, string(f.download(auth_token, streamId, "frames.xtc?partition=3&checkpoint=0")), "frame3")
+	assert.Equal(t, len(f.download(auth_token, streamId, "frames.xtc?partition=3&checkpoint=1")), 0)
+	assert.Equal(t, len(f.download(auth_token, streamId, "frames.xtc?checkpoint=0")), 0)
 }
 
 func TestDownload(t *testing.T) {
@@ -665,9 +1205,9 @@ func TestFaultyStreamActivation(t *testing.T) {
 	}
 	wg.Wait()
 	_, code := f.activateStream(target_id, "a", "b", "bad_pass")
-	assert.Equal(t, code, 400)
+	assert.Equal(t, code, 401)
 	_, code = f.activateStream("54321", "a", "b", f.app.Config.Password)
-	assert.Equal(t, code, 400)
+	assert.Equal(t, code, 404)
 }
 
 func TestStreamActivation(t *testing.T) {
@@ -722,7 +1262,7 @@ func TestBadCoreStart(t *testing.T) {
 	req.Header.Add("Authorization", "bad_token")
 	w := httptest.NewRecorder()
 	f.app.Router.ServeHTTP(w, req)
-	assert.Equal(t, w.Code, 400)
+	assert.Equal(t, w.Code, 401)
 }
 
 func TestHammerTime(t *testing.T) {
@@ -825,7 +1365,7 @@ func TestStreamCheckpoint(t *testing.T) {
 	assert.Equal(t, string(chkptBin), "data2")
 }
 
-func TestStreamStateActive(t *testing.T) {
+func TestStreamVerify(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
 	target_id := "12345"
@@ -833,20 +1373,259 @@ func TestStreamStateActive(t *testing.T) {
 				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
 				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
 	auth_token := f.addManager("yutong", 1)
-	stream_id, code := f.postStream(auth_token, jsonData)
-
-	stream, code := f.getStream(stream_id)
-	assert.Equal(t, code, 200)
-	assert.Equal(t, stream.MongoStatus, "enabled")
-	assert.Equal(t, stream.Active, false)
-	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	streamId, _ := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
 	assert.Equal(t, code, 200)
-	stream, code = f.getStream(stream_id)
-	assert.Equal(t, stream.MongoStatus, "enabled")
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "ZnJhbWUx"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"state.xml.gz.b64": "c3RhdGU="}, "frames": 1}`), 200)
+	verify := func() (result map[string]interface{}) {
+		req, _ := http.NewRequest("GET", "/streams/verify/"+streamId, nil)
+		req.Header.Add("Authorization", auth_token)
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return
+	}
+	result := verify()
+	assert.Equal(t, result["checked"], 1.0)
+	assert.Equal(t, len(result["corrupted"].([]interface{})), 0)
+	// flip the checkpoint on disk
+	chkpt := filepath.Join(f.app.StreamDir(streamId), "1", "0", "checkpoint_files", "state.xml.gz.b64")
+	ioutil.WriteFile(chkpt, []byte("c3RhdGF="), 0776)
+	result = verify()
+	corrupted := result["corrupted"].([]interface{})
+	assert.Equal(t, len(corrupted), 1)
+	assert.Equal(t, corrupted[0].(map[string]interface{})["partition"], 1.0)
+	req, _ := http.NewRequest("GET", "/streams/download/"+streamId+"/1/0/checkpoint_files/state.xml.gz.b64", nil)
+	req.Header.Add("Authorization", auth_token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 400)
+	_, code = f.coreStart(token)
+	assert.Equal(t, code, 400)
+}
+
+func TestScrubStream(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	streamId, _ := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "ZnJhbWUx"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"state.xml.gz.b64": "c3RhdGU="}, "frames": 1}`), 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+	corrupted, err := f.app.ScrubStream(streamId)
+	assert.Nil(t, err)
+	assert.Equal(t, len(corrupted), 0)
+
+	sub := f.app.events.Subscribe("", "", nil)
+	defer f.app.events.Unsubscribe(sub)
+	os.Remove(filepath.Join(f.app.StreamDir(streamId), "1", "0", "frames.xtc"))
+	corrupted, err = f.app.ScrubStream(streamId)
+	assert.Nil(t, err)
+	assert.Equal(t, corrupted, []Corruption{{Partition: 1, Checkpoint: 0, Files: []string{"frames.xtc"}}})
+	assert.Equal(t, f.loadMongoStream(streamId)["status"], "disabled")
+	_, code = f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 400)
+	types := make([]string, 0)
+	for len(sub.C) > 0 {
+		types = append(types, (<-sub.C).Type)
+	}
+	assert.Equal(t, types, []string{EVENT_DISABLED, EVENT_CORRUPTED})
+	assert.Equal(t, f.app.Metrics()["scrubber"].(map[string]interface{})["corrupted"], int64(1))
+}
+
+func TestFrameValidation(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.addTarget(target_id, "yutong", "")
+	f.app.Mongo.DB("data").C("targets").UpdateId(target_id, bson.M{"$set": bson.M{"options": bson.M{
+		"validators": []bson.M{{"type": "xtc"}},
+	}}})
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	streamId, _ := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	// "AAAHyw==" is the XTC magic number
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc.b64": "AAAHyw==", "log.txt": "1"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"state.xml.gz.b64": "c3RhdGU="}, "frames": 1}`), 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc.b64": "Z2FyYmFnZQ==", "log.txt": "2"}}`), 400)
+	// the invalid frame quarantines the stream
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"state.xml.gz.b64": "c3RhdGU="}, "frames": 1}`), 401)
+	stream, code := f.getStream(streamId)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.MongoStatus, "quarantined")
+	log := f.download(auth_token, streamId, "1/0/log.txt")
+	assert.Equal(t, string(log), "1")
+}
+
+func TestStreamQuarantine(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	bad_token := f.addManager("jesse", 1)
+	streamId, _ := f.postStream(auth_token, jsonData)
+	assert.Equal(t, f.streamQuarantine(bad_token, streamId, ""), 403)
+	assert.Equal(t, f.streamQuarantine(auth_token, streamId, `{"reason": "bad forcefield"}`), 200)
+	_, code := f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 400)
+	assert.Equal(t, f.streamStart(auth_token, streamId), 409)
+
+	// the quarantine survives a restart
+	f.app.Manager = manager.NewManager(f.app)
+	f.app.LoadStreams()
+	stream, code := f.getStream(streamId)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.MongoStatus, "quarantined")
+	assert.Equal(t, stream.QuarantineReason, "bad forcefield")
+	_, code = f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 400)
+
+	assert.Equal(t, f.streamRelease(bad_token, streamId), 403)
+	assert.Equal(t, f.streamRelease(auth_token, streamId), 200)
+	assert.Equal(t, f.streamRelease(auth_token, streamId), 409)
+	stream, code = f.getStream(streamId)
+	assert.Equal(t, stream.MongoStatus, "enabled")
+	_, code = f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+}
+
+func TestStreamHistory(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	streamId, _ := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "ZnJhbWUx"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"state.xml.gz.b64": "c3RhdGU="}, "frames": 1}`), 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+	token, code = f.activateStream(target_id, "openmm", "bad_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.coreStop(token, "ZXJyb3I="), 200)
+	// sessions without frames or errors are not recorded
+	token, code = f.activateStream(target_id, "openmm", "idle", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+	f.app.drainStats()
+
+	req, _ := http.NewRequest("GET", "/streams/history/"+streamId, nil)
+	req.Header.Add("Authorization", auth_token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	result := make(map[string][]Session)
+	json.Unmarshal(w.Body.Bytes(), &result)
+	sessions := result["sessions"]
+	assert.Equal(t, len(sessions), 2)
+	assert.Equal(t, sessions[0].User, "jesse")
+	assert.Equal(t, sessions[0].Engine, "openmm")
+	assert.Equal(t, sessions[0].StartFrames, 0)
+	assert.Equal(t, sessions[0].EndFrames, 1)
+	assert.Equal(t, sessions[0].Frames, 1.0)
+	assert.False(t, sessions[0].Error)
+	assert.Equal(t, sessions[1].User, "bad_donor")
+	assert.Equal(t, sessions[1].StartFrames, 1)
+	assert.True(t, sessions[1].Error)
+
+	other_token := f.addManager("diwakar", 1)
+	req.Header.Set("Authorization", other_token)
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 403)
+}
+
+func TestStreamErrors(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	streamId, _ := f.postStream(auth_token, jsonData)
+	stop := func(user, body string) {
+		token, code := f.activateStream(target_id, "openmm", user, f.app.Config.Password)
+		assert.Equal(t, code, 200)
+		req, _ := http.NewRequest("PUT", "/core/stop", bytes.NewBufferString(body))
+		req.Header.Add("Authorization", token)
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+	}
+	// "Particle coordinate is nan"
+	stop("jesse", `{"error": "UGFydGljbGUgY29vcmRpbmF0ZSBpcyBuYW4="}`)
+	stop("bad_donor", `{"error": "ZXJyb3I="}`)
+	stop("quitter", `{"kind": "aborted"}`)
+	f.app.drainStats()
+	f.app.Manager.ReadStream(streamId, func(stream *Stream) error {
+		assert.Equal(t, stream.ErrorCount, 3)
+		return nil
+	})
+
+	req, _ := http.NewRequest("GET", "/streams/errors/"+streamId, nil)
+	req.Header.Add("Authorization", auth_token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	result := make(map[string][]StreamError)
+	json.Unmarshal(w.Body.Bytes(), &result)
+	streamErrors := result["errors"]
+	assert.Equal(t, len(streamErrors), 3)
+	kinds := make(map[string]string)
+	for _, e := range streamErrors {
+		kinds[e.User] = e.Kind
+	}
+	assert.Equal(t, kinds, map[string]string{"jesse": "simulation", "bad_donor": "core", "quitter": "aborted"})
+
+	other_token := f.addManager("diwakar", 1)
+	req.Header.Set("Authorization", other_token)
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 403)
+}
+
+func TestStreamStateActive(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, jsonData)
+
+	stream, code := f.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.MongoStatus, "enabled")
+	assert.Equal(t, stream.Active, false)
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	stream, code = f.getStream(stream_id)
+	assert.Equal(t, stream.MongoStatus, "enabled")
 	assert.Equal(t, stream.Active, true)
 	// stopping a core without an error message
 	assert.Equal(t, f.coreStop(token, ""), 200)
-	for i := 0; i < MAX_STREAM_FAILS; i++ {
+	// errors this frequent would quarantine the stream before it is disabled
+	f.app.Manager.SetQuarantineErrors(0)
+	for i := 0; i < manager.MAX_STREAM_FAILS; i++ {
 		token, code = f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
 		assert.Equal(t, code, 200)
 		assert.Equal(t, f.coreStop(token, "some_error"), 200)
@@ -855,14 +1634,14 @@ func TestStreamStateActive(t *testing.T) {
 	stream, code = f.getStream(stream_id)
 	assert.Equal(t, code, 200)
 	assert.Equal(t, stream.MongoStatus, "disabled")
-	assert.Equal(t, stream.ErrorCount, MAX_STREAM_FAILS)
+	assert.Equal(t, stream.ErrorCount, manager.MAX_STREAM_FAILS)
 
 	_, code = f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
 	assert.Equal(t, code, 400)
 	time.Sleep(time.Second * 2)
 	result := f.loadMongoStream(stream_id)
 	assert.Equal(t, result["frames"].(int), 0)
-	assert.Equal(t, result["error_count"].(int), MAX_STREAM_FAILS)
+	assert.Equal(t, result["error_count"].(int), manager.MAX_STREAM_FAILS)
 	assert.Equal(t, result["status"].(string), "disabled")
 }
 
@@ -942,6 +1721,152 @@ func TestStreamSync(t *testing.T) {
 
 }
 
+func TestCompactStream(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	stream_id, _ := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "`+strconv.Itoa(i)+`"}}`), 200)
+		assert.Equal(t, f.putCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 1}`), 200)
+	}
+
+	// compaction is disabled by default
+	assert.Nil(t, f.app.CompactStream(stream_id))
+	result, code := f.syncStream(auth_token, stream_id)
+	assert.Equal(t, result.Partitions, []int{1, 2, 3})
+
+	f.app.Config.CompactThreshold = 2
+	assert.Nil(t, f.app.CompactStream(stream_id))
+	result, code = f.syncStream(auth_token, stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, result.Partitions, []int{3})
+	assert.Equal(t, len(result.Archives), 1)
+	assert.Equal(t, result.Archives[0].Name, "archives/2.tar")
+	assert.Equal(t, result.Archives[0].Partitions, []int{1, 2})
+	assert.Equal(t, result.FrameFiles, []string{"frames.xtc"})
+
+	data := f.download(auth_token, stream_id, result.Archives[0].Name)
+	reader := tar.NewReader(bytes.NewReader(data))
+	contents := make(map[string]string)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(reader)
+		contents[header.Name] = string(body)
+	}
+	assert.Equal(t, contents["1/0/frames.xtc"], "0")
+	assert.Equal(t, contents["2/0/frames.xtc"], "1")
+	assert.Equal(t, contents["2/0/checkpoint_files/chkpt"], "data")
+
+	// the stream still restarts from the most recent partition
+	f.app.Manager = manager.NewManager(f.app)
+	f.app.LoadStreams()
+	stream, code := f.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.Frames, 3)
+}
+
+func TestExportImportStream(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	stream_id, _ := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "12345"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 1}`), 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "67890"}}`), 200)
+
+	req, _ := http.NewRequest("GET", "/streams/export/"+stream_id, nil)
+	req.Header.Add("Authorization", auth_token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	exported := w.Body.Bytes()
+
+	// buffered frames are not exported
+	reader := tar.NewReader(bytes.NewReader(exported))
+	header, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, header.Name, MANIFEST_NAME)
+	for {
+		header, err = reader.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NotContains(t, header.Name, "buffer_files")
+	}
+
+	assert.Equal(t, f.deleteStream(auth_token, stream_id), 200)
+	os.RemoveAll(f.app.StreamDir(stream_id))
+
+	req, _ = http.NewRequest("POST", "/streams/import", bytes.NewReader(exported))
+	req.Header.Add("Authorization", auth_token)
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	reply := make(map[string]string)
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	assert.Equal(t, reply["stream_id"], stream_id)
+	f.app.Manager.ReadStream(stream_id, func(stream *Stream) error {
+		assert.Equal(t, stream.Owner, "yutong")
+		assert.Equal(t, stream.Namespace, "yutong")
+		return nil
+	})
+
+	stream, code := f.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.Frames, 1)
+	assert.Equal(t, stream.TargetId, target_id)
+	result, code := f.syncStream(auth_token, stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, result.Partitions, []int{1})
+	assert.Equal(t, string(f.downloadFrame(auth_token, stream_id, "frames.xtc", 1)), "12345")
+
+	// importing the same stream twice is refused
+	req, _ = http.NewRequest("POST", "/streams/import", bytes.NewReader(exported))
+	req.Header.Add("Authorization", auth_token)
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 409)
+
+	// concurrent imports of the same stream, only one of them succeeds
+	assert.Equal(t, f.deleteStream(auth_token, stream_id), 200)
+	os.RemoveAll(f.app.StreamDir(stream_id))
+	codes := make(chan int, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			req, _ := http.NewRequest("POST", "/streams/import", bytes.NewReader(exported))
+			req.Header.Add("Authorization", auth_token)
+			w := httptest.NewRecorder()
+			f.app.Router.ServeHTTP(w, req)
+			codes <- w.Code
+		}()
+	}
+	imported := 0
+	for i := 0; i < 4; i++ {
+		if <-codes == 200 {
+			imported += 1
+		}
+	}
+	assert.Equal(t, imported, 1)
+	assert.Equal(t, string(f.downloadFrame(auth_token, stream_id, "frames.xtc", 1)), "12345")
+}
+
 func TestStreamCycle(t *testing.T) {
 	// Test POSTing frames, checkpoints, starting and stopping.
 	f := NewFixture()
@@ -958,21 +1883,21 @@ func TestStreamCycle(t *testing.T) {
 
 	// test posting plaintext
 	assert.Equal(t, f.putFrame(token, `{"files": {"some_file": "12345"}}`), 200)
-	assert.Equal(t, f.app.Manager.streams[stream_id].activeStream.bufferFrames, 1)
+	assert.Equal(t, f.stream(stream_id).ActiveStream.BufferFrames, 1)
 	assert.Equal(t, f.putFrame(token, `{"files": {"some_file": "67890"}}`), 200)
-	assert.Equal(t, f.app.Manager.streams[stream_id].activeStream.bufferFrames, 2)
+	assert.Equal(t, f.stream(stream_id).ActiveStream.BufferFrames, 2)
 	assert.Equal(t, f.download(auth_token, stream_id, "buffer_files/some_file"), []byte("1234567890"))
 
 	assert.Equal(t, f.putCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.234}`), 200)
-	assert.Equal(t, f.app.Manager.streams[stream_id].activeStream.donorFrames, 0.234)
-	assert.Equal(t, f.app.Manager.streams[stream_id].activeStream.bufferFrames, 0)
+	assert.Equal(t, f.stream(stream_id).ActiveStream.DonorFrames, 0.234)
+	assert.Equal(t, f.stream(stream_id).ActiveStream.BufferFrames, 0)
 
 	assert.Equal(t, f.download(auth_token, stream_id, "2/0/some_file"), []byte("1234567890"))
 	assert.Equal(t, f.download(auth_token, stream_id, "2/0/checkpoint_files/chkpt"), []byte("data"))
 
 	assert.Equal(t, f.putCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.123}`), 200)
-	assert.Equal(t, f.app.Manager.streams[stream_id].activeStream.donorFrames, 0.234+0.123)
-	assert.Equal(t, f.app.Manager.streams[stream_id].activeStream.bufferFrames, 0)
+	assert.Equal(t, f.stream(stream_id).ActiveStream.DonorFrames, 0.234+0.123)
+	assert.Equal(t, f.stream(stream_id).ActiveStream.BufferFrames, 0)
 	assert.Equal(t, f.download(auth_token, stream_id, "2/1/checkpoint_files/chkpt"), []byte("data"))
 
 	// test posting base64 encoded
@@ -1003,14 +1928,15 @@ func TestStreamCycle(t *testing.T) {
 	result = make(map[string]interface{})
 	cursor.Find(bson.M{"_id": stream_id}).One(&result)
 	assert.Equal(t, result["frames"].(int), 2)
+	assert.Equal(t, result["donor_frames"].(float64), 0.234+0.123)
 	assert.Equal(t, result["error_count"].(int), 0)
 	// assert.Equal(t, result["frames"].(int), 5)
 	// assert.Equal(t, result["engine"].(string), "some_engine")
 	// assert.Equal(t, result["user"].(string), "some_donor")
 
-	assert.Equal(t, f.putFrame(token, `{"files": {"some_file": "12345"}}`), 400)
-	assert.Equal(t, f.putCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.234}`), 400)
-	assert.Nil(t, f.app.Manager.streams[stream_id].activeStream, nil)
+	assert.Equal(t, f.putFrame(token, `{"files": {"some_file": "12345"}}`), 401)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.234}`), 401)
+	assert.Nil(t, f.stream(stream_id).ActiveStream, nil)
 
 	assert.Equal(t, f.download(auth_token, stream_id, "buffer_files/some_file"), []byte("123456789012345"))
 	// test that activating a stream removes buffer_files
@@ -1018,95 +1944,598 @@ func TestStreamCycle(t *testing.T) {
 	assert.Equal(t, f.download(auth_token, stream_id, "buffer_files/some_file"), []byte(""))
 }
 
-func TestStreamStartStop(t *testing.T) {
+func TestKeepBuffers(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
+	f.app.Config.KeepBuffers = true
 	target_id := "12345"
-	jsonData := `{"target_id":"` + target_id + `",
-				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
-				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
 	auth_token := f.addManager("yutong", 1)
-	stream_id, code := f.postStream(auth_token, jsonData)
-
-	result, code := f.getStream(stream_id)
+	stream_id, code := f.postStream(auth_token, `{"target_id": "`+target_id+`", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`)
 	assert.Equal(t, code, 200)
-	assert.Equal(t, result.MongoStatus, "enabled")
-
-	_, code = f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	token, _ := f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "12345"}}`), 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "67890"}}`), 200)
+	// as if the SCV was restarted before the core stopped
+	f.app.flushBuffers()
+	f.app.Manager.DeactivateStream(token, 0)
+
+	_, code = f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
 	assert.Equal(t, code, 200)
-
-	activestreams := f.activeStreams()
-	_, ok := activestreams[stream_id]
-	assert.True(t, ok)
-
-	assert.Equal(t, f.streamStop(auth_token, stream_id), 200)
-	result, code = f.getStream(stream_id)
+	assert.Equal(t, f.download(auth_token, stream_id, "buffer_files/frames.xtc"), []byte(""))
+	assert.Equal(t, f.download(auth_token, stream_id, "recovered_buffer/frames.xtc"), []byte("1234567890"))
+	result, code := f.syncStream(auth_token, stream_id)
 	assert.Equal(t, code, 200)
-	assert.Equal(t, result.MongoStatus, "disabled")
+	assert.Equal(t, result.RecoveredFiles, []string{"recovered_buffer/frames.xtc"})
 
-	assert.Equal(t, f.streamStart(auth_token, stream_id), 200)
-	result, code = f.getStream(stream_id)
-	assert.Equal(t, code, 200)
-	assert.Equal(t, result.MongoStatus, "enabled")
+	req, _ := http.NewRequest("DELETE", "/streams/recovered/"+stream_id, nil)
+	req.Header.Add("Authorization", auth_token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	result, _ = f.syncStream(auth_token, stream_id)
+	assert.Equal(t, len(result.RecoveredFiles), 0)
 }
 
-func TestCoreStart(t *testing.T) {
+func TestFrameMetadata(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
 	target_id := "12345"
-	f.addTarget("12345", "yutong", `{"options": {"steps_per_frame": 1}}`)
-	jsonData := `{"target_id":"` + target_id + `",
-				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
-				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
 	auth_token := f.addManager("yutong", 1)
-	f.postStream(auth_token, jsonData)
-	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	stream_id, code := f.postStream(auth_token, `{"target_id": "`+target_id+`", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`)
 	assert.Equal(t, code, 200)
-
-	{
-		req, _ := http.NewRequest("GET", "/core/start", nil)
-		req.Header.Add("Authorization", token)
-		w := httptest.NewRecorder()
-		f.app.Router.ServeHTTP(w, req)
-		assert.Equal(t, w.Code, 200)
-	}
-
-	{
-		dataBuffer := bytes.NewBuffer([]byte("12345678"))
-		req, _ := http.NewRequest("POST", "/core/frame", dataBuffer)
-		req.Header.Add("Authorization", token)
-		req.Header.Add("Content-MD5", "1234")
-		w := httptest.NewRecorder()
-		f.app.Router.ServeHTTP(w, req)
-		assert.Equal(t, w.Code, 400)
-	}
-
-	assert.Equal(t, f.putFrame(token, "12345678"), 400)
-	assert.Equal(t, f.putFrame(token, `{"files": {"some_file": "some_data"}}`), 200)
-	assert.Equal(t, f.putFrame(token, `{"files": {"some_file": "some_data"}}`), 400)
+	token, _ := f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "a"}, "meta": {"wall_clock": 95.5, "gpu": "GTX 980"}}`), 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "b"}}`), 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "c"}, "meta": {"simulation_time": 30, "core_version": "0.1.4"}}`), 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.jsonl": "d"}}`), 400)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"chkpt": "data"}}`), 200)
+
+	req, _ := http.NewRequest("GET", "/streams/frames/"+stream_id, nil)
+	req.Header.Add("Authorization", auth_token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	var reply FramesReply
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &reply))
+	assert.Equal(t, len(reply.Frames), 2)
+	assert.Equal(t, reply.Frames[0].Frame, 1)
+	assert.Equal(t, reply.Frames[0].WallClock, 95.5)
+	assert.Equal(t, reply.Frames[0].GPU, "GTX 980")
+	assert.Equal(t, reply.Frames[1].Frame, 3)
+	assert.Equal(t, reply.Frames[1].SimulationTime, 30.0)
+	assert.Equal(t, reply.Frames[1].CoreVersion, "0.1.4")
+	// the sidecar is not a frame file
+	result, _ := f.syncStream(auth_token, stream_id)
+	assert.Equal(t, result.FrameFiles, []string{"frames.xtc"})
 }
 
-func TestCoreExpiration(t *testing.T) {
+func TestStreamLineage(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
-	f.app.Manager.expirationTime = 5
 	target_id := "12345"
-	f.addTarget("12345", "yutong", `{"options": {"steps_per_frame": 1}}`)
-	jsonData := `{"target_id":"` + target_id + `",
-				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
-				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	files := `"target_id": "` + target_id + `", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}`
 	auth_token := f.addManager("yutong", 1)
-	f.postStream(auth_token, jsonData)
-	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	root, code := f.postStream(auth_token, `{`+files+`}`)
 	assert.Equal(t, code, 200)
-	time.Sleep(time.Duration(6) * time.Second)
-	assert.Equal(t, f.coreStop(token, ""), 400)
-}
+	token, code := f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "ZnJhbWUx"}}`), 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "ZnJhbWUx"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"state.xml.gz.b64": "c3RhdGU="}}`), 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
 
-func TestCoreHeartbeat(t *testing.T) {
+	_, code = f.postStream(auth_token, `{`+files+`, "parent_stream_id": "`+root+`", "fork_frame": 3}`)
+	assert.Equal(t, code, 400)
+	_, code = f.postStream(auth_token, `{`+files+`, "parent_stream_id": "bad_stream", "fork_frame": 1}`)
+	assert.Equal(t, code, 404)
+	_, code = f.postStream(auth_token, `{`+files+`, "fork_frame": 1}`)
+	assert.Equal(t, code, 400)
+	child1, code := f.postStream(auth_token, `{`+files+`, "parent_stream_id": "`+root+`", "fork_frame": 2}`)
+	assert.Equal(t, code, 200)
+	child2, code := f.postStream(auth_token, `{`+files+`, "parent_stream_id": "`+root+`", "fork_frame": 1}`)
+	assert.Equal(t, code, 200)
+	grandchild, code := f.postStream(auth_token, `{`+files+`, "parent_stream_id": "`+child1+`"}`)
+	assert.Equal(t, code, 200)
+	stream, _ := f.getStream(child1)
+	assert.Equal(t, stream.ParentStreamId, root)
+	assert.Equal(t, stream.ForkFrame, 2)
+
+	req, _ := http.NewRequest("GET", "/streams/lineage/"+grandchild, nil)
+	req.Header.Add("Authorization", auth_token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	result := struct {
+		Ancestors []string    `json:"ancestors"`
+		Tree      LineageNode `json:"tree"`
+	}{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Equal(t, result.Ancestors, []string{child1, root})
+	assert.Equal(t, result.Tree.StreamId, root)
+	assert.Equal(t, result.Tree.Frames, 2)
+	assert.Equal(t, len(result.Tree.Children), 2)
+	assert.Equal(t, result.Tree.Children[0].StreamId, child2)
+	assert.Equal(t, result.Tree.Children[1].StreamId, child1)
+	assert.Equal(t, result.Tree.Children[1].ForkFrame, 2)
+	assert.Equal(t, result.Tree.Children[1].Children[0].StreamId, grandchild)
+
+	// lineage survives the deletion of an ancestor
+	assert.Equal(t, f.deleteStream(auth_token, root), 200)
+	tree, ancestors, err := f.app.Lineage(grandchild)
+	assert.Nil(t, err)
+	assert.Equal(t, ancestors, []string{child1, root})
+	assert.Equal(t, tree.StreamId, child1)
+}
+
+func TestStreamTagsMeta(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="},
+				"tags": {"pdb": "original", "notes": "some notes"}}`
+	auth_token := f.addManager("yutong", 1)
+	bad_token := f.addManager("jesse", 1)
+	streamId, _ := f.postStream(auth_token, jsonData)
+	request := func(method, url, token, body string) int {
+		req, _ := http.NewRequest(method, url+streamId, strings.NewReader(body))
+		req.Header.Add("Authorization", token)
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, request("PUT", "/streams/tags/", bad_token, `{"pdb": "replaced"}`), 403)
+	assert.Equal(t, request("PUT", "/streams/tags/", auth_token, `{"../pdb": "replaced"}`), 400)
+	assert.Equal(t, request("PUT", "/streams/tags/", auth_token, `{"pdb": "replaced", "notes": null, "new": "added"}`), 200)
+	assert.Equal(t, f.download(auth_token, streamId, "tags/pdb"), []byte("replaced"))
+	assert.Equal(t, f.download(auth_token, streamId, "tags/new"), []byte("added"))
+	_, err := os.Stat(filepath.Join(f.app.StreamDir(streamId), "tags", "notes"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, request("PATCH", "/streams/meta/", bad_token, `{"round": 1}`), 403)
+	assert.Equal(t, request("PATCH", "/streams/meta/", auth_token, `{"$where": 1}`), 400)
+	assert.Equal(t, request("PATCH", "/streams/meta/", auth_token, `{"round": 1, "forcefield": "amber99sb"}`), 200)
+	assert.Equal(t, request("PATCH", "/streams/meta/", auth_token, `{"round": null, "temperature": 300}`), 200)
+	expected := map[string]interface{}{"forcefield": "amber99sb", "temperature": 300.0}
+	stream, _ := f.getStream(streamId)
+	assert.Equal(t, stream.Meta, expected)
+
+	// metadata is persisted in Mongo
+	f.app.Manager = manager.NewManager(f.app)
+	f.app.LoadStreams()
+	stream, _ = f.getStream(streamId)
+	assert.Equal(t, stream.Meta, expected)
+}
+
+func TestStreamOptions(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.app.Mongo.DB("data").C("targets").Insert(bson.M{"_id": target_id, "owner": "yutong", "options": bson.M{"steps_per_frame": 50000, "title": "DHFR"}})
+	auth_token := f.addManager("yutong", 1)
+	bad_token := f.addManager("jesse", 1)
+	_, code := f.postStream(auth_token, `{"target_id":"`+target_id+`", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}, "options": {"$where": 1}}`)
+	assert.Equal(t, code, 400)
+	streamId, code := f.postStream(auth_token, `{"target_id":"`+target_id+`", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}, "options": {"title": "near TS"}}`)
+	assert.Equal(t, code, 200)
+	request := func(token, body string) int {
+		req, _ := http.NewRequest("PATCH", "/streams/options/"+streamId, strings.NewReader(body))
+		req.Header.Add("Authorization", token)
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, request(bad_token, `{"steps_per_frame": 5000}`), 403)
+	assert.Equal(t, request(auth_token, `{"a.b": 1}`), 400)
+	assert.Equal(t, request(auth_token, `{"steps_per_frame": 5000, "title": null}`), 200)
+	stream, _ := f.getStream(streamId)
+	assert.Equal(t, stream.Options, map[string]interface{}{"steps_per_frame": 5000.0})
+
+	// the overrides are merged over the target's options for the core
+	token, _ := f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	req, _ := http.NewRequest("GET", "/core/start", nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	reply := CoreStartReply{}
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	assert.Equal(t, reply.Options, map[string]interface{}{"steps_per_frame": 5000.0, "title": "DHFR"})
+	options, _ := f.app.targetOptions(target_id)
+	assert.Equal(t, options["steps_per_frame"], 50000)
+
+	// and persisted in Mongo
+	f.app.Manager = manager.NewManager(f.app)
+	f.app.LoadStreams()
+	stream, _ = f.getStream(streamId)
+	assert.Equal(t, stream.Options, map[string]interface{}{"steps_per_frame": 5000.0})
+}
+
+func TestPostTarget(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	auth_token := f.addManager("yutong", 1)
+	bad_token := f.addManager("jesse", 1)
+	request := func(method, url, token, body string) (int, []byte) {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Add("Authorization", token)
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		return w.Code, w.Body.Bytes()
+	}
+	code, _ := request("POST", "/targets", auth_token, `{"options": {"title": "DHFR"}}`)
+	assert.Equal(t, code, 400)
+	code, _ = request("POST", "/targets", auth_token, `{"engines": ["openmm"], "stage": "beta"}`)
+	assert.Equal(t, code, 400)
+	code, body := request("POST", "/targets", auth_token,
+		`{"engines": ["openmm"], "options": {"title": "DHFR", "steps_per_frame": 50000}}`)
+	assert.Equal(t, code, 200)
+	result := make(map[string]string)
+	json.Unmarshal(body, &result)
+	target_id := result["target_id"]
+	options, err := f.app.targetOptions(target_id)
+	assert.Nil(t, err)
+	assert.Equal(t, options["steps_per_frame"], 50000)
+
+	url := "/targets/" + target_id + "/options"
+	code, _ = request("PUT", url, bad_token, `{"priority": 1}`)
+	assert.Equal(t, code, 403)
+	code, _ = request("PUT", url, auth_token, `{"options": {"steps_per_frame": -1}}`)
+	assert.Equal(t, code, 400)
+	code, _ = request("PUT", url, auth_token, `{"priority": 1, "options": {"steps_per_frame": 100, "title": null}}`)
+	assert.Equal(t, code, 200)
+	doc := make(map[string]interface{})
+	f.app.Mongo.DB("data").C("targets").FindId(target_id).One(&doc)
+	assert.Equal(t, doc["owner"], "yutong")
+	assert.Equal(t, doc["stage"], "private")
+	assert.Equal(t, doc["priority"], 1)
+	// the cached options are invalidated
+	options, err = f.app.targetOptions(target_id)
+	assert.Nil(t, err)
+	assert.Equal(t, options, map[string]interface{}{"steps_per_frame": 100})
+
+	// cores receive the options of the target
+	jsonData := `{"target_id":"` + target_id + `", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	code, body = request("GET", "/core/start", token, "")
+	assert.Equal(t, code, 200)
+	start := struct {
+		Options map[string]interface{} `json:"options"`
+	}{}
+	json.Unmarshal(body, &start)
+	assert.Equal(t, start.Options["steps_per_frame"], 100.0)
+}
+
+func TestTargetPause(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	auth_token := f.addManager("yutong", 1)
+	bad_token := f.addManager("jesse", 1)
+	target_id := "12345"
+	f.app.Mongo.DB("data").C("targets").Insert(bson.M{"_id": target_id, "owner": "yutong", "engines": []string{"openmm"}, "stage": "private"})
+	jsonData := `{"target_id":"` + target_id + `", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	stream1, _ := f.postStream(auth_token, jsonData)
+	f.postStream(auth_token, jsonData)
+	request := func(url, token string) (int, TargetPauseReply) {
+		req, _ := http.NewRequest("PUT", url, nil)
+		req.Header.Add("Authorization", token)
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		reply := TargetPauseReply{}
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return w.Code, reply
+	}
+	token, code := f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	code, _ = request("/targets/"+target_id+"/pause", bad_token)
+	assert.Equal(t, code, 403)
+	code, _ = request("/targets/unknown/pause", auth_token)
+	assert.Equal(t, code, 404)
+	code, reply := request("/targets/"+target_id+"/pause", auth_token)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, reply, TargetPauseReply{true, 1})
+	options, err := f.app.targetOptions(target_id)
+	assert.Nil(t, err)
+	assert.Equal(t, options["paused"], true)
+
+	// the active stream finishes its session, no other stream is activated
+	_, code = f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 503)
+	_, code = f.coreStart(token)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+	_, code = f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 503)
+	req, _ := http.NewRequest("GET", "/streams/info/"+stream1, nil)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	info := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &info)
+	assert.Equal(t, info["target_paused"], true)
+
+	code, reply = request("/targets/"+target_id+"/resume", auth_token)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, reply, TargetPauseReply{false, 0})
+	options, _ = f.app.targetOptions(target_id)
+	assert.Equal(t, options["paused"], nil)
+	_, code = f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+}
+
+func TestAssign(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	auth_token := f.addManager("yutong", 1)
+	donor_token := f.addUser("jesse")
+	f.app.Mongo.DB("engines").C("keys").Insert(bson.M{"_id": "engine_key", "engine": "openmm"})
+	f.app.Mongo.DB("data").C("targets").Insert(bson.M{"_id": "public", "owner": "yutong", "engines": []string{"openmm"}, "stage": "public"})
+	f.app.Mongo.DB("data").C("targets").Insert(bson.M{"_id": "private", "owner": "yutong", "engines": []string{"openmm"}, "stage": "private"})
+	f.app.Mongo.DB("data").C("targets").Insert(bson.M{"_id": "other", "owner": "yutong", "engines": []string{"amber"}, "stage": "public"})
+	for _, target_id := range []string{"public", "private", "other"} {
+		f.postStream(auth_token, `{"target_id": "`+target_id+`", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`)
+	}
+	assign := func(key, body string) (int, map[string]string) {
+		req, _ := http.NewRequest("POST", "/assign", strings.NewReader(body))
+		req.Header.Add("Authorization", key)
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		result := make(map[string]string)
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w.Code, result
+	}
+	code, _ := assign("bad_key", `{}`)
+	assert.Equal(t, code, 401)
+	code, _ = assign("engine_key", `{"donor_token": "bad_token"}`)
+	assert.Equal(t, code, 401)
+	code, _ = assign("engine_key", `{"target_id": "other"}`)
+	assert.Equal(t, code, 403)
+	code, result := assign("engine_key", `{"donor_token": "`+donor_token+`"}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, result["url"], "http://alexis.stanford.edu/core/start")
+	stream := f.activeStream(result["token"])
+	assert.Equal(t, stream.TargetId, "public")
+	assert.Equal(t, stream.ActiveStream.User, "jesse")
+	assert.Equal(t, stream.ActiveStream.Engine, "openmm")
+	// private targets are only assigned on request
+	code, _ = assign("engine_key", `{}`)
+	assert.Equal(t, code, 400)
+	code, result = assign("engine_key", `{"target_id": "private"}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.activeStream(result["token"]).TargetId, "private")
+}
+
+func TestWeightedActivation(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	heavy_token := f.addManager("heavy", 3)
+	light_token := f.addManager("light", 1)
+	f.app.Mongo.DB("data").C("targets").Insert(bson.M{"_id": "t_heavy", "owner": "heavy", "engines": []string{"openmm"}, "stage": "public"})
+	f.app.Mongo.DB("data").C("targets").Insert(bson.M{"_id": "t_light", "owner": "light", "engines": []string{"openmm"}, "stage": "public"})
+	for i := 0; i < 100; i++ {
+		f.postStream(heavy_token, `{"target_id": "t_heavy", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`)
+		f.postStream(light_token, `{"target_id": "t_light", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`)
+	}
+	counts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		token, code := f.activateStream("", "openmm", "jesse", f.app.Config.Password)
+		assert.Equal(t, code, 200)
+		counts[f.activeStream(token).TargetId] += 1
+	}
+	assert.InDelta(t, counts["t_heavy"], 75, 20)
+	assert.InDelta(t, counts["t_light"], 25, 20)
+	// targets of other engines are never picked
+	_, code := f.activateStream("", "amber", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 400)
+}
+
+func TestActivateWait(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	auth_token := f.addManager("yutong", 1)
+	f.postStream(auth_token, `{"target_id": "`+target_id+`", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`)
+	token, code := f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	_, code = f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 400)
+	codes := make(chan int)
+	go func() {
+		req, _ := http.NewRequest("POST", "/streams/activate",
+			strings.NewReader(`{"target_id": "`+target_id+`", "engine": "openmm", "wait": 10}`))
+		req.Header.Add("Authorization", f.app.Config.Password)
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		codes <- w.Code
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+	assert.Equal(t, <-codes, 200)
+}
+
+func TestDonorFrames(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	stream_id, _ := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"some_file": "12345"}}`), 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"some_file": "67890"}}`), 200)
+	// without frames, the buffered frames are credited
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"chkpt": "data"}}`), 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"some_file": "12345"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": -1}`), 400)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 0.5}`), 200)
+	stream, code := f.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.Frames, 3)
+	assert.Equal(t, stream.DonorFrames, 2.5)
+	assert.Equal(t, f.coreStop(token, ""), 200)
+	f.app.drainStats()
+
+	f.app.Manager = manager.NewManager(f.app)
+	f.app.LoadStreams()
+	stream, code = f.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, stream.Frames, 3)
+	assert.Equal(t, stream.DonorFrames, 2.5)
+}
+
+func TestStreamStartStop(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, jsonData)
+
+	result, code := f.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, result.MongoStatus, "enabled")
+
+	_, code = f.activateStream(target_id, "some_engine", "some_donor", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+
+	activestreams := f.activeStreams()
+	_, ok := activestreams[target_id].(map[string]interface{})[stream_id]
+	assert.True(t, ok)
+
+	assert.Equal(t, f.streamStop(auth_token, stream_id), 200)
+	result, code = f.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, result.MongoStatus, "disabled")
+
+	assert.Equal(t, f.streamStart(auth_token, stream_id), 200)
+	result, code = f.getStream(stream_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, result.MongoStatus, "enabled")
+}
+
+func TestCoreStart(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.addTarget("12345", "yutong", `{"options": {"steps_per_frame": 1}}`)
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+
+	{
+		req, _ := http.NewRequest("GET", "/core/start", nil)
+		req.Header.Add("Authorization", token)
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+	}
+
+	{
+		dataBuffer := bytes.NewBuffer([]byte("12345678"))
+		req, _ := http.NewRequest("POST", "/core/frame", dataBuffer)
+		req.Header.Add("Authorization", token)
+		req.Header.Add("Content-MD5", "1234")
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 400)
+	}
+
+	assert.Equal(t, f.putFrame(token, "12345678"), 400)
+	assert.Equal(t, f.putFrame(token, `{"files": {"some_file": "some_data"}}`), 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"some_file": "some_data"}}`), 409)
+}
+
+func TestCoreStartGzip(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	f.addTarget("12345", "yutong", `{"options": {"steps_per_frame": 1}}`)
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	stream_id, _ := f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+
+	req, _ := http.NewRequest("GET", "/core/start", nil)
+	req.Header.Add("Authorization", token)
+	req.Header.Add("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.HeaderMap.Get("Content-Encoding"), "gzip")
+	h := md5.New()
+	h.Write(w.Body.Bytes())
+	assert.Equal(t, w.HeaderMap.Get("Content-MD5"), hex.EncodeToString(h.Sum(nil)))
+
+	reader, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	result := make(map[string]interface{})
+	assert.Nil(t, json.Unmarshal(body, &result))
+	assert.Equal(t, result["stream_id"], stream_id)
+}
+
+func TestCoreUploadLimits(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	frame := `{"files": {"frames.xtc": "12345"}}`
+	checkpoint := `{"files": {"chkpt": "data"}, "frames": 1}`
+	f.app.Config.MaxFrameBytes = int64(len(frame) - 1)
+	f.app.Config.MaxCheckpointBytes = int64(len(checkpoint) - 1)
+	assert.Equal(t, f.putFrame(token, frame), 413)
+	assert.Equal(t, f.putCheckpoint(token, checkpoint), 413)
+	f.app.Config.MaxFrameBytes = int64(len(frame))
+	f.app.Config.MaxCheckpointBytes = int64(len(checkpoint))
+	assert.Equal(t, f.putFrame(token, frame), 200)
+	assert.Equal(t, f.putCheckpoint(token, checkpoint), 200)
+	// spooled bodies are cleaned up
+	files, _ := ioutil.ReadDir(f.app.TmpDir())
+	assert.Equal(t, len(files), 0)
+}
+
+func TestCoreExpiration(t *testing.T) {
 	f := NewFixture()
 	defer f.shutdown()
-	f.app.Manager.expirationTime = 5
+	f.app.Manager.SetExpirationTime(5)
+	target_id := "12345"
+	f.addTarget("12345", "yutong", `{"options": {"steps_per_frame": 1}}`)
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	f.postStream(auth_token, jsonData)
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	time.Sleep(time.Duration(6) * time.Second)
+	assert.Equal(t, f.coreStop(token, ""), 401)
+}
+
+func TestCoreHeartbeat(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	f.app.Manager.SetExpirationTime(5)
 	target_id := "12345"
 	f.addTarget("12345", "yutong", `{"options": {"steps_per_frame": 1}}`)
 	jsonData := `{"target_id":"` + target_id + `",
@@ -1121,7 +2550,306 @@ func TestCoreHeartbeat(t *testing.T) {
 	time.Sleep(time.Duration(3) * time.Second)
 	assert.Equal(t, f.coreStop(token, ""), 200)
 	time.Sleep(time.Duration(3) * time.Second)
-	assert.Equal(t, f.coreStop(token, ""), 400)
+	assert.Equal(t, f.coreStop(token, ""), 401)
+}
+
+func (f *Fixture) corePause(token, body string) (result CorePauseReply, code int) {
+	req, _ := http.NewRequest("POST", "/core/pause", strings.NewReader(body))
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &result)
+	code = w.Code
+	return
+}
+
+func TestCorePause(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	f.app.Manager.SetExpirationTime(2)
+	target_id := "12345"
+	auth_token := f.addManager("yutong", 1)
+	stream_id, _ := f.postStream(auth_token, `{"target_id":"`+target_id+`", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`)
+	token, code := f.activateStream(target_id, "openmm", "jesse", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	_, code = f.corePause(token, `{"duration": -1}`)
+	assert.Equal(t, code, 400)
+	reply, code := f.corePause(token, `{"duration": 4}`)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, reply.Expires, reply.PausedUntil+2)
+	active := f.activeStreams()[target_id].(map[string]interface{})[stream_id].(map[string]interface{})
+	assert.Equal(t, active["paused"], true)
+	time.Sleep(3 * time.Second)
+	req, _ := http.NewRequest("POST", "/core/resume", nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	active = f.activeStreams()[target_id].(map[string]interface{})[stream_id].(map[string]interface{})
+	assert.Nil(t, active["paused"])
+	time.Sleep(3 * time.Second)
+	assert.Equal(t, f.coreHeartbeat(token), 401)
+}
+
+func (f *Fixture) targetUsage(token, targetId string) (result map[string]interface{}, code int) {
+	req, _ := http.NewRequest("GET", "/targets/"+targetId+"/usage", nil)
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &result)
+	code = w.Code
+	return
+}
+
+func TestTargetUsage(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	stream_id, code := f.postStream(auth_token, jsonData)
+	assert.Equal(t, code, 200)
+	usage, code := f.targetUsage(auth_token, target_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, usage["bytes"], float64(48))
+
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "12345"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 1}`), 200)
+	usage, code = f.targetUsage(auth_token, target_id)
+	assert.Equal(t, usage["bytes"], float64(57))
+	streams := usage["streams"].(map[string]interface{})
+	assert.Equal(t, streams[stream_id], float64(57))
+
+	// frames are refused once the quota is reached
+	f.app.Config.TargetQuota = 57
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "67890"}}`), 400)
+	f.app.Config.TargetQuota = 0
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "67890"}}`), 200)
+
+	assert.Equal(t, f.deleteStream(auth_token, stream_id), 200)
+	usage, code = f.targetUsage(auth_token, target_id)
+	assert.Equal(t, usage["bytes"], float64(0))
+}
+
+func TestTargetStreams(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	stream1, _ := f.postStream(auth_token, jsonData)
+	stream2, _ := f.postStream(auth_token, jsonData)
+	stream3, _ := f.postStream(auth_token, jsonData)
+	_, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.streamStop(auth_token, stream3), 200)
+
+	list := func(token, targetId string) (TargetStreamsReply, int) {
+		req, _ := http.NewRequest("GET", "/targets/"+targetId+"/streams", nil)
+		req.Header.Add("Authorization", token)
+		w := httptest.NewRecorder()
+		f.app.Router.ServeHTTP(w, req)
+		reply := TargetStreamsReply{}
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return reply, w.Code
+	}
+	_, code = list("bad_token", target_id)
+	assert.Equal(t, code, 401)
+	reply, code := list(auth_token, target_id)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, len(reply.Active), 1)
+	assert.Equal(t, len(reply.Inactive), 1)
+	assert.Equal(t, reply.Disabled, []string{stream3})
+	listed := map[string]bool{reply.Active[0]: true, reply.Inactive[0]: true}
+	assert.True(t, listed[stream1] && listed[stream2])
+
+	reply, code = list(auth_token, "unknown")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, reply, TargetStreamsReply{[]string{}, []string{}, []string{}, false})
+}
+
+func TestTargetStats(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	auth_token := f.addManager("yutong", 1)
+	cursor := f.app.Mongo.DB("stats").C("12345")
+	day := 1404432000
+	cursor.Insert(bson.M{"user": "jesse", "engine": "a", "start_time": day, "end_time": day + 3600, "frames": 2.5, "stream": "s1", "start_frames": 0, "end_frames": 2})
+	cursor.Insert(bson.M{"user": "jesse", "engine": "a", "start_time": day + 3600, "end_time": day + 7200, "frames": 1.5, "stream": "s2", "start_frames": 3, "end_frames": 4})
+	cursor.Insert(bson.M{"user": "", "engine": "a", "start_time": day + 86400, "end_time": day + 86400 + 1800, "frames": 1.0, "stream": "s1"})
+	req, _ := http.NewRequest("GET", "/targets/12345/stats", nil)
+	req.Header.Add("Authorization", auth_token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	stats := TargetStats{}
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	assert.Equal(t, stats.Frames, 5.0)
+	// sessions recorded before partitions were tracked count for nothing
+	assert.Equal(t, stats.Partitions, 3)
+	assert.Equal(t, stats.Hours, 2.5)
+	assert.Equal(t, stats.Sessions, 3)
+	assert.Equal(t, stats.Donors, 1)
+	assert.Equal(t, stats.Daily, []DailyFrames{{day, 4.0}, {day + 86400, 1.0}})
+	// results are cached
+	cursor.Insert(bson.M{"user": "jesse", "engine": "a", "start_time": day, "end_time": day + 3600, "frames": 2.5, "stream": "s1"})
+	cached, _ := f.app.TargetStats("12345")
+	assert.Equal(t, cached.Frames, 5.0)
+}
+
+func TestCredit(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	f.addTarget("t1", "yutong", "")
+	f.app.Mongo.DB("data").C("targets").UpdateId("t1", bson.M{"$set": bson.M{"options": bson.M{"points_per_frame": 3}}})
+	f.app.Mongo.DB("stats").C("t1").Insert(bson.M{"user": "jesse", "start_time": 0, "end_time": 10, "frames": 2.0})
+	f.app.Mongo.DB("stats").C("t1").Insert(bson.M{"user": "", "start_time": 0, "end_time": 10, "frames": 4.0})
+	f.app.Mongo.DB("stats").C("t2").Insert(bson.M{"user": "jesse", "start_time": 0, "end_time": 10, "frames": 1.0})
+	f.app.Mongo.DB("stats").C("t2").Insert(bson.M{"user": "yutong", "start_time": 0, "end_time": 10, "frames": 5.0})
+	assert.Nil(t, f.app.UpdateCredit())
+
+	req, _ := http.NewRequest("GET", "/donors/jesse/stats", nil)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	result := make(map[string]interface{})
+	json.Unmarshal(w.Body.Bytes(), &result)
+	assert.Equal(t, result["frames"], 3.0)
+	assert.Equal(t, result["points"], 7.0)
+	assert.Equal(t, result["sessions"], 2.0)
+	assert.Equal(t, result["rank"], 1.0)
+	assert.Equal(t, len(result["targets"].(map[string]interface{})), 2)
+
+	req, _ = http.NewRequest("GET", "/donors/nobody/stats", nil)
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 404)
+
+	req, _ = http.NewRequest("GET", "/leaderboard?limit=5", nil)
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	leaderboard := make(map[string][]DonorCredit)
+	json.Unmarshal(w.Body.Bytes(), &leaderboard)
+	assert.Equal(t, len(leaderboard["donors"]), 2)
+	assert.Equal(t, leaderboard["donors"][0].User, "jesse")
+	assert.Equal(t, leaderboard["donors"][1].User, "yutong")
+	assert.Equal(t, leaderboard["donors"][1].Points, 5.0)
+}
+
+func (f *Fixture) issueToken(token string, expiresIn int) (result APIToken, code int) {
+	body := `{"description": "test", "expires_in": ` + strconv.Itoa(expiresIn) + `}`
+	req, _ := http.NewRequest("POST", "/auth/tokens", bytes.NewBufferString(body))
+	req.Header.Add("Authorization", token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	json.Unmarshal(w.Body.Bytes(), &result)
+	return result, w.Code
+}
+
+func TestTokenLifecycle(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	issued, code := f.issueToken(auth_token, 0)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, issued.User, "yutong")
+	assert.Equal(t, issued.Expires, 0)
+
+	// issued tokens act on behalf of the user
+	stream_id, code := f.postStream(issued.Token, jsonData)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.streamStop(issued.Token, stream_id), 200)
+
+	req, _ := http.NewRequest("GET", "/auth/tokens", nil)
+	req.Header.Add("Authorization", auth_token)
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	listing := make(map[string][]APIToken)
+	json.Unmarshal(w.Body.Bytes(), &listing)
+	assert.Equal(t, len(listing["tokens"]), 1)
+	assert.Equal(t, listing["tokens"][0].Id, issued.Id)
+	assert.Equal(t, listing["tokens"][0].Token, "")
+
+	// rotation invalidates the old secret
+	req, _ = http.NewRequest("PUT", "/auth/tokens/"+issued.Id+"/rotate", nil)
+	req.Header.Add("Authorization", auth_token)
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	rotated := make(map[string]string)
+	json.Unmarshal(w.Body.Bytes(), &rotated)
+	assert.Equal(t, f.streamStart(issued.Token, stream_id), 401)
+	assert.Equal(t, f.streamStart(rotated["token"], stream_id), 200)
+
+	// revocation
+	req, _ = http.NewRequest("DELETE", "/auth/tokens/"+issued.Id, nil)
+	req.Header.Add("Authorization", auth_token)
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, f.streamStop(rotated["token"], stream_id), 401)
+
+	// expiration
+	expiring, code := f.issueToken(auth_token, 1)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.streamStop(expiring.Token, stream_id), 200)
+	time.Sleep(2 * time.Second)
+	assert.Equal(t, f.streamStart(expiring.Token, stream_id), 401)
+}
+
+func TestEvents(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	jsonData := `{"target_id":"` + target_id + `",
+				"files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA==",
+				"amber": "ZmlsZWRhdGFibGFoYmFsaA=="}}`
+	auth_token := f.addManager("yutong", 1)
+	stream_id, _ := f.postStream(auth_token, jsonData)
+
+	server := httptest.NewServer(f.app.Router)
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL+"/events?target_id="+target_id, nil)
+	req.Header.Add("Authorization", auth_token)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, resp.Header.Get("Content-Type"), "text/event-stream")
+
+	token, code := f.activateStream(target_id, "a", "b", f.app.Config.Password)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, f.putFrame(token, `{"files": {"frames.xtc": "12345"}}`), 200)
+	assert.Equal(t, f.putCheckpoint(token, `{"files": {"chkpt": "data"}, "frames": 1}`), 200)
+	assert.Equal(t, f.coreStop(token, "bad"), 200)
+
+	scanner := bufio.NewScanner(resp.Body)
+	expected := []string{EVENT_ACTIVATED, EVENT_FRAME, EVENT_CHECKPOINT, EVENT_ERRORED, EVENT_DEACTIVATED}
+	for _, eventType := range expected {
+		var e Event
+		for scanner.Scan() {
+			line := scanner.Text()
+			if len(line) > 6 && line[0:6] == "data: " {
+				json.Unmarshal([]byte(line[6:]), &e)
+				break
+			}
+		}
+		assert.Equal(t, e.Type, eventType)
+		assert.Equal(t, e.StreamId, stream_id)
+		assert.Equal(t, e.TargetId, target_id)
+	}
 }
 
 func TestAlive(t *testing.T) {
@@ -1132,3 +2860,100 @@ func TestAlive(t *testing.T) {
 	f.app.Router.ServeHTTP(w, req)
 	assert.Equal(t, w.Code, 200)
 }
+
+func TestStatsDeadLetter(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	// field names starting with $ are rejected by Mongo
+	f.app.deferInsert("stats", "12345", nil, bson.M{"$frames": 1})
+	f.app.deferInsert("stats", "12345", nil, bson.M{"frames": 2})
+	f.app.drainStats()
+	count, _ := f.app.Mongo.DB("stats").C("12345").Count()
+	assert.Equal(t, count, 1)
+	assert.Equal(t, f.app.stats.Metrics()["retrying"], 1)
+	for i := 1; i < STATS_MAX_RETRIES; i++ {
+		f.app.drainStats()
+	}
+	metrics := f.app.stats.Metrics()
+	assert.Equal(t, metrics["retrying"], 0)
+	assert.Equal(t, metrics["dead_letters"], int64(1))
+	assert.Equal(t, metrics["written"], int64(1))
+	count, _ = f.app.Mongo.DB("dead_letters").C(f.app.Config.Name).Count()
+	assert.Equal(t, count, 1)
+}
+
+func TestRequestIdInStats(t *testing.T) {
+	f := NewFixture()
+	defer f.shutdown()
+	target_id := "12345"
+	auth_token := f.addManager("yutong", 1)
+	stream_id, _ := f.postStream(auth_token, `{"target_id":"`+target_id+`", "files": {"openmm": "ZmlsZWRhdGFibGFoYmFsaA=="}}`)
+	data, _ := json.Marshal(map[string]string{"target_id": target_id, "engine": "openmm", "user": "jesse_v"})
+	req, _ := http.NewRequest("POST", "/streams/activate", bytes.NewBuffer(data))
+	req.Header.Add("Authorization", f.app.Config.Password)
+	req.Header.Add("X-Request-ID", "cc-1234")
+	w := httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Header().Get("X-Request-ID"), "cc-1234")
+	result := ActivateReply{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	token := result.Token
+	assert.Equal(t, result.URL, "http://"+f.app.Config.ExternalHost+"/core/start")
+
+	// a failed frame post is recorded with the session
+	assert.Equal(t, f.putFrame(token, `{"files": {"a": "1"}}`), 200)
+	req, _ = http.NewRequest("PUT", "/core/frame", bytes.NewBufferString(`{"files": {"a": "1"}}`))
+	req.Header.Add("Authorization", token)
+	h := md5.New()
+	io.WriteString(h, `{"files": {"a": "1"}}`)
+	req.Header.Add("Content-MD5", hex.EncodeToString(h.Sum(nil)))
+	req.Header.Add("X-Request-ID", "frame-1")
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 409)
+	assert.Equal(t, w.Header().Get("X-Request-ID"), "frame-1")
+	assert.Equal(t, f.coreStop(token, "failed"), 200)
+	f.app.drainStats()
+
+	stats := make(map[string]interface{})
+	f.app.Mongo.DB("stats").C(target_id).Find(bson.M{"stream": stream_id}).One(&stats)
+	requests, _ := stats["requests"].(bson.M)
+	assert.Equal(t, requests["activate"], "cc-1234")
+	assert.Equal(t, requests["failed"], "frame-1")
+	assert.NotEqual(t, requests["stop"], "")
+
+	// invalid ids are replaced
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Add("X-Request-ID", "bad id")
+	w = httptest.NewRecorder()
+	f.app.Router.ServeHTTP(w, req)
+	assert.Equal(t, len(w.Header().Get("X-Request-ID")), 16)
+}
+
+func TestActivateReply(t *testing.T) {
+	app := &Application{Config: Configuration{ExternalHost: "vspg11.stanford.edu:8080"}}
+	m := manager.NewManagerWithOptions(&manager.ManagerCallbacks{}, manager.ManagerOptions{ExpirationTime: 1200})
+	m.AddStream(newStream("stream", "target", "none", 0, 0, int(time.Now().Unix())), "target", true)
+	session := activation{}
+	token, _, err := m.ActivateStream("target", "jesse", "openmm", func(s *Stream) error {
+		session.expires = s.ActiveStream.Expires()
+		session.timeout = s.ActiveStream.Timeout
+		return nil
+	})
+	assert.Nil(t, err)
+	session.token = token
+	reply := app.activateReply(session)
+	assert.Equal(t, reply.Token, token)
+	assert.Equal(t, reply.URL, "http://vspg11.stanford.edu:8080/core/start")
+	assert.True(t, reply.Expires >= int(time.Now().Unix())+1199)
+	assert.Equal(t, reply.HeartbeatInterval, 300)
+	assert.Equal(t, reply.Backoff, HEARTBEAT_BACKOFF)
+
+	// the backoff stays within the interval of short sessions
+	reply = app.activateReply(activation{timeout: 2 * time.Second})
+	assert.Equal(t, reply.HeartbeatInterval, 1)
+	assert.Equal(t, reply.Backoff, 1)
+	app.Config.SSL = map[string]string{"Cert": "cert.pem", "Key": "key.pem"}
+	assert.Equal(t, app.activateReply(session).URL, "https://vspg11.stanford.edu:8080/core/start")
+}
@@ -1,218 +1,161 @@
-/*
-Copyright 2013 Richard Crowley. All rights reserved.
-
-Redistribution and use in source and binary forms, with or without
-modification, are permitted provided that the following conditions are
-met:
-
-    1.  Redistributions of source code must retain the above copyright
-        notice, this list of conditions and the following disclaimer.
-
-    2.  Redistributions in binary form must reproduce the above
-        copyright notice, this list of conditions and the following
-        disclaimer in the documentation and/or other materials provided
-        with the distribution.
-
-THIS SOFTWARE IS PROVIDED BY RICHARD CROWLEY ``AS IS'' AND ANY EXPRESS
-OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
-WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
-DISCLAIMED. IN NO EVENT SHALL RICHARD CROWLEY OR CONTRIBUTORS BE LIABLE
-FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
-CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
-SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
-INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
-CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
-ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF
-THE POSSIBILITY OF SUCH DAMAGE.
-
-The views and conclusions contained in the software and documentation
-are those of the authors and should not be interpreted as representing
-*/
-
 package scv
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"fmt"
-	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"sync"
 	"time"
 )
 
-// Server is an http.Server with better defaults and built-in graceful stop.
+// Default seconds a client has to send the headers of a request, so that
+// slow clients cannot hold connections open.
+const SERVER_READ_HEADER_TIMEOUT int = 10
+
+// Default seconds a client has to send a whole request, and the server to
+// write the reply. Both must be longer than the longest upload or download.
+const SERVER_READ_TIMEOUT int = 60
+const SERVER_WRITE_TIMEOUT int = 60
+
+// Default seconds an idle keep-alive connection is kept open.
+const SERVER_IDLE_TIMEOUT int = 120
+
+// Default seconds Close waits for the requests in flight to finish before
+// closing their connections.
+const SHUTDOWN_TIMEOUT int = 30
+
+// The timeouts of the Server, in seconds, 0 for default, <0 for none.
+type ServerTimeouts struct {
+	ReadHeader int `json:"ReadHeader"`
+	Read       int `json:"Read"`
+	Write      int `json:"Write"`
+	Idle       int `json:"Idle"`
+	Shutdown   int `json:"Shutdown"` // <0 to close connections right away
+}
+
+func serverTimeout(seconds, fallback int) time.Duration {
+	if seconds == 0 {
+		seconds = fallback
+	} else if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+/*
+Server is an http.Server that keeps track of its connections and closes
+gracefully: Close stops accepting connections, closes the idle ones, and waits
+up to ShutdownTimeout for the requests in flight before closing the rest.
+HTTP/2 is negotiated over TLS unless it is disabled.
+*/
 type Server struct {
 	http.Server
-	ch        chan<- struct{}
-	conns     map[string]net.Conn
-	listeners []net.Listener
-	mu        sync.Mutex // guards conns and listeners
-	wg        sync.WaitGroup
+	ShutdownTimeout time.Duration
+
+	mu    sync.Mutex                  // guards conns
+	conns map[net.Conn]http.ConnState // open connections and their state
 }
 
-// NewServer returns an http.Server with better defaults and built-in graceful
-// stop.
-func NewServer(addr string, handler http.Handler) *Server {
-	ch := make(chan struct{})
+func NewServer(addr string, handler http.Handler, timeouts ServerTimeouts) *Server {
 	s := &Server{
 		Server: http.Server{
-			Addr: addr,
-			Handler: &serverHandler{
-				Handler: handler,
-			},
-			MaxHeaderBytes: 4096,
-			ReadTimeout:    60e9, // These are absolute times which must be
-			WriteTimeout:   60e9, // longer than the longest {up,down}load.
+			Addr:              addr,
+			Handler:           &serverHandler{Handler: handler},
+			MaxHeaderBytes:    4096,
+			ReadHeaderTimeout: serverTimeout(timeouts.ReadHeader, SERVER_READ_HEADER_TIMEOUT),
+			ReadTimeout:       serverTimeout(timeouts.Read, SERVER_READ_TIMEOUT),
+			WriteTimeout:      serverTimeout(timeouts.Write, SERVER_WRITE_TIMEOUT),
+			IdleTimeout:       serverTimeout(timeouts.Idle, SERVER_IDLE_TIMEOUT),
 		},
-		ch:    ch,
-		conns: make(map[string]net.Conn),
+		ShutdownTimeout: serverTimeout(timeouts.Shutdown, SHUTDOWN_TIMEOUT),
+		conns:           make(map[net.Conn]http.ConnState),
 	}
 	s.ConnState = func(conn net.Conn, state http.ConnState) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
 		switch state {
-		case http.StateNew:
-			s.wg.Add(1)
-		case http.StateActive:
-			s.mu.Lock()
-			delete(s.conns, conn.LocalAddr().String())
-			s.mu.Unlock()
-		case http.StateIdle:
-			select {
-			case <-ch:
-				//conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond)) // Doesn't work but seems like the right idea.
-				conn.Close()
-			default:
-				s.mu.Lock()
-				s.conns[conn.LocalAddr().String()] = conn
-				s.mu.Unlock()
-			}
 		case http.StateHijacked, http.StateClosed:
-			s.wg.Done()
+			delete(s.conns, conn)
+		default:
+			s.conns[conn] = state
 		}
 	}
 	return s
 }
 
-// NewTLSServer returns an http.Server with better defaults configured to use
-// the certificate and private key files.
-func NewTLSServer(
-	addr, cert, key string,
-	handler http.Handler,
-) (*Server, error) {
-	s := NewServer(addr, handler)
-	return s, s.TLS(cert, key)
-}
-
-// CA overrides the certificate authority on the Server's TLSConfig field.
-func (s *Server) CA(ca string) error {
-	certPool := x509.NewCertPool()
-	buf, err := ioutil.ReadFile(ca)
-	if nil != err {
-		return err
+// Serve over TLS if a TLSConfig is set, and plain HTTP otherwise. Returns nil
+// once the Server is closed.
+func (s *Server) ListenAndServe() error {
+	var err error
+	if s.TLSConfig != nil {
+		// the certificate is served by TLSConfig.GetCertificate
+		err = s.Server.ListenAndServeTLS("", "")
+	} else {
+		err = s.Server.ListenAndServe()
 	}
-	certPool.AppendCertsFromPEM(buf)
-	s.tlsConfig()
-	s.TLSConfig.RootCAs = certPool
-	return nil
-}
-
-// ClientCA configures the CA pool for verifying client side certificates.
-func (s *Server) ClientCA(ca string) error {
-	certPool := x509.NewCertPool()
-	buf, err := ioutil.ReadFile(ca)
-	if nil != err {
-		return err
+	if err == http.ErrServerClosed {
+		return nil
 	}
-	certPool.AppendCertsFromPEM(buf)
-	s.tlsConfig()
-	s.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
-	s.TLSConfig.ClientCAs = certPool
-	return nil
+	return err
 }
 
-// Close closes all the net.Listeners passed to Serve (even via ListenAndServe)
-// and signals open connections to close at their earliest convenience.  That
-// is either after responding to the current request or after a short grace
-// period for idle keepalive connections.  Close blocks until all connections
-// have been closed.
+/*
+Stop accepting connections and close the idle ones, then wait for the requests
+in flight for up to ShutdownTimeout before closing their connections. Handlers
+of connections closed that way may still be running when Close returns.
+*/
 func (s *Server) Close() error {
-	close(s.ch)
-	s.SetKeepAlivesEnabled(false)
-	s.mu.Lock()
-	for _, l := range s.listeners {
-		// fmt.Println("Closing", l)
-		if err := l.Close(); nil != err {
-			return err
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		log.Printf("Closing %d connections still in use", s.Connections()[http.StateActive.String()])
+		err = s.Server.Close()
 	}
-	s.listeners = nil
-	t := time.Now().Add(500 * time.Millisecond)
-	for _, c := range s.conns {
-		// fmt.Println("closing c")
-		c.SetReadDeadline(t)
-	}
-	s.conns = make(map[string]net.Conn)
-	s.mu.Unlock()
-	s.wg.Wait()
-	return nil
+	return err
 }
 
-// ListenAndServe calls net.Listen with s.Addr and then calls s.Serve.
-func (s *Server) ListenAndServe() error {
-	addr := s.Addr
-	if "" == addr {
-		if nil == s.TLSConfig {
-			addr = ":http"
-		} else {
-			addr = ":https"
-		}
-	}
-	l, err := net.Listen("tcp", addr)
-	if nil != err {
-		return err
+// Returns the number of open connections by state: new, active or idle.
+func (s *Server) Connections() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := map[string]int{
+		http.StateNew.String():    0,
+		http.StateActive.String(): 0,
+		http.StateIdle.String():   0,
 	}
-	if nil != s.TLSConfig {
-		l = tls.NewListener(l, s.TLSConfig)
+	for _, state := range s.conns {
+		counts[state.String()] += 1
 	}
-	return s.Serve(l)
-}
-
-// ListenAndServeTLS calls s.TLS with the given certificate and private key
-// files and then calls s.ListenAndServe.
-func (s *Server) ListenAndServeTLS(cert, key string) error {
-	s.TLS(cert, key)
-	return s.ListenAndServe()
-}
-
-// Serve behaves like http.Server.Serve with the added option to stop the
-// Server gracefully with the s.Close method.
-func (s *Server) Serve(l net.Listener) error {
-	s.mu.Lock()
-	s.listeners = append(s.listeners, l)
-	s.mu.Unlock()
-	return s.Server.Serve(l)
+	return counts
 }
 
-// TLS configures this Server to be a TLS server using the given certificate
-// and private key files.
-func (s *Server) TLS(cert, key string) error {
-	c, err := tls.LoadX509KeyPair(cert, key)
-	if nil != err {
-		fmt.Println(err)
-		panic("Could not load X509 Key Pair")
+// Set up the TLSConfig of the Server. HTTP/2 is negotiated unless disableHTTP2
+// is set.
+func (s *Server) tlsConfig(disableHTTP2 bool) {
+	if s.TLSConfig == nil {
+		s.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if disableHTTP2 {
+		s.TLSConfig.NextProtos = []string{"http/1.1"}
+		s.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 	}
-	s.tlsConfig()
-	s.TLSConfig.Certificates = []tls.Certificate{c}
-	return nil
 }
 
-func (s *Server) tlsConfig() {
-	if nil == s.TLSConfig {
-		s.TLSConfig = &tls.Config{
-			NextProtos: []string{"http/1.1"},
-		}
+// Extends the read and write deadlines of the connection of a request to
+// timeout from now, or removes them if timeout is 0, for requests that outlast
+// the timeouts of the Server, eg. large uploads and event streams. Left as is
+// if the connection does not support it.
+func extendDeadlines(w http.ResponseWriter, timeout time.Duration) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
 	}
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(deadline)
+	rc.SetWriteDeadline(deadline)
 }
 
 type serverHandler struct {
@@ -220,7 +163,6 @@ type serverHandler struct {
 }
 
 func (h *serverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// r.Header.Set("Host", r.Host) // Should I?
 	r.URL.Host = r.Host
 	if nil != r.TLS {
 		r.URL.Scheme = "https"
@@ -0,0 +1,95 @@
+package scv
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerClose(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	s := NewServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-time.After(2 * time.Second):
+		}
+		w.Write([]byte(r.URL.Scheme))
+	}), ServerTimeouts{Shutdown: 1})
+	assert.Equal(t, s.ReadHeaderTimeout, time.Duration(SERVER_READ_HEADER_TIMEOUT)*time.Second)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.Serve(l)
+	url := "http://" + l.Addr().String() + "/"
+
+	// requests in flight are waited for
+	replies := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			replies <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		replies <- string(body)
+	}()
+	<-started
+	assert.Equal(t, s.Connections()["active"], 1)
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	assert.Equal(t, <-replies, "http")
+	<-closed
+	_, err = http.Get(url)
+	assert.NotNil(t, err)
+
+	// and closed once ShutdownTimeout expires
+	s = NewServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		time.Sleep(3 * time.Second)
+	}), ServerTimeouts{Shutdown: -1})
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.Serve(l)
+	go http.Get("http://" + l.Addr().String() + "/")
+	<-started
+	start := time.Now()
+	assert.Nil(t, s.Close())
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestExtendDeadlines(t *testing.T) {
+	s := NewServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/extended" {
+			// through the writers of the middlewares
+			extendDeadlines(&encodingWriter{w: &timeoutWriter{w: w}}, 0)
+		}
+		time.Sleep(1500 * time.Millisecond)
+		w.Write([]byte("done"))
+	}), ServerTimeouts{Write: 1})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go s.Serve(l)
+	defer s.Close()
+	get := func(path string) string {
+		resp, err := http.Get("http://" + l.Addr().String() + path)
+		if err != nil {
+			return ""
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+	assert.Equal(t, get("/"), "")
+	assert.Equal(t, get("/extended"), "done")
+}
@@ -0,0 +1,157 @@
+package scv
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+A target whose streams are on this SCV, in servers.shards. Each SCV keeps one
+document per target it holds streams of, so that managers can fan out their
+requests over the SCVs of a target without going through the CC.
+*/
+type Shard struct {
+	Id       string `json:"-" bson:"_id"` // see shardId
+	TargetId string `json:"target_id" bson:"target_id"`
+	SCV      string `json:"scv" bson:"scv"`
+	Host     string `json:"host" bson:"host"`           // ExternalHost of the SCV
+	Streams  int    `json:"streams" bson:"streams"`     // as of LastSeen
+	LastSeen int    `json:"last_seen" bson:"last_seen"` // refreshed on every heartbeat of the SCV
+}
+
+func shardId(targetId, scv string) string {
+	return targetId + ":" + scv
+}
+
+// The targets this SCV is registered as a shard of.
+type shardRegistry struct {
+	sync.Mutex
+	targets map[string]bool
+}
+
+func newShardRegistry() *shardRegistry {
+	return &shardRegistry{targets: make(map[string]bool)}
+}
+
+func (app *Application) newShard(targetId string, streams int) Shard {
+	return Shard{
+		Id:       shardId(targetId, app.Config.Name),
+		TargetId: targetId,
+		SCV:      app.Config.Name,
+		Host:     app.Config.ExternalHost,
+		Streams:  streams,
+		LastSeen: int(time.Now().Unix()),
+	}
+}
+
+// Register the SCV as a shard of a target once a stream of the target was
+// added, unless it already is.
+func (app *Application) addShard(targetId string) {
+	app.shards.Lock()
+	registered := app.shards.targets[targetId]
+	app.shards.targets[targetId] = true
+	app.shards.Unlock()
+	if registered {
+		return
+	}
+	if err := app.Database.UpsertShard(app.newShard(targetId, app.Manager.TargetSizes()[targetId])); err != nil {
+		// retried by the next SyncShards
+		log.Println("Unable to register shard of target "+targetId+":", err)
+	}
+}
+
+// Unregister the SCV as a shard of a target once its last stream was removed.
+func (app *Application) removeShard(targetId string) {
+	if app.Manager.TargetSizes()[targetId] > 0 {
+		return
+	}
+	app.shards.Lock()
+	delete(app.shards.targets, targetId)
+	app.shards.Unlock()
+	if err := app.Database.RemoveShard(shardId(targetId, app.Config.Name)); err != nil && err != ErrNotFound {
+		log.Println("Unable to unregister shard of target "+targetId+":", err)
+	}
+}
+
+/*
+Bring the shards of this SCV in servers.shards up to date: refresh the number
+of streams of every target, and remove the targets that no longer have
+streams here, eg. because they were removed while the SCV was down. Called on
+every heartbeat, which also repairs the registrations that failed.
+*/
+func (app *Application) SyncShards() error {
+	sizes := app.Manager.TargetSizes()
+	existing, err := app.Database.SCVShards(app.Config.Name)
+	if err != nil {
+		return err
+	}
+	for _, shard := range existing {
+		if _, ok := sizes[shard.TargetId]; ok == false {
+			if err := app.Database.RemoveShard(shard.Id); err != nil && err != ErrNotFound {
+				return err
+			}
+		}
+	}
+	targets := make(map[string]bool)
+	for targetId, streams := range sizes {
+		if err := app.Database.UpsertShard(app.newShard(targetId, streams)); err != nil {
+			return err
+		}
+		targets[targetId] = true
+	}
+	app.shards.Lock()
+	app.shards.targets = targets
+	app.shards.Unlock()
+	return nil
+}
+
+/*
+.. http:get:: /targets/:target_id/shards
+    List the SCVs holding streams of the target, including this one, so
+    that requests such as ``/streams/sync`` can be sent to each of them.
+    :reqheader Authorization: Manager's authorization token
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "shards": [
+                {
+                    "target_id": "target_id",
+                    "scv": "vspg11",
+                    "host": "vspg11.stanford.edu",
+                    "streams": 25000,
+                    "last_seen": 1404505630 // SCVs not seen for a while may be down
+                }
+            ]
+        }
+    :status 200: OK
+    :status 403: The target belongs to another namespace
+*/
+func (app *Application) TargetShardsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, err := app.CurrentManager(r)
+		if err != nil {
+			return err
+		}
+		targetId := mux.Vars(r)["target_id"]
+		if err := app.checkTarget(targetId, user); err != nil {
+			return err
+		}
+		shards, err := app.Database.Shards(targetId)
+		if err != nil {
+			return err
+		}
+		sort.Slice(shards, func(i, j int) bool { return shards[i].SCV < shards[j].SCV })
+		data, err := json.Marshal(map[string][]Shard{"shards": shards})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
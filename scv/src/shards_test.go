@@ -0,0 +1,79 @@
+package scv
+
+import (
+	"../manager"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShards(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "shards")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{
+		Config:   Configuration{Name: "vspg11", ExternalHost: "vspg11.stanford.edu"},
+		Database: db,
+		shards:   newShardRegistry(),
+	}
+	app.Manager = manager.NewManager(app)
+	now := int(time.Now().Unix())
+	app.Manager.AddStream(newStream("a", "target", "yutong", 0, 0, now), "target", true)
+	app.addShard("target")
+	app.Manager.AddStream(newStream("b", "target", "yutong", 0, 0, now), "target", true)
+	app.addShard("target")
+	// another SCV holding streams of the target, and a target removed while
+	// this SCV was down
+	assert.Nil(t, db.UpsertShard(Shard{Id: shardId("target", "vspg12"), TargetId: "target", SCV: "vspg12"}))
+	assert.Nil(t, db.UpsertShard(Shard{Id: shardId("gone", "vspg11"), TargetId: "gone", SCV: "vspg11"}))
+
+	shards, err := db.Shards("target")
+	assert.Nil(t, err)
+	assert.Equal(t, len(shards), 2)
+	assert.Nil(t, app.SyncShards())
+	shards, err = db.SCVShards("vspg11")
+	assert.Nil(t, err)
+	assert.Equal(t, len(shards), 1)
+	assert.Equal(t, shards[0].Streams, 2)
+	assert.Equal(t, shards[0].Host, "vspg11.stanford.edu")
+
+	db.InsertTarget(map[string]interface{}{"_id": "target", "owner": "yutong"})
+	db.insert("users", "all", map[string]interface{}{"_id": "yutong", "token": "secret"})
+	db.insert("users", "managers", map[string]interface{}{"_id": "yutong"})
+	app.tokenCache = NewTokenCache(time.Minute)
+	app.optionsCache = NewResultCache(time.Minute)
+	router := mux.NewRouter()
+	router.Handle("/targets/{target_id}/shards", app.TargetShardsHandler())
+	req, _ := http.NewRequest("GET", "/targets/target/shards", nil)
+	req.Header.Add("Authorization", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	reply := struct {
+		Shards []Shard `json:"shards"`
+	}{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &reply))
+	assert.Equal(t, len(reply.Shards), 2)
+	assert.Equal(t, reply.Shards[0].SCV, "vspg11")
+	assert.Equal(t, reply.Shards[1].SCV, "vspg12")
+
+	// the last stream of the target is removed
+	assert.Nil(t, app.Manager.RemoveStream("a", "yutong"))
+	app.removeShard("target")
+	assert.Equal(t, len(app.shards.targets), 1)
+	assert.Nil(t, app.Manager.RemoveStream("b", "yutong"))
+	app.removeShard("target")
+	shards, _ = db.Shards("target")
+	assert.Equal(t, len(shards), 1)
+	assert.Equal(t, shards[0].SCV, "vspg12")
+}
@@ -0,0 +1,78 @@
+package scv
+
+import (
+	"../manager"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// Reply of GET /admin/state.
+type StateReply struct {
+	Time       int                  `json:"time"`
+	Manager    manager.ManagerState `json:"manager"`
+	Queues     map[string]int       `json:"queues"` // writes, checkpoints and verifications waiting to be processed
+	Goroutines int                  `json:"goroutines"`
+}
+
+/*
+.. http:get:: /admin/state
+    A snapshot of the state of the SCV for debugging, eg. stuck activations
+    or leaked expirations. The counts of the manager are taken under its lock,
+    and are consistent with each other.
+    .. note:: This request can only be made by CCs.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "time": 1404505630,
+            "manager": {
+                "version": 1520, // activations and deactivations so far
+                "streams": 3,
+                "tokens": 1,
+                "stale_tokens": 0, // tokens of ended sessions, should be 0
+                "donor_streams": {"yutong": 1},
+                "timers": {"expiration": 1, "cooldown": 1},
+                "targets": {
+                    "target_id": {
+                        "active": 1,
+                        "inactive": 0,
+                        "cooling": 1,
+                        "disabled": 1,
+                        "paused": false,
+                        "max_active": 10, // omitted if there is no limit
+                        "aging_rate": 0,
+                        "waiters": 2
+                    }
+                }
+            },
+            "queues": {"stats": 12, "plugins": 0, "verifications": 3},
+            "goroutines": 150
+        }
+    :status 200: OK
+    :status 401: Not the CC
+*/
+func (app *Application) StateHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if app.isCC(r) == false {
+			return ErrUnauthorized
+		}
+		reply := StateReply{
+			Time:    int(time.Now().Unix()),
+			Manager: app.Manager.State(),
+			Queues: map[string]int{
+				"stats":   app.stats.Depth(),
+				"plugins":       len(app.pluginQueue),
+				"verifications": app.verifications.len(),
+			},
+			Goroutines: runtime.NumGoroutine(),
+		}
+		data, err := json.Marshal(reply)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(data)
+		return nil
+	}
+}
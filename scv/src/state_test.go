@@ -0,0 +1,38 @@
+package scv
+
+import (
+	"../manager"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateHandler(t *testing.T) {
+	app := &Application{
+		Config:        Configuration{Password: "hello"},
+		Manager:       manager.NewManager(&manager.ManagerCallbacks{}),
+		stats:         NewStatsWriter(4),
+		pluginQueue:   make(chan pluginJob, 4),
+		verifications: newVerificationQueue(),
+	}
+	app.stats.enqueue(&deferredOp{})
+	state := func(password string) (StateReply, int) {
+		req, _ := http.NewRequest("GET", "/admin/state", nil)
+		req.Header.Set("Authorization", password)
+		w := httptest.NewRecorder()
+		app.StateHandler().ServeHTTP(w, req)
+		reply := StateReply{}
+		json.Unmarshal(w.Body.Bytes(), &reply)
+		return reply, w.Code
+	}
+	_, code := state("")
+	assert.Equal(t, code, 401)
+	reply, code := state("hello")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, reply.Queues, map[string]int{"stats": 1, "plugins": 0, "verifications": 0})
+	assert.Equal(t, reply.Manager.Tokens, 0)
+	assert.True(t, reply.Goroutines > 0)
+}
@@ -0,0 +1,271 @@
+package scv
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Seconds an aggregation over the stats DB is cached before being recomputed.
+const STATS_CACHE_TTL int = 60
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// ResultCache memoizes the results of expensive queries for a fixed ttl.
+type ResultCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+func NewResultCache(ttl time.Duration) *ResultCache {
+	return &ResultCache{
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry),
+	}
+}
+
+func (c *ResultCache) Get(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[key]
+	if ok == false || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// Like Get, but also returns entries that have expired. Used as a fallback
+// when the result cannot be recomputed.
+func (c *ResultCache) GetStale(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[key]
+	if ok == false {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *ResultCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, key)
+}
+
+func (c *ResultCache) Put(key string, value interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	c.entries[key] = cacheEntry{value: value, expires: time.Now().Add(c.ttl)}
+}
+
+// Frames completed on a given day, identified by the unix time of its midnight
+// (UTC).
+type DailyFrames struct {
+	Day    int     `json:"day" bson:"_id"`
+	Frames float64 `json:"frames" bson:"frames"`
+}
+
+// Aggregate of the stats documents recorded each time a stream of the target
+// is deactivated.
+type TargetStats struct {
+	Frames     float64       `json:"frames" bson:"frames"`         // credited to donors, including partial frames
+	Partitions int           `json:"partitions" bson:"partitions"` // partitions written, ie. whole frames
+	Hours      float64       `json:"hours" bson:"-"`
+	Seconds    int           `json:"-" bson:"seconds"`
+	Sessions   int           `json:"sessions" bson:"sessions"`
+	Donors     int           `json:"donors" bson:"-"`
+	Users      []string      `json:"-" bson:"users"`
+	Daily      []DailyFrames `json:"daily" bson:"-"`
+
+	// Progress on this SCV towards the max_frames and max_target_frames of
+	// the target, see checkProgress, filled in by TargetStatsHandler.
+	StreamFrames     int  `json:"stream_frames" bson:"-"`
+	CompletedStreams int  `json:"completed_streams" bson:"-"`
+	Completed        bool `json:"completed" bson:"-"`
+}
+
+// Compute the statistics of a target from the stats DB. Results are cached
+// for STATS_CACHE_TTL seconds.
+func (app *Application) TargetStats(targetId string) (TargetStats, error) {
+	if cached, ok := app.statsCache.Get("target:" + targetId); ok {
+		return cached.(TargetStats), nil
+	}
+	stats, err := app.Database.TargetStats(targetId)
+	if err != nil {
+		return stats, err
+	}
+	stats.Hours = float64(stats.Seconds) / 3600
+	for _, user := range stats.Users {
+		if user != "" {
+			stats.Donors += 1
+		}
+	}
+	app.statsCache.Put("target:"+targetId, stats)
+	return stats, nil
+}
+
+/*
+.. http:get:: /targets/:target_id/stats
+    Aggregate statistics of the work done on a target's streams. Only
+    sessions that have ended are counted. Results may be up to a minute
+    old.
+    :reqheader Authorization: Manager's authorization token
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "frames": 1250.5, // credited to donors, including partial frames
+            "partitions": 1200, // whole frames written to the streams
+            "hours": 310.2, // wall-clock hours spent by cores
+            "sessions": 412,
+            "donors": 37, // unique donors, anonymous sessions excluded
+            "daily": [
+                {"day": 1404432000, "frames": 600.5},
+                {"day": 1404518400, "frames": 650}
+            ],
+            "stream_frames": 1210,
+            "completed_streams": 3,
+            "completed": false
+        }
+    .. note:: ``stream_frames`` are the frames of the target's streams
+        on this SCV, and ``completed_streams`` those that were completed
+        by the ``max_frames`` or ``max_target_frames`` of the target,
+        see ``/targets``. The target is ``completed`` once it has
+        ``max_target_frames``, or every stream is completed. These are
+        always current.
+    :status 200: OK
+    :status 400: Bad request
+    :status 403: The target belongs to another namespace
+*/
+func (app *Application) TargetStatsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		targetId := mux.Vars(r)["target_id"]
+		if err := app.checkTarget(targetId, user); err != nil {
+			return err
+		}
+		stats, err := app.TargetStats(targetId)
+		if err != nil {
+			return err
+		}
+		active, inactive, disabled := app.Manager.TargetStreams(targetId)
+		streams := len(active) + len(inactive) + len(disabled)
+		stats.StreamFrames, stats.CompletedStreams = app.targetProgress(targetId)
+		if options, err := app.targetOptions(targetId); err == nil {
+			max := optionInt(options, "max_target_frames", 0)
+			stats.Completed = max > 0 && stats.StreamFrames >= max
+		}
+		if streams > 0 && stats.CompletedStreams == streams {
+			stats.Completed = true
+		}
+		data, err := json.Marshal(stats)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+// Indexes of the collections of the stats DB: by stream for /streams/history,
+// and by donor, newest first, for /donors/:user/sessions.
+var STATS_INDEXES = []string{"stream", "user,-end_time,-_id"}
+
+// An activation of a stream, as recorded in the stats DB when the stream was
+// deactivated. The session produced partitions (StartFrames, EndFrames].
+type Session struct {
+	User        string  `json:"user" bson:"user"`
+	Engine      string  `json:"engine" bson:"engine"`
+	Device      string  `json:"device" bson:"device"` // DEVICE_GPU or DEVICE_CPU, see engineDevice
+	StartTime   int     `json:"start_time" bson:"start_time"`
+	EndTime     int     `json:"end_time" bson:"end_time"`
+	Seconds     int     `json:"seconds" bson:"seconds"` // wall-clock time of the session
+	Frames      float64 `json:"frames" bson:"frames"`
+	StartFrames int     `json:"start_frames" bson:"start_frames"`
+	EndFrames   int     `json:"end_frames" bson:"end_frames"`
+	Error       bool    `json:"error" bson:"error"`
+
+	Id       bson.ObjectId `json:"-" bson:"_id,omitempty"`       // orders the sessions ending at the same time, see SessionCursor
+	TargetId string        `json:"target_id,omitempty" bson:"-"` // filled in by DonorSessionsHandler
+}
+
+// Fill in the seconds and device of sessions recorded before they were.
+func (s *Session) complete() {
+	if s.Seconds == 0 {
+		s.Seconds = s.EndTime - s.StartTime
+	}
+	if s.Device == "" {
+		s.Device = engineDevice(s.Engine)
+	}
+}
+
+/*
+.. http:get:: /streams/history/:stream_id
+    The activation sessions of a stream, oldest first. Sessions that
+    produced no frames and ended without an error are not recorded.
+    Sessions appear shortly after the stream is deactivated.
+    :reqheader Authorization: Manager's authorization token
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "sessions": [
+                {
+                    "user": "jesse_v",
+                    "engine": "openmm",
+                    "device": "gpu",
+                    "start_time": 1404502030,
+                    "end_time": 1404505630,
+                    "seconds": 3600,
+                    "frames": 10.5, // frames done, including partial ones
+                    "start_frames": 0,
+                    "end_frames": 10, // partitions (start_frames, end_frames]
+                    "error": false
+                }
+            ]
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) StreamHistoryHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		var targetId string
+		e := app.Manager.ReadStream(streamId, func(stream *Stream) error {
+			if app.canManage(user, stream) == false {
+				return ErrForbidden.With("You do not own this stream.")
+			}
+			targetId = stream.TargetId
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+		sessions, err := app.Database.StreamSessions(targetId, streamId)
+		if err != nil {
+			return err
+		}
+		for i := range sessions {
+			sessions[i].complete()
+		}
+		data, err := json.Marshal(map[string]interface{}{"sessions": sessions})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
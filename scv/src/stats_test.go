@@ -0,0 +1,26 @@
+package scv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultCache(t *testing.T) {
+	cache := NewResultCache(50 * time.Millisecond)
+	_, ok := cache.Get("a")
+	assert.False(t, ok)
+	cache.Put("a", 5)
+	value, ok := cache.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, value, 5)
+	time.Sleep(60 * time.Millisecond)
+	_, ok = cache.Get("a")
+	assert.False(t, ok)
+	value, ok = cache.GetStale("a")
+	assert.True(t, ok)
+	assert.Equal(t, value, 5)
+	_, ok = cache.GetStale("b")
+	assert.False(t, ok)
+}
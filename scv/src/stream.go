@@ -1,56 +1,81 @@
 package scv
 
 import (
-	"sync"
-	"time"
+	"../manager"
 )
 
-// Cached object persisted in Mongo
-type Stream struct {
-	sync.RWMutex `json:"-" bson:"-"`
-	Owner        string `json:"-" bson:"-"`                 // constant (safe to read without mutex)
-	StreamId     string `json:"-" bson:"_id"`               // constant
-	TargetId     string `json:"target_id" bson:"target_id"` // constant
-	Frames       int    `json:"frames" bson:"frames"`
-	ErrorCount   int    `json:"error_count" bson:"error_count"`
-	CreationDate int    `json:"creation_date" bson:"creation_date"`
-
-	MongoStatus string `json:"status" bson:"status"` // this value is used only for persistence purposes.
-
-	activeStream *ActiveStream
-}
-
-func NewStream(streamId, targetId, owner string,
-	frames, errorCount, creationDate int) *Stream {
-	stream := &Stream{
-		StreamId:     streamId,
-		TargetId:     targetId,
-		Frames:       frames,
-		ErrorCount:   errorCount,
-		CreationDate: creationDate,
-		Owner:        owner,
-		MongoStatus:  "enabled", // by default is enabled because we can't
-	}
+// The streams of the SCV are scheduled by a manager.Manager, see package
+// manager. The SCV keeps its own state of each stream in a streamState, and of
+// each session in a sessionState.
+type Stream = manager.Stream
+type ActiveStream = manager.ActiveStream
+
+// The state the SCV keeps along with a stream, in its Data.
+type streamState struct {
+	hydrated   bool // false until the data on disk of a lazily loaded stream was checked
+	partial    bool // set until the Meta and Options of a lazily loaded stream are read, see loadStreamFields
+	index      partitionIndex
+	generation int // incremented whenever files of the stream are removed or replaced, see filesChanged
+
+	// Unix times the notices of upcoming lifecycle actions were sent, by
+	// action, see dueLifecycleActions.
+	lifecycleNotices map[string]int
+}
+
+// Returns the state the SCV keeps along with s, see newStream.
+func streamData(s *Stream) *streamState {
+	return s.Data.(*streamState)
+}
+
+/*
+Record that files of the stream were removed or replaced. Handlers that release
+the stream's lock while they read its files compare the generation from before
+and after reading, so that they do not serve files that changed meanwhile. The
+stream must be locked for writing.
+*/
+func (st *streamState) filesChanged() {
+	st.generation++
+}
+
+// Returns a stream created by the SCV, whose data on disk needs no checking.
+func newStream(streamId, targetId, owner string, frames, errorCount, creationDate int) *Stream {
+	stream := manager.NewStream(streamId, targetId, owner, frames, errorCount, creationDate)
+	stream.Data = &streamState{hydrated: true}
 	return stream
 }
 
-type ActiveStream struct {
-	donorFrames  float64 // number of frames done by this donor (including partial frames)
-	bufferFrames int     // number of frames stored in the buffer
-	authToken    string  // token of the ActiveStream
-	user         string  // donor id
-	startTime    int     // time the stream was activated
-	frameHash    string  // md5 hash of the last frame
-	engine       string  // core engine type the stream is assigned to
-	timer        *time.Timer
+// The state the SCV keeps along with a session, in the Data of the stream's
+// ActiveStream.
+type sessionState struct {
+	frameHash  string // md5 hash of the last frame
+	validation ValidationState
+	xtcFrames  int            // XTC frames in the buffer, if the target verifies frames
+	xtcSteps   map[string]int // last step of each XTC file of the session, see verifyFrames
+	writer     *frameWriter   // appends frames to the buffer, created with the first frame
+
+	requests map[string]string // ids of the requests that activated, failed and stopped the session, see recordFailure
+}
+
+func newSessionState() *sessionState {
+	return &sessionState{
+		validation: make(ValidationState),
+		requests:   make(map[string]string),
+	}
+}
+
+// Returns the state the SCV keeps along with the session of s, which must be
+// active, see activateStream.
+func sessionData(s *Stream) *sessionState {
+	return s.ActiveStream.Data.(*sessionState)
 }
 
-func NewActiveStream(user, token, engine string) *ActiveStream {
-	as := &ActiveStream{
-		user:      user,
-		engine:    engine,
-		authToken: token,
-		startTime: int(time.Now().Unix()),
+// Record the XTC frames of a frame added to the buffer.
+func (ss *sessionState) addFrameCount(count frameCount) {
+	ss.xtcFrames += count.frames
+	for name, step := range count.steps {
+		if ss.xtcSteps == nil {
+			ss.xtcSteps = make(map[string]int)
+		}
+		ss.xtcSteps[name] = step
 	}
-	return as
 }
@@ -0,0 +1,141 @@
+package scv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Kinds of failures reported to /core/stop.
+const (
+	ERROR_CORE       string = "core"       // the core or the donor's machine failed
+	ERROR_SIMULATION string = "simulation" // the simulation blew up, eg. NaN coordinates
+	ERROR_ABORTED    string = "aborted"    // the donor stopped the core
+)
+
+/*
+Errors added to a stream's error_count for each kind of failure. Restarting
+from the same checkpoint usually blows up the same way, so simulation failures
+disable a stream twice as fast as core faults. Aborts are not the stream's
+fault and are not counted.
+*/
+var ERROR_WEIGHTS = map[string]int{
+	ERROR_CORE:       1,
+	ERROR_SIMULATION: 2,
+	ERROR_ABORTED:    0,
+}
+
+// Messages of failures reported without a kind that are simulation failures.
+var simulationFailure = regexp.MustCompile(`(?i)\bnan\b|not a number|energy is infinite|particle coordinate`)
+
+// A failure reported by a core, as recorded in the errors DB, which holds a
+// collection of errors per target.
+type StreamError struct {
+	Time    int    `json:"time" bson:"time"`
+	User    string `json:"user" bson:"user"`
+	Engine  string `json:"engine" bson:"engine"`
+	Kind    string `json:"kind" bson:"kind"`
+	Message string `json:"message" bson:"message"`
+	Frames  int    `json:"frames" bson:"frames"` // frames of the stream when it failed
+}
+
+// Returns the kind of a failure reported to /core/stop. Failures reported
+// without a kind are classified from their message, as core faults unless the
+// message looks like a simulation failure.
+func classifyError(kind, message string) (string, error) {
+	if kind != "" {
+		if _, ok := ERROR_WEIGHTS[kind]; ok == false {
+			return "", errors.New("Unknown error kind: " + kind)
+		}
+		return kind, nil
+	}
+	if simulationFailure.MatchString(message) {
+		return ERROR_SIMULATION, nil
+	}
+	return ERROR_CORE, nil
+}
+
+// Decode the b64 error message of /core/stop. Messages that are not valid
+// base64, as sent by old cores, are kept as is.
+func decodeErrorMessage(encoded string) string {
+	if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+		return string(decoded)
+	}
+	return encoded
+}
+
+// Record the failure of the core of an active stream. The stream must be
+// locked.
+func (app *Application) recordStreamError(s *Stream, kind, message string) {
+	app.deferInsert("errors", s.TargetId, []string{"stream"}, bson.M{
+		"stream":  s.StreamId,
+		"time":    int(time.Now().Unix()),
+		"user":    s.ActiveStream.User,
+		"engine":  s.ActiveStream.Engine,
+		"kind":    kind,
+		"message": message,
+		"frames":  s.Frames,
+	})
+}
+
+/*
+.. http:get:: /streams/errors/:stream_id
+    The failures reported by the cores of a stream, oldest first. Errors
+    appear shortly after they are reported.
+    :reqheader Authorization: Manager's authorization token
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "errors": [
+                {
+                    "time": 1404505630,
+                    "user": "jesse_v",
+                    "engine": "openmm",
+                    "kind": "simulation", // core, simulation or aborted
+                    "message": "Particle coordinate is nan",
+                    "frames": 120
+                }
+            ]
+        }
+    :status 200: OK
+    :status 400: Bad request
+    :status 401: Not authenticated
+    :status 403: You do not own this stream
+    :status 404: Stream not found
+*/
+func (app *Application) StreamErrorsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		var targetId string
+		e := app.Manager.ReadStream(streamId, func(stream *Stream) error {
+			if app.canManage(user, stream) == false {
+				return ErrForbidden.With("You do not own this stream.")
+			}
+			targetId = stream.TargetId
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+		streamErrors, err := app.Database.StreamErrors(targetId, streamId)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(map[string]interface{}{"errors": streamErrors})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,24 @@
+package scv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyError(t *testing.T) {
+	kind, err := classifyError("", "Particle coordinate is nan")
+	assert.Nil(t, err)
+	assert.Equal(t, kind, ERROR_SIMULATION)
+	kind, _ = classifyError("", "Energy is NaN at step 5000")
+	assert.Equal(t, kind, ERROR_SIMULATION)
+	kind, _ = classifyError("", "CUDA_ERROR_LAUNCH_FAILED, financial report attached")
+	assert.Equal(t, kind, ERROR_CORE)
+	kind, _ = classifyError(ERROR_ABORTED, "Particle coordinate is nan")
+	assert.Equal(t, kind, ERROR_ABORTED)
+	_, err = classifyError("bogus", "")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, decodeErrorMessage("ZXJyb3I="), "error")
+	assert.Equal(t, decodeErrorMessage("some_error"), "some_error")
+}
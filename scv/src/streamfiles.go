@@ -0,0 +1,108 @@
+package scv
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Default number of files of new streams written at once, over all requests.
+const WRITE_WORKERS int = 8
+
+type streamFile struct {
+	path string
+	data []byte
+}
+
+/*
+Write the files of a new stream, keyed by the directory of the stream they go
+to, and return the number of bytes written. Files are written by a pool of
+goroutines, each holding one of the WriteWorkers slots of the SCV while it
+writes, so that large creations keep the disk busy without concurrent ones
+flooding it. Every file is flushed to disk and renamed into place, and the
+directories are synced once written, so that a crash cannot leave a truncated
+file behind. If any write fails or ctx is cancelled, the directory of the
+stream is removed.
+*/
+func (app *Application) writeStreamFiles(ctx context.Context, streamId string, dirs map[string]map[string]string) (size int64, err error) {
+	streamDir := app.StreamDir(streamId)
+	defer func() {
+		if err != nil {
+			os.RemoveAll(streamDir)
+		}
+	}()
+	if err := os.MkdirAll(streamDir, 0776); err != nil {
+		return 0, err
+	}
+	todo := make([]streamFile, 0)
+	synced := []string{filepath.Dir(streamDir), streamDir}
+	for dir, files := range dirs {
+		if len(files) == 0 {
+			continue
+		}
+		path := filepath.Join(streamDir, dir)
+		if err := os.MkdirAll(path, 0776); err != nil {
+			return 0, err
+		}
+		synced = append(synced, path)
+		for name, data := range files {
+			todo = append(todo, streamFile{filepath.Join(path, name), []byte(data)})
+			size += int64(len(data))
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan streamFile)
+	var failed error
+	var failedMutex sync.Mutex
+	var wg sync.WaitGroup
+	workers := writeWorkers(app.Config.WriteWorkers)
+	if workers > len(todo) {
+		workers = len(todo)
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				select {
+				case app.writeSlots <- struct{}{}:
+				case <-ctx.Done():
+					continue
+				}
+				e := writeFileSynced(file.path, file.data, 0776)
+				<-app.writeSlots
+				if e != nil {
+					failedMutex.Lock()
+					if failed == nil {
+						failed = e
+					}
+					failedMutex.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+	for _, file := range todo {
+		select {
+		case jobs <- file:
+		case <-ctx.Done():
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if failed != nil {
+		return 0, failed
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	// the files and the stream's directory only persist once their parents are synced
+	for i := len(synced) - 1; i >= 0; i-- {
+		if err := syncDir(synced[i]); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
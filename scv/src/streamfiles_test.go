@@ -0,0 +1,52 @@
+package scv
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteStreamFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "streamfiles")
+	defer os.RemoveAll(dir)
+	app := &Application{
+		Config:     Configuration{Name: filepath.Join(dir, "scv"), WriteWorkers: 2},
+		writeSlots: make(chan struct{}, 2),
+	}
+	files := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		files["file"+strconv.Itoa(i)] = "content" + strconv.Itoa(i)
+	}
+	todo := map[string]map[string]string{"files": files, "tags": {"pdb.gz.b64": "pdb"}}
+	size, err := app.writeStreamFiles(context.Background(), "s1", todo)
+	assert.Nil(t, err)
+	assert.Equal(t, size, int64(len("pdb")+10*len("content0")+10*len("content10")))
+	written, _ := ioutil.ReadDir(filepath.Join(app.StreamDir("s1"), "files"))
+	assert.Equal(t, len(written), 20)
+	data, _ := ioutil.ReadFile(filepath.Join(app.StreamDir("s1"), "files", "file7"))
+	assert.Equal(t, string(data), "content7")
+	data, _ = ioutil.ReadFile(filepath.Join(app.StreamDir("s1"), "tags", "pdb.gz.b64"))
+	assert.Equal(t, string(data), "pdb")
+	assert.Equal(t, len(app.writeSlots), 0)
+
+	// a failed write removes every file of the stream
+	os.MkdirAll(filepath.Join(app.StreamDir("s2"), "files", "file3", "taken"), 0776)
+	_, err = app.writeStreamFiles(context.Background(), "s2", todo)
+	assert.NotNil(t, err)
+	exists, _ := pathExists(app.StreamDir("s2"))
+	assert.False(t, exists)
+	assert.Equal(t, len(app.writeSlots), 0)
+
+	// so does a cancelled request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = app.writeStreamFiles(ctx, "s3", todo)
+	assert.Equal(t, err, context.Canceled)
+	exists, _ = pathExists(app.StreamDir("s3"))
+	assert.False(t, exists)
+}
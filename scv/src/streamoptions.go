@@ -0,0 +1,125 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Check the options a stream overrides its target's with. Keys set to nil are
+// only allowed in patches, where they remove the override.
+func checkStreamOptions(options map[string]interface{}, patch bool) error {
+	for key, value := range options {
+		if validMetaKey(key) == false {
+			return errors.New("Bad request: bad option key " + key)
+		}
+		if value == nil && patch == false {
+			return errors.New("Bad request: option " + key + " is null")
+		}
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	if len(data) > MAX_META_BYTES {
+		return ErrTooLarge.With("Options may not exceed 16384 bytes")
+	}
+	return nil
+}
+
+// Returns the options of a target merged with those overridden by one of its
+// streams. The options of the target are left untouched.
+func mergeOptions(target, stream map[string]interface{}) map[string]interface{} {
+	if len(stream) == 0 {
+		return target
+	}
+	return mergeMeta(target, stream)
+}
+
+/*
+.. http:patch:: /streams/options/:stream_id
+    Override options of the stream's target for this stream only, eg. a
+    smaller ``steps_per_frame`` for streams near a transition state. The
+    options are merged over the target's in the reply of ``/core/start``,
+    so they apply from the next activation of the stream. Keys set to
+    null are removed, and keys that are not mentioned are left
+    untouched. Keys may not contain dots or start with ``$``.
+    :reqheader Authorization: Manager's authorization token
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "steps_per_frame": 5000,
+            "title": null // the target's title is used again
+        }
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "steps_per_frame": 5000
+        }
+    .. note:: The overrides are also returned in ``options`` by
+        ``/streams/info``, and can be set when the stream is created.
+    :status 200: OK
+    :status 400: Bad request
+    :status 403: The stream belongs to another namespace
+    :status 413: The options exceed 16384 bytes
+*/
+func (app *Application) StreamOptionsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		streamId := mux.Vars(r)["stream_id"]
+		patch := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			return errors.New("Could not decode JSON")
+		}
+		if err := checkStreamOptions(patch, true); err != nil {
+			return err
+		}
+		set := bson.M{}
+		unset := bson.M{}
+		for key, value := range patch {
+			if value == nil {
+				unset["options."+key] = ""
+			} else {
+				set["options."+key] = value
+			}
+		}
+		var data []byte
+		e := app.Manager.ModifyStream(streamId, func(stream *Stream) error {
+			if app.canManage(user, stream) == false {
+				return ErrForbidden.With("You do not own this stream.")
+			}
+			if err := app.loadStreamFields(stream); err != nil {
+				return err
+			}
+			options := mergeMeta(stream.Options, patch)
+			if err := checkStreamOptions(options, false); err != nil {
+				return err
+			}
+			var err error
+			if data, err = json.Marshal(options); err != nil {
+				return err
+			}
+			if len(set) > 0 || len(unset) > 0 {
+				if err := app.Database.UpdateStream(streamId, set, unset); err != nil {
+					return err
+				}
+			}
+			if len(options) == 0 {
+				options = nil
+			}
+			stream.Options = options
+			return nil
+		})
+		if e != nil {
+			return e
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,26 @@
+package scv
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamOptionsChecks(t *testing.T) {
+	assert.Nil(t, checkStreamOptions(nil, false))
+	assert.Nil(t, checkStreamOptions(map[string]interface{}{"steps_per_frame": 5000}, false))
+	assert.NotNil(t, checkStreamOptions(map[string]interface{}{"$set": 1}, false))
+	assert.NotNil(t, checkStreamOptions(map[string]interface{}{"title": nil}, false))
+	assert.Nil(t, checkStreamOptions(map[string]interface{}{"title": nil}, true))
+	assert.NotNil(t, checkStreamOptions(map[string]interface{}{"title": strings.Repeat("x", MAX_META_BYTES)}, false))
+
+	target := map[string]interface{}{"steps_per_frame": 50000.0, "timestep_fs": 2.0}
+	assert.Equal(t, mergeOptions(target, nil), target)
+	merged := mergeOptions(target, map[string]interface{}{"steps_per_frame": 5000.0})
+	assert.Equal(t, nsPerFrame(merged), 0.01)
+	assert.Equal(t, nsPerFrame(map[string]interface{}{"ns_per_frame": 0.1}), 0.1)
+	assert.Equal(t, nsPerFrame(map[string]interface{}{"steps_per_frame": 50000.0, "timestep_fs": 2.0}), 0.1)
+	assert.Equal(t, nsPerFrame(map[string]interface{}{"steps_per_frame": 50000.0}), 0.0)
+	assert.Equal(t, target["steps_per_frame"], 50000.0)
+}
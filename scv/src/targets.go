@@ -0,0 +1,449 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var TARGET_STAGES = map[string]bool{"disabled": true, "private": true, "public": true}
+
+// Default aging rate of a target's streams, in frames of priority gained per
+// hour since their last activation, see Manager.SetAgingRate.
+const AGING_RATE float64 = 1
+
+// Fields of a target document in data.targets that can be set by its owner.
+// The document has the same layout as the one written by the CC.
+type targetUpdate struct {
+	Engines  []string               `json:"engines"`
+	Stage    *string                `json:"stage"`
+	Weight   *float64               `json:"weight"`   // weight of the target relative to others
+	Priority *int                   `json:"priority"` // streams of higher priority targets are assigned first
+	Options  map[string]interface{} `json:"options"`  // eg. title, description and steps_per_frame
+}
+
+func (u *targetUpdate) validate() error {
+	if u.Engines != nil && len(u.Engines) == 0 {
+		return errors.New("engines must not be empty")
+	}
+	if u.Stage != nil && TARGET_STAGES[*u.Stage] == false {
+		return errors.New("unsupported stage: " + *u.Stage)
+	}
+	if u.Weight != nil && *u.Weight < 0 {
+		return errors.New("weight must not be negative")
+	}
+	if u.Priority != nil && *u.Priority < 0 {
+		return errors.New("priority must not be negative")
+	}
+	for _, key := range []string{"title", "description"} {
+		if value, ok := u.Options[key]; ok && value != nil {
+			if _, ok := value.(string); ok == false {
+				return errors.New(key + " must be a string")
+			}
+		}
+	}
+	if value, ok := u.Options["steps_per_frame"]; ok && value != nil {
+		valid := false
+		switch steps := value.(type) {
+		case float64:
+			valid = steps > 0 && steps == float64(int64(steps))
+		case int:
+			valid = steps > 0
+		case int64:
+			valid = steps > 0
+		}
+		if valid == false {
+			return errors.New("steps_per_frame must be a positive integer")
+		}
+	}
+	for _, key := range []string{"paused", "benchmark"} {
+		if value, ok := u.Options[key]; ok && value != nil {
+			if _, ok := value.(bool); ok == false {
+				return errors.New(key + " must be a boolean")
+			}
+		}
+	}
+	for _, key := range []string{"max_active_streams", "max_frames", "max_target_frames"} {
+		if value, ok := u.Options[key]; ok && value != nil {
+			if limit, ok := value.(float64); ok == false || limit < 0 || limit != float64(int64(limit)) {
+				return errors.New(key + " must be a non-negative integer")
+			}
+		}
+	}
+	if value, ok := u.Options["milestones"]; ok && value != nil {
+		values, ok := value.([]interface{})
+		if ok == false {
+			return errors.New("milestones must be a list of positive integers")
+		}
+		for _, value := range values {
+			if frames, ok := value.(float64); ok == false || frames <= 0 || frames != float64(int64(frames)) {
+				return errors.New("milestones must be a list of positive integers")
+			}
+		}
+	}
+	if value, ok := u.Options["aging_rate"]; ok && value != nil {
+		if rate, ok := value.(float64); ok == false || rate < 0 {
+			return errors.New("aging_rate must be a non-negative number")
+		}
+	}
+	if _, _, err := newValidators(u.Options); err != nil {
+		return errors.New("Bad validators: " + err.Error())
+	}
+	if _, _, err := newLifecyclePolicy(u.Options); err != nil {
+		return errors.New("Bad stream_lifecycle: " + err.Error())
+	}
+	return nil
+}
+
+/*
+Pass the options of a target that the Manager needs, the aging rate, whether
+the target is paused and its max_active_streams, on to it. Targets without a document in data.targets use
+the default aging rate. If the options cannot be read, the target stays paused
+or not.
+*/
+func (app *Application) applyTargetOptions(targetId string) {
+	options, err := app.targetOptions(targetId)
+	if err != nil {
+		app.Manager.SetAgingRate(targetId, AGING_RATE)
+		return
+	}
+	rate := optionFloat(options, "aging_rate", AGING_RATE)
+	if rate < 0 {
+		rate = AGING_RATE
+	}
+	app.Manager.SetAgingRate(targetId, rate)
+	app.Manager.SetPaused(targetId, optionBool(options, "paused", false))
+	app.Manager.SetMaxActive(targetId, optionInt(options, "max_active_streams", 0))
+}
+
+// Forget the cached options and validators of a target.
+func (app *Application) invalidateTarget(targetId string) {
+	app.optionsCache.Delete("options:" + targetId)
+	app.optionsCache.Delete("validators:" + targetId)
+}
+
+/*
+.. http:post:: /targets
+    Add a new target, so that an SCV can be used without a CC.
+    :reqheader Authorization: Manager's authorization token
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "engines": ["openmm_60_opencl", "openmm_60_cpu"],
+            "stage": "private", // optional: disabled, private or public
+            "weight": 1, // optional
+            "priority": 0, // optional
+            "options": { // optional
+                "title": "Dihydrofolate reductase",
+                "description": "project description",
+                "steps_per_frame": 50000,
+                "min_engine_version": "6.1", // optional, older cores are refused
+                "aging_rate": 1, // optional, see below
+                "max_active_streams": 100, // optional, 0 for no limit
+                "max_frames": 5000, // optional, 0 for no limit
+                "max_target_frames": 100000, // optional, 0 for no limit
+                "milestones": [1000, 2500], // optional
+                "benchmark": false, // optional, see /benchmarks
+                "public_data": false, // optional, see below
+                "stream_lifecycle": { // optional, see below
+                    "disable_idle_days": 30,
+                    "archive_age_days": 180,
+                    "delete_idle_days": 365,
+                    "notice_days": 3
+                }
+            }
+        }
+    .. note:: Inactive streams with more frames are activated first, but
+        a stream gains ``aging_rate`` frames of priority per hour since
+        it was last activated, so that every stream is eventually
+        simulated. Set it to 0 to always activate the streams with the
+        most frames first.
+    .. note:: Once ``max_active_streams`` streams of the target are active
+        on an SCV, activations of the target fail with a 429 until one is
+        deactivated.
+    .. note:: Streams that reach ``max_frames`` frames are completed:
+        a ``completed`` event is sent on ``/events`` and the stream is
+        disabled. Once the streams of the target on an SCV have
+        ``max_target_frames`` frames together, all of them are. Streams
+        send a ``milestone`` event when they reach each of the
+        ``milestones``, in frames.
+    .. note:: ``stream_lifecycle`` ages out the streams of the target on
+        every SCV: streams idle for ``disable_idle_days`` are disabled and
+        those idle for ``delete_idle_days`` deleted, as by
+        ``/streams/delete``, while the partitions of streams created
+        ``archive_age_days`` ago are archived. A ``notice`` event is sent
+        on ``/events`` ``notice_days`` before each action.
+    .. note:: With ``public_data``, anyone may read the streams of the
+        target with ``/streams/sync`` and ``/streams/download`` without
+        authorization, except for their logs and recovered frames. Every
+        other route still requires a manager of the target.
+    .. note:: The target belongs to the namespace of the manager, set by
+        the ``namespace`` field of its document in users.managers. Every
+        manager of the namespace can manage the target and its streams,
+        while managers of other namespaces cannot even list them.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "target_id": "uuid4"
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) PostTargetHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		msg := targetUpdate{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return errors.New("Could not decode JSON")
+		}
+		if msg.Engines == nil {
+			return errors.New("Missing engines")
+		}
+		if err := msg.validate(); err != nil {
+			return err
+		}
+		doc := bson.M{
+			"_id":           RandSeq(36),
+			"creation_date": int(time.Now().Unix()),
+			"engines":       msg.Engines,
+			"owner":         user,
+			"stage":         "private",
+			"weight":        1.0,
+			"priority":      0,
+			"options":       bson.M{},
+		}
+		if msg.Stage != nil {
+			doc["stage"] = *msg.Stage
+		}
+		if msg.Weight != nil {
+			doc["weight"] = *msg.Weight
+		}
+		if msg.Priority != nil {
+			doc["priority"] = *msg.Priority
+		}
+		if msg.Options != nil {
+			options := bson.M{}
+			for key, value := range msg.Options {
+				if validMetaKey(key) == false {
+					return errors.New("Bad option: " + key)
+				}
+				if value != nil {
+					options[key] = value
+				}
+			}
+			doc["options"] = options
+		}
+		if err := app.Database.InsertTarget(doc); err != nil {
+			return err
+		}
+		data, err := json.Marshal(map[string]interface{}{"target_id": doc["_id"]})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:put:: /targets/:target_id/options
+    Update a target. Only the fields given are updated. Fields inside
+    ``options`` are updated individually, and are deleted if set to null.
+    :reqheader Authorization: Manager's authorization token
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "engines": ["openmm_60_opencl"], // optional
+            "stage": "public", // optional
+            "weight": 2, // optional
+            "priority": 1, // optional
+            "options": { // optional
+                "steps_per_frame": 25000,
+                "description": null // deleted
+            }
+        }
+    .. note:: Changes may take up to 30 seconds to be seen by cores.
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) TargetOptionsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		targetId := mux.Vars(r)["target_id"]
+		msg := targetUpdate{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return errors.New("Could not decode JSON")
+		}
+		doc, err := app.Database.Target(targetId)
+		if err != nil {
+			return ErrNotFound.With("target " + targetId + " does not exist")
+		}
+		if app.canManageTarget(user, doc) == false {
+			return ErrForbidden.With("You do not own this target.")
+		}
+		// the validators are checked against the options they will be used with
+		options := make(map[string]interface{})
+		if current, ok := doc["options"].(map[string]interface{}); ok {
+			for key, value := range current {
+				options[key] = value
+			}
+		}
+		for key, value := range msg.Options {
+			options[key] = value
+		}
+		merged := msg
+		merged.Options = options
+		if err := merged.validate(); err != nil {
+			return err
+		}
+		set := bson.M{}
+		unset := bson.M{}
+		if msg.Engines != nil {
+			set["engines"] = msg.Engines
+		}
+		if msg.Stage != nil {
+			set["stage"] = *msg.Stage
+		}
+		if msg.Weight != nil {
+			set["weight"] = *msg.Weight
+		}
+		if msg.Priority != nil {
+			set["priority"] = *msg.Priority
+		}
+		for key, value := range msg.Options {
+			if validMetaKey(key) == false {
+				return errors.New("Bad option: " + key)
+			}
+			if value == nil {
+				unset["options."+key] = ""
+			} else {
+				set["options."+key] = value
+			}
+		}
+		if len(set) == 0 && len(unset) == 0 {
+			return nil
+		}
+		if err := app.Database.UpdateTarget(targetId, set, unset); err != nil {
+			return err
+		}
+		app.invalidateTarget(targetId)
+		app.applyTargetOptions(targetId)
+		return nil
+	}
+}
+
+/*
+.. http:put:: /targets/:target_id/pause
+    Pause a target: its streams are no longer activated, but its active
+    streams keep running until their cores stop them, so that donors
+    are not cut off mid-session and the streams end on a clean
+    checkpoint. The reply tells how many streams of the target are still
+    active on this SCV. The target's ``paused`` option is set to true.
+    :reqheader Authorization: Manager's authorization token
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "paused": true,
+            "active_streams": 3
+        }
+    .. note:: Other SCVs stop activating the target's streams within 30
+        seconds. Activations of a paused target fail with a 503.
+    :status 200: OK
+    :status 400: Bad request
+    :status 401: Not authenticated
+    :status 403: You do not own this target
+    :status 404: Target not found
+
+.. http:put:: /targets/:target_id/resume
+    Resume a paused target, so that its streams are activated again. The
+    reply is the same as for pause.
+    :reqheader Authorization: Manager's authorization token
+    :status 200: OK
+    :status 400: Bad request
+    :status 401: Not authenticated
+    :status 403: You do not own this target
+    :status 404: Target not found
+*/
+func (app *Application) TargetPauseHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		targetId := mux.Vars(r)["target_id"]
+		doc, err := app.Database.Target(targetId)
+		if err != nil {
+			return ErrNotFound.With("target " + targetId + " does not exist")
+		}
+		if app.canManageTarget(user, doc) == false {
+			return ErrForbidden.With("You do not own this target.")
+		}
+		paused := strings.HasSuffix(r.URL.Path, "/pause")
+		if paused {
+			err = app.Database.UpdateTarget(targetId, bson.M{"options.paused": true}, nil)
+		} else {
+			err = app.Database.UpdateTarget(targetId, nil, bson.M{"options.paused": ""})
+		}
+		if err != nil {
+			return err
+		}
+		app.invalidateTarget(targetId)
+		active := app.Manager.SetPaused(targetId, paused)
+		data, err := json.Marshal(TargetPauseReply{paused, active})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:get:: /targets/:target_id/streams
+    List the streams of a target loaded by this SCV, by state.
+    Quarantined streams are listed as disabled.
+    :reqheader Authorization: Manager's authorization token
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "active": ["stream_id_1"],
+            "inactive": ["stream_id_3", "stream_id_2"], // next activated first
+            "disabled": [],
+            "paused": false // see /targets/:target_id/pause
+        }
+    :status 200: OK
+    :status 400: Bad request
+    :status 403: The target belongs to another namespace
+*/
+func (app *Application) TargetStreamsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		targetId := mux.Vars(r)["target_id"]
+		if err := app.checkTarget(targetId, user); err != nil {
+			return err
+		}
+		reply := TargetStreamsReply{}
+		reply.Active, reply.Inactive, reply.Disabled = app.Manager.TargetStreams(targetId)
+		reply.Paused = app.Manager.Paused(targetId)
+		data, err := json.Marshal(reply)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
@@ -0,0 +1,80 @@
+package scv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTargetUpdateValidate(t *testing.T) {
+	valid := []string{
+		`{"engines": ["openmm"]}`,
+		`{"stage": "public", "weight": 0, "priority": 2}`,
+		`{"options": {"title": "DHFR", "steps_per_frame": 50000, "description": null}}`,
+		`{"options": {"validators": [{"type": "xtc"}]}}`,
+		`{"options": {"aging_rate": 0.5}}`,
+		`{"options": {"max_active_streams": 10}}`,
+	}
+	invalid := []string{
+		`{"engines": []}`,
+		`{"stage": "beta"}`,
+		`{"weight": -1}`,
+		`{"priority": -1}`,
+		`{"options": {"title": 5}}`,
+		`{"options": {"steps_per_frame": 0}}`,
+		`{"options": {"steps_per_frame": 2.5}}`,
+		`{"options": {"aging_rate": -1}}`,
+		`{"options": {"max_active_streams": 1.5}}`,
+		`{"options": {"aging_rate": "fast"}}`,
+		`{"options": {"validators": [{"type": "unknown"}]}}`,
+	}
+	for _, body := range valid {
+		u := targetUpdate{}
+		assert.Nil(t, json.Unmarshal([]byte(body), &u))
+		assert.Nil(t, u.validate(), body)
+	}
+	for _, body := range invalid {
+		u := targetUpdate{}
+		assert.Nil(t, json.Unmarshal([]byte(body), &u))
+		assert.NotNil(t, u.validate(), body)
+	}
+	// options read back from Mongo hold ints
+	u := targetUpdate{Options: map[string]interface{}{"steps_per_frame": 50000}}
+	assert.Nil(t, u.validate())
+}
+
+func TestPostTargetOptionKeys(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "targets")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{
+		Config:       Configuration{Name: filepath.Join(dir, "scv")},
+		Database:     db,
+		tokenCache:   NewTokenCache(time.Minute),
+		optionsCache: NewResultCache(time.Minute),
+	}
+	db.InsertToken(APIToken{Id: "full", Token: "full", User: "yutong"})
+	db.upsert("users", "managers", bson.M{"_id": "yutong"})
+	post := func(options string) int {
+		body := `{"engines": ["openmm"], "options": ` + options + `}`
+		req, _ := http.NewRequest("POST", "/targets", strings.NewReader(body))
+		req.Header.Set("Authorization", "full")
+		w := httptest.NewRecorder()
+		app.PostTargetHandler().ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, post(`{"title": "DHFR"}`), 200)
+	assert.Equal(t, post(`{"$where": "1"}`), 400)
+	assert.Equal(t, post(`{"a.b": 1}`), 400)
+}
@@ -0,0 +1,99 @@
+package scv
+
+import (
+	"errors"
+)
+
+/*
+Returns the namespace of a manager, the research group its streams and targets
+are scoped to, as set by the namespace field of its document in
+users.managers. Managers without one are in a namespace of their own. Results
+are cached for TARGET_OPTIONS_TTL seconds, and a manager whose document cannot
+be read is in its own namespace.
+*/
+func (app *Application) namespace(user string) string {
+	if cached, ok := app.optionsCache.Get("namespace:" + user); ok {
+		return cached.(string)
+	}
+	doc, err := app.Database.Manager(user)
+	if err != nil {
+		if stale, ok := app.optionsCache.GetStale("namespace:" + user); ok && isTransient(err) {
+			return stale.(string)
+		}
+		return user
+	}
+	namespace, _ := doc["namespace"].(string)
+	if namespace == "" {
+		namespace = user
+	}
+	app.optionsCache.Put("namespace:"+user, namespace)
+	return namespace
+}
+
+// Returns true if user may manage what owner owns in namespace: user is the
+// owner, or a manager of the namespace. Nothing belongs to the empty
+// namespace.
+func (app *Application) authorized(user, owner, namespace string) bool {
+	return user == owner || (namespace != "" && namespace == app.namespace(user))
+}
+
+// Returns true if user may manage the stream.
+func (app *Application) canManage(user string, s *Stream) bool {
+	return app.authorized(user, s.Owner, s.Namespace)
+}
+
+// Returns true if user may manage the target described by doc, a document of
+// data.targets.
+func (app *Application) canManageTarget(user string, doc map[string]interface{}) bool {
+	owner, _ := doc["owner"].(string)
+	return owner != "" && app.authorized(user, owner, app.namespace(owner))
+}
+
+/*
+Checks that user may see a target. Targets with a document in data.targets
+belong to the namespace of their owner. The others were only ever seen through
+their streams, so they belong to the namespaces of their streams on this SCV,
+and targets without streams are empty to every manager.
+*/
+func (app *Application) checkTarget(targetId, user string) error {
+	doc, err := app.Database.Target(targetId)
+	if err == nil {
+		if app.canManageTarget(user, doc) == false {
+			return ErrForbidden.With("You do not own this target.")
+		}
+		return nil
+	} else if err != ErrNotFound {
+		return err
+	}
+	active, inactive, disabled := app.Manager.TargetStreams(targetId)
+	streamIds := append(append(active, inactive...), disabled...)
+	for _, streamId := range streamIds {
+		allowed := false
+		app.Manager.ReadStream(streamId, func(stream *Stream) error {
+			allowed = app.canManage(user, stream)
+			return nil
+		})
+		if allowed {
+			return nil
+		}
+	}
+	if len(streamIds) > 0 {
+		return ErrForbidden.With("You do not own this target.")
+	}
+	return nil
+}
+
+// Refuse to store more data for a stream once its target exceeds TargetQuota
+// or its namespace NamespaceQuota.
+func (app *Application) checkQuota(s *Stream) error {
+	settings := app.Settings()
+	quota := settings.TargetQuota
+	if quota > 0 && app.usage.Target(s.TargetId) >= quota {
+		return errors.New("Target disk quota exceeded")
+	}
+	quota = settings.NamespaceQuota
+	if quota > 0 && s.Namespace != "" && app.usage.Namespace(s.Namespace) >= quota {
+		return errors.New("Namespace disk quota exceeded")
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package scv
+
+import (
+	"../manager"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaces(t *testing.T) {
+	db := &fakeDatabase{
+		managers: map[string]map[string]interface{}{
+			"yutong":  {"namespace": "pande"},
+			"jesse_v": {"namespace": "pande"},
+			"diwakar": {},
+		},
+		targets: map[string]map[string]interface{}{
+			"t1": {"owner": "yutong"},
+		},
+	}
+	app := &Application{Database: db, optionsCache: NewResultCache(time.Minute), usage: NewDiskUsage()}
+	app.Manager = manager.NewManager(app)
+	assert.Equal(t, app.namespace("jesse_v"), "pande")
+	assert.Equal(t, app.namespace("diwakar"), "diwakar")
+
+	// targets belong to the namespace of their owner
+	assert.Nil(t, app.checkTarget("t1", "yutong"))
+	assert.Nil(t, app.checkTarget("t1", "jesse_v"))
+	assert.NotNil(t, app.checkTarget("t1", "diwakar"))
+
+	// targets without a document belong to the namespaces of their streams
+	stream := newStream("s1", "t2", "diwakar", 0, 0, 0)
+	stream.Namespace = app.namespace("diwakar")
+	assert.Nil(t, app.Manager.AddStream(stream, "t2", true))
+	assert.Nil(t, app.checkTarget("t2", "diwakar"))
+	assert.NotNil(t, app.checkTarget("t2", "yutong"))
+	assert.Nil(t, app.checkTarget("t3", "yutong"))
+	assert.True(t, app.canManage("diwakar", stream))
+	assert.False(t, app.canManage("jesse_v", stream))
+	stream = newStream("s2", "t1", "yutong", 0, 0, 0)
+	stream.Namespace = "pande"
+	assert.True(t, app.canManage("jesse_v", stream))
+
+	// namespace quotas
+	app.Config.NamespaceQuota = 100
+	app.usage.Add("t1", "s2", 60)
+	app.usage.SetNamespace("s2", "pande")
+	assert.Nil(t, app.checkQuota(stream))
+	app.usage.Add("t1", "s2", 40)
+	assert.Equal(t, app.usage.Namespace("pande"), int64(100))
+	assert.NotNil(t, app.checkQuota(stream))
+	app.usage.RemoveStream("s2")
+	assert.Equal(t, app.usage.Namespace("pande"), int64(0))
+	assert.Nil(t, app.checkQuota(stream))
+}
@@ -0,0 +1,114 @@
+package scv
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Seconds over which the ingest rate of the SCV is averaged.
+const INGEST_RATE_WINDOW int = 60
+
+/*
+IngestThrottle limits the bandwidth of frame uploads, so that a core uploading
+at line rate cannot starve the disk of the other active streams. Each active
+stream has its own budget, and all of them share a global one. The limits are
+RateLimits counted in bytes: Rate is in bytes per second, and a frame larger
+than Burst is let through when the bucket is full, after which the stream waits
+until the bucket refilled.
+*/
+type IngestThrottle struct {
+	streams *RateLimiter // keyed by the hash of the core's token
+	global  *RateLimiter // a single bucket
+
+	mu       sync.Mutex
+	received []ingestSecond // bytes let through in each of the last INGEST_RATE_WINDOW seconds
+}
+
+type ingestSecond struct {
+	second int64
+	bytes  int64
+}
+
+func NewIngestThrottle(stream, global RateLimit) *IngestThrottle {
+	return &IngestThrottle{
+		streams:  NewRateLimiter(stream),
+		global:   NewRateLimiter(global),
+		received: make([]ingestSecond, INGEST_RATE_WINDOW),
+	}
+}
+
+func (t *IngestThrottle) SetLimits(stream, global RateLimit) {
+	t.streams.SetLimit(stream)
+	t.global.SetLimit(global)
+}
+
+// Take size bytes from the budgets of the stream of token and of the SCV. If
+// either is exhausted, returns false and how long the core should wait.
+func (t *IngestThrottle) Allow(token string, size int64) (bool, time.Duration) {
+	h := md5.Sum([]byte(token))
+	key := hex.EncodeToString(h[:])
+	if ok, wait := t.streams.AllowN(key, float64(size)); ok == false {
+		return false, wait
+	}
+	if ok, wait := t.global.AllowN("", float64(size)); ok == false {
+		t.streams.Refund(key, float64(size))
+		return false, wait
+	}
+	t.record(time.Now().Unix(), size)
+	return true, 0
+}
+
+func (t *IngestThrottle) record(now, size int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slot := &t.received[now%int64(len(t.received))]
+	if slot.second != now {
+		slot.second, slot.bytes = now, 0
+	}
+	slot.bytes += size
+}
+
+// Returns the bytes of frames let through per second, averaged over the last
+// INGEST_RATE_WINDOW seconds.
+func (t *IngestThrottle) Rate() float64 {
+	return t.rate(time.Now().Unix())
+}
+
+func (t *IngestThrottle) rate(now int64) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var total int64
+	for _, slot := range t.received {
+		if now-slot.second < int64(len(t.received)) {
+			total += slot.bytes
+		}
+	}
+	return float64(total) / float64(len(t.received))
+}
+
+func (t *IngestThrottle) Metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"stream": t.streams.Metrics(),
+		"global": t.global.Metrics(),
+	}
+}
+
+// Returns a 429 with a Retry-After header if a frame of size bytes exceeds the
+// ingest limits. Tokens of no active stream are refused first, so that they
+// cannot drain the budgets of the active ones.
+func (app *Application) throttleFrame(w http.ResponseWriter, token string, size int64) error {
+	if err := app.Manager.CheckActiveToken(token); err != nil {
+		return err
+	}
+	ok, wait := app.ingest.Allow(token, size)
+	if ok {
+		return nil
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return ErrTooManyRequests.With("Frame uploads are throttled, retry later")
+}
@@ -0,0 +1,85 @@
+package scv
+
+import (
+	"../manager"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngestThrottle(t *testing.T) {
+	throttle := NewIngestThrottle(RateLimit{Rate: 1000, Burst: 2000}, RateLimit{})
+	ok, _ := throttle.Allow("a", 1500)
+	assert.True(t, ok)
+	ok, wait := throttle.Allow("a", 1000)
+	assert.False(t, ok)
+	assert.True(t, wait > 400*time.Millisecond && wait <= 500*time.Millisecond)
+	ok, _ = throttle.Allow("b", 1500)
+	assert.True(t, ok)
+
+	// a frame larger than the burst goes through once, then the stream waits
+	ok, _ = throttle.Allow("c", 5000)
+	assert.True(t, ok)
+	ok, wait = throttle.Allow("c", 1)
+	assert.False(t, ok)
+	assert.True(t, wait > 2900*time.Millisecond)
+
+	// streams share the global budget, a rejected frame costs its stream nothing
+	throttle = NewIngestThrottle(RateLimit{Rate: 1000, Burst: 1000}, RateLimit{Rate: 1000, Burst: 1500})
+	ok, _ = throttle.Allow("a", 1000)
+	assert.True(t, ok)
+	ok, _ = throttle.Allow("b", 1000)
+	assert.False(t, ok)
+	throttle.SetLimits(RateLimit{Rate: 1000, Burst: 1000}, RateLimit{})
+	ok, _ = throttle.Allow("b", 1000)
+	assert.True(t, ok)
+	assert.Equal(t, throttle.Metrics()["global"].(map[string]interface{})["rejected"], int64(1))
+}
+
+func TestIngestRate(t *testing.T) {
+	throttle := NewIngestThrottle(RateLimit{}, RateLimit{})
+	throttle.record(100, 3000)
+	throttle.record(100, 3000)
+	throttle.record(130, 6000)
+	assert.Equal(t, throttle.rate(130), 200.0)
+	// the seconds that left the window no longer count
+	assert.Equal(t, throttle.rate(165), 100.0)
+	throttle.record(190, 600)
+	assert.Equal(t, throttle.rate(190), 10.0)
+}
+
+func TestFrameThrottled(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "throttle")
+	defer os.RemoveAll(dir)
+	app := &Application{
+		Config: Configuration{Name: filepath.Join(dir, "scv")},
+		ingest: NewIngestThrottle(RateLimit{Rate: 10, Burst: 10}, RateLimit{Rate: 10, Burst: 10}),
+	}
+	app.Manager = manager.NewManager(app)
+	app.Manager.AddStream(newStream("s1", "t1", "yutong", 0, 0, 0), "t1", true)
+	token, _, err := app.Manager.ActivateStream("t1", "jesse_v", "openmm", mockFunc)
+	assert.Nil(t, err)
+	post := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", "/core/frame", bytes.NewBufferString(`{"files": {}}`))
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		app.CoreFrameHandler().ServeHTTP(w, req)
+		return w
+	}
+	// unknown tokens are refused without draining the budgets
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, post("core_token").Code, 401)
+	}
+	// let through, then refused for its missing Content-MD5
+	assert.Equal(t, post(token).Code, 400)
+	w := post(token)
+	assert.Equal(t, w.Code, 429)
+	assert.Equal(t, w.Header().Get("Retry-After"), "2")
+}
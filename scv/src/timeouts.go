@@ -0,0 +1,260 @@
+package scv
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Default seconds a handler has to reply, for routes that do not set a
+// Timeout.
+const REQUEST_TIMEOUT int = 30
+
+// Seconds handlers transferring files have to reply, as the read and write
+// timeouts of the Server.
+const LONG_REQUEST_TIMEOUT int = 60
+
+// Seconds /core/heartbeat has to reply, well within STREAM_EXPIRATION_TIME.
+const HEARTBEAT_TIMEOUT int = 5
+
+// Default seconds after which a request is logged as slow.
+const SLOW_REQUEST_TIME int = 5
+
+// Counts the requests that were slow or timed out, keyed by path template.
+type RequestMetrics struct {
+	sync.Mutex
+	slow     map[string]int
+	timedOut map[string]int
+}
+
+func NewRequestMetrics() *RequestMetrics {
+	return &RequestMetrics{
+		slow:     make(map[string]int),
+		timedOut: make(map[string]int),
+	}
+}
+
+func (m *RequestMetrics) record(path string, slow, timedOut bool) {
+	m.Lock()
+	defer m.Unlock()
+	if slow {
+		m.slow[path] += 1
+	}
+	if timedOut {
+		m.timedOut[path] += 1
+	}
+}
+
+func (m *RequestMetrics) Metrics() map[string]interface{} {
+	m.Lock()
+	defer m.Unlock()
+	slow := make(map[string]int)
+	for path, count := range m.slow {
+		slow[path] = count
+	}
+	timedOut := make(map[string]int)
+	for path, count := range m.timedOut {
+		timedOut[path] = count
+	}
+	return map[string]interface{}{"slow": slow, "timed_out": timedOut}
+}
+
+// Returns the timeout of the route with the given path template: the one in
+// the configuration's Timeouts, else the route's, else REQUEST_TIMEOUT. 0 means
+// no limit.
+func (app *Application) routeTimeout(settings Configuration, path string) time.Duration {
+	seconds, ok := settings.Timeouts[path]
+	if ok == false {
+		seconds = app.routeTimeouts[path]
+	}
+	if seconds == 0 {
+		seconds = REQUEST_TIMEOUT
+	} else if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func slowRequestTime(seconds int) time.Duration {
+	if seconds == 0 {
+		seconds = SLOW_REQUEST_TIME
+	} else if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+/*
+Passes the reply of a handler on to the client, unless the handler timed out
+before replying, in which case its reply is dropped. Headers set by the
+handler are only sent with the status.
+*/
+type timeoutWriter struct {
+	w           http.ResponseWriter
+	ctx         context.Context
+	header      http.Header
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(code)
+}
+
+// Assumes that tw is locked.
+func (tw *timeoutWriter) writeHeader(code int) {
+	if tw.wroteHeader == false && tw.ctx.Err() == context.DeadlineExceeded {
+		// too late, TimeoutMiddleware replies
+		tw.timedOut = true
+	}
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	for key, values := range tw.header {
+		tw.w.Header()[key] = values
+	}
+	tw.w.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(data []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(http.StatusOK)
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	return tw.w.Write(data)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if flusher, ok := tw.w.(http.Flusher); ok && tw.timedOut == false {
+		flusher.Flush()
+	}
+}
+
+// Lets http.ResponseController reach the connection, see extendDeadlines.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
+
+// Called once the handler returned. Sends its headers if it did not reply,
+// unless it timed out, in which case false is returned.
+func (tw *timeoutWriter) finish() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wroteHeader {
+		return true
+	}
+	if tw.timedOut || tw.ctx.Err() == context.DeadlineExceeded {
+		tw.timedOut = true
+		return false
+	}
+	for key, values := range tw.header {
+		tw.w.Header()[key] = values
+	}
+	return true
+}
+
+// Claims the reply once the handler timed out. Returns false if the handler
+// already started replying, in which case it has to be waited for.
+func (tw *timeoutWriter) timeout() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wroteHeader {
+		return false
+	}
+	tw.timedOut = true
+	return true
+}
+
+/*
+Middleware giving handlers the timeout of their route, see routeTimeout. The
+request's context is cancelled once the timeout expires, and if the handler
+has not started replying by then, the client gets a 503 right away while the
+handler is left to give up on its own, eg. once a hung database call returns.
+Handlers that already started replying, eg. downloads, are waited for. Requests
+slower than SlowRequestTime are logged, and both are counted in /metrics.
+*/
+func (app *Application) TimeoutMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				path = template
+			}
+		}
+		settings := app.Settings()
+		start := time.Now()
+		timedOut := false
+		if timeout := app.routeTimeout(settings, path); timeout > 0 {
+			timedOut = app.serveWithTimeout(w, r, next, timeout)
+		} else {
+			next.ServeHTTP(w, r)
+		}
+		elapsed := time.Since(start)
+		threshold := slowRequestTime(settings.SlowRequestTime)
+		slow := threshold > 0 && elapsed > threshold
+		if slow {
+			log.Printf("Slow request: %s %s %s %s took %v", r.RemoteAddr, requestId(r), r.Method, r.URL, elapsed)
+		}
+		if slow || timedOut {
+			app.requestMetrics.record(path, slow, timedOut)
+		}
+	})
+}
+
+// Serve a request with a timeout. Returns true if the client got a 503.
+func (app *Application) serveWithTimeout(w http.ResponseWriter, r *http.Request, next http.Handler, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	tw := &timeoutWriter{w: w, ctx: ctx, header: make(http.Header)}
+	done := make(chan struct{})
+	panics := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panics <- p
+			}
+		}()
+		next.ServeHTTP(tw, r.WithContext(ctx))
+		close(done)
+	}()
+	select {
+	case p := <-panics:
+		panic(p)
+	case <-done:
+		if tw.finish() {
+			return false
+		}
+	case <-ctx.Done():
+		if tw.timeout() == false {
+			select {
+			case p := <-panics:
+				panic(p)
+			case <-done:
+			}
+			return false
+		}
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		// the client hung up, nobody reads the reply
+		return false
+	}
+	code := writeError(w, r, ErrTimeout.With("Request timed out after "+timeout.String()))
+	log.Printf("%s %s %s %s %d", r.RemoteAddr, requestId(r), r.Method, r.URL, code)
+	return true
+}
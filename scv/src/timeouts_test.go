@@ -0,0 +1,70 @@
+package scv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	app := &Application{
+		Config: Configuration{
+			Timeouts:        map[string]int{"/slow/{id}": 1, "/stream": 1},
+			SlowRequestTime: -1,
+		},
+		routeTimeouts:  map[string]int{"/events": -1, "/slow/{id}": 60},
+		requestMetrics: NewRequestMetrics(),
+	}
+	router := mux.NewRouter()
+	router.Use(app.TimeoutMiddleware)
+	router.HandleFunc("/fast", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, ok := r.Context().Deadline()
+		assert.True(t, ok)
+		w.Write([]byte("ok"))
+	})
+	router.HandleFunc("/slow/{id}", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		w.Write([]byte("late"))
+	})
+	router.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		<-r.Context().Done()
+	})
+	router.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.Context().Deadline()
+		assert.False(t, ok)
+	})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	w := serve("/fast")
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "ok")
+	assert.Equal(t, w.Header().Get("Content-Type"), "text/plain")
+
+	// the configuration overrides the route's timeout
+	w = serve("/slow/1")
+	assert.Equal(t, w.Code, 503)
+	reply := ErrorReply{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &reply))
+	assert.Equal(t, reply.Code, "timeout")
+
+	// handlers that started replying are waited for
+	w = serve("/stream")
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), "partial")
+
+	serve("/events")
+	metrics := app.requestMetrics.Metrics()
+	assert.Equal(t, metrics["timed_out"], map[string]int{"/slow/{id}": 1})
+	assert.Equal(t, metrics["slow"], map[string]int{})
+}
@@ -0,0 +1,139 @@
+package scv
+
+import (
+	"sync"
+	"time"
+)
+
+// Default number of seconds a token is trusted before it is looked up again.
+const TOKEN_CACHE_TTL int = 300
+
+type tokenEntry struct {
+	identity Identity
+	expires  time.Time
+}
+
+// TokenCache maps authorization tokens to users, and the scopes of service
+// tokens, so that authenticated requests do not need to query Mongo every time. Entries expire after ttl,
+// and must be explicitly invalidated when a token is revoked.
+type TokenCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]tokenEntry
+	hits    int64
+	misses  int64
+}
+
+func NewTokenCache(ttl time.Duration) *TokenCache {
+	return &TokenCache{
+		ttl:     ttl,
+		entries: make(map[string]tokenEntry),
+	}
+}
+
+// Returns the user owning token, if it is cached and has not expired.
+func (c *TokenCache) Get(token string) (string, bool) {
+	identity, ok := c.GetIdentity(token)
+	return identity.User, ok
+}
+
+// Like Get, returning the scopes and targets of the token along with its user.
+func (c *TokenCache) GetIdentity(token string) (Identity, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[token]
+	if ok && time.Now().After(entry.expires) {
+		delete(c.entries, token)
+		ok = false
+	}
+	if ok == false {
+		c.misses += 1
+		return Identity{}, false
+	}
+	c.hits += 1
+	return entry.identity, true
+}
+
+func (c *TokenCache) Put(token, user string) {
+	c.PutUntil(token, user, time.Time{})
+}
+
+// Same as Put, but the entry never outlives expires (eg. when the token itself
+// expires before the ttl would). A zero expires only applies the ttl.
+func (c *TokenCache) PutUntil(token, user string, expires time.Time) {
+	c.PutIdentity(token, Identity{User: user, Expires: expires})
+}
+
+// Cache the identity of a token until its Expires, or for the ttl.
+func (c *TokenCache) PutIdentity(token string, identity Identity) {
+	expires := identity.Expires
+	c.Lock()
+	defer c.Unlock()
+	if c.ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	if expires.IsZero() || expires.After(now.Add(c.ttl)) {
+		expires = now.Add(c.ttl)
+	}
+	// sweep expired entries every so often so that the cache stays bounded
+	// by the number of tokens seen within a ttl.
+	if len(c.entries) > 0 && len(c.entries)%1024 == 0 {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	c.entries[token] = tokenEntry{identity: identity, expires: expires}
+}
+
+// Change the ttl of entries added from now on. A ttl <= 0 disables the cache
+// and drops every entry.
+func (c *TokenCache) SetTTL(ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.ttl = ttl
+	if ttl <= 0 {
+		c.entries = make(map[string]tokenEntry)
+	}
+}
+
+// Drop every entry.
+func (c *TokenCache) Clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.entries = make(map[string]tokenEntry)
+}
+
+func (c *TokenCache) Invalidate(token string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.entries, token)
+}
+
+// Remove every cached token belonging to user.
+func (c *TokenCache) InvalidateUser(user string) {
+	c.Lock()
+	defer c.Unlock()
+	for token, entry := range c.entries {
+		if entry.identity.User == user {
+			delete(c.entries, token)
+		}
+	}
+}
+
+func (c *TokenCache) Metrics() map[string]interface{} {
+	c.Lock()
+	defer c.Unlock()
+	hitRate := 0.0
+	if c.hits+c.misses > 0 {
+		hitRate = float64(c.hits) / float64(c.hits+c.misses)
+	}
+	return map[string]interface{}{
+		"hits":     c.hits,
+		"misses":   c.misses,
+		"size":     len(c.entries),
+		"hit_rate": hitRate,
+	}
+}
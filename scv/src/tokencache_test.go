@@ -0,0 +1,33 @@
+package scv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenCache(t *testing.T) {
+	c := NewTokenCache(time.Second)
+	_, ok := c.Get("token1")
+	assert.False(t, ok)
+	c.Put("token1", "yutong")
+	c.Put("token2", "yutong")
+	c.Put("token3", "diwakar")
+	user, ok := c.Get("token1")
+	assert.True(t, ok)
+	assert.Equal(t, user, "yutong")
+	c.Invalidate("token1")
+	_, ok = c.Get("token1")
+	assert.False(t, ok)
+	c.InvalidateUser("yutong")
+	_, ok = c.Get("token2")
+	assert.False(t, ok)
+	metrics := c.Metrics()
+	assert.Equal(t, metrics["hits"], int64(1))
+	assert.Equal(t, metrics["misses"], int64(3))
+	assert.Equal(t, metrics["size"], 1)
+	time.Sleep(1100 * time.Millisecond)
+	_, ok = c.Get("token3")
+	assert.False(t, ok)
+}
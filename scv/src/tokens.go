@@ -0,0 +1,381 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Scopes of service tokens, see ScopeMiddleware. Every manager route requires
+// one of them, and SCOPE_ADMIN grants every other.
+const (
+	SCOPE_STREAMS_READ  string = "streams:read"  // stream and target information
+	SCOPE_STREAMS_WRITE string = "streams:write" // creating and changing streams
+	SCOPE_DOWNLOAD      string = "download"      // syncing and downloading the files of streams
+	SCOPE_ADMIN         string = "admin"         // targets, webhooks and API tokens
+)
+
+var SCOPES = []string{SCOPE_STREAMS_READ, SCOPE_STREAMS_WRITE, SCOPE_DOWNLOAD, SCOPE_ADMIN}
+
+/*
+An API token issued through /auth/tokens. Unlike the token stored in the
+users.all document, a user may hold any number of these, and each one can
+expire and be revoked independently. Service tokens, for automation, are
+limited to their Scopes and Targets.
+*/
+type APIToken struct {
+	Id          string   `json:"id" bson:"_id"`
+	Token       string   `json:"token,omitempty" bson:"token"`
+	User        string   `json:"user" bson:"user"`
+	Description string   `json:"description" bson:"description"`
+	Created     int      `json:"created" bson:"created"`
+	Expires     int      `json:"expires" bson:"expires"`                         // unix time, 0 if the token never expires
+	Scopes      []string `json:"scopes,omitempty" bson:"scopes,omitempty"`       // every scope if empty
+	Targets     []string `json:"target_ids,omitempty" bson:"targets,omitempty"` // every target if empty
+}
+
+func (t *APIToken) Expired() bool {
+	return t.Expires > 0 && int(time.Now().Unix()) >= t.Expires
+}
+
+// Returns true if the token is limited to scopes or targets.
+func (id Identity) scoped() bool {
+	return len(id.Scopes) > 0 || len(id.Targets) > 0
+}
+
+// Returns true if the token may be used for routes of scope.
+func (id Identity) allows(scope string) bool {
+	return len(id.Scopes) == 0 || containsString(id.Scopes, scope) || containsString(id.Scopes, SCOPE_ADMIN)
+}
+
+/*
+Returns the targets a request is about: those of the target_id and stream_id
+in its path. Returns no target if the path names none, eg. POST /streams,
+whose target is in the body.
+*/
+func (app *Application) requestTargets(r *http.Request) ([]string, error) {
+	vars := mux.Vars(r)
+	if targetId, ok := vars["target_id"]; ok {
+		return []string{targetId}, nil
+	}
+	if streamId, ok := vars["stream_id"]; ok {
+		var targetId string
+		err := app.Manager.ReadStream(streamId, func(stream *Stream) error {
+			targetId = stream.TargetId
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []string{targetId}, nil
+	}
+	return nil, nil
+}
+
+// Check that a service token restricted to targets may be used for every
+// target in targetIds. Empty ids are ignored, and naming no target is refused.
+// Used by the handlers of routes with ChecksTargets, whose targets are named
+// in the body or the query. Other credentials are left to the handler.
+func (app *Application) checkTokenTargets(r *http.Request, targetIds ...string) error {
+	identity, err := app.tokenIdentity(r.Header.Get("Authorization"))
+	if err != nil || len(identity.Targets) == 0 {
+		return nil
+	}
+	named := false
+	for _, targetId := range targetIds {
+		if targetId == "" {
+			continue
+		}
+		named = true
+		if containsString(identity.Targets, targetId) == false {
+			return ErrForbidden.With("Token is not valid for target " + targetId)
+		}
+	}
+	if named == false {
+		return ErrForbidden.With("Token is restricted to targets, and the request names none")
+	}
+	return nil
+}
+
+// Refuse service tokens, which could otherwise issue themselves tokens without
+// their limits.
+func (app *Application) checkUnscoped(r *http.Request) error {
+	identity, err := app.tokenIdentity(r.Header.Get("Authorization"))
+	if err == nil && identity.scoped() {
+		return ErrForbidden.With("Service tokens cannot manage tokens")
+	}
+	return nil
+}
+
+// Check that the scopes and targets of a service token allow a request to a
+// route of scope. The targets of routes whose handler checks them, see
+// checkTokenTargets, are left to the handler, as are other credentials.
+func (app *Application) checkScope(r *http.Request, scope string, checksTargets bool) error {
+	identity, err := app.tokenIdentity(r.Header.Get("Authorization"))
+	if err != nil || identity.scoped() == false {
+		return nil
+	}
+	if identity.allows(scope) == false {
+		return ErrForbidden.With("Token does not have the " + scope + " scope")
+	}
+	if len(identity.Targets) == 0 || checksTargets {
+		return nil
+	}
+	targets, err := app.requestTargets(r)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return ErrForbidden.With("Token is restricted to targets, and the request names none")
+	}
+	for _, targetId := range targets {
+		if containsString(identity.Targets, targetId) == false {
+			return ErrForbidden.With("Token is not valid for target " + targetId)
+		}
+	}
+	return nil
+}
+
+/*
+Middleware of the manager routes, refusing the requests of service tokens
+outside of their scopes and targets. Service tokens restricted to targets may
+only call routes naming a target or stream in their path, or routes whose
+handler checks the targets they name, if checksTargets is true.
+*/
+func (app *Application) ScopeMiddleware(scope string, checksTargets bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := app.checkScope(r, scope, checksTargets); err != nil {
+			code := writeError(w, r, err)
+			log.Printf("%s %s %s %s %d: %v", r.RemoteAddr, requestId(r), r.Method, r.URL, code, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Find a token by id that is owned by user.
+func (app *Application) findOwnedToken(id, user string) (doc APIToken, err error) {
+	if doc, err = app.Database.Token(id); err != nil {
+		return doc, ErrNotFound.With("token " + id + " does not exist")
+	}
+	if doc.User != user {
+		return doc, ErrForbidden.With(user + " does not own token " + id)
+	}
+	return doc, nil
+}
+
+/*
+.. http:post:: /auth/tokens
+    Issue a new token for the authenticated user.
+    :reqheader Authorization: any valid token of the user
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "description": "sync script", // optional
+            "expires_in": 86400, // optional, seconds until the token expires
+            "scopes": ["streams:read", "download"], // optional
+            "target_ids": ["target_id"] // optional
+        }
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "id": "token_id",
+            "token": "secret",
+            "user": "yutong",
+            "description": "sync script",
+            "created": 1404502030,
+            "expires": 1404588430,
+            "scopes": ["streams:read", "download"],
+            "target_ids": ["target_id"]
+        }
+    .. note:: Tokens with ``scopes`` or ``target_ids`` are service
+        tokens, for automation such as CI pipelines. They may only call
+        the manager routes of their scopes, ``streams:read``,
+        ``streams:write``, ``download`` (``/streams/sync``,
+        ``/streams/download`` and ``/streams/export``) or ``admin``,
+        which grants every other. Tokens restricted to targets may only
+        call routes naming one of them, or a stream of one of them.
+        Service tokens cannot call the ``/auth/tokens`` routes.
+    :status 200: OK
+    :status 400: Bad request
+    :status 403: The user does not own one of the targets
+*/
+func (app *Application) PostTokenHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, err := app.CurrentUser(r)
+		if err != nil {
+			return ErrUnauthorized.With("Unable to find user.")
+		}
+		if err := app.checkUnscoped(r); err != nil {
+			return err
+		}
+		type Message struct {
+			Description string   `json:"description"`
+			ExpiresIn   int      `json:"expires_in"`
+			Scopes      []string `json:"scopes"`
+			TargetIds   []string `json:"target_ids"`
+		}
+		msg := Message{}
+		if r.Body != nil {
+			if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+				return errors.New("Bad request: " + err.Error())
+			}
+		}
+		if msg.ExpiresIn < 0 {
+			return errors.New("expires_in must be positive")
+		}
+		for _, scope := range msg.Scopes {
+			if containsString(SCOPES, scope) == false {
+				return errors.New("Bad request: unknown scope " + scope)
+			}
+		}
+		for _, targetId := range msg.TargetIds {
+			if err := app.checkTarget(targetId, user); err != nil {
+				return err
+			}
+		}
+		now := int(time.Now().Unix())
+		doc := APIToken{
+			Id:          RandSeq(12),
+			Token:       RandSecret(36),
+			User:        user,
+			Description: msg.Description,
+			Created:     now,
+			Scopes:      msg.Scopes,
+			Targets:     msg.TargetIds,
+		}
+		if msg.ExpiresIn > 0 {
+			doc.Expires = now + msg.ExpiresIn
+		}
+		if err := app.Database.InsertToken(doc); err != nil {
+			return errors.New("Unable to insert token into DB")
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:get:: /auth/tokens
+    List the tokens issued to the authenticated user. Secrets are not
+    returned.
+    :reqheader Authorization: any valid token of the user
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "tokens": [
+                {
+                    "id": "token_id",
+                    "user": "yutong",
+                    "description": "sync script",
+                    "created": 1404502030,
+                    "expires": 0
+                }
+            ]
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) ListTokensHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, err := app.CurrentUser(r)
+		if err != nil {
+			return ErrUnauthorized.With("Unable to find user.")
+		}
+		if err := app.checkUnscoped(r); err != nil {
+			return err
+		}
+		tokens, err := app.Database.UserTokens(user)
+		if err != nil {
+			return err
+		}
+		for i := range tokens {
+			tokens[i].Token = ""
+		}
+		data, err := json.Marshal(map[string]interface{}{"tokens": tokens})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:put:: /auth/tokens/:id/rotate
+    Replace the secret of a token, keeping its id, description and
+    expiration. The old secret stops working immediately.
+    :reqheader Authorization: any valid token of the user
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "id": "token_id",
+            "token": "new_secret"
+        }
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) RotateTokenHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, err := app.CurrentUser(r)
+		if err != nil {
+			return ErrUnauthorized.With("Unable to find user.")
+		}
+		if err := app.checkUnscoped(r); err != nil {
+			return err
+		}
+		id := mux.Vars(r)["id"]
+		doc, err := app.findOwnedToken(id, user)
+		if err != nil {
+			return err
+		}
+		secret := RandSecret(36)
+		if err := app.Database.SetTokenSecret(id, secret); err != nil {
+			return err
+		}
+		app.tokenCache.Invalidate(doc.Token)
+		data, err := json.Marshal(map[string]string{"id": id, "token": secret})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:delete:: /auth/tokens/:id
+    Revoke a token.
+    :reqheader Authorization: any valid token of the user
+    :status 200: OK
+    :status 400: Bad request
+*/
+func (app *Application) RevokeTokenHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, err := app.CurrentUser(r)
+		if err != nil {
+			return ErrUnauthorized.With("Unable to find user.")
+		}
+		if err := app.checkUnscoped(r); err != nil {
+			return err
+		}
+		id := mux.Vars(r)["id"]
+		doc, err := app.findOwnedToken(id, user)
+		if err != nil {
+			return err
+		}
+		if err := app.Database.RemoveToken(id); err != nil {
+			return err
+		}
+		app.tokenCache.Invalidate(doc.Token)
+		return nil
+	}
+}
@@ -0,0 +1,114 @@
+package scv
+
+import (
+	"../manager"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceTokens(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tokens")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{
+		Config:       Configuration{Name: filepath.Join(dir, "scv")},
+		Database:     db,
+		Manager:      manager.NewManager(intf),
+		tokenCache:   NewTokenCache(time.Minute),
+		optionsCache: NewResultCache(time.Minute),
+	}
+	app.Manager.AddStream(newStream("s1", "t1", "yutong", 0, 0, 0), "t1", true)
+	app.Manager.AddStream(newStream("s2", "t2", "yutong", 0, 0, 0), "t2", true)
+	app.Manager.AddStream(newStream("s3", "t3", "jesse_v", 0, 0, 0), "t3", true)
+	db.InsertToken(APIToken{Id: "full", Token: "full", User: "yutong"})
+
+	router := mux.NewRouter()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("{}")) })
+	// the targets of these are named in the query and the body
+	events := AppHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return app.checkTokenTargets(r, r.URL.Query()["target_id"]...)
+	})
+	streams := AppHandler(func(w http.ResponseWriter, r *http.Request) error {
+		msg := PostStreamRequest{}
+		json.NewDecoder(r.Body).Decode(&msg)
+		return app.checkTokenTargets(r, msg.TargetId)
+	})
+	router.Handle("/auth/tokens", app.ScopeMiddleware(SCOPE_ADMIN, false, app.PostTokenHandler())).Methods("POST")
+	router.Handle("/streams/sync/{stream_id}", app.ScopeMiddleware(SCOPE_DOWNLOAD, false, ok))
+	router.Handle("/streams/delete/{stream_id}", app.ScopeMiddleware(SCOPE_STREAMS_WRITE, false, ok))
+	router.Handle("/targets/{target_id}/stats", app.ScopeMiddleware(SCOPE_STREAMS_READ, false, ok))
+	router.Handle("/targets", app.ScopeMiddleware(SCOPE_STREAMS_READ, false, ok))
+	router.Handle("/events", app.ScopeMiddleware(SCOPE_STREAMS_READ, true, events))
+	router.Handle("/streams", app.ScopeMiddleware(SCOPE_STREAMS_WRITE, true, streams))
+	serve := func(method, url, token string, body interface{}) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, url, bytes.NewReader(data))
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	issue := func(token string, scopes, targets []string) (APIToken, int) {
+		w := serve("POST", "/auth/tokens", token, map[string]interface{}{"scopes": scopes, "target_ids": targets})
+		doc := APIToken{}
+		json.Unmarshal(w.Body.Bytes(), &doc)
+		return doc, w.Code
+	}
+
+	_, code := issue("full", []string{"streams:delete"}, nil)
+	assert.Equal(t, code, 400)
+	_, code = issue("full", []string{SCOPE_DOWNLOAD}, []string{"t3"})
+	assert.Equal(t, code, 403)
+	sync, code := issue("full", []string{SCOPE_DOWNLOAD}, []string{"t1"})
+	assert.Equal(t, code, 200)
+	assert.Equal(t, sync.Scopes, []string{SCOPE_DOWNLOAD})
+	assert.Equal(t, sync.Targets, []string{"t1"})
+
+	// a sync token only downloads the streams of its targets
+	assert.Equal(t, serve("GET", "/streams/sync/s1", sync.Token, nil).Code, 200)
+	assert.Equal(t, serve("GET", "/streams/sync/s1", "Bearer "+sync.Token, nil).Code, 200)
+	assert.Equal(t, serve("GET", "/streams/sync/s2", sync.Token, nil).Code, 403)
+	assert.Equal(t, serve("GET", "/streams/sync/unknown", sync.Token, nil).Code, 404)
+	assert.Equal(t, serve("PUT", "/streams/delete/s1", sync.Token, nil).Code, 403)
+	assert.Equal(t, serve("GET", "/targets/t1/stats", sync.Token, nil).Code, 403)
+	_, code = issue(sync.Token, nil, nil)
+	assert.Equal(t, code, 403)
+
+	// targets are named in the path, or checked by the handler
+	reader, _ := issue("full", []string{SCOPE_STREAMS_READ, SCOPE_STREAMS_WRITE}, []string{"t1", "t2"})
+	assert.Equal(t, serve("GET", "/targets/t2/stats", reader.Token, nil).Code, 200)
+	assert.Equal(t, serve("GET", "/targets/t3/stats", reader.Token, nil).Code, 403)
+	assert.Equal(t, serve("GET", "/targets?target_id=t1", reader.Token, nil).Code, 403)
+	assert.Equal(t, serve("GET", "/events?target_id=t1&target_id=t2", reader.Token, nil).Code, 200)
+	assert.Equal(t, serve("GET", "/events?target_id=t1&target_id=t3", reader.Token, nil).Code, 403)
+	assert.Equal(t, serve("GET", "/events", reader.Token, nil).Code, 403)
+	assert.Equal(t, serve("POST", "/streams", reader.Token, nil).Code, 403)
+	assert.Equal(t, serve("POST", "/streams", reader.Token, map[string]string{"target_id": "t2"}).Code, 200)
+	assert.Equal(t, serve("POST", "/streams?target_id=t1", reader.Token, map[string]string{"target_id": "t3"}).Code, 403)
+
+	// admin grants every scope, and tokens without targets any target
+	admin, _ := issue("full", []string{SCOPE_ADMIN}, nil)
+	assert.Equal(t, serve("POST", "/streams", admin.Token, nil).Code, 200)
+	assert.Equal(t, serve("GET", "/streams/sync/s2", admin.Token, nil).Code, 200)
+
+	// service tokens cannot issue tokens without their limits
+	_, code = issue(admin.Token, nil, nil)
+	assert.Equal(t, code, 403)
+	_, code = issue(reader.Token, nil, nil)
+	assert.Equal(t, code, 403)
+	for _, url := range []string{"/events", "/streams/sync/s3", "/targets/t3/stats"} {
+		assert.Equal(t, serve("GET", url, "full", nil).Code, 200)
+	}
+}
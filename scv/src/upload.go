@@ -0,0 +1,70 @@
+package scv
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Default limits on the size of core uploads, in bytes.
+const (
+	MAX_FRAME_BYTES      int64 = 64 << 20
+	MAX_CHECKPOINT_BYTES int64 = 256 << 20
+)
+
+// Return a directory for scratch files. It lives on the same filesystem as the
+// streams so that its files can be renamed into place.
+func (app *Application) TmpDir() string {
+	return filepath.Join(app.Config.Name+"_data", "tmp")
+}
+
+/*
+Copy the request body into a temporary file while computing its MD5, so that
+large uploads are never held in memory in their entirety. At most limit bytes
+are read. If expectedMD5 does not match the hex digest of the body, an error is
+returned. On success, the returned file is positioned at its beginning and must
+be released with releaseBody.
+*/
+func (app *Application) spoolBody(w http.ResponseWriter, r *http.Request, limit int64, expectedMD5 string) (*os.File, error) {
+	os.MkdirAll(app.TmpDir(), 0776)
+	file, err := ioutil.TempFile(app.TmpDir(), "upload_")
+	if err != nil {
+		return nil, err
+	}
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(file, h), http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		releaseBody(file)
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return nil, ErrTooLarge.With("Request body too large")
+		}
+		return nil, err
+	}
+	if expectedMD5 != hex.EncodeToString(h.Sum(nil)) {
+		releaseBody(file)
+		return nil, errors.New("MD5 mismatch")
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		releaseBody(file)
+		return nil, err
+	}
+	return file, nil
+}
+
+func releaseBody(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+func uploadLimit(configured, fallback int64) int64 {
+	if configured > 0 {
+		return configured
+	}
+	return fallback
+}
@@ -0,0 +1,187 @@
+package scv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// File the usage of every stream is saved to on shutdown, see saveUsageCache.
+const USAGE_CACHE_FILE string = "usage.json"
+
+// DiskUsage keeps track of the number of bytes stored on disk by each stream,
+// grouped by target and by namespace. It has its own mutex so it can be updated while the
+// Manager and stream locks are held.
+type DiskUsage struct {
+	sync.RWMutex
+	targets map[string]map[string]int64 // map of targetId to map of streamId to bytes
+	totals  map[string]int64            // map of targetId to total bytes
+	owners  map[string]string           // map of streamId to targetId
+
+	namespaces      map[string]string // map of streamId to namespace, see SetNamespace
+	namespaceTotals map[string]int64  // map of namespace to total bytes
+}
+
+func NewDiskUsage() *DiskUsage {
+	return &DiskUsage{
+		targets: make(map[string]map[string]int64),
+		totals:  make(map[string]int64),
+		owners:  make(map[string]string),
+
+		namespaces:      make(map[string]string),
+		namespaceTotals: make(map[string]int64),
+	}
+}
+
+// Add (or subtract, if negative) bytes to the usage of a stream.
+func (d *DiskUsage) Add(targetId, streamId string, bytes int64) {
+	d.Lock()
+	defer d.Unlock()
+	streams, ok := d.targets[targetId]
+	if ok == false {
+		streams = make(map[string]int64)
+		d.targets[targetId] = streams
+	}
+	streams[streamId] += bytes
+	d.totals[targetId] += bytes
+	d.owners[streamId] = targetId
+	if namespace, ok := d.namespaces[streamId]; ok {
+		d.namespaceTotals[namespace] += bytes
+	}
+}
+
+// Count the usage of a stream, past and future, towards namespace.
+func (d *DiskUsage) SetNamespace(streamId, namespace string) {
+	d.Lock()
+	defer d.Unlock()
+	bytes := d.targets[d.owners[streamId]][streamId]
+	if previous, ok := d.namespaces[streamId]; ok {
+		d.namespaceTotals[previous] -= bytes
+	}
+	d.namespaces[streamId] = namespace
+	d.namespaceTotals[namespace] += bytes
+}
+
+// Forget about a stream entirely, typically after its directory was removed.
+func (d *DiskUsage) RemoveStream(streamId string) {
+	d.Lock()
+	defer d.Unlock()
+	targetId, ok := d.owners[streamId]
+	if namespace, ok := d.namespaces[streamId]; ok {
+		d.namespaceTotals[namespace] -= d.targets[targetId][streamId]
+		delete(d.namespaces, streamId)
+	}
+	if ok == false {
+		return
+	}
+	streams := d.targets[targetId]
+	d.totals[targetId] -= streams[streamId]
+	delete(streams, streamId)
+	delete(d.owners, streamId)
+	if len(streams) == 0 {
+		delete(d.targets, targetId)
+		delete(d.totals, targetId)
+	}
+}
+
+func (d *DiskUsage) Target(targetId string) int64 {
+	d.RLock()
+	defer d.RUnlock()
+	return d.totals[targetId]
+}
+
+func (d *DiskUsage) Namespace(namespace string) int64 {
+	d.RLock()
+	defer d.RUnlock()
+	return d.namespaceTotals[namespace]
+}
+
+// Returns a copy of the per-stream usage of a target.
+func (d *DiskUsage) Streams(targetId string) map[string]int64 {
+	d.RLock()
+	defer d.RUnlock()
+	result := make(map[string]int64)
+	for streamId, bytes := range d.targets[targetId] {
+		result[streamId] = bytes
+	}
+	return result
+}
+
+// Returns a copy of the usage of every stream, keyed by stream id.
+func (d *DiskUsage) Snapshot() map[string]int64 {
+	d.RLock()
+	defer d.RUnlock()
+	result := make(map[string]int64, len(d.owners))
+	for targetId, streams := range d.targets {
+		for streamId, bytes := range streams {
+			if d.owners[streamId] == targetId {
+				result[streamId] = bytes
+			}
+		}
+	}
+	return result
+}
+
+func (app *Application) usageCachePath() string {
+	return filepath.Join(app.Config.Name+"_data", USAGE_CACHE_FILE)
+}
+
+// Save the usage of every stream once the SCV stopped changing its data, so
+// that the next start does not have to walk the directory of every stream.
+func (app *Application) saveUsageCache() error {
+	data, err := json.Marshal(app.usage.Snapshot())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(app.usageCachePath(), data, 0664)
+}
+
+/*
+Returns the usage saved by the last shutdown, or nil if the SCV did not shut
+down cleanly. The file is removed as soon as it is read: it is only accurate
+until the data of a stream changes, and a later crash must not leave it
+behind.
+*/
+func (app *Application) loadUsageCache() map[string]int64 {
+	path := app.usageCachePath()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		log.Println("Unable to remove usage cache, ignoring it:", err)
+		return nil
+	}
+	sizes := make(map[string]int64)
+	if err := json.Unmarshal(data, &sizes); err != nil {
+		log.Println("Unable to read usage cache:", err)
+		return nil
+	}
+	return sizes
+}
+
+// Returns the number of bytes used by all regular files under path.
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// Returns the number of bytes available to the SCV on the filesystem holding
+// path, or -1 if it cannot be determined.
+func diskFree(path string) int64 {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return -1
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize)
+}
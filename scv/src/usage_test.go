@@ -0,0 +1,42 @@
+package scv
+
+import (
+	"../manager"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "usage")
+	defer os.RemoveAll(dir)
+	app := &Application{
+		Config: Configuration{Name: filepath.Join(dir, "scv")},
+		usage:  NewDiskUsage(),
+	}
+	app.Manager = manager.NewManager(app)
+	os.MkdirAll(app.StreamDir("s1"), 0776)
+	ioutil.WriteFile(filepath.Join(app.StreamDir("s1"), "seed"), []byte("12345"), 0666)
+
+	// without a cache the directory is walked
+	assert.Nil(t, app.loadUsageCache())
+	settings := Configuration{SkipFrameVerify: true}
+	assert.Nil(t, app.loadStream(Stream{StreamId: "s1", TargetId: "t1", MongoStatus: "enabled"}, settings, nil))
+	assert.Equal(t, app.usage.Target("t1"), int64(5))
+
+	app.usage.Add("t2", "s2", 7)
+	assert.Nil(t, app.saveUsageCache())
+	sizes := app.loadUsageCache()
+	assert.Equal(t, sizes, map[string]int64{"s1": 5, "s2": 7})
+	// only the first start after a shutdown may use it
+	assert.Nil(t, app.loadUsageCache())
+
+	app.usage.RemoveStream("s1")
+	sizes["s1"] = 100
+	assert.Nil(t, app.Manager.RemoveStream("s1", ""))
+	assert.Nil(t, app.loadStream(Stream{StreamId: "s1", TargetId: "t1", MongoStatus: "enabled"}, settings, sizes))
+	assert.Equal(t, app.usage.Target("t1"), int64(100))
+}
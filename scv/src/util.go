@@ -1,7 +1,18 @@
 package scv
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	crand "crypto/rand"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func RandSeq(n int) string {
@@ -12,3 +23,195 @@ func RandSeq(n int) string {
 	}
 	return string(b)
 }
+
+// Like RandSeq, but drawn from crypto/rand, for secrets that must not be
+// guessed: API tokens, tokens of cores and webhook signing secrets.
+func RandSecret(n int) string {
+	const letters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	// bytes past the last multiple of len(letters) are dropped so that every
+	// letter is equally likely
+	max := 256 - 256%len(letters)
+	b := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(b) < n {
+		if _, err := crand.Read(buf); err != nil {
+			panic("FATAL RandSecret(), crypto/rand failed: " + err.Error())
+		}
+		for _, c := range buf {
+			if int(c) < max && len(b) < n {
+				b = append(b, letters[int(c)%len(letters)])
+			}
+		}
+	}
+	return string(b)
+}
+
+// Returns true if the client accepts gzip in its Accept-Encoding header, either
+// explicitly or through *. A q-value of 0 refuses the encoding, and gzip takes
+// precedence over *.
+func acceptsGzip(r *http.Request) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(enc, ";")
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(params[0])) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress data, which may hold several gzip members one after the other.
+func gunzipBytes(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// Like gunzipBytes, but refuses data that decompresses to more than limit
+// bytes with ErrTooLarge, without decompressing the rest.
+func gunzipBytesLimit(data []byte, limit int64) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	contents, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(contents)) > limit {
+		return nil, ErrTooLarge.With("Decompressed files too large")
+	}
+	return contents, nil
+}
+
+// Bytes read at once by readFileSize before checking whether to carry on.
+const READ_CHUNK_SIZE int64 = 1 << 20
+
+// Read the first size bytes of a file, eg. its size when it was looked up if it
+// may be appended to meanwhile. Stops with the error of ctx once it is done.
+func readFileSize(ctx context.Context, path string, size int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, size)
+	for read := int64(0); read < size; read += READ_CHUNK_SIZE {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		end := read + READ_CHUNK_SIZE
+		if end > size {
+			end = size
+		}
+		if _, err := io.ReadFull(file, data[read:end]); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Write data to path such that after a crash, path holds either its previous
+// contents or all of data. The data is written to a temporary file in the same
+// directory, flushed to disk, and renamed over path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := writeFileSynced(path, data, perm); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Same as writeFileAtomic, but the rename is not flushed to disk: the caller
+// syncs the directory once it is done writing to it.
+func writeFileSynced(path string, data []byte, perm os.FileMode) error {
+	dir, name := filepath.Split(path)
+	file, err := ioutil.TempFile(dir, ".tmp_"+name)
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// Flush a directory's entries to disk, making renames and newly created files
+// inside it durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Flush every file and directory under root to disk.
+func syncTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return file.Sync()
+	})
+}
+
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
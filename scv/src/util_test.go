@@ -0,0 +1,92 @@
+package scv
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scv_util")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.xml.gz.b64")
+	assert.Nil(t, writeFileAtomic(path, []byte("first"), 0776))
+	assert.Nil(t, writeFileAtomic(path, []byte("second"), 0776))
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "second")
+	// no temporary files are left behind
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, len(files), 1)
+	assert.NotNil(t, writeFileAtomic(filepath.Join(dir, "missing", "file"), []byte("x"), 0776))
+	assert.Nil(t, syncTree(dir))
+}
+
+func TestGunzipBytes(t *testing.T) {
+	first, _ := gzipBytes([]byte("first "))
+	second, _ := gzipBytes([]byte("second"))
+	// appended frames form a single gzip stream
+	data, err := gunzipBytes(append(first, second...))
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "first second")
+	_, err = gunzipBytes(bytes.Repeat([]byte("x"), 20))
+	assert.NotNil(t, err)
+}
+
+func TestReadFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scv_util")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "frames.xtc")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("0123456789"), 0776))
+	// bytes appended after the size was taken are not read
+	data, err := readFileSize(context.Background(), path, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "0123")
+	// the file was truncated since
+	_, err = readFileSize(context.Background(), path, 20)
+	assert.NotNil(t, err)
+	// the request was abandoned
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = readFileSize(ctx, path, 4)
+	assert.Equal(t, err, context.Canceled)
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	accepts := func(header string) bool {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", header)
+		return acceptsGzip(req)
+	}
+	assert.False(t, accepts(""))
+	assert.True(t, accepts("gzip"))
+	assert.True(t, accepts("deflate, gzip;q=0.5"))
+	assert.True(t, accepts("*"))
+	assert.False(t, accepts("identity"))
+	assert.False(t, accepts("gzip;q=0"))
+	assert.False(t, accepts("gzip; q=0.0, deflate"))
+	assert.False(t, accepts("*, gzip;q=0"))
+	assert.False(t, accepts("*;q=0"))
+	assert.True(t, accepts("*;q=0, gzip"))
+}
+
+func TestRandSecret(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		secret := RandSecret(36)
+		assert.Equal(t, len(secret), 36)
+		for _, c := range secret {
+			assert.True(t, (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z'))
+		}
+		assert.False(t, seen[secret])
+		seen[secret] = true
+	}
+}
@@ -0,0 +1,333 @@
+package scv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Seconds the options of a target are cached before being read from Mongo
+// again.
+const TARGET_OPTIONS_TTL int = 30
+
+// Magic number at the start of every frame of an XTC file.
+const XTC_MAGIC uint32 = 1995
+
+/*
+A Validator inspects the files uploaded by a core before they are written to
+the stream, so that garbage from broken cores is rejected instead of polluting
+partitions. Files are given decoded, keyed by their name in the stream (eg.
+frames.xtc). State is private to the active stream and persists across the
+uploads of a single activation.
+*/
+type Validator interface {
+	ValidateFrame(state ValidationState, files map[string][]byte) error
+	ValidateCheckpoint(state ValidationState, files map[string][]byte) error
+}
+
+type ValidationState map[string]interface{}
+
+// Creates a Validator from its entry in the target's options.
+type ValidatorFactory func(options map[string]interface{}) (Validator, error)
+
+var validatorFactories = map[string]ValidatorFactory{
+	"xtc":             newXTCValidator,
+	"max_frame_bytes": newMaxFrameBytesValidator,
+	"log_time":        newLogTimeValidator,
+}
+
+// Make a validator available to targets under name.
+func RegisterValidator(name string, factory ValidatorFactory) {
+	validatorFactories[name] = factory
+}
+
+// Returned when an upload is rejected by a validator.
+type ValidationError struct {
+	Validator string
+	Reason    string
+}
+
+func (e *ValidationError) Error() string {
+	return "Invalid upload (" + e.Validator + "): " + e.Reason
+}
+
+/*
+Build the validators listed in the "validators" option of a target, eg.
+
+    "validators": [
+        {"type": "xtc"},
+        {"type": "max_frame_bytes", "bytes": 1048576},
+        {"type": "log_time", "file": "log.txt", "column": 0}
+    ]
+*/
+func newValidators(options map[string]interface{}) ([]string, []Validator, error) {
+	names := make([]string, 0)
+	validators := make([]Validator, 0)
+	entries, _ := options["validators"].([]interface{})
+	for _, entry := range entries {
+		config, ok := entry.(map[string]interface{})
+		if ok == false {
+			return nil, nil, errors.New("validator must be an object")
+		}
+		name, _ := config["type"].(string)
+		factory, ok := validatorFactories[name]
+		if ok == false {
+			return nil, nil, errors.New("unknown validator: " + name)
+		}
+		validator, err := factory(config)
+		if err != nil {
+			return nil, nil, errors.New(name + ": " + err.Error())
+		}
+		names = append(names, name)
+		validators = append(validators, validator)
+	}
+	return names, validators, nil
+}
+
+type targetValidators struct {
+	names      []string
+	validators []Validator
+}
+
+// Returns the options of a target stored in data.targets. Options are cached
+// for TARGET_OPTIONS_TTL seconds, and for as long as the database cannot be
+// reached so that cores keep working.
+func (app *Application) targetOptions(targetId string) (map[string]interface{}, error) {
+	if cached, ok := app.optionsCache.Get("options:" + targetId); ok {
+		return cached.(map[string]interface{}), nil
+	}
+	doc, err := app.Database.Target(targetId)
+	if err != nil {
+		if stale, ok := app.optionsCache.GetStale("options:" + targetId); ok && isTransient(err) {
+			return stale.(map[string]interface{}), nil
+		}
+		return nil, err
+	}
+	options, _ := doc["options"].(map[string]interface{})
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+	app.optionsCache.Put("options:"+targetId, options)
+	return options, nil
+}
+
+func (app *Application) validators(targetId string) (targetValidators, error) {
+	if cached, ok := app.optionsCache.Get("validators:" + targetId); ok {
+		return cached.(targetValidators), nil
+	}
+	options, err := app.targetOptions(targetId)
+	if err != nil {
+		// targets without a document in data.targets are not validated
+		return targetValidators{}, nil
+	}
+	names, validators, err := newValidators(options)
+	if err != nil {
+		return targetValidators{}, errors.New("Bad validators for target " + targetId + ": " + err.Error())
+	}
+	result := targetValidators{names, validators}
+	app.optionsCache.Put("validators:"+targetId, result)
+	return result, nil
+}
+
+// Run the validators of the stream's target on a frame or, if checkpoint is
+// true, a checkpoint. The stream must be active and locked. Changes made to the
+// validation state are only kept if the upload is accepted.
+func (app *Application) validateUpload(stream *Stream, files map[string][]byte, checkpoint bool) error {
+	tv, err := app.validators(stream.TargetId)
+	if err != nil {
+		return err
+	}
+	state := make(ValidationState)
+	for key, value := range sessionData(stream).validation {
+		state[key] = value
+	}
+	for i, validator := range tv.validators {
+		if checkpoint {
+			err = validator.ValidateCheckpoint(state, files)
+		} else {
+			err = validator.ValidateFrame(state, files)
+		}
+		if err != nil {
+			return &ValidationError{tv.names[i], err.Error()}
+		}
+	}
+	sessionData(stream).validation = state
+	return nil
+}
+
+// Run the validators of the stream's target on a frame whose files are stored
+// gzipped, see decodeFrameFiles. The files are only decompressed if the target
+// has validators.
+func (app *Application) validateCompressedFrame(stream *Stream, stored map[string][]byte) error {
+	tv, err := app.validators(stream.TargetId)
+	if err != nil {
+		return err
+	}
+	if len(tv.validators) == 0 {
+		return nil
+	}
+	files, err := frameContents(stored)
+	if err != nil {
+		return err
+	}
+	return app.validateUpload(stream, files, false)
+}
+
+// Quarantine the stream if err is a ValidationError. The stream must not be
+// locked by the caller.
+func (app *Application) quarantineInvalid(streamId string, err error) {
+	verr, ok := err.(*ValidationError)
+	if ok == false {
+		return
+	}
+	if e := app.Manager.QuarantineStream(streamId, verr.Error()); e != nil {
+		log.Println("Unable to quarantine stream "+streamId+":", e)
+	}
+}
+
+func optionString(options map[string]interface{}, key, def string) string {
+	if value, ok := options[key].(string); ok {
+		return value
+	}
+	return def
+}
+
+func optionInt(options map[string]interface{}, key string, def int) int {
+	switch v := options[key].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return def
+}
+
+func optionBool(options map[string]interface{}, key string, def bool) bool {
+	if value, ok := options[key].(bool); ok {
+		return value
+	}
+	return def
+}
+
+func optionFloat(options map[string]interface{}, key string, def float64) float64 {
+	switch v := options[key].(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	}
+	return def
+}
+
+// Embedded by validators that only look at frames.
+type frameOnly struct{}
+
+func (frameOnly) ValidateCheckpoint(ValidationState, map[string][]byte) error {
+	return nil
+}
+
+// Checks that every .xtc file starts with the XTC magic number.
+type xtcValidator struct {
+	frameOnly
+}
+
+func newXTCValidator(options map[string]interface{}) (Validator, error) {
+	return xtcValidator{}, nil
+}
+
+func (xtcValidator) ValidateFrame(state ValidationState, files map[string][]byte) error {
+	for name, data := range files {
+		if filepath.Ext(name) != ".xtc" {
+			continue
+		}
+		if len(data) < 4 || binary.BigEndian.Uint32(data) != XTC_MAGIC {
+			return errors.New(name + " is not an XTC file")
+		}
+	}
+	return nil
+}
+
+// Limits the total size of the files of a single frame.
+type maxFrameBytesValidator struct {
+	frameOnly
+	bytes int
+}
+
+func newMaxFrameBytesValidator(options map[string]interface{}) (Validator, error) {
+	limit := optionInt(options, "bytes", 0)
+	if limit <= 0 {
+		return nil, errors.New("bytes must be positive")
+	}
+	return maxFrameBytesValidator{bytes: limit}, nil
+}
+
+func (v maxFrameBytesValidator) ValidateFrame(state ValidationState, files map[string][]byte) error {
+	size := 0
+	for _, data := range files {
+		size += len(data)
+	}
+	if size > v.bytes {
+		return errors.New("frame is " + strconv.Itoa(size) + " bytes, the limit is " + strconv.Itoa(v.bytes))
+	}
+	return nil
+}
+
+// Checks that the simulation time logged in a column of a text file strictly
+// increases from one line to the next, including across frames. Lines that
+// do not parse as a number (eg. headers) are ignored.
+type logTimeValidator struct {
+	frameOnly
+	file   string
+	column int
+}
+
+func newLogTimeValidator(options map[string]interface{}) (Validator, error) {
+	v := logTimeValidator{
+		file:   optionString(options, "file", "log.txt"),
+		column: optionInt(options, "column", 0),
+	}
+	if v.column < 0 {
+		return nil, errors.New("column must not be negative")
+	}
+	return v, nil
+}
+
+func (v logTimeValidator) ValidateFrame(state ValidationState, files map[string][]byte) error {
+	data, ok := files[v.file]
+	if ok == false {
+		return nil
+	}
+	key := "log_time:" + v.file
+	last, seen := state[key].(float64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if v.column >= len(fields) {
+			continue
+		}
+		t, err := strconv.ParseFloat(fields[v.column], 64)
+		if err != nil {
+			continue
+		}
+		if seen && t <= last {
+			return errors.New("simulation time went from " + strconv.FormatFloat(last, 'g', -1, 64) +
+				" to " + strconv.FormatFloat(t, 'g', -1, 64) + " in " + v.file)
+		}
+		last, seen = t, true
+	}
+	if seen {
+		state[key] = last
+	}
+	return nil
+}
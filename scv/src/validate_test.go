@@ -0,0 +1,79 @@
+package scv
+
+import (
+	"../manager"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func xtcFrame(size int) []byte {
+	data := make([]byte, size)
+	binary.BigEndian.PutUint32(data, XTC_MAGIC)
+	return data
+}
+
+func TestNewValidators(t *testing.T) {
+	names, validators, err := newValidators(map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, len(validators), 0)
+	names, validators, err = newValidators(map[string]interface{}{
+		"validators": []interface{}{
+			map[string]interface{}{"type": "xtc"},
+			map[string]interface{}{"type": "max_frame_bytes", "bytes": 100.0},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, names, []string{"xtc", "max_frame_bytes"})
+	_, _, err = newValidators(map[string]interface{}{
+		"validators": []interface{}{map[string]interface{}{"type": "bogus"}},
+	})
+	assert.NotNil(t, err)
+	_, _, err = newValidators(map[string]interface{}{
+		"validators": []interface{}{map[string]interface{}{"type": "max_frame_bytes"}},
+	})
+	assert.NotNil(t, err)
+}
+
+func TestValidators(t *testing.T) {
+	state := make(ValidationState)
+	xtc, _ := newXTCValidator(nil)
+	assert.Nil(t, xtc.ValidateFrame(state, map[string][]byte{"frames.xtc": xtcFrame(8), "log.txt": []byte("x")}))
+	assert.NotNil(t, xtc.ValidateFrame(state, map[string][]byte{"frames.xtc": []byte("garbage")}))
+	assert.NotNil(t, xtc.ValidateFrame(state, map[string][]byte{"frames.xtc": []byte{}}))
+	assert.Nil(t, xtc.ValidateCheckpoint(state, map[string][]byte{"state.xml": []byte("garbage")}))
+
+	size, _ := newMaxFrameBytesValidator(map[string]interface{}{"bytes": 10})
+	assert.Nil(t, size.ValidateFrame(state, map[string][]byte{"a": make([]byte, 5), "b": make([]byte, 5)}))
+	assert.NotNil(t, size.ValidateFrame(state, map[string][]byte{"a": make([]byte, 5), "b": make([]byte, 6)}))
+
+	logTime, _ := newLogTimeValidator(map[string]interface{}{"column": 1.0})
+	assert.Nil(t, logTime.ValidateFrame(state, map[string][]byte{"log.txt": []byte("#step,time\n10,0.5\n20,1.0\n")}))
+	assert.Nil(t, logTime.ValidateFrame(state, map[string][]byte{"frames.xtc": xtcFrame(4)}))
+	assert.Nil(t, logTime.ValidateFrame(state, map[string][]byte{"log.txt": []byte("30,1.5\n")}))
+	assert.NotNil(t, logTime.ValidateFrame(state, map[string][]byte{"log.txt": []byte("40,1.5\n")}))
+	assert.NotNil(t, logTime.ValidateFrame(make(ValidationState), map[string][]byte{"log.txt": []byte("1 2.0\n2 1.0\n")}))
+}
+
+func TestValidateUpload(t *testing.T) {
+	app := &Application{optionsCache: NewResultCache(time.Minute)}
+	app.optionsCache.Put("options:target", map[string]interface{}{
+		"validators": []interface{}{
+			map[string]interface{}{"type": "log_time"},
+			map[string]interface{}{"type": "max_frame_bytes", "bytes": 10},
+		},
+	})
+	stream := newStream("stream", "target", "owner", 0, 0, 0)
+	stream.ActiveStream = manager.NewActiveStream("donor", "token", "openmm")
+	stream.ActiveStream.Data = newSessionState()
+	assert.Nil(t, app.validateUpload(stream, map[string][]byte{"log.txt": []byte("1\n")}, false))
+	// a rejected frame does not advance the validation state
+	err := app.validateUpload(stream, map[string][]byte{"log.txt": []byte("2\n3\n4\n5\n6\n7\n")}, false)
+	assert.Equal(t, err.(*ValidationError).Validator, "max_frame_bytes")
+	assert.Nil(t, app.validateUpload(stream, map[string][]byte{"log.txt": []byte("2\n")}, false))
+	err = app.validateUpload(stream, map[string][]byte{"log.txt": []byte("2\n")}, false)
+	assert.Equal(t, err.(*ValidationError).Validator, "log_time")
+	assert.Nil(t, app.validateUpload(stream, map[string][]byte{"state.xml": make([]byte, 100)}, true))
+}
@@ -0,0 +1,650 @@
+package scv
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status of a Verification.
+const (
+	VERIFY_PENDING  string = "pending"
+	VERIFY_ASSIGNED string = "assigned"
+	VERIFY_PASSED   string = "passed"
+	VERIFY_FAILED   string = "failed"
+)
+
+// Verifications waiting for a verifier above which checkpoints are no longer
+// sampled.
+const MAX_VERIFICATIONS int = 64
+
+// Seconds a verifier has to post its result before the verification is handed
+// to another one.
+const VERIFICATION_TIMEOUT int = 3600
+
+// Seconds a sampled checkpoint waits for a verifier before it is dropped.
+const VERIFICATION_TTL int = 86400
+
+// Failed verifications after which a donor is flagged, provided they outnumber
+// the passed ones.
+const VERIFICATION_FLAG_FAILURES int = 3
+
+// Default relative tolerance of the energies compared by verifications.
+const VERIFICATION_TOLERANCE float64 = 1e-4
+
+/*
+Spot checks of the checkpoints of a target, set by the "verification" option
+of the target, eg.
+
+    "verification": {"rate": 0.01, "tolerance": 0.0001}
+
+A fraction rate of the checkpoints posted by cores is sampled and handed to
+the cores of trusted donors, the Verifiers of the configuration, which
+re-simulate the frames of the checkpoint from the previous checkpoint of the
+stream. Their checkpoint files must hash like the donor's, and their energy
+must be within tolerance of the donor's, relative to it.
+*/
+type VerificationPolicy struct {
+	Rate      float64
+	Tolerance float64
+}
+
+// Parse the verification policy in the options of a target. Returns false if
+// the checkpoints of the target are not verified.
+func newVerificationPolicy(options map[string]interface{}) (VerificationPolicy, bool, error) {
+	config, ok := options["verification"].(map[string]interface{})
+	if ok == false {
+		return VerificationPolicy{}, false, nil
+	}
+	policy := VerificationPolicy{
+		Rate:      optionFloat(config, "rate", 0),
+		Tolerance: optionFloat(config, "tolerance", VERIFICATION_TOLERANCE),
+	}
+	if policy.Rate <= 0 || policy.Rate > 1 {
+		return VerificationPolicy{}, false, errors.New("rate must be in (0, 1]")
+	}
+	if policy.Tolerance < 0 {
+		return VerificationPolicy{}, false, errors.New("tolerance must not be negative")
+	}
+	return policy, true, nil
+}
+
+func (app *Application) verificationPolicy(targetId string) (VerificationPolicy, bool, error) {
+	options, err := app.targetOptions(targetId)
+	if err != nil {
+		// targets without a document in data.targets are not verified
+		return VerificationPolicy{}, false, nil
+	}
+	policy, ok, err := newVerificationPolicy(options)
+	if err != nil {
+		return VerificationPolicy{}, false, errors.New("Bad verification for target " + targetId + ": " + err.Error())
+	}
+	return policy, ok, nil
+}
+
+/*
+A checkpoint of a donor sampled for re-simulation by a verifier. The files the
+verifier starts from are copied when the checkpoint is sampled, so that the
+stream's retention or a truncation cannot remove them, see VerificationDir.
+Verifications are held in memory by the SCV of the stream, and are lost if it
+restarts.
+*/
+type Verification struct {
+	Id       string       `json:"id"`
+	StreamId string       `json:"stream_id"`
+	TargetId string       `json:"target_id"`
+	User     string       `json:"user"`   // donor of the checkpoint
+	Engine   string       `json:"engine"` // of the donor's core, which the verifier's must match
+	Start    RestartPoint `json:"start"`  // the verifier starts from, partition 0 for the seed files
+	Frames   int          `json:"frames"` // to simulate from Start
+	Steps    int          `json:"steps"`  // Frames times the steps_per_frame of the stream, 0 if unknown
+	Status   string       `json:"status"` // VERIFY_PENDING or VERIFY_ASSIGNED
+	Verifier string       `json:"verifier,omitempty"`
+	Created  int          `json:"created"`
+	Deadline int          `json:"deadline,omitempty"` // unix time the verifier has to post its result
+
+	hashes    map[string]string      // SHA-256 of the donor's checkpoint files, by name
+	energy    *float64               // reported by the donor, see CheckpointRequest
+	tolerance float64                // see VerificationPolicy
+	options   map[string]interface{} // of the stream when the checkpoint was sampled
+	token     string                 // of the verifier's core while assigned
+}
+
+/*
+Compare the result of a verifier with the donor's checkpoint. Only the files
+hashed by both and the energy, if both reported one, are compared. Returns
+whether they agree and the number of values compared.
+*/
+func (v *Verification) compare(hashes map[string]string, energy *float64) (passed bool, compared int) {
+	passed = true
+	for name, sum := range hashes {
+		if expected, ok := v.hashes[name]; ok {
+			compared += 1
+			passed = passed && strings.EqualFold(expected, sum)
+		}
+	}
+	if energy != nil && v.energy != nil {
+		compared += 1
+		passed = passed && math.Abs(*energy-*v.energy) <= v.tolerance*math.Abs(*v.energy)
+	}
+	return passed, compared
+}
+
+// The verifications of this SCV, oldest first.
+type verificationQueue struct {
+	sync.Mutex
+	jobs    []*Verification
+	tokens  map[string]*Verification // of the verifiers' cores
+	records sync.Mutex               // serializes the updates of data.verifications
+}
+
+func newVerificationQueue() *verificationQueue {
+	return &verificationQueue{tokens: make(map[string]*Verification)}
+}
+
+// Number of verifications pending or assigned.
+func (q *verificationQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.jobs)
+}
+
+// Hand the verifications whose verifier went past its deadline to another
+// one, and drop those that waited for one for too long. Returns the ids of the
+// dropped verifications. The queue must be locked.
+func (q *verificationQueue) prune(now time.Time) []string {
+	dropped := make([]string, 0)
+	jobs := q.jobs[:0]
+	for _, job := range q.jobs {
+		if job.Status == VERIFY_ASSIGNED && int(now.Unix()) >= job.Deadline {
+			delete(q.tokens, job.token)
+			job.Status, job.Verifier, job.Deadline, job.token = VERIFY_PENDING, "", 0, ""
+		}
+		if job.Status == VERIFY_PENDING && int(now.Unix()) >= job.Created+VERIFICATION_TTL {
+			dropped = append(dropped, job.Id)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	q.jobs = jobs
+	return dropped
+}
+
+// Queue a verification unless the queue is full. Returns the ids of the
+// verifications dropped meanwhile, see prune.
+func (q *verificationQueue) push(job *Verification, now time.Time) (bool, []string) {
+	q.Lock()
+	defer q.Unlock()
+	dropped := q.prune(now)
+	if len(q.jobs) >= MAX_VERIFICATIONS {
+		return false, dropped
+	}
+	q.jobs = append(q.jobs, job)
+	return true, dropped
+}
+
+// Assign the oldest pending verification of engine that is not of user's own
+// checkpoints to user. Returns a copy of the verification, if any, and the ids
+// of the verifications dropped meanwhile.
+func (q *verificationQueue) claim(user, engine string, now time.Time) (*Verification, []string) {
+	q.Lock()
+	defer q.Unlock()
+	dropped := q.prune(now)
+	for _, job := range q.jobs {
+		if job.Status != VERIFY_PENDING || job.Engine != engine || job.User == user {
+			continue
+		}
+		job.Status = VERIFY_ASSIGNED
+		job.Verifier = user
+		job.Deadline = int(now.Unix()) + VERIFICATION_TIMEOUT
+		job.token = RandSecret(36)
+		q.tokens[job.token] = job
+		claimed := *job
+		return &claimed, dropped
+	}
+	return nil, dropped
+}
+
+// Returns a copy of the verification assigned to the core of token.
+func (q *verificationQueue) get(token string) (*Verification, bool) {
+	q.Lock()
+	defer q.Unlock()
+	job, ok := q.tokens[token]
+	if ok == false {
+		return nil, false
+	}
+	assigned := *job
+	return &assigned, true
+}
+
+// Returns true if a verification is assigned to the core of token.
+func (q *verificationQueue) has(token string) bool {
+	q.Lock()
+	defer q.Unlock()
+	_, ok := q.tokens[token]
+	return ok
+}
+
+// Remove the verification assigned to the core of token once its result is
+// in. Returns false if it is no longer assigned to it.
+func (q *verificationQueue) finish(token string) bool {
+	q.Lock()
+	defer q.Unlock()
+	job, ok := q.tokens[token]
+	if ok == false {
+		return false
+	}
+	delete(q.tokens, token)
+	for i, other := range q.jobs {
+		if other == job {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Returns copies of the verifications.
+func (q *verificationQueue) list() []Verification {
+	q.Lock()
+	defer q.Unlock()
+	jobs := make([]Verification, len(q.jobs))
+	for i, job := range q.jobs {
+		jobs[i] = *job
+	}
+	return jobs
+}
+
+// Directory of the files verifiers start from, one JSON file per verification.
+func (app *Application) VerificationDir() string {
+	return filepath.Join(app.Config.Name+"_data", "verifications")
+}
+
+func (app *Application) verificationFiles(id string) string {
+	return filepath.Join(app.VerificationDir(), id+".json")
+}
+
+func (app *Application) removeVerifications(ids []string) {
+	for _, id := range ids {
+		os.Remove(app.verificationFiles(id))
+	}
+}
+
+/*
+Sample the checkpoint of frames frames just moved into checkpointDir for
+verification, according to the target's VerificationPolicy. Must be called
+before the stream's frames are updated and its retention is applied, since the
+verifier starts from the stream's previous checkpoint. Failures are logged, the
+checkpoint is not affected. The stream must be active and locked.
+*/
+func (app *Application) sampleVerification(s *Stream, checkpointDir string, frames int, energy *float64) {
+	if s.ActiveStream.User == "" {
+		// anonymous donors cannot be flagged
+		return
+	}
+	policy, ok, err := app.verificationPolicy(s.TargetId)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if ok == false || rand.Float64() >= policy.Rate || app.verifications.len() >= MAX_VERIFICATIONS {
+		return
+	}
+	checksums, err := readChecksums(checkpointDir)
+	if err != nil {
+		log.Println("Unable to sample checkpoint of stream "+s.StreamId+":", err)
+		return
+	}
+	hashes := make(map[string]string)
+	for name, sum := range checksums {
+		if strings.HasPrefix(name, "checkpoint_files/") {
+			hashes[strings.TrimPrefix(name, "checkpoint_files/")] = sum
+		}
+	}
+	if len(hashes) == 0 && energy == nil {
+		return
+	}
+	job := &Verification{
+		Id:        RandSeq(12),
+		StreamId:  s.StreamId,
+		TargetId:  s.TargetId,
+		User:      s.ActiveStream.User,
+		Engine:    s.ActiveStream.Engine,
+		Frames:    frames,
+		Status:    VERIFY_PENDING,
+		Created:   int(time.Now().Unix()),
+		hashes:    hashes,
+		energy:    energy,
+		tolerance: policy.Tolerance,
+	}
+	var files map[string]string
+	if s.Frames > 0 {
+		checkpoint, err := app.lastCheckpoint(s, s.Frames)
+		if err != nil {
+			log.Println("Unable to sample checkpoint of stream "+s.StreamId+":", err)
+			return
+		}
+		job.Start = RestartPoint{s.Frames, checkpoint}
+		if files, err = app.readCheckpoint(s.StreamId, job.Start); err != nil {
+			log.Println("Unable to sample checkpoint of stream "+s.StreamId+":", err)
+			return
+		}
+	}
+	if files, err = app.withSeedFiles(s.StreamId, files); err != nil {
+		log.Println("Unable to sample checkpoint of stream "+s.StreamId+":", err)
+		return
+	}
+	options, err := app.targetOptions(s.TargetId)
+	if err != nil {
+		options = nil
+	}
+	job.options = mergeOptions(options, s.Options)
+	job.Steps = optionInt(job.options, "steps_per_frame", 0) * frames
+	data, err := json.Marshal(files)
+	if err == nil {
+		os.MkdirAll(app.VerificationDir(), 0776)
+		err = writeFileAtomic(app.verificationFiles(job.Id), data, 0666)
+	}
+	if err != nil {
+		log.Println("Unable to sample checkpoint of stream "+s.StreamId+":", err)
+		return
+	}
+	queued, dropped := app.verifications.push(job, time.Now())
+	if queued == false {
+		dropped = append(dropped, job.Id)
+	}
+	app.removeVerifications(dropped)
+}
+
+// Verification results of a donor, stored in data.verifications.
+type DonorVerifications struct {
+	User    string `json:"user" bson:"_id"`
+	Passed  int    `json:"passed" bson:"passed"`
+	Failed  int    `json:"failed" bson:"failed"`
+	Flagged bool   `json:"flagged" bson:"flagged"` // see VERIFICATION_FLAG_FAILURES
+	Updated int    `json:"updated" bson:"updated"`
+}
+
+// Add the result of a verification to the record of the donor of the
+// checkpoint, flagging the donor if its checkpoints keep failing.
+func (app *Application) recordVerification(user string, passed bool) (DonorVerifications, error) {
+	app.verifications.records.Lock()
+	defer app.verifications.records.Unlock()
+	record, err := app.Database.DonorVerifications(user)
+	if err == ErrNotFound {
+		record = DonorVerifications{User: user}
+	} else if err != nil {
+		return record, err
+	}
+	if passed {
+		record.Passed += 1
+	} else {
+		record.Failed += 1
+	}
+	flagged := record.Failed >= VERIFICATION_FLAG_FAILURES && record.Failed > record.Passed
+	if flagged && record.Flagged == false {
+		log.Printf("Donor %s flagged after failing %d of %d verifications", user, record.Failed, record.Failed+record.Passed)
+	}
+	record.Flagged = flagged
+	record.Updated = int(time.Now().Unix())
+	return record, app.Database.UpsertDonorVerifications(&record)
+}
+
+// Returns the URL cores of verifiers start from.
+func (app *Application) coreVerificationURL() string {
+	return strings.TrimSuffix(app.coreStartURL(), "/core/start") + "/core/verification/start"
+}
+
+/*
+.. http:post:: /verifications/activate
+    Assign the oldest pending verification of the engine to a core of a
+    trusted donor, one of the ``Verifiers`` of the configuration. The
+    core then gets the files to start from at ``url``, re-simulates
+    ``frames`` frames, and posts the hashes of its checkpoint files and
+    its energy to ``/core/verification/result``. Donors never verify
+    their own checkpoints.
+    .. note:: This request can only be made by CCs.
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "user": "proteneer",
+            "engine": "openmm_60_opencl"
+        }
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "id": "verification_id",
+            "token": "uuid token",
+            "url": "https://raynor.stanford.edu:1234/core/verification/start",
+            "expires": 1404509230 // the result must be posted by then
+        }
+    :status 200: OK
+    :status 400: Bad request
+    :status 401: Not authenticated as a CC
+    :status 403: ``user`` is not a verifier, or ``user`` or ``engine``
+        is banned
+    :status 404: No verification pending for the engine
+*/
+func (app *Application) VerificationActivateHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if app.isCC(r) == false {
+			return ErrUnauthorized
+		}
+		msg := VerificationActivateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return errors.New("Bad request: " + err.Error())
+		}
+		if msg.User == "" || containsString(app.Settings().Verifiers, msg.User) == false {
+			return ErrForbidden.With("Donor " + msg.User + " is not a verifier")
+		}
+		if err := app.checkBan(msg.User, msg.Engine); err != nil {
+			return err
+		}
+		job, dropped := app.verifications.claim(msg.User, msg.Engine, time.Now())
+		app.removeVerifications(dropped)
+		if job == nil {
+			return ErrNotFound.With("No verification pending for engine " + msg.Engine)
+		}
+		data, err := json.Marshal(VerificationActivateReply{
+			Id:      job.Id,
+			Token:   job.token,
+			URL:     app.coreVerificationURL(),
+			Expires: job.Deadline,
+		})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:get:: /core/verification/start
+    Get the files a verifier starts from, like ``/core/start``, and how
+    far it has to simulate.
+    :reqheader Authorization: token returned by ``/verifications/activate``
+    :reqheader Accept-Encoding: gzip (optional)
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "id": "verification_id",
+            "stream_id": "uuid4",
+            "target_id": "uuid4",
+            "files": {
+                "state.xml.gz.b64": "content.b64",
+                "system.xml.gz.b64": "content.b64"
+            },
+            "options": {"steps_per_frame": 50000},
+            "frames": 10,
+            "steps": 500000 // 0 if the target has no steps_per_frame
+        }
+    :status 200: OK
+    :status 401: Invalid token, or the verification was handed to
+        another core
+*/
+func (app *Application) CoreVerificationStartHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		job, ok := app.verifications.get(r.Header.Get("Authorization"))
+		if ok == false {
+			return ErrUnauthorized
+		}
+		files := make(map[string]string)
+		data, err := ioutil.ReadFile(app.verificationFiles(job.Id))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &files); err != nil {
+			return err
+		}
+		data, err = json.Marshal(VerificationStartReply{
+			Id:       job.Id,
+			StreamId: job.StreamId,
+			TargetId: job.TargetId,
+			Files:    files,
+			Options:  job.options,
+			Frames:   job.Frames,
+			Steps:    job.Steps,
+		})
+		if err != nil {
+			return err
+		}
+		if acceptsGzip(r) {
+			if data, err = gzipBytes(data); err != nil {
+				return err
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:put:: /core/verification/result
+    Post the result of a verification. The SHA-256 hexdigests of the
+    verifier's checkpoint files are compared with those of the donor's
+    checkpoint, and its energy with the donor's within the ``tolerance``
+    of the target's ``verification`` option. The donor's record in
+    ``data.verifications`` is updated, and the donor is flagged once
+    it failed at least 3 verifications, and more than it passed.
+    :reqheader Authorization: token returned by ``/verifications/activate``
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "hashes": {"state.xml": "sha256 hexdigest"}, // optional
+            "energy": -51234.5 // optional, kJ/mol
+        }
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "status": "failed" // or passed
+        }
+    :status 200: OK
+    :status 400: Bad request, or nothing the donor reported could be
+        compared
+    :status 401: Invalid token, or the verification was handed to
+        another core
+*/
+func (app *Application) CoreVerificationResultHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		token := r.Header.Get("Authorization")
+		job, ok := app.verifications.get(token)
+		if ok == false {
+			return ErrUnauthorized
+		}
+		msg := VerificationResultRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return errors.New("Bad request: " + err.Error())
+		}
+		passed, compared := job.compare(msg.Hashes, msg.Energy)
+		if compared == 0 {
+			return errors.New("Bad request: neither the hashes nor the energy can be compared with the donor's")
+		}
+		if app.verifications.finish(token) == false {
+			return ErrUnauthorized
+		}
+		app.removeVerifications([]string{job.Id})
+		reply := VerificationResultReply{Status: VERIFY_PASSED}
+		if passed == false {
+			reply.Status = VERIFY_FAILED
+		}
+		if _, err := app.recordVerification(job.User, passed); err != nil {
+			log.Println("Unable to record verification of donor "+job.User+":", err)
+		}
+		data, err := json.Marshal(reply)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:get:: /admin/verifications
+    List the verifications of this SCV and the donors flagged by
+    verifications so far.
+    .. note:: This request can only be made by CCs.
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "verifications": [
+                {
+                    "id": "verification_id",
+                    "stream_id": "uuid4",
+                    "target_id": "uuid4",
+                    "user": "jesse_v",
+                    "engine": "openmm_60_opencl",
+                    "start": {"partition": 20, "checkpoint": 0},
+                    "frames": 10,
+                    "steps": 500000,
+                    "status": "assigned", // or pending
+                    "verifier": "proteneer",
+                    "created": 1404505630,
+                    "deadline": 1404509230
+                }
+            ],
+            "flagged": [
+                {
+                    "user": "cheater",
+                    "passed": 1,
+                    "failed": 4,
+                    "flagged": true,
+                    "updated": 1404505630
+                }
+            ]
+        }
+    :status 200: OK
+    :status 401: Not authenticated as a CC
+*/
+func (app *Application) ListVerificationsHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if app.isCC(r) == false {
+			return ErrUnauthorized
+		}
+		flagged, err := app.Database.FlaggedDonors()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(VerificationsReply{
+			Verifications: app.verifications.list(),
+			Flagged:       flagged,
+		})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
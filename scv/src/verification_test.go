@@ -0,0 +1,183 @@
+package scv
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewVerificationPolicy(t *testing.T) {
+	_, ok, err := newVerificationPolicy(map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	policy, ok, err := newVerificationPolicy(map[string]interface{}{
+		"verification": map[string]interface{}{"rate": 0.5},
+	})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, policy, VerificationPolicy{0.5, VERIFICATION_TOLERANCE})
+	for _, config := range []map[string]interface{}{
+		{"rate": 0.0},
+		{"rate": 2.0},
+		{"rate": 0.5, "tolerance": -1.0},
+	} {
+		_, _, err = newVerificationPolicy(map[string]interface{}{"verification": config})
+		assert.NotNil(t, err)
+	}
+}
+
+func TestVerificationQueue(t *testing.T) {
+	q := newVerificationQueue()
+	now := time.Now()
+	energy := -100.0
+	job := &Verification{Id: "a", User: "joe", Engine: "openmm", Status: VERIFY_PENDING, Created: int(now.Unix()),
+		hashes: map[string]string{"state.xml": "abc"}, energy: &energy, tolerance: 0.01}
+	queued, _ := q.push(job, now)
+	assert.True(t, queued)
+
+	// donors do not verify their own checkpoints
+	claimed, _ := q.claim("joe", "openmm", now)
+	assert.Nil(t, claimed)
+	claimed, _ = q.claim("bob", "opencl", now)
+	assert.Nil(t, claimed)
+	claimed, _ = q.claim("bob", "openmm", now)
+	assert.Equal(t, claimed.Verifier, "bob")
+	assert.Equal(t, claimed.Status, VERIFY_ASSIGNED)
+	other, _ := q.claim("ann", "openmm", now)
+	assert.Nil(t, other)
+
+	// lapsed assignments are handed to another verifier
+	later := now.Add(time.Duration(VERIFICATION_TIMEOUT) * time.Second)
+	other, _ = q.claim("ann", "openmm", later)
+	assert.Equal(t, other.Verifier, "ann")
+	_, ok := q.get(claimed.token)
+	assert.False(t, ok)
+	assert.False(t, q.finish(claimed.token))
+	assert.True(t, q.finish(other.token))
+	assert.Equal(t, q.len(), 0)
+
+	// as are the checkpoints nobody verified
+	q.push(&Verification{Id: "b", Status: VERIFY_PENDING, Created: int(now.Unix())}, now)
+	_, dropped := q.claim("ann", "openmm", now.Add(time.Duration(VERIFICATION_TTL)*time.Second))
+	assert.Equal(t, dropped, []string{"b"})
+
+	passed, compared := job.compare(map[string]string{"state.xml": "ABC", "other.xml": "def"}, nil)
+	assert.True(t, passed)
+	assert.Equal(t, compared, 1)
+	close := -100.5
+	passed, compared = job.compare(nil, &close)
+	assert.True(t, passed)
+	assert.Equal(t, compared, 1)
+	far := -102.0
+	passed, compared = job.compare(map[string]string{"state.xml": "abc"}, &far)
+	assert.False(t, passed)
+	assert.Equal(t, compared, 2)
+	_, compared = job.compare(map[string]string{"other.xml": "def"}, nil)
+	assert.Equal(t, compared, 0)
+}
+
+func TestVerifications(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "verifications")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(filepath.Join(dir, "db"), "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	app := &Application{
+		Config:        Configuration{Name: filepath.Join(dir, "scv"), Password: "cc", Verifiers: []string{"bob"}},
+		Database:      db,
+		optionsCache:  NewResultCache(time.Minute),
+		banCache:      NewResultCache(time.Minute),
+		verifications: newVerificationQueue(),
+	}
+	app.banCache.Put("bans", []Ban{})
+	app.optionsCache.Put("options:target", map[string]interface{}{
+		"steps_per_frame": 100.0,
+		"verification":    map[string]interface{}{"rate": 1.0},
+	})
+	stream := newStream("stream", "target", "owner", 0, 0, 0)
+	stream.ActiveStream = &ActiveStream{User: "joe", Engine: "openmm", Data: newSessionState()}
+	os.MkdirAll(filepath.Join(app.StreamDir("stream"), "files"), 0776)
+	ioutil.WriteFile(filepath.Join(app.StreamDir("stream"), "files", "system.xml"), []byte("system"), 0666)
+	checkpointDir := filepath.Join(app.StreamDir("stream"), "10", "0")
+	os.MkdirAll(filepath.Join(checkpointDir, "checkpoint_files"), 0776)
+	ioutil.WriteFile(filepath.Join(checkpointDir, "checkpoint_files", "state.xml"), []byte("state"), 0666)
+	assert.Nil(t, writeChecksums(checkpointDir))
+	sum, _ := sha256File(filepath.Join(checkpointDir, "checkpoint_files", "state.xml"))
+	energy := -100.0
+	sample := func() {
+		app.sampleVerification(stream, checkpointDir, 10, &energy)
+	}
+
+	serve := func(handler AppHandler, method, path, token string, body interface{}, reply interface{}) int {
+		data, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewReader(data))
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if reply != nil {
+			json.Unmarshal(w.Body.Bytes(), reply)
+		}
+		return w.Code
+	}
+	activate := func(user string) (VerificationActivateReply, int) {
+		reply := VerificationActivateReply{}
+		code := serve(app.VerificationActivateHandler(), "POST", "/verifications/activate", "cc",
+			VerificationActivateRequest{User: user, Engine: "openmm"}, &reply)
+		return reply, code
+	}
+	result := func(token string, msg VerificationResultRequest) (string, int) {
+		reply := VerificationResultReply{}
+		code := serve(app.CoreVerificationResultHandler(), "PUT", "/core/verification/result", token, msg, &reply)
+		return reply.Status, code
+	}
+
+	_, code := activate("bob")
+	assert.Equal(t, code, 404)
+	sample()
+	_, code = activate("ann")
+	assert.Equal(t, code, 403)
+	job, code := activate("bob")
+	assert.Equal(t, code, 200)
+
+	start := VerificationStartReply{}
+	assert.Equal(t, serve(app.CoreVerificationStartHandler(), "GET", "/core/verification/start", job.Token, nil, &start), 200)
+	assert.Equal(t, start.StreamId, "stream")
+	assert.Equal(t, start.Frames, 10)
+	assert.Equal(t, start.Steps, 1000)
+	assert.Equal(t, len(start.Files), 1)
+	assert.Equal(t, serve(app.CoreVerificationStartHandler(), "GET", "/core/verification/start", "bogus", nil, nil), 401)
+
+	_, code = result(job.Token, VerificationResultRequest{Hashes: map[string]string{"other.xml": sum}})
+	assert.Equal(t, code, 400)
+	status, code := result(job.Token, VerificationResultRequest{Hashes: map[string]string{"state.xml": sum}, Energy: &energy})
+	assert.Equal(t, code, 200)
+	assert.Equal(t, status, VERIFY_PASSED)
+	_, code = result(job.Token, VerificationResultRequest{Energy: &energy})
+	assert.Equal(t, code, 401)
+	_, err = os.Stat(app.verificationFiles(job.Id))
+	assert.True(t, os.IsNotExist(err))
+
+	// donors failing most of their verifications are flagged
+	wrong := -200.0
+	for i := 0; i < VERIFICATION_FLAG_FAILURES; i++ {
+		sample()
+		job, _ := activate("bob")
+		status, _ := result(job.Token, VerificationResultRequest{Energy: &wrong})
+		assert.Equal(t, status, VERIFY_FAILED)
+	}
+	reply := VerificationsReply{}
+	assert.Equal(t, serve(app.ListVerificationsHandler(), "GET", "/admin/verifications", "cc", nil, &reply), 200)
+	assert.Equal(t, len(reply.Verifications), 0)
+	assert.Equal(t, len(reply.Flagged), 1)
+	assert.Equal(t, reply.Flagged[0].User, "joe")
+	assert.Equal(t, reply.Flagged[0].Passed, 1)
+	assert.Equal(t, reply.Flagged[0].Failed, 3)
+}
@@ -0,0 +1,73 @@
+package scv
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+Compare two dotted engine versions, returning -1, 0 or 1. Components are
+compared as numbers when both are, so that 6.10 is newer than 6.9, and as
+strings otherwise. Missing components count as 0, so 6.1 equals 6.1.0. The
+empty version is older than any other.
+*/
+func compareVersions(a, b string) int {
+	if a == "" || b == "" {
+		return strings.Compare(a, b)
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		m, errX := strconv.Atoi(x)
+		n, errY := strconv.Atoi(y)
+		switch {
+		case errX == nil && errY == nil && m < n:
+			return -1
+		case errX == nil && errY == nil && m > n:
+			return 1
+		case errX != nil || errY != nil:
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+// Returns the error replied to a core whose engine is older than the minimum
+// version of a target.
+func upgradeRequired(engine, version, minVersion string) error {
+	current := version
+	if current == "" {
+		current = "unknown"
+	}
+	return ErrUpgradeRequired.WithDetails(
+		"Engine "+engine+" "+current+" is too old, version "+minVersion+" or newer is required",
+		map[string]string{
+			"engine":             engine,
+			"engine_version":     version,
+			"min_engine_version": minVersion,
+		})
+}
+
+// Returns ErrUpgradeRequired if the core's engine is older than the
+// "min_engine_version" option of the target. Cores that do not send their
+// version are assumed to be too old for targets that set one.
+func (app *Application) checkEngineVersion(targetId, engine, version string) error {
+	options, err := app.targetOptions(targetId)
+	if err != nil {
+		// left to the activation, eg. targets without a document
+		return nil
+	}
+	minVersion := optionString(options, "min_engine_version", "")
+	if minVersion != "" && compareVersions(version, minVersion) < 0 {
+		return upgradeRequired(engine, version, minVersion)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package scv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, compareVersions("6.10", "6.9"), 1)
+	assert.Equal(t, compareVersions("6.1", "6.1.0"), 0)
+	assert.Equal(t, compareVersions("6.1", "6.1.1"), -1)
+	assert.Equal(t, compareVersions("6.1b", "6.1a"), 1)
+	assert.Equal(t, compareVersions("", "1"), -1)
+	assert.Equal(t, compareVersions("", ""), 0)
+}
+
+func TestCheckEngineVersion(t *testing.T) {
+	app := &Application{optionsCache: NewResultCache(time.Minute)}
+	app.optionsCache.Put("options:target", map[string]interface{}{"min_engine_version": "6.1"})
+	assert.Nil(t, app.checkEngineVersion("target", "openmm", "6.1.2"))
+	err := app.checkEngineVersion("target", "openmm", "6.0")
+	assert.Equal(t, err.(*StatusError).Status, 426)
+	assert.Equal(t, err.(*StatusError).Details["min_engine_version"], "6.1")
+	// cores that do not report their version are too old
+	assert.NotNil(t, app.checkEngineVersion("target", "openmm", ""))
+	app.optionsCache.Put("options:other", map[string]interface{}{})
+	assert.Nil(t, app.checkEngineVersion("other", "openmm", ""))
+}
@@ -0,0 +1,403 @@
+package scv
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Seconds a webhook endpoint has to reply.
+const WEBHOOK_TIMEOUT int = 10
+
+// Attempts at delivering an event to a webhook before it is dropped.
+const WEBHOOK_ATTEMPTS int = 5
+
+// Seconds before the first retry of a delivery, doubled on every retry.
+const WEBHOOK_BACKOFF int = 5
+
+// Number of concurrent deliveries, and of deliveries queued per worker before
+// events are dropped.
+const WEBHOOK_WORKERS int = 4
+const WEBHOOK_QUEUE_SIZE int = 256
+
+// Events webhooks can be registered for. The other events of a stream are
+// sent too often to be POSTed, see /events.
+var webhookEvents = []string{
+	EVENT_DISABLED, EVENT_ERRORED, EVENT_QUARANTINED, EVENT_COMPLETED,
+	EVENT_MILESTONE, EVENT_ENABLED, EVENT_DELETED, EVENT_UNDELETED,
+	EVENT_CORRUPTED, EVENT_REWOUND, EVENT_NOTICE,
+}
+
+// Events of webhooks registered without a list of events.
+var defaultWebhookEvents = []string{EVENT_DISABLED, EVENT_ERRORED, EVENT_COMPLETED, EVENT_MILESTONE}
+
+var webhookClient = newWebhookClient()
+
+// Returns an error if a webhook would be POSTed to an address that is not
+// public, such as a service only reachable from the SCV. It is checked once
+// the URL's host has been resolved, so that a name cannot be made to point to
+// such an address after the webhook was registered.
+func checkWebhookAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return errors.New("webhook address " + host + " is not public")
+	}
+	return nil
+}
+
+// The client webhooks are POSTed with. It only connects to public addresses,
+// never through a proxy, and does not follow redirects, which could lead
+// anywhere.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: time.Duration(WEBHOOK_TIMEOUT) * time.Second,
+		Control: checkWebhookAddress,
+	}
+	return &http.Client{
+		Timeout:   time.Duration(WEBHOOK_TIMEOUT) * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+/*
+A webhook POSTs the events of the streams of a target to a URL, on every SCV.
+Webhooks are stored in data.webhooks and shared by every SCV. Payloads are
+signed with the webhook's secret, which is only replied when the webhook is
+registered.
+*/
+type Webhook struct {
+	Id       string   `json:"id" bson:"_id"`
+	TargetId string   `json:"target_id" bson:"target_id"`
+	URL      string   `json:"url" bson:"url"`
+	Events   []string `json:"events" bson:"events"`
+	Secret   string   `json:"secret,omitempty" bson:"secret"`
+	Owner    string   `json:"owner" bson:"owner"` // manager that registered it
+	Created  int      `json:"created" bson:"created"`
+}
+
+func (h *Webhook) Matches(e Event) bool {
+	return e.TargetId == h.TargetId && containsString(h.Events, e.Type)
+}
+
+// An event to POST to a webhook.
+type webhookDelivery struct {
+	hook    Webhook
+	id      string // identifies the delivery across its attempts
+	event   Event
+	body    []byte
+	attempt int
+}
+
+// Returns the signature of a payload sent with secret, as in the
+// X-Siegetank-Signature header.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// POST the event of a delivery once. Endpoints must reply with a 2xx.
+func (d *webhookDelivery) post() error {
+	req, err := http.NewRequest("POST", d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Siegetank-Event", d.event.Type)
+	req.Header.Set("X-Siegetank-Delivery", d.id)
+	req.Header.Set("X-Siegetank-Signature", signWebhook(d.hook.Secret, d.body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body so that the connection is reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("endpoint replied " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// Returns the webhooks of a target, cached for TARGET_OPTIONS_TTL seconds, and
+// for as long as the database cannot be reached.
+func (app *Application) webhooks(targetId string) ([]Webhook, error) {
+	key := "webhooks:" + targetId
+	if cached, ok := app.optionsCache.Get(key); ok {
+		return cached.([]Webhook), nil
+	}
+	hooks, err := app.Database.Webhooks(targetId)
+	if err != nil {
+		if stale, ok := app.optionsCache.GetStale(key); ok && isTransient(err) {
+			return stale.([]Webhook), nil
+		}
+		return nil, err
+	}
+	app.optionsCache.Put(key, hooks)
+	return hooks, nil
+}
+
+// Queue a delivery without blocking, dropping it if the queue is full.
+func queueWebhook(queue chan *webhookDelivery, d *webhookDelivery) {
+	select {
+	case queue <- d:
+	default:
+		log.Println("Webhook queue full, dropping " + d.event.Type + " event of stream " + d.event.StreamId)
+	}
+}
+
+// Deliver the queued events until the SCV shuts down. Failed deliveries are
+// retried with an exponential backoff.
+func (app *Application) deliverWebhooks(queue chan *webhookDelivery) {
+	for {
+		select {
+		case <-app.finish:
+			return
+		case d := <-queue:
+			err := d.post()
+			if err == nil {
+				continue
+			}
+			d.attempt += 1
+			if d.attempt >= WEBHOOK_ATTEMPTS {
+				log.Println("Unable to deliver webhook "+d.hook.Id+":", err)
+				continue
+			}
+			backoff := time.Duration(WEBHOOK_BACKOFF<<uint(d.attempt-1)) * time.Second
+			time.AfterFunc(backoff, func() { queueWebhook(queue, d) })
+		}
+	}
+}
+
+// A separate goroutine that POSTs the events of the streams of this SCV to the
+// webhooks of their targets.
+func (app *Application) RunWebhooks() {
+	defer app.workerWG.Done()
+	sub := app.events.SubscribeTypes(webhookEvents)
+	defer app.events.Unsubscribe(sub)
+	queue := make(chan *webhookDelivery, WEBHOOK_WORKERS*WEBHOOK_QUEUE_SIZE)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for i := 0; i < WEBHOOK_WORKERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			app.deliverWebhooks(queue)
+		}()
+	}
+	for {
+		select {
+		case <-app.finish:
+			return
+		case e := <-sub.C:
+			hooks, err := app.webhooks(e.TargetId)
+			if err != nil {
+				log.Println("Unable to read webhooks of target "+e.TargetId+":", err)
+				continue
+			}
+			body, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			for _, hook := range hooks {
+				if hook.Matches(e) {
+					queueWebhook(queue, &webhookDelivery{hook: hook, id: RandSeq(12), event: e, body: body})
+				}
+			}
+		}
+	}
+}
+
+/*
+.. http:post:: /targets/:target_id/webhooks
+    Register a URL to be POSTed the events of the streams of a target,
+    on every SCV.
+    :reqheader Authorization: Manager's authorization token
+    **Example request**
+    .. sourcecode:: javascript
+        {
+            "url": "https://workflow.example.org/hooks/siegetank",
+            "events": ["disabled", "errored", "completed"] // optional
+        }
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "id": "webhook_id",
+            "target_id": "target_id",
+            "url": "https://workflow.example.org/hooks/siegetank",
+            "events": ["disabled", "errored", "completed"],
+            "secret": "KgCGC7uXKqlrFj5xQrQVxPKFTsXrX6Yd",
+            "owner": "proteneer",
+            "created": 1404502030
+        }
+    .. note:: ``events`` may hold disabled, errored, quarantined,
+        completed, milestone, enabled, deleted, undeleted, corrupted,
+        rewound and notice, see ``/events``. It defaults to disabled,
+        errored, completed and milestone.
+    .. note:: The body of each POST is the event as sent by
+        ``/events``. The ``X-Siegetank-Event`` header holds its type,
+        ``X-Siegetank-Delivery`` identifies the delivery across retries,
+        and ``X-Siegetank-Signature`` is ``sha256=`` followed by the hex
+        HMAC-SHA256 of the body keyed by the webhook's ``secret``, which
+        is only replied here.
+    .. note:: Endpoints must reply with a 2xx within 10 seconds. Failed
+        deliveries are retried 4 times, 5 seconds later then twice as
+        late each time. Redirects are not followed, and URLs resolving
+        to loopback, private or link-local addresses fail.
+    :status 200: OK
+    :status 400: Bad request
+    :status 403: The target belongs to another namespace
+*/
+func (app *Application) PostWebhookHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		targetId := mux.Vars(r)["target_id"]
+		msg := struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			return errors.New("Bad request: " + err.Error())
+		}
+		u, err := url.Parse(msg.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("url must be an http or https URL")
+		}
+		if len(msg.Events) == 0 {
+			msg.Events = defaultWebhookEvents
+		}
+		for _, eventType := range msg.Events {
+			if containsString(webhookEvents, eventType) == false {
+				return errors.New("Bad event: " + eventType)
+			}
+		}
+		if err := app.checkTarget(targetId, user); err != nil {
+			return err
+		}
+		hook := Webhook{
+			Id:       RandSeq(12),
+			TargetId: targetId,
+			URL:      msg.URL,
+			Events:   msg.Events,
+			Secret:   RandSecret(32),
+			Owner:    user,
+			Created:  int(time.Now().Unix()),
+		}
+		if err := app.Database.InsertWebhook(hook); err != nil {
+			return errors.New("Unable to insert webhook into DB")
+		}
+		app.optionsCache.Delete("webhooks:" + targetId)
+		data, err := json.Marshal(hook)
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:get:: /targets/:target_id/webhooks
+    List the webhooks of a target, without their secrets.
+    :reqheader Authorization: Manager's authorization token
+    **Example reply**
+    .. sourcecode:: javascript
+        {
+            "webhooks": [
+                {
+                    "id": "webhook_id",
+                    "target_id": "target_id",
+                    "url": "https://workflow.example.org/hooks/siegetank",
+                    "events": ["disabled", "errored", "completed"],
+                    "owner": "proteneer",
+                    "created": 1404502030
+                }
+            ]
+        }
+    :status 200: OK
+    :status 403: The target belongs to another namespace
+*/
+func (app *Application) ListWebhooksHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		targetId := mux.Vars(r)["target_id"]
+		if err := app.checkTarget(targetId, user); err != nil {
+			return err
+		}
+		hooks, err := app.Database.Webhooks(targetId)
+		if err != nil {
+			return err
+		}
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		data, err := json.Marshal(map[string]interface{}{"webhooks": hooks})
+		if err != nil {
+			return err
+		}
+		w.Write(data)
+		return nil
+	}
+}
+
+/*
+.. http:delete:: /targets/:target_id/webhooks/:id
+    Remove a webhook. Events already queued may still be delivered.
+    :reqheader Authorization: Manager's authorization token
+    :status 200: OK
+    :status 403: The target belongs to another namespace
+    :status 404: Webhook not found
+*/
+func (app *Application) RemoveWebhookHandler() AppHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, auth_err := app.CurrentManager(r)
+		if auth_err != nil {
+			return auth_err
+		}
+		targetId := mux.Vars(r)["target_id"]
+		if err := app.checkTarget(targetId, user); err != nil {
+			return err
+		}
+		hook, err := app.Database.Webhook(mux.Vars(r)["id"])
+		if err != nil {
+			return err
+		}
+		if hook.TargetId != targetId {
+			return ErrNotFound.With("Webhook not found")
+		}
+		if err := app.Database.RemoveWebhook(hook.Id); err != nil {
+			return err
+		}
+		app.optionsCache.Delete("webhooks:" + targetId)
+		return nil
+	}
+}
@@ -0,0 +1,87 @@
+package scv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunWebhooks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "webhooks")
+	defer os.RemoveAll(dir)
+	db, err := OpenEmbeddedDatabase(dir, "scv")
+	assert.Nil(t, err)
+	defer db.Close()
+	received := make(chan *http.Request, 4)
+	bodies := make(chan []byte, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+	// the test server only listens on the loopback
+	defer func(client *http.Client) { webhookClient = client }(webhookClient)
+	webhookClient = server.Client()
+	assert.Nil(t, db.InsertWebhook(Webhook{Id: "h1", TargetId: "t1", URL: server.URL, Events: defaultWebhookEvents, Secret: "secret"}))
+	app := &Application{
+		Database:     db,
+		events:       NewEventBus(),
+		optionsCache: NewResultCache(time.Minute),
+		finish:       make(chan struct{}),
+	}
+	app.workerWG.Add(1)
+	go app.RunWebhooks()
+	defer app.workerWG.Wait()
+	defer close(app.finish)
+	// wait for the subscription
+	for app.events.Metrics()["subscribers"] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	app.events.Publish(NewEvent(EVENT_FRAME, &Stream{StreamId: "s1", TargetId: "t1"}, nil))
+	app.events.Publish(NewEvent(EVENT_DISABLED, &Stream{StreamId: "s2", TargetId: "t2"}, nil))
+	app.events.Publish(NewEvent(EVENT_DISABLED, &Stream{StreamId: "s1", TargetId: "t1"}, nil))
+	select {
+	case r := <-received:
+		body := <-bodies
+		assert.Equal(t, r.Header.Get("X-Siegetank-Event"), EVENT_DISABLED)
+		assert.Equal(t, r.Header.Get("X-Siegetank-Signature"), signWebhook("secret", body))
+		e := Event{}
+		assert.Nil(t, json.Unmarshal(body, &e))
+		assert.Equal(t, e.StreamId, "s1")
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	select {
+	case <-received:
+		t.Fatal("unexpected delivery")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	}))
+	defer server.Close()
+	d := &webhookDelivery{hook: Webhook{URL: server.URL}, event: Event{Type: EVENT_DISABLED}}
+	err := d.post()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "is not public")
+
+	for _, address := range []string{"127.0.0.1:80", "[::1]:80", "10.0.0.1:80", "192.168.1.1:80", "169.254.169.254:80", "[fe80::1]:80", "0.0.0.0:80"} {
+		assert.NotNil(t, checkWebhookAddress("tcp", address, nil), address)
+	}
+	assert.Nil(t, checkWebhookAddress("tcp", "171.64.65.1:443", nil))
+
+	// redirects are replied as is
+	req, _ := http.NewRequest("POST", server.URL, nil)
+	assert.Equal(t, newWebhookClient().CheckRedirect(req, []*http.Request{req}), http.ErrUseLastResponse)
+}
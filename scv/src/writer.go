@@ -0,0 +1,229 @@
+package scv
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Number of deferred writes that can be queued. Writes are dropped, and
+// logged, once the queue is full.
+const STATS_QUEUE_SIZE int = 10000
+
+// Maximum number of deferred writes sent to Mongo in a single bulk operation.
+const STATS_BATCH_SIZE int = 500
+
+// Times a write rejected by Mongo is retried before it is moved to the dead
+// letter collection.
+const STATS_MAX_RETRIES int = 5
+
+// Interval at which queued writes are flushed, even if the batch is not full.
+const STATS_FLUSH_INTERVAL time.Duration = time.Second
+
+// A write to Mongo deferred so that it does not hold up the handler, which
+// usually holds the manager and stream locks.
+type deferredOp struct {
+	db         string
+	collection string
+	indexes    []string    // indexed before the first write to the collection, each a comma separated list of keys
+	doc        interface{} // document to insert, nil for an update
+	selector   interface{}
+	update     interface{}
+	retries    int
+	err        error
+}
+
+func (op *deferredOp) key() string {
+	return op.db + "." + op.collection
+}
+
+/*
+StatsWriter batches the writes deferred by handlers, such as the stats recorded
+when a stream is deactivated, into bulk operations. A write rejected by the database is
+retried on the next flush and moved to the dead letter collection after
+STATS_MAX_RETRIES attempts, so that a single bad document does not hold up the
+others. Writes are kept in memory while the database is unreachable, see
+Database.WriteDeferred.
+*/
+type StatsWriter struct {
+	sync.Mutex
+	queue   chan *deferredOp
+	flush   chan chan struct{} // requests to flush, closed once done
+	pending []*deferredOp      // writes to retry, only used by the writer goroutine
+
+	waiting     int // len(pending), readable by Metrics
+	written     int64
+	retried     int64
+	deadLetters int64
+	dropped     int64
+}
+
+func NewStatsWriter(capacity int) *StatsWriter {
+	return &StatsWriter{
+		queue: make(chan *deferredOp, capacity),
+		flush: make(chan chan struct{}),
+	}
+}
+
+func (w *StatsWriter) enqueue(op *deferredOp) {
+	select {
+	case w.queue <- op:
+	default:
+		w.Lock()
+		w.dropped += 1
+		w.Unlock()
+		log.Printf("Stats queue is full, dropping write to %s: %v%v%v", op.key(), op.doc, op.selector, op.update)
+	}
+}
+
+// Number of writes waiting for the database, queued or being retried.
+func (w *StatsWriter) Depth() int {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.queue) + w.waiting
+}
+
+func (w *StatsWriter) Metrics() map[string]interface{} {
+	w.Lock()
+	defer w.Unlock()
+	return map[string]interface{}{
+		"queued":       len(w.queue),
+		"retrying":     w.waiting,
+		"written":      w.written,
+		"retried":      w.retried,
+		"dead_letters": w.deadLetters,
+		"dropped":      w.dropped,
+	}
+}
+
+// Insert doc into db.collection later. The collection is indexed on each of
+// indexes, a comma separated list of keys as in mgo's EnsureIndexKey, eg.
+// "user,-end_time".
+func (app *Application) deferInsert(db, collection string, indexes []string, doc bson.M) {
+	if _, ok := doc["_id"]; ok == false {
+		// retrying an insert that made it to Mongo is then harmless
+		doc["_id"] = bson.NewObjectId()
+	}
+	app.stats.enqueue(&deferredOp{db: db, collection: collection, indexes: indexes, doc: doc})
+}
+
+// Update a document of db.collection later.
+func (app *Application) deferUpdate(db, collection string, selector, update interface{}) {
+	app.stats.enqueue(&deferredOp{db: db, collection: collection, selector: selector, update: update})
+}
+
+// Write batch, after the writes left over from the previous flush.
+func (app *Application) flushStats(batch []*deferredOp) {
+	w := app.stats
+	ops := append(w.pending, batch...)
+	w.pending = nil
+	keys := make([]string, 0)
+	groups := make(map[string][]*deferredOp)
+	for _, op := range ops {
+		if _, ok := groups[op.key()]; ok == false {
+			keys = append(keys, op.key())
+		}
+		groups[op.key()] = append(groups[op.key()], op)
+	}
+	for _, key := range keys {
+		written, failed, unreachable := app.Database.WriteDeferred(groups[key])
+		for _, op := range failed {
+			if unreachable == false && op.retries >= STATS_MAX_RETRIES {
+				app.deadLetter(op)
+				continue
+			}
+			w.pending = append(w.pending, op)
+		}
+		w.Lock()
+		w.written += int64(written)
+		w.retried += int64(len(failed))
+		w.Unlock()
+	}
+	w.Lock()
+	w.waiting = len(w.pending)
+	w.Unlock()
+}
+
+func (app *Application) deadLetter(op *deferredOp) {
+	log.Printf("Giving up on write to %s after %d attempts: %v", op.key(), op.retries, op.err)
+	doc := map[string]interface{}{
+		"db":         op.db,
+		"collection": op.collection,
+		"doc":        op.doc,
+		"selector":   op.selector,
+		"update":     op.update,
+		"error":      op.err.Error(),
+		"retries":    op.retries,
+		"time":       int(time.Now().Unix()),
+	}
+	if err := app.Database.InsertDeadLetter(doc); err != nil {
+		log.Println("Unable to record dead letter:", err)
+	}
+	app.stats.Lock()
+	app.stats.deadLetters += 1
+	app.stats.Unlock()
+}
+
+// Flush every queued write and wait for it to complete.
+func (app *Application) drainStats() {
+	done := make(chan struct{})
+	select {
+	case app.stats.flush <- done:
+		<-done
+	case <-app.finish:
+	}
+}
+
+// A separate goroutine that populates MongoDB with stats entries.
+func (app *Application) RecordDeferredDocs() {
+	defer app.statsWG.Done()
+	w := app.stats
+	ticker := time.NewTicker(STATS_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	batch := make([]*deferredOp, 0)
+	// stop taking writes while too many are waiting for Mongo, the queue
+	// then fills up instead of memory
+	queue := func() chan *deferredOp {
+		if len(w.pending) >= STATS_QUEUE_SIZE {
+			return nil
+		}
+		return w.queue
+	}
+	drain := func() {
+		for {
+			select {
+			case op := <-w.queue:
+				batch = append(batch, op)
+			default:
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case <-app.finish:
+			drain()
+			app.flushStats(batch)
+			if len(w.pending) > 0 {
+				log.Printf("Unable to write %d deferred documents before shutting down", len(w.pending))
+			}
+			return
+		case op := <-queue():
+			batch = append(batch, op)
+			if len(batch) >= STATS_BATCH_SIZE {
+				app.flushStats(batch)
+				batch = make([]*deferredOp, 0)
+			}
+		case <-ticker.C:
+			app.flushStats(batch)
+			batch = make([]*deferredOp, 0)
+		case done := <-w.flush:
+			drain()
+			app.flushStats(batch)
+			batch = make([]*deferredOp, 0)
+			close(done)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package scv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestStatsWriterBounded(t *testing.T) {
+	app := &Application{stats: NewStatsWriter(2)}
+	doc := bson.M{"frames": 1}
+	app.deferInsert("stats", "target", []string{"stream"}, doc)
+	_, ok := doc["_id"].(bson.ObjectId)
+	assert.True(t, ok)
+	app.deferUpdate("streams", "scv", bson.M{"_id": "stream"}, bson.M{"$set": bson.M{"frames": 1}})
+	app.deferUpdate("streams", "scv", bson.M{"_id": "stream"}, bson.M{"$set": bson.M{"frames": 2}})
+	metrics := app.stats.Metrics()
+	assert.Equal(t, metrics["queued"], 2)
+	assert.Equal(t, metrics["dropped"], int64(1))
+	op := <-app.stats.queue
+	assert.Equal(t, op.key(), "stats.target")
+	assert.Equal(t, op.indexes, []string{"stream"})
+}
@@ -0,0 +1,178 @@
+package scv
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+)
+
+// Bytes of the header of an XTC frame up to its coordinates: magic number,
+// atoms, step, time, box and atoms again.
+const XTC_HEADER_BYTES int = 56
+
+// Bytes of the compression parameters of an XTC frame of more than 9 atoms,
+// up to its compressed coordinates: precision, bounds, smallidx and length.
+const XTC_COMPRESSION_BYTES int = 36
+
+// The header of a frame of an XTC file.
+type xtcHeader struct {
+	Atoms int
+	Step  int
+	Time  float32
+}
+
+/*
+Parse the frames of an XTC file, as written by GROMACS and OpenMM. Each frame
+must start with XTC_MAGIC, hold the same number of atoms as the first one, and
+have a step greater than the previous frame's, so that truncated, padded or
+repeated frames are refused. Coordinates are skipped, not decompressed.
+*/
+func parseXTC(data []byte) ([]xtcHeader, error) {
+	frames := make([]xtcHeader, 0)
+	for offset := 0; offset < len(data); {
+		n := strconv.Itoa(len(frames))
+		if len(data)-offset < XTC_HEADER_BYTES {
+			return nil, errors.New("frame " + n + " is truncated")
+		}
+		header := data[offset:]
+		if binary.BigEndian.Uint32(header) != XTC_MAGIC {
+			return nil, errors.New("frame " + n + " does not start with the XTC magic number")
+		}
+		frame := xtcHeader{
+			Atoms: int(int32(binary.BigEndian.Uint32(header[4:]))),
+			Step:  int(int32(binary.BigEndian.Uint32(header[8:]))),
+			Time:  math.Float32frombits(binary.BigEndian.Uint32(header[12:])),
+		}
+		if frame.Atoms <= 0 || int(int32(binary.BigEndian.Uint32(header[52:]))) != frame.Atoms {
+			return nil, errors.New("frame " + n + " has a bad number of atoms")
+		}
+		if len(frames) > 0 {
+			last := frames[len(frames)-1]
+			if frame.Atoms != last.Atoms {
+				return nil, errors.New("frame " + n + " has " + strconv.Itoa(frame.Atoms) + " atoms instead of " + strconv.Itoa(last.Atoms))
+			}
+			if frame.Step <= last.Step {
+				return nil, errors.New("step went from " + strconv.Itoa(last.Step) + " to " + strconv.Itoa(frame.Step) + " in frame " + n)
+			}
+		}
+		offset += XTC_HEADER_BYTES
+		if frame.Atoms <= 9 {
+			// small systems are stored uncompressed
+			offset += 12 * frame.Atoms
+		} else {
+			if len(data)-offset < XTC_COMPRESSION_BYTES {
+				return nil, errors.New("frame " + n + " is truncated")
+			}
+			length := int(binary.BigEndian.Uint32(data[offset+32:]))
+			// the compressed coordinates are padded to 4 bytes
+			offset += XTC_COMPRESSION_BYTES + (length+3)/4*4
+		}
+		if offset > len(data) {
+			return nil, errors.New("frame " + n + " is truncated")
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) == 0 {
+		return nil, errors.New("no frames")
+	}
+	return frames, nil
+}
+
+// The XTC frames counted in the files of an upload, see verifyFrames.
+type frameCount struct {
+	frames int            // in each XTC file of the upload
+	steps  map[string]int // last step of each XTC file
+}
+
+// Returns true if the frames posted to streams of the target are counted, as
+// set by the "verify_frames" option of the target.
+func (app *Application) verifiesFrames(targetId string) bool {
+	options, err := app.targetOptions(targetId)
+	if err != nil {
+		// targets without a document in data.targets are not verified
+		return false
+	}
+	return optionBool(options, "verify_frames", false)
+}
+
+/*
+Count the frames of the XTC files of a frame posted to a stream whose target
+verifies frames, so that cores cannot be credited for frames they did not
+compute. Every XTC file must parse, hold the number of frames reported by the
+core, and continue the steps of the previous frames of the session. Files are
+keyed by their stored name, gzipped ones are decompressed. The stream must be
+active and locked.
+*/
+func (app *Application) verifyFrames(stream *Stream, files map[string][]byte, reported int) (frameCount, error) {
+	count := frameCount{steps: make(map[string]int)}
+	if app.verifiesFrames(stream.TargetId) == false {
+		return count, nil
+	}
+	for name, data := range files {
+		root, gz := splitGz(name)
+		if filepath.Ext(root) != ".xtc" {
+			continue
+		}
+		if gz != "" {
+			var err error
+			if data, err = gunzipBytes(data); err != nil {
+				return count, errors.New("Bad request: unable to gunzip " + name + ": " + err.Error())
+			}
+		}
+		frames, err := parseXTC(data)
+		if err != nil {
+			return count, errors.New("Bad request: " + root + " is not a valid XTC file: " + err.Error())
+		}
+		if last, ok := sessionData(stream).xtcSteps[root]; ok && frames[0].Step <= last {
+			return count, errors.New("Bad request: step of " + root + " went from " + strconv.Itoa(last) + " to " + strconv.Itoa(frames[0].Step))
+		}
+		if len(frames) != reported {
+			return count, errors.New("Bad request: " + root + " holds " + strconv.Itoa(len(frames)) + " frames, not " + strconv.Itoa(reported))
+		}
+		count.frames = len(frames)
+		count.steps[root] = frames[len(frames)-1].Step
+	}
+	return count, nil
+}
+
+// Like verifyFrames, for a frame spooled to disk. Only the XTC files are read,
+// and only if the target verifies frames.
+func (app *Application) verifySpooledFrame(stream *Stream, paths map[string]string, reported int) (frameCount, error) {
+	files := make(map[string][]byte)
+	if app.verifiesFrames(stream.TargetId) {
+		for name, path := range paths {
+			if root, _ := splitGz(name); filepath.Ext(root) != ".xtc" {
+				continue
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return frameCount{}, err
+			}
+			files[name] = data
+		}
+	}
+	return app.verifyFrames(stream, files, reported)
+}
+
+/*
+Check the frames a core claims on checkpoint against those it posted, if the
+target verifies frames. The core may claim one partial frame on top of the
+buffered frames, counted in XTC frames if the frames had XTC files. The stream
+must be active and locked.
+*/
+func (app *Application) verifyDonorFrames(stream *Stream, donorFrames float64) error {
+	if app.verifiesFrames(stream.TargetId) == false {
+		return nil
+	}
+	limit := stream.ActiveStream.BufferFrames
+	if sessionData(stream).xtcFrames > limit {
+		limit = sessionData(stream).xtcFrames
+	}
+	if donorFrames >= float64(limit+1) {
+		return errors.New("Bad request: frames exceeds the " + strconv.Itoa(limit) + " frames buffered")
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package scv
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Encode an XTC file of atoms atoms with one frame per step. Coordinates of
+// more than 9 atoms are 5 bytes of garbage.
+func encodeXTC(atoms int, steps ...int) []byte {
+	data := make([]byte, 0)
+	for _, step := range steps {
+		frame := make([]byte, XTC_HEADER_BYTES)
+		binary.BigEndian.PutUint32(frame, XTC_MAGIC)
+		binary.BigEndian.PutUint32(frame[4:], uint32(atoms))
+		binary.BigEndian.PutUint32(frame[8:], uint32(step))
+		binary.BigEndian.PutUint32(frame[52:], uint32(atoms))
+		if atoms <= 9 {
+			frame = append(frame, make([]byte, 12*atoms)...)
+		} else {
+			compression := make([]byte, XTC_COMPRESSION_BYTES)
+			binary.BigEndian.PutUint32(compression[32:], 5)
+			frame = append(append(frame, compression...), make([]byte, 8)...)
+		}
+		data = append(data, frame...)
+	}
+	return data
+}
+
+func TestParseXTC(t *testing.T) {
+	frames, err := parseXTC(encodeXTC(3, 100, 200))
+	assert.Nil(t, err)
+	assert.Equal(t, frames, []xtcHeader{{Atoms: 3, Step: 100}, {Atoms: 3, Step: 200}})
+	frames, err = parseXTC(encodeXTC(2000, 0, 10, 20))
+	assert.Nil(t, err)
+	assert.Equal(t, len(frames), 3)
+
+	_, err = parseXTC(nil)
+	assert.NotNil(t, err)
+	data := encodeXTC(2000, 0, 10)
+	_, err = parseXTC(data[:len(data)-1])
+	assert.NotNil(t, err)
+	_, err = parseXTC(append(data, 0))
+	assert.NotNil(t, err)
+	_, err = parseXTC(encodeXTC(3, 10, 10))
+	assert.NotNil(t, err)
+	_, err = parseXTC(append(encodeXTC(3, 10), encodeXTC(4, 20)...))
+	assert.NotNil(t, err)
+	data = encodeXTC(3, 10)
+	binary.BigEndian.PutUint32(data, 1996)
+	_, err = parseXTC(data)
+	assert.NotNil(t, err)
+}
+
+func TestVerifyFrames(t *testing.T) {
+	app := &Application{optionsCache: NewResultCache(time.Minute)}
+	stream := newStream("stream", "target", "owner", 0, 0, 0)
+	stream.ActiveStream = &ActiveStream{Data: newSessionState()}
+	app.optionsCache.Put("options:target", map[string]interface{}{})
+	count, err := app.verifyFrames(stream, map[string][]byte{"frames.xtc": []byte("garbage")}, 25)
+	assert.Nil(t, err)
+	assert.Equal(t, count.frames, 0)
+	assert.Nil(t, app.verifyDonorFrames(stream, 100))
+
+	app.optionsCache.Put("options:target", map[string]interface{}{"verify_frames": true})
+	_, err = app.verifyFrames(stream, map[string][]byte{"frames.xtc": []byte("garbage")}, 1)
+	assert.NotNil(t, err)
+	_, err = app.verifyFrames(stream, map[string][]byte{"frames.xtc": encodeXTC(3, 1, 2)}, 25)
+	assert.NotNil(t, err)
+	gz, _ := gzipBytes(encodeXTC(3, 1, 2))
+	count, err = app.verifyFrames(stream, map[string][]byte{"frames.xtc.gz": gz, "log.txt": []byte("log")}, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, count, frameCount{frames: 2, steps: map[string]int{"frames.xtc": 2}})
+	stream.ActiveStream.BufferFrames += 1
+	sessionData(stream).addFrameCount(count)
+
+	// steps continue across frames
+	_, err = app.verifyFrames(stream, map[string][]byte{"frames.xtc": encodeXTC(3, 2, 3)}, 2)
+	assert.NotNil(t, err)
+	count, err = app.verifyFrames(stream, map[string][]byte{"frames.xtc": encodeXTC(3, 3)}, 1)
+	assert.Nil(t, err)
+	stream.ActiveStream.BufferFrames += 1
+	sessionData(stream).addFrameCount(count)
+	assert.Equal(t, sessionData(stream).xtcFrames, 3)
+
+	// one partial frame on top of the buffered ones
+	assert.Nil(t, app.verifyDonorFrames(stream, 3))
+	assert.Nil(t, app.verifyDonorFrames(stream, 3.5))
+	assert.NotNil(t, app.verifyDonorFrames(stream, 4))
+}